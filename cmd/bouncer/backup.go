@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// backupCmd writes a consistent copy of the local store to a file.
+func backupCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "backup <file>",
+		Short: "Write a consistent copy of the local store to a file",
+		Long: `Copy the STORAGE_BACKEND database in DATA_DIR to <file> ("-" for stdout).
+The copy is taken inside a single read transaction, so it is consistent even
+while bans are being written.
+
+Both backends can be backed up while the daemon runs. A running daemon holds
+an exclusive lock on bouncer.db, so with bbolt the copy is taken by the daemon
+itself and fetched from the /backup endpoint on HEALTH_ADDR, which only
+answers loopback clients: run the command on the daemon's host or inside its
+container. Redis is not supported; use the server's RDB or AOF persistence
+instead.
+
+Restore the file with the restore command.`,
+		Args: cobra.ExactArgs(1),
+	}
+	dataDir := dataDirFlag(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		var backup func(io.Writer) error
+		store, err := openStoreReadOnly(cfg, zerolog.Nop())
+		switch {
+		case errors.Is(err, storage.ErrStoreInUse):
+			backup = daemonBackup(cfg.HealthAddr)
+		case err != nil:
+			return err
+		default:
+			defer store.Close()
+			backup = store.Backup
+		}
+
+		if args[0] == "-" {
+			return backup(cmd.OutOrStdout())
+		}
+		n, err := writeBackupFile(backup, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "wrote %d bytes to %s\n", n, args[0])
+		return nil
+	}
+	return cmd
+}
+
+// daemonBackupTimeout bounds a backup fetched from the running daemon.
+const daemonBackupTimeout = 10 * time.Minute
+
+// daemonBackup returns a backup function that streams the copy the running
+// daemon takes of its store from the /backup endpoint on healthAddr.
+func daemonBackup(healthAddr string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		client := &http.Client{Timeout: daemonBackupTimeout}
+		resp, err := client.Get("http://" + healthAddr + "/backup")
+		if err != nil {
+			return fmt.Errorf("store is locked by the running daemon and its /backup endpoint is unreachable: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("daemon /backup returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+		}
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			return fmt.Errorf("read backup from daemon: %w", err)
+		}
+		return nil
+	}
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeBackupFile writes the output of backup to a temporary file beside path
+// and renames it into place, so an interrupted backup never leaves a truncated
+// file at path. It returns the size of the backup.
+func writeBackupFile(backup func(io.Writer) error, path string) (int64, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("create backup: %w", err)
+	}
+	tmp := f.Name()
+	defer func() { _ = os.Remove(tmp) }()
+
+	cw := &countingWriter{w: f}
+	if err := backup(cw); err != nil {
+		_ = f.Close()
+		return 0, fmt.Errorf("backup: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return 0, fmt.Errorf("sync backup: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("close backup: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, fmt.Errorf("install backup: %w", err)
+	}
+	return cw.n, nil
+}
+
+// restoreCmd swaps a backup file in as the local store.
+func restoreCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "Replace the local store with a backup file (daemon must be stopped)",
+		Long: `Validate <file> as a backup written by the backup command and swap it in as
+the STORAGE_BACKEND database in DATA_DIR. The replaced database is kept beside
+it with a .pre-restore suffix.
+
+The daemon must be stopped first. With bbolt a running daemon is detected and
+the restore is refused; SQLite cannot detect it, and restoring under a running
+daemon loses its writes or corrupts the database.`,
+		Args: cobra.ExactArgs(1),
+	}
+	dataDir := dataDirFlag(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		switch cfg.StorageBackend {
+		case "redis":
+			return fmt.Errorf("restore: %w", storage.ErrBackupUnsupported)
+		case "sqlite":
+			err = storage.RestoreSQLite(cfg.DataDir, args[0])
+		default:
+			err = storage.RestoreBbolt(cfg.DataDir, args[0])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "restored %s into %s\n", args[0], cfg.DataDir)
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+)
+
+// TestWriteBackupFile verifies that a backup is renamed into place only when
+// it completes, so a failed backup never replaces the previous file.
+func TestWriteBackupFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bouncer.bak")
+	store := testutil.NewMockStore()
+	_ = store.BanRecord("192.0.2.1", time.Time{}, false)
+
+	n, err := writeBackupFile(store.Backup, path)
+	if err != nil {
+		t.Fatalf("writeBackupFile: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || int64(len(data)) != n || n == 0 {
+		t.Fatalf("backup file = %d bytes (%v), reported %d", len(data), err, n)
+	}
+
+	store.SetError("Backup", errors.New("disk full"))
+	if _, err := writeBackupFile(store.Backup, path); err == nil {
+		t.Fatal("expected the injected error")
+	}
+	after, _ := os.ReadFile(path)
+	if string(after) != string(data) {
+		t.Error("failed backup replaced the previous file")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("failed backup left temporary files: %v", entries)
+	}
+}
+
+// TestDaemonBackup verifies that the backup is read from the daemon's
+// /backup endpoint and that an error status is reported, not saved.
+func TestDaemonBackup(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/backup" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("snapshot"))
+	}))
+	defer srv.Close()
+	backup := daemonBackup(strings.TrimPrefix(srv.URL, "http://"))
+
+	var buf bytes.Buffer
+	if err := backup(&buf); err != nil || buf.String() != "snapshot" {
+		t.Fatalf("backup = %q, %v; want the snapshot", buf.String(), err)
+	}
+
+	status = http.StatusForbidden
+	if err := backup(io.Discard); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("err = %v, want the 403 reported", err)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/logger"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+)
+
+// bundleRecentErrors caps the error/warning log lines copied into a bundle.
+const bundleRecentErrors = 50
+
+// debugBundle is the document written by debug-bundle. Every section is
+// best-effort: a section that cannot be collected records why in Errors
+// instead of failing the whole bundle.
+type debugBundle struct {
+	GeneratedAt   time.Time                   `json:"generated_at"`
+	Version       string                      `json:"version"`
+	Config        map[string]config.DumpEntry `json:"config"`
+	Store         *bundleStore                `json:"store"`
+	Shards        []bundleShard               `json:"shards"`
+	ReconcilePlan map[string]bundlePlan       `json:"reconcile_plan"`
+	RecentErrors  []string                    `json:"recent_errors"`
+	Controller    map[string]bundleSite       `json:"controller"`
+	Errors        map[string]string           `json:"errors,omitempty"` // section -> reason
+}
+
+type bundleStore struct {
+	Backend     string `json:"backend"`
+	BansActive  int    `json:"bans_active"`
+	BansExpired int    `json:"bans_expired"`
+	BansIPv6    int    `json:"bans_ipv6"`
+	Groups      int    `json:"groups"`
+	Policies    int    `json:"policies"`
+	SizeBytes   int64  `json:"size_bytes"`
+}
+
+// bundleShard is the member count of one stored group; names are kept, IPs
+// are not.
+type bundleShard struct {
+	Name      string    `json:"name"`
+	Site      string    `json:"site"`
+	IPv6      bool      `json:"ipv6"`
+	Members   int       `json:"members"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// bundlePlan is what the next reconcile of a site would change, derived from
+// the store: bans missing from the stored group members, and stored members
+// that are no longer banned.
+type bundlePlan struct {
+	WouldAdd    int `json:"would_add"`
+	WouldRemove int `json:"would_remove"`
+}
+
+type bundleSite struct {
+	Features map[string]bool `json:"features,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// debugBundleCmd writes a redacted JSON snapshot of configuration and state
+// for attaching to bug reports. It reads the store read-only and does not
+// need the daemon; the controller is probed unless --offline is given.
+func debugBundleCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "debug-bundle",
+		Short: "Write a redacted JSON bundle of config and state for bug reports",
+		Long: `Collect the effective configuration (secrets redacted), store statistics,
+shard distribution, the pending reconcile plan, recent errors from LOG_FILE and
+the controller's feature flags into one JSON document.
+
+The store is opened read-only, so this is safe while the daemon is running.
+Use --offline to skip the controller probe.`,
+		Args: cobra.NoArgs,
+	}
+	dataDir := dataDirFlag(cmd)
+	output := cmd.Flags().StringP("output", "o", "", "Write the bundle to this file instead of stdout")
+	offline := cmd.Flags().Bool("offline", false, "Do not contact the UniFi controller")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		bundle := newDebugBundle(cfg, time.Now())
+		if err := cfg.Validate(); err != nil {
+			bundle.Errors["config"] = err.Error()
+		}
+
+		if store, err := openStoreReadOnly(cfg, zerolog.Nop()); err != nil {
+			bundle.Errors["store"] = err.Error()
+		} else {
+			collectBundleStore(bundle, cfg, store, time.Now())
+			_ = store.Close()
+		}
+
+		if cfg.LogFile != "" {
+			lines, err := recentLogErrors(cfg.LogFile, bundleRecentErrors)
+			if err != nil {
+				bundle.Errors["recent_errors"] = err.Error()
+			}
+			bundle.RecentErrors = lines
+		}
+
+		if !*offline {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			ctrl, err := newControllerClient(ctx, cfg, zerolog.Nop())
+			if err != nil {
+				bundle.Errors["controller"] = err.Error()
+			} else {
+				collectBundleController(ctx, bundle, ctrl, cfg.UnifiSites)
+				_ = ctrl.Close()
+			}
+		}
+
+		out := io.Writer(os.Stdout)
+		if *output != "" {
+			f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return fmt.Errorf("create bundle: %w", err)
+			}
+			defer f.Close()
+			out = f
+		}
+		return writeDebugBundle(out, bundle, cfg)
+	}
+	return cmd
+}
+
+// newDebugBundle starts a bundle with the redacted configuration.
+func newDebugBundle(cfg *config.Config, now time.Time) *debugBundle {
+	return &debugBundle{
+		GeneratedAt:   now.UTC(),
+		Version:       Version,
+		Config:        cfg.Dump(),
+		Shards:        []bundleShard{},
+		ReconcilePlan: make(map[string]bundlePlan),
+		RecentErrors:  []string{},
+		Controller:    make(map[string]bundleSite),
+		Errors:        make(map[string]string),
+	}
+}
+
+// collectBundleStore fills the store, shard and reconcile plan sections.
+func collectBundleStore(b *debugBundle, cfg *config.Config, store storage.Store, now time.Time) {
+	bans, err := store.BanList()
+	if err != nil {
+		b.Errors["store"] = fmt.Sprintf("list bans: %v", err)
+		return
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		b.Errors["store"] = fmt.Sprintf("list groups: %v", err)
+		return
+	}
+	policies, err := store.ListPolicies()
+	if err != nil {
+		b.Errors["store"] = fmt.Sprintf("list policies: %v", err)
+		return
+	}
+	size, _ := store.SizeBytes()
+
+	st := &bundleStore{Backend: cfg.StorageBackend, Groups: len(groups), Policies: len(policies), SizeBytes: size}
+	for _, entry := range bans {
+		if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now) {
+			st.BansExpired++
+		} else {
+			st.BansActive++
+		}
+		if entry.IPv6 {
+			st.BansIPv6++
+		}
+	}
+	b.Store = st
+
+	members := make(map[string]map[string]bool, len(cfg.UnifiSites))
+	for name, rec := range groups {
+		b.Shards = append(b.Shards, bundleShard{
+			Name: name, Site: rec.Site, IPv6: rec.IPv6, Members: len(rec.Members), UpdatedAt: rec.UpdatedAt,
+		})
+		if members[rec.Site] == nil {
+			members[rec.Site] = make(map[string]bool)
+		}
+		for _, m := range rec.Members {
+			members[rec.Site][m] = true
+		}
+	}
+	sort.Slice(b.Shards, func(i, j int) bool { return b.Shards[i].Name < b.Shards[j].Name })
+
+	for _, site := range cfg.UnifiSites {
+		var plan bundlePlan
+		for ip := range bans {
+			if !members[site][ip] {
+				plan.WouldAdd++
+			}
+		}
+		for m := range members[site] {
+			if _, ok := bans[m]; !ok {
+				plan.WouldRemove++
+			}
+		}
+		b.ReconcilePlan[site] = plan
+	}
+}
+
+// collectBundleController records the controller's feature flags per site.
+func collectBundleController(ctx context.Context, b *debugBundle, ctrl controller.Controller, sites []string) {
+	if err := ctrl.Ping(ctx); err != nil {
+		b.Errors["controller"] = err.Error()
+		return
+	}
+	for _, site := range sites {
+		entry := bundleSite{Features: make(map[string]bool)}
+		for _, feature := range []string{controller.FeatureZoneBasedFirewall, controller.FeatureBulkFirewallGroups} {
+			ok, err := ctrl.HasFeature(ctx, site, feature)
+			if err != nil {
+				entry.Error = err.Error()
+				break
+			}
+			entry.Features[feature] = ok
+		}
+		b.Controller[site] = entry
+	}
+}
+
+// recentLogErrors returns the last max error or warning lines of the log file
+// at path, in either the JSON or the text format.
+func recentLogErrors(path string, max int) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return []string{}, fmt.Errorf("open log file: %w", err)
+	}
+	defer f.Close()
+
+	lines := []string{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.Contains(line, `"level":"error"`) || strings.Contains(line, `"level":"warn"`) ||
+			strings.Contains(line, " ERR ") || strings.Contains(line, " WRN ") {
+			lines = append(lines, line)
+			if len(lines) > max {
+				lines = lines[1:]
+			}
+		}
+	}
+	return lines, sc.Err()
+}
+
+// writeDebugBundle redacts b and encodes it as indented JSON. Configuration
+// is already masked by Dump; the free-text sections (log lines and error
+// messages) are passed through the log redaction patterns and have every
+// configured secret value masked, since credentials can leak into either.
+func writeDebugBundle(w io.Writer, b *debugBundle, cfg *config.Config) error {
+	extra, _ := logger.CompilePatterns(cfg.LogRedactPatterns)
+	var secrets []string
+	for _, s := range []string{
+		cfg.UnifiPassword, cfg.UnifiAPIKey, cfg.CrowdSecLAPIKey,
+		cfg.RedisURL, cfg.UnifiHTTPProxy, cfg.WebhookURL, cfg.WebhookSecret,
+	} {
+		if s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	redact := func(s string) string {
+		for _, secret := range secrets {
+			s = strings.ReplaceAll(s, secret, logger.Redacted)
+		}
+		return logger.RedactString(s, extra)
+	}
+
+	for i, line := range b.RecentErrors {
+		b.RecentErrors[i] = redact(line)
+	}
+	for section, msg := range b.Errors {
+		b.Errors[section] = redact(msg)
+	}
+	for site, entry := range b.Controller {
+		entry.Error = redact(entry.Error)
+		b.Controller[site] = entry
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(b); err != nil {
+		return fmt.Errorf("encode bundle: %w", err)
+	}
+	return nil
+}
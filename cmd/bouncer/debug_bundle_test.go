@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+)
+
+func bundleTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	logFile := filepath.Join(t.TempDir(), "bouncer.log")
+	lines := []string{
+		`{"level":"info","message":"started"}`,
+		`{"level":"error","message":"login failed for password hunter2-secret"}`,
+		`{"level":"warn","message":"lapi key lapi-key-0123456789abcdef rejected"}`,
+	}
+	if err := os.WriteFile(logFile, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatalf("write log: %v", err)
+	}
+	return &config.Config{
+		UnifiURL:        "https://unifi.example",
+		UnifiSites:      []string{"default"},
+		UnifiUsername:   "bouncer",
+		UnifiPassword:   "hunter2-secret",
+		UnifiAPIKey:     "unifi-api-key-0123456789",
+		CrowdSecLAPIKey: "lapi-key-0123456789abcdef",
+		WebhookSecret:   "webhook-signing-secret",
+		StorageBackend:  "bbolt",
+		LogFile:         logFile,
+	}
+}
+
+// TestDebugBundle_SectionsAndRedaction verifies that the bundle carries every
+// section and that no configured secret survives, including secrets that
+// appear in log lines or error messages.
+func TestDebugBundle_SectionsAndRedaction(t *testing.T) {
+	cfg := bundleTestConfig(t)
+	now := time.Now()
+
+	store := testutil.NewMockStore()
+	_ = store.BanRecord("192.0.2.1", now.Add(time.Hour), false)
+	_ = store.BanRecord("192.0.2.2", now.Add(-time.Hour), false)
+	_ = store.BanRecord("2001:db8::1", time.Time{}, true)
+	_ = store.SetGroup("crowdsec-block-v4-0", storage.GroupRecord{
+		UnifiID: "g1", Site: "default", Members: []string{"192.0.2.1", "198.51.100.9"},
+	})
+
+	ctrl := testutil.NewMockController()
+	ctrl.SetHasFeature("default", controller.FeatureZoneBasedFirewall, true)
+
+	b := newDebugBundle(cfg, now)
+	b.Errors["config"] = "UNIFI_PASSWORD hunter2-secret is invalid"
+	collectBundleStore(b, cfg, store, now)
+	collectBundleController(context.Background(), b, ctrl, cfg.UnifiSites)
+	lines, err := recentLogErrors(cfg.LogFile, bundleRecentErrors)
+	if err != nil {
+		t.Fatalf("recentLogErrors: %v", err)
+	}
+	b.RecentErrors = lines
+
+	var out bytes.Buffer
+	if err := writeDebugBundle(&out, b, cfg); err != nil {
+		t.Fatalf("writeDebugBundle: %v", err)
+	}
+
+	for _, secret := range []string{cfg.UnifiPassword, cfg.UnifiAPIKey, cfg.CrowdSecLAPIKey, cfg.WebhookSecret} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("bundle leaks secret %q:\n%s", secret, out.String())
+		}
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(out.Bytes(), &doc); err != nil {
+		t.Fatalf("bundle is not valid JSON: %v\n%s", err, out.String())
+	}
+	for _, section := range []string{"generated_at", "version", "config", "store", "shards", "reconcile_plan", "recent_errors", "controller", "errors"} {
+		if _, ok := doc[section]; !ok {
+			t.Errorf("bundle is missing section %q", section)
+		}
+	}
+
+	var decoded debugBundle
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("decode bundle: %v", err)
+	}
+	if decoded.Config["unifi_username"].Value != "bouncer" {
+		t.Errorf("config.unifi_username = %v, want bouncer", decoded.Config["unifi_username"].Value)
+	}
+	if s := decoded.Store; s == nil || s.BansActive != 2 || s.BansExpired != 1 || s.BansIPv6 != 1 || s.Groups != 1 {
+		t.Errorf("store section = %+v, want 2 active, 1 expired, 1 IPv6, 1 group", s)
+	}
+	if len(decoded.Shards) != 1 || decoded.Shards[0].Members != 2 {
+		t.Errorf("shards = %+v, want one shard with 2 members", decoded.Shards)
+	}
+	// 192.0.2.2 and 2001:db8::1 are banned but not in a group; 198.51.100.9
+	// is in a group but not banned.
+	if plan := decoded.ReconcilePlan["default"]; plan.WouldAdd != 2 || plan.WouldRemove != 1 {
+		t.Errorf("reconcile_plan[default] = %+v, want add=2 remove=1", plan)
+	}
+	if len(decoded.RecentErrors) != 2 {
+		t.Errorf("recent_errors = %v, want the error and warn lines", decoded.RecentErrors)
+	}
+	if site := decoded.Controller["default"]; !site.Features[controller.FeatureZoneBasedFirewall] {
+		t.Errorf("controller[default] = %+v, want zone firewall detected", site)
+	}
+}
+
+// TestDebugBundle_ControllerUnreachable verifies that a failed probe is
+// recorded in errors rather than failing the bundle.
+func TestDebugBundle_ControllerUnreachable(t *testing.T) {
+	cfg := bundleTestConfig(t)
+	ctrl := testutil.NewMockController()
+	ctrl.SetError("Ping", errors.New("connection refused"))
+
+	b := newDebugBundle(cfg, time.Now())
+	collectBundleController(context.Background(), b, ctrl, cfg.UnifiSites)
+	if b.Errors["controller"] != "connection refused" {
+		t.Errorf("errors.controller = %q, want the ping error", b.Errors["controller"])
+	}
+	if len(b.Controller) != 0 {
+		t.Errorf("controller section = %+v, want empty", b.Controller)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/bouncer"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/rs/zerolog"
+)
+
+// importBlocklist records every IP or CIDR in the file at path as a permanent
+// ban (IMPORT_BLOCKLIST_PATH) tagged with bouncer.ImportOrigin, so LAPI
+// deletes leave it alone. Imports are written to the store directly rather
+// than through the job handler, so they are never counted by the LAPI
+// usage-metrics reporter. The startup or periodic reconcile then adds them to
+// the firewall groups. In dry-run nothing is written.
+func importBlocklist(store storage.Store, path string, dryRun bool, log zerolog.Logger) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("open blocklist: %w", err)
+	}
+	defer f.Close()
+	return importBlocklistFrom(store, f, path, dryRun, log)
+}
+
+// importBlocklistFrom reads one entry per line from r. Blank lines and text
+// after '#' are ignored; invalid entries are skipped with a warning. Entries
+// imported before are left alone so restarts do not inflate the ban history;
+// any other ban of an entry is replaced by a permanent imported one.
+func importBlocklistFrom(store storage.Store, r io.Reader, path string, dryRun bool, log zerolog.Logger) (int, error) {
+	bans, err := store.BanList()
+	if err != nil {
+		return 0, fmt.Errorf("list bans: %w", err)
+	}
+
+	imported, skipped := 0, 0
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		value, _, err := decision.ParseAndSanitize(line)
+		if err != nil {
+			log.Warn().Err(err).Str("file", path).Int("line", lineNo).Msg("skipping invalid blocklist entry")
+			skipped++
+			continue
+		}
+		if entry, ok := bans[value]; ok && entry.ExpiresAt.IsZero() && entry.Origin == bouncer.ImportOrigin {
+			continue
+		}
+		if !dryRun {
+			if err := store.BanRecordOrigin(value, time.Time{}, decision.IsIPv6(value), bouncer.ImportOrigin); err != nil {
+				return imported, fmt.Errorf("record %s: %w", value, err)
+			}
+		}
+		bans[value] = storage.BanEntry{IPv6: decision.IsIPv6(value), Origin: bouncer.ImportOrigin}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return imported, fmt.Errorf("read blocklist: %w", err)
+	}
+
+	if dryRun {
+		log.Info().Str("file", path).Int("would_import", imported).Int("skipped", skipped).
+			Msg("[DRY-RUN] would import static blocklist")
+		return imported, nil
+	}
+	log.Info().Str("file", path).Str("origin", bouncer.ImportOrigin).Int("imported", imported).Int("skipped", skipped).
+		Msg("imported static blocklist")
+	return imported, nil
+}
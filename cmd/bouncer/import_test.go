@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/bouncer"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+// TestImportBlocklist verifies that valid entries become permanent bans,
+// invalid lines and comments are skipped, and a re-import leaves existing
+// permanent bans alone.
+func TestImportBlocklist(t *testing.T) {
+	store := testutil.NewMockStore()
+	_ = store.BanRecord("192.0.2.7", time.Now().Add(time.Hour), false)
+
+	const list = `# migrated from the old router
+192.0.2.1
+198.51.100.0/24   # scanner range
+2001:db8::1
+192.0.2.7
+not-an-ip
+
+10.0.0.1/32
+`
+	var logs strings.Builder
+	n, err := importBlocklistFrom(store, strings.NewReader(list), "blocklist.txt", false, zerolog.New(&logs))
+	if err != nil {
+		t.Fatalf("importBlocklistFrom: %v", err)
+	}
+	if n != 5 {
+		t.Errorf("imported = %d, want 5", n)
+	}
+	if !strings.Contains(logs.String(), `"line":6`) {
+		t.Errorf("invalid line not reported with its number: %s", logs.String())
+	}
+
+	bans, _ := store.BanList()
+	for _, ip := range []string{"192.0.2.1", "198.51.100.0/24", "2001:db8::1", "192.0.2.7", "10.0.0.1"} {
+		entry, ok := bans[ip]
+		if !ok {
+			t.Errorf("%s not banned", ip)
+			continue
+		}
+		if !entry.ExpiresAt.IsZero() {
+			t.Errorf("%s expires at %s, want a permanent ban", ip, entry.ExpiresAt)
+		}
+		if entry.Origin != bouncer.ImportOrigin {
+			t.Errorf("%s origin = %q, want %q", ip, entry.Origin, bouncer.ImportOrigin)
+		}
+	}
+	if !bans["2001:db8::1"].IPv6 || bans["192.0.2.1"].IPv6 {
+		t.Error("address family recorded incorrectly")
+	}
+
+	// A restart re-imports the same file without touching existing bans.
+	n, err = importBlocklistFrom(store, strings.NewReader(list), "blocklist.txt", false, zerolog.Nop())
+	if err != nil || n != 0 {
+		t.Errorf("re-import = %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestImportBlocklist_DryRun(t *testing.T) {
+	store := testutil.NewMockStore()
+	n, err := importBlocklistFrom(store, strings.NewReader("192.0.2.1\n198.51.100.0/24\n"), "blocklist.txt", true, zerolog.Nop())
+	if err != nil || n != 2 {
+		t.Fatalf("importBlocklistFrom = %d, %v; want 2, nil", n, err)
+	}
+	if bans, _ := store.BanList(); len(bans) != 0 {
+		t.Errorf("dry-run recorded %d ban(s)", len(bans))
+	}
+}
@@ -2,11 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand/v2"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/tabwriter"
 	"time"
@@ -15,12 +22,18 @@ import (
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/capabilities"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/geoip"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/lapi_metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/logger"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/tracing"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/webhook"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/whitelist"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 )
@@ -29,8 +42,8 @@ import (
 // Used when LAPI_METRICS_PUSH_INTERVAL=0 (reporting disabled).
 type nopRecorder struct{}
 
-func (nopRecorder) RecordBan(_, _ string) {}
-func (nopRecorder) RecordDeletion()       {}
+func (nopRecorder) RecordBan(_, _ string)   {}
+func (nopRecorder) RecordDeletion(_ string) {}
 
 // Version, Commit, and BuildDate are set by the build system via -ldflags.
 var (
@@ -50,15 +63,25 @@ func main() {
 		healthcheckCmd(),
 		versionCmd(),
 		reconcileCmd(),
+		verifyCmd(),
 		statusCmd(),
+		historyCmd(),
+		metricsCmd(),
 		drainCmd(),
+		enableCmd(),
 		validateCmd(),
 		diagnoseCmd(),
+		selftestCmd(),
+		configCmd(),
+		debugBundleCmd(),
+		backupCmd(),
+		restoreCmd(),
 	)
+	addOutputFlag(root)
 
 	if err := root.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+		printCommandError(os.Stdout, os.Stderr, err)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -73,16 +96,24 @@ func runCmd() *cobra.Command {
 	}
 }
 
+// shutdownFlushTimeout bounds the final flush of dirty shards on exit so an
+// unreachable controller cannot hang shutdown.
+const shutdownFlushTimeout = 10 * time.Second
+
 func runDaemon() error {
 	cfg, err := config.Load()
 	if err != nil {
 		return fmt.Errorf("load config: %w", err)
 	}
 
-	log := buildLogger(cfg)
+	log, closeLog := buildLogger(cfg)
+	defer closeLog()
 	for _, w := range cfg.DeprecationWarnings {
 		log.Warn().Msg(w)
 	}
+	for _, w := range cfg.Warnings {
+		log.Warn().Msg(w)
+	}
 	if w := cfg.InsecureLAPIURLWarning(); w != "" {
 		log.Warn().Str("url", cfg.CrowdSecLAPIURL).Msg(w)
 	}
@@ -95,28 +126,51 @@ func runDaemon() error {
 		Bool("appsec", capabilities.SupportsAppSec).
 		Msg("bouncer capabilities")
 
-	store, err := storage.NewBboltStore(cfg.DataDir, log)
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OtelEnabled, Version)
+	if err != nil {
+		return fmt.Errorf("init tracing: %w", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warn().Err(err).Msg("failed to flush traces on shutdown")
+		}
+	}()
+	if cfg.OtelEnabled {
+		log.Info().Msg("OpenTelemetry tracing enabled")
+	}
+
+	store, err := openStore(cfg, log)
+	var tooNew *storage.ErrSchemaTooNew
+	if errors.As(err, &tooNew) && cfg.StorageSchemaPolicy == "read-only" {
+		log.Warn().Int("stored", tooNew.Stored).Int("supported", tooNew.Supported).
+			Msg("store was written by a newer version; STORAGE_SCHEMA_POLICY=read-only, running in dry-run mode without store writes")
+		store, err = openStoreReadOnly(cfg, log)
+		cfg.DryRun, cfg.DryRunStoreOnly = true, false
+	}
 	if err != nil {
 		return fmt.Errorf("open storage: %w", err)
 	}
 	defer store.Close()
 
-	ctrl, err := controller.NewClient(context.Background(), controller.ClientConfig{
-		BaseURL:      cfg.UnifiURL,
-		Username:     cfg.UnifiUsername,
-		Password:     cfg.UnifiPassword,
-		APIKey:       cfg.UnifiAPIKey,
-		VerifyTLS:    cfg.UnifiVerifyTLS,
-		CACertPath:   cfg.UnifiCACert,
-		Timeout:      cfg.UnifiHTTPTimeout,
-		Debug:        cfg.UnifiAPIDebug,
-		ReauthMinGap: cfg.SessionReauthMinGap,
-		EnableIPv6:   cfg.EnableIPv6,
-	}, log)
+	if cfg.ImportBlocklistPath != "" && tooNew == nil {
+		if _, err := importBlocklist(store, cfg.ImportBlocklistPath, cfg.DryRun, log); err != nil {
+			return fmt.Errorf("import blocklist: %w", err)
+		}
+	}
+
+	ctrl, err := newControllerClient(context.Background(), cfg, log)
 	if err != nil {
 		return fmt.Errorf("init UniFi client: %w", err)
 	}
 	defer ctrl.Close()
+	ctrl = controller.NewRateLimitedController(ctrl, log)
+	ctrl, closeAudit, err := wrapAudit(cfg, ctrl, log)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
@@ -154,45 +208,22 @@ func runDaemon() error {
 		return err
 	}
 
+	// Spread the bootstrap and startup reconcile of bouncers that start
+	// together against one controller.
+	if delay := startupJitterDelay(cfg.StartupJitter); delay > 0 {
+		log.Info().Dur("delay", delay).Msg("waiting out startup jitter")
+		if err := sleepContext(ctx, delay); err != nil {
+			log.Info().Msg("shutdown requested during startup jitter")
+			return nil
+		}
+	}
+
 	// Bootstrap infrastructure
 	log.Info().Strs("sites", cfg.UnifiSites).Msg("ensuring firewall infrastructure")
 	if err := fwMgr.EnsureInfrastructure(ctx, cfg.UnifiSites); err != nil {
 		return fmt.Errorf("ensure infrastructure: %w", err)
 	}
 
-	// SIGHUP hot-reload: reload config and update zone pairs without restart.
-	sighup := make(chan os.Signal, 1)
-	signal.Notify(sighup, syscall.SIGHUP)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-sighup:
-				newCfg, err := config.Load()
-				if err != nil {
-					log.Warn().Err(err).Msg("SIGHUP: reload config failed")
-					continue
-				}
-				newPairs, err := newCfg.ParseZonePairs()
-				if err != nil {
-					log.Warn().Err(err).Msg("SIGHUP: parse zone pairs failed")
-					continue
-				}
-				zm := fwMgr.ZoneManager()
-				if zm == nil {
-					log.Warn().Msg("SIGHUP: ZoneManager not available (legacy mode?), skipping reload")
-					continue
-				}
-				if err := zm.Reload(ctx, newCfg.UnifiSites, newPairs); err != nil {
-					log.Warn().Err(err).Msg("SIGHUP: zone reload completed with errors")
-				} else {
-					log.Info().Msg("SIGHUP: zone pairs reloaded successfully")
-				}
-			}
-		}
-	}()
-
 	// Start Cloudflare whitelist sync if enabled
 	var cfManager *whitelist.Manager
 	if cfg.CloudflareWhitelistEnabled {
@@ -207,54 +238,112 @@ func runDaemon() error {
 		}
 	}
 
-	// Startup reconcile
+	// Construct LAPI usage-metrics reporter.
+	var recorder bouncer.MetricsRecorder
+	if cfg.LAPIMetricsPushInterval > 0 {
+		reporter := lapi_metrics.NewReporter(
+			cfg.CrowdSecLAPIURL, cfg.CrowdSecLAPIKey, Version,
+			cfg.LAPIMetricsPushInterval, log,
+		)
+		go reporter.Run(ctx)
+		recorder = reporter
+	} else {
+		recorder = nopRecorder{}
+	}
+
+	// Startup reconcile. /readyz waits for it to succeed without errors; if
+	// it does not, the first clean periodic reconcile marks the bouncer ready
+	// instead.
+	reconciled := !cfg.FirewallReconcileOnStart
 	if cfg.FirewallReconcileOnStart {
 		log.Info().Msg("running startup reconcile")
 		start := time.Now()
 		result, err := fwMgr.Reconcile(ctx, cfg.UnifiSites)
 		if err != nil {
 			log.Warn().Err(err).Msg("startup reconcile encountered errors")
+		} else {
+			for _, rErr := range result.Errors {
+				log.Warn().Err(rErr).Msg("startup reconcile error")
+			}
+			reconciled = reconcileClean(result)
 		}
 		elapsed := time.Since(start)
 		metrics.ReconcileDuration.WithLabelValues("startup").Observe(elapsed.Seconds())
 		if result != nil {
 			log.Info().Int("added", result.Added).Int("removed", result.Removed).
 				Dur("elapsed", result.Elapsed).Msg("startup reconcile complete")
+			recordReconcileRemovals(recorder, result, cfg.DryRun || cfg.DryRunStoreOnly)
 		}
 	}
 
-	// Construct LAPI usage-metrics reporter.
-	var recorder bouncer.MetricsRecorder
-	if cfg.LAPIMetricsPushInterval > 0 {
-		reporter := lapi_metrics.NewReporter(
-			cfg.CrowdSecLAPIURL, cfg.CrowdSecLAPIKey, Version,
-			cfg.LAPIMetricsPushInterval, log,
-		)
-		go reporter.Run(ctx)
-		recorder = reporter
-	} else {
-		recorder = nopRecorder{}
+	// Optional ban/unban event webhook.
+	var events bouncer.EventSink
+	if cfg.WebhookURL != "" {
+		notifier := webhook.NewNotifier(cfg.WebhookURL, cfg.WebhookSecret, cfg.WebhookTimeout, log)
+		go notifier.Run(ctx)
+		events = notifier
 	}
 
 	bouncer.BinaryVersion = Version
-	bnc, err := bouncer.New(cfg, ctrl, store, fwMgr, recorder, log)
+	bnc, err := bouncer.New(cfg, ctrl, store, fwMgr, recorder, events, log)
 	if err != nil {
 		return fmt.Errorf("build bouncer: %w", err)
 	}
+	if reconciled {
+		bnc.MarkReconciled()
+	}
+
+	// Start janitor. A read-only store cannot prune, so every sweep would fail.
+	if tooNew == nil {
+		janitor := bouncer.NewJanitor(store, fwMgr, recorder, cfg.UnifiSites, cfg.JanitorInterval, cfg.BanStoreMax,
+			cfg.JanitorBatchSize, log)
+		go func() {
+			if err := janitor.Run(ctx); err != nil {
+				log.Warn().Err(err).Msg("janitor exited")
+			}
+		}()
+	} else {
+		log.Info().Msg("store is read-only; janitor disabled")
+	}
+
+	// Start periodic reconcile. The goroutine always runs so that SIGHUP can
+	// enable it later; an interval of 0 leaves it idle.
+	reconcileIntervalCh := make(chan time.Duration, 1)
+	go runPeriodicReconcile(ctx, fwMgr, cfg.UnifiSites, cfg.FirewallReconcileInterval, reconcileIntervalCh,
+		func(result *firewall.ReconcileResult) {
+			if reconcileClean(result) {
+				bnc.MarkReconciled()
+			}
+			recordReconcileRemovals(recorder, result, cfg.DryRun || cfg.DryRunStoreOnly)
+		}, log)
+
+	// Re-detect controller capabilities so a firmware upgrade that adds or
+	// removes the zone firewall switches FIREWALL_MODE=auto sites over.
+	if cfg.CapabilityCheckInterval > 0 {
+		go runCapabilityChecks(ctx, fwMgr, cfg.UnifiSites, cfg.CapabilityCheckInterval, log)
+	}
 
-	// Start janitor
-	janitor := bouncer.NewJanitor(store, fwMgr, cfg.UnifiSites, cfg.JanitorInterval, log)
+	// SIGHUP hot-reload: re-read config and apply the runtime-safe subset.
+	// See config.reloadableKeys for the list of reloadable settings.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
 	go func() {
-		if err := janitor.Run(ctx); err != nil {
-			log.Warn().Err(err).Msg("janitor exited")
+		current := cfg
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+				next, err := config.Load()
+				if err != nil {
+					log.Warn().Err(err).Msg("SIGHUP: reload config failed")
+					continue
+				}
+				current = applyReload(ctx, current, next, bnc, fwMgr, reconcileIntervalCh, log)
+			}
 		}
 	}()
 
-	// Start periodic reconcile if configured
-	if cfg.FirewallReconcileInterval > 0 {
-		go runPeriodicReconcile(ctx, fwMgr, cfg.UnifiSites, cfg.FirewallReconcileInterval, log)
-	}
-
 	// Start periodic Cloudflare whitelist refresh if enabled
 	if cfManager != nil {
 		go func() {
@@ -275,10 +364,186 @@ func runDaemon() error {
 		}()
 	}
 
-	return bnc.Run(ctx)
+	runErr := bnc.Run(ctx)
+
+	// ctx is already cancelled here; flush bans applied since the last sync
+	// tick on a fresh, bounded context.
+	flushCtx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancel()
+	if err := fwMgr.Shutdown(flushCtx); err != nil {
+		log.Warn().Err(err).Msg("shutdown flush incomplete; remaining bans are restored by the next reconcile")
+	}
+	return runErr
+}
+
+// applyReload applies the reloadable settings from next and returns the config
+// that is now in effect. Settings that need a restart are logged and ignored.
+func applyReload(ctx context.Context, current, next *config.Config, bnc *bouncer.Bouncer,
+	fwMgr firewall.Manager, reconcileIntervalCh chan time.Duration, log zerolog.Logger) *config.Config {
+
+	if fields := current.RestartRequired(next); len(fields) > 0 {
+		log.Warn().Strs("fields", fields).Msg("SIGHUP: changed settings require restart; ignoring them")
+	}
+
+	applied := *current
+	if next.LogLevel != current.LogLevel {
+		if level, err := zerolog.ParseLevel(next.LogLevel); err == nil {
+			zerolog.SetGlobalLevel(level)
+			applied.LogLevel = next.LogLevel
+			log.Info().Str("level", next.LogLevel).Msg("SIGHUP: log level updated")
+		}
+	}
+
+	if err := bnc.ApplyReload(next); err != nil {
+		log.Warn().Err(err).Msg("SIGHUP: reload whitelist/sync interval failed")
+	} else {
+		applied.BlockWhitelist = next.BlockWhitelist
+		applied.SyncInterval = next.SyncInterval
+	}
+
+	if next.FirewallReconcileInterval != current.FirewallReconcileInterval {
+		select {
+		case <-reconcileIntervalCh:
+		default:
+		}
+		reconcileIntervalCh <- next.FirewallReconcileInterval
+		applied.FirewallReconcileInterval = next.FirewallReconcileInterval
+	}
+
+	if zm := fwMgr.ZoneManager(); zm != nil {
+		newPairs, err := next.ParseZonePairs()
+		if err != nil {
+			log.Warn().Err(err).Msg("SIGHUP: parse zone pairs failed")
+		} else if err := zm.Reload(ctx, current.UnifiSites, newPairs); err != nil {
+			log.Warn().Err(err).Msg("SIGHUP: zone reload completed with errors")
+		} else {
+			applied.ZonePairs = next.ZonePairs
+		}
+	}
+
+	log.Info().Msg("SIGHUP: configuration reloaded")
+	return &applied
+}
+
+// startupJitterDelay returns a random delay in [0, max); 0 when max <= 0.
+func startupJitterDelay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(max)))
+}
+
+// sleepContext waits for d or until ctx is done, returning ctx.Err() in the
+// latter case.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// runPeriodicReconcile reconciles all sites every interval. A new interval
+// received on updates resets the ticker; an interval of 0 pauses reconciles.
+// Each reconcile runs in its own goroutine; a tick that arrives while the
+// previous run is still in progress is skipped rather than queued, so slow
+// reconciles never overlap or run back-to-back. onSuccess, if non-nil, is
+// called with the result of each reconcile that returns no error.
+func runPeriodicReconcile(ctx context.Context, fwMgr firewall.Manager, sites []string,
+	interval time.Duration, updates <-chan time.Duration, onSuccess func(*firewall.ReconcileResult), log zerolog.Logger) {
+
+	var running atomic.Bool
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	setInterval := func(d time.Duration) {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, tick = nil, nil
+		}
+		if d > 0 {
+			ticker = time.NewTicker(d)
+			tick = ticker.C
+		}
+	}
+	setInterval(interval)
+	defer func() { setInterval(0) }()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-updates:
+			setInterval(d)
+			log.Info().Dur("interval", d).Msg("periodic reconcile interval updated")
+		case <-tick:
+			if !running.CompareAndSwap(false, true) {
+				metrics.ReconcileSkippedOverlap.Inc()
+				log.Warn().Msg("periodic reconcile skipped: previous run still in progress")
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer running.Store(false)
+				start := time.Now()
+				result, err := fwMgr.Reconcile(ctx, sites)
+				elapsed := time.Since(start)
+				metrics.ReconcileDuration.WithLabelValues("periodic").Observe(elapsed.Seconds())
+				if err != nil {
+					log.Warn().Err(err).Msg("periodic reconcile error")
+					return
+				}
+				if result != nil {
+					for _, rErr := range result.Errors {
+						log.Warn().Err(rErr).Msg("periodic reconcile error")
+					}
+					log.Info().Int("added", result.Added).Int("removed", result.Removed).
+						Int("errors", len(result.Errors)).Dur("elapsed", result.Elapsed).Msg("periodic reconcile complete")
+				}
+				if onSuccess != nil {
+					onSuccess(result)
+				}
+			}()
+		}
+	}
+}
+
+// reconcileClean reports whether a reconcile that returned no error also
+// finished every site without one, as /readyz requires.
+func reconcileClean(result *firewall.ReconcileResult) bool {
+	return result != nil && len(result.Errors) == 0
 }
 
-func runPeriodicReconcile(ctx context.Context, fwMgr firewall.Manager, sites []string, interval time.Duration, log zerolog.Logger) {
+// recordReconcileRemovals reports the members a reconcile took out of UniFi
+// as deletions, split into whitelisted IPs, aggregate churn and drift.
+// Removals are counted per site. A dry-run reconcile removes nothing and
+// records nothing.
+func recordReconcileRemovals(recorder bouncer.MetricsRecorder, result *firewall.ReconcileResult, dryRun bool) {
+	if result == nil || dryRun {
+		return
+	}
+	for i := 0; i < result.Whitelisted; i++ {
+		recorder.RecordDeletion(bouncer.UnbanWhitelisted)
+	}
+	for i := 0; i < result.Aggregated; i++ {
+		recorder.RecordDeletion(bouncer.UnbanAggregateChurn)
+	}
+	for i := result.Whitelisted + result.Aggregated; i < result.Removed; i++ {
+		recorder.RecordDeletion(bouncer.UnbanReconcileDrift)
+	}
+}
+
+// runCapabilityChecks calls fwMgr.CheckCapabilities every interval until ctx
+// is cancelled.
+func runCapabilityChecks(ctx context.Context, fwMgr firewall.Manager, sites []string,
+	interval time.Duration, log zerolog.Logger) {
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 	for {
@@ -286,15 +551,11 @@ func runPeriodicReconcile(ctx context.Context, fwMgr firewall.Manager, sites []s
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			start := time.Now()
-			result, err := fwMgr.Reconcile(ctx, sites)
-			elapsed := time.Since(start)
-			metrics.ReconcileDuration.WithLabelValues("periodic").Observe(elapsed.Seconds())
+			changed, err := fwMgr.CheckCapabilities(ctx, sites)
 			if err != nil {
-				log.Warn().Err(err).Msg("periodic reconcile error")
-			} else if result != nil {
-				log.Info().Int("added", result.Added).Int("removed", result.Removed).
-					Dur("elapsed", result.Elapsed).Msg("periodic reconcile complete")
+				log.Error().Err(err).Strs("sites", changed).Msg("capability check: mode switch incomplete")
+			} else if len(changed) > 0 {
+				log.Info().Strs("sites", changed).Msg("capability check: firewall mode switched")
 			}
 		}
 	}
@@ -334,6 +595,10 @@ func versionCmd() *cobra.Command {
 		Long:  "Print the version, commit hash, and build date, then exit 0.",
 		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
+			if jsonOutput() {
+				_ = writeJSON(os.Stdout, versionInfo{OK: true, Version: Version, Commit: Commit, BuildDate: BuildDate})
+				return
+			}
 			fmt.Printf("cs-unifi-bouncer-pro %s (commit: %s, built: %s)\n",
 				Version, Commit, BuildDate)
 		},
@@ -342,45 +607,53 @@ func versionCmd() *cobra.Command {
 
 // reconcileCmd runs a one-shot full reconcile.
 func reconcileCmd() *cobra.Command {
-	return &cobra.Command{
+	var failOnDrift bool
+	cmd := &cobra.Command{
 		Use:   "reconcile",
 		Short: "Run a one-shot full reconcile and exit",
+		Long: `Run a one-shot full reconcile and exit.
+
+With --fail-on-drift the command is usable as a health gate: it prints the
+per-site deltas and exits 2 when the firewall had drifted from the ban list
+(anything was added or removed), 1 on errors, and 0 when it was in sync.
+
+With --output=json the result is a single JSON object with the totals, a
+"drifted" flag and the per-site deltas; exit codes are unchanged.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			cfg, err := config.Load()
 			if err != nil {
 				return err
 			}
 
-			log := buildLogger(cfg)
+			log, closeLog := buildLogger(cfg)
+			defer closeLog()
 			for _, w := range cfg.DeprecationWarnings {
 				log.Warn().Msg(w)
 			}
+			for _, w := range cfg.Warnings {
+				log.Warn().Msg(w)
+			}
 
 			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
 
-			store, err := storage.NewBboltStore(cfg.DataDir, log)
+			store, err := openStore(cfg, log)
 			if err != nil {
 				return err
 			}
 			defer store.Close()
 
-			ctrl, err := controller.NewClient(ctx, controller.ClientConfig{
-				BaseURL:      cfg.UnifiURL,
-				Username:     cfg.UnifiUsername,
-				Password:     cfg.UnifiPassword,
-				APIKey:       cfg.UnifiAPIKey,
-				VerifyTLS:    cfg.UnifiVerifyTLS,
-				CACertPath:   cfg.UnifiCACert,
-				Timeout:      cfg.UnifiHTTPTimeout,
-				Debug:        cfg.UnifiAPIDebug,
-				ReauthMinGap: cfg.SessionReauthMinGap,
-				EnableIPv6:   cfg.EnableIPv6,
-			}, log)
+			ctrl, err := newControllerClient(ctx, cfg, log)
 			if err != nil {
 				return err
 			}
 			defer ctrl.Close()
+			ctrl = controller.NewRateLimitedController(ctrl, log)
+			ctrl, closeAudit, err := wrapAudit(cfg, ctrl, log)
+			if err != nil {
+				return err
+			}
+			defer closeAudit()
 
 			fwMgr, err := buildFWManager(ctx, cfg, ctrl, store, log)
 			if err != nil {
@@ -398,11 +671,81 @@ func reconcileCmd() *cobra.Command {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("reconcile complete: added=%d removed=%d elapsed=%s\n",
-				result.Added, result.Removed, result.Elapsed)
+			var failErr error
+			if failOnDrift && len(result.Errors) > 0 {
+				failErr = fmt.Errorf("reconcile finished with %d error(s): %w", len(result.Errors), errors.Join(result.Errors...))
+			}
+			if jsonOutput() {
+				if err := writeJSON(os.Stdout, newReconcileOutput(cfg.UnifiSites, result, cfg.DryRun, failErr)); err != nil {
+					return err
+				}
+				if failErr != nil {
+					return errReported
+				}
+			} else {
+				fmt.Printf("reconcile complete: added=%d removed=%d elapsed=%s\n",
+					result.Added, result.Removed, result.Elapsed)
+				if cfg.DryRun {
+					printReconcileDiff(os.Stdout, cfg.UnifiSites, result)
+				} else if failOnDrift {
+					printReconcileDeltas(os.Stdout, cfg.UnifiSites, result)
+				}
+				if failErr != nil {
+					return failErr
+				}
+			}
+			if failOnDrift && reconcileDrifted(result) {
+				return &exitCodeError{code: 2}
+			}
 			return nil
 		},
 	}
+	cmd.Flags().BoolVar(&failOnDrift, "fail-on-drift", false,
+		"Exit 2 if the reconcile added or removed anything, 1 on errors")
+	return cmd
+}
+
+// reconcileDrifted reports whether a reconcile found the firewall out of sync
+// with the ban list.
+func reconcileDrifted(result *firewall.ReconcileResult) bool {
+	return result.Added > 0 || result.Removed > 0
+}
+
+// printReconcileDeltas writes how many IPs a reconcile added and removed on
+// each site.
+func printReconcileDeltas(w io.Writer, sites []string, result *firewall.ReconcileResult) {
+	for _, site := range sites {
+		diff := result.Sites[site]
+		if diff == nil {
+			diff = &firewall.SiteReconcileDiff{}
+		}
+		fmt.Fprintf(w, "site %s: added=%d removed=%d\n", site, diff.Added, diff.Removed)
+	}
+}
+
+// printReconcileDiff writes the per-site IPs a dry-run reconcile would add
+// ("+") or remove ("-"). Each list is a sample; the number of IPs not shown
+// is printed when the site's diff exceeds it.
+func printReconcileDiff(w io.Writer, sites []string, result *firewall.ReconcileResult) {
+	for _, site := range sites {
+		diff := result.Sites[site]
+		if diff == nil {
+			continue
+		}
+		fmt.Fprintf(w, "[DRY-RUN] site %s: would_add=%d would_remove=%d\n", site, diff.Added, diff.Removed)
+		for _, ip := range diff.AddedIPs {
+			fmt.Fprintf(w, "  + %s\n", ip)
+		}
+		if more := diff.Added - len(diff.AddedIPs); more > 0 {
+			fmt.Fprintf(w, "  + ... %d more\n", more)
+		}
+		for _, ip := range diff.RemovedIPs {
+			fmt.Fprintf(w, "  - %s\n", ip)
+		}
+		if more := diff.Removed - len(diff.RemovedIPs); more > 0 {
+			fmt.Fprintf(w, "  - ... %d more\n", more)
+		}
+	}
 }
 
 // statusCmd prints a read-only summary of the bbolt database state.
@@ -416,18 +759,16 @@ func statusCmd() *cobra.Command {
 Opens the database in read-only mode — safe to run while the daemon is running.`,
 	}
 
-	defaultDataDir := os.Getenv("DATA_DIR")
-	if defaultDataDir == "" {
-		defaultDataDir = "/data"
-	}
-	var dataDir string
-	cmd.Flags().StringVar(&dataDir, "data-dir", defaultDataDir,
-		"Path to the data directory containing bouncer.db (env: DATA_DIR)")
+	dataDir := dataDirFlag(cmd)
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
-		store, err := storage.NewBboltStoreReadOnly(dataDir)
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		store, err := openStoreReadOnly(cfg, zerolog.Nop())
 		if err != nil {
-			return fmt.Errorf("open store (read-only): %w", err)
+			return err
 		}
 		defer store.Close()
 
@@ -483,6 +824,200 @@ Opens the database in read-only mode — safe to run while the daemon is running
 	return cmd
 }
 
+// historyCmd prints how often an IP has been banned.
+func historyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "history <ip>",
+		Short: "Print the ban history of an IP (no API calls)",
+		Long: `Print how many times an IP has been banned and when, as recorded in the store.
+History is kept for 90 days after the IP's most recent ban. Opens the
+database in read-only mode — safe to run while the daemon is running.`,
+		Args: cobra.ExactArgs(1),
+	}
+	dataDir := dataDirFlag(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ip, _, err := decision.ParseAndSanitize(args[0])
+		if err != nil {
+			return err
+		}
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		store, err := openStoreReadOnly(cfg, zerolog.Nop())
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		hist, err := store.GetBanHistory(ip)
+		if err != nil {
+			return fmt.Errorf("get ban history: %w", err)
+		}
+		banned, err := store.BanExists(ip)
+		if err != nil {
+			return fmt.Errorf("check ban: %w", err)
+		}
+		return printBanHistory(cmd.OutOrStdout(), ip, hist, banned)
+	}
+
+	return cmd
+}
+
+// printBanHistory writes the history of ip as FIELD/VALUE rows.
+func printBanHistory(out io.Writer, ip string, hist *storage.BanHistory, banned bool) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FIELD\tVALUE")
+	fmt.Fprintf(w, "ip\t%s\n", ip)
+	fmt.Fprintf(w, "currently_banned\t%t\n", banned)
+	if hist == nil {
+		fmt.Fprintf(w, "ban_count\t0\n")
+		return w.Flush()
+	}
+	fmt.Fprintf(w, "ban_count\t%d\n", hist.Count)
+	fmt.Fprintf(w, "first_banned\t%s\n", hist.FirstBanned.UTC().Format(time.RFC3339))
+	fmt.Fprintf(w, "last_banned\t%s\n", hist.LastBanned.UTC().Format(time.RFC3339))
+	return w.Flush()
+}
+
+// metricsCmdFamilies are the metric families printed by the metrics command.
+var metricsCmdFamilies = []string{
+	"crowdsec_unifi_active_bans",
+	"crowdsec_unifi_firewall_group_size",
+	"crowdsec_unifi_api_calls_total",
+}
+
+// metricsCmd prints the main gauges without starting the metrics server.
+func metricsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "metrics",
+		Short: "Print current ban and group gauges (no HTTP server, no API calls)",
+		Long: `Rebuild the active-ban and group-size gauges from the store, gather the
+Prometheus registry once and print the values as a table.
+
+Counters such as api_calls_total live in the daemon's memory and only cover
+this process, so they are printed for completeness but read as empty here.
+Opens the database in read-only mode — safe to run while the daemon is running.`,
+		Args: cobra.NoArgs,
+	}
+	dataDir := dataDirFlag(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := storageConfig(cmd, *dataDir)
+		if err != nil {
+			return err
+		}
+		store, err := openStoreReadOnly(cfg, zerolog.Nop())
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		if err := loadStoreGauges(store); err != nil {
+			return err
+		}
+		return printMetrics(cmd.OutOrStdout(), prometheus.DefaultGatherer, metricsCmdFamilies)
+	}
+
+	return cmd
+}
+
+// loadStoreGauges sets ActiveBans and FirewallGroupSize from the stored bans
+// and group records, the same sources the daemon uses.
+func loadStoreGauges(store storage.Store) error {
+	bans, err := store.BanList()
+	if err != nil {
+		return fmt.Errorf("list bans: %w", err)
+	}
+	groups, err := store.ListGroups()
+	if err != nil {
+		return fmt.Errorf("list groups: %w", err)
+	}
+
+	sites := make(map[string]bool)
+	for name, rec := range groups {
+		sites[rec.Site] = true
+		metrics.FirewallGroupSize.WithLabelValues(firewall.Family(rec.IPv6), name, rec.Site).Set(float64(len(rec.Members)))
+	}
+	if len(sites) == 0 {
+		sites["default"] = true
+	}
+
+	var v4Count, v6Count int
+	for _, entry := range bans {
+		if entry.IPv6 {
+			v6Count++
+		} else {
+			v4Count++
+		}
+	}
+	for site := range sites {
+		metrics.ActiveBans.WithLabelValues("v4", site).Set(float64(v4Count))
+		metrics.ActiveBans.WithLabelValues("v6", site).Set(float64(v6Count))
+	}
+	return nil
+}
+
+// printMetrics gathers g once and writes one METRIC/LABELS/VALUE row per
+// series of the named families. A family without series prints a single "-".
+func printMetrics(out io.Writer, g prometheus.Gatherer, names []string) error {
+	families, err := g.Gather()
+	if err != nil {
+		return fmt.Errorf("gather metrics: %w", err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, mf := range families {
+		byName[mf.GetName()] = mf
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "METRIC\tLABELS\tVALUE")
+	for _, name := range names {
+		mf := byName[name]
+		if mf == nil || len(mf.GetMetric()) == 0 {
+			fmt.Fprintf(w, "%s\t-\t-\n", name)
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make([]string, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels = append(labels, lp.GetName()+"="+lp.GetValue())
+			}
+			value := m.GetGauge().GetValue()
+			if mf.GetType() == dto.MetricType_COUNTER {
+				value = m.GetCounter().GetValue()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%g\n", name, strings.Join(labels, ","), value)
+		}
+	}
+	return w.Flush()
+}
+
+// dataDirFlag registers the --data-dir flag used by the read-only commands.
+func dataDirFlag(cmd *cobra.Command) *string {
+	defaultDataDir := os.Getenv("DATA_DIR")
+	if defaultDataDir == "" {
+		defaultDataDir = "/data"
+	}
+	return cmd.Flags().String("data-dir", defaultDataDir,
+		"Path to the data directory containing bouncer.db (env: DATA_DIR)")
+}
+
+// storageConfig loads the configuration for a command that only opens the
+// store, without validating the rest of it. An explicit --data-dir overrides
+// DATA_DIR.
+func storageConfig(cmd *cobra.Command, dataDir string) (*config.Config, error) {
+	cfg, err := config.LoadUnvalidated()
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	if cmd.Flags().Changed("data-dir") {
+		cfg.DataDir = dataDir
+	}
+	return cfg, nil
+}
+
 // drainCmd removes all managed firewall objects from UniFi and cleans up bbolt.
 func drainCmd() *cobra.Command {
 	cmd := &cobra.Command{
@@ -512,36 +1047,35 @@ Requires either --force or --dry-run for safety.`,
 			cfg.DryRun = true
 		}
 
-		log := buildLogger(cfg)
+		log, closeLog := buildLogger(cfg)
+		defer closeLog()
 		for _, w := range cfg.DeprecationWarnings {
 			log.Warn().Msg(w)
 		}
+		for _, w := range cfg.Warnings {
+			log.Warn().Msg(w)
+		}
 
 		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 		defer cancel()
 
-		store, err := storage.NewBboltStore(cfg.DataDir, log)
+		store, err := openStore(cfg, log)
 		if err != nil {
 			return fmt.Errorf("open storage: %w", err)
 		}
 		defer store.Close()
 
-		ctrl, err := controller.NewClient(ctx, controller.ClientConfig{
-			BaseURL:      cfg.UnifiURL,
-			Username:     cfg.UnifiUsername,
-			Password:     cfg.UnifiPassword,
-			APIKey:       cfg.UnifiAPIKey,
-			VerifyTLS:    cfg.UnifiVerifyTLS,
-			CACertPath:   cfg.UnifiCACert,
-			Timeout:      cfg.UnifiHTTPTimeout,
-			Debug:        cfg.UnifiAPIDebug,
-			ReauthMinGap: cfg.SessionReauthMinGap,
-			EnableIPv6:   cfg.EnableIPv6,
-		}, log)
+		ctrl, err := newControllerClient(ctx, cfg, log)
 		if err != nil {
 			return fmt.Errorf("init UniFi client: %w", err)
 		}
 		defer ctrl.Close()
+		ctrl = controller.NewRateLimitedController(ctrl, log)
+		ctrl, closeAudit, err := wrapAudit(cfg, ctrl, log)
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
 
 		fwMgr, err := buildFWManager(ctx, cfg, ctrl, store, log)
 		if err != nil {
@@ -567,6 +1101,85 @@ Requires either --force or --dry-run for safety.`,
 	return cmd
 }
 
+// enableCmd turns on the rules/policies created with FIREWALL_START_DISABLED.
+func enableCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "enable",
+		Short: "Enable all managed firewall rules/policies after a staged rollout",
+		Long: `Enables every managed firewall rule (legacy mode) or zone policy (zone
+mode), country blocks included, for every configured site. Use it once the
+objects created with FIREWALL_START_DISABLED=true have been verified.
+
+Unset FIREWALL_START_DISABLED before the daemon next starts; otherwise rules
+for shards it creates later start disabled again.`,
+	}
+
+	var dryRun bool
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log what would be enabled without making changes")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := config.Load()
+		if err != nil {
+			return fmt.Errorf("load config: %w", err)
+		}
+		if dryRun {
+			cfg.DryRun = true
+		}
+
+		log, closeLog := buildLogger(cfg)
+		defer closeLog()
+		for _, w := range cfg.DeprecationWarnings {
+			log.Warn().Msg(w)
+		}
+		for _, w := range cfg.Warnings {
+			log.Warn().Msg(w)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		store, err := openStore(cfg, log)
+		if err != nil {
+			return fmt.Errorf("open storage: %w", err)
+		}
+		defer store.Close()
+
+		ctrl, err := newControllerClient(ctx, cfg, log)
+		if err != nil {
+			return fmt.Errorf("init UniFi client: %w", err)
+		}
+		defer ctrl.Close()
+		ctrl = controller.NewRateLimitedController(ctrl, log)
+		ctrl, closeAudit, err := wrapAudit(cfg, ctrl, log)
+		if err != nil {
+			return err
+		}
+		defer closeAudit()
+
+		fwMgr, err := buildFWManager(ctx, cfg, ctrl, store, log)
+		if err != nil {
+			return err
+		}
+
+		// EnsureInfrastructure resolves each site's mode and creates any
+		// missing rules/policies, which EnableEnforcement then turns on.
+		log.Info().Strs("sites", cfg.UnifiSites).Msg("loading firewall infrastructure state")
+		if err := fwMgr.EnsureInfrastructure(ctx, cfg.UnifiSites); err != nil {
+			return fmt.Errorf("ensure infrastructure: %w", err)
+		}
+
+		n, err := fwMgr.EnableEnforcement(ctx, cfg.UnifiSites)
+		if err != nil {
+			return fmt.Errorf("enable: %w", err)
+		}
+
+		fmt.Printf("enabled %d rules/policies (dry_run=%v)\n", n, dryRun)
+		return nil
+	}
+
+	return cmd
+}
+
 // buildFWManager constructs a firewall.Manager from config, controller, store, and logger.
 // It does NOT call EnsureInfrastructure — callers do that themselves when needed.
 func buildFWManager(ctx context.Context, cfg *config.Config,
@@ -589,17 +1202,53 @@ func buildFWManager(ctx context.Context, cfg *config.Config,
 		return nil, fmt.Errorf("parse zone pairs: %w", err)
 	}
 
+	modeOverrides, err := cfg.ParseFirewallModeOverrides()
+	if err != nil {
+		return nil, fmt.Errorf("parse firewall mode overrides: %w", err)
+	}
+
+	whitelist, err := decision.ParseWhitelist(cfg.BlockWhitelist)
+	if err != nil {
+		return nil, fmt.Errorf("parse whitelist: %w", err)
+	}
+
+	var countrySource firewall.CountrySource
+	if len(cfg.BlockCountries) > 0 {
+		countrySource = geoip.NewProvider(cfg.BlockCountriesIPv4URL, cfg.BlockCountriesIPv6URL)
+	}
+
 	return firewall.NewManager(firewall.ManagerConfig{
 		FirewallMode:                cfg.FirewallMode,
+		ModeOverrides:               modeOverrides,
 		EnableIPv6:                  cfg.FirewallEnableIPv6,
 		GroupCapacityV4:             v4Cap,
 		GroupCapacityV6:             v6Cap,
-		DryRun:                      cfg.DryRun,
+		DryRun:                      cfg.DryRun || cfg.DryRunStoreOnly, // store-only: no UniFi writes from reconcile/flush/janitor
 		APIShardDelay:               cfg.FirewallAPIShardDelay,
+		NewShardSettle:              cfg.FirewallNewShardSettle,
+		KeepEmptyShards:             !cfg.FirewallPruneEmptyShards,
+		MaxShards:                   cfg.FirewallMaxShards,
 		FlushConcurrency:            cfg.FirewallFlushConcurrency,
 		CircuitBreakerThreshold:     cfg.CircuitBreakerThreshold,
 		CircuitBreakerResetInterval: cfg.CircuitBreakerResetInterval,
 		ShardMergeThreshold:         cfg.ShardMergeThreshold,
+		ImmediateFirstBlock:         cfg.FirewallImmediateFirstBlock,
+		ParallelFamilyEnsure:        cfg.FirewallParallelFamilyEnsure,
+		CIDRSubsumption:             cfg.FirewallCIDRSubsumption,
+		AggregateCIDR:               cfg.FirewallAggregateCIDR,
+		LogSampleRate:               cfg.FirewallLogSampleRate,
+		GroupNameCollision:          cfg.GroupNameCollision,
+		BufferEarlyDecisions:        cfg.BufferEarlyDecisions,
+		CompactStaleModes:           cfg.StorageCompactStaleModes,
+		ReconcileSiteConcurrency:    cfg.ReconcileSiteConcurrency,
+		BanListRetries:              cfg.ReconcileBanListRetries,
+		BanListRetryDelay:           cfg.ReconcileBanListRetryDelay,
+		FlushTimeout:                cfg.UnifiHTTPTimeout * time.Duration(cfg.UnifiMaxRetries+1), // every retry may use the full HTTP timeout
+		Whitelist:                   whitelist,
+
+		BlockCountries: cfg.BlockCountries,
+		CountrySource:  countrySource,
+
 		LegacyCfg: firewall.LegacyConfig{
 			RuleIndexStartV4: cfg.LegacyRuleIndexStartV4,
 			RuleIndexStartV6: cfg.LegacyRuleIndexStartV6,
@@ -609,16 +1258,34 @@ func buildFWManager(ctx context.Context, cfg *config.Config,
 			LogDrops:         cfg.FirewallLogDrops,
 			Description:      cfg.ObjectDescription,
 			APIWriteDelay:    cfg.FirewallAPIShardDelay,
+			CreateDisabled:   !cfg.LegacyRuleEnabled || cfg.FirewallStartDisabled,
+			EnforceEnabled:   cfg.FirewallEnforceEnabled,
 		},
 		ZoneCfg: firewall.ZoneConfig{
-			ZonePairs:     zonePairs,
-			Description:   cfg.ObjectDescription,
-			LogDrops:      cfg.FirewallLogDrops,
-			APIWriteDelay: cfg.FirewallAPIShardDelay,
+			ZonePairs:      zonePairs,
+			Description:    cfg.ObjectDescription,
+			LogDrops:       cfg.FirewallLogDrops,
+			BlockAction:    cfg.FirewallBlockAction,
+			APIWriteDelay:  cfg.FirewallAPIShardDelay,
+			CreateDisabled: !cfg.ZonePolicyEnabled || cfg.FirewallStartDisabled,
+			EnforceEnabled: cfg.FirewallEnforceEnabled,
 		},
 	}, ctrl, store, namer, log), nil
 }
 
+// wrapAudit decorates ctrl with the AUDIT_LOG_PATH audit log, appending to
+// the file. The returned func closes it; without a path ctrl is returned as is.
+func wrapAudit(cfg *config.Config, ctrl controller.Controller, log zerolog.Logger) (controller.Controller, func(), error) {
+	if cfg.AuditLogPath == "" {
+		return ctrl, func() {}, nil
+	}
+	f, err := os.OpenFile(cfg.AuditLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open audit log: %w", err)
+	}
+	return controller.NewAuditController(ctrl, f, log), func() { _ = f.Close() }, nil
+}
+
 // resolveCapacities determines effective v4/v6 group capacities from config,
 // applying the per-family overrides and falling back to the shared capacity.
 func resolveCapacities(cfg *config.Config) (v4Cap, v6Cap int) {
@@ -633,6 +1300,76 @@ func resolveCapacities(cfg *config.Config) (v4Cap, v6Cap int) {
 	return v4Cap, v6Cap
 }
 
+// openStore opens the persistence backend selected by STORAGE_BACKEND.
+func openStore(cfg *config.Config, log zerolog.Logger) (storage.Store, error) {
+	switch cfg.StorageBackend {
+	case "redis":
+		return storage.NewRedisStore(cfg.RedisURL, log)
+	case "sqlite":
+		return storage.NewSQLiteStore(cfg.DataDir, log)
+	}
+	return storage.NewBboltStore(cfg.DataDir, log)
+}
+
+// openStoreReadOnly opens the STORAGE_BACKEND store without checking or
+// stamping its schema version; every write fails with storage.ErrReadOnly.
+// It backs both the daemon's STORAGE_SCHEMA_POLICY=read-only mode and the
+// commands that only inspect the store.
+func openStoreReadOnly(cfg *config.Config, log zerolog.Logger) (storage.Store, error) {
+	var store storage.Store
+	var err error
+	switch cfg.StorageBackend {
+	case "redis":
+		store, err = storage.NewRedisStoreReadOnly(cfg.RedisURL, log)
+	case "sqlite":
+		store, err = storage.NewSQLiteStoreReadOnly(cfg.DataDir)
+	default:
+		store, err = storage.NewBboltStoreReadOnly(cfg.DataDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open store (read-only): %w", err)
+	}
+	return store, nil
+}
+
+// configCmd groups configuration inspection subcommands.
+func configCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the effective configuration",
+	}
+	cmd.AddCommand(dumpConfigCmd())
+	return cmd
+}
+
+// dumpConfigCmd prints the resolved configuration as JSON, one entry per
+// setting with its value and source (default, config_file, env, secret_file).
+// Settings the log redaction would mask are shown as "[REDACTED]". Exits 1
+// when validation fails, so it doubles as a config linter.
+func dumpConfigCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "dump",
+		Short: "Print the effective configuration as JSON with secrets redacted",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.LoadUnvalidated()
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(cfg.Dump()); err != nil {
+				return fmt.Errorf("encode config: %w", err)
+			}
+			if err := cfg.Validate(); err != nil {
+				fmt.Fprintf(os.Stderr, "config invalid: %v\n", err)
+				os.Exit(1)
+			}
+			return nil
+		},
+	}
+}
+
 // validateCmd loads and validates config without making any API calls.
 func validateCmd() *cobra.Command {
 	return &cobra.Command{
@@ -663,6 +1400,9 @@ No API calls are made — safe to run in CI without network access.`,
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
 			fmt.Fprintln(w, "FIELD\tVALUE")
 			fmt.Fprintf(w, "firewall_mode\t%s\n", cfg.FirewallMode)
+			if len(cfg.FirewallModeOverrides) > 0 {
+				fmt.Fprintf(w, "firewall_mode_overrides\t%s\n", strings.Join(cfg.FirewallModeOverrides, ", "))
+			}
 			fmt.Fprintf(w, "zone_pairs\t%s\n", pairStr)
 			fmt.Fprintf(w, "sites\t%s\n", strings.Join(cfg.UnifiSites, ", "))
 			fmt.Fprintf(w, "ban_ttl\t%s\n", cfg.BanTTL)
@@ -682,6 +1422,9 @@ No API calls are made — safe to run in CI without network access.`,
 			for _, warn := range cfg.DeprecationWarnings {
 				fmt.Fprintf(os.Stderr, "WARNING: %s\n", warn)
 			}
+			for _, warn := range cfg.Warnings {
+				fmt.Fprintf(os.Stderr, "WARNING: %s\n", warn)
+			}
 			if w2 := cfg.InsecureLAPIURLWarning(); w2 != "" {
 				fmt.Fprintf(os.Stderr, "WARNING: %s\n", w2)
 			}
@@ -760,17 +1503,7 @@ Exits 0 when all checks pass, 1 if any check fails.`,
 
 			// --- Phase 3: UniFi reachability ---
 			diagLog := zerolog.Nop()
-			ctrl, ctrlErr := controller.NewClient(ctx, controller.ClientConfig{
-				BaseURL:      cfg.UnifiURL,
-				Username:     cfg.UnifiUsername,
-				Password:     cfg.UnifiPassword,
-				APIKey:       cfg.UnifiAPIKey,
-				VerifyTLS:    cfg.UnifiVerifyTLS,
-				CACertPath:   cfg.UnifiCACert,
-				Timeout:      cfg.UnifiHTTPTimeout,
-				ReauthMinGap: cfg.SessionReauthMinGap,
-				EnableIPv6:   cfg.EnableIPv6,
-			}, diagLog)
+			ctrl, ctrlErr := newControllerClient(ctx, cfg, diagLog)
 			if ctrlErr != nil {
 				checks = append(checks, diagCheck{"unifi_reachable", "FAIL", ctrlErr.Error()})
 				allPass = false
@@ -789,9 +1522,14 @@ Exits 0 when all checks pass, 1 if any check fails.`,
 				checks = append(checks, diagCheck{"unifi_reachable", "PASS", cfg.UnifiURL + " ping ok"})
 			}
 
-			// --- Zone discovery (zone or auto mode) ---
-			if cfg.FirewallMode != "legacy" {
-				for _, site := range cfg.UnifiSites {
+			// --- Zone discovery (sites in zone or auto mode) ---
+			modeOverrides, _ := cfg.ParseFirewallModeOverrides()
+			for _, site := range cfg.UnifiSites {
+				mode := cfg.FirewallMode
+				if override, ok := modeOverrides[site]; ok {
+					mode = override
+				}
+				if mode != "legacy" {
 					zones, zoneErr := ctrl.DiscoverZones(ctx, site)
 					if zoneErr != nil {
 						checks = append(checks, diagCheck{
@@ -828,21 +1566,80 @@ func printDiagChecks(checks []diagCheck) {
 	_ = w.Flush()
 }
 
-// buildLogger constructs a zerolog.Logger based on config.
-func buildLogger(cfg *config.Config) zerolog.Logger {
+// newControllerClient connects to the UniFi controller configured in cfg.
+// Every command that talks to the controller goes through here, so a new
+// client option only has to be wired up once.
+func newControllerClient(ctx context.Context, cfg *config.Config, log zerolog.Logger) (controller.Controller, error) {
+	return controller.NewClient(ctx, controller.ClientConfig{
+		BaseURL:      cfg.UnifiURL,
+		Username:     cfg.UnifiUsername,
+		Password:     cfg.UnifiPassword,
+		APIKey:       cfg.UnifiAPIKey,
+		VerifyTLS:    cfg.UnifiVerifyTLS,
+		CACertPath:   cfg.UnifiCACert,
+		Timeout:      cfg.UnifiHTTPTimeout,
+		Debug:        cfg.UnifiAPIDebug,
+		DebugBodies:  cfg.UnifiAPIDebugBodies,
+		ReauthMinGap: cfg.SessionReauthMinGap,
+		MaxRetries:   cfg.UnifiMaxRetries,
+		EnableIPv6:   cfg.EnableIPv6,
+
+		SessionCookieCache: cfg.SessionCookieCache,
+		ReadConcurrency:    cfg.UnifiReadConcurrency,
+		TLSServerName:      cfg.UnifiTLSServerName,
+		HTTPProxy:          cfg.UnifiHTTPProxy,
+		FallbackURL:        cfg.UnifiURLFallback,
+		ClientCertPath:     cfg.UnifiClientCert,
+		ClientKeyPath:      cfg.UnifiClientKey,
+		ClockSkewThreshold: cfg.UnifiClockSkewThreshold,
+		FeatureCacheTTL:    cfg.UnifiFeatureCacheTTL,
+		UserAgent:          cfg.UnifiUserAgent,
+		Version:            Version,
+	}, log)
+}
+
+// buildLogger constructs a zerolog.Logger based on config. When LOG_FILE is set,
+// output goes to both stderr and a size-rotated file; both pass through the
+// redaction writer. The returned function closes the log file and should be
+// deferred by the caller.
+func buildLogger(cfg *config.Config) (zerolog.Logger, func()) {
 	level, err := zerolog.ParseLevel(cfg.LogLevel)
 	if err != nil {
 		level = zerolog.InfoLevel
 	}
 
-	var base zerolog.Logger
-	if cfg.LogFormat == "text" {
-		cw := zerolog.NewConsoleWriter()
-		cw.Out = logger.NewRedactWriter(os.Stderr)
-		base = zerolog.New(cw).Level(level).With().Timestamp().Logger()
-	} else {
-		redactWriter := logger.NewRedactWriter(os.Stderr)
-		base = zerolog.New(redactWriter).Level(level).With().Timestamp().Logger()
+	// The logger itself stays at trace; the effective level is zerolog's global
+	// level so that SIGHUP can change it for every derived logger at once.
+	zerolog.SetGlobalLevel(level)
+
+	// Patterns were validated by config.Validate.
+	extra, _ := logger.CompilePatterns(cfg.LogRedactPatterns)
+
+	var out io.Writer = logOutput(os.Stderr, cfg.LogFormat, false, extra)
+	closeLog := func() {}
+	if cfg.LogFile != "" {
+		file := logger.NewFileWriter(logger.FileConfig{
+			Path:       cfg.LogFile,
+			MaxSizeMB:  cfg.LogFileMaxSize,
+			MaxBackups: cfg.LogFileMaxBackups,
+			MaxAge:     cfg.LogFileMaxAge,
+		})
+		// Keep ANSI colour codes out of the log file; stderr keeps them.
+		out = zerolog.MultiLevelWriter(out, logOutput(file, cfg.LogFormat, true, extra))
+		closeLog = func() { _ = file.Close() }
+	}
+	return zerolog.New(out).Level(zerolog.TraceLevel).With().Timestamp().Logger(), closeLog
+}
+
+// logOutput wraps w in the redaction writer and, for LOG_FORMAT=text, a
+// console writer.
+func logOutput(w io.Writer, format string, noColor bool, extra []*regexp.Regexp) io.Writer {
+	redactWriter := logger.NewRedactWriterWithPatterns(w, extra)
+	if format != "text" {
+		return redactWriter
 	}
-	return base
+	cw := zerolog.NewConsoleWriter()
+	cw.Out = redactWriter
+	cw.NoColor = noColor
+	return cw
 }
@@ -2,12 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/bouncer"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 )
 
@@ -19,8 +35,10 @@ func buildRoot() *cobra.Command {
 	}
 	root.AddCommand(
 		runCmd(), healthcheckCmd(), versionCmd(), reconcileCmd(),
-		statusCmd(), drainCmd(), validateCmd(), diagnoseCmd(),
+		statusCmd(), metricsCmd(), drainCmd(), enableCmd(), validateCmd(), diagnoseCmd(),
+		selftestCmd(), configCmd(), debugBundleCmd(), backupCmd(), restoreCmd(),
 	)
+	addOutputFlag(root)
 	return root
 }
 
@@ -30,10 +48,10 @@ func TestRootSubcommands(t *testing.T) {
 
 	registered := make(map[string]bool)
 	for _, cmd := range root.Commands() {
-		registered[cmd.Use] = true
+		registered[cmd.Name()] = true
 	}
 
-	for _, want := range []string{"run", "version", "healthcheck", "reconcile", "status", "drain", "validate", "diagnose"} {
+	for _, want := range []string{"run", "version", "healthcheck", "reconcile", "status", "metrics", "drain", "enable", "validate", "diagnose", "selftest", "config", "debug-bundle", "backup", "restore"} {
 		if !registered[want] {
 			t.Errorf("subcommand %q not registered on root command", want)
 		}
@@ -86,6 +104,166 @@ func TestVersionOutput(t *testing.T) {
 	}
 }
 
+// captureStdout runs fn and returns what it wrote to os.Stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStdout := os.Stdout
+	os.Stdout = w
+	fn()
+	w.Close()
+	os.Stdout = oldStdout
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// TestVersionOutput_JSON verifies --output=json prints the version fields as
+// one JSON object.
+func TestVersionOutput_JSON(t *testing.T) {
+	Version, Commit, BuildDate = "1.2.3", "abc1234", "2025-01-01T00:00:00Z"
+	t.Cleanup(func() { outputFormat = "text" })
+
+	var execErr error
+	out := captureStdout(t, func() {
+		root := buildRoot()
+		root.SetArgs([]string{"version", "--output=json"})
+		execErr = root.Execute()
+	})
+	if execErr != nil {
+		t.Fatalf("version command returned error: %v", execErr)
+	}
+	var got versionInfo
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatalf("version output %q is not JSON: %v", out, err)
+	}
+	want := versionInfo{OK: true, Version: "1.2.3", Commit: "abc1234", BuildDate: "2025-01-01T00:00:00Z"}
+	if got != want {
+		t.Errorf("version JSON = %+v, want %+v", got, want)
+	}
+}
+
+// TestOutputFlag_RejectsUnknownFormat verifies that an unknown --output
+// value fails before the command runs.
+func TestOutputFlag_RejectsUnknownFormat(t *testing.T) {
+	t.Cleanup(func() { outputFormat = "text" })
+	root := buildRoot()
+	root.SetArgs([]string{"version", "--output=yaml"})
+	root.SetOut(io.Discard)
+	root.SetErr(io.Discard)
+	if err := root.Execute(); err == nil || !strings.Contains(err.Error(), "--output") {
+		t.Errorf("Execute error = %v, want --output format error", err)
+	}
+}
+
+// TestPrintCommandError verifies the text and JSON forms of a command
+// failure, and that an already reported failure is not printed again.
+func TestPrintCommandError(t *testing.T) {
+	t.Cleanup(func() { outputFormat = "text" })
+	var stdout, stderr bytes.Buffer
+
+	printCommandError(&stdout, &stderr, errors.New("boom"))
+	if stdout.Len() != 0 || stderr.String() != "error: boom\n" {
+		t.Errorf("text mode: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+
+	outputFormat = "json"
+	stderr.Reset()
+	printCommandError(&stdout, &stderr, errors.New("boom"))
+	if stderr.Len() != 0 || stdout.String() != `{"ok":false,"error":"boom"}`+"\n" {
+		t.Errorf("json mode: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+
+	stdout.Reset()
+	printCommandError(&stdout, &stderr, errReported)
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("reported error printed again: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+
+	printCommandError(&stdout, &stderr, &exitCodeError{code: 2})
+	if stdout.Len() != 0 || stderr.Len() != 0 {
+		t.Errorf("exit code error printed: stdout=%q stderr=%q", stdout.String(), stderr.String())
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	if got := exitCode(&exitCodeError{code: 2}); got != 2 {
+		t.Errorf("exitCode(exit 2) = %d, want 2", got)
+	}
+	if got := exitCode(errors.New("boom")); got != 1 {
+		t.Errorf("exitCode(plain error) = %d, want 1", got)
+	}
+}
+
+// TestNewReconcileOutput verifies the JSON reconcile result lists every
+// configured site and carries a failure.
+// TestLogOutput_NoColor verifies that text output keeps ANSI colour codes only
+// when asked to, so the log file stays plain while stderr is coloured.
+func TestLogOutput_NoColor(t *testing.T) {
+	line := []byte(`{"level":"warn","message":"hello"}` + "\n")
+	for _, noColor := range []bool{false, true} {
+		var buf bytes.Buffer
+		if _, err := logOutput(&buf, "text", noColor, nil).Write(line); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		if got := strings.Contains(buf.String(), "\x1b["); got == noColor {
+			t.Errorf("noColor=%v: colour codes present = %v in %q", noColor, got, buf.String())
+		}
+	}
+}
+
+// TestBuildLogger_ClosesLogFile verifies that LOG_FILE output is written
+// without colour codes and that the returned function closes the file.
+func TestBuildLogger_ClosesLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouncer.log")
+	cfg := &config.Config{LogLevel: "info", LogFormat: "text", LogFile: path, LogFileMaxSize: 1}
+	prev := zerolog.GlobalLevel()
+	t.Cleanup(func() { zerolog.SetGlobalLevel(prev) })
+	log, closeLog := buildLogger(cfg)
+	log.Info().Msg("written to file")
+	closeLog()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	if !strings.Contains(string(data), "written to file") {
+		t.Errorf("log file missing the message: %q", data)
+	}
+	if strings.Contains(string(data), "\x1b[") {
+		t.Errorf("log file contains colour codes: %q", data)
+	}
+}
+
+func TestNewReconcileOutput(t *testing.T) {
+	result := &firewall.ReconcileResult{
+		Added:   2,
+		Elapsed: 1500 * time.Millisecond,
+		Errors:  []error{errors.New("site branch: list groups failed")},
+		Sites: map[string]*firewall.SiteReconcileDiff{
+			"default": {Added: 2, AddedIPs: []string{"203.0.113.1", "203.0.113.2"}},
+		},
+	}
+	out := newReconcileOutput([]string{"default", "branch"}, result, false, errors.New("reconcile finished with 1 error(s)"))
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ok":false,"error":"reconcile finished with 1 error(s)","dry_run":false,"added":2,"removed":0,` +
+		`"whitelisted":0,"drifted":true,"elapsed_seconds":1.5,"errors":["site branch: list groups failed"],` +
+		`"sites":{"branch":{"added":0,"removed":0},"default":{"added":2,"removed":0,"added_ips":["203.0.113.1","203.0.113.2"]}}}`
+	if string(data) != want {
+		t.Errorf("reconcile JSON:\n%s\nwant:\n%s", data, want)
+	}
+}
+
 // TestRunDaemonMissingConfig verifies runDaemon returns an error (not panics)
 // when UNIFI_URL is not set.
 func TestRunDaemonMissingConfig(t *testing.T) {
@@ -110,3 +288,323 @@ func TestLoadMissingRequired(t *testing.T) {
 		t.Errorf("expected error message to mention UNIFI_URL; got: %v", err)
 	}
 }
+
+// deletionRecorder counts RecordDeletion calls by reason.
+type deletionRecorder struct {
+	nopRecorder
+	deletions map[string]int
+}
+
+func (r *deletionRecorder) RecordDeletion(reason string) { r.deletions[reason]++ }
+
+func TestRecordReconcileRemovals(t *testing.T) {
+	result := &firewall.ReconcileResult{Removed: 6, Whitelisted: 1, Aggregated: 3}
+
+	rec := &deletionRecorder{deletions: make(map[string]int)}
+	recordReconcileRemovals(rec, result, false)
+	want := map[string]int{bouncer.UnbanWhitelisted: 1, bouncer.UnbanAggregateChurn: 3, bouncer.UnbanReconcileDrift: 2}
+	if !reflect.DeepEqual(rec.deletions, want) {
+		t.Errorf("deletions = %v, want %v", rec.deletions, want)
+	}
+
+	rec = &deletionRecorder{deletions: make(map[string]int)}
+	recordReconcileRemovals(rec, result, true)
+	if len(rec.deletions) != 0 {
+		t.Errorf("dry-run deletions = %v, want none", rec.deletions)
+	}
+}
+
+// TestStorageConfig verifies that the read-only commands take the backend from
+// the config and let an explicit --data-dir override DATA_DIR.
+func TestStorageConfig(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "sqlite")
+	t.Setenv("DATA_DIR", "/from-env")
+
+	cmd := &cobra.Command{}
+	dataDir := dataDirFlag(cmd)
+	cfg, err := storageConfig(cmd, *dataDir)
+	if err != nil {
+		t.Fatalf("storageConfig: %v", err)
+	}
+	if cfg.StorageBackend != "sqlite" || cfg.DataDir != "/from-env" {
+		t.Errorf("backend=%q data dir=%q, want sqlite and /from-env", cfg.StorageBackend, cfg.DataDir)
+	}
+
+	if err := cmd.Flags().Set("data-dir", "/from-flag"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err = storageConfig(cmd, *dataDir); err != nil {
+		t.Fatalf("storageConfig: %v", err)
+	}
+	if cfg.DataDir != "/from-flag" {
+		t.Errorf("data dir = %q, want /from-flag", cfg.DataDir)
+	}
+}
+
+// blockingReconciler is a firewall.Manager whose Reconcile blocks until
+// release is closed. Only Reconcile is implemented.
+type blockingReconciler struct {
+	firewall.Manager
+	calls   atomic.Int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingReconciler) Reconcile(ctx context.Context, _ []string) (*firewall.ReconcileResult, error) {
+	if b.calls.Add(1) == 1 {
+		close(b.started)
+	}
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+	}
+	return &firewall.ReconcileResult{}, nil
+}
+
+// TestRunPeriodicReconcile_SkipsOverlap verifies that ticks arriving while a
+// reconcile is still running are skipped and counted, and that reconciles
+// resume once the slow run finishes.
+func TestRunPeriodicReconcile_SkipsOverlap(t *testing.T) {
+	fwMgr := &blockingReconciler{started: make(chan struct{}), release: make(chan struct{})}
+	skippedBefore := promtestutil.ToFloat64(metrics.ReconcileSkippedOverlap)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runPeriodicReconcile(ctx, fwMgr, []string{"default"}, 5*time.Millisecond,
+			make(chan time.Duration), nil, zerolog.Nop())
+	}()
+
+	select {
+	case <-fwMgr.started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first reconcile did not start")
+	}
+	time.Sleep(50 * time.Millisecond) // several ticks while the first run blocks
+
+	if got := fwMgr.calls.Load(); got != 1 {
+		t.Fatalf("Reconcile calls while first run in progress: got %d, want 1", got)
+	}
+	if skipped := promtestutil.ToFloat64(metrics.ReconcileSkippedOverlap) - skippedBefore; skipped < 1 {
+		t.Errorf("expected reconcile_skipped_overlap_total to increase, got +%v", skipped)
+	}
+
+	close(fwMgr.release)
+	deadline := time.Now().Add(2 * time.Second)
+	for fwMgr.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := fwMgr.calls.Load(); got < 2 {
+		t.Errorf("reconcile did not resume after the slow run finished (calls=%d)", got)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("runPeriodicReconcile did not return after cancel")
+	}
+}
+
+// TestReconcileClean verifies that a reconcile with per-site errors does not
+// count as the clean reconcile /readyz waits for.
+func TestReconcileClean(t *testing.T) {
+	if reconcileClean(nil) {
+		t.Error("nil result counted as clean")
+	}
+	if !reconcileClean(&firewall.ReconcileResult{}) {
+		t.Error("result without errors not counted as clean")
+	}
+	if reconcileClean(&firewall.ReconcileResult{Errors: []error{errors.New("site default: list groups: timeout")}}) {
+		t.Error("result with errors counted as clean")
+	}
+}
+
+func TestStartupJitterDelay(t *testing.T) {
+	if got := startupJitterDelay(0); got != 0 {
+		t.Errorf("startupJitterDelay(0) = %s, want 0", got)
+	}
+	for i := 0; i < 100; i++ {
+		if got := startupJitterDelay(time.Second); got < 0 || got >= time.Second {
+			t.Fatalf("startupJitterDelay(1s) = %s, want [0, 1s)", got)
+		}
+	}
+}
+
+// TestSleepContext_Cancelled verifies that a SIGTERM during the startup
+// jitter ends the wait promptly.
+func TestSleepContext_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	if err := sleepContext(ctx, time.Hour); err == nil {
+		t.Fatal("expected context error")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("sleepContext returned after %s; want prompt return on cancel", elapsed)
+	}
+	if err := sleepContext(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("sleepContext without cancel: %v", err)
+	}
+}
+
+// TestWrapAudit_AppendsToFile verifies that AUDIT_LOG_PATH is opened in append
+// mode and that the controller is returned unwrapped without it.
+func TestWrapAudit_AppendsToFile(t *testing.T) {
+	mock := testutil.NewMockController()
+	cfg := &config.Config{}
+	if ctrl, closeAudit, err := wrapAudit(cfg, mock, zerolog.Nop()); err != nil || ctrl != controller.Controller(mock) {
+		t.Fatalf("wrapAudit without a path: got %T, %v; want the client unchanged", ctrl, err)
+	} else {
+		closeAudit()
+	}
+
+	cfg.AuditLogPath = filepath.Join(t.TempDir(), "audit.jsonl")
+	for run := 0; run < 2; run++ {
+		ctrl, closeAudit, err := wrapAudit(cfg, mock, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("wrapAudit: %v", err)
+		}
+		if err := ctrl.DeleteFirewallRule(context.Background(), "default", "rule-1"); err != nil {
+			t.Fatalf("DeleteFirewallRule: %v", err)
+		}
+		closeAudit()
+	}
+
+	data, err := os.ReadFile(cfg.AuditLogPath)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("audit log has %d lines, want 2 (one per run):\n%s", lines, data)
+	}
+}
+
+// TestPrintReconcileDiff verifies the dry-run diff lists IPs per site and
+// reports how many were left out of the sample.
+func TestPrintReconcileDiff(t *testing.T) {
+	result := &firewall.ReconcileResult{
+		Sites: map[string]*firewall.SiteReconcileDiff{
+			"default": {Added: 3, AddedIPs: []string{"203.0.113.1", "203.0.113.2"}},
+			"branch":  {Removed: 1, RemovedIPs: []string{"198.51.100.7"}},
+		},
+	}
+	var buf bytes.Buffer
+	printReconcileDiff(&buf, []string{"default", "branch"}, result)
+
+	want := "[DRY-RUN] site default: would_add=3 would_remove=0\n" +
+		"  + 203.0.113.1\n" +
+		"  + 203.0.113.2\n" +
+		"  + ... 1 more\n" +
+		"[DRY-RUN] site branch: would_add=0 would_remove=1\n" +
+		"  - 198.51.100.7\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printReconcileDiff output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+// TestReconcileDeltas verifies the --fail-on-drift output and drift check:
+// every configured site gets a line, including sites with no changes.
+func TestReconcileDeltas(t *testing.T) {
+	result := &firewall.ReconcileResult{
+		Added: 2,
+		Sites: map[string]*firewall.SiteReconcileDiff{
+			"default": {Added: 2, AddedIPs: []string{"203.0.113.1", "203.0.113.2"}},
+		},
+	}
+	var buf bytes.Buffer
+	printReconcileDeltas(&buf, []string{"default", "branch"}, result)
+
+	want := "site default: added=2 removed=0\n" +
+		"site branch: added=0 removed=0\n"
+	if got := buf.String(); got != want {
+		t.Errorf("printReconcileDeltas output:\n%s\nwant:\n%s", got, want)
+	}
+	if !reconcileDrifted(result) {
+		t.Error("reconcileDrifted = false for a reconcile that added IPs")
+	}
+	if reconcileDrifted(&firewall.ReconcileResult{}) {
+		t.Error("reconcileDrifted = true for an in-sync reconcile")
+	}
+}
+
+func TestPrintBanHistory(t *testing.T) {
+	first := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	hist := &storage.BanHistory{Count: 4, FirstBanned: first, LastBanned: first.Add(48 * time.Hour)}
+
+	var buf bytes.Buffer
+	if err := printBanHistory(&buf, "203.0.113.9", hist, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip                203.0.113.9",
+		"currently_banned  true",
+		"ban_count         4",
+		"first_banned      2026-01-02T03:04:05Z",
+		"last_banned       2026-01-04T03:04:05Z",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := printBanHistory(&buf, "203.0.113.10", nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "ban_count         0") || strings.Contains(buf.String(), "first_banned") {
+		t.Errorf("unexpected output for IP without history:\n%s", buf.String())
+	}
+}
+
+func TestPrintMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	bans := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_active_bans"}, []string{"family", "site"})
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_api_calls_total"}, []string{"endpoint"})
+	reg.MustRegister(bans, calls)
+	bans.WithLabelValues("v4", "default").Set(12)
+	calls.WithLabelValues("groups").Add(3)
+
+	var buf bytes.Buffer
+	if err := printMetrics(&buf, reg, []string{"test_active_bans", "test_api_calls_total", "test_missing"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"test_active_bans      family=v4,site=default  12",
+		"test_api_calls_total  endpoint=groups         3",
+		"test_missing          -                       -",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestLoadStoreGauges(t *testing.T) {
+	store, err := storage.NewBboltStore(t.TempDir(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.BanRecord("203.0.113.1", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetGroup("metrics-cmd-v4-0", storage.GroupRecord{Site: "metrics-site", Members: []string{"203.0.113.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadStoreGauges(store); err != nil {
+		t.Fatal(err)
+	}
+	if got := promtestutil.ToFloat64(metrics.ActiveBans.WithLabelValues("v4", "metrics-site")); got != 1 {
+		t.Errorf("active_bans{v4,metrics-site} = %v, want 1", got)
+	}
+	if got := promtestutil.ToFloat64(metrics.FirewallGroupSize.WithLabelValues("v4", "metrics-cmd-v4-0", "metrics-site")); got != 1 {
+		t.Errorf("firewall_group_size = %v, want 1", got)
+	}
+}
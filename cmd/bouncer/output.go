@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/spf13/cobra"
+)
+
+// outputFormat is the value of the global --output flag: "text" (default) or
+// "json".
+var outputFormat = "text"
+
+// errReported is returned by a command that has already written its failure,
+// as JSON or as a report table, so main exits 1 without printing it again.
+var errReported = errors.New("failure already reported")
+
+// exitCodeError is returned by a command whose result is already printed but
+// must exit with a status other than 1. Returning it instead of calling
+// os.Exit lets the command's deferred cleanup run.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// exitCode returns the process exit status for err returned by a command.
+func exitCode(err error) int {
+	var ec *exitCodeError
+	if errors.As(err, &ec) {
+		return ec.code
+	}
+	return 1
+}
+
+// addOutputFlag registers the global --output flag on root and rejects
+// unknown formats before any command runs.
+func addOutputFlag(root *cobra.Command) {
+	root.PersistentFlags().StringVar(&outputFormat, "output", "text",
+		"Output format for results and errors: text or json")
+	root.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if outputFormat != "text" && outputFormat != "json" {
+			return fmt.Errorf("--output must be text or json; got %q", outputFormat)
+		}
+		return nil
+	}
+}
+
+// jsonOutput reports whether --output=json was given.
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// writeJSON writes v to w as a single line of JSON.
+func writeJSON(w io.Writer, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// cliError is the JSON object written for a failed command.
+type cliError struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error"`
+}
+
+// printCommandError reports err from a failed command: as "error: ..." on
+// stderr, or with --output=json as {"ok":false,"error":"..."} on stdout so a
+// wrapper reads one stream for both outcomes.
+func printCommandError(stdout, stderr io.Writer, err error) {
+	if errors.Is(err, errReported) || errors.As(err, new(*exitCodeError)) {
+		return
+	}
+	if jsonOutput() {
+		_ = writeJSON(stdout, cliError{Error: err.Error()})
+		return
+	}
+	fmt.Fprintf(stderr, "error: %v\n", err)
+}
+
+// versionInfo is the JSON form of the version command.
+type versionInfo struct {
+	OK        bool   `json:"ok"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// reconcileSiteOutput is one site's entry in reconcileOutput. The IP lists
+// are samples; see firewall.SiteReconcileDiff.
+type reconcileSiteOutput struct {
+	Added      int      `json:"added"`
+	Removed    int      `json:"removed"`
+	AddedIPs   []string `json:"added_ips,omitempty"`
+	RemovedIPs []string `json:"removed_ips,omitempty"`
+}
+
+// reconcileOutput is the JSON form of the reconcile command.
+type reconcileOutput struct {
+	OK             bool                           `json:"ok"`
+	Error          string                         `json:"error,omitempty"`
+	DryRun         bool                           `json:"dry_run"`
+	Added          int                            `json:"added"`
+	Removed        int                            `json:"removed"`
+	Whitelisted    int                            `json:"whitelisted"`
+	Drifted        bool                           `json:"drifted"`
+	ElapsedSeconds float64                        `json:"elapsed_seconds"`
+	Errors         []string                       `json:"errors,omitempty"`
+	Sites          map[string]reconcileSiteOutput `json:"sites"`
+}
+
+// newReconcileOutput converts result for sites into its JSON form. failErr,
+// when non-nil, marks the reconcile as failed.
+func newReconcileOutput(sites []string, result *firewall.ReconcileResult, dryRun bool, failErr error) reconcileOutput {
+	out := reconcileOutput{
+		OK:             failErr == nil,
+		DryRun:         dryRun,
+		Added:          result.Added,
+		Removed:        result.Removed,
+		Whitelisted:    result.Whitelisted,
+		Drifted:        reconcileDrifted(result),
+		ElapsedSeconds: result.Elapsed.Seconds(),
+		Errors:         errorStrings(result.Errors),
+		Sites:          make(map[string]reconcileSiteOutput, len(sites)),
+	}
+	if failErr != nil {
+		out.Error = failErr.Error()
+	}
+	for _, site := range sites {
+		var s reconcileSiteOutput
+		if diff := result.Sites[site]; diff != nil {
+			s = reconcileSiteOutput{Added: diff.Added, Removed: diff.Removed,
+				AddedIPs: diff.AddedIPs, RemovedIPs: diff.RemovedIPs}
+		}
+		out.Sites[site] = s
+	}
+	return out
+}
+
+// verifyIssueOutput is one discrepancy in verifyOutput.
+type verifyIssueOutput struct {
+	Site   string `json:"site"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	ID     string `json:"id,omitempty"`
+	Detail string `json:"detail"`
+}
+
+// verifyOutput is the JSON form of the verify command.
+type verifyOutput struct {
+	OK         bool                `json:"ok"`
+	Error      string              `json:"error,omitempty"`
+	Consistent bool                `json:"consistent"`
+	Issues     []verifyIssueOutput `json:"issues"`
+	Errors     []string            `json:"errors,omitempty"`
+}
+
+// newVerifyOutput converts report into its JSON form. failErr, when non-nil,
+// marks the report as incomplete.
+func newVerifyOutput(report *firewall.VerifyReport, failErr error) verifyOutput {
+	out := verifyOutput{
+		OK:         failErr == nil,
+		Consistent: len(report.Issues) == 0 && len(report.Errors) == 0,
+		Issues:     make([]verifyIssueOutput, 0, len(report.Issues)),
+		Errors:     errorStrings(report.Errors),
+	}
+	if failErr != nil {
+		out.Error = failErr.Error()
+	}
+	for _, issue := range report.Issues {
+		out.Issues = append(out.Issues, verifyIssueOutput{
+			Site: issue.Site, Kind: issue.Kind, Name: issue.Name, ID: issue.ID, Detail: issue.Detail,
+		})
+	}
+	return out
+}
+
+// selftestCheckOutput is one capability in selftestOutput.
+type selftestCheckOutput struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// selftestOutput is the JSON form of the selftest command.
+type selftestOutput struct {
+	OK     bool                  `json:"ok"`
+	Site   string                `json:"site"`
+	Mode   string                `json:"mode"`
+	Checks []selftestCheckOutput `json:"checks"`
+}
+
+// newSelftestOutput converts the checks run against site into their JSON form.
+func newSelftestOutput(site, mode string, checks []diagCheck) selftestOutput {
+	out := selftestOutput{
+		OK:     !selftestFailed(checks),
+		Site:   site,
+		Mode:   mode,
+		Checks: make([]selftestCheckOutput, 0, len(checks)),
+	}
+	for _, c := range checks {
+		out.Checks = append(out.Checks, selftestCheckOutput{Name: c.name, Status: c.status, Detail: c.detail})
+	}
+	return out
+}
+
+// errorStrings returns the messages of errs.
+func errorStrings(errs []error) []string {
+	if len(errs) == 0 {
+		return nil
+	}
+	out := make([]string, len(errs))
+	for i, err := range errs {
+		out[i] = strings.TrimSpace(err.Error())
+	}
+	return out
+}
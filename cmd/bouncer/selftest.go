@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/spf13/cobra"
+)
+
+// selftestAddress is the member of the throwaway group: TEST-NET-1, which is
+// never routed, and the group's rule or policy is created disabled anyway.
+const selftestAddress = "192.0.2.1"
+
+// selftestCleanupTimeout bounds the deletes of the throwaway objects, which run
+// on a fresh context so an interrupted selftest still cleans up.
+const selftestCleanupTimeout = 30 * time.Second
+
+// errNoObjectID reports a create the controller answered with success but
+// without the new object's ID, as some read-only keys do.
+var errNoObjectID = errors.New("controller returned no object ID")
+
+// selftestDescription marks the throwaway objects in the controller UI in case
+// cleanup fails.
+const selftestDescription = "crowdsec-unifi-bouncer selftest; safe to delete"
+
+// selftestCmd creates and deletes throwaway firewall objects to confirm the
+// configured credentials may write everything the daemon will.
+func selftestCmd() *cobra.Command {
+	var site string
+	cmd := &cobra.Command{
+		Use:   "selftest",
+		Short: "Create and delete throwaway firewall objects to check controller permissions",
+		Long: `Exercise the controller API with the configured credentials before enforcing.
+For one site it creates a throwaway address group, a disabled rule (legacy
+mode) or zone policy (zone mode) referencing it, rewrites the zone pair's
+policy ordering unchanged, and deletes everything again. Each capability is
+reported as PASS, FAIL or SKIP, so a read-only API key shows up here instead
+of as failed flushes once the daemon runs.
+
+The group holds only 192.0.2.1 (TEST-NET-1) and the rule or policy is never
+enabled, so traffic is not affected. If a delete fails, the object's name and
+ID are reported so it can be removed by hand.
+
+Exits 0 when every check passes and 1 otherwise.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load()
+			if err != nil {
+				return err
+			}
+			log, closeLog := buildLogger(cfg)
+			defer closeLog()
+			if site == "" {
+				site = cfg.UnifiSites[0]
+			}
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			ctrl, err := newControllerClient(ctx, cfg, log)
+			if err != nil {
+				return err
+			}
+			defer ctrl.Close()
+
+			mode, err := selftestMode(ctx, ctrl, cfg, site)
+			if err != nil {
+				return err
+			}
+			pairs, err := cfg.ParseZonePairs()
+			if err != nil {
+				return err
+			}
+			stcfg := selftestConfig{
+				Site:           site,
+				Mode:           mode,
+				Pairs:          pairs,
+				RuleIndexStart: cfg.LegacyRuleIndexStartV4,
+				Name:           fmt.Sprintf("crowdsec-selftest-%d", time.Now().Unix()),
+			}
+			if mode == "legacy" {
+				lm := firewall.NewLegacyManager(firewall.LegacyConfig{
+					RulesetV4: cfg.LegacyRulesetV4,
+					RulesetV6: cfg.LegacyRulesetV6,
+				}, nil, ctrl, nil, log)
+				if err := lm.ResolveRulesets(ctx, site); err != nil {
+					return err
+				}
+				stcfg.Ruleset = lm.Ruleset(site, false)
+			}
+			return reportSelftest(site, mode, runSelftest(ctx, ctrl, stcfg))
+		},
+	}
+	cmd.Flags().StringVar(&site, "site", "", "Site to test (default: the first UNIFI_SITES entry)")
+	return cmd
+}
+
+// selftestMode resolves the firewall mode for site the way the daemon does:
+// a per-site override wins over FIREWALL_MODE, and "auto" asks the controller.
+func selftestMode(ctx context.Context, ctrl controller.Controller, cfg *config.Config, site string) (string, error) {
+	mode := cfg.FirewallMode
+	overrides, err := cfg.ParseFirewallModeOverrides()
+	if err != nil {
+		return "", err
+	}
+	if override, ok := overrides[site]; ok {
+		mode = override
+	}
+	if mode != "auto" {
+		return mode, nil
+	}
+	hasZone, err := ctrl.HasFeature(ctx, site, controller.FeatureZoneBasedFirewall)
+	if err != nil {
+		return "", fmt.Errorf("detect firewall mode for site %s: %w", site, err)
+	}
+	if hasZone {
+		return "zone", nil
+	}
+	return "legacy", nil
+}
+
+// selftestConfig holds the inputs of runSelftest.
+type selftestConfig struct {
+	Site           string
+	Mode           string // "legacy" or "zone"
+	Pairs          []config.ZonePair
+	Ruleset        string // resolved IPv4 legacy ruleset
+	RuleIndexStart int    // the throwaway rule goes above this and every existing rule
+	Name           string // name of every throwaway object
+}
+
+// runSelftest creates a throwaway group and a disabled rule or zone policy
+// referencing it, writes the zone pair's policy ordering back unchanged, and
+// deletes what it created. It returns one check per capability: groups,
+// rules (legacy) or zone_policies and reorder (zone).
+func runSelftest(ctx context.Context, ctrl controller.Controller, cfg selftestConfig) []diagCheck {
+	if cfg.Mode == "zone" {
+		return runZoneSelftest(ctx, ctrl, cfg)
+	}
+	return runLegacySelftest(ctx, ctrl, cfg)
+}
+
+func runLegacySelftest(ctx context.Context, ctrl controller.Controller, cfg selftestConfig) []diagCheck {
+	group, err := ctrl.CreateFirewallGroup(ctx, cfg.Site, controller.FirewallGroup{
+		Name:         cfg.Name,
+		GroupType:    "address-group",
+		GroupMembers: []string{selftestAddress},
+	})
+	if err = created(err, group.ID); err != nil {
+		return []diagCheck{
+			{"groups", "FAIL", "create group: " + err.Error()},
+			{"rules", "SKIP", "needs a group"},
+		}
+	}
+
+	rules := selftestRule(ctx, ctrl, cfg, group.ID)
+
+	groups := diagCheck{"groups", "PASS", "created and deleted group " + cfg.Name}
+	if err := cleanup(func(ctx context.Context) error { return ctrl.DeleteFirewallGroup(ctx, cfg.Site, group.ID) }); err != nil {
+		groups = diagCheck{"groups", "FAIL", leftoverDetail("group", cfg.Name, group.ID, err)}
+	}
+	return []diagCheck{groups, rules}
+}
+
+// selftestRule creates a disabled rule in cfg.Ruleset that drops groupID,
+// at an index no existing rule of the ruleset uses, and deletes it again.
+func selftestRule(ctx context.Context, ctrl controller.Controller, cfg selftestConfig, groupID string) diagCheck {
+	existing, err := ctrl.ListFirewallRules(ctx, cfg.Site)
+	if err != nil {
+		return diagCheck{"rules", "FAIL", "list rules: " + err.Error()}
+	}
+	rule, err := ctrl.CreateFirewallRule(ctx, cfg.Site, controller.FirewallRule{
+		Name:                cfg.Name,
+		Enabled:             false,
+		RuleIndex:           selftestRuleIndex(existing, cfg.Ruleset, cfg.RuleIndexStart),
+		Action:              "drop",
+		Ruleset:             cfg.Ruleset,
+		Description:         selftestDescription,
+		Protocol:            "all",
+		SrcFirewallGroupIDs: []string{groupID},
+	})
+	if err = created(err, rule.ID); err != nil {
+		return diagCheck{"rules", "FAIL", "create rule in " + cfg.Ruleset + ": " + err.Error()}
+	}
+	if err := cleanup(func(ctx context.Context) error { return ctrl.DeleteFirewallRule(ctx, cfg.Site, rule.ID) }); err != nil {
+		return diagCheck{"rules", "FAIL", leftoverDetail("rule", cfg.Name, rule.ID, err)}
+	}
+	return diagCheck{"rules", "PASS", "created and deleted disabled rule " + cfg.Name + " in " + cfg.Ruleset}
+}
+
+// selftestRuleIndex returns an index above start and above every rule in
+// ruleset, so the throwaway rule collides with neither user rules nor the
+// bouncer's own.
+func selftestRuleIndex(rules []controller.FirewallRule, ruleset string, start int) int {
+	index := start
+	for _, r := range rules {
+		if r.Ruleset == ruleset && r.RuleIndex >= index {
+			index = r.RuleIndex + 1
+		}
+	}
+	return index
+}
+
+func runZoneSelftest(ctx context.Context, ctrl controller.Controller, cfg selftestConfig) []diagCheck {
+	list, err := ctrl.CreateTrafficMatchingList(ctx, cfg.Site, controller.TrafficMatchingList{
+		Name:      cfg.Name,
+		Type:      "IPV4_ADDRESSES",
+		GroupType: "address-group",
+		Items:     []controller.TrafficMatchingListItem{{Type: "IP_ADDRESS", Value: selftestAddress}},
+	})
+	if err = created(err, list.ID); err != nil {
+		return []diagCheck{
+			{"groups", "FAIL", "create traffic matching list: " + err.Error()},
+			{"zone_policies", "SKIP", "needs a group"},
+			{"reorder", "SKIP", "needs a policy"},
+		}
+	}
+
+	policies, reorder := selftestZonePolicy(ctx, ctrl, cfg, list.ID)
+
+	groups := diagCheck{"groups", "PASS", "created and deleted traffic matching list " + cfg.Name}
+	if err := cleanup(func(ctx context.Context) error { return ctrl.DeleteTrafficMatchingList(ctx, cfg.Site, list.ID) }); err != nil {
+		groups = diagCheck{"groups", "FAIL", leftoverDetail("traffic matching list", cfg.Name, list.ID, err)}
+	}
+	return []diagCheck{groups, policies, reorder}
+}
+
+// selftestZonePolicy creates a disabled policy for the first zone pair that
+// blocks listID, writes the pair's ordering back unchanged, and deletes the
+// policy. It returns the zone_policies and reorder checks.
+func selftestZonePolicy(ctx context.Context, ctrl controller.Controller, cfg selftestConfig, listID string) (diagCheck, diagCheck) {
+	if len(cfg.Pairs) == 0 {
+		return diagCheck{"zone_policies", "SKIP", "no ZONE_PAIRS configured"},
+			diagCheck{"reorder", "SKIP", "no ZONE_PAIRS configured"}
+	}
+	pair := cfg.Pairs[0]
+	label := pair.Src + "->" + pair.Dst
+	zoneIDs := make([]string, 2)
+	for i, zone := range []string{pair.Src, pair.Dst} {
+		id, err := ctrl.GetZoneID(ctx, cfg.Site, zone)
+		if err != nil {
+			return diagCheck{"zone_policies", "FAIL", "resolve zone " + zone + ": " + err.Error()},
+				diagCheck{"reorder", "SKIP", "needs a policy"}
+		}
+		zoneIDs[i] = id
+	}
+	return selftestPolicyForPair(ctx, ctrl, cfg, listID, label, zoneIDs[0], zoneIDs[1])
+}
+
+func selftestPolicyForPair(ctx context.Context, ctrl controller.Controller, cfg selftestConfig, listID, label, srcID, dstID string) (diagCheck, diagCheck) {
+	policy, err := ctrl.CreateZonePolicy(ctx, cfg.Site, controller.ZonePolicy{
+		Name:                   cfg.Name,
+		Enabled:                false,
+		Action:                 "BLOCK",
+		Description:            selftestDescription,
+		SrcZone:                srcID,
+		DstZone:                dstID,
+		IPVersion:              "IPV4",
+		TrafficMatchingListIDs: []string{listID},
+	})
+	if err = created(err, policy.ID); err != nil {
+		return diagCheck{"zone_policies", "FAIL", "create policy " + label + ": " + err.Error()},
+			diagCheck{"reorder", "SKIP", "needs a policy"}
+	}
+
+	reorder := diagCheck{"reorder", "PASS", "rewrote policy ordering for " + label}
+	if ordering, err := ctrl.GetPolicyOrdering(ctx, cfg.Site, srcID, dstID); err != nil {
+		reorder = diagCheck{"reorder", "FAIL", "get policy ordering " + label + ": " + err.Error()}
+	} else if err := ctrl.SetPolicyOrdering(ctx, cfg.Site, srcID, dstID, ordering); err != nil {
+		reorder = diagCheck{"reorder", "FAIL", "set policy ordering " + label + ": " + err.Error()}
+	}
+
+	policies := diagCheck{"zone_policies", "PASS", "created and deleted disabled policy " + cfg.Name + " for " + label}
+	if err := cleanup(func(ctx context.Context) error { return ctrl.DeleteZonePolicy(ctx, cfg.Site, policy.ID) }); err != nil {
+		policies = diagCheck{"zone_policies", "FAIL", leftoverDetail("policy", cfg.Name, policy.ID, err)}
+	}
+	return policies, reorder
+}
+
+// created returns the error of a create call, or errNoObjectID when it
+// succeeded without returning the new object's ID.
+func created(err error, id string) error {
+	if err == nil && id == "" {
+		return errNoObjectID
+	}
+	return err
+}
+
+// cleanup runs del on a fresh context bounded by selftestCleanupTimeout, so
+// the throwaway objects are removed even once the command was interrupted.
+func cleanup(del func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), selftestCleanupTimeout)
+	defer cancel()
+	return del(ctx)
+}
+
+// leftoverDetail describes a throwaway object that could not be deleted.
+func leftoverDetail(kind, name, id string, err error) string {
+	return fmt.Sprintf("delete %s: %v; remove %s (id %s) by hand", kind, err, name, id)
+}
+
+// reportSelftest prints checks as a table, or as JSON with --output=json, and
+// returns errReported when any failed. Returning instead of exiting lets the
+// command's deferred cleanup close the session and LOG_FILE.
+func reportSelftest(site, mode string, checks []diagCheck) error {
+	failed := selftestFailed(checks)
+	if jsonOutput() {
+		if err := writeJSON(os.Stdout, newSelftestOutput(site, mode, checks)); err != nil {
+			return err
+		}
+	} else {
+		printDiagChecks(checks)
+	}
+	if failed {
+		return errReported
+	}
+	return nil
+}
+
+// selftestFailed reports whether any check failed.
+func selftestFailed(checks []diagCheck) bool {
+	for _, c := range checks {
+		if c.status == "FAIL" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+)
+
+// checkStatuses maps each check name to its status.
+func checkStatuses(checks []diagCheck) map[string]string {
+	out := make(map[string]string, len(checks))
+	for _, c := range checks {
+		out[c.name] = c.status
+	}
+	return out
+}
+
+func TestRunSelftest_Legacy(t *testing.T) {
+	ctx := context.Background()
+	ctrl := testutil.NewMockController()
+	checks := runSelftest(ctx, ctrl, selftestConfig{Site: "default", Mode: "legacy", Ruleset: "WAN_IN", RuleIndexStart: 22000, Name: "crowdsec-selftest-1"})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "PASS" || got["rules"] != "PASS" || len(got) != 2 {
+		t.Fatalf("checks = %+v, want groups and rules PASS", checks)
+	}
+	groups, _ := ctrl.ListFirewallGroups(ctx, "default")
+	rules, _ := ctrl.ListFirewallRules(ctx, "default")
+	if len(groups) != 0 || len(rules) != 0 {
+		t.Errorf("left behind %d group(s) and %d rule(s)", len(groups), len(rules))
+	}
+	if selftestFailed(checks) {
+		t.Error("selftestFailed = true for passing checks")
+	}
+}
+
+// TestRunSelftest_LegacyRuleDenied verifies that a refused rule create is a
+// FAIL and that the group is still cleaned up.
+func TestRunSelftest_LegacyRuleDenied(t *testing.T) {
+	ctx := context.Background()
+	ctrl := testutil.NewMockController()
+	ctrl.SetError("CreateFirewallRule", &controller.ErrUnauthorized{Msg: "HTTP 403 forbidden"})
+	checks := runSelftest(ctx, ctrl, selftestConfig{Site: "default", Mode: "legacy", Name: "crowdsec-selftest-1"})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "PASS" || got["rules"] != "FAIL" {
+		t.Fatalf("checks = %+v, want groups PASS, rules FAIL", checks)
+	}
+	if groups, _ := ctrl.ListFirewallGroups(ctx, "default"); len(groups) != 0 {
+		t.Errorf("left behind %d group(s)", len(groups))
+	}
+	if !selftestFailed(checks) {
+		t.Error("selftestFailed = false with a failed check")
+	}
+}
+
+// noIDController answers group creates with success but no ID.
+type noIDController struct {
+	*testutil.MockController
+}
+
+func (c noIDController) CreateFirewallGroup(ctx context.Context, site string, g controller.FirewallGroup) (controller.FirewallGroup, error) {
+	return controller.FirewallGroup{Name: g.Name}, nil
+}
+
+func TestRunSelftest_EmptyCreatedID(t *testing.T) {
+	checks := runSelftest(context.Background(), noIDController{testutil.NewMockController()},
+		selftestConfig{Site: "default", Mode: "legacy", Ruleset: "WAN_IN", Name: "crowdsec-selftest-1"})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "FAIL" || got["rules"] != "SKIP" {
+		t.Errorf("checks = %+v, want groups FAIL and rules SKIP", checks)
+	}
+}
+
+func TestSelftestRuleIndex(t *testing.T) {
+	rules := []controller.FirewallRule{
+		{Ruleset: "WAN_IN", RuleIndex: 22003},
+		{Ruleset: "WAN_IN", RuleIndex: 2000},
+		{Ruleset: "WAN_LOCAL", RuleIndex: 22050},
+	}
+	if got := selftestRuleIndex(rules, "WAN_IN", 22000); got != 22004 {
+		t.Errorf("index = %d, want 22004", got)
+	}
+	if got := selftestRuleIndex(rules, "WANv6_IN", 22000); got != 22000 {
+		t.Errorf("index on empty ruleset = %d, want 22000", got)
+	}
+}
+
+func TestRunSelftest_GroupDenied(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetError("CreateTrafficMatchingList", &controller.ErrUnauthorized{Msg: "HTTP 403 forbidden"})
+	checks := runSelftest(context.Background(), ctrl, selftestConfig{Site: "default", Mode: "zone", Name: "crowdsec-selftest-1"})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "FAIL" || got["zone_policies"] != "SKIP" || got["reorder"] != "SKIP" {
+		t.Errorf("checks = %+v, want groups FAIL and the rest SKIP", checks)
+	}
+	if ctrl.Calls("CreateZonePolicy") != 0 {
+		t.Error("policy created without a group")
+	}
+}
+
+func TestRunSelftest_Zone(t *testing.T) {
+	ctx := context.Background()
+	ctrl := testutil.NewMockController()
+	ctrl.SetZones("default", []controller.Zone{{ID: "z-ext", Name: "External"}, {ID: "z-int", Name: "Internal"}})
+	checks := runSelftest(ctx, ctrl, selftestConfig{
+		Site:  "default",
+		Mode:  "zone",
+		Pairs: []config.ZonePair{{Src: "External", Dst: "Internal"}},
+		Name:  "crowdsec-selftest-1",
+	})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "PASS" || got["zone_policies"] != "PASS" || got["reorder"] != "PASS" {
+		t.Fatalf("checks = %+v, want all PASS", checks)
+	}
+	if ctrl.Calls("SetPolicyOrdering") != 1 {
+		t.Errorf("SetPolicyOrdering calls = %d, want 1", ctrl.Calls("SetPolicyOrdering"))
+	}
+	policies, _ := ctrl.ListZonePolicies(ctx, "default")
+	lists, _ := ctrl.ListTrafficMatchingLists(ctx, "default")
+	if len(policies) != 0 || len(lists) != 0 {
+		t.Errorf("left behind %d policy(ies) and %d list(s)", len(policies), len(lists))
+	}
+
+	out := newSelftestOutput("default", "zone", checks)
+	if !out.OK || len(out.Checks) != 3 {
+		t.Errorf("JSON output = %+v, want ok with 3 checks", out)
+	}
+}
+
+// TestRunSelftest_ZoneDeleteFails verifies that a policy left behind is a
+// FAIL naming its ID.
+func TestRunSelftest_ZoneDeleteFails(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetError("DeleteZonePolicy", &controller.ErrServerBusy{Status: 503, Msg: "provisioning"})
+	checks := runSelftest(context.Background(), ctrl, selftestConfig{
+		Site:  "default",
+		Mode:  "zone",
+		Pairs: []config.ZonePair{{Src: "External", Dst: "Internal"}},
+		Name:  "crowdsec-selftest-1",
+	})
+
+	for _, c := range checks {
+		if c.name == "zone_policies" && (c.status != "FAIL" || !strings.Contains(c.detail, "remove crowdsec-selftest-1")) {
+			t.Errorf("zone_policies = %+v, want FAIL naming the leftover policy", c)
+		}
+	}
+	if out := newSelftestOutput("default", "zone", checks); out.OK {
+		t.Error("JSON output ok = true with a failed check")
+	}
+}
+
+func TestRunSelftest_ZoneWithoutPairs(t *testing.T) {
+	checks := runSelftest(context.Background(), testutil.NewMockController(),
+		selftestConfig{Site: "default", Mode: "zone", Name: "crowdsec-selftest-1"})
+
+	got := checkStatuses(checks)
+	if got["groups"] != "PASS" || got["zone_policies"] != "SKIP" || got["reorder"] != "SKIP" {
+		t.Errorf("checks = %+v, want groups PASS and policy checks SKIP", checks)
+	}
+}
+
+// TestReportSelftest_FailedReturnsError verifies that a failed check in text
+// output prints the table and returns errReported instead of exiting, so the
+// command's deferred cleanup still runs.
+func TestReportSelftest_FailedReturnsError(t *testing.T) {
+	checks := []diagCheck{
+		{name: "groups", status: "PASS"},
+		{name: "rules", status: "FAIL", detail: "HTTP 403 forbidden"},
+	}
+	var err error
+	out := captureStdout(t, func() { err = reportSelftest("default", "legacy", checks) })
+	if !errors.Is(err, errReported) {
+		t.Errorf("err = %v, want errReported", err)
+	}
+	if !strings.Contains(out, "HTTP 403 forbidden") {
+		t.Errorf("report missing the failed check:\n%s", out)
+	}
+
+	checks[1].status = "PASS"
+	captureStdout(t, func() { err = reportSelftest("default", "legacy", checks) })
+	if err != nil {
+		t.Errorf("err = %v, want nil when every check passed", err)
+	}
+}
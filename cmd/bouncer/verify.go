@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/spf13/cobra"
+)
+
+// verifyCmd cross-checks the controller against the store without changing
+// either.
+func verifyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify",
+		Short: "Compare controller objects with the store without changing anything",
+		Long: `List the managed firewall groups, rules and policies on the controller and
+compare them with the store's caches and ban list. Reports stale cache
+records, orphaned shards, cached members that differ from the controller, and
+active bans missing from (or members missing a ban in) the shards.
+
+Nothing is written: the store is opened read-only and every controller write
+is refused. With STORAGE_BACKEND=sqlite or redis it can run beside the daemon;
+bbolt allows one process at a time, so stop the daemon first.
+
+Exits 0 when everything matches, 2 when discrepancies were found, and 1 when
+a lookup failed and the report is incomplete. With --output=json the report
+is written as a single JSON object.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := config.Load()
+			if err != nil {
+				return err
+			}
+			log, closeLog := buildLogger(cfg)
+			defer closeLog()
+
+			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer cancel()
+
+			store, err := openStoreReadOnly(cfg, log)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			namer, err := firewall.NewNamer(cfg.GroupNameTemplate, cfg.RuleNameTemplate,
+				cfg.PolicyNameTemplate, cfg.ObjectDescription)
+			if err != nil {
+				return fmt.Errorf("build namer: %w", err)
+			}
+			whitelist, err := decision.ParseWhitelist(cfg.BlockWhitelist)
+			if err != nil {
+				return fmt.Errorf("parse whitelist: %w", err)
+			}
+
+			ctrl, err := newControllerClient(ctx, cfg, log)
+			if err != nil {
+				return err
+			}
+			defer ctrl.Close()
+
+			report, err := firewall.Verify(ctx, controller.NewReadOnlyController(ctrl), store, firewall.VerifyConfig{
+				Namer:      namer,
+				EnableIPv6: cfg.FirewallEnableIPv6,
+				Whitelist:  whitelist,
+			}, cfg.UnifiSites)
+			if err != nil {
+				return err
+			}
+			var failErr error
+			if len(report.Errors) > 0 {
+				failErr = fmt.Errorf("verify incomplete, %d lookup(s) failed: %w", len(report.Errors), errors.Join(report.Errors...))
+			}
+			if jsonOutput() {
+				if err := writeJSON(os.Stdout, newVerifyOutput(report, failErr)); err != nil {
+					return err
+				}
+				if failErr != nil {
+					return errReported
+				}
+			} else {
+				if err := printVerifyReport(os.Stdout, report); err != nil {
+					return err
+				}
+				if failErr != nil {
+					return failErr
+				}
+			}
+			if len(report.Issues) > 0 {
+				return &exitCodeError{code: 2}
+			}
+			return nil
+		},
+	}
+}
+
+// printVerifyReport writes one row per issue, or a single line when there
+// are none.
+func printVerifyReport(out io.Writer, report *firewall.VerifyReport) error {
+	if len(report.Issues) == 0 {
+		_, err := fmt.Fprintln(out, "controller and store are consistent")
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tKIND\tNAME\tID\tDETAIL")
+	for _, issue := range report.Issues {
+		id := issue.ID
+		if id == "" {
+			id = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", issue.Site, issue.Kind, issue.Name, id, issue.Detail)
+	}
+	return w.Flush()
+}
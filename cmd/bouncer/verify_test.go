@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+)
+
+func TestPrintVerifyReport(t *testing.T) {
+	var out strings.Builder
+	if err := printVerifyReport(&out, &firewall.VerifyReport{}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "controller and store are consistent\n" {
+		t.Errorf("empty report = %q", out.String())
+	}
+
+	out.Reset()
+	report := &firewall.VerifyReport{Issues: []firewall.VerifyIssue{
+		{Site: "default", Kind: firewall.VerifyStaleGroup, Name: "crowdsec-block-v4-2", ID: "abc", Detail: "cached group not found on the controller"},
+		{Site: "default", Kind: firewall.VerifyMissingBan, Name: "v4", Detail: "1 active bans not in any shard: 192.0.2.50"},
+	}}
+	if err := printVerifyReport(&out, report); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "SITE") {
+		t.Fatalf("report = %q", out.String())
+	}
+	if fields := strings.Fields(lines[2]); fields[1] != "missing_ban" || fields[3] != "-" {
+		t.Errorf("missing_ban row = %q, want kind and a - ID", lines[2])
+	}
+}
+
+func TestNewVerifyOutput(t *testing.T) {
+	out := newVerifyOutput(&firewall.VerifyReport{}, nil)
+	if !out.OK || !out.Consistent || out.Issues == nil {
+		t.Errorf("empty report = %+v, want ok, consistent, issues []", out)
+	}
+
+	report := &firewall.VerifyReport{
+		Issues: []firewall.VerifyIssue{
+			{Site: "default", Kind: firewall.VerifyMissingBan, Name: "v4", Detail: "1 active bans not in any shard: 192.0.2.50"},
+		},
+		Errors: []error{errors.New("list groups: timeout")},
+	}
+	out = newVerifyOutput(report, errors.New("verify incomplete"))
+	if out.OK || out.Consistent || out.Error != "verify incomplete" {
+		t.Errorf("incomplete report = %+v", out)
+	}
+	if len(out.Issues) != 1 || out.Issues[0].Kind != firewall.VerifyMissingBan || out.Issues[0].ID != "" {
+		t.Errorf("issues = %+v", out.Issues)
+	}
+	if len(out.Errors) != 1 || out.Errors[0] != "list groups: timeout" {
+		t.Errorf("errors = %v", out.Errors)
+	}
+}
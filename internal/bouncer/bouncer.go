@@ -4,7 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/models"
@@ -29,28 +34,79 @@ type Bouncer struct {
 	store     storage.Store
 	fwMgr     firewall.Manager
 	handler   JobHandler
-	filterCfg decision.FilterConfig
 	log       zerolog.Logger
 	streamBnc *csbouncer.StreamBouncer
 	recorder  MetricsRecorder
+	events    EventSink // nil when WEBHOOK_URL is unset
+
+	// filterMu guards filterCfg, which ApplyReload may swap while the stream
+	// processor is running.
+	filterMu  sync.RWMutex
+	filterCfg decision.FilterConfig
+
+	// syncIntervalCh delivers a new SyncInterval to runPeriodicSync on reload.
+	syncIntervalCh chan time.Duration
+
+	// originTTLs maps a lowercased decision origin to the ban TTL used when a
+	// decision carries no duration (BAN_TTL_ORIGIN_<ORIGIN>).
+	originTTLs map[string]time.Duration
+
+	// scenarioDurations maps a lowercased scenario to the ban duration set by
+	// BLOCK_SCENARIO_DURATION. It overrides the decision's own duration.
+	scenarioDurations map[string]time.Duration
+
+	// burstMu guards the unban burst window: when it started and how many
+	// deletes it has seen (UNBAN_BURST_THRESHOLD/UNBAN_BURST_WINDOW), and
+	// the deletes waiting for the deferred burst reconcile.
+	burstMu      sync.Mutex
+	burstStart   time.Time
+	burstCount   int
+	burstPending []SyncJob
+
+	// burstSignal wakes runUnbanBurstReconcile when deletes are parked.
+	burstSignal chan struct{}
+
+	// dedup drops ban decisions already applied (DECISION_DEDUP_CACHE_SIZE);
+	// nil when disabled.
+	dedup *decisionCache
+
+	// reconciled is set once a full reconcile has completed without error;
+	// /readyz reports 503 until then.
+	reconciled atomic.Bool
 }
 
-// New constructs a fully wired Bouncer.
+// New constructs a fully wired Bouncer. events may be nil.
 func New(cfg *config.Config, ctrl controller.Controller, store storage.Store,
-	fwMgr firewall.Manager, recorder MetricsRecorder, log zerolog.Logger) (*Bouncer, error) {
+	fwMgr firewall.Manager, recorder MetricsRecorder, events EventSink, log zerolog.Logger) (*Bouncer, error) {
 
 	whitelist, err := decision.ParseWhitelist(cfg.BlockWhitelist)
 	if err != nil {
 		return nil, fmt.Errorf("parse whitelist: %w", err)
 	}
 
+	scenarioExclude, err := decision.CompileScenarioPatterns(cfg.BlockScenarioExclude)
+	if err != nil {
+		return nil, fmt.Errorf("parse scenario excludes: %w", err)
+	}
+
 	filterCfg := decision.NewFilterConfig()
-	filterCfg.BlockScenarioExclude = cfg.BlockScenarioExclude
+	if len(cfg.BlockDecisionTypes) > 0 {
+		filterCfg.AllowedActions = append(slices.Clone(cfg.BlockDecisionTypes), "delete")
+	}
+	filterCfg.BlockScenarioExclude = scenarioExclude
 	filterCfg.AllowedOrigins = cfg.CrowdSecOrigins
+	filterCfg.ExcludedOrigins = cfg.CrowdSecOriginsExclude
 	filterCfg.Whitelist = whitelist
 	filterCfg.MinBanDuration = cfg.BlockMinDuration
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, recorder, log)
+	originTTLs, err := cfg.ParseBanTTLOrigins()
+	if err != nil {
+		return nil, fmt.Errorf("parse ban TTL origins: %w", err)
+	}
+	scenarioDurations, err := cfg.ParseBlockScenarioDurations()
+	if err != nil {
+		return nil, fmt.Errorf("parse scenario durations: %w", err)
+	}
 
 	// StreamBouncer.TickerInterval is a string like "30s"
 	tickerStr := cfg.CrowdSecPollInterval.String()
@@ -64,17 +120,62 @@ func New(cfg *config.Config, ctrl controller.Controller, store storage.Store,
 		RetryInitialConnect: true,
 	}
 
-	return &Bouncer{
-		cfg:       cfg,
-		ctrl:      ctrl,
-		store:     store,
-		fwMgr:     fwMgr,
-		handler:   handler,
-		filterCfg: filterCfg,
-		log:       log,
-		streamBnc: streamBnc,
-		recorder:  recorder,
-	}, nil
+	b := &Bouncer{
+		cfg:            cfg,
+		ctrl:           ctrl,
+		store:          store,
+		fwMgr:          fwMgr,
+		filterCfg:      filterCfg,
+		log:            log,
+		streamBnc:      streamBnc,
+		recorder:       recorder,
+		events:         events,
+		syncIntervalCh: make(chan time.Duration, 1),
+		burstSignal:    make(chan struct{}, 1),
+		originTTLs:     originTTLs,
+
+		scenarioDurations: scenarioDurations,
+		dedup:             newDecisionCache(cfg.DecisionDedupCacheSize),
+	}
+	b.handler = makeJobHandler(ctrl, store, fwMgr, cfg, b.currentWhitelist, recorder, events, log)
+	return b, nil
+}
+
+// ApplyReload applies the runtime-reloadable settings from next to a running
+// bouncer: the block whitelist and the periodic sync interval. Other fields of
+// next are ignored; see config.RestartRequired for the fields that need a restart.
+func (b *Bouncer) ApplyReload(next *config.Config) error {
+	whitelist, err := decision.ParseWhitelist(next.BlockWhitelist)
+	if err != nil {
+		return fmt.Errorf("parse whitelist: %w", err)
+	}
+	b.filterMu.Lock()
+	b.filterCfg.Whitelist = whitelist
+	b.filterMu.Unlock()
+	b.fwMgr.SetWhitelist(whitelist)
+
+	if next.SyncInterval > 0 {
+		// Drop any pending update that runPeriodicSync has not picked up yet;
+		// only the latest interval matters.
+		select {
+		case <-b.syncIntervalCh:
+		default:
+		}
+		b.syncIntervalCh <- next.SyncInterval
+	}
+	return nil
+}
+
+// currentWhitelist returns the BLOCK_WHITELIST currently in effect.
+func (b *Bouncer) currentWhitelist() []*net.IPNet {
+	return b.currentFilter().Whitelist
+}
+
+// currentFilter returns a snapshot of the filter configuration.
+func (b *Bouncer) currentFilter() decision.FilterConfig {
+	b.filterMu.RLock()
+	defer b.filterMu.RUnlock()
+	return b.filterCfg
 }
 
 // Run starts all goroutines and blocks until ctx is cancelled or a fatal error occurs.
@@ -82,6 +183,7 @@ func (b *Bouncer) Run(ctx context.Context) error {
 	if err := b.streamBnc.Init(); err != nil {
 		return fmt.Errorf("init CrowdSec stream: %w", err)
 	}
+	instrumentPollErrors(b.streamBnc.APIClient.GetClient())
 
 	g, gctx := errgroup.WithContext(ctx)
 
@@ -99,6 +201,14 @@ func (b *Bouncer) Run(ctx context.Context) error {
 		})
 	}
 
+	// Deferred reconcile for unban bursts.
+	if b.cfg.UnbanBurstThreshold > 0 {
+		g.Go(func() error {
+			b.runUnbanBurstReconcile(gctx)
+			return nil
+		})
+	}
+
 	// Prometheus metrics server
 	if b.cfg.MetricsEnabled {
 		g.Go(func() error {
@@ -126,6 +236,9 @@ func (b *Bouncer) runPeriodicSync(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
+		case d := <-b.syncIntervalCh:
+			ticker.Reset(d)
+			b.log.Info().Dur("interval", d).Msg("periodic sync interval updated")
 		case <-ticker.C:
 			if err := b.fwMgr.SyncDirty(ctx, b.cfg.UnifiSites); err != nil {
 				b.log.Warn().Err(err).Msg("periodic SyncDirty failed")
@@ -149,6 +262,7 @@ func (b *Bouncer) processStream(ctx context.Context) error {
 			if !ok {
 				return fmt.Errorf("CrowdSec stream closed")
 			}
+			metrics.CrowdSecLastPollSuccess.SetToCurrentTime()
 			b.handleDecisionBlock(ctx, decisions)
 			if err := b.fwMgr.SyncDirty(ctx, b.cfg.UnifiSites); err != nil {
 				b.log.Warn().Err(err).Msg("SyncDirty after decision block failed")
@@ -161,11 +275,29 @@ func (b *Bouncer) processStream(ctx context.Context) error {
 	}
 }
 
+// handleDecisionBlock applies one stream block: new decisions first, or the
+// deleted ones first with UNBAN_PRIORITY so that false-positive corrections
+// are not held up by a large ban batch.
 func (b *Bouncer) handleDecisionBlock(ctx context.Context, decisions *models.DecisionsStreamResponse) {
-	source := "stream"
+	filterCfg := b.currentFilter()
+	if b.cfg.UnbanPriority {
+		b.handleDeleted(ctx, decisions.Deleted, filterCfg)
+		b.handleNew(ctx, decisions.New, filterCfg)
+		return
+	}
+	b.handleNew(ctx, decisions.New, filterCfg)
+	b.handleDeleted(ctx, decisions.Deleted, filterCfg)
+}
 
-	for _, d := range decisions.New {
-		result := decision.Filter(d, b.filterCfg, b.log)
+// handleNew applies the new decisions of a block as bans.
+func (b *Bouncer) handleNew(ctx context.Context, decisions models.GetDecisionsResponse, filterCfg decision.FilterConfig) {
+	source := "stream"
+	for _, d := range decisions {
+		if b.dedup.seen(d.ID, time.Now()) {
+			metrics.DecisionsDeduped.Inc()
+			continue
+		}
+		result := decision.Filter(d, filterCfg, b.log)
 		if !result.Passed {
 			continue
 		}
@@ -175,38 +307,194 @@ func (b *Bouncer) handleDecisionBlock(ctx context.Context, decisions *models.Dec
 		if d.Origin != nil {
 			origin = *d.Origin
 		}
+		scenario := ""
+		if d.Scenario != nil {
+			scenario = *d.Scenario
+		}
 		remType := ""
 		if d.Type != nil {
 			remType = *d.Type
 		}
 
-		if err := b.handler(ctx, SyncJob{
+		job := SyncJob{
 			Action:          "ban",
 			IP:              result.Value,
 			IPv6:            result.IPv6,
-			ExpiresAt:       expiresAt(result.Duration),
+			ExpiresAt:       expiresAt(b.banDuration(result.Duration, origin, scenario)),
 			Origin:          origin,
 			RemediationType: remType,
 			ReceivedAt:      time.Now(),
-		}); err != nil {
+		}
+		if err := b.handler(ctx, job); err != nil {
 			b.log.Error().Err(err).Str("ip", result.Value).Msg("failed to apply ban")
+			continue
+		}
+		// The handler drops a ban whitelisted by a reload since the filter ran
+		// without an error; it was not applied, so a resend must not be skipped.
+		if decision.IsWhitelisted(job.IP, b.currentWhitelist()) {
+			continue
 		}
+		b.dedup.add(d.ID, job.IP, job.ExpiresAt)
 	}
+}
 
-	for _, d := range decisions.Deleted {
-		result := decision.Filter(d, b.filterCfg, b.log)
+// handleDeleted applies the deleted decisions of a block as unbans, through a
+// single reconcile when they amount to an unban burst.
+func (b *Bouncer) handleDeleted(ctx context.Context, decisions models.GetDecisionsResponse, filterCfg decision.FilterConfig) {
+	source := "stream"
+	var deletes []SyncJob
+	for _, d := range decisions {
+		result := decision.Filter(d, filterCfg, b.log)
 		if !result.Passed {
 			continue
 		}
+		if b.keepOnDelete(d, result.Value) {
+			continue
+		}
 		metrics.DecisionsProcessed.WithLabelValues("unban", source).Inc()
-
-		if err := b.handler(ctx, SyncJob{
+		b.dedup.forgetIP(result.Value)
+		deletes = append(deletes, SyncJob{
 			Action: "delete",
 			IP:     result.Value,
 			IPv6:   result.IPv6,
-		}); err != nil {
-			b.log.Error().Err(err).Str("ip", result.Value).Msg("failed to apply unban")
+		})
+	}
+
+	if b.unbanBurst(len(deletes), time.Now()) {
+		b.applyUnbanBurst(deletes)
+		return
+	}
+	for _, job := range deletes {
+		if err := b.handler(ctx, job); err != nil {
+			b.log.Error().Err(err).Str("ip", job.IP).Msg("failed to apply unban")
+		}
+	}
+}
+
+// unbanBurst counts n deletes into the current burst window and reports
+// whether the window has reached UNBAN_BURST_THRESHOLD. A window that has
+// run longer than UNBAN_BURST_WINDOW starts over at now.
+func (b *Bouncer) unbanBurst(n int, now time.Time) bool {
+	if b.cfg.UnbanBurstThreshold <= 0 || n == 0 || b.cfg.DryRun {
+		return false
+	}
+	b.burstMu.Lock()
+	defer b.burstMu.Unlock()
+	if b.burstStart.IsZero() || now.Sub(b.burstStart) > b.cfg.UnbanBurstWindow {
+		b.burstStart = now
+		b.burstCount = 0
+	}
+	b.burstCount += n
+	return b.burstCount >= b.cfg.UnbanBurstThreshold
+}
+
+// applyUnbanBurst removes the bans of jobs from the store and parks them for
+// runUnbanBurstReconcile, which takes the IPs out of UniFi with one reconcile
+// for the whole burst instead of one ApplyUnban per IP and site. Unlike the
+// per-IP path the store is updated first; a crash before the reconcile leaves
+// the IPs blocked until the next reconcile removes them.
+func (b *Bouncer) applyUnbanBurst(jobs []SyncJob) {
+	var unbanned []SyncJob
+	for _, job := range jobs {
+		exists, err := b.store.BanExists(job.IP)
+		if err != nil {
+			b.log.Error().Err(err).Str("ip", job.IP).Msg("failed to apply unban")
+			continue
+		}
+		if !exists {
+			continue
+		}
+		if err := b.store.BanDelete(job.IP); err != nil {
+			b.log.Error().Err(err).Str("ip", job.IP).Msg("failed to delete ban from bbolt")
+			continue
+		}
+		unbanned = append(unbanned, job)
+	}
+
+	b.log.Info().Int("deletes", len(jobs)).Int("removed", len(unbanned)).
+		Msg("unban burst: deferring deletes to a single reconcile")
+	if len(unbanned) == 0 {
+		return
+	}
+	b.burstMu.Lock()
+	b.burstPending = append(b.burstPending, unbanned...)
+	b.burstMu.Unlock()
+	select {
+	case b.burstSignal <- struct{}{}:
+	default:
+	}
+}
+
+// runUnbanBurstReconcile applies the deletes parked by applyUnbanBurst. After
+// the first one it waits until no further burst block has arrived for two
+// poll intervals, or UNBAN_BURST_WINDOW has passed, so a burst spread over
+// several stream blocks costs a single reconcile.
+func (b *Bouncer) runUnbanBurstReconcile(ctx context.Context) {
+	quietFor := 2 * b.cfg.CrowdSecPollInterval
+	if quietFor <= 0 {
+		quietFor = time.Second
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.burstSignal:
+		}
+		quiet := time.NewTimer(quietFor)
+		deadline := time.NewTimer(b.cfg.UnbanBurstWindow)
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				quiet.Stop()
+				deadline.Stop()
+				return
+			case <-b.burstSignal:
+				quiet.Reset(quietFor)
+			case <-quiet.C:
+				break wait
+			case <-deadline.C:
+				break wait
+			}
+		}
+		quiet.Stop()
+		deadline.Stop()
+		b.reconcileUnbanBurst(ctx)
+	}
+}
+
+// reconcileUnbanBurst runs one reconcile for the parked burst deletes and
+// reports them as unbans. An IP banned again in the meantime was kept by the
+// reconcile and is left out.
+func (b *Bouncer) reconcileUnbanBurst(ctx context.Context) {
+	b.burstMu.Lock()
+	jobs := b.burstPending
+	b.burstPending = nil
+	b.burstMu.Unlock()
+	if len(jobs) == 0 {
+		return
+	}
+
+	b.log.Info().Int("removed", len(jobs)).Msg("unban burst: applying deletes with a single reconcile")
+	result, err := b.fwMgr.Reconcile(ctx, b.cfg.UnifiSites)
+	if err != nil {
+		b.log.Error().Err(err).Msg("unban burst reconcile failed")
+		return
+	}
+	for _, rErr := range result.Errors {
+		b.log.Warn().Err(rErr).Msg("unban burst reconcile error")
+	}
+	// A failed site keeps the IPs until the next reconcile, which counts them
+	// as drift; only a clean reconcile records the deletions here.
+	clean := len(result.Errors) == 0
+	for _, job := range jobs {
+		if banned, err := b.store.BanExists(job.IP); err == nil && banned {
+			continue
+		}
+		if clean {
+			b.recorder.RecordDeletion(UnbanDecisionDeleted)
 		}
+		notifyApplied(b.events, job.Action, job.IP, job.IPv6, b.cfg.UnifiSites)
 	}
 }
 
@@ -224,11 +512,7 @@ func (b *Bouncer) serveMetrics(ctx context.Context) error {
 		_ = srv.Close()
 	}()
 
-	b.log.Info().Str("addr", b.cfg.MetricsAddr).Msg("Prometheus metrics server started")
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("metrics server: %w", err)
-	}
-	return nil
+	return b.listenAndServe(srv, "metrics server")
 }
 
 // serveHealth runs the health endpoint.
@@ -238,15 +522,8 @@ func (b *Bouncer) serveHealth(ctx context.Context) error {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
-		if err := b.ctrl.Ping(r.Context()); err != nil {
-			b.log.Warn().Err(err).Msg("readyz: controller ping failed")
-			http.Error(w, "not ready", http.StatusServiceUnavailable)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write([]byte("ready"))
-	})
+	mux.HandleFunc("/readyz", b.handleReady)
+	mux.HandleFunc("/backup", b.handleBackup)
 
 	srv := &http.Server{
 		Addr:              b.cfg.HealthAddr,
@@ -261,13 +538,151 @@ func (b *Bouncer) serveHealth(ctx context.Context) error {
 		_ = srv.Close()
 	}()
 
-	b.log.Info().Str("addr", b.cfg.HealthAddr).Msg("health server started")
-	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		return fmt.Errorf("health server: %w", err)
+	return b.listenAndServe(srv, "health server")
+}
+
+// handleBackup serves /backup: a consistent copy of the store taken by
+// Store.Backup, for the backup command while the daemon holds the bbolt lock.
+// Only loopback clients are served, so the database is not exposed on a
+// HEALTH_ADDR reachable from the network. A failure after the copy started
+// aborts the connection so the client cannot mistake it for a complete file.
+func (b *Bouncer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+		http.Error(w, "backup is only served to loopback clients", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// A large database takes longer than the server's WriteTimeout.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bw := &startedWriter{w: w}
+	err = b.store.Backup(bw)
+	switch {
+	case err == nil:
+	case bw.started:
+		b.log.Error().Err(err).Msg("backup over /backup failed mid-copy")
+		panic(http.ErrAbortHandler)
+	case errors.Is(err, storage.ErrBackupUnsupported):
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		b.log.Error().Err(err).Msg("backup over /backup failed")
+		http.Error(w, "backup failed", http.StatusInternalServerError)
+	}
+}
+
+// startedWriter records whether anything was written through it.
+type startedWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+func (s *startedWriter) Write(p []byte) (int, error) {
+	s.started = true
+	return s.w.Write(p)
+}
+
+// MarkReconciled records that a full reconcile completed successfully, which
+// /readyz requires before it reports ready.
+func (b *Bouncer) MarkReconciled() {
+	b.reconciled.Store(true)
+}
+
+// handleReady serves /readyz: ready once the firewall infrastructure is in
+// place (decisions received earlier are buffered), a full reconcile has
+// succeeded (see MarkReconciled) and the controller answers. Unlike /healthz,
+// which only reports that the process is up.
+func (b *Bouncer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !b.fwMgr.Ready() {
+		http.Error(w, "firewall infrastructure not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if !b.reconciled.Load() {
+		http.Error(w, "startup reconcile not complete", http.StatusServiceUnavailable)
+		return
+	}
+	if err := b.ctrl.Ping(r.Context()); err != nil {
+		b.log.Warn().Err(err).Msg("readyz: controller ping failed")
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("ready"))
+}
+
+// listenAndServe binds srv.Addr and serves until the server is closed. A bind
+// failure (e.g. the port is taken by another container) only disables this
+// endpoint unless FAIL_ON_BIND_ERROR=true, so decision processing keeps running.
+func (b *Bouncer) listenAndServe(srv *http.Server, name string) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		if b.cfg.FailOnBindError {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		b.log.Warn().Err(err).Str("addr", srv.Addr).
+			Msgf("%s disabled: cannot bind address (set FAIL_ON_BIND_ERROR=true to exit instead)", name)
+		return nil
+	}
+
+	b.log.Info().Str("addr", srv.Addr).Msgf("%s started", name)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%s: %w", name, err)
 	}
 	return nil
 }
 
+// banDuration returns the scenario's BLOCK_SCENARIO_DURATION when set, else
+// dur when the decision carries one. Otherwise it falls back to the origin's
+// BAN_TTL_ORIGIN_<ORIGIN> override, then to BAN_TTL.
+func (b *Bouncer) banDuration(dur time.Duration, origin, scenario string) time.Duration {
+	if d, ok := b.scenarioDurations[strings.ToLower(scenario)]; ok {
+		return d
+	}
+	if dur > 0 {
+		return dur
+	}
+	if ttl, ok := b.originTTLs[strings.ToLower(origin)]; ok {
+		return ttl
+	}
+	return b.cfg.BanTTL
+}
+
+// keepOnDelete reports whether the LAPI delete of d must leave ip's ban in
+// place. Bans imported from IMPORT_BLOCKLIST_PATH are not LAPI's to lift. A
+// ban whose scenario has a BLOCK_SCENARIO_DURATION stays until the ExpiresAt
+// that duration gave it: LAPI deletes the decision when its own, shorter
+// duration runs out, and the janitor expires the ban later.
+func (b *Bouncer) keepOnDelete(d *models.Decision, ip string) bool {
+	entry, err := b.store.BanGet(ip)
+	if err != nil {
+		b.log.Warn().Err(err).Str("ip", ip).Msg("failed to read ban; applying the delete")
+		return false
+	}
+	if entry == nil {
+		return false
+	}
+	if entry.Origin == ImportOrigin {
+		b.log.Debug().Str("ip", ip).Msg("ignoring LAPI delete for an imported ban")
+		return true
+	}
+	if d.Scenario == nil {
+		return false
+	}
+	if _, ok := b.scenarioDurations[strings.ToLower(*d.Scenario)]; !ok {
+		return false
+	}
+	if entry.ExpiresAt.IsZero() || !time.Now().Before(entry.ExpiresAt) {
+		return false
+	}
+	b.log.Debug().Str("ip", ip).Str("scenario", *d.Scenario).Time("expires_at", entry.ExpiresAt).
+		Msg("keeping ban extended by BLOCK_SCENARIO_DURATION until it expires")
+	return true
+}
+
 func expiresAt(dur time.Duration) time.Time {
 	if dur == 0 {
 		return time.Time{}
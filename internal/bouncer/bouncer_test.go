@@ -0,0 +1,658 @@
+package bouncer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+func newTestBouncer(t *testing.T, cfg *config.Config) *Bouncer {
+	t.Helper()
+	b, err := New(cfg, testutil.NewMockController(), testutil.NewMockStore(),
+		&mockFirewallManager{}, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return b
+}
+
+func TestApplyReload_UpdatesWhitelistAndSyncInterval(t *testing.T) {
+	b := newTestBouncer(t, testCfg())
+
+	next := testCfg()
+	next.BlockWhitelist = []string{"10.0.0.0/8", "192.168.1.1"}
+	next.SyncInterval = 45 * time.Second
+	if err := b.ApplyReload(next); err != nil {
+		t.Fatalf("ApplyReload: %v", err)
+	}
+
+	if got := len(b.currentFilter().Whitelist); got != 2 {
+		t.Errorf("expected 2 whitelist entries after reload, got %d", got)
+	}
+	if got := len(b.fwMgr.(*mockFirewallManager).whitelist); got != 2 {
+		t.Errorf("expected reload to pass 2 whitelist entries to the firewall manager, got %d", got)
+	}
+	select {
+	case d := <-b.syncIntervalCh:
+		if d != 45*time.Second {
+			t.Errorf("sync interval: got %s, want 45s", d)
+		}
+	default:
+		t.Error("expected sync interval update to be queued")
+	}
+}
+
+func TestApplyReload_InvalidWhitelistKeepsPrevious(t *testing.T) {
+	cfg := testCfg()
+	cfg.BlockWhitelist = []string{"10.0.0.0/8"}
+	b := newTestBouncer(t, cfg)
+
+	next := testCfg()
+	next.BlockWhitelist = []string{"not-an-ip"}
+	if err := b.ApplyReload(next); err == nil {
+		t.Fatal("expected error for invalid whitelist")
+	}
+	if got := len(b.currentFilter().Whitelist); got != 1 {
+		t.Errorf("whitelist should be unchanged after failed reload, got %d entries", got)
+	}
+}
+
+func TestHandleDecisionBlock_NewAndDeleted(t *testing.T) {
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(testCfg(), testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = store.BanRecord("5.6.7.8", time.Now().Add(time.Hour), false)
+
+	decision := func(value string) *models.Decision {
+		return &models.Decision{
+			Type:     ptr("ban"),
+			Scope:    ptr("Ip"),
+			Value:    ptr(value),
+			Origin:   ptr("crowdsec"),
+			Scenario: ptr("crowdsecurity/ssh-bf"),
+			Duration: ptr("4h"),
+		}
+	}
+
+	b.handleDecisionBlock(context.Background(), &models.DecisionsStreamResponse{
+		New:     models.GetDecisionsResponse{decision("1.2.3.4")},
+		Deleted: models.GetDecisionsResponse{decision("5.6.7.8")},
+	})
+
+	if fwMgr.applyBanCalls != 1 {
+		t.Errorf("expected 1 ApplyBan call for new decision, got %d", fwMgr.applyBanCalls)
+	}
+	if fwMgr.applyUnbanCalls != 1 {
+		t.Errorf("expected 1 ApplyUnban call for deleted decision, got %d", fwMgr.applyUnbanCalls)
+	}
+	if ok, _ := store.BanExists("5.6.7.8"); ok {
+		t.Error("deleted decision should remove the ban record")
+	}
+}
+
+func ptr(s string) *string { return &s }
+
+func TestBanDuration_PerOriginTTL(t *testing.T) {
+	cfg := testCfg()
+	cfg.BanTTL = 168 * time.Hour
+	cfg.BanTTLOrigins = map[string]string{"capi": "24h"}
+	b := newTestBouncer(t, cfg)
+
+	cases := []struct {
+		name   string
+		dur    time.Duration
+		origin string
+		want   time.Duration
+	}{
+		{"capi without duration uses origin TTL", 0, "CAPI", 24 * time.Hour},
+		{"other origin without duration uses global TTL", 0, "crowdsec", 168 * time.Hour},
+		{"explicit duration wins over origin TTL", 4 * time.Hour, "CAPI", 4 * time.Hour},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := b.banDuration(tc.dur, tc.origin, ""); got != tc.want {
+				t.Errorf("banDuration(%s, %q) = %s, want %s", tc.dur, tc.origin, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBanDuration_ScenarioDuration(t *testing.T) {
+	cfg := testCfg()
+	cfg.BanTTL = 4 * time.Hour
+	cfg.BanTTLOrigins = map[string]string{"capi": "24h"}
+	cfg.BlockScenarioDuration = []string{"crowdsecurity/ssh-bf=168h"}
+	b := newTestBouncer(t, cfg)
+
+	cases := []struct {
+		name     string
+		dur      time.Duration
+		origin   string
+		scenario string
+		want     time.Duration
+	}{
+		{"matched scenario overrides decision duration", 4 * time.Hour, "crowdsec", "crowdsecurity/ssh-bf", 168 * time.Hour},
+		{"matched scenario overrides origin TTL", 0, "CAPI", "CrowdSecurity/SSH-BF", 168 * time.Hour},
+		{"unmatched scenario keeps decision duration", 2 * time.Hour, "crowdsec", "crowdsecurity/http-probing", 2 * time.Hour},
+		{"unmatched scenario without duration uses origin TTL", 0, "CAPI", "crowdsecurity/http-probing", 24 * time.Hour},
+		{"unmatched scenario without duration uses BAN_TTL", 0, "crowdsec", "", 4 * time.Hour},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := b.banDuration(tc.dur, tc.origin, tc.scenario); got != tc.want {
+				t.Errorf("banDuration(%s, %q, %q) = %s, want %s", tc.dur, tc.origin, tc.scenario, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestHandleDecisionBlock_RecordsDecisionExpiry verifies that the stored ban
+// expiry follows the decision's own duration and falls back to BAN_TTL only
+// when the decision carries none.
+func TestHandleDecisionBlock_RecordsDecisionExpiry(t *testing.T) {
+	cfg := testCfg()
+	cfg.BanTTL = 168 * time.Hour
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, &mockFirewallManager{}, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	decision := func(value string, dur *string) *models.Decision {
+		return &models.Decision{
+			Type:     ptr("ban"),
+			Scope:    ptr("Ip"),
+			Value:    ptr(value),
+			Origin:   ptr("CAPI"),
+			Scenario: ptr("crowdsecurity/ssh-bf"),
+			Duration: dur,
+		}
+	}
+	start := time.Now()
+	b.handleDecisionBlock(context.Background(), &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{
+			decision("1.2.3.4", ptr("3h59m30s")),
+			decision("5.6.7.8", nil),
+		},
+	})
+
+	bans, err := store.BanList()
+	if err != nil {
+		t.Fatalf("BanList: %v", err)
+	}
+	cases := map[string]time.Duration{
+		"1.2.3.4": 3*time.Hour + 59*time.Minute + 30*time.Second,
+		"5.6.7.8": cfg.BanTTL,
+	}
+	for ip, want := range cases {
+		entry, ok := bans[ip]
+		if !ok {
+			t.Fatalf("no ban record for %s", ip)
+		}
+		got := entry.ExpiresAt.Sub(start)
+		if got < want || got > want+time.Minute {
+			t.Errorf("%s expires in %s, want ~%s", ip, got, want)
+		}
+	}
+}
+
+// deleteBlock returns a stream response deleting ip decisions for each value.
+func deleteBlock(values ...string) *models.DecisionsStreamResponse {
+	resp := &models.DecisionsStreamResponse{}
+	for _, v := range values {
+		resp.Deleted = append(resp.Deleted, &models.Decision{
+			Type:     ptr("ban"),
+			Scope:    ptr("Ip"),
+			Value:    ptr(v),
+			Origin:   ptr("crowdsec"),
+			Scenario: ptr("crowdsecurity/ssh-bf"),
+			Duration: ptr("4h"),
+		})
+	}
+	return resp
+}
+
+func TestHandleDecisionBlock_UnbanBurstReconciles(t *testing.T) {
+	cfg := testCfg("default", "branch")
+	cfg.UnbanBurstThreshold = 3
+	cfg.UnbanBurstWindow = time.Minute
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ips := []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"}
+	for _, ip := range ips {
+		_ = store.BanRecord(ip, time.Now().Add(time.Hour), false)
+	}
+
+	b.handleDecisionBlock(context.Background(), deleteBlock(ips[:3]...))
+	b.handleDecisionBlock(context.Background(), deleteBlock(ips[3:]...))
+
+	if fwMgr.applyUnbanCalls != 0 {
+		t.Errorf("ApplyUnban calls = %d, want 0 on the burst path", fwMgr.applyUnbanCalls)
+	}
+	if fwMgr.reconcileCalls != 0 {
+		t.Errorf("Reconcile calls = %d before the deferred reconcile, want 0", fwMgr.reconcileCalls)
+	}
+	for _, ip := range ips {
+		if ok, _ := store.BanExists(ip); ok {
+			t.Errorf("%s should be removed from the store", ip)
+		}
+	}
+
+	// Both blocks are applied by one reconcile, and every unban is announced
+	// per site.
+	sink := &recordingSink{}
+	b.events = sink
+	b.reconcileUnbanBurst(context.Background())
+	if fwMgr.reconcileCalls != 1 {
+		t.Errorf("Reconcile calls = %d, want 1 for both blocks", fwMgr.reconcileCalls)
+	}
+	if len(sink.events) != len(ips)*2 || sink.events[0].Action != "unban" {
+		t.Errorf("webhook events = %+v, want one unban per IP and site", sink.events)
+	}
+}
+
+// TestRunUnbanBurstReconcile_Coalesces verifies that deletes parked while the
+// burst is still arriving are applied by one deferred reconcile.
+func TestRunUnbanBurstReconcile_Coalesces(t *testing.T) {
+	cfg := testCfg()
+	cfg.UnbanBurstThreshold = 1
+	cfg.UnbanBurstWindow = time.Minute
+	cfg.CrowdSecPollInterval = 25 * time.Millisecond
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		_ = store.BanRecord(ip, time.Now().Add(time.Hour), false)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		b.runUnbanBurstReconcile(ctx)
+		close(done)
+	}()
+	b.handleDecisionBlock(ctx, deleteBlock("192.0.2.1"))
+	b.handleDecisionBlock(ctx, deleteBlock("192.0.2.2"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		b.burstMu.Lock()
+		pending := len(b.burstPending)
+		b.burstMu.Unlock()
+		if pending == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if fwMgr.reconcileCalls != 1 {
+		t.Errorf("Reconcile calls = %d, want 1", fwMgr.reconcileCalls)
+	}
+}
+
+func TestHandleDecisionBlock_UnbanBelowThresholdIsPerIP(t *testing.T) {
+	cfg := testCfg()
+	cfg.UnbanBurstThreshold = 10
+	cfg.UnbanBurstWindow = time.Minute
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = store.BanRecord("192.0.2.1", time.Now().Add(time.Hour), false)
+	_ = store.BanRecord("192.0.2.2", time.Now().Add(time.Hour), false)
+
+	b.handleDecisionBlock(context.Background(), deleteBlock("192.0.2.1", "192.0.2.2"))
+
+	if fwMgr.applyUnbanCalls != 2 || fwMgr.reconcileCalls != 0 {
+		t.Errorf("ApplyUnban=%d Reconcile=%d, want 2 and 0", fwMgr.applyUnbanCalls, fwMgr.reconcileCalls)
+	}
+}
+
+// TestHandleDecisionBlock_DeleteKeepsExtendedBan verifies that a LAPI delete
+// does not lift a ban BLOCK_SCENARIO_DURATION extended past now, while an
+// expired extended ban is still removed.
+func TestHandleDecisionBlock_DeleteKeepsExtendedBan(t *testing.T) {
+	cfg := testCfg()
+	cfg.BlockScenarioDuration = []string{"crowdsecurity/ssh-bf=168h"}
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = store.BanRecord("192.0.2.1", time.Now().Add(160*time.Hour), false)
+	_ = store.BanRecord("192.0.2.2", time.Now().Add(-time.Minute), false)
+
+	b.handleDecisionBlock(context.Background(), deleteBlock("192.0.2.1", "192.0.2.2"))
+
+	if ok, _ := store.BanExists("192.0.2.1"); !ok {
+		t.Error("extended ban was removed by the LAPI delete")
+	}
+	if ok, _ := store.BanExists("192.0.2.2"); ok {
+		t.Error("expired extended ban should be removed")
+	}
+	if fwMgr.applyUnbanCalls != 1 {
+		t.Errorf("ApplyUnban calls = %d, want 1", fwMgr.applyUnbanCalls)
+	}
+}
+
+// TestHandleDecisionBlock_DeleteKeepsImportedBan verifies that LAPI cannot
+// lift a ban imported from IMPORT_BLOCKLIST_PATH.
+func TestHandleDecisionBlock_DeleteKeepsImportedBan(t *testing.T) {
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(testCfg(), testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_ = store.BanRecordOrigin("192.0.2.1", time.Time{}, false, ImportOrigin)
+
+	b.handleDecisionBlock(context.Background(), deleteBlock("192.0.2.1"))
+
+	if ok, _ := store.BanExists("192.0.2.1"); !ok {
+		t.Error("imported ban was removed by a LAPI delete")
+	}
+	if fwMgr.applyUnbanCalls != 0 {
+		t.Errorf("ApplyUnban calls = %d, want 0", fwMgr.applyUnbanCalls)
+	}
+}
+
+// TestHandleDecisionBlock_UnbanPriority verifies the order of a block that
+// deletes and re-adds the same IP: with UnbanPriority the delete runs first and
+// the IP ends up banned; without it the ban is skipped as a duplicate and the
+// delete then removes it.
+func TestHandleDecisionBlock_UnbanPriority(t *testing.T) {
+	for _, priority := range []bool{true, false} {
+		cfg := testCfg()
+		cfg.UnbanPriority = priority
+		fwMgr := &mockFirewallManager{}
+		store := testutil.NewMockStore()
+		b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		_ = store.BanRecord("192.0.2.9", time.Now().Add(time.Hour), false)
+
+		block := deleteBlock("192.0.2.9")
+		block.New = block.Deleted
+
+		b.handleDecisionBlock(context.Background(), block)
+
+		banned, _ := store.BanExists("192.0.2.9")
+		if banned != priority {
+			t.Errorf("UnbanPriority=%v: banned after block = %v, want %v", priority, banned, priority)
+		}
+		wantBans := 0
+		if priority {
+			wantBans = 1
+		}
+		if fwMgr.applyUnbanCalls != 1 || fwMgr.applyBanCalls != wantBans {
+			t.Errorf("UnbanPriority=%v: ApplyUnban=%d ApplyBan=%d, want 1 and %d",
+				priority, fwMgr.applyUnbanCalls, fwMgr.applyBanCalls, wantBans)
+		}
+	}
+}
+
+func TestUnbanBurst_Window(t *testing.T) {
+	cfg := testCfg()
+	cfg.UnbanBurstThreshold = 5
+	cfg.UnbanBurstWindow = time.Minute
+	b := newTestBouncer(t, cfg)
+
+	start := time.Now()
+	if b.unbanBurst(3, start) {
+		t.Error("3 deletes should stay below a threshold of 5")
+	}
+	if !b.unbanBurst(3, start.Add(30*time.Second)) {
+		t.Error("6 deletes within the window should reach the threshold")
+	}
+	if b.unbanBurst(3, start.Add(2*time.Minute)) {
+		t.Error("a new window should start counting from zero")
+	}
+
+	cfg.UnbanBurstThreshold = 0
+	if b.unbanBurst(1000, start) {
+		t.Error("threshold 0 must disable the burst path")
+	}
+}
+
+// TestUnbanBurst_FinalState runs a delete burst against a real firewall
+// manager: the removed IPs leave the group in one update and the rest stay.
+func TestUnbanBurst_FinalState(t *testing.T) {
+	ctx := context.Background()
+	cfg := testCfg()
+	cfg.UnbanBurstThreshold = 10
+	cfg.UnbanBurstWindow = time.Minute
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	namer, err := firewall.NewNamer("crowdsec-block-{{.Family}}-{{.Index}}",
+		"crowdsec-drop-{{.Family}}-{{.Index}}",
+		"crowdsec-policy-{{.SrcZone}}-{{.DstZone}}-{{.Family}}-{{.Index}}", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwMgr := firewall.NewManager(firewall.ManagerConfig{
+		FirewallMode:    "legacy",
+		GroupCapacityV4: 100,
+		LegacyCfg: firewall.LegacyConfig{
+			RuleIndexStartV4: 22000, RulesetV4: "WAN_IN", BlockAction: "drop", Description: "test",
+		},
+	}, ctrl, store, namer, zerolog.Nop())
+	if err := fwMgr.EnsureInfrastructure(ctx, cfg.UnifiSites); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	b, err := New(cfg, ctrl, store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var all []string
+	newBlock := &models.DecisionsStreamResponse{}
+	for i := 1; i <= 15; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		all = append(all, ip)
+		newBlock.New = append(newBlock.New, deleteBlock(ip).Deleted[0])
+	}
+	b.handleDecisionBlock(ctx, newBlock)
+	if err := fwMgr.SyncDirty(ctx, cfg.UnifiSites); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	updatesBefore := ctrl.Calls("UpdateFirewallGroup")
+	b.handleDecisionBlock(ctx, deleteBlock(all[:12]...))
+	b.reconcileUnbanBurst(ctx)
+	if err := fwMgr.SyncDirty(ctx, cfg.UnifiSites); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 1 {
+		t.Errorf("group updates for the burst = %d, want 1", got)
+	}
+
+	groups, _ := ctrl.ListFirewallGroups(ctx, "default")
+	if len(groups) != 1 {
+		t.Fatalf("groups = %d, want 1", len(groups))
+	}
+	members := append([]string(nil), groups[0].GroupMembers...)
+	sort.Strings(members)
+	want := append([]string(nil), all[12:]...)
+	sort.Strings(want)
+	if strings.Join(members, ",") != strings.Join(want, ",") {
+		t.Errorf("members after burst = %v, want %v", members, want)
+	}
+	bans, _ := store.BanList()
+	if len(bans) != 3 {
+		t.Errorf("stored bans = %d, want 3", len(bans))
+	}
+}
+
+// occupyPort binds a loopback port for the duration of the test and returns
+// its address, simulating another container holding METRICS_ADDR/HEALTH_ADDR.
+func occupyPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln.Addr().String()
+}
+
+// TestHandleReady_WaitsForInfrastructure verifies that /readyz reports 503
+// until the firewall manager has finished EnsureInfrastructure.
+func TestHandleReady_WaitsForInfrastructure(t *testing.T) {
+	b := newTestBouncer(t, testCfg())
+	b.MarkReconciled()
+	fw := b.fwMgr.(*mockFirewallManager)
+
+	fw.notReady = true
+	rec := httptest.NewRecorder()
+	b.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before infrastructure: got %d, want 503", rec.Code)
+	}
+
+	fw.notReady = false
+	rec = httptest.NewRecorder()
+	b.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("after infrastructure: got %d, want 200", rec.Code)
+	}
+}
+
+// TestHandleBackup verifies that /backup streams the store to loopback
+// clients only.
+func TestHandleBackup(t *testing.T) {
+	b := newTestBouncer(t, testCfg())
+	_ = b.store.BanRecord("192.0.2.1", time.Time{}, false)
+
+	rec := httptest.NewRecorder()
+	b.handleBackup(rec, httptest.NewRequest(http.MethodGet, "/backup", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("remote client: got %d, want 403", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/backup", nil)
+	req.RemoteAddr = "127.0.0.1:40000"
+	rec = httptest.NewRecorder()
+	b.handleBackup(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "192.0.2.1") {
+		t.Errorf("loopback client: got %d %q, want 200 with the store", rec.Code, rec.Body.String())
+	}
+
+	b.store.(*testutil.MockStore).SetError("Backup", errors.New("disk error"))
+	rec = httptest.NewRecorder()
+	b.handleBackup(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("failed backup: got %d, want 500", rec.Code)
+	}
+}
+
+// TestHandleReady_WaitsForReconcileAndPing verifies that /readyz reports 503
+// until a reconcile has succeeded, and again whenever the controller ping
+// fails.
+func TestHandleReady_WaitsForReconcileAndPing(t *testing.T) {
+	b := newTestBouncer(t, testCfg())
+	ctrl := b.ctrl.(*testutil.MockController)
+
+	rec := httptest.NewRecorder()
+	b.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("before reconcile: got %d, want 503", rec.Code)
+	}
+
+	b.MarkReconciled()
+	ctrl.SetError("Ping", errors.New("connection refused"))
+	rec = httptest.NewRecorder()
+	b.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("with failing ping: got %d, want 503", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	b.handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("once ping recovers: got %d, want 200", rec.Code)
+	}
+}
+
+func TestServeMetrics_BindConflictNonFatal(t *testing.T) {
+	cfg := testCfg()
+	cfg.MetricsAddr = occupyPort(t)
+	cfg.HealthAddr = occupyPort(t)
+
+	var logBuf bytes.Buffer
+	fwMgr := &mockFirewallManager{}
+	b, err := New(cfg, testutil.NewMockController(), testutil.NewMockStore(), fwMgr,
+		nopRecorder{}, nil, zerolog.New(&logBuf))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.serveMetrics(ctx); err != nil {
+		t.Fatalf("serveMetrics: expected nil on bind conflict, got %v", err)
+	}
+	if err := b.serveHealth(ctx); err != nil {
+		t.Fatalf("serveHealth: expected nil on bind conflict, got %v", err)
+	}
+	for _, name := range []string{"metrics server disabled", "health server disabled"} {
+		if !strings.Contains(logBuf.String(), name) {
+			t.Errorf("expected %q warning in log, got: %s", name, logBuf.String())
+		}
+	}
+
+	// Decision processing is unaffected by the missing endpoints.
+	b.handleDecisionBlock(ctx, &models.DecisionsStreamResponse{
+		New: models.GetDecisionsResponse{{
+			Type:     ptr("ban"),
+			Scope:    ptr("Ip"),
+			Value:    ptr("1.2.3.4"),
+			Origin:   ptr("crowdsec"),
+			Scenario: ptr("crowdsecurity/ssh-bf"),
+			Duration: ptr("4h"),
+		}},
+	})
+	if fwMgr.applyBanCalls != 1 {
+		t.Errorf("expected 1 ApplyBan call, got %d", fwMgr.applyBanCalls)
+	}
+}
+
+func TestServeMetrics_BindConflictFatalWhenEnabled(t *testing.T) {
+	cfg := testCfg()
+	cfg.MetricsAddr = occupyPort(t)
+	cfg.FailOnBindError = true
+	b := newTestBouncer(t, cfg)
+
+	if err := b.serveMetrics(context.Background()); err == nil {
+		t.Fatal("expected error on bind conflict with FAIL_ON_BIND_ERROR=true")
+	}
+}
@@ -0,0 +1,116 @@
+package bouncer
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// decisionCache remembers the IDs of recently applied ban decisions so a
+// decision the LAPI sends again (e.g. the full list after a reconnect) is
+// dropped before it becomes a SyncJob. It holds at most size entries and
+// evicts the least recently seen. A nil *decisionCache disables the cache.
+type decisionCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List              // front = most recently seen; values are *cachedDecision
+	byID  map[int64]*list.Element // decision ID → element in order
+	byIP  map[string]map[int64]struct{}
+}
+
+// cachedDecision is one applied ban decision. It stops counting as a
+// duplicate once expiresAt has passed, so a ban the janitor expired from the
+// store is applied again if the LAPI still sends it.
+type cachedDecision struct {
+	id        int64
+	ip        string
+	expiresAt time.Time
+}
+
+// newDecisionCache returns a cache of at most size decisions, or nil when
+// size <= 0.
+func newDecisionCache(size int) *decisionCache {
+	if size <= 0 {
+		return nil
+	}
+	return &decisionCache{
+		size:  size,
+		order: list.New(),
+		byID:  make(map[int64]*list.Element),
+		byIP:  make(map[string]map[int64]struct{}),
+	}
+}
+
+// seen reports whether decision id was applied and has not expired at now.
+func (c *decisionCache) seen(id int64, now time.Time) bool {
+	if c == nil || id == 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.byID[id]
+	if !ok {
+		return false
+	}
+	if d := el.Value.(*cachedDecision); !d.expiresAt.IsZero() && !now.Before(d.expiresAt) {
+		c.removeLocked(el)
+		return false
+	}
+	c.order.MoveToFront(el)
+	return true
+}
+
+// add records decision id, applied as a ban of ip until expiresAt. Decisions
+// without an ID are not cached.
+func (c *decisionCache) add(id int64, ip string, expiresAt time.Time) {
+	if c == nil || id == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.byID[id]; ok {
+		c.removeLocked(el)
+	}
+	c.byID[id] = c.order.PushFront(&cachedDecision{id: id, ip: ip, expiresAt: expiresAt})
+	if c.byIP[ip] == nil {
+		c.byIP[ip] = make(map[int64]struct{})
+	}
+	c.byIP[ip][id] = struct{}{}
+	for c.order.Len() > c.size {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// forgetIP drops every decision for ip, so a ban for it is applied again after
+// an unban even if another of its decisions is resent.
+func (c *decisionCache) forgetIP(ip string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id := range c.byIP[ip] {
+		c.removeLocked(c.byID[id])
+	}
+}
+
+// len returns the number of cached decisions.
+func (c *decisionCache) len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *decisionCache) removeLocked(el *list.Element) {
+	d := c.order.Remove(el).(*cachedDecision)
+	delete(c.byID, d.id)
+	if ids := c.byIP[d.ip]; ids != nil {
+		delete(ids, d.id)
+		if len(ids) == 0 {
+			delete(c.byIP, d.ip)
+		}
+	}
+}
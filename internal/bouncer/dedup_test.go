@@ -0,0 +1,158 @@
+package bouncer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+func TestDecisionCache_SeenAndExpiry(t *testing.T) {
+	now := time.Now()
+	c := newDecisionCache(10)
+	c.add(1, "192.0.2.1", now.Add(time.Hour))
+	c.add(2, "192.0.2.2", now.Add(-time.Second))
+	c.add(0, "192.0.2.3", now.Add(time.Hour)) // no ID: not cached
+
+	if !c.seen(1, now) {
+		t.Error("decision 1 should be seen")
+	}
+	if c.seen(2, now) {
+		t.Error("expired decision 2 should not be seen")
+	}
+	if c.seen(0, now) {
+		t.Error("decision without ID should not be seen")
+	}
+	if got := c.len(); got != 1 {
+		t.Errorf("len = %d, want 1 after the expired entry was dropped", got)
+	}
+}
+
+func TestDecisionCache_EvictsLeastRecentlySeen(t *testing.T) {
+	now := time.Now()
+	c := newDecisionCache(2)
+	c.add(1, "192.0.2.1", time.Time{})
+	c.add(2, "192.0.2.2", time.Time{})
+	c.seen(1, now) // 2 is now the least recently seen
+	c.add(3, "192.0.2.3", time.Time{})
+
+	if !c.seen(1, now) || !c.seen(3, now) {
+		t.Error("decisions 1 and 3 should be kept")
+	}
+	if c.seen(2, now) {
+		t.Error("decision 2 should have been evicted")
+	}
+}
+
+func TestDecisionCache_ForgetIP(t *testing.T) {
+	now := time.Now()
+	c := newDecisionCache(10)
+	c.add(1, "192.0.2.1", time.Time{})
+	c.add(2, "192.0.2.1", time.Time{})
+	c.add(3, "192.0.2.2", time.Time{})
+	c.forgetIP("192.0.2.1")
+
+	if c.seen(1, now) || c.seen(2, now) {
+		t.Error("decisions of the forgotten IP should be dropped")
+	}
+	if !c.seen(3, now) {
+		t.Error("decision of another IP should be kept")
+	}
+}
+
+func TestDecisionCache_DisabledIsNil(t *testing.T) {
+	c := newDecisionCache(0)
+	if c != nil {
+		t.Fatal("size 0 should disable the cache")
+	}
+	c.add(1, "192.0.2.1", time.Time{})
+	if c.seen(1, time.Now()) {
+		t.Error("nil cache should never report a decision as seen")
+	}
+}
+
+// TestHandleDecisionBlock_DedupsResentDecisions verifies that a ban decision
+// sent again is dropped before the handler, and applied again after a delete
+// for its IP.
+func TestHandleDecisionBlock_DedupsResentDecisions(t *testing.T) {
+	cfg := testCfg()
+	cfg.DecisionDedupCacheSize = 100
+	fwMgr := &mockFirewallManager{}
+	store := testutil.NewMockStore()
+	b, err := New(cfg, testutil.NewMockController(), store, fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ban := &models.Decision{
+		ID:       42,
+		Type:     ptr("ban"),
+		Scope:    ptr("Ip"),
+		Value:    ptr("1.2.3.4"),
+		Origin:   ptr("crowdsec"),
+		Scenario: ptr("crowdsecurity/ssh-bf"),
+		Duration: ptr("4h"),
+	}
+	block := &models.DecisionsStreamResponse{New: models.GetDecisionsResponse{ban}}
+	ctx := context.Background()
+
+	b.handleDecisionBlock(ctx, block)
+	b.handleDecisionBlock(ctx, block)
+	if fwMgr.applyBanCalls != 1 {
+		t.Fatalf("ApplyBan calls = %d, want 1 for a resent decision", fwMgr.applyBanCalls)
+	}
+
+	b.handleDecisionBlock(ctx, deleteBlock("1.2.3.4"))
+	b.handleDecisionBlock(ctx, block)
+	if fwMgr.applyBanCalls != 2 {
+		t.Errorf("ApplyBan calls = %d, want 2 after the IP was unbanned", fwMgr.applyBanCalls)
+	}
+}
+
+// TestHandleNew_WhitelistedNotDeduped verifies that a ban the handler drops as
+// whitelisted is not cached, so the same decision is applied once the
+// whitelist stops covering it.
+func TestHandleNew_WhitelistedNotDeduped(t *testing.T) {
+	cfg := testCfg()
+	cfg.DecisionDedupCacheSize = 100
+	fwMgr := &mockFirewallManager{}
+	b, err := New(cfg, testutil.NewMockController(), testutil.NewMockStore(), fwMgr, nopRecorder{}, nil, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ban := &models.Decision{
+		ID:       42,
+		Type:     ptr("ban"),
+		Scope:    ptr("Ip"),
+		Value:    ptr("1.2.3.4"),
+		Origin:   ptr("crowdsec"),
+		Scenario: ptr("crowdsecurity/ssh-bf"),
+		Duration: ptr("4h"),
+	}
+	ctx := context.Background()
+	filterCfg := b.currentFilter()
+
+	// A reload whitelists the IP after the filter snapshot was taken.
+	whitelist, err := decision.ParseWhitelist([]string{"1.2.3.4"})
+	if err != nil {
+		t.Fatalf("ParseWhitelist: %v", err)
+	}
+	b.filterMu.Lock()
+	b.filterCfg.Whitelist = whitelist
+	b.filterMu.Unlock()
+	b.handleNew(ctx, models.GetDecisionsResponse{ban}, filterCfg)
+	if fwMgr.applyBanCalls != 0 {
+		t.Fatalf("ApplyBan calls = %d, want 0 for a whitelisted IP", fwMgr.applyBanCalls)
+	}
+
+	b.filterMu.Lock()
+	b.filterCfg.Whitelist = nil
+	b.filterMu.Unlock()
+	b.handleNew(ctx, models.GetDecisionsResponse{ban}, b.currentFilter())
+	if fwMgr.applyBanCalls != 1 {
+		t.Errorf("ApplyBan calls = %d, want 1 once the IP is no longer whitelisted", fwMgr.applyBanCalls)
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/webhook"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 )
@@ -20,7 +23,51 @@ import (
 // A no-op implementation is used when reporting is disabled.
 type MetricsRecorder interface {
 	RecordBan(origin, remediationType string)
-	RecordDeletion()
+
+	// RecordDeletion counts an unban; reason is one of the Unban* constants.
+	RecordDeletion(reason string)
+}
+
+// Reasons passed to MetricsRecorder.RecordDeletion.
+const (
+	// UnbanExpired: the janitor reaped a ban past its expiry.
+	UnbanExpired = "expired"
+	// UnbanDecisionDeleted: CrowdSec deleted the decision.
+	UnbanDecisionDeleted = "decision_deleted"
+	// UnbanWhitelisted: reconcile removed an IP covered by BLOCK_WHITELIST.
+	UnbanWhitelisted = "whitelisted"
+	// UnbanReconcileDrift: reconcile removed an IP that had no ban in bbolt.
+	UnbanReconcileDrift = "reconcile_drift"
+	// UnbanAggregateChurn: reconcile replaced a CIDR_AGGREGATION block with
+	// others covering the same bans; nothing was unblocked.
+	UnbanAggregateChurn = "aggregate_churn"
+	// UnbanEvicted: the janitor evicted an old ban to stay under BAN_STORE_MAX.
+	UnbanEvicted = "evicted"
+)
+
+// ImportOrigin is the BanEntry origin of bans imported from
+// IMPORT_BLOCKLIST_PATH. LAPI deletes never lift them.
+const ImportOrigin = "blocklist-import"
+
+// EventSink receives an event for each ban or unban applied to a site
+// (WEBHOOK_URL). Notify must not block the job handler.
+type EventSink interface {
+	Notify(ev webhook.Event)
+}
+
+// notifyApplied sends one event per site for an applied job. A nil sink
+// disables events.
+func notifyApplied(events EventSink, action, ip string, ipv6 bool, sites []string) {
+	if events == nil {
+		return
+	}
+	if action == "delete" {
+		action = "unban"
+	}
+	ts := time.Now().UTC()
+	for _, site := range sites {
+		events.Notify(webhook.Event{Action: action, IP: ip, IPv6: ipv6, Site: site, TS: ts})
+	}
 }
 
 // SyncJob represents a single ban or unban operation.
@@ -31,23 +78,34 @@ type SyncJob struct {
 	ExpiresAt       time.Time
 	Origin          string    // CrowdSec decision origin (e.g. "CAPI", "crowdsec")
 	RemediationType string    // CrowdSec remediation type (e.g. "ban")
-	ReceivedAt      time.Time // when this decision passed the filter pipeline; zero = unknown
+	ReceivedAt      time.Time // when this decision passed the filter pipeline and was enqueued; zero = unknown
 }
 
 // JobHandler processes a single SyncJob.
 type JobHandler func(ctx context.Context, job SyncJob) error
 
 // makeJobHandler returns a JobHandler that performs idempotency checks
-// and firewall API calls for each SyncJob.
+// and firewall API calls for each SyncJob. whitelist returns the current
+// BLOCK_WHITELIST; ban jobs matching it are dropped even if they got past the
+// filter pipeline. A nil whitelist disables the check. events, when non-nil,
+// is notified after each successfully applied job.
 func makeJobHandler(
 	ctrl controller.Controller,
 	store storage.Store,
 	fwMgr firewall.Manager,
 	cfg *config.Config,
+	whitelist func() []*net.IPNet,
 	recorder MetricsRecorder,
+	events EventSink,
 	log zerolog.Logger,
 ) JobHandler {
 	return func(ctx context.Context, job SyncJob) error {
+		if job.Action == "ban" && whitelist != nil && decision.IsWhitelisted(job.IP, whitelist()) {
+			metrics.WhitelistedSkips.Inc()
+			log.Debug().Str("ip", job.IP).Msg("skipping: whitelisted")
+			return nil
+		}
+
 		// Step 1: Idempotency check
 		exists, err := store.BanExists(job.IP)
 		if err != nil {
@@ -81,13 +139,26 @@ func makeJobHandler(
 			}
 		}
 
+		// DRY_RUN_STORE_ONLY: bbolt mirrors what live mode would hold, but UniFi
+		// is never touched. A later live start reconciles the accumulated state.
+		if cfg.DryRunStoreOnly {
+			if job.Action == "delete" {
+				if err := store.BanDelete(job.IP); err != nil {
+					return fmt.Errorf("delete ban from bbolt: %w", err)
+				}
+			}
+			log.Info().Str("action", job.Action).Str("ip", job.IP).Bool("ipv6", job.IPv6).
+				Strs("sites", cfg.UnifiSites).Msg("[DRY-RUN store-only] recorded in bbolt; would apply to UniFi")
+			return nil
+		}
+
 		// Step 3: Apply to all sites
 		sites := cfg.UnifiSites
 		for _, site := range sites {
 			var applyErr error
 			switch job.Action {
 			case "ban":
-				applyErr = fwMgr.ApplyBan(ctx, site, job.IP, job.IPv6)
+				applyErr = fwMgr.ApplyBan(firewall.WithBanEnqueued(ctx, job.ReceivedAt), site, job.IP, job.IPv6)
 			case "delete":
 				applyErr = fwMgr.ApplyUnban(ctx, site, job.IP, job.IPv6)
 			}
@@ -117,8 +188,9 @@ func makeJobHandler(
 			if err := store.BanDelete(job.IP); err != nil {
 				log.Warn().Err(err).Str("ip", job.IP).Msg("failed to delete ban from bbolt")
 			}
-			recorder.RecordDeletion()
+			recorder.RecordDeletion(UnbanDecisionDeleted)
 		}
+		notifyApplied(events, job.Action, job.IP, job.IPv6, sites)
 
 		log.Debug().Str("action", job.Action).Str("ip", job.IP).Bool("ipv6", job.IPv6).
 			Strs("sites", cfg.UnifiSites).Msg("job applied")
@@ -3,21 +3,27 @@ package bouncer
 import (
 	"context"
 	"errors"
+	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/webhook"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
 // nopRecorder is a MetricsRecorder that discards all recordings.
 type nopRecorder struct{}
 
-func (nopRecorder) RecordBan(_, _ string) {}
-func (nopRecorder) RecordDeletion()       {}
+func (nopRecorder) RecordBan(_, _ string)   {}
+func (nopRecorder) RecordDeletion(_ string) {}
 
 // mockFirewallManager satisfies firewall.Manager for handler tests.
 type mockFirewallManager struct {
@@ -25,6 +31,9 @@ type mockFirewallManager struct {
 	applyUnbanErr   error
 	applyBanCalls   int
 	applyUnbanCalls int
+	reconcileCalls  int
+	whitelist       []*net.IPNet
+	notReady        bool
 }
 
 func (m *mockFirewallManager) ApplyBan(_ context.Context, site, ip string, ipv6 bool) error {
@@ -38,6 +47,7 @@ func (m *mockFirewallManager) ApplyUnban(_ context.Context, site, ip string, ipv
 }
 
 func (m *mockFirewallManager) Reconcile(_ context.Context, sites []string) (*firewall.ReconcileResult, error) {
+	m.reconcileCalls++
 	return &firewall.ReconcileResult{}, nil
 }
 
@@ -53,10 +63,30 @@ func (m *mockFirewallManager) Drain(_ context.Context, sites []string) error {
 	return nil
 }
 
+func (m *mockFirewallManager) EnableEnforcement(_ context.Context, _ []string) (int, error) {
+	return 0, nil
+}
+
 func (m *mockFirewallManager) ZoneManager() *firewall.ZoneManager {
 	return nil
 }
 
+func (m *mockFirewallManager) SetWhitelist(whitelist []*net.IPNet) {
+	m.whitelist = whitelist
+}
+
+func (m *mockFirewallManager) Shutdown(_ context.Context) error {
+	return nil
+}
+
+func (m *mockFirewallManager) Ready() bool {
+	return !m.notReady
+}
+
+func (m *mockFirewallManager) CheckCapabilities(_ context.Context, _ []string) ([]string, error) {
+	return nil, nil
+}
+
 // testCfg returns a minimal config suitable for handler tests.
 func testCfg(sites ...string) *config.Config {
 	if len(sites) == 0 {
@@ -77,7 +107,7 @@ func TestJobHandler_BanAlreadyExists(t *testing.T) {
 	// Pre-record a ban
 	_ = store.BanRecord("1.2.3.4", time.Now().Add(time.Hour), false)
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	err := handler(context.Background(), SyncJob{Action: "ban", IP: "1.2.3.4"})
 	if err != nil {
 		t.Errorf("expected nil error for already-banned IP, got %v", err)
@@ -87,13 +117,52 @@ func TestJobHandler_BanAlreadyExists(t *testing.T) {
 	}
 }
 
+func TestJobHandler_SkipsWhitelisted(t *testing.T) {
+	store := testutil.NewMockStore()
+	ctrl := testutil.NewMockController()
+	fwMgr := &mockFirewallManager{}
+	whitelist, err := decision.ParseWhitelist([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := makeJobHandler(ctrl, store, fwMgr, testCfg(),
+		func() []*net.IPNet { return whitelist }, nopRecorder{}, nil, zerolog.Nop())
+	before := promtestutil.ToFloat64(metrics.WhitelistedSkips)
+	for _, job := range []SyncJob{
+		{Action: "ban", IP: "10.1.2.3"},
+		{Action: "ban", IP: "2001:db8::1", IPv6: true},
+	} {
+		if err := handler(context.Background(), job); err != nil {
+			t.Fatalf("handler(%s): %v", job.IP, err)
+		}
+		if ok, _ := store.BanExists(job.IP); ok {
+			t.Errorf("whitelisted %s was recorded in the store", job.IP)
+		}
+	}
+	if fwMgr.applyBanCalls != 0 {
+		t.Errorf("ApplyBan calls = %d, want 0", fwMgr.applyBanCalls)
+	}
+	if got := promtestutil.ToFloat64(metrics.WhitelistedSkips) - before; got != 2 {
+		t.Errorf("whitelisted_skips delta = %v, want 2", got)
+	}
+
+	// A non-whitelisted IPv6 address is still banned.
+	if err := handler(context.Background(), SyncJob{Action: "ban", IP: "2001:db9::1", IPv6: true}); err != nil {
+		t.Fatalf("handler: %v", err)
+	}
+	if fwMgr.applyBanCalls != 1 {
+		t.Errorf("ApplyBan calls = %d, want 1", fwMgr.applyBanCalls)
+	}
+}
+
 func TestJobHandler_UnbanNotBanned(t *testing.T) {
 	store := testutil.NewMockStore()
 	ctrl := testutil.NewMockController()
 	cfg := testCfg()
 	fwMgr := &mockFirewallManager{}
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	// IP not in ban list — delete should be skipped
 	err := handler(context.Background(), SyncJob{Action: "delete", IP: "5.6.7.8"})
 	if err != nil {
@@ -110,7 +179,7 @@ func TestJobHandler_ApplyBanSuccess(t *testing.T) {
 	cfg := testCfg("default", "site2")
 	fwMgr := &mockFirewallManager{}
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	job := SyncJob{
 		Action:    "ban",
 		IP:        "203.0.113.1",
@@ -139,7 +208,7 @@ func TestJobHandler_ApplyUnbanSuccess(t *testing.T) {
 
 	_ = store.BanRecord("10.20.30.40", time.Now().Add(time.Hour), false)
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	if err := handler(context.Background(), SyncJob{Action: "delete", IP: "10.20.30.40"}); err != nil {
 		t.Fatalf("expected success, got %v", err)
 	}
@@ -152,13 +221,64 @@ func TestJobHandler_ApplyUnbanSuccess(t *testing.T) {
 	}
 }
 
+// recordingSink is an EventSink that keeps every event.
+type recordingSink struct {
+	events []webhook.Event
+}
+
+func (s *recordingSink) Notify(ev webhook.Event) { s.events = append(s.events, ev) }
+
+func TestJobHandler_NotifiesEventsPerSite(t *testing.T) {
+	store := testutil.NewMockStore()
+	cfg := testCfg("default", "site2")
+	fwMgr := &mockFirewallManager{}
+	sink := &recordingSink{}
+
+	handler := makeJobHandler(testutil.NewMockController(), store, fwMgr, cfg, nil, nopRecorder{}, sink, zerolog.Nop())
+	if err := handler(context.Background(), SyncJob{Action: "ban", IP: "203.0.113.1"}); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	if err := handler(context.Background(), SyncJob{Action: "delete", IP: "203.0.113.1"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	var got []string
+	for _, ev := range sink.events {
+		got = append(got, ev.Action+"/"+ev.Site+"/"+ev.IP)
+		if ev.TS.IsZero() {
+			t.Errorf("event %+v has no timestamp", ev)
+		}
+	}
+	want := []string{
+		"ban/default/203.0.113.1", "ban/site2/203.0.113.1",
+		"unban/default/203.0.113.1", "unban/site2/203.0.113.1",
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestJobHandler_NoEventOnFailure(t *testing.T) {
+	fwMgr := &mockFirewallManager{applyBanErr: errors.New("controller down")}
+	sink := &recordingSink{}
+
+	handler := makeJobHandler(testutil.NewMockController(), testutil.NewMockStore(), fwMgr, testCfg(),
+		nil, nopRecorder{}, sink, zerolog.Nop())
+	if err := handler(context.Background(), SyncJob{Action: "ban", IP: "203.0.113.2"}); err == nil {
+		t.Fatal("expected apply error")
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("expected no events for a failed job, got %v", sink.events)
+	}
+}
+
 func TestJobHandler_UnauthorizedRetriable(t *testing.T) {
 	store := testutil.NewMockStore()
 	ctrl := testutil.NewMockController()
 	cfg := testCfg()
 	fwMgr := &mockFirewallManager{applyBanErr: &controller.ErrUnauthorized{Msg: "test"}}
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	err := handler(context.Background(), SyncJob{Action: "ban", IP: "1.1.1.1"})
 	if err == nil {
 		t.Fatal("expected ErrUnauthorized, got nil")
@@ -179,7 +299,7 @@ func TestJobHandler_StorageError_Fatal(t *testing.T) {
 	// abort the job so the UniFi write is never attempted without a bbolt record.
 	store.SetError("BanRecord", errors.New("storage failure"))
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	job := SyncJob{
 		Action:    "ban",
 		IP:        "2.2.2.2",
@@ -203,7 +323,7 @@ func TestJobHandler_DryRun(t *testing.T) {
 	// Handler itself doesn't check DryRun; that's in the manager. So just verify no error.
 	fwMgr := &mockFirewallManager{}
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 	job := SyncJob{
 		Action:    "ban",
 		IP:        "3.3.3.3",
@@ -226,7 +346,7 @@ func TestJobHandler_DryRunNoBboltWrites(t *testing.T) {
 	}
 	fwMgr := &mockFirewallManager{}
 
-	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nopRecorder{}, zerolog.Nop())
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
 
 	// Execute a ban job in dry run
 	job := SyncJob{
@@ -272,3 +392,48 @@ func TestJobHandler_DryRunNoBboltWrites(t *testing.T) {
 		t.Error("DRY_RUN should not delete from bbolt; ban should still exist")
 	}
 }
+
+// TestJobHandler_DryRunStoreOnly verifies that DRY_RUN_STORE_ONLY records bans
+// and unbans in bbolt but never reaches the firewall manager or controller.
+func TestJobHandler_DryRunStoreOnly(t *testing.T) {
+	store := testutil.NewMockStore()
+	ctrl := testutil.NewMockController()
+	cfg := testCfg("default", "homelab")
+	cfg.DryRunStoreOnly = true
+	fwMgr := &mockFirewallManager{}
+
+	handler := makeJobHandler(ctrl, store, fwMgr, cfg, nil, nopRecorder{}, nil, zerolog.Nop())
+
+	ban := SyncJob{Action: "ban", IP: "203.0.113.7", ExpiresAt: time.Now().Add(time.Hour)}
+	if err := handler(context.Background(), ban); err != nil {
+		t.Fatalf("ban: %v", err)
+	}
+	exists, err := store.BanExists("203.0.113.7")
+	if err != nil {
+		t.Fatalf("BanExists: %v", err)
+	}
+	if !exists {
+		t.Error("store-only dry run should record the ban in bbolt")
+	}
+
+	if err := handler(context.Background(), SyncJob{Action: "delete", IP: "203.0.113.7"}); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	exists, err = store.BanExists("203.0.113.7")
+	if err != nil {
+		t.Fatalf("BanExists: %v", err)
+	}
+	if exists {
+		t.Error("store-only dry run should remove the unbanned IP from bbolt")
+	}
+
+	if fwMgr.applyBanCalls != 0 || fwMgr.applyUnbanCalls != 0 {
+		t.Errorf("firewall manager must not be called: bans=%d unbans=%d",
+			fwMgr.applyBanCalls, fwMgr.applyUnbanCalls)
+	}
+	for _, method := range []string{"UpdateFirewallGroup", "CreateFirewallGroup", "UpdateTrafficMatchingList", "CreateTrafficMatchingList"} {
+		if got := ctrl.Calls(method); got != 0 {
+			t.Errorf("controller %s calls: got %d, want 0", method, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package bouncer
 
 import (
 	"context"
+	"sort"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
@@ -12,23 +13,33 @@ import (
 
 // Janitor performs periodic housekeeping: pruning expired bans, updating gauges.
 type Janitor struct {
-	store    storage.Store
-	fwMgr    firewall.Manager
-	sites    []string
-	interval time.Duration
-	log      zerolog.Logger
+	store     storage.Store
+	fwMgr     firewall.Manager
+	recorder  MetricsRecorder
+	sites     []string
+	interval  time.Duration
+	maxBans   int
+	batchSize int
+	log       zerolog.Logger
 }
 
 // NewJanitor creates a Janitor. The fwMgr is used to call ApplyUnban on expired
-// bans before they are pruned from bbolt, keeping UniFi state consistent.
-func NewJanitor(store storage.Store, fwMgr firewall.Manager, sites []string,
-	interval time.Duration, log zerolog.Logger) *Janitor {
+// bans before they are pruned from bbolt, keeping UniFi state consistent;
+// each reaped ban is recorded as UnbanExpired. When maxBans is positive the
+// store is kept at or below it by evicting the oldest expiring bans
+// (BAN_STORE_MAX). batchSize is how many expired bans are pruned per write
+// transaction (JANITOR_BATCH_SIZE).
+func NewJanitor(store storage.Store, fwMgr firewall.Manager, recorder MetricsRecorder, sites []string,
+	interval time.Duration, maxBans, batchSize int, log zerolog.Logger) *Janitor {
 	return &Janitor{
-		store:    store,
-		fwMgr:    fwMgr,
-		sites:    sites,
-		interval: interval,
-		log:      log,
+		store:     store,
+		fwMgr:     fwMgr,
+		recorder:  recorder,
+		sites:     sites,
+		interval:  interval,
+		maxBans:   maxBans,
+		batchSize: batchSize,
+		log:       log,
 	}
 }
 
@@ -61,6 +72,10 @@ func (j *Janitor) tick(ctx context.Context) {
 			ip   string
 			ipv6 bool
 		}
+		oldest, expiringSoon := banAgeStats(banList, now)
+		metrics.BanOldestAgeSeconds.Set(oldest.Seconds())
+		metrics.BanExpiringWithin1h.Set(float64(expiringSoon))
+
 		var expired []expiredEntry
 		for ip, entry := range banList {
 			if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now) {
@@ -70,24 +85,35 @@ func (j *Janitor) tick(ctx context.Context) {
 		if len(expired) > 0 {
 			j.log.Info().Int("count", len(expired)).Msg("expiry reaper: unbanning expired IPs")
 			for _, e := range expired {
+				unbanned := true
 				for _, site := range j.sites {
 					if err := j.fwMgr.ApplyUnban(ctx, site, e.ip, e.ipv6); err != nil {
 						j.log.Warn().Err(err).Str("ip", e.ip).Str("site", site).
 							Msg("expiry reaper: unban failed")
+						unbanned = false
 					}
 				}
+				if unbanned {
+					j.recorder.RecordDeletion(UnbanExpired)
+				}
 			}
 		}
 	}
 
 	// Prune expired bans from bbolt.
-	pruned, err := j.store.PruneExpiredBans()
+	pruned, err := j.store.PruneExpiredBans(j.batchSize)
 	if err != nil {
 		j.log.Warn().Err(err).Msg("janitor: prune expired bans failed")
 	} else {
 		j.log.Info().Int("pruned", pruned).Msg("janitor: pruned expired bans from bbolt")
 	}
 
+	// Evict over-capacity bans only once expired ones are gone, so that
+	// expiry always frees space before anything still active is dropped.
+	if j.maxBans > 0 {
+		j.evictOverCapacity(ctx)
+	}
+
 	// Update DB size gauge.
 	size, err := j.store.SizeBytes()
 	if err != nil {
@@ -98,3 +124,98 @@ func (j *Janitor) tick(ctx context.Context) {
 
 	j.log.Debug().Msg("janitor: tick complete")
 }
+
+// evictOverCapacity unbans and deletes the oldest non-permanent bans, by
+// RecordedAt, while the store holds more than maxBans. It evicts down to
+// evictLowWater of the cap rather than to the cap itself, so that a store
+// hovering at the limit does not evict a few bans on every tick.
+// Permanent bans are never evicted, even if they alone exceed the cap.
+func (j *Janitor) evictOverCapacity(ctx context.Context) {
+	bans, err := j.store.BanList()
+	if err != nil {
+		j.log.Warn().Err(err).Msg("janitor: failed to list bans for capacity check")
+		return
+	}
+	if len(bans) <= j.maxBans {
+		return
+	}
+
+	victims := evictionCandidates(bans, len(bans)-evictLowWater(j.maxBans))
+	if len(victims) == 0 {
+		j.log.Warn().Int("bans", len(bans)).Int("max", j.maxBans).
+			Msg("janitor: ban store over BAN_STORE_MAX but holds only permanent bans")
+		return
+	}
+	j.log.Warn().Int("bans", len(bans)).Int("max", j.maxBans).Int("evicting", len(victims)).
+		Msg("janitor: ban store over BAN_STORE_MAX; evicting oldest bans")
+
+	for _, ip := range victims {
+		if ctx.Err() != nil {
+			return
+		}
+		unbanned := true
+		for _, site := range j.sites {
+			if err := j.fwMgr.ApplyUnban(ctx, site, ip, bans[ip].IPv6); err != nil {
+				j.log.Warn().Err(err).Str("ip", ip).Str("site", site).
+					Msg("janitor: unban of evicted IP failed")
+				unbanned = false
+			}
+		}
+		if err := j.store.BanDelete(ip); err != nil {
+			j.log.Warn().Err(err).Str("ip", ip).Msg("janitor: delete of evicted ban failed")
+			continue
+		}
+		metrics.EvictedBans.Inc()
+		if unbanned {
+			j.recorder.RecordDeletion(UnbanEvicted)
+		}
+	}
+}
+
+// evictLowWater is the ban count eviction brings the store down to: 95% of
+// limit, leaving headroom before the next eviction.
+func evictLowWater(limit int) int {
+	return limit - limit/20
+}
+
+// evictionCandidates returns up to n IPs of non-permanent bans, oldest
+// RecordedAt first; ties are broken by IP so the order is stable.
+func evictionCandidates(bans map[string]storage.BanEntry, n int) []string {
+	ips := make([]string, 0, len(bans))
+	for ip, entry := range bans {
+		if !entry.ExpiresAt.IsZero() {
+			ips = append(ips, ip)
+		}
+	}
+	sort.Slice(ips, func(a, b int) bool {
+		ra, rb := bans[ips[a]].RecordedAt, bans[ips[b]].RecordedAt
+		if !ra.Equal(rb) {
+			return ra.Before(rb)
+		}
+		return ips[a] < ips[b]
+	})
+	if len(ips) > n {
+		ips = ips[:n]
+	}
+	return ips
+}
+
+// banAgeStats returns the age of the oldest unexpired ban and how many
+// unexpired bans expire within the next hour. Bans already past their expiry
+// are about to be reaped and are not counted.
+func banAgeStats(bans map[string]storage.BanEntry, now time.Time) (oldest time.Duration, expiringSoon int) {
+	for _, entry := range bans {
+		if !entry.ExpiresAt.IsZero() {
+			if entry.ExpiresAt.Before(now) {
+				continue
+			}
+			if entry.ExpiresAt.Sub(now) <= time.Hour {
+				expiringSoon++
+			}
+		}
+		if age := now.Sub(entry.RecordedAt); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest, expiringSoon
+}
@@ -2,11 +2,16 @@ package bouncer
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net"
 	"testing"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/firewall"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
@@ -33,9 +38,18 @@ func (nopFWManager) EnsureInfrastructure(_ context.Context, _ []string) error {
 func (nopFWManager) SyncDirty(_ context.Context, _ []string) error             { return nil }
 func (nopFWManager) Drain(_ context.Context, _ []string) error                 { return nil }
 func (nopFWManager) ZoneManager() *firewall.ZoneManager                        { return nil }
+func (nopFWManager) SetWhitelist(_ []*net.IPNet)                               {}
+func (nopFWManager) Shutdown(_ context.Context) error                          { return nil }
+func (nopFWManager) Ready() bool                                               { return true }
+func (nopFWManager) CheckCapabilities(_ context.Context, _ []string) ([]string, error) {
+	return nil, nil
+}
+func (nopFWManager) EnableEnforcement(_ context.Context, _ []string) (int, error) {
+	return 0, nil
+}
 
 func newTestJanitor(store storage.Store, interval time.Duration) *Janitor {
-	return NewJanitor(store, nopFWManager{}, []string{"default"}, interval, zerolog.Nop())
+	return NewJanitor(store, nopFWManager{}, nopRecorder{}, []string{"default"}, interval, 0, 500, zerolog.Nop())
 }
 
 func TestJanitor_PrunesExpiredBans(t *testing.T) {
@@ -66,6 +80,113 @@ func TestJanitor_PrunesExpiredBans(t *testing.T) {
 	}
 }
 
+// reasonRecorder counts RecordDeletion calls by reason.
+type reasonRecorder struct {
+	nopRecorder
+	deletions map[string]int
+}
+
+func (r *reasonRecorder) RecordDeletion(reason string) { r.deletions[reason]++ }
+
+func TestJanitor_RecordsExpiredDeletions(t *testing.T) {
+	store := newJanitorTestStore(t)
+	past := time.Now().Add(-time.Hour)
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+		if err := store.BanRecord(ip, past, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.BanRecord("5.6.7.8", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &reasonRecorder{deletions: make(map[string]int)}
+	j := NewJanitor(store, nopFWManager{}, rec, []string{"default", "branch"}, time.Minute, 0, 500, zerolog.Nop())
+	j.tick(context.Background())
+
+	// One deletion per expired ban, not per site.
+	if len(rec.deletions) != 1 || rec.deletions[UnbanExpired] != 2 {
+		t.Errorf("deletions = %v, want 2 %q", rec.deletions, UnbanExpired)
+	}
+}
+
+// TestJanitor_EvictsOldestOverCapacity verifies that BAN_STORE_MAX evicts the
+// oldest expiring bans down to the low-water mark and never touches
+// permanent ones.
+func TestJanitor_EvictsOldestOverCapacity(t *testing.T) {
+	store := newJanitorTestStore(t)
+	for i := 0; i < 3; i++ {
+		if err := store.BanRecord(fmt.Sprintf("10.0.0.%d", i), time.Time{}, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	future := time.Now().Add(time.Hour)
+	for i := 0; i < 22; i++ {
+		if err := store.BanRecord(fmt.Sprintf("192.0.2.%d", 100+i), future, false); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	before := promtestutil.ToFloat64(metrics.EvictedBans)
+	rec := &reasonRecorder{deletions: make(map[string]int)}
+	j := NewJanitor(store, nopFWManager{}, rec, []string{"default"}, time.Minute, 20, 500, zerolog.Nop())
+	j.tick(context.Background())
+
+	// 25 bans over a cap of 20 are brought down to 19.
+	bans, _ := store.BanList()
+	if len(bans) != 19 {
+		t.Fatalf("bans after eviction = %d, want 19", len(bans))
+	}
+	for i := 0; i < 3; i++ {
+		if _, ok := bans[fmt.Sprintf("10.0.0.%d", i)]; !ok {
+			t.Errorf("permanent ban 10.0.0.%d evicted", i)
+		}
+	}
+	for i := 0; i < 22; i++ {
+		ip := fmt.Sprintf("192.0.2.%d", 100+i)
+		if _, ok := bans[ip]; ok == (i < 6) {
+			t.Errorf("%s present = %v, want only the 6 oldest evicted", ip, ok)
+		}
+	}
+	if got := promtestutil.ToFloat64(metrics.EvictedBans) - before; got != 6 {
+		t.Errorf("evicted_bans_total increased by %v, want 6", got)
+	}
+	if rec.deletions[UnbanEvicted] != 6 {
+		t.Errorf("deletions = %v, want 6 %q", rec.deletions, UnbanEvicted)
+	}
+
+	// Under the cap, the next tick evicts nothing.
+	j.tick(context.Background())
+	if bans, _ := store.BanList(); len(bans) != 19 {
+		t.Errorf("second tick changed the ban count to %d", len(bans))
+	}
+}
+
+// failUnbanFWManager refuses every unban.
+type failUnbanFWManager struct{ nopFWManager }
+
+func (failUnbanFWManager) ApplyUnban(_ context.Context, _, _ string, _ bool) error {
+	return errors.New("controller unreachable")
+}
+
+// TestJanitor_FailedUnbanNotRecorded verifies that an expired ban whose unban
+// failed is not reported as a deletion.
+func TestJanitor_FailedUnbanNotRecorded(t *testing.T) {
+	store := newJanitorTestStore(t)
+	if err := store.BanRecord("1.2.3.4", time.Now().Add(-time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := &reasonRecorder{deletions: make(map[string]int)}
+	j := NewJanitor(store, failUnbanFWManager{}, rec, []string{"default"}, time.Minute, 0, 500, zerolog.Nop())
+	j.tick(context.Background())
+
+	if len(rec.deletions) != 0 {
+		t.Errorf("deletions = %v, want none after a failed unban", rec.deletions)
+	}
+}
+
 func TestJanitor_KeepsFreshBans(t *testing.T) {
 	store := newJanitorTestStore(t)
 
@@ -120,3 +241,44 @@ func TestJanitor_TickImmediatelyOnStart(t *testing.T) {
 		t.Error("expired ban should have been pruned on first immediate tick")
 	}
 }
+
+func TestBanAgeStats(t *testing.T) {
+	now := time.Now()
+	bans := map[string]storage.BanEntry{
+		"192.0.2.1": {RecordedAt: now.Add(-48 * time.Hour)},                                   // permanent, oldest
+		"192.0.2.2": {RecordedAt: now.Add(-time.Hour), ExpiresAt: now.Add(30 * time.Minute)},  // expiring soon
+		"192.0.2.3": {RecordedAt: now.Add(-time.Minute), ExpiresAt: now.Add(2 * time.Hour)},   // expiring later
+		"192.0.2.4": {RecordedAt: now.Add(-72 * time.Hour), ExpiresAt: now.Add(-time.Minute)}, // expired: ignored
+		"192.0.2.5": {RecordedAt: now.Add(-10 * time.Minute), ExpiresAt: now.Add(time.Hour)},  // boundary counts
+	}
+	oldest, soon := banAgeStats(bans, now)
+	if oldest != 48*time.Hour {
+		t.Errorf("oldest = %v, want 48h", oldest)
+	}
+	if soon != 2 {
+		t.Errorf("expiring within 1h = %d, want 2", soon)
+	}
+
+	if oldest, soon := banAgeStats(nil, now); oldest != 0 || soon != 0 {
+		t.Errorf("empty store = %v, %d; want 0, 0", oldest, soon)
+	}
+}
+
+func TestJanitor_UpdatesBanAgeMetrics(t *testing.T) {
+	store := newJanitorTestStore(t)
+	if err := store.BanRecord("192.0.2.1", time.Now().Add(30*time.Minute), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.BanRecord("192.0.2.2", time.Now().Add(24*time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	newTestJanitor(store, time.Minute).tick(context.Background())
+
+	if got := promtestutil.ToFloat64(metrics.BanExpiringWithin1h); got != 1 {
+		t.Errorf("bans_expiring_within_1h = %v, want 1", got)
+	}
+	if got := promtestutil.ToFloat64(metrics.BanOldestAgeSeconds); got < 0 || got > 60 {
+		t.Errorf("ban_oldest_age_seconds = %v, want a just-recorded age", got)
+	}
+}
@@ -0,0 +1,41 @@
+package bouncer
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+)
+
+// decisionsStreamPath is the LAPI endpoint StreamBouncer polls for decisions.
+const decisionsStreamPath = "/decisions/stream"
+
+// pollErrorTransport counts failed decision stream fetches in
+// metrics.CrowdSecPollErrors. StreamBouncer only logs these failures, so the
+// bouncer sees them at the HTTP layer instead. Successful fetches are
+// recorded by processStream when their block arrives.
+type pollErrorTransport struct {
+	next http.RoundTripper
+}
+
+func (t *pollErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if strings.HasSuffix(req.URL.Path, decisionsStreamPath) &&
+		(err != nil || resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		metrics.CrowdSecPollErrors.Inc()
+	}
+	return resp, err
+}
+
+// instrumentPollErrors wraps the HTTP client StreamBouncer.Init built so
+// failed decision fetches are counted. It must run after Init and before Run.
+func instrumentPollErrors(client *http.Client) {
+	if client == nil {
+		return
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	client.Transport = &pollErrorTransport{next: next}
+}
@@ -0,0 +1,89 @@
+package bouncer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestPollErrorTransport verifies that only failed decision stream fetches
+// are counted.
+func TestPollErrorTransport(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{}
+	instrumentPollErrors(client)
+	get := func(path string) {
+		t.Helper()
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+
+	before := promtestutil.ToFloat64(metrics.CrowdSecPollErrors)
+	get("/v1/decisions/stream?startup=true")
+	status = http.StatusForbidden
+	get("/v1/decisions/stream")
+	get("/v1/usage-metrics")
+	status = http.StatusBadGateway
+	get("/v1/decisions/stream")
+	if got := promtestutil.ToFloat64(metrics.CrowdSecPollErrors) - before; got != 2 {
+		t.Errorf("poll errors = %v, want 2", got)
+	}
+
+	srv.Close()
+	if _, err := client.Get(srv.URL + "/v1/decisions/stream"); err == nil {
+		t.Fatal("expected connection error after server close")
+	}
+	if got := promtestutil.ToFloat64(metrics.CrowdSecPollErrors) - before; got != 3 {
+		t.Errorf("poll errors after connection failure = %v, want 3", got)
+	}
+}
+
+// TestProcessStream_RecordsLastPollSuccess verifies that a decision block
+// from the LAPI stamps the last poll success gauge.
+func TestProcessStream_RecordsLastPollSuccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"new":[],"deleted":[]}`))
+	}))
+	defer srv.Close()
+
+	cfg := testCfg()
+	cfg.CrowdSecLAPIURL = srv.URL
+	cfg.CrowdSecLAPIKey = "test-key"
+	cfg.CrowdSecPollInterval = time.Hour
+	b := newTestBouncer(t, cfg)
+	if err := b.streamBnc.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	instrumentPollErrors(b.streamBnc.APIClient.GetClient())
+
+	metrics.CrowdSecLastPollSuccess.Set(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- b.processStream(ctx) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for promtestutil.ToFloat64(metrics.CrowdSecLastPollSuccess) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("last poll success gauge not set after the first decision block")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("processStream: %v", err)
+	}
+}
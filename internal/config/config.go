@@ -5,12 +5,18 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
 
+	"github.com/knadh/koanf/parsers/toml/v2"
+	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/env"
+	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/v2"
 )
 
@@ -25,24 +31,117 @@ type Config struct {
 	UnifiCACert      string        `koanf:"unifi_ca_cert"`
 	UnifiHTTPTimeout time.Duration `koanf:"unifi_http_timeout"`
 	UnifiAPIDebug    bool          `koanf:"unifi_api_debug"`
+	UnifiMaxRetries  int           `koanf:"unifi_max_retries"`
+
+	// UnifiAPIDebugBodies logs redacted request/response bodies of every
+	// controller call.
+	UnifiAPIDebugBodies bool `koanf:"unifi_api_debug_bodies"`
+
+	// UnifiReadConcurrency caps concurrent list calls to the controller.
+	UnifiReadConcurrency int `koanf:"unifi_read_concurrency"`
+
+	// UnifiTLSServerName overrides the SNI/verification hostname when
+	// UNIFI_URL points at an IP but the certificate is issued for a name.
+	UnifiTLSServerName string `koanf:"unifi_tls_server_name"`
+
+	// UnifiClientCert and UnifiClientKey are the PEM client certificate and
+	// key presented to a controller proxy that requires mutual TLS.
+	UnifiClientCert string `koanf:"unifi_client_cert"`
+	UnifiClientKey  string `koanf:"unifi_client_key"`
+
+	// UnifiHTTPProxy routes controller calls (only) through a proxy; may
+	// embed user:pass credentials, so it is redacted in config dump.
+	UnifiHTTPProxy string `koanf:"unifi_http_proxy"`
+
+	// UnifiURLFallback is a second controller URL used after repeated
+	// connection failures to UnifiURL. Empty = no failover.
+	UnifiURLFallback string `koanf:"unifi_url_fallback"`
+
+	// UnifiClockSkewThreshold is the controller clock offset above which a
+	// warning is logged at startup. 0 disables the warning.
+	UnifiClockSkewThreshold time.Duration `koanf:"unifi_clock_skew_threshold"`
+
+	// UnifiFeatureCacheTTL is how long a controller feature detection is
+	// reused before it is probed again. 0 = until restart.
+	UnifiFeatureCacheTTL time.Duration `koanf:"unifi_feature_cache_ttl"`
+
+	// UnifiUserAgent is the User-Agent of controller requests. Empty =
+	// cs-unifi-bouncer-pro/<version>.
+	UnifiUserAgent string `koanf:"unifi_user_agent"`
 
 	// UniFi Sites
 	UnifiSites []string `koanf:"unifi_sites"`
 
 	// Firewall Mode & Behavior
 	FirewallMode              string        `koanf:"firewall_mode"`
+	FirewallModeOverrides     []string      `koanf:"firewall_mode_overrides"` // "site=mode" entries
 	FirewallBlockAction       string        `koanf:"firewall_block_action"`
 	FirewallEnableIPv6        bool          `koanf:"firewall_enable_ipv6"`
 	EnableIPv6                bool          `koanf:"enable_ipv6"` // HTTP client IPv6 dialing
 	FirewallGroupCapacity     int           `koanf:"firewall_group_capacity"`
 	FirewallGroupCapacityV4   int           `koanf:"firewall_group_capacity_v4"`
 	FirewallGroupCapacityV6   int           `koanf:"firewall_group_capacity_v6"`
+	FirewallGroupHardMax      int           `koanf:"firewall_group_hard_max"` // controller's members-per-group limit; 0 = no cap
+	FirewallMaxShards         int           `koanf:"firewall_max_shards"`     // decision shards per site and family; 0 = unlimited
 	FirewallAPIShardDelay     time.Duration `koanf:"firewall_api_shard_delay"`
 	FirewallFlushConcurrency  int           `koanf:"firewall_flush_concurrency"`
+
+	// FirewallNewShardSettle is the wait before a new group's rule or policy
+	// is created, and between retries of that create. 0 = no wait.
+	FirewallNewShardSettle time.Duration `koanf:"firewall_new_shard_settle"`
+
+	// FirewallPruneEmptyShards deletes empty trailing shards (and their rule
+	// or policies) after each reconcile. false keeps them for later bans.
+	FirewallPruneEmptyShards bool `koanf:"firewall_prune_empty_shards"`
 	FirewallLogDrops          bool          `koanf:"firewall_log_drops"`
 	FirewallReconcileOnStart  bool          `koanf:"firewall_reconcile_on_start"`
 	FirewallReconcileInterval time.Duration `koanf:"firewall_reconcile_interval"`
 
+	// StartupJitter delays the startup bootstrap and reconcile by a random
+	// interval in [0, StartupJitter) so bouncers sharing a controller do not
+	// hit it at once. 0 disables the delay.
+	StartupJitter time.Duration `koanf:"startup_jitter"`
+
+	// CapabilityCheckInterval is how often FIREWALL_MODE=auto sites re-run
+	// zone-firewall detection so a controller firmware upgrade switches the
+	// mode without a restart. 0 disables the check.
+	CapabilityCheckInterval time.Duration `koanf:"capability_check_interval"`
+
+	// ReconcileSiteConcurrency is the number of sites a reconcile pass
+	// processes at once.
+	ReconcileSiteConcurrency int `koanf:"reconcile_site_concurrency"`
+
+	// ReconcileBanListRetries is how many times a site reconcile re-reads the
+	// ban list after a store error, waiting ReconcileBanListRetryDelay
+	// (doubling each time) in between.
+	ReconcileBanListRetries    int           `koanf:"reconcile_banlist_retries"`
+	ReconcileBanListRetryDelay time.Duration `koanf:"reconcile_banlist_retry_delay"`
+
+	// Push the first ban after each sync tick immediately instead of waiting
+	// for SYNC_INTERVAL; later bans in the same window are still batched.
+	FirewallImmediateFirstBlock bool `koanf:"firewall_immediate_first_block"`
+
+	// Load v4 and v6 shard state concurrently at startup on dual-stack sites.
+	FirewallParallelFamilyEnsure bool `koanf:"firewall_parallel_family_ensure"`
+
+	// Reset managed rules/policies to LEGACY_RULE_ENABLED / ZONE_POLICY_ENABLED
+	// when an operator toggles them; by default their state is left alone.
+	FirewallEnforceEnabled bool `koanf:"firewall_enforce_enabled"`
+
+	// Create rules/policies disabled for a staged rollout; the enable
+	// command turns them on.
+	FirewallStartDisabled bool `koanf:"firewall_start_disabled"`
+
+	// How members covered by a banned CIDR are handled: off, skip or prune.
+	FirewallCIDRSubsumption string `koanf:"firewall_cidr_subsumption"`
+
+	// Collapse contiguous IPv4 members into CIDR blocks during reconcile.
+	FirewallAggregateCIDR bool `koanf:"firewall_aggregate_cidr"`
+
+	// Fraction of banned addresses also placed in a logging group whose rule
+	// runs ahead of the silent block rules. 0 = off.
+	FirewallLogSampleRate float64 `koanf:"firewall_log_sample_rate"`
+
 	// Shard Management (integration v1)
 	SyncInterval        time.Duration `koanf:"sync_interval"`
 	ShardLimit          int           `koanf:"shard_limit"`
@@ -56,14 +155,20 @@ type Config struct {
 	PolicyNameTemplate string `koanf:"policy_name_template"`
 	ObjectDescription  string `koanf:"object_description"`
 
+	// What to do when a UniFi object already has a shard's name but the
+	// store has no record of creating it: adopt or refuse.
+	GroupNameCollision string `koanf:"group_name_collision"`
+
 	// Legacy Firewall Mode
 	LegacyRuleIndexStartV4 int    `koanf:"legacy_rule_index_start_v4"`
 	LegacyRuleIndexStartV6 int    `koanf:"legacy_rule_index_start_v6"`
 	LegacyRulesetV4        string `koanf:"legacy_ruleset_v4"`
 	LegacyRulesetV6        string `koanf:"legacy_ruleset_v6"`
+	LegacyRuleEnabled      bool   `koanf:"legacy_rule_enabled"`
 
 	// Zone-Based Firewall Mode
-	ZonePairs []string `koanf:"zone_pairs"`
+	ZonePairs         []string `koanf:"zone_pairs"`
+	ZonePolicyEnabled bool     `koanf:"zone_policy_enabled"`
 
 	// Circuit Breaker
 	CircuitBreakerThreshold    int           `koanf:"circuit_breaker_threshold"`
@@ -76,45 +181,164 @@ type Config struct {
 	CloudflareIPv6URL           string        `koanf:"cloudflare_ipv6_url"`
 	CloudflareZonePairs         []string      `koanf:"cloudflare_zone_pairs"`
 
+	// Country blocking: ISO 3166-1 alpha-2 codes and the GeoIP list URLs,
+	// in which "{country}" is replaced with the lower-case code.
+	BlockCountries        []string `koanf:"block_countries"`
+	BlockCountriesIPv4URL string   `koanf:"block_countries_ipv4_url"`
+	BlockCountriesIPv6URL string   `koanf:"block_countries_ipv6_url"`
+
 	// CrowdSec Decision Filtering
 	CrowdSecLAPIURL         string        `koanf:"crowdsec_lapi_url"`
 	CrowdSecLAPIKey         string        `koanf:"crowdsec_lapi_key"`
 	CrowdSecLAPIVerifyTLS   bool          `koanf:"crowdsec_lapi_verify_tls"`
 	CrowdSecOrigins         []string      `koanf:"crowdsec_origins"`
+	CrowdSecOriginsExclude  []string      `koanf:"crowdsec_origins_exclude"`
 	CrowdSecPollInterval    time.Duration `koanf:"crowdsec_poll_interval"`
 	LAPIMetricsPushInterval time.Duration `koanf:"lapi_metrics_push_interval"`
+	BlockDecisionTypes      []string      `koanf:"block_decision_types"`
 	BlockScenarioExclude    []string      `koanf:"block_scenario_exclude"`
+	BlockScenarioDuration   []string      `koanf:"block_scenario_duration"`
 	BlockWhitelist          []string      `koanf:"block_whitelist"`
 	BlockMinDuration        time.Duration `koanf:"block_min_duration"`
 
+	// Unban bursts: when at least UnbanBurstThreshold deletes arrive within
+	// UnbanBurstWindow, they are applied with a single reconcile instead of
+	// one unban per IP. 0 disables the heuristic.
+	UnbanBurstThreshold int           `koanf:"unban_burst_threshold"`
+	UnbanBurstWindow    time.Duration `koanf:"unban_burst_window"`
+
+	// DecisionDedupCacheSize bounds the cache of applied decision IDs used
+	// to drop decisions the LAPI sends again. 0 disables it.
+	DecisionDedupCacheSize int `koanf:"decision_dedup_cache_size"`
+
+	// UnbanPriority applies the deleted decisions of each stream block before
+	// its new ones, so unbans are not delayed behind a ban storm.
+	UnbanPriority bool `koanf:"unban_priority"`
+
+	// Webhook: POST an event for each applied ban/unban to WebhookURL,
+	// signed with HMAC-SHA256 when WebhookSecret is set.
+	WebhookURL     string        `koanf:"webhook_url"`
+	WebhookSecret  string        `koanf:"webhook_secret"`
+	WebhookTimeout time.Duration `koanf:"webhook_timeout"`
+
+	// BufferEarlyDecisions keeps decisions that arrive before the firewall
+	// infrastructure is ready in the store and replays them once it is.
+	BufferEarlyDecisions bool `koanf:"buffer_early_decisions"`
+
 	// Session Management
 	SessionReauthMinGap  time.Duration `koanf:"session_reauth_min_gap"`
 	SessionReauthTimeout time.Duration `koanf:"session_reauth_timeout"`
+	SessionCookieCache   string        `koanf:"session_cookie_cache"` // optional path for persisted session cookies
 
 	// Storage
-	DataDir string        `koanf:"data_dir"`
-	BanTTL  time.Duration `koanf:"ban_ttl"`
+	DataDir        string        `koanf:"data_dir"`
+	BanTTL         time.Duration `koanf:"ban_ttl"`
+	StorageBackend string        `koanf:"storage_backend"` // "bbolt", "sqlite" or "redis"
+	RedisURL       string        `koanf:"redis_url"`
+
+	// BanStoreMax caps the number of stored bans; above it the janitor
+	// evicts the oldest expiring bans. 0 disables the cap.
+	BanStoreMax int `koanf:"ban_store_max"`
+
+	// What to do when the store was written by a newer binary: "fail" or
+	// "read-only" (run in dry-run mode without writing to the store).
+	StorageSchemaPolicy string `koanf:"storage_schema_policy"`
+
+	// ImportBlocklistPath names a file of IPs/CIDRs (one per line) recorded
+	// as permanent bans at startup, for migrating from a manual blocklist.
+	ImportBlocklistPath string `koanf:"import_blocklist_path"`
+
+	// Delete the rules/policies and records of a site's previous firewall
+	// mode once it runs in another one.
+	StorageCompactStaleModes bool `koanf:"storage_compact_stale_modes"`
 
 	// Operational
 	DryRun          bool          `koanf:"dry_run"`
+	DryRunStoreOnly bool          `koanf:"dry_run_store_only"` // persist bans to bbolt, no UniFi writes
 	LogLevel        string        `koanf:"log_level"`
 	LogFormat       string        `koanf:"log_format"`
 	MetricsEnabled  bool          `koanf:"metrics_enabled"`
 	MetricsAddr     string        `koanf:"metrics_addr"`
 	HealthAddr      string        `koanf:"health_addr"`
 	JanitorInterval time.Duration `koanf:"janitor_interval"`
+	FailOnBindError bool          `koanf:"fail_on_bind_error"` // exit when the metrics/health port cannot be bound
+
+	// JanitorBatchSize is how many expired bans are pruned per write
+	// transaction; the store's write lock is released between batches.
+	JanitorBatchSize int `koanf:"janitor_batch_size"`
+
+	// Log File Output (in addition to stderr)
+	LogFile           string        `koanf:"log_file"`
+	LogFileMaxSize    int           `koanf:"log_file_max_size"` // megabytes
+	LogFileMaxBackups int           `koanf:"log_file_max_backups"`
+	LogFileMaxAge     time.Duration `koanf:"log_file_max_age"`
+
+	// LogRedactPatterns are extra regular expressions masked by the log
+	// redaction writer, semicolon-separated in LOG_REDACT_PATTERNS.
+	LogRedactPatterns []string `koanf:"log_redact_patterns"`
+
+	// AuditLogPath, when set, receives one JSON line per firewall object the
+	// controller created, updated or deleted.
+	AuditLogPath string `koanf:"audit_log_path"`
+
+	// OtelEnabled exports OpenTelemetry traces over OTLP/HTTP. The exporter
+	// reads the standard OTEL_EXPORTER_OTLP_* variables directly.
+	OtelEnabled bool `koanf:"otel_enabled"`
+
+	// BanTTLOrigins holds the raw per-origin BAN_TTL_ORIGIN_<ORIGIN> values,
+	// keyed by lowercased origin. Parse with ParseBanTTLOrigins.
+	BanTTLOrigins map[string]string `koanf:"-"`
+
+	// Sources records where each setting's value came from (keyed by koanf
+	// key): SourceDefault, SourceConfigFile, SourceEnv or SourceSecretFile.
+	Sources map[string]string `koanf:"-"`
 
 	// DeprecationWarnings holds warnings about deprecated env vars that were
 	// used. Callers should log these after building the logger.
 	DeprecationWarnings []string `koanf:"-"`
+
+	// Warnings holds notices about values Validate adjusted, such as group
+	// capacities clamped to FIREWALL_GROUP_HARD_MAX. Callers should log these
+	// alongside DeprecationWarnings.
+	Warnings []string `koanf:"-"`
 }
 
-// ZonePair represents a parsed src->dst zone pair, optionally with port filters.
+// ZonePair represents a parsed src->dst zone pair, optionally with port filters
+// and the connection states its block policies match.
 type ZonePair struct {
-	Src      string
-	Dst      string
-	SrcPorts []int // empty = any source ports
-	DstPorts []int // empty = any destination ports
+	Src              string
+	Dst              string
+	SrcPorts         []int    // empty = any source ports
+	DstPorts         []int    // empty = any destination ports
+	ConnectionStates []string // empty = all connection states; else UniFi names, e.g. "NEW"
+}
+
+// zoneConnectionStates lists the connection states a zone pair may name after
+// "@", in the order ParseZonePairs returns them.
+var zoneConnectionStates = []string{"new", "established", "related", "invalid"}
+
+// parseConnectionStates parses the comma-separated state list after "@" in a
+// zone pair into the UniFi API names, deduplicated and in canonical order.
+func parseConnectionStates(list string) ([]string, error) {
+	want := make(map[string]bool)
+	for _, tok := range strings.Split(list, ",") {
+		tok = strings.ToLower(strings.TrimSpace(tok))
+		if tok == "" {
+			return nil, fmt.Errorf("empty connection state in state list")
+		}
+		if !slices.Contains(zoneConnectionStates, tok) {
+			return nil, fmt.Errorf("unknown connection state %q: must be one of %s",
+				tok, strings.Join(zoneConnectionStates, ", "))
+		}
+		want[tok] = true
+	}
+	states := make([]string, 0, len(want))
+	for _, st := range zoneConnectionStates {
+		if want[st] {
+			states = append(states, strings.ToUpper(st))
+		}
+	}
+	return states, nil
 }
 
 // parseZoneSide parses "zoneName[:port1,port2,...]" and returns the zone name
@@ -154,14 +378,26 @@ func parseZoneSide(side string) (zoneName string, ports []int, err error) {
 	return zoneName, ports, nil
 }
 
-// parseZonePairList parses zone pair strings in "src[:port,...]->dst[:port,...]" format.
+// parseZonePairList parses zone pair strings in
+// "src[:port,...]->dst[:port,...][@state,...]" format.
 func parseZonePairList(pairs []string) ([]ZonePair, error) {
 	result := make([]ZonePair, 0, len(pairs))
 	for _, p := range pairs {
-		parts := strings.SplitN(p, "->", 2)
+		spec, stateList, hasStates := strings.Cut(p, "@")
+		var states []string
+		if hasStates {
+			var err error
+			if states, err = parseConnectionStates(stateList); err != nil {
+				return nil, fmt.Errorf("invalid zone pair %q: %w", p, err)
+			}
+		}
+		parts := strings.SplitN(spec, "->", 2)
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid zone pair %q: expected format src->dst", p)
 		}
+		if strings.Contains(parts[1], "->") {
+			return nil, fmt.Errorf("invalid zone pair %q: separate pairs with ';' when any uses ports or states", p)
+		}
 		src, srcPorts, err := parseZoneSide(strings.TrimSpace(parts[0]))
 		if err != nil {
 			return nil, fmt.Errorf("invalid zone pair %q src: %w", p, err)
@@ -170,19 +406,93 @@ func parseZonePairList(pairs []string) ([]ZonePair, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid zone pair %q dst: %w", p, err)
 		}
-		result = append(result, ZonePair{Src: src, Dst: dst, SrcPorts: srcPorts, DstPorts: dstPorts})
+		result = append(result, ZonePair{Src: src, Dst: dst, SrcPorts: srcPorts, DstPorts: dstPorts, ConnectionStates: states})
 	}
 	return result, nil
 }
 
-// ParseZonePairs parses ZONE_PAIRS in "src[:port,...]->dst[:port,...]" format.
+// ParseZonePairs parses ZONE_PAIRS in "src[:port,...]->dst[:port,...][@state,...]"
+// format. The optional state list (new, established, related, invalid) limits
+// the pair's block policies to those connection states.
 func (c *Config) ParseZonePairs() ([]ZonePair, error) {
 	return parseZonePairList(c.ZonePairs)
 }
 
 // ParseCloudflareZonePairs parses CLOUDFLARE_ZONE_PAIRS in "src[:port,...]->dst[:port,...]" format.
+// Connection states are not supported: the allow policies match all states.
 func (c *Config) ParseCloudflareZonePairs() ([]ZonePair, error) {
-	return parseZonePairList(c.CloudflareZonePairs)
+	pairs, err := parseZonePairList(c.CloudflareZonePairs)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pairs {
+		if len(p.ConnectionStates) > 0 {
+			return nil, fmt.Errorf("invalid zone pair %s->%s: connection states are only supported in ZONE_PAIRS", p.Src, p.Dst)
+		}
+	}
+	return pairs, nil
+}
+
+// ParseFirewallModeOverrides parses FIREWALL_MODE_OVERRIDES ("site=mode,...")
+// into a site → mode map. Modes are auto, legacy, or zone.
+func (c *Config) ParseFirewallModeOverrides() (map[string]string, error) {
+	overrides := make(map[string]string, len(c.FirewallModeOverrides))
+	for _, entry := range c.FirewallModeOverrides {
+		site, mode, ok := strings.Cut(entry, "=")
+		site, mode = strings.TrimSpace(site), strings.TrimSpace(mode)
+		if !ok || site == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected format site=mode", entry)
+		}
+		switch mode {
+		case "auto", "legacy", "zone":
+		default:
+			return nil, fmt.Errorf("invalid mode %q for site %q: must be auto, legacy, or zone", mode, site)
+		}
+		if _, dup := overrides[site]; dup {
+			return nil, fmt.Errorf("duplicate entry for site %q", site)
+		}
+		overrides[site] = mode
+	}
+	return overrides, nil
+}
+
+// banTTLOriginPrefix is the koanf key prefix of per-origin TTL overrides
+// (BAN_TTL_ORIGIN_CAPI → "ban_ttl_origin_capi").
+const banTTLOriginPrefix = "ban_ttl_origin_"
+
+// ParseBanTTLOrigins parses the BAN_TTL_ORIGIN_<ORIGIN> overrides into a
+// lowercased origin → TTL map.
+func (c *Config) ParseBanTTLOrigins() (map[string]time.Duration, error) {
+	ttls := make(map[string]time.Duration, len(c.BanTTLOrigins))
+	for origin, raw := range c.BanTTLOrigins {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("BAN_TTL_ORIGIN_%s must be a positive duration; got %q",
+				strings.ToUpper(origin), raw)
+		}
+		ttls[origin] = d
+	}
+	return ttls, nil
+}
+
+// ParseBlockScenarioDurations parses the BLOCK_SCENARIO_DURATION
+// "scenario=duration" pairs into a lowercased scenario → ban duration map.
+func (c *Config) ParseBlockScenarioDurations() (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(c.BlockScenarioDuration))
+	for _, pair := range c.BlockScenarioDuration {
+		scenario, raw, ok := strings.Cut(pair, "=")
+		scenario, raw = strings.TrimSpace(scenario), strings.TrimSpace(raw)
+		if !ok || scenario == "" {
+			return nil, fmt.Errorf("BLOCK_SCENARIO_DURATION entries must be scenario=duration; got %q", pair)
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("BLOCK_SCENARIO_DURATION duration for %s must be a positive duration; got %q",
+				scenario, raw)
+		}
+		durations[strings.ToLower(scenario)] = d
+	}
+	return durations, nil
 }
 
 // sanitise removes a single layer of matching surrounding quotes from all string
@@ -190,10 +500,17 @@ func (c *Config) ParseCloudflareZonePairs() ([]ZonePair, error) {
 // which does not strip shell quoting.
 func (c *Config) sanitise() {
 	c.UnifiURL = stripEnvQuotes(c.UnifiURL)
+	c.UnifiURLFallback = stripEnvQuotes(c.UnifiURLFallback)
 	c.UnifiUsername = stripEnvQuotes(c.UnifiUsername)
 	c.UnifiPassword = stripEnvQuotes(c.UnifiPassword)
 	c.UnifiAPIKey = stripEnvQuotes(c.UnifiAPIKey)
 	c.UnifiCACert = stripEnvQuotes(c.UnifiCACert)
+	c.UnifiClientCert = stripEnvQuotes(c.UnifiClientCert)
+	c.UnifiClientKey = stripEnvQuotes(c.UnifiClientKey)
+	c.UnifiTLSServerName = stripEnvQuotes(c.UnifiTLSServerName)
+	c.UnifiHTTPProxy = stripEnvQuotes(c.UnifiHTTPProxy)
+	c.WebhookURL = stripEnvQuotes(c.WebhookURL)
+	c.WebhookSecret = stripEnvQuotes(c.WebhookSecret)
 	c.CrowdSecLAPIURL = stripEnvQuotes(c.CrowdSecLAPIURL)
 	c.CrowdSecLAPIKey = stripEnvQuotes(c.CrowdSecLAPIKey)
 	c.FirewallMode = stripEnvQuotes(c.FirewallMode)
@@ -204,13 +521,21 @@ func (c *Config) sanitise() {
 	c.RuleNameTemplate = stripEnvQuotes(c.RuleNameTemplate)
 	c.PolicyNameTemplate = stripEnvQuotes(c.PolicyNameTemplate)
 	c.ObjectDescription = stripEnvQuotes(c.ObjectDescription)
+	c.GroupNameCollision = stripEnvQuotes(c.GroupNameCollision)
 	c.DataDir = stripEnvQuotes(c.DataDir)
+	c.ImportBlocklistPath = stripEnvQuotes(c.ImportBlocklistPath)
+	c.StorageBackend = stripEnvQuotes(c.StorageBackend)
+	c.RedisURL = stripEnvQuotes(c.RedisURL)
 	c.LogLevel = stripEnvQuotes(c.LogLevel)
 	c.LogFormat = stripEnvQuotes(c.LogFormat)
+	c.LogFile = stripEnvQuotes(c.LogFile)
+	c.AuditLogPath = stripEnvQuotes(c.AuditLogPath)
 	c.MetricsAddr = stripEnvQuotes(c.MetricsAddr)
 	c.HealthAddr = stripEnvQuotes(c.HealthAddr)
 	c.CloudflareIPv4URL = stripEnvQuotes(c.CloudflareIPv4URL)
 	c.CloudflareIPv6URL = stripEnvQuotes(c.CloudflareIPv6URL)
+	c.BlockCountriesIPv4URL = stripEnvQuotes(c.BlockCountriesIPv4URL)
+	c.BlockCountriesIPv6URL = stripEnvQuotes(c.BlockCountriesIPv6URL)
 
 	// Slice fields: strip each element
 	for i, s := range c.UnifiSites {
@@ -219,18 +544,33 @@ func (c *Config) sanitise() {
 	for i, s := range c.CrowdSecOrigins {
 		c.CrowdSecOrigins[i] = stripEnvQuotes(s)
 	}
+	for i, s := range c.CrowdSecOriginsExclude {
+		c.CrowdSecOriginsExclude[i] = stripEnvQuotes(s)
+	}
 	for i, s := range c.BlockWhitelist {
 		c.BlockWhitelist[i] = stripEnvQuotes(s)
 	}
+	for i, s := range c.BlockDecisionTypes {
+		c.BlockDecisionTypes[i] = stripEnvQuotes(s)
+	}
 	for i, s := range c.BlockScenarioExclude {
 		c.BlockScenarioExclude[i] = stripEnvQuotes(s)
 	}
+	for i, s := range c.BlockScenarioDuration {
+		c.BlockScenarioDuration[i] = stripEnvQuotes(s)
+	}
 	for i, s := range c.ZonePairs {
 		c.ZonePairs[i] = stripEnvQuotes(s)
 	}
+	for i, s := range c.FirewallModeOverrides {
+		c.FirewallModeOverrides[i] = stripEnvQuotes(s)
+	}
 	for i, s := range c.CloudflareZonePairs {
 		c.CloudflareZonePairs[i] = stripEnvQuotes(s)
 	}
+	for i, s := range c.BlockCountries {
+		c.BlockCountries[i] = strings.ToUpper(stripEnvQuotes(s))
+	}
 }
 
 // defaults sets sensible default values.
@@ -238,16 +578,33 @@ func defaults() map[string]interface{} {
 	return map[string]interface{}{
 		"unifi_verify_tls":            false,
 		"unifi_http_timeout":          "120s",
+		"unifi_max_retries":           3,
+		"unifi_read_concurrency":      4,
+		"unifi_clock_skew_threshold":  "30s",
+		"unifi_feature_cache_ttl":     "1h",
 		"unifi_sites":                 "default",
 		"firewall_mode":               "auto",
 		"firewall_block_action":       "drop",
+		"firewall_cidr_subsumption":   "off",
+		"firewall_aggregate_cidr":     false,
+		"firewall_log_sample_rate":    0.0,
+		"firewall_start_disabled":     false,
 		"firewall_enable_ipv6":        true,
 		"enable_ipv6":                 false,
 		"firewall_group_capacity":     10000,
+		"firewall_group_hard_max":     10000,
+		"firewall_max_shards":         0,
 		"firewall_api_shard_delay":    "250ms",
+		"firewall_new_shard_settle":   "250ms",
+		"firewall_prune_empty_shards": true,
 		"firewall_flush_concurrency":  1,
 		"firewall_reconcile_on_start": true,
 		"firewall_reconcile_interval": "0s",
+		"startup_jitter":              "0s",
+		"capability_check_interval":   "1h",
+		"reconcile_site_concurrency":  1,
+		"reconcile_banlist_retries":     2,
+		"reconcile_banlist_retry_delay": "500ms",
 		"sync_interval":               "30s",
 		"shard_limit":                 10000,
 		"shard_merge_threshold":       0,
@@ -255,10 +612,13 @@ func defaults() map[string]interface{} {
 		"rule_name_template":          "crowdsec-drop-{{.Family}}-{{.Index}}",
 		"policy_name_template":        "crowdsec-policy-{{.SrcZone}}-{{.DstZone}}-{{.Family}}-{{.Index}}",
 		"object_description":          "Managed by cs-unifi-bouncer-pro. Do not edit manually.",
+		"group_name_collision":        "adopt",
 		"legacy_rule_index_start_v4":  22000,
 		"legacy_rule_index_start_v6":  27000,
 		"legacy_ruleset_v4":           "WAN_IN",
 		"legacy_ruleset_v6":           "WANv6_IN",
+		"legacy_rule_enabled":         true,
+		"zone_policy_enabled":         true,
 		"zone_pairs":                    "External->Internal",
 		"circuit_breaker_threshold":     5,
 		"circuit_breaker_reset_interval": "60s",
@@ -266,20 +626,38 @@ func defaults() map[string]interface{} {
 		"cloudflare_refresh_interval":  "168h",
 		"cloudflare_ipv4_url":          "https://www.cloudflare.com/ips-v4",
 		"cloudflare_ipv6_url":          "https://www.cloudflare.com/ips-v6",
+		"block_countries_ipv4_url":     "https://www.ipdeny.com/ipblocks/data/aggregated/{country}-aggregated.zone",
+		"block_countries_ipv6_url":     "https://www.ipdeny.com/ipv6/ipaddresses/aggregated/{country}-aggregated.zone",
 		"crowdsec_lapi_url":           "http://crowdsec:8080",
 		"crowdsec_lapi_verify_tls":    true,
 		"crowdsec_poll_interval":      "30s",
 		"lapi_metrics_push_interval":  "30m",
+		"block_decision_types":        "ban",
+		"unban_burst_threshold":       0,
+		"unban_burst_window":          "1m",
+		"decision_dedup_cache_size":   10000,
+		"unban_priority":              false,
+		"buffer_early_decisions":      true,
+		"webhook_timeout":             "5s",
 		"session_reauth_min_gap":      "5s",
 		"session_reauth_timeout":      "10s",
 		"data_dir":                    "/data",
 		"ban_ttl":                     "168h",
+		"ban_store_max":               0,
+		"storage_backend":             "bbolt",
+		"storage_schema_policy":       "fail",
+		"storage_compact_stale_modes": true,
 		"log_level":                   "info",
 		"log_format":                  "json",
+		"log_file_max_size":           100,
+		"log_file_max_backups":        5,
+		"log_file_max_age":            "0s",
 		"metrics_enabled":             true,
 		"metrics_addr":                ":9090",
+		"otel_enabled":                false,
 		"health_addr":                 ":8081",
 		"janitor_interval":            "1h",
+		"janitor_batch_size":          500,
 	}
 }
 
@@ -299,30 +677,82 @@ func stripEnvQuotes(s string) string {
 }
 
 // Load reads configuration from environment variables, applying _FILE secret injection.
+// When CONFIG_FILE points at a YAML or TOML file, the file is loaded on top of
+// the defaults and environment variables are overlaid on top of the file, so a
+// variable set in the environment always wins.
 func Load() (*Config, error) {
+	cfg, err := LoadUnvalidated()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// LoadUnvalidated resolves the configuration exactly like Load but skips
+// Validate, so callers such as `config dump` can show an invalid config
+// alongside the validation error.
+func LoadUnvalidated() (*Config, error) {
 	// Use "." as delimiter so that env vars with "_" in their names are
 	// treated as flat keys, not nested paths. E.g. UNIFI_URL → "unifi_url"
 	// maps to struct tag koanf:"unifi_url" without any nesting.
 	k := koanf.New(".")
+	sources := make(map[string]string)
 
 	// Apply defaults first
 	defs := defaults()
 	if err := k.Load(&rawProvider{data: defs}, nil); err != nil {
 		return nil, fmt.Errorf("load defaults: %w", err)
 	}
+	for key := range defs {
+		sources[key] = SourceDefault
+	}
+
+	// Optional config file. Keys match the koanf struct tags (e.g. unifi_url).
+	if path := stripEnvQuotes(os.Getenv("CONFIG_FILE")); path != "" {
+		fk, err := loadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := k.Merge(fk); err != nil {
+			return nil, fmt.Errorf("merge config file: %w", err)
+		}
+		markSources(fk, sources, SourceConfigFile)
+
+		// Secret files named in the config file are read before the
+		// environment is merged, so UNIFI_PASSWORD and friends still win.
+		injected, err := injectFileSecrets(k, fk)
+		if err != nil {
+			return nil, fmt.Errorf("inject file secrets from config file: %w", err)
+		}
+		for _, key := range injected {
+			sources[key] = SourceSecretFile
+		}
+	}
 
 	// Load from environment — use "." as delimiter so env vars aren't split
 	// by "_". Our env var names don't contain ".", so they stay flat.
-	if err := k.Load(env.Provider("", ".", func(s string) string {
+	ek := koanf.New(".")
+	if err := ek.Load(env.Provider("", ".", func(s string) string {
 		return strings.ToLower(s)
 	}), nil); err != nil {
 		return nil, fmt.Errorf("load env: %w", err)
 	}
+	if err := k.Merge(ek); err != nil {
+		return nil, fmt.Errorf("merge env: %w", err)
+	}
+	markSources(ek, sources, SourceEnv)
 
 	// Inject _FILE secrets
-	if err := injectFileSecrets(k); err != nil {
+	injected, err := injectFileSecrets(k, ek)
+	if err != nil {
 		return nil, fmt.Errorf("inject file secrets: %w", err)
 	}
+	for _, key := range injected {
+		sources[key] = SourceSecretFile
+	}
 
 	cfg := &Config{}
 	if err := k.UnmarshalWithConf("", cfg, koanf.UnmarshalConf{Tag: "koanf"}); err != nil {
@@ -330,12 +760,29 @@ func Load() (*Config, error) {
 	}
 
 	// Post-process comma-separated list fields that koanf won't split automatically
-	cfg.UnifiSites = splitCSV(k.String("unifi_sites"))
-	cfg.CrowdSecOrigins = splitCSV(k.String("crowdsec_origins"))
-	cfg.BlockScenarioExclude = splitCSV(k.String("block_scenario_exclude"))
-	cfg.BlockWhitelist = splitCSV(k.String("block_whitelist"))
-	cfg.ZonePairs = splitZonePairList(k.String("zone_pairs"))
-	cfg.CloudflareZonePairs = splitZonePairList(k.String("cloudflare_zone_pairs"))
+	cfg.UnifiSites = splitCSV(listString(k, "unifi_sites", ","))
+	cfg.CrowdSecOrigins = splitCSV(listString(k, "crowdsec_origins", ","))
+	cfg.CrowdSecOriginsExclude = splitCSV(listString(k, "crowdsec_origins_exclude", ","))
+	cfg.BlockDecisionTypes = splitCSV(listString(k, "block_decision_types", ","))
+	cfg.BlockScenarioExclude = splitCSV(listString(k, "block_scenario_exclude", ","))
+	cfg.BlockScenarioDuration = splitCSV(listString(k, "block_scenario_duration", ","))
+	cfg.BlockWhitelist = splitCSV(listString(k, "block_whitelist", ","))
+	cfg.BlockCountries = splitCSV(listString(k, "block_countries", ","))
+	cfg.FirewallModeOverrides = splitCSV(listString(k, "firewall_mode_overrides", ","))
+	cfg.ZonePairs = splitZonePairList(listString(k, "zone_pairs", ";"))
+	cfg.CloudflareZonePairs = splitZonePairList(listString(k, "cloudflare_zone_pairs", ";"))
+	cfg.LogRedactPatterns = splitSemicolon(listString(k, "log_redact_patterns", ";"))
+
+	// Collect per-origin TTL overrides; the origin is part of the key name so
+	// they cannot be expressed as a struct field.
+	for _, key := range k.Keys() {
+		if origin, ok := strings.CutPrefix(key, banTTLOriginPrefix); ok && origin != "" {
+			if cfg.BanTTLOrigins == nil {
+				cfg.BanTTLOrigins = make(map[string]string)
+			}
+			cfg.BanTTLOrigins[origin] = stripEnvQuotes(k.String(key))
+		}
+	}
 
 	// Strip Docker env-file quoting from all string values
 	cfg.sanitise()
@@ -345,17 +792,46 @@ func Load() (*Config, error) {
 	if bw := os.Getenv("FIREWALL_BATCH_WINDOW"); bw != "" && os.Getenv("SYNC_INTERVAL") == "" {
 		if d, parseErr := time.ParseDuration(bw); parseErr == nil {
 			cfg.SyncInterval = d
+			sources["sync_interval"] = SourceEnv
 		}
 		cfg.DeprecationWarnings = append(cfg.DeprecationWarnings,
 			"FIREWALL_BATCH_WINDOW is deprecated; use SYNC_INTERVAL instead")
 	}
 
-	if err := cfg.Validate(); err != nil {
-		return nil, err
-	}
+	cfg.Sources = sources
 	return cfg, nil
 }
 
+// loadConfigFile loads a YAML (.yaml, .yml) or TOML (.toml) config file.
+// The parser is chosen by file extension.
+func loadConfigFile(path string) (*koanf.Koanf, error) {
+	var parser koanf.Parser
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		parser = yaml.Parser()
+	case ".toml":
+		parser = toml.Parser()
+	default:
+		return nil, fmt.Errorf("CONFIG_FILE %q: unsupported extension (use .yaml, .yml or .toml)", path)
+	}
+	k := koanf.New(".")
+	if err := k.Load(file.Provider(path), parser); err != nil {
+		return nil, fmt.Errorf("load config file %s: %w", path, err)
+	}
+	return k, nil
+}
+
+// listString returns the value at key as a single delimited string. Env vars
+// and defaults are already strings; config files may instead provide a native
+// list, whose elements are joined with sep so the usual splitters apply.
+func listString(k *koanf.Koanf, key, sep string) string {
+	switch k.Get(key).(type) {
+	case []interface{}, []string:
+		return strings.Join(k.Strings(key), sep)
+	}
+	return k.String(key)
+}
+
 // Validate checks required fields and semantic constraints.
 func (c *Config) Validate() error {
 	if c.UnifiURL == "" {
@@ -368,16 +844,101 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("either UNIFI_API_KEY or both UNIFI_USERNAME and UNIFI_PASSWORD are required")
 	}
 
+	if c.UnifiMaxRetries < 0 {
+		return fmt.Errorf("UNIFI_MAX_RETRIES must be >= 0; got %d", c.UnifiMaxRetries)
+	}
+	if c.UnifiReadConcurrency < 0 {
+		return fmt.Errorf("UNIFI_READ_CONCURRENCY must be >= 0; got %d", c.UnifiReadConcurrency)
+	}
+	if c.UnifiClockSkewThreshold < 0 {
+		return fmt.Errorf("UNIFI_CLOCK_SKEW_THRESHOLD must be >= 0; got %s", c.UnifiClockSkewThreshold)
+	}
+	if c.UnifiFeatureCacheTTL < 0 {
+		return fmt.Errorf("UNIFI_FEATURE_CACHE_TTL must be >= 0; got %s", c.UnifiFeatureCacheTTL)
+	}
+	if strings.ContainsAny(c.UnifiUserAgent, "\r\n") {
+		return fmt.Errorf("UNIFI_USER_AGENT must not contain line breaks")
+	}
+	if (c.UnifiClientCert == "") != (c.UnifiClientKey == "") {
+		return fmt.Errorf("UNIFI_CLIENT_CERT and UNIFI_CLIENT_KEY must be set together")
+	}
+	if c.UnifiURLFallback != "" {
+		u, err := url.Parse(c.UnifiURLFallback)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("UNIFI_URL_FALLBACK must be an http:// or https:// URL with a host; got %q", c.UnifiURLFallback)
+		}
+		if strings.TrimRight(c.UnifiURLFallback, "/") == strings.TrimRight(c.UnifiURL, "/") {
+			return fmt.Errorf("UNIFI_URL_FALLBACK must differ from UNIFI_URL")
+		}
+	}
+	if c.UnifiHTTPProxy != "" {
+		// The value is not echoed: it may carry proxy credentials.
+		u, err := url.Parse(c.UnifiHTTPProxy)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("UNIFI_HTTP_PROXY must be an http://, https:// or socks5:// URL with a host")
+		}
+	}
+
 	validModes := map[string]bool{"auto": true, "legacy": true, "zone": true}
 	if !validModes[c.FirewallMode] {
 		return fmt.Errorf("FIREWALL_MODE must be auto, legacy, or zone; got %q", c.FirewallMode)
 	}
+	if c.FirewallNewShardSettle < 0 {
+		return fmt.Errorf("FIREWALL_NEW_SHARD_SETTLE must be >= 0; got %s", c.FirewallNewShardSettle)
+	}
+
+	overrides, err := c.ParseFirewallModeOverrides()
+	if err != nil {
+		return fmt.Errorf("FIREWALL_MODE_OVERRIDES: %w", err)
+	}
+	for site := range overrides {
+		if !slices.Contains(c.UnifiSites, site) {
+			return fmt.Errorf("FIREWALL_MODE_OVERRIDES: site %q is not listed in UNIFI_SITES", site)
+		}
+	}
+
+	switch c.StorageBackend {
+	case "bbolt", "sqlite":
+	case "redis":
+		if c.RedisURL == "" {
+			return fmt.Errorf("REDIS_URL is required when STORAGE_BACKEND=redis")
+		}
+	default:
+		return fmt.Errorf("STORAGE_BACKEND must be bbolt, sqlite or redis; got %q", c.StorageBackend)
+	}
+	if c.StorageSchemaPolicy != "fail" && c.StorageSchemaPolicy != "read-only" {
+		return fmt.Errorf("STORAGE_SCHEMA_POLICY must be fail or read-only; got %q", c.StorageSchemaPolicy)
+	}
+
+	if c.DryRun && c.DryRunStoreOnly {
+		return fmt.Errorf("DRY_RUN and DRY_RUN_STORE_ONLY are mutually exclusive")
+	}
+	// Enforcement would disable again whatever the enable command turned on.
+	if c.FirewallStartDisabled && c.FirewallEnforceEnabled {
+		return fmt.Errorf("FIREWALL_START_DISABLED and FIREWALL_ENFORCE_ENABLED are mutually exclusive")
+	}
 
 	validActions := map[string]bool{"drop": true, "reject": true}
 	if !validActions[c.FirewallBlockAction] {
 		return fmt.Errorf("FIREWALL_BLOCK_ACTION must be drop or reject; got %q", c.FirewallBlockAction)
 	}
 
+	validSubsumption := map[string]bool{"off": true, "skip": true, "prune": true}
+	if !validSubsumption[c.FirewallCIDRSubsumption] {
+		return fmt.Errorf("FIREWALL_CIDR_SUBSUMPTION must be off, skip, or prune; got %q", c.FirewallCIDRSubsumption)
+	}
+
+	if c.FirewallLogSampleRate < 0 || c.FirewallLogSampleRate > 1 {
+		return fmt.Errorf("FIREWALL_LOG_SAMPLE_RATE must be between 0 and 1; got %g", c.FirewallLogSampleRate)
+	}
+	if c.FirewallLogSampleRate > 0 && !c.FirewallLogDrops {
+		return fmt.Errorf("FIREWALL_LOG_SAMPLE_RATE requires FIREWALL_LOG_DROPS=true")
+	}
+
+	if c.GroupNameCollision != "adopt" && c.GroupNameCollision != "refuse" {
+		return fmt.Errorf("GROUP_NAME_COLLISION must be adopt or refuse; got %q", c.GroupNameCollision)
+	}
+
 	// Validate Go templates
 	for _, pair := range []struct{ name, tmpl string }{
 		{"GROUP_NAME_TEMPLATE", c.GroupNameTemplate},
@@ -389,8 +950,14 @@ func (c *Config) Validate() error {
 		}
 	}
 
-	// Validate zone pairs if mode is zone or auto
-	if c.FirewallMode != "legacy" {
+	// Validate zone pairs if any site may run in zone mode
+	zoneCapable := c.FirewallMode != "legacy"
+	for _, mode := range overrides {
+		if mode != "legacy" {
+			zoneCapable = true
+		}
+	}
+	if zoneCapable {
 		if _, err := c.ParseZonePairs(); err != nil {
 			return fmt.Errorf("ZONE_PAIRS: %w", err)
 		}
@@ -408,6 +975,41 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("LOG_FORMAT must be json or text; got %q", c.LogFormat)
 	}
 
+	if len(c.BlockDecisionTypes) == 0 {
+		return fmt.Errorf("BLOCK_DECISION_TYPES must list at least one decision type")
+	}
+	for _, t := range c.BlockDecisionTypes {
+		if strings.EqualFold(t, "delete") {
+			return fmt.Errorf("BLOCK_DECISION_TYPES must not contain %q; deletions are always applied", t)
+		}
+	}
+
+	for _, expr := range c.BlockScenarioExclude {
+		if re, ok := strings.CutPrefix(expr, "re:"); ok {
+			if _, err := regexp.Compile(re); err != nil {
+				return fmt.Errorf("BLOCK_SCENARIO_EXCLUDE: invalid regex %q: %w", expr, err)
+			}
+		}
+	}
+
+	for _, expr := range c.LogRedactPatterns {
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("LOG_REDACT_PATTERNS: invalid regex %q: %w", expr, err)
+		}
+	}
+
+	if c.LogFile != "" {
+		if c.LogFileMaxSize < 1 {
+			return fmt.Errorf("LOG_FILE_MAX_SIZE must be >= 1; got %d", c.LogFileMaxSize)
+		}
+		if c.LogFileMaxBackups < 0 {
+			return fmt.Errorf("LOG_FILE_MAX_BACKUPS must be >= 0; got %d", c.LogFileMaxBackups)
+		}
+		if c.LogFileMaxAge < 0 {
+			return fmt.Errorf("LOG_FILE_MAX_AGE must be >= 0; got %s", c.LogFileMaxAge)
+		}
+	}
+
 	for _, entry := range c.BlockWhitelist {
 		entry = strings.TrimSpace(entry)
 		if entry == "" {
@@ -431,14 +1033,58 @@ func (c *Config) Validate() error {
 	if c.FirewallGroupCapacity != 0 && c.FirewallGroupCapacity < 1 {
 		return fmt.Errorf("FIREWALL_GROUP_CAPACITY must be >= 1; got %d", c.FirewallGroupCapacity)
 	}
+	if c.FirewallGroupHardMax < 0 {
+		return fmt.Errorf("FIREWALL_GROUP_HARD_MAX must be >= 0; got %d", c.FirewallGroupHardMax)
+	}
+	if c.FirewallMaxShards < 0 {
+		return fmt.Errorf("FIREWALL_MAX_SHARDS must be >= 0; got %d", c.FirewallMaxShards)
+	}
+	c.clampGroupCapacities()
 
 	if c.BanTTL <= 0 {
 		return fmt.Errorf("BAN_TTL must be > 0; got %s", c.BanTTL)
 	}
+	if _, err := c.ParseBanTTLOrigins(); err != nil {
+		return err
+	}
+	if _, err := c.ParseBlockScenarioDurations(); err != nil {
+		return err
+	}
 
 	if c.JanitorInterval <= 0 {
 		return fmt.Errorf("JANITOR_INTERVAL must be > 0; got %s", c.JanitorInterval)
 	}
+	if c.JanitorBatchSize < 1 {
+		return fmt.Errorf("JANITOR_BATCH_SIZE must be >= 1; got %d", c.JanitorBatchSize)
+	}
+	if c.BanStoreMax < 0 {
+		return fmt.Errorf("BAN_STORE_MAX must be >= 0; got %d", c.BanStoreMax)
+	}
+	if c.WebhookURL != "" {
+		// The value is not echoed: webhook URLs often embed a token.
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("WEBHOOK_URL must be an http:// or https:// URL with a host")
+		}
+		if c.WebhookTimeout <= 0 {
+			return fmt.Errorf("WEBHOOK_TIMEOUT must be > 0; got %s", c.WebhookTimeout)
+		}
+	}
+	if c.StartupJitter < 0 {
+		return fmt.Errorf("STARTUP_JITTER must be >= 0; got %s", c.StartupJitter)
+	}
+	if c.CapabilityCheckInterval < 0 {
+		return fmt.Errorf("CAPABILITY_CHECK_INTERVAL must be >= 0; got %s", c.CapabilityCheckInterval)
+	}
+	if c.ReconcileSiteConcurrency < 1 {
+		return fmt.Errorf("RECONCILE_SITE_CONCURRENCY must be >= 1; got %d", c.ReconcileSiteConcurrency)
+	}
+	if c.ReconcileBanListRetries < 0 {
+		return fmt.Errorf("RECONCILE_BANLIST_RETRIES must be >= 0; got %d", c.ReconcileBanListRetries)
+	}
+	if c.ReconcileBanListRetries > 0 && c.ReconcileBanListRetryDelay <= 0 {
+		return fmt.Errorf("RECONCILE_BANLIST_RETRY_DELAY must be > 0 when RECONCILE_BANLIST_RETRIES is set; got %s", c.ReconcileBanListRetryDelay)
+	}
 
 	if c.SyncInterval < 5*time.Second {
 		return fmt.Errorf("SYNC_INTERVAL must be at least 5s (got %s)", c.SyncInterval)
@@ -463,9 +1109,71 @@ func (c *Config) Validate() error {
 		}
 	}
 
+	if c.DecisionDedupCacheSize < 0 {
+		return fmt.Errorf("DECISION_DEDUP_CACHE_SIZE must be >= 0; got %d", c.DecisionDedupCacheSize)
+	}
+	if c.UnbanBurstThreshold < 0 {
+		return fmt.Errorf("UNBAN_BURST_THRESHOLD must be >= 0; got %d", c.UnbanBurstThreshold)
+	}
+	if c.UnbanBurstThreshold > 0 && c.UnbanBurstWindow <= 0 {
+		return fmt.Errorf("UNBAN_BURST_WINDOW must be > 0 when UNBAN_BURST_THRESHOLD is set; got %s", c.UnbanBurstWindow)
+	}
+
+	// Validate country blocking config
+	for _, code := range c.BlockCountries {
+		if !isCountryCode(code) {
+			return fmt.Errorf("BLOCK_COUNTRIES entries must be ISO 3166-1 alpha-2 codes; got %q", code)
+		}
+	}
+	if len(c.BlockCountries) > 0 {
+		if !strings.Contains(c.BlockCountriesIPv4URL, "{country}") {
+			return fmt.Errorf("BLOCK_COUNTRIES_IPV4_URL must contain {country}; got %q", c.BlockCountriesIPv4URL)
+		}
+		if c.FirewallEnableIPv6 && !strings.Contains(c.BlockCountriesIPv6URL, "{country}") {
+			return fmt.Errorf("BLOCK_COUNTRIES_IPV6_URL must contain {country}; got %q", c.BlockCountriesIPv6URL)
+		}
+	}
+
 	return nil
 }
 
+// isCountryCode reports whether s is two upper-case ASCII letters.
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, r := range s {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// clampGroupCapacities lowers the group capacities to FIREWALL_GROUP_HARD_MAX,
+// since the controller rejects larger groups on every write. A warning is
+// recorded for each value clamped.
+func (c *Config) clampGroupCapacities() {
+	if c.FirewallGroupHardMax == 0 {
+		return
+	}
+	for _, capacity := range []struct {
+		name  string
+		value *int
+	}{
+		{"FIREWALL_GROUP_CAPACITY", &c.FirewallGroupCapacity},
+		{"FIREWALL_GROUP_CAPACITY_V4", &c.FirewallGroupCapacityV4},
+		{"FIREWALL_GROUP_CAPACITY_V6", &c.FirewallGroupCapacityV6},
+	} {
+		if *capacity.value > c.FirewallGroupHardMax {
+			c.Warnings = append(c.Warnings, fmt.Sprintf(
+				"%s=%d exceeds FIREWALL_GROUP_HARD_MAX=%d; using %d",
+				capacity.name, *capacity.value, c.FirewallGroupHardMax, c.FirewallGroupHardMax))
+			*capacity.value = c.FirewallGroupHardMax
+		}
+	}
+}
+
 // InsecureLAPIURLWarning returns a non-empty warning message when the LAPI
 // connection is susceptible to eavesdropping or a man-in-the-middle attack:
 //   - http:// with a non-loopback host: LAPI key transmitted in plaintext.
@@ -508,23 +1216,25 @@ func isLoopbackHost(host string) bool {
 	return false
 }
 
-// injectFileSecrets reads _FILE env vars and injects their file contents.
+// fileSecretKeys are the settings that can be read from a file named by the
+// matching _FILE variable.
 var fileSecretKeys = []string{
 	"unifi_username",
 	"unifi_password",
 	"unifi_api_key",
 	"crowdsec_lapi_key",
+	"redis_url",
+	"unifi_http_proxy",
+	"webhook_secret",
 }
 
-func injectFileSecrets(k *koanf.Koanf) error {
+// injectFileSecrets reads the <key>_file paths set in src and stores each
+// file's contents in k under key. src is a single layer (the config file or
+// the environment), so a path only overrides values from earlier layers.
+func injectFileSecrets(k, src *koanf.Koanf) ([]string, error) {
+	var injected []string
 	for _, key := range fileSecretKeys {
-		fileKey := key + "_file"
-		filePath := k.String(fileKey)
-		if filePath == "" {
-			// Also check uppercased env var with _FILE suffix
-			envKey := strings.ToUpper(key) + "_FILE"
-			filePath = os.Getenv(envKey)
-		}
+		filePath := src.String(key + "_file")
 		if filePath == "" {
 			continue
 		}
@@ -532,14 +1242,15 @@ func injectFileSecrets(k *koanf.Koanf) error {
 		filePath = stripEnvQuotes(filePath)
 		content, err := os.ReadFile(filePath)
 		if err != nil {
-			return fmt.Errorf("reading secret file for %s (%s): %w", key, filePath, err)
+			return nil, fmt.Errorf("reading secret file for %s (%s): %w", key, filePath, err)
 		}
 		val := strings.TrimSpace(string(content))
 		if err := k.Set(key, val); err != nil {
-			return fmt.Errorf("setting %s from file: %w", key, err)
+			return nil, fmt.Errorf("setting %s from file: %w", key, err)
 		}
+		injected = append(injected, key)
 	}
-	return nil
+	return injected, nil
 }
 
 func splitCSV(s string) []string {
@@ -557,6 +1268,23 @@ func splitCSV(s string) []string {
 	return result
 }
 
+// splitSemicolon splits a semicolon-separated list, for values such as regular
+// expressions where commas are significant.
+func splitSemicolon(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	parts := strings.Split(s, ";")
+	result := make([]string, 0, len(parts))
+	for _, p := range parts {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
 // splitZonePairList splits a zone-pair list string into individual zone pair
 // strings. It handles two formats:
 //
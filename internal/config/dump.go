@@ -0,0 +1,63 @@
+package config
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/logger"
+	"github.com/knadh/koanf/v2"
+)
+
+// Value sources reported in Config.Sources.
+const (
+	SourceDefault    = "default"
+	SourceConfigFile = "config_file"
+	SourceEnv        = "env"
+	SourceSecretFile = "secret_file"
+)
+
+// DumpEntry is a single resolved setting as reported by Dump.
+type DumpEntry struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"` // "" when the setting is unset
+}
+
+// Dump returns every setting keyed by its koanf key, with durations rendered
+// as strings. A string setting is masked as logger.Redacted when the log
+// redaction (including LOG_REDACT_PATTERNS) would mask it as key=value.
+func (c *Config) Dump() map[string]DumpEntry {
+	// Invalid patterns are reported by Validate; the defaults still apply.
+	extra, _ := logger.CompilePatterns(c.LogRedactPatterns)
+	out := make(map[string]DumpEntry)
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("koanf")
+		if key == "" || key == "-" {
+			continue
+		}
+		var val interface{} = v.Field(i).Interface()
+		if d, ok := val.(time.Duration); ok {
+			val = d.String()
+		}
+		if str, ok := val.(string); ok && str != "" {
+			val = logger.RedactField(key, str, extra)
+		}
+		out[key] = DumpEntry{Value: val, Source: c.Sources[key]}
+	}
+	return out
+}
+
+// markSources records source for every Config key present in k.
+func markSources(k *koanf.Koanf, sources map[string]string, source string) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("koanf")
+		if key == "" || key == "-" {
+			continue
+		}
+		if k.Exists(key) {
+			sources[key] = source
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// reloadableKeys lists the settings that can be applied to a running daemon on
+// SIGHUP without a restart. Everything else (controller URL and credentials,
+// TLS, storage, listen addresses, naming templates, shard sizing, ...) is wired
+// into long-lived objects at startup and only takes effect after a restart.
+//
+//   - log_level:                   applied via zerolog's global level
+//   - block_whitelist:             swapped into the decision filter
+//   - sync_interval:               resets the periodic SyncDirty ticker (also
+//     covers the deprecated FIREWALL_BATCH_WINDOW alias)
+//   - firewall_reconcile_interval: resets the periodic reconcile ticker; 0 stops it
+//   - zone_pairs:                  passed to ZoneManager.Reload in zone mode
+//
+// CROWDSEC_POLL_INTERVAL is deliberately not reloadable: the CrowdSec stream
+// client reads its ticker interval once when the stream starts.
+var reloadableKeys = map[string]bool{
+	"log_level":                   true,
+	"block_whitelist":             true,
+	"sync_interval":               true,
+	"firewall_reconcile_interval": true,
+	"zone_pairs":                  true,
+}
+
+// RestartRequired compares c against next and returns the env var names of
+// settings that changed but cannot be applied without a restart, sorted.
+func (c *Config) RestartRequired(next *Config) []string {
+	var changed []string
+	cv := reflect.ValueOf(c).Elem()
+	nv := reflect.ValueOf(next).Elem()
+	t := cv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := t.Field(i).Tag.Get("koanf")
+		if key == "" || key == "-" || reloadableKeys[key] {
+			continue
+		}
+		if !reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			changed = append(changed, strings.ToUpper(key))
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
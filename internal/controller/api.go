@@ -180,25 +180,53 @@ type apiOrderedPolicyIDs struct {
 
 // --- Generic HTTP helpers ---------------------------------------------------
 
-func doGET(ctx context.Context, c *unifiClient, url, endpoint string) ([]json.RawMessage, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// maxListPages bounds how many pages a single list call follows, so that a
+// controller which keeps reporting more results cannot loop us forever.
+const maxListPages = 1000
+
+// doGET fetches a legacy list endpoint. When meta.count reports more results
+// than have arrived, the remaining pages are requested with ?offset=N and
+// accumulated into the returned slice.
+func doGET(ctx context.Context, c *unifiClient, endpointURL, endpoint string) ([]json.RawMessage, error) {
+	base, err := url.Parse(endpointURL)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("parse URL %q: %w", endpointURL, err)
 	}
-	var result []json.RawMessage
-	return result, c.withReauth(ctx, func() error {
-		resp, err := c.apiDo(ctx, req, endpoint)
+	var all []json.RawMessage
+	for page := 0; ; page++ {
+		if page >= maxListPages {
+			return nil, fmt.Errorf("%s: gave up after %d pages", endpoint, maxListPages)
+		}
+		u := *base
+		if page > 0 {
+			q := u.Query()
+			q.Set("offset", strconv.Itoa(len(all)))
+			u.RawQuery = q.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		defer resp.Body.Close()
 		var body apiResponse
-		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-			return fmt.Errorf("decode response: %w", err)
+		err = c.withReauth(ctx, func() error {
+			resp, err := c.apiDo(ctx, req, endpoint)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				return fmt.Errorf("decode response: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
-		result = body.Data
-		return nil
-	})
+		all = append(all, body.Data...)
+		if len(body.Data) == 0 || len(all) >= body.Meta.Count {
+			return all, nil
+		}
+	}
 }
 
 func doPOST(ctx context.Context, c *unifiClient, url, endpoint string, payload interface{}) (json.RawMessage, error) {
@@ -331,6 +359,14 @@ func updateFirewallGroup(ctx context.Context, c *unifiClient, site string, g Fir
 	return doPUT(ctx, c, u, "update-group", payload)
 }
 
+func bulkUpdateFirewallGroups(ctx context.Context, c *unifiClient, site string, groups []FirewallGroup) error {
+	payload := make([]apiGroup, 0, len(groups))
+	for _, g := range groups {
+		payload = append(payload, apiGroup(g))
+	}
+	return doPUT(ctx, c, groupBatchEndpoint(c.cfg.BaseURL, site), "bulk-update-groups", payload)
+}
+
 func deleteFirewallGroup(ctx context.Context, c *unifiClient, site, id string) error {
 	u := groupEndpoint(c.cfg.BaseURL, site) + "/" + id
 	return ignoreNotFound(doDELETE(ctx, c, u, "delete-group"))
@@ -396,7 +432,8 @@ func deleteFirewallRule(ctx context.Context, c *unifiClient, site, id string) er
 
 // --- Integration v1 helpers -------------------------------------------------
 
-// listAllV1Pages fetches all pages from an integration v1 paginated endpoint.
+// listAllV1Pages fetches all pages from an integration v1 paginated endpoint,
+// stopping after maxListPages.
 func listAllV1Pages(ctx context.Context, c *unifiClient, endpointURL, metricEndpoint string) ([]json.RawMessage, error) {
 	const pageLimit = 200
 	base, err := url.Parse(endpointURL)
@@ -405,7 +442,10 @@ func listAllV1Pages(ctx context.Context, c *unifiClient, endpointURL, metricEndp
 	}
 	var all []json.RawMessage
 	offset := 0
-	for {
+	for pages := 0; ; pages++ {
+		if pages >= maxListPages {
+			return nil, fmt.Errorf("%s: gave up after %d pages", metricEndpoint, maxListPages)
+		}
 		u := *base
 		q := u.Query()
 		q.Set("offset", strconv.Itoa(offset))
@@ -429,10 +469,10 @@ func listAllV1Pages(ctx context.Context, c *unifiClient, endpointURL, metricEndp
 			return nil, err
 		}
 		all = append(all, page.Data...)
-		if len(page.Data) == 0 || (page.TotalCount > 0 && offset+page.Count >= page.TotalCount) {
+		if len(page.Data) == 0 || (page.TotalCount > 0 && offset+len(page.Data) >= page.TotalCount) {
 			break
 		}
-		offset += page.Count
+		offset += len(page.Data)
 	}
 	return all, nil
 }
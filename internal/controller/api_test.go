@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -174,6 +175,72 @@ func TestListFirewallGroups(t *testing.T) {
 	}
 }
 
+// pagedGroupsHandler serves total groups in legacy envelopes of pageSize,
+// reporting the total in meta.count and honouring ?offset=N.
+func pagedGroupsHandler(t *testing.T, total, pageSize int) http.HandlerFunc {
+	t.Helper()
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		var items []json.RawMessage
+		for i := offset; i < total && i < offset+pageSize; i++ {
+			b, _ := json.Marshal(apiGroup{ID: fmt.Sprintf("g%d", i), Name: fmt.Sprintf("grp%d", i), GroupType: "address-group"})
+			items = append(items, b)
+		}
+		body := struct {
+			Data []json.RawMessage `json:"data"`
+			Meta struct {
+				RC    string `json:"rc"`
+				Count int    `json:"count"`
+			} `json:"meta"`
+		}{Data: items}
+		body.Meta.RC = "ok"
+		body.Meta.Count = total
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(body)
+	}
+}
+
+func TestListFirewallGroups_FollowsPages(t *testing.T) {
+	srv := httptest.NewServer(pagedGroupsHandler(t, 7, 3))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	groups, err := listFirewallGroups(context.Background(), c, "default")
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(groups) != 7 {
+		t.Fatalf("expected 7 groups across 3 pages, got %d", len(groups))
+	}
+	for i, g := range groups {
+		if want := fmt.Sprintf("g%d", i); g.ID != want {
+			t.Errorf("groups[%d].ID = %q, want %q", i, g.ID, want)
+		}
+	}
+}
+
+// TestListFirewallGroups_PageLimit verifies that a controller which always
+// reports more results stops the loop at maxListPages with an error.
+func TestListFirewallGroups_PageLimit(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body := makeAPIResp(apiGroup{ID: "g", Name: "grp", GroupType: "address-group"})
+		body = []byte(strings.Replace(string(body), `"rc":"ok"`, `"rc":"ok","count":1000000`, 1))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	if _, err := listFirewallGroups(context.Background(), c, "default"); err == nil {
+		t.Fatal("expected an error from a never-ending pager")
+	}
+	if requests != maxListPages {
+		t.Errorf("expected %d requests, got %d", maxListPages, requests)
+	}
+}
+
 func TestCreateFirewallGroup(t *testing.T) {
 	const site = "default"
 	expectedPath := fmt.Sprintf("/proxy/network/api/s/%s/rest/firewallgroup", site)
@@ -287,6 +354,30 @@ func TestListFirewallRules(t *testing.T) {
 	}
 }
 
+func TestListRulesets(t *testing.T) {
+	const site = "default"
+	respBody := makeAPIResp(
+		apiRule{ID: "r1", Ruleset: "WAN_IN"},
+		apiRule{ID: "r2", Ruleset: "LAN_IN"},
+		apiRule{ID: "r3", Ruleset: "WAN_IN"},
+		apiRule{ID: "r4", Ruleset: ""},
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(respBody)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	rulesets, err := c.ListRulesets(context.Background(), site)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(rulesets) != 2 || rulesets[0] != "LAN_IN" || rulesets[1] != "WAN_IN" {
+		t.Errorf("expected [LAN_IN WAN_IN], got %v", rulesets)
+	}
+}
+
 func TestCreateFirewallRule(t *testing.T) {
 	const site = "default"
 	expectedPath := fmt.Sprintf("/proxy/network/api/s/%s/rest/firewallrule", site)
@@ -378,6 +469,35 @@ func TestListZonePolicies(t *testing.T) {
 	}
 }
 
+// TestListZonePolicies_FollowsPages verifies that v1 paging advances by the
+// number of items received, even when the controller omits "count".
+func TestListZonePolicies_FollowsPages(t *testing.T) {
+	const siteID = testSiteUUID
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		page := apiV1Page{TotalCount: 3}
+		if offset < 3 {
+			b, _ := json.Marshal(apiV1Policy{ID: fmt.Sprintf("p%d", offset), Name: "block"})
+			page.Data = []json.RawMessage{b}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	policies, err := listZonePoliciesV1(context.Background(), c, siteID)
+	if err != nil {
+		t.Fatalf("expected no error, got: %v", err)
+	}
+	if len(policies) != 3 {
+		t.Fatalf("expected 3 policies, got %d", len(policies))
+	}
+	if policies[2].ID != "p2" {
+		t.Errorf("expected last policy ID=p2, got %q", policies[2].ID)
+	}
+}
+
 func TestCreateZonePolicy(t *testing.T) {
 	const siteID = testSiteUUID
 	expectedPath := fmt.Sprintf("/proxy/network/integration/v1/sites/%s/firewall/policies", siteID)
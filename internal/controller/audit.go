@@ -0,0 +1,172 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// AuditRecord is one line of the AUDIT_LOG_PATH file: a mutation the
+// controller accepted. Only names, IDs and counts are recorded, never request
+// bodies, so no credential can end up in the log.
+type AuditRecord struct {
+	TS      time.Time `json:"ts"`
+	Action  string    `json:"action"` // "create", "update", "delete"
+	Kind    string    `json:"kind"`   // "firewall_group", "firewall_rule", "zone_policy", "traffic_matching_list", "policy_ordering"
+	Site    string    `json:"site"`
+	Name    string    `json:"name,omitempty"`
+	ID      string    `json:"id,omitempty"`
+	Members *int      `json:"members,omitempty"` // group/list size after the change
+}
+
+// auditController wraps a Controller and appends an AuditRecord for every
+// mutation that returned without error. Reads pass straight through.
+type auditController struct {
+	Controller
+	mu  sync.Mutex
+	enc *json.Encoder
+	log zerolog.Logger
+	now func() time.Time
+}
+
+// NewAuditController returns ctrl decorated with an audit log written to w as
+// newline-delimited JSON. A failed write is logged and does not fail the call.
+func NewAuditController(ctrl Controller, w io.Writer, log zerolog.Logger) Controller {
+	return &auditController{Controller: ctrl, enc: json.NewEncoder(w), log: log, now: time.Now}
+}
+
+func (a *auditController) record(rec AuditRecord) {
+	rec.TS = a.now().UTC()
+	a.mu.Lock()
+	err := a.enc.Encode(rec)
+	a.mu.Unlock()
+	if err != nil {
+		a.log.Warn().Err(err).Str("action", rec.Action).Str("kind", rec.Kind).Str("id", rec.ID).
+			Msg("failed to write audit record")
+	}
+}
+
+func count(n int) *int { return &n }
+
+func (a *auditController) CreateFirewallGroup(ctx context.Context, site string, g FirewallGroup) (FirewallGroup, error) {
+	created, err := a.Controller.CreateFirewallGroup(ctx, site, g)
+	if err == nil {
+		a.record(AuditRecord{Action: "create", Kind: "firewall_group", Site: site, Name: created.Name, ID: created.ID,
+			Members: count(len(created.GroupMembers))})
+	}
+	return created, err
+}
+
+func (a *auditController) UpdateFirewallGroup(ctx context.Context, site string, g FirewallGroup) error {
+	err := a.Controller.UpdateFirewallGroup(ctx, site, g)
+	if err == nil {
+		a.record(AuditRecord{Action: "update", Kind: "firewall_group", Site: site, Name: g.Name, ID: g.ID,
+			Members: count(len(g.GroupMembers))})
+	}
+	return err
+}
+
+func (a *auditController) BulkUpdateFirewallGroups(ctx context.Context, site string, groups []FirewallGroup) error {
+	err := a.Controller.BulkUpdateFirewallGroups(ctx, site, groups)
+	if err == nil {
+		for _, g := range groups {
+			a.record(AuditRecord{Action: "update", Kind: "firewall_group", Site: site, Name: g.Name, ID: g.ID,
+				Members: count(len(g.GroupMembers))})
+		}
+	}
+	return err
+}
+
+func (a *auditController) DeleteFirewallGroup(ctx context.Context, site string, id string) error {
+	err := a.Controller.DeleteFirewallGroup(ctx, site, id)
+	if err == nil {
+		a.record(AuditRecord{Action: "delete", Kind: "firewall_group", Site: site, ID: id})
+	}
+	return err
+}
+
+func (a *auditController) CreateFirewallRule(ctx context.Context, site string, r FirewallRule) (FirewallRule, error) {
+	created, err := a.Controller.CreateFirewallRule(ctx, site, r)
+	if err == nil {
+		a.record(AuditRecord{Action: "create", Kind: "firewall_rule", Site: site, Name: created.Name, ID: created.ID})
+	}
+	return created, err
+}
+
+func (a *auditController) UpdateFirewallRule(ctx context.Context, site string, r FirewallRule) error {
+	err := a.Controller.UpdateFirewallRule(ctx, site, r)
+	if err == nil {
+		a.record(AuditRecord{Action: "update", Kind: "firewall_rule", Site: site, Name: r.Name, ID: r.ID})
+	}
+	return err
+}
+
+func (a *auditController) DeleteFirewallRule(ctx context.Context, site string, id string) error {
+	err := a.Controller.DeleteFirewallRule(ctx, site, id)
+	if err == nil {
+		a.record(AuditRecord{Action: "delete", Kind: "firewall_rule", Site: site, ID: id})
+	}
+	return err
+}
+
+func (a *auditController) CreateZonePolicy(ctx context.Context, site string, p ZonePolicy) (ZonePolicy, error) {
+	created, err := a.Controller.CreateZonePolicy(ctx, site, p)
+	if err == nil {
+		a.record(AuditRecord{Action: "create", Kind: "zone_policy", Site: site, Name: created.Name, ID: created.ID})
+	}
+	return created, err
+}
+
+func (a *auditController) UpdateZonePolicy(ctx context.Context, site string, p ZonePolicy) error {
+	err := a.Controller.UpdateZonePolicy(ctx, site, p)
+	if err == nil {
+		a.record(AuditRecord{Action: "update", Kind: "zone_policy", Site: site, Name: p.Name, ID: p.ID})
+	}
+	return err
+}
+
+func (a *auditController) DeleteZonePolicy(ctx context.Context, site string, id string) error {
+	err := a.Controller.DeleteZonePolicy(ctx, site, id)
+	if err == nil {
+		a.record(AuditRecord{Action: "delete", Kind: "zone_policy", Site: site, ID: id})
+	}
+	return err
+}
+
+func (a *auditController) SetPolicyOrdering(ctx context.Context, site, srcZoneID, dstZoneID string, ordering PolicyOrdering) error {
+	err := a.Controller.SetPolicyOrdering(ctx, site, srcZoneID, dstZoneID, ordering)
+	if err == nil {
+		a.record(AuditRecord{Action: "update", Kind: "policy_ordering", Site: site, Name: srcZoneID + "->" + dstZoneID})
+	}
+	return err
+}
+
+func (a *auditController) CreateTrafficMatchingList(ctx context.Context, site string, list TrafficMatchingList) (TrafficMatchingList, error) {
+	created, err := a.Controller.CreateTrafficMatchingList(ctx, site, list)
+	if err == nil {
+		a.record(AuditRecord{Action: "create", Kind: "traffic_matching_list", Site: site, Name: created.Name, ID: created.ID,
+			Members: count(len(created.Items))})
+	}
+	return created, err
+}
+
+func (a *auditController) UpdateTrafficMatchingList(ctx context.Context, site string, list TrafficMatchingList) error {
+	err := a.Controller.UpdateTrafficMatchingList(ctx, site, list)
+	if err == nil {
+		a.record(AuditRecord{Action: "update", Kind: "traffic_matching_list", Site: site, Name: list.Name, ID: list.ID,
+			Members: count(len(list.Items))})
+	}
+	return err
+}
+
+func (a *auditController) DeleteTrafficMatchingList(ctx context.Context, site string, id string) error {
+	err := a.Controller.DeleteTrafficMatchingList(ctx, site, id)
+	if err == nil {
+		a.record(AuditRecord{Action: "delete", Kind: "traffic_matching_list", Site: site, ID: id})
+	}
+	return err
+}
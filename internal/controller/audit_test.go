@@ -0,0 +1,97 @@
+package controller_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+func readAudit(t *testing.T, buf *bytes.Buffer) []controller.AuditRecord {
+	t.Helper()
+	var recs []controller.AuditRecord
+	sc := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for sc.Scan() {
+		var rec controller.AuditRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			t.Fatalf("audit line %q is not JSON: %v", sc.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditController_RecordsSuccessfulMutations(t *testing.T) {
+	ctx := context.Background()
+	mock := testutil.NewMockController()
+	var buf bytes.Buffer
+	ctrl := controller.NewAuditController(mock, &buf, zerolog.Nop())
+
+	g, err := ctrl.CreateFirewallGroup(ctx, "default", controller.FirewallGroup{
+		Name: "crowdsec-block-v4-0", GroupType: "address-group", GroupMembers: []string{"192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatalf("CreateFirewallGroup: %v", err)
+	}
+	g.GroupMembers = append(g.GroupMembers, "192.0.2.2")
+	if err := ctrl.UpdateFirewallGroup(ctx, "default", g); err != nil {
+		t.Fatalf("UpdateFirewallGroup: %v", err)
+	}
+	if _, err := ctrl.CreateZonePolicy(ctx, "default", controller.ZonePolicy{Name: "crowdsec-policy-wan-lan-v4-0"}); err != nil {
+		t.Fatalf("CreateZonePolicy: %v", err)
+	}
+	if err := ctrl.DeleteFirewallGroup(ctx, "default", g.ID); err != nil {
+		t.Fatalf("DeleteFirewallGroup: %v", err)
+	}
+	// Reads are not audited.
+	if _, err := ctrl.ListFirewallGroups(ctx, "default"); err != nil {
+		t.Fatalf("ListFirewallGroups: %v", err)
+	}
+
+	recs := readAudit(t, &buf)
+	want := []struct{ action, kind, name string }{
+		{"create", "firewall_group", "crowdsec-block-v4-0"},
+		{"update", "firewall_group", "crowdsec-block-v4-0"},
+		{"create", "zone_policy", "crowdsec-policy-wan-lan-v4-0"},
+		{"delete", "firewall_group", ""},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("got %d audit records, want %d: %+v", len(recs), len(want), recs)
+	}
+	for i, w := range want {
+		r := recs[i]
+		if r.Action != w.action || r.Kind != w.kind || r.Name != w.name || r.Site != "default" || r.ID == "" || r.TS.IsZero() {
+			t.Errorf("record %d = %+v, want %s %s %q", i, r, w.action, w.kind, w.name)
+		}
+	}
+	if recs[1].Members == nil || *recs[1].Members != 2 {
+		t.Errorf("update record members = %v, want 2", recs[1].Members)
+	}
+	if recs[3].ID != g.ID {
+		t.Errorf("delete record ID = %q, want %q", recs[3].ID, g.ID)
+	}
+	if strings.Contains(buf.String(), "192.0.2.") {
+		t.Errorf("audit log must not list group members: %s", buf.String())
+	}
+}
+
+func TestAuditController_SkipsFailedMutations(t *testing.T) {
+	mock := testutil.NewMockController()
+	mock.SetError("UpdateFirewallRule", errors.New("500 internal error"))
+	var buf bytes.Buffer
+	ctrl := controller.NewAuditController(mock, &buf, zerolog.Nop())
+
+	if err := ctrl.UpdateFirewallRule(context.Background(), "default", controller.FirewallRule{ID: "r1", Name: "x"}); err == nil {
+		t.Fatal("expected the injected error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("failed mutation was audited: %s", buf.String())
+	}
+}
@@ -1,21 +1,29 @@
 package controller
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptrace"
+	"net/url"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/logger"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/publicsuffix"
 )
 
@@ -31,18 +39,104 @@ type ClientConfig struct {
 	Debug        bool
 	ReauthMinGap time.Duration // thundering-herd guard: skip re-auth if last one was < this ago
 	EnableIPv6   bool          // dial IPv6 — false by default, set true only with working IPv6 path
+	MaxRetries   int           // retries for 429/5xx/network errors in apiDo; 0 disables
+
+	// ReadConcurrency caps in-flight list calls (UNIFI_READ_CONCURRENCY),
+	// independently of the firewall manager's write semaphore. 0 = unlimited.
+	ReadConcurrency int
+
+	// SessionCookieCache is an optional file path where session cookies are
+	// persisted so restarts can skip the login POST (SESSION_COOKIE_CACHE).
+	SessionCookieCache string
+
+	// TLSServerName overrides the hostname sent as SNI and checked against
+	// the controller certificate (UNIFI_TLS_SERVER_NAME), for a BaseURL that
+	// uses an IP address while the certificate names a host. Empty = BaseURL host.
+	TLSServerName string
+
+	// ClientCertPath and ClientKeyPath name a PEM client certificate and key
+	// presented during the TLS handshake (UNIFI_CLIENT_CERT/UNIFI_CLIENT_KEY),
+	// for controllers behind a proxy that requires mutual TLS. Both or neither.
+	ClientCertPath string
+	ClientKeyPath  string
+
+	// HTTPProxy routes controller calls through this proxy URL
+	// (UNIFI_HTTP_PROXY), overriding HTTP_PROXY/HTTPS_PROXY for UniFi only.
+	// May embed user:pass credentials. Empty = proxy from environment.
+	HTTPProxy string
+
+	// FallbackURL is a second controller URL (UNIFI_URL_FALLBACK) that
+	// requests move to after repeated connection failures to BaseURL; the
+	// primary is probed periodically and used again once it answers.
+	// Empty = no failover.
+	FallbackURL string
+
+	// ClockSkewThreshold is the controller clock offset above which the
+	// first measurement is logged as a warning (UNIFI_CLOCK_SKEW_THRESHOLD).
+	// 0 = never warn; the clock_skew_seconds gauge is updated regardless.
+	ClockSkewThreshold time.Duration
+
+	// FeatureCacheTTL is how long a HasFeature result is reused before the
+	// controller is probed again (UNIFI_FEATURE_CACHE_TTL). 0 = for the
+	// lifetime of the client.
+	FeatureCacheTTL time.Duration
+
+	// DebugBodies logs the request and response body of every API call at
+	// debug level (UNIFI_API_DEBUG_BODIES), redacted and cut at
+	// debugBodyLimit bytes.
+	DebugBodies bool
+
+	// UserAgent is sent on every controller request (UNIFI_USER_AGENT).
+	// Empty = "cs-unifi-bouncer-pro/<Version>".
+	UserAgent string
+
+	// Version is the bouncer version used in the default UserAgent.
+	Version string
 }
 
+// userAgent returns the User-Agent header value for controller requests.
+func (cfg ClientConfig) userAgent() string {
+	if cfg.UserAgent != "" {
+		return cfg.UserAgent
+	}
+	if cfg.Version == "" {
+		return defaultUserAgent
+	}
+	return defaultUserAgent + "/" + cfg.Version
+}
+
+// defaultUserAgent identifies the bouncer to the controller and to any WAF in
+// front of it when UNIFI_USER_AGENT is unset.
+const defaultUserAgent = "cs-unifi-bouncer-pro"
+
+// debugBodyLimit caps each body logged by DebugBodies; a full group member
+// list can run to hundreds of kilobytes.
+const debugBodyLimit = 4096
+
 // unifiClient implements Controller using direct HTTPS calls to the UniFi Network API.
 type unifiClient struct {
 	cfg          ClientConfig
 	http         *http.Client
 	session      *sessionManager
-	featureCache map[string]map[string]bool // site -> feature -> bool
+	featureCache map[string]map[string]featureResult // site -> feature -> result
 	cacheMu      sync.RWMutex
 	zoneIDCache  map[string]map[string]string // site key -> zone input -> zone UUID
 	siteIDCache  map[string]string            // site internalReference -> integration v1 UUID
 	log          zerolog.Logger
+
+	// readSem bounds concurrent list calls; nil = unlimited.
+	readSem chan struct{}
+
+	// retryBaseDelay overrides the package retryBaseDelay (tests only).
+	retryBaseDelay time.Duration
+
+	// failover switches requests between BaseURL and FallbackURL; nil
+	// without a fallback.
+	failover *failover
+
+	// skewChecked is set once the first clock skew measurement has been
+	// compared against ClockSkewThreshold.
+	skewChecked atomic.Bool
 }
 
 // NewClient constructs a new Controller client and performs initial login.
@@ -50,6 +144,7 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 	tlsCfg := &tls.Config{
 		InsecureSkipVerify: !cfg.VerifyTLS, //nolint:gosec // user-opted-in
 		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.TLSServerName,
 	}
 	if cfg.CACertPath != "" {
 		pem, err := os.ReadFile(cfg.CACertPath)
@@ -62,6 +157,16 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 		}
 		tlsCfg.RootCAs = pool
 	}
+	if (cfg.ClientCertPath == "") != (cfg.ClientKeyPath == "") {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if cfg.ClientCertPath != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertPath, cfg.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %s: %w", cfg.ClientCertPath, err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
 
 	// dialNetwork is "tcp4" by default to avoid happy eyeballs stalls where IPv6
 	// attempts to the UniFi controller blackhole silently for 15 seconds.
@@ -72,8 +177,19 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 		dialNetwork = "tcp"
 	}
 
+	proxy := http.ProxyFromEnvironment
+	if cfg.HTTPProxy != "" {
+		proxyURL, err := url.Parse(cfg.HTTPProxy)
+		if err != nil || proxyURL.Host == "" {
+			// The parse error quotes the URL, password included.
+			return nil, errors.New("invalid HTTP proxy URL")
+		}
+		proxy = http.ProxyURL(proxyURL)
+		log.Info().Str("proxy", proxyURL.Redacted()).Msg("routing UniFi requests through HTTP proxy")
+	}
+
 	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+		Proxy: proxy,
 		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
 			return (&net.Dialer{
 				Timeout:   30 * time.Second,
@@ -89,6 +205,8 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 		DisableKeepAlives:     false,
 	}
 
+	// The jar keeps the login cookie and any rotated Set-Cookie values the
+	// controller sends on later responses, so rotation does not force a re-auth.
 	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
 	if err != nil {
 		return nil, fmt.Errorf("create cookie jar: %w", err)
@@ -103,11 +221,14 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 	c := &unifiClient{
 		cfg:          cfg,
 		http:         httpClient,
-		featureCache: make(map[string]map[string]bool),
+		featureCache: make(map[string]map[string]featureResult),
 		zoneIDCache:  make(map[string]map[string]string),
 		siteIDCache:  make(map[string]string),
 		log:          log,
 	}
+	if cfg.ReadConcurrency > 0 {
+		c.readSem = make(chan struct{}, cfg.ReadConcurrency)
+	}
 
 	authCfg := AuthConfig{
 		BaseURL:       cfg.BaseURL,
@@ -116,8 +237,24 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 		APIKey:        cfg.APIKey,
 		ReauthTimeout: cfg.Timeout,
 		ReauthMinGap:  cfg.ReauthMinGap,
+
+		CookieCachePath: cfg.SessionCookieCache,
+		UserAgent:       cfg.userAgent(),
 	}
 	c.session = newSessionManager(authCfg, httpClient, log)
+	if cfg.FallbackURL != "" {
+		c.failover = newFailover(cfg.BaseURL, cfg.FallbackURL)
+		c.session.activeBase = c.baseURL
+	}
+
+	if c.session.loadCookieCache() {
+		err := c.probeSession(ctx)
+		if err == nil {
+			log.Info().Msg("reusing cached UniFi session")
+			return c, nil
+		}
+		log.Info().Err(err).Msg("cached UniFi session rejected; logging in")
+	}
 
 	if err := c.session.EnsureAuth(ctx); err != nil {
 		return nil, fmt.Errorf("initial login: %w", err)
@@ -125,9 +262,147 @@ func NewClient(ctx context.Context, cfg ClientConfig, log zerolog.Logger) (Contr
 	return c, nil
 }
 
-// apiDo executes an HTTP request, handling auth, metrics, and typed error translation.
-func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint string) (*http.Response, error) {
+// Retry tuning for apiDo. Backoff doubles from retryBaseDelay up to
+// retryMaxDelay; a Retry-After longer than maxRateLimitWait is not waited out
+// in-process but surfaced as ErrRateLimit so the caller's circuit breaker
+// can take over.
+const (
+	retryBaseDelay   = 500 * time.Millisecond
+	retryMaxDelay    = 10 * time.Second
+	maxRateLimitWait = 30 * time.Second
+)
+
+// apiDo executes an HTTP request via apiDoOnce, retrying up to MaxRetries
+// times on 429 (after Retry-After plus jitter) and, for idempotent methods,
+// on ErrServerBusy (5xx) and network errors (capped exponential backoff with
+// jitter). It sits below withReauth, so a 401 is returned immediately.
+func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint string) (resp *http.Response, err error) {
+	ctx, span := tracing.Start(ctx, "controller.apiDo",
+		attribute.String("unifi.endpoint", endpoint), attribute.String("http.request.method", req.Method))
+	defer func() {
+		if resp != nil {
+			span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
+		tracing.End(span, &err)
+	}()
+	for attempt := 0; ; attempt++ {
+		resp, err := c.apiDoOnce(ctx, req, endpoint)
+		if attempt >= c.cfg.MaxRetries || !canReplay(req) {
+			return resp, err
+		}
+
+		var wait time.Duration
+		var reason string
+		var rl *ErrRateLimit
+		switch {
+		case errors.As(err, &rl):
+			if rl.RetryAfter > maxRateLimitWait {
+				return resp, err
+			}
+			wait = rl.RetryAfter + jitter(backoffDelay(c.retryBase(), attempt)/2)
+			reason = "rate_limit"
+		case !isIdempotent(req.Method):
+			return resp, err
+		case errors.As(err, new(*ErrServerBusy)):
+			d := backoffDelay(c.retryBase(), attempt)
+			wait = d/2 + jitter(d/2)
+			reason = "server_error"
+		case err != nil && isTransientNetErr(ctx, err):
+			d := backoffDelay(c.retryBase(), attempt)
+			wait = d/2 + jitter(d/2)
+			reason = "network"
+		default:
+			return resp, err
+		}
+
+		if req.GetBody != nil {
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return nil, bodyErr
+			}
+			req.Body = body
+		}
+
+		metrics.APIRetries.WithLabelValues(endpoint, reason).Inc()
+		c.log.Debug().Str("endpoint", endpoint).Str("reason", reason).
+			Int("attempt", attempt+1).Dur("wait", wait).Msg("retrying UniFi API request")
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// retryBase returns the first backoff step, overridable in tests.
+func (c *unifiClient) retryBase() time.Duration {
+	if c.retryBaseDelay > 0 {
+		return c.retryBaseDelay
+	}
+	return retryBaseDelay
+}
+
+// backoffDelay returns base·2^attempt capped at retryMaxDelay.
+func backoffDelay(base time.Duration, attempt int) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < retryMaxDelay; i++ {
+		d *= 2
+	}
+	if d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return d
+}
+
+// jitter returns a random duration in [0, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(d)))
+}
+
+// canReplay reports whether req's body (if any) can be rewound for a retry.
+// http.NewRequest sets GetBody for bytes/strings readers.
+func canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// isIdempotent reports whether a request may be safely replayed after a 5xx or
+// network failure. POST is excluded: a create that reached the controller
+// before the failure would be duplicated.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isTransientNetErr reports whether err is a network-level failure worth
+// retrying. Context cancellation by the caller is never retried.
+func isTransientNetErr(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF)
+}
+
+// apiDoOnce executes a single HTTP request, handling auth, metrics, and typed error translation.
+func (c *unifiClient) apiDoOnce(ctx context.Context, req *http.Request, endpoint string) (*http.Response, error) {
 	start := time.Now()
+	var base string
+	if c.failover != nil {
+		c.maybeProbePrimary()
+		base = c.failover.rewrite(req)
+	}
 	c.session.SetAuthHeader(req)
 
 	// UniFi Network API requires these headers on every request.
@@ -137,7 +412,7 @@ func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint str
 	if req.Header.Get("Content-Type") == "" {
 		req.Header.Set("Content-Type", "application/json; charset=utf-8")
 	}
-	req.Header.Set("User-Agent", "cs-unifi-bouncer-pro")
+	req.Header.Set("User-Agent", c.cfg.userAgent())
 
 	if c.cfg.Debug {
 		c.log.Debug().Str("method", req.Method).Str("url", req.URL.String()).Msg("unifi api request")
@@ -173,8 +448,13 @@ func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint str
 		ctx = httptrace.WithClientTrace(ctx, trace)
 	}
 
+	if c.cfg.DebugBodies {
+		c.logRequestBody(req)
+	}
+
 	resp, err := c.http.Do(req.WithContext(ctx))
 	elapsed := time.Since(start)
+	c.recordFailover(ctx, base, err)
 
 	if err != nil {
 		if c.cfg.Debug {
@@ -187,6 +467,7 @@ func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint str
 
 	// Extract CSRF token from response header for cookie-based auth.
 	c.session.UpdateFromResponse(resp)
+	c.observeClockSkew(resp.Header.Get("Date"), start, elapsed)
 
 	statusLabel := fmt.Sprintf("%dxx", resp.StatusCode/100)
 	metrics.APICalls.WithLabelValues(endpoint, statusLabel).Inc()
@@ -196,18 +477,24 @@ func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint str
 		c.log.Debug().Str("method", req.Method).Str("url", req.URL.String()).
 			Int("status", resp.StatusCode).Dur("elapsed", elapsed).Msg("unifi api response")
 	}
+	if c.cfg.DebugBodies {
+		c.logResponseBody(req, resp)
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		// The controller answers 500/503 for a few seconds while it applies
+		// configuration; the body is usually HTML, not the JSON callers expect.
+		return nil, &ErrServerBusy{Status: resp.StatusCode, Msg: readErrorBody(resp)}
+	}
 
 	switch resp.StatusCode {
 	case http.StatusBadRequest:
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		_ = resp.Body.Close()
-		bodyStr := string(body)
-		if len(body) == 4096 {
-			bodyStr += "...(truncated)"
-		}
-		return nil, fmt.Errorf("bad request: %s", bodyStr)
+		return nil, &ErrBadRequest{Msg: readErrorBody(resp)}
 	case http.StatusUnauthorized:
 		_ = resp.Body.Close()
+		if c.session.RefreshCSRF(req.Header.Get("X-Csrf-Token")) {
+			return nil, &ErrUnauthorized{Msg: "HTTP 401 (CSRF token rotated)", csrfRotated: true}
+		}
 		return nil, &ErrUnauthorized{Msg: "HTTP 401"}
 	case http.StatusNotFound:
 		_ = resp.Body.Close()
@@ -221,22 +508,120 @@ func (c *unifiClient) apiDo(ctx context.Context, req *http.Request, endpoint str
 		}
 		_ = resp.Body.Close()
 		return nil, &ErrRateLimit{RetryAfter: retryAfter}
+	case http.StatusForbidden:
+		return nil, &ErrForbidden{Msg: readErrorBody(resp)}
 	case http.StatusConflict:
 		_ = resp.Body.Close()
 		return nil, &ErrConflict{Msg: "HTTP 409 conflict"}
 	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &ErrHTTPStatus{Status: resp.StatusCode, Msg: readErrorBody(resp)}
+	}
 	return resp, nil
 }
 
+// readErrorBody reads and closes the body of an error response, cut at 4 KiB.
+func readErrorBody(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+	bodyStr := string(body)
+	if len(body) == 4096 {
+		bodyStr += "...(truncated)"
+	}
+	return bodyStr
+}
+
+// logRequestBody logs the body of req without consuming it. Bodies that
+// cannot be replayed (no GetBody) are not logged.
+func (c *unifiClient) logRequestBody(req *http.Request) {
+	if req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	b, _ := io.ReadAll(io.LimitReader(body, debugBodyLimit+1))
+	if len(b) == 0 {
+		return
+	}
+	c.log.Debug().Str("method", req.Method).Str("url", req.URL.String()).
+		Str("body", debugBody(b)).Msg("unifi api request body")
+}
+
+// logResponseBody logs the start of resp's body and puts the bytes it read
+// back in front of the remainder, so callers still see the whole body.
+func (c *unifiClient) logResponseBody(req *http.Request, resp *http.Response) {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, debugBodyLimit+1))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(b), resp.Body), resp.Body}
+	c.log.Debug().Str("method", req.Method).Str("url", req.URL.String()).
+		Int("status", resp.StatusCode).Str("body", debugBody(b)).Msg("unifi api response body")
+}
+
+// debugBody redacts b and marks it truncated when it exceeds debugBodyLimit.
+func debugBody(b []byte) string {
+	truncated := len(b) > debugBodyLimit
+	if truncated {
+		b = b[:debugBodyLimit]
+	}
+	s := string(logger.Redact(b))
+	if truncated {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+// observeClockSkew estimates the controller's clock offset from a response
+// Date header, against the local time halfway through the request, and
+// publishes it as clock_skew_seconds (positive = controller ahead). The first
+// measurement is the startup check: it is logged as a warning when it exceeds
+// ClockSkewThreshold. Date has one-second resolution, so offsets of a second
+// or two are noise.
+func (c *unifiClient) observeClockSkew(date string, start time.Time, elapsed time.Duration) {
+	if date == "" {
+		return
+	}
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	skew := remote.Sub(start.Add(elapsed / 2))
+	metrics.ClockSkew.Set(skew.Seconds())
+
+	if c.skewChecked.Swap(true) {
+		return
+	}
+	if c.cfg.ClockSkewThreshold > 0 && skew.Abs() > c.cfg.ClockSkewThreshold {
+		c.log.Warn().Dur("skew", skew.Round(time.Second)).Dur("threshold", c.cfg.ClockSkewThreshold).
+			Msg("local clock differs from the UniFi controller's; ban expiry uses the local clock, so check NTP on this host")
+	}
+}
+
 // withReauth executes fn, and on ErrUnauthorized calls EnsureAuth then retries once.
+// A 401 caused by CSRF token rotation is first retried with the new token
+// alone; only if that is rejected too does it fall back to a full login.
 func (c *unifiClient) withReauth(ctx context.Context, fn func() error) error {
 	err := fn()
 	if err == nil {
 		return nil
 	}
-	if _, ok := err.(*ErrUnauthorized); !ok {
+	unauth, ok := err.(*ErrUnauthorized)
+	if !ok {
 		return err
 	}
+	if unauth.csrfRotated {
+		c.log.Debug().Msg("CSRF token rotated; retrying with the new token")
+		if err = fn(); err == nil {
+			return nil
+		}
+		if _, ok := err.(*ErrUnauthorized); !ok {
+			return err
+		}
+	}
 	if authErr := c.session.EnsureAuth(ctx); authErr != nil {
 		return fmt.Errorf("re-auth failed: %w", authErr)
 	}
@@ -259,7 +644,23 @@ func (c *unifiClient) Ping(ctx context.Context) error {
 	})
 }
 
-// Close is a no-op for stateless HTTP clients (session cookies expire server-side).
+// probeSession issues a single Ping without the re-auth retry, so a stale
+// cached session surfaces as an error instead of triggering a login.
+func (c *unifiClient) probeSession(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.BaseURL+"/api/self", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.apiDo(ctx, req, "ping")
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
+// Close is a no-op. Session cookies live in the client's cookie jar (and in
+// SESSION_COOKIE_CACHE when configured) and expire server-side.
 func (c *unifiClient) Close() error {
 	return nil
 }
@@ -278,9 +679,28 @@ func (c *unifiClient) InvalidateZoneCache(site string) {
 	c.siteIDCache = make(map[string]string)
 }
 
+// acquireRead takes a slot on the read semaphore, blocking until one is free
+// or ctx is done. The returned func releases the slot.
+func (c *unifiClient) acquireRead(ctx context.Context) (func(), error) {
+	if c.readSem == nil {
+		return func() {}, nil
+	}
+	select {
+	case c.readSem <- struct{}{}:
+		return func() { <-c.readSem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // ---- Firewall Groups -------------------------------------------------------
 
 func (c *unifiClient) ListFirewallGroups(ctx context.Context, site string) ([]FirewallGroup, error) {
+	release, err := c.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	return listFirewallGroups(ctx, c, site)
 }
 
@@ -292,6 +712,10 @@ func (c *unifiClient) UpdateFirewallGroup(ctx context.Context, site string, g Fi
 	return updateFirewallGroup(ctx, c, site, g)
 }
 
+func (c *unifiClient) BulkUpdateFirewallGroups(ctx context.Context, site string, groups []FirewallGroup) error {
+	return bulkUpdateFirewallGroups(ctx, c, site, groups)
+}
+
 func (c *unifiClient) DeleteFirewallGroup(ctx context.Context, site string, id string) error {
 	return deleteFirewallGroup(ctx, c, site, id)
 }
@@ -299,6 +723,11 @@ func (c *unifiClient) DeleteFirewallGroup(ctx context.Context, site string, id s
 // ---- Firewall Rules --------------------------------------------------------
 
 func (c *unifiClient) ListFirewallRules(ctx context.Context, site string) ([]FirewallRule, error) {
+	release, err := c.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	return listFirewallRules(ctx, c, site)
 }
 
@@ -314,6 +743,14 @@ func (c *unifiClient) DeleteFirewallRule(ctx context.Context, site string, id st
 	return deleteFirewallRule(ctx, c, site, id)
 }
 
+func (c *unifiClient) ListRulesets(ctx context.Context, site string) ([]string, error) {
+	rules, err := c.ListFirewallRules(ctx, site)
+	if err != nil {
+		return nil, err
+	}
+	return DistinctRulesets(rules), nil
+}
+
 // ---- Site and Zone Resolution (integration v1) -----------------------------
 
 func (c *unifiClient) GetSiteID(ctx context.Context, siteName string) (string, error) {
@@ -335,6 +772,11 @@ func (c *unifiClient) DiscoverZones(ctx context.Context, site string) ([]Zone, e
 // ---- Zone Policies (integration v1) ----------------------------------------
 
 func (c *unifiClient) ListZonePolicies(ctx context.Context, site string) ([]ZonePolicy, error) {
+	release, err := c.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	siteID, err := getSiteID(ctx, c, site)
 	if err != nil {
 		return nil, err
@@ -385,6 +827,11 @@ func (c *unifiClient) SetPolicyOrdering(ctx context.Context, site, srcZoneID, ds
 // ---- Traffic Matching Lists (integration v1) --------------------------------
 
 func (c *unifiClient) ListTrafficMatchingLists(ctx context.Context, site string) ([]TrafficMatchingList, error) {
+	release, err := c.acquireRead(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 	siteID, err := getSiteID(ctx, c, site)
 	if err != nil {
 		return nil, err
@@ -2,15 +2,31 @@ package controller
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"fmt"
 	"io"
+	stdlog "log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
@@ -37,7 +53,7 @@ func newTestClient(baseURL, apiKey string) *unifiClient {
 		cfg:          cfg,
 		http:         httpClient,
 		session:      newSessionManager(authCfg, httpClient, log),
-		featureCache: make(map[string]map[string]bool),
+		featureCache: make(map[string]map[string]featureResult),
 		zoneIDCache:  make(map[string]map[string]string),
 		siteIDCache:  make(map[string]string),
 		log:          log,
@@ -69,6 +85,164 @@ func TestNewClient_Success(t *testing.T) {
 	}
 }
 
+// sessionServer is a fake controller that issues a fresh TOKEN cookie per
+// login and only accepts /api/self with a token it still considers valid.
+type sessionServer struct {
+	mu     sync.Mutex
+	logins int
+	valid  map[string]bool
+}
+
+func (s *sessionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/auth/login":
+		s.logins++
+		token := fmt.Sprintf("session-%d", s.logins)
+		s.valid[token] = true
+		http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: token, Path: "/"})
+		w.WriteHeader(http.StatusOK)
+	case "/api/self":
+		if c, err := r.Cookie("TOKEN"); err != nil || !s.valid[c.Value] {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *sessionServer) loginCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logins
+}
+
+func newCookieCacheClient(t *testing.T, baseURL, cachePath string) {
+	t.Helper()
+	_, err := NewClient(context.Background(), ClientConfig{
+		BaseURL:            baseURL,
+		Username:           "admin",
+		Password:           "secret",
+		Timeout:            5 * time.Second,
+		SessionCookieCache: cachePath,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+}
+
+// TestNewClient_ReusesCachedSession verifies that a second client started with
+// the same SESSION_COOKIE_CACHE skips the login POST.
+func TestNewClient_ReusesCachedSession(t *testing.T) {
+	fake := &sessionServer{valid: make(map[string]bool)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cachePath := filepath.Join(t.TempDir(), "session.json")
+
+	newCookieCacheClient(t, srv.URL, cachePath)
+	if got := fake.loginCount(); got != 1 {
+		t.Fatalf("logins after first start: got %d, want 1", got)
+	}
+	info, err := os.Stat(cachePath)
+	if err != nil {
+		t.Fatalf("cookie cache not written: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("cookie cache mode: got %o, want 600", perm)
+	}
+
+	newCookieCacheClient(t, srv.URL, cachePath)
+	if got := fake.loginCount(); got != 1 {
+		t.Errorf("logins after restart: got %d, want 1 (cached session reused)", got)
+	}
+}
+
+// TestNewClient_CachedSessionRejected verifies that an expired cached session
+// falls back to a full login and refreshes the cache.
+func TestNewClient_CachedSessionRejected(t *testing.T) {
+	fake := &sessionServer{valid: make(map[string]bool)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	cachePath := filepath.Join(t.TempDir(), "session.json")
+
+	newCookieCacheClient(t, srv.URL, cachePath)
+
+	// Controller restart: every existing session is invalidated.
+	fake.mu.Lock()
+	fake.valid = make(map[string]bool)
+	fake.mu.Unlock()
+
+	newCookieCacheClient(t, srv.URL, cachePath)
+	if got := fake.loginCount(); got != 2 {
+		t.Fatalf("logins after rejected cache: got %d, want 2", got)
+	}
+
+	// The refreshed cache is accepted on the next start.
+	newCookieCacheClient(t, srv.URL, cachePath)
+	if got := fake.loginCount(); got != 2 {
+		t.Errorf("logins after refreshed cache: got %d, want 2", got)
+	}
+}
+
+// TestClient_RetainsRotatedSessionCookie verifies that a Set-Cookie on an API
+// response replaces the login cookie for subsequent requests and refreshes the
+// SESSION_COOKIE_CACHE file.
+func TestClient_RetainsRotatedSessionCookie(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth/login" {
+			http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: "login", Path: "/"})
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		c, _ := r.Cookie("TOKEN")
+		if c == nil {
+			seen = append(seen, "")
+		} else {
+			seen = append(seen, c.Value)
+		}
+		if len(seen) == 1 {
+			http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: "rotated", Path: "/"})
+		}
+	}))
+	defer srv.Close()
+
+	cachePath := filepath.Join(t.TempDir(), "session.json")
+	c, err := NewClient(context.Background(), ClientConfig{
+		BaseURL:            srv.URL,
+		Username:           "admin",
+		Password:           "secret",
+		Timeout:            5 * time.Second,
+		SessionCookieCache: cachePath,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Ping(context.Background()); err != nil {
+			t.Fatalf("Ping %d: %v", i, err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 2 || seen[0] != "login" || seen[1] != "rotated" {
+		t.Fatalf("cookies sent: got %q, want [login rotated]", seen)
+	}
+	data, err := os.ReadFile(cachePath)
+	if err != nil {
+		t.Fatalf("read cookie cache: %v", err)
+	}
+	if !strings.Contains(string(data), `"rotated"`) {
+		t.Errorf("cookie cache not refreshed after rotation: %s", data)
+	}
+}
+
 // TestNewClient_LoginFailure verifies that username/password auth failures
 // are surfaced as errors during construction (401 on POST /api/auth/login).
 func TestNewClient_LoginFailure(t *testing.T) {
@@ -121,6 +295,214 @@ func TestNewClient_TLSVerification(t *testing.T) {
 	}
 }
 
+// hostnameCertServer starts a TLS server whose self-signed certificate names
+// only host (no IP SANs) and returns it with the path of the CA PEM.
+func hostnameCertServer(t *testing.T, host string) (*httptest.Server, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0) // expected handshake failures
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, caPath
+}
+
+// TestNewClient_TLSServerNameOverride verifies that a controller reached by
+// IP verifies against a hostname certificate only with TLSServerName set.
+func TestNewClient_TLSServerNameOverride(t *testing.T) {
+	srv, caPath := hostnameCertServer(t, "unifi.example.lan")
+	cfg := ClientConfig{
+		BaseURL:    srv.URL, // https://127.0.0.1:port
+		APIKey:     "test-api-key",
+		VerifyTLS:  true,
+		CACertPath: caPath,
+		Timeout:    5 * time.Second,
+	}
+
+	c, err := NewClient(context.Background(), cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Ping(context.Background()); err == nil {
+		t.Fatal("expected certificate verification to fail for the IP without an override")
+	}
+
+	cfg.TLSServerName = "unifi.example.lan"
+	c, err = NewClient(context.Background(), cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient with TLSServerName: %v", err)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping with TLSServerName: %v", err)
+	}
+}
+
+// writeClientCert writes a self-signed client certificate and its key as PEM
+// files and returns their paths with the certificate.
+func writeClientCert(t *testing.T) (certPath, keyPath string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "bouncer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath = filepath.Join(dir, "client.pem")
+	keyPath = filepath.Join(dir, "client-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath, cert
+}
+
+// TestNewClient_ClientCertificate verifies that a controller requiring
+// mutual TLS accepts the client only with the configured certificate.
+func TestNewClient_ClientCertificate(t *testing.T) {
+	certPath, keyPath, cert := writeClientCert(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0) // expected handshake failures
+	srv.StartTLS()
+	defer srv.Close()
+
+	cfg := ClientConfig{
+		BaseURL: srv.URL,
+		APIKey:  "test-api-key",
+		Timeout: 5 * time.Second,
+	}
+	c, err := NewClient(context.Background(), cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Ping(context.Background()); err == nil {
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	cfg.ClientCertPath, cfg.ClientKeyPath = certPath, keyPath
+	c, err = NewClient(context.Background(), cfg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient with client certificate: %v", err)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping with client certificate: %v", err)
+	}
+
+	cfg.ClientKeyPath = ""
+	if _, err := NewClient(context.Background(), cfg, zerolog.Nop()); err == nil ||
+		!strings.Contains(err.Error(), "must be set together") {
+		t.Errorf("NewClient with only a certificate: got %v, want a clear error", err)
+	}
+}
+
+// TestNewClient_HTTPProxy verifies that HTTPProxy routes controller calls
+// through the proxy with its credentials and that the log redacts them.
+func TestNewClient_HTTPProxy(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		proxyAuth string
+		target    string
+	)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxyAuth = r.Header.Get("Proxy-Authorization")
+		target = r.URL.Host
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer proxy.Close()
+
+	var logBuf strings.Builder
+	cfg := ClientConfig{
+		BaseURL:   "http://unifi.invalid:8443",
+		APIKey:    "test-api-key",
+		Timeout:   5 * time.Second,
+		HTTPProxy: "http://proxyuser:s3cret@" + strings.TrimPrefix(proxy.URL, "http://"),
+	}
+	c, err := NewClient(context.Background(), cfg, zerolog.New(&logBuf))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping through proxy: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if target != "unifi.invalid:8443" {
+		t.Errorf("proxy saw target %q, want unifi.invalid:8443", target)
+	}
+	if !strings.HasPrefix(proxyAuth, "Basic ") {
+		t.Errorf("expected Basic Proxy-Authorization, got %q", proxyAuth)
+	}
+	if strings.Contains(logBuf.String(), "s3cret") {
+		t.Errorf("proxy password leaked into log: %s", logBuf.String())
+	}
+	if !strings.Contains(logBuf.String(), "proxyuser") {
+		t.Errorf("expected redacted proxy URL in log, got: %s", logBuf.String())
+	}
+
+	cfg.HTTPProxy = "http://proxyuser:s3cret@[bad"
+	if _, err := NewClient(context.Background(), cfg, zerolog.Nop()); err == nil {
+		t.Fatal("expected error for malformed proxy URL")
+	} else if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks proxy password: %v", err)
+	}
+}
+
 // TestApiDo_ErrorTranslation verifies that HTTP status codes are translated
 // into the appropriate typed errors.
 func TestApiDo_ErrorTranslation(t *testing.T) {
@@ -133,6 +515,9 @@ func TestApiDo_ErrorTranslation(t *testing.T) {
 		{"404 -> ErrNotFound", http.StatusNotFound, &ErrNotFound{}},
 		{"429 -> ErrRateLimit", http.StatusTooManyRequests, &ErrRateLimit{}},
 		{"409 -> ErrConflict", http.StatusConflict, &ErrConflict{}},
+		{"403 -> ErrForbidden", http.StatusForbidden, &ErrForbidden{}},
+		{"405 -> ErrHTTPStatus", http.StatusMethodNotAllowed, &ErrHTTPStatus{}},
+		{"302 -> ErrHTTPStatus", http.StatusFound, &ErrHTTPStatus{}},
 	}
 
 	for _, tc := range cases {
@@ -174,6 +559,16 @@ func TestApiDo_ErrorTranslation(t *testing.T) {
 				if !errors.As(gotErr, &e) {
 					t.Errorf("expected *ErrConflict, got %T: %v", gotErr, gotErr)
 				}
+			case *ErrForbidden:
+				var e *ErrForbidden
+				if !errors.As(gotErr, &e) {
+					t.Errorf("expected *ErrForbidden, got %T: %v", gotErr, gotErr)
+				}
+			case *ErrHTTPStatus:
+				var e *ErrHTTPStatus
+				if !errors.As(gotErr, &e) || e.Status != tc.statusCode {
+					t.Errorf("expected *ErrHTTPStatus{%d}, got %T: %v", tc.statusCode, gotErr, gotErr)
+				}
 			}
 		})
 	}
@@ -319,13 +714,8 @@ func TestPing_Success(t *testing.T) {
 // TestPing_ReturnsError verifies that Ping surfaces errors when /api/self fails.
 func TestPing_ReturnsError(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Return 500 — not a typed API error, but not 200 either.
-		// apiDo passes 5xx through to the caller, so Ping should get a non-nil
-		// response with status 500. However, since apiDo only translates
-		// 401/404/429/409, a 500 is returned as a successful resp.
-		// Ping does not inspect the status beyond what apiDo filters,
-		// so to get an error we use 401 which becomes ErrUnauthorized,
-		// then re-auth also fails (returning 401), so withReauth returns an error.
+		// 401 becomes ErrUnauthorized, re-auth also fails (returning 401),
+		// so withReauth returns an error.
 		w.WriteHeader(http.StatusUnauthorized)
 	}))
 	defer srv.Close()
@@ -336,3 +726,420 @@ func TestPing_ReturnsError(t *testing.T) {
 		t.Fatal("expected Ping to return an error, got nil")
 	}
 }
+
+// newRetryTestClient returns a test client with retries enabled and a tiny
+// backoff so retry tests run quickly.
+func newRetryTestClient(baseURL string, maxRetries int) *unifiClient {
+	c := newTestClient(baseURL, "api-key")
+	c.cfg.MaxRetries = maxRetries
+	c.retryBaseDelay = time.Millisecond
+	return c
+}
+
+// TestApiDo_RetriesRateLimit verifies that a 429 is retried after Retry-After
+// and the eventual success is returned to the caller.
+func TestApiDo_RetriesRateLimit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 3)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/test", strings.NewReader(`{}`))
+	resp, err := c.apiDo(context.Background(), req, "test")
+	if err != nil {
+		t.Fatalf("expected success after retries, got %v", err)
+	}
+	_ = resp.Body.Close()
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("server calls: got %d, want 3", got)
+	}
+}
+
+// TestApiDo_RateLimitExhausted verifies that ErrRateLimit is surfaced once
+// UNIFI_MAX_RETRIES is used up.
+func TestApiDo_RateLimitExhausted(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 2)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+	_, err := c.apiDo(context.Background(), req, "test")
+	var rl *ErrRateLimit
+	if !errors.As(err, &rl) {
+		t.Fatalf("expected ErrRateLimit, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("server calls: got %d, want 3 (1 + 2 retries)", got)
+	}
+}
+
+// TestApiDo_LongRetryAfterNotWaited verifies that a Retry-After beyond
+// maxRateLimitWait is returned immediately for the circuit breaker to handle.
+func TestApiDo_LongRetryAfterNotWaited(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 3)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+	if _, err := c.apiDo(context.Background(), req, "test"); err == nil {
+		t.Fatal("expected ErrRateLimit")
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("server calls: got %d, want 1", got)
+	}
+}
+
+// TestApiDo_Retries5xxIdempotentOnly verifies that 5xx responses are retried
+// for PUT (with the body replayed) but not for POST.
+func TestApiDo_Retries5xxIdempotentOnly(t *testing.T) {
+	var calls int32
+	var lastBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		lastBody = string(b)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 3)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, srv.URL+"/test", strings.NewReader(`{"a":1}`))
+	resp, err := c.apiDo(context.Background(), req, "test")
+	if err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("PUT: status %d after %d calls; want 200 after 2", resp.StatusCode, calls)
+	}
+	if lastBody != `{"a":1}` {
+		t.Errorf("PUT retry body: got %q", lastBody)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	req, _ = http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/test", strings.NewReader(`{}`))
+	_, err = c.apiDo(context.Background(), req, "test")
+	var busy *ErrServerBusy
+	if !errors.As(err, &busy) || busy.Status != http.StatusBadGateway {
+		t.Fatalf("POST: got %v, want ErrServerBusy with status 502", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("POST: server calls: got %d, want 1", got)
+	}
+}
+
+// TestApiDo_ServerBusy verifies that 500 and 503 responses become
+// ErrServerBusy carrying the response body instead of passing through as a
+// successful response.
+func TestApiDo_ServerBusy(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte("<html>provisioning</html>"))
+			}))
+			defer srv.Close()
+
+			c := newTestClient(srv.URL, "api-key")
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+			resp, err := c.apiDo(context.Background(), req, "test")
+			if resp != nil {
+				t.Errorf("expected nil response, got status %d", resp.StatusCode)
+			}
+			var busy *ErrServerBusy
+			if !errors.As(err, &busy) {
+				t.Fatalf("expected *ErrServerBusy, got %T: %v", err, err)
+			}
+			if busy.Status != status {
+				t.Errorf("Status: got %d, want %d", busy.Status, status)
+			}
+			if busy.Msg != "<html>provisioning</html>" {
+				t.Errorf("Msg: got %q", busy.Msg)
+			}
+		})
+	}
+}
+
+// TestApiDo_RetriesServerBusy verifies that a GET answered with 503 while the
+// controller provisions is retried until it succeeds.
+func TestApiDo_RetriesServerBusy(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 3)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+	resp, err := c.apiDo(context.Background(), req, "test")
+	if err != nil {
+		t.Fatalf("apiDo: %v", err)
+	}
+	_ = resp.Body.Close()
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("server calls: got %d, want 3", got)
+	}
+}
+
+// TestApiDo_NoRetryOnUnauthorized verifies that a 401 is returned on the
+// first attempt so withReauth can log in and retry.
+func TestApiDo_NoRetryOnUnauthorized(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	c := newRetryTestClient(srv.URL, 3)
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+	_, err := c.apiDo(context.Background(), req, "test")
+	var ua *ErrUnauthorized
+	if !errors.As(err, &ua) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("server calls: got %d, want 1", got)
+	}
+}
+
+func TestBackoffDelay_Capped(t *testing.T) {
+	if got := backoffDelay(retryBaseDelay, 0); got != retryBaseDelay {
+		t.Errorf("attempt 0: got %s, want %s", got, retryBaseDelay)
+	}
+	if got := backoffDelay(retryBaseDelay, 2); got != 4*retryBaseDelay {
+		t.Errorf("attempt 2: got %s, want %s", got, 4*retryBaseDelay)
+	}
+	if got := backoffDelay(retryBaseDelay, 20); got != retryMaxDelay {
+		t.Errorf("attempt 20: got %s, want %s", got, retryMaxDelay)
+	}
+}
+
+// TestClient_ReadConcurrencyBounded verifies that concurrent list calls never
+// exceed UNIFI_READ_CONCURRENCY in-flight requests.
+func TestClient_ReadConcurrencyBounded(t *testing.T) {
+	const limit = 2
+	var inFlight, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		_, _ = w.Write([]byte(`{"meta":{"rc":"ok"},"data":[]}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	c.readSem = make(chan struct{}, limit)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if i%2 == 0 {
+				_, err = c.ListFirewallGroups(context.Background(), "default")
+			} else {
+				_, err = c.ListFirewallRules(context.Background(), "default")
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("list call: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&peak); got > limit {
+		t.Errorf("peak concurrent reads = %d, want <= %d", got, limit)
+	}
+	if got := atomic.LoadInt32(&peak); got < 1 {
+		t.Errorf("peak concurrent reads = %d, want >= 1", got)
+	}
+}
+
+// TestClient_ReadConcurrencyHonoursContext verifies that a caller waiting for
+// a read slot gives up when its context is cancelled.
+func TestClient_ReadConcurrencyHonoursContext(t *testing.T) {
+	c := newTestClient("http://127.0.0.1:0", "api-key")
+	c.readSem = make(chan struct{}, 1)
+	c.readSem <- struct{}{} // occupy the only slot
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := c.ListFirewallGroups(ctx, "default"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestClient_ClockSkew verifies that the controller's Date header sets the
+// clock_skew_seconds gauge on every response and that only the first
+// measurement beyond ClockSkewThreshold is logged.
+func TestClient_ClockSkew(t *testing.T) {
+	var mu sync.Mutex
+	offset := 2 * time.Hour
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+	}))
+	defer srv.Close()
+
+	var logs strings.Builder
+	c := newTestClient(srv.URL, "api-key")
+	c.cfg.ClockSkewThreshold = time.Minute
+	c.log = zerolog.New(&logs)
+
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if got := promtestutil.ToFloat64(metrics.ClockSkew); got < 7190 || got > 7210 {
+		t.Errorf("clock_skew_seconds = %v, want about 7200", got)
+	}
+	if n := strings.Count(logs.String(), "local clock differs"); n != 1 {
+		t.Fatalf("skew warnings after first response = %d, want 1", n)
+	}
+
+	mu.Lock()
+	offset = -3 * time.Hour
+	mu.Unlock()
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if got := promtestutil.ToFloat64(metrics.ClockSkew); got > -10790 || got < -10810 {
+		t.Errorf("clock_skew_seconds = %v, want about -10800", got)
+	}
+	if n := strings.Count(logs.String(), "local clock differs"); n != 1 {
+		t.Errorf("skew warnings after second response = %d, want still 1", n)
+	}
+}
+
+// TestClient_ClockSkewWithinThreshold verifies that an in-sync controller
+// does not trigger the warning.
+func TestClient_ClockSkewWithinThreshold(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	var logs strings.Builder
+	c := newTestClient(srv.URL, "api-key")
+	c.cfg.ClockSkewThreshold = 30 * time.Second
+	c.log = zerolog.New(&logs)
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if strings.Contains(logs.String(), "local clock differs") {
+		t.Errorf("unexpected skew warning: %s", logs.String())
+	}
+}
+
+// TestApiDo_DebugBodies verifies that DebugBodies logs redacted, capped
+// request and response bodies while the caller still reads the full response.
+func TestApiDo_DebugBodies(t *testing.T) {
+	long := strings.Repeat("1.2.3.4,", debugBodyLimit)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"members":"`+long+`"}`)
+	}))
+	defer srv.Close()
+
+	var logs strings.Builder
+	c := newTestClient(srv.URL, "api-key")
+	c.cfg.DebugBodies = true
+	c.log = zerolog.New(&logs)
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPut, srv.URL+"/test",
+		strings.NewReader(`{"name":"crowdsec-block-v4-0","x_passphrase":"","api_key":"abcdefghijklmnop1234"}`))
+	resp, err := c.apiDo(context.Background(), req, "test")
+	if err != nil {
+		t.Fatalf("apiDo: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != `{"members":"`+long+`"}` {
+		t.Errorf("caller read %d bytes, want the full %d-byte body", len(body), len(long)+14)
+	}
+
+	out := logs.String()
+	if !strings.Contains(out, "unifi api request body") || !strings.Contains(out, "crowdsec-block-v4-0") {
+		t.Errorf("request body not logged: %s", out)
+	}
+	if strings.Contains(out, "abcdefghijklmnop1234") {
+		t.Errorf("API key not redacted: %s", out)
+	}
+	if !strings.Contains(out, "unifi api response body") || !strings.Contains(out, "...(truncated)") {
+		t.Errorf("response body not logged truncated: %s", out)
+	}
+	if len(out) > 3*debugBodyLimit {
+		t.Errorf("logged %d bytes, want bodies capped at %d", len(out), debugBodyLimit)
+	}
+}
+
+// TestApiDo_UserAgent verifies the User-Agent sent on API requests: the
+// configured UNIFI_USER_AGENT, else cs-unifi-bouncer-pro/<version>.
+func TestApiDo_UserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		version   string
+		want      string
+	}{
+		{"default", "", "1.2.3", "cs-unifi-bouncer-pro/1.2.3"},
+		{"no version", "", "", "cs-unifi-bouncer-pro"},
+		{"configured", "acme-bouncer/7", "1.2.3", "acme-bouncer/7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("User-Agent")
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			c := newTestClient(srv.URL, "api-key")
+			c.cfg.UserAgent = tt.userAgent
+			c.cfg.Version = tt.version
+			req, _ := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/test", nil)
+			resp, err := c.apiDo(context.Background(), req, "test")
+			if err != nil {
+				t.Fatalf("apiDo: %v", err)
+			}
+			_ = resp.Body.Close()
+			if got != tt.want {
+				t.Errorf("User-Agent = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
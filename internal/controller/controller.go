@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"time"
 )
 
@@ -83,6 +84,9 @@ type Controller interface {
 	ListFirewallGroups(ctx context.Context, site string) ([]FirewallGroup, error)
 	CreateFirewallGroup(ctx context.Context, site string, g FirewallGroup) (FirewallGroup, error)
 	UpdateFirewallGroup(ctx context.Context, site string, g FirewallGroup) error
+	// BulkUpdateFirewallGroups replaces the members of several groups in one
+	// request. Only call when HasFeature(FeatureBulkFirewallGroups) is true.
+	BulkUpdateFirewallGroups(ctx context.Context, site string, groups []FirewallGroup) error
 	DeleteFirewallGroup(ctx context.Context, site string, id string) error
 
 	// Legacy Rules (WAN_IN / WANv6_IN) — legacy mode only
@@ -90,6 +94,9 @@ type Controller interface {
 	CreateFirewallRule(ctx context.Context, site string, r FirewallRule) (FirewallRule, error)
 	UpdateFirewallRule(ctx context.Context, site string, r FirewallRule) error
 	DeleteFirewallRule(ctx context.Context, site string, id string) error
+	// ListRulesets returns the distinct ruleset names ("WAN_IN", "WANv6_IN",
+	// or localized equivalents) referenced by the site's firewall rules, sorted.
+	ListRulesets(ctx context.Context, site string) ([]string, error)
 
 	// Zone-Based Policies — integration v1
 	ListZonePolicies(ctx context.Context, site string) ([]ZonePolicy, error)
@@ -122,17 +129,46 @@ type Controller interface {
 	Close() error
 }
 
+// DistinctRulesets returns the sorted, de-duplicated non-empty Ruleset values of rules.
+func DistinctRulesets(rules []FirewallRule) []string {
+	seen := make(map[string]bool, len(rules))
+	out := make([]string, 0)
+	for _, r := range rules {
+		if r.Ruleset == "" || seen[r.Ruleset] {
+			continue
+		}
+		seen[r.Ruleset] = true
+		out = append(out, r.Ruleset)
+	}
+	sort.Strings(out)
+	return out
+}
+
 // --- Typed errors -----------------------------------------------------------
 
 // ErrUnauthorized is returned on HTTP 401 responses.
 type ErrUnauthorized struct {
 	Msg string
+
+	// csrfRotated marks a 401 caused by a rotated CSRF token; the request
+	// can be resent with the new token without logging in again.
+	csrfRotated bool
 }
 
 func (e *ErrUnauthorized) Error() string {
 	return fmt.Sprintf("unauthorized: %s", e.Msg)
 }
 
+// ErrForbidden is returned on HTTP 403 responses, typically when the API key
+// or account is read-only. Msg holds the (truncated) response body.
+type ErrForbidden struct {
+	Msg string
+}
+
+func (e *ErrForbidden) Error() string {
+	return fmt.Sprintf("forbidden: HTTP 403: %s", e.Msg)
+}
+
 // ErrNotFound is returned when a resource does not exist.
 type ErrNotFound struct {
 	URL string
@@ -154,7 +190,29 @@ func (e *ErrRateLimit) Error() string {
 	return fmt.Sprintf("rate limited (retry after %s)", e.RetryAfter)
 }
 
-// ErrConflict is returned when a create operation would cause a duplicate.
+// ErrBadRequest is returned on HTTP 400 responses. Msg holds the (truncated)
+// response body, which usually names the rejected field.
+type ErrBadRequest struct {
+	Msg string
+}
+
+func (e *ErrBadRequest) Error() string {
+	return fmt.Sprintf("bad request: %s", e.Msg)
+}
+
+// ErrServerBusy is returned on HTTP 5xx responses, which the controller sends
+// while it applies configuration. Msg holds the (truncated) response body.
+type ErrServerBusy struct {
+	Status int
+	Msg    string
+}
+
+func (e *ErrServerBusy) Error() string {
+	return fmt.Sprintf("server busy: HTTP %d: %s", e.Status, e.Msg)
+}
+
+// ErrConflict is returned (HTTP 409) when a create would cause a duplicate or
+// an update collides with a concurrent change to the same object.
 type ErrConflict struct {
 	Msg string
 }
@@ -163,6 +221,17 @@ func (e *ErrConflict) Error() string {
 	return fmt.Sprintf("conflict: %s", e.Msg)
 }
 
+// ErrHTTPStatus is returned for any other non-2xx response that has no more
+// specific error type (e.g. 405). Msg holds the (truncated) response body.
+type ErrHTTPStatus struct {
+	Status int
+	Msg    string
+}
+
+func (e *ErrHTTPStatus) Error() string {
+	return fmt.Sprintf("unexpected HTTP %d: %s", e.Status, e.Msg)
+}
+
 // ignoreNotFound returns nil if err wraps *ErrNotFound, otherwise returns err.
 // Makes DELETE operations idempotent: "not found" means the object is already absent.
 func ignoreNotFound(err error) error {
@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+)
+
+// Failover tuning for UNIFI_URL_FALLBACK.
+const (
+	// failoverThreshold is the number of consecutive connection failures
+	// after which requests move to the other controller URL.
+	failoverThreshold = 3
+
+	// primaryProbeInterval is how often the primary is probed while the
+	// fallback is active.
+	primaryProbeInterval = time.Minute
+)
+
+// failover tracks which of two controller URLs requests go to. Endpoint
+// helpers always build URLs from the primary; apiDoOnce rewrites them onto
+// the active URL, so failover is invisible to them.
+type failover struct {
+	primary  string
+	fallback string
+
+	// primaryURL and fallbackURL are primary and fallback parsed once, so
+	// rewrite can match a request on its scheme and host.
+	primaryURL  *url.URL
+	fallbackURL *url.URL
+
+	threshold     int
+	probeInterval time.Duration
+
+	mu        sync.Mutex
+	active    string
+	failures  int
+	lastProbe time.Time
+
+	// probing is set while a background probe of the primary runs.
+	probing atomic.Bool
+}
+
+func newFailover(primary, fallback string) *failover {
+	f := &failover{
+		primary:       strings.TrimRight(primary, "/"),
+		fallback:      strings.TrimRight(fallback, "/"),
+		threshold:     failoverThreshold,
+		probeInterval: primaryProbeInterval,
+	}
+	f.primaryURL, _ = url.Parse(f.primary)
+	f.fallbackURL, _ = url.Parse(f.fallback)
+	f.active = f.primary
+	f.setMetric()
+	return f
+}
+
+// current returns the active base URL.
+func (f *failover) current() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// rewrite points req at the active base URL and returns it. req may
+// already have been rewritten by an earlier attempt, so a request on either
+// base is moved. Bases are matched on scheme and host, never as a string
+// prefix: one URL may be a prefix of the other (https://10.0.0.1 and
+// https://10.0.0.10). Only the scheme, host and base path are replaced.
+func (f *failover) rewrite(req *http.Request) string {
+	active := f.current()
+	to := f.primaryURL
+	if active == f.fallback {
+		to = f.fallbackURL
+	}
+	if to == nil {
+		return active
+	}
+	for _, from := range []*url.URL{f.primaryURL, f.fallbackURL} {
+		if from == nil || from == to || !sameBase(req.URL, from) {
+			continue
+		}
+		u := *req.URL
+		u.Scheme = to.Scheme
+		u.Host = to.Host
+		if from.Path != to.Path {
+			u.Path = to.Path + strings.TrimPrefix(u.Path, from.Path)
+			u.RawPath = ""
+		}
+		req.URL = &u
+		req.Host = u.Host
+		break
+	}
+	return active
+}
+
+// sameBase reports whether u is on base: same scheme and host, and a path
+// under base's path.
+func sameBase(u, base *url.URL) bool {
+	return strings.EqualFold(u.Scheme, base.Scheme) &&
+		strings.EqualFold(u.Host, base.Host) &&
+		strings.HasPrefix(u.Path, base.Path)
+}
+
+// record counts the outcome of a request sent to base and reports whether
+// it made the other URL active. A failure against a URL that is no longer
+// active (a request in flight during a switch) is ignored.
+func (f *failover) record(base string, connFailed bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if base != f.active {
+		return false
+	}
+	if !connFailed {
+		f.failures = 0
+		return false
+	}
+	f.failures++
+	if f.failures < f.threshold {
+		return false
+	}
+	if f.active == f.primary {
+		f.active = f.fallback
+		f.lastProbe = time.Now()
+	} else {
+		f.active = f.primary
+	}
+	f.failures = 0
+	f.setMetric()
+	return true
+}
+
+// probeDue reports whether the primary should be probed now, and if so
+// claims the probe so concurrent requests do not start another.
+func (f *failover) probeDue(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == f.primary || now.Sub(f.lastProbe) < f.probeInterval {
+		return false
+	}
+	if !f.probing.CompareAndSwap(false, true) {
+		return false
+	}
+	f.lastProbe = now
+	return true
+}
+
+// restorePrimary makes the primary active again and reports whether it was not.
+func (f *failover) restorePrimary() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active == f.primary {
+		return false
+	}
+	f.active = f.primary
+	f.failures = 0
+	f.setMetric()
+	return true
+}
+
+// setMetric publishes the active URL; callers hold f.mu.
+func (f *failover) setMetric() {
+	onPrimary := 0.0
+	if f.active == f.primary {
+		onPrimary = 1
+	}
+	metrics.ControllerURLActive.WithLabelValues("primary").Set(onPrimary)
+	metrics.ControllerURLActive.WithLabelValues("fallback").Set(1 - onPrimary)
+}
+
+// baseURL returns the base URL requests currently go to.
+func (c *unifiClient) baseURL() string {
+	if c.failover == nil {
+		return c.cfg.BaseURL
+	}
+	return c.failover.current()
+}
+
+// recordFailover feeds a request outcome into the failover state and, when
+// it switches URLs, resets the session and the cached site/zone IDs so that
+// both are rebuilt against the newly active controller.
+func (c *unifiClient) recordFailover(ctx context.Context, base string, err error) {
+	if c.failover == nil {
+		return
+	}
+	connFailed := err != nil && ctx.Err() == nil
+	if !c.failover.record(base, connFailed) {
+		return
+	}
+	c.log.Warn().Err(err).Str("from", base).Str("to", c.failover.current()).
+		Msg("UniFi controller unreachable; switched controller URL")
+	c.switchedURL()
+}
+
+// maybeProbePrimary starts a background probe of the primary URL while the
+// fallback is active. Any HTTP response counts as reachable.
+func (c *unifiClient) maybeProbePrimary() {
+	if c.failover == nil || !c.failover.probeDue(time.Now()) {
+		return
+	}
+	go func() {
+		defer c.failover.probing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.failover.primary+"/", nil)
+		if err != nil {
+			return
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			c.log.Debug().Err(err).Msg("primary UniFi controller still unreachable")
+			return
+		}
+		_ = resp.Body.Close()
+		if c.failover.restorePrimary() {
+			c.log.Info().Str("url", c.failover.primary).Msg("primary UniFi controller reachable again; switched back")
+			c.switchedURL()
+		}
+	}()
+}
+
+// switchedURL drops state tied to the previous controller: the session must
+// log in again and site, zone and feature lookups are repeated.
+func (c *unifiClient) switchedURL() {
+	c.session.reset()
+	c.cacheMu.Lock()
+	c.featureCache = make(map[string]map[string]featureResult)
+	c.zoneIDCache = make(map[string]map[string]string)
+	c.siteIDCache = make(map[string]string)
+	c.cacheMu.Unlock()
+}
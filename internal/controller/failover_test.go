@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// downTransport fails every request to host while down is set, as if the
+// controller refused connections.
+type downTransport struct {
+	host string
+	down atomic.Bool
+	next http.RoundTripper
+}
+
+func (t *downTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.down.Load() && req.URL.Host == t.host {
+		return nil, errors.New("connection refused")
+	}
+	return t.next.RoundTrip(req)
+}
+
+// TestClient_FailoverToFallbackAndBack verifies that requests move to the
+// fallback URL after failoverThreshold connection failures and return to the
+// primary once a probe reaches it again.
+func TestClient_FailoverToFallbackAndBack(t *testing.T) {
+	var primaryHits, fallbackHits atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits.Add(1)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/self" {
+			t.Errorf("fallback got path %q, want /api/self", r.URL.Path)
+		}
+		fallbackHits.Add(1)
+	}))
+	defer fallback.Close()
+
+	c := newTestClient(primary.URL, "api-key")
+	tr := &downTransport{host: strings.TrimPrefix(primary.URL, "http://"), next: c.http.Transport}
+	c.http.Transport = tr
+	c.failover = newFailover(primary.URL, fallback.URL+"/")
+	c.session.activeBase = c.baseURL
+	ctx := context.Background()
+
+	tr.down.Store(true)
+	for i := 0; i < failoverThreshold; i++ {
+		if err := c.Ping(ctx); err == nil {
+			t.Fatalf("Ping %d succeeded against an unreachable primary", i+1)
+		}
+	}
+	if got := c.baseURL(); got != fallback.URL {
+		t.Fatalf("active URL = %q, want the fallback %q", got, fallback.URL)
+	}
+	if got := promtestutil.ToFloat64(metrics.ControllerURLActive.WithLabelValues("fallback")); got != 1 {
+		t.Errorf("controller_url_active{role=fallback} = %v, want 1", got)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping via fallback: %v", err)
+	}
+	if fallbackHits.Load() != 1 {
+		t.Fatalf("fallback hits = %d, want 1", fallbackHits.Load())
+	}
+
+	// The primary recovers; the next request triggers a probe that switches back.
+	tr.down.Store(false)
+	c.failover.mu.Lock()
+	c.failover.probeInterval = 0
+	c.failover.mu.Unlock()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.baseURL() != primary.URL {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not switch back to the primary")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := promtestutil.ToFloat64(metrics.ControllerURLActive.WithLabelValues("primary")); got != 1 {
+		t.Errorf("controller_url_active{role=primary} = %v, want 1", got)
+	}
+	before := primaryHits.Load()
+	if err := c.Ping(ctx); err != nil {
+		t.Fatalf("Ping after switching back: %v", err)
+	}
+	if primaryHits.Load() != before+1 {
+		t.Error("request after switching back did not reach the primary")
+	}
+}
+
+// TestFailover_HTTPErrorsDoNotSwitch verifies that only connection failures
+// count towards the threshold, and that a success resets the count.
+func TestFailover_HTTPErrorsDoNotSwitch(t *testing.T) {
+	f := newFailover("https://primary", "https://fallback")
+	for i := 0; i < failoverThreshold-1; i++ {
+		if f.record(f.primary, true) {
+			t.Fatalf("switched after %d failures", i+1)
+		}
+	}
+	f.record(f.primary, false)
+	for i := 0; i < failoverThreshold-1; i++ {
+		if f.record(f.primary, true) {
+			t.Fatal("success did not reset the failure count")
+		}
+	}
+	// A failure reported for a URL that is no longer active is ignored.
+	if f.record(f.fallback, true) {
+		t.Error("failure against the inactive URL caused a switch")
+	}
+	if !f.record(f.primary, true) {
+		t.Error("threshold reached without switching")
+	}
+}
+
+// TestFailover_RewritePrefixBases verifies that rewrite matches bases on
+// scheme and host, so a retried request already on the fallback stays there
+// when the primary URL is a string prefix of the fallback URL.
+func TestFailover_RewritePrefixBases(t *testing.T) {
+	cases := []struct {
+		primary, fallback string
+	}{
+		{"https://10.0.0.1", "https://10.0.0.10"},
+		{"https://ctl.example.com", "https://ctl.example.com:8443"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.fallback, func(t *testing.T) {
+			f := newFailover(tc.primary, tc.fallback)
+			for i := 0; i < failoverThreshold; i++ {
+				f.record(f.primary, true)
+			}
+			if f.current() != f.fallback {
+				t.Fatalf("active = %q, want the fallback", f.current())
+			}
+
+			req, err := http.NewRequest(http.MethodGet, tc.primary+"/proxy/network/api/self?x=1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.fallback + "/proxy/network/api/self?x=1"
+			// apiDo passes the same request to every retry.
+			for attempt := 1; attempt <= 2; attempt++ {
+				if got := f.rewrite(req); got != f.fallback {
+					t.Errorf("attempt %d: rewrite returned %q, want %q", attempt, got, f.fallback)
+				}
+				if got := req.URL.String(); got != want {
+					t.Errorf("attempt %d: URL = %q, want %q", attempt, got, want)
+				}
+			}
+
+			f.restorePrimary()
+			f.rewrite(req)
+			if got, want := req.URL.String(), tc.primary+"/proxy/network/api/self?x=1"; got != want {
+				t.Errorf("after switching back: URL = %q, want %q", got, want)
+			}
+			if req.Host != req.URL.Host {
+				t.Errorf("req.Host = %q, want %q", req.Host, req.URL.Host)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// rateLimitedController wraps a Controller and shares the controller's rate
+// limit across every caller. Once a mutation is answered with ErrRateLimit,
+// further mutations wait until its Retry-After has passed instead of each
+// caller (shard flush, reconcile, rule provisioning, janitor) finding out with
+// a request of its own. Reads pass straight through.
+type rateLimitedController struct {
+	Controller
+	log zerolog.Logger
+
+	mu    sync.Mutex
+	until time.Time // mutations wait until this time
+}
+
+// NewRateLimitedController returns ctrl with its write methods gated by the
+// most recent rate limit any of them received. A wait longer than
+// maxRateLimitWait is not sat out: the call fails with ErrRateLimit so the
+// caller can retry later.
+func NewRateLimitedController(ctrl Controller, log zerolog.Logger) Controller {
+	return &rateLimitedController{Controller: ctrl, log: log}
+}
+
+// wait blocks until the current rate limit window has passed.
+func (r *rateLimitedController) wait(ctx context.Context) error {
+	r.mu.Lock()
+	d := time.Until(r.until)
+	r.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	if d > maxRateLimitWait {
+		return &ErrRateLimit{RetryAfter: d}
+	}
+	r.log.Debug().Dur("wait", d).Msg("UniFi API rate limited; delaying write")
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// observe extends the rate limit window when err is an ErrRateLimit.
+func (r *rateLimitedController) observe(err error) error {
+	var rl *ErrRateLimit
+	if !errors.As(err, &rl) {
+		return err
+	}
+	until := time.Now().Add(rl.RetryAfter)
+	r.mu.Lock()
+	if until.After(r.until) {
+		r.until = until
+	}
+	r.mu.Unlock()
+	r.log.Warn().Dur("retry_after", rl.RetryAfter).Msg("UniFi API rate limited; holding writes")
+	return err
+}
+
+// gated runs call once the rate limit window has passed and records any rate
+// limit it returns.
+func gated[T any](ctx context.Context, r *rateLimitedController, call func() (T, error)) (T, error) {
+	if err := r.wait(ctx); err != nil {
+		var zero T
+		return zero, err
+	}
+	v, err := call()
+	return v, r.observe(err)
+}
+
+// gatedErr is gated for methods that return only an error.
+func gatedErr(ctx context.Context, r *rateLimitedController, call func() error) error {
+	_, err := gated(ctx, r, func() (struct{}, error) { return struct{}{}, call() })
+	return err
+}
+
+func (r *rateLimitedController) CreateFirewallGroup(ctx context.Context, site string, g FirewallGroup) (FirewallGroup, error) {
+	return gated(ctx, r, func() (FirewallGroup, error) { return r.Controller.CreateFirewallGroup(ctx, site, g) })
+}
+func (r *rateLimitedController) UpdateFirewallGroup(ctx context.Context, site string, g FirewallGroup) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.UpdateFirewallGroup(ctx, site, g) })
+}
+func (r *rateLimitedController) BulkUpdateFirewallGroups(ctx context.Context, site string, groups []FirewallGroup) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.BulkUpdateFirewallGroups(ctx, site, groups) })
+}
+func (r *rateLimitedController) DeleteFirewallGroup(ctx context.Context, site, id string) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.DeleteFirewallGroup(ctx, site, id) })
+}
+func (r *rateLimitedController) CreateFirewallRule(ctx context.Context, site string, rule FirewallRule) (FirewallRule, error) {
+	return gated(ctx, r, func() (FirewallRule, error) { return r.Controller.CreateFirewallRule(ctx, site, rule) })
+}
+func (r *rateLimitedController) UpdateFirewallRule(ctx context.Context, site string, rule FirewallRule) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.UpdateFirewallRule(ctx, site, rule) })
+}
+func (r *rateLimitedController) DeleteFirewallRule(ctx context.Context, site, id string) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.DeleteFirewallRule(ctx, site, id) })
+}
+func (r *rateLimitedController) CreateZonePolicy(ctx context.Context, site string, p ZonePolicy) (ZonePolicy, error) {
+	return gated(ctx, r, func() (ZonePolicy, error) { return r.Controller.CreateZonePolicy(ctx, site, p) })
+}
+func (r *rateLimitedController) UpdateZonePolicy(ctx context.Context, site string, p ZonePolicy) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.UpdateZonePolicy(ctx, site, p) })
+}
+func (r *rateLimitedController) DeleteZonePolicy(ctx context.Context, site, id string) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.DeleteZonePolicy(ctx, site, id) })
+}
+func (r *rateLimitedController) SetPolicyOrdering(ctx context.Context, site, srcZoneID, dstZoneID string, o PolicyOrdering) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.SetPolicyOrdering(ctx, site, srcZoneID, dstZoneID, o) })
+}
+func (r *rateLimitedController) CreateTrafficMatchingList(ctx context.Context, site string, l TrafficMatchingList) (TrafficMatchingList, error) {
+	return gated(ctx, r, func() (TrafficMatchingList, error) { return r.Controller.CreateTrafficMatchingList(ctx, site, l) })
+}
+func (r *rateLimitedController) UpdateTrafficMatchingList(ctx context.Context, site string, l TrafficMatchingList) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.UpdateTrafficMatchingList(ctx, site, l) })
+}
+func (r *rateLimitedController) DeleteTrafficMatchingList(ctx context.Context, site, id string) error {
+	return gatedErr(ctx, r, func() error { return r.Controller.DeleteTrafficMatchingList(ctx, site, id) })
+}
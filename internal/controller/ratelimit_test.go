@@ -0,0 +1,80 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+// TestRateLimitedController_HoldsWritesAfter429 verifies that a rate limit
+// returned to one write delays the next write of any kind, and that reads are
+// not held.
+func TestRateLimitedController_HoldsWritesAfter429(t *testing.T) {
+	ctx := context.Background()
+	mock := testutil.NewMockController()
+	ctrl := controller.NewRateLimitedController(mock, zerolog.Nop())
+
+	const retryAfter = 100 * time.Millisecond
+	mock.SetError("UpdateFirewallGroup", &controller.ErrRateLimit{RetryAfter: retryAfter})
+	err := ctrl.UpdateFirewallGroup(ctx, "default", controller.FirewallGroup{ID: "g1"})
+	var rl *controller.ErrRateLimit
+	if !errors.As(err, &rl) {
+		t.Fatalf("UpdateFirewallGroup error = %v, want ErrRateLimit", err)
+	}
+
+	start := time.Now()
+	if _, err := ctrl.ListFirewallGroups(ctx, "default"); err != nil {
+		t.Fatalf("ListFirewallGroups: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > retryAfter/2 {
+		t.Errorf("read waited %s, want no wait", elapsed)
+	}
+
+	if _, err := ctrl.CreateFirewallRule(ctx, "default", controller.FirewallRule{Name: "r"}); err != nil {
+		t.Fatalf("CreateFirewallRule: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < retryAfter/2 {
+		t.Errorf("write after rate limit ran after %s, want it held for about %s", elapsed, retryAfter)
+	}
+}
+
+// TestRateLimitedController_LongWindowFailsFast verifies that a Retry-After
+// too long to wait out fails further writes with ErrRateLimit without
+// reaching the controller.
+func TestRateLimitedController_LongWindowFailsFast(t *testing.T) {
+	ctx := context.Background()
+	mock := testutil.NewMockController()
+	ctrl := controller.NewRateLimitedController(mock, zerolog.Nop())
+
+	mock.SetError("DeleteZonePolicy", &controller.ErrRateLimit{RetryAfter: 10 * time.Minute})
+	_ = ctrl.DeleteZonePolicy(ctx, "default", "p1")
+
+	err := ctrl.DeleteZonePolicy(ctx, "default", "p1")
+	var rl *controller.ErrRateLimit
+	if !errors.As(err, &rl) || rl.RetryAfter <= 0 {
+		t.Fatalf("second DeleteZonePolicy error = %v, want ErrRateLimit with the remaining wait", err)
+	}
+	if n := mock.Calls("DeleteZonePolicy"); n != 1 {
+		t.Errorf("DeleteZonePolicy reached the controller %d times, want 1", n)
+	}
+}
+
+// TestRateLimitedController_WaitHonoursContext verifies that a held write
+// returns when its context is cancelled.
+func TestRateLimitedController_WaitHonoursContext(t *testing.T) {
+	mock := testutil.NewMockController()
+	ctrl := controller.NewRateLimitedController(mock, zerolog.Nop())
+	mock.SetError("DeleteFirewallGroup", &controller.ErrRateLimit{RetryAfter: 20 * time.Second})
+	_ = ctrl.DeleteFirewallGroup(context.Background(), "default", "g1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := ctrl.DeleteFirewallGroup(ctx, "default", "g1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DeleteFirewallGroup error = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,65 @@
+package controller
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrReadOnly is returned by every mutating method of a controller wrapped
+// with NewReadOnlyController.
+var ErrReadOnly = errors.New("controller is read-only")
+
+// readOnlyController wraps a Controller and rejects every mutation with
+// ErrReadOnly before it reaches the API. Reads pass straight through.
+type readOnlyController struct {
+	Controller
+}
+
+// NewReadOnlyController returns ctrl with all write methods disabled, for
+// commands that must never change the controller (verify).
+func NewReadOnlyController(ctrl Controller) Controller {
+	return readOnlyController{Controller: ctrl}
+}
+
+func (readOnlyController) CreateFirewallGroup(context.Context, string, FirewallGroup) (FirewallGroup, error) {
+	return FirewallGroup{}, ErrReadOnly
+}
+func (readOnlyController) UpdateFirewallGroup(context.Context, string, FirewallGroup) error {
+	return ErrReadOnly
+}
+func (readOnlyController) BulkUpdateFirewallGroups(context.Context, string, []FirewallGroup) error {
+	return ErrReadOnly
+}
+func (readOnlyController) DeleteFirewallGroup(context.Context, string, string) error {
+	return ErrReadOnly
+}
+func (readOnlyController) CreateFirewallRule(context.Context, string, FirewallRule) (FirewallRule, error) {
+	return FirewallRule{}, ErrReadOnly
+}
+func (readOnlyController) UpdateFirewallRule(context.Context, string, FirewallRule) error {
+	return ErrReadOnly
+}
+func (readOnlyController) DeleteFirewallRule(context.Context, string, string) error {
+	return ErrReadOnly
+}
+func (readOnlyController) CreateZonePolicy(context.Context, string, ZonePolicy) (ZonePolicy, error) {
+	return ZonePolicy{}, ErrReadOnly
+}
+func (readOnlyController) UpdateZonePolicy(context.Context, string, ZonePolicy) error {
+	return ErrReadOnly
+}
+func (readOnlyController) DeleteZonePolicy(context.Context, string, string) error {
+	return ErrReadOnly
+}
+func (readOnlyController) SetPolicyOrdering(context.Context, string, string, string, PolicyOrdering) error {
+	return ErrReadOnly
+}
+func (readOnlyController) CreateTrafficMatchingList(context.Context, string, TrafficMatchingList) (TrafficMatchingList, error) {
+	return TrafficMatchingList{}, ErrReadOnly
+}
+func (readOnlyController) UpdateTrafficMatchingList(context.Context, string, TrafficMatchingList) error {
+	return ErrReadOnly
+}
+func (readOnlyController) DeleteTrafficMatchingList(context.Context, string, string) error {
+	return ErrReadOnly
+}
@@ -3,9 +3,14 @@ package controller
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,6 +26,13 @@ type AuthConfig struct {
 	APIKey        string
 	ReauthTimeout time.Duration
 	ReauthMinGap  time.Duration
+
+	// CookieCachePath, when set, persists the session cookies after each
+	// successful login so a restarted process can reuse them.
+	CookieCachePath string
+
+	// UserAgent is sent on the login request; see ClientConfig.UserAgent.
+	UserAgent string
 }
 
 // sessionManager guards re-authentication with a mutex to prevent thundering herd.
@@ -31,6 +43,15 @@ type sessionManager struct {
 	csrfToken  string // cached from X-Csrf-Token response header
 	lastReauth time.Time
 	log        zerolog.Logger
+
+	// cachedCookies is the last cookie set written to CookieCachePath, used to
+	// skip rewriting the cache when a response does not change the session.
+	cachedCookies string
+
+	// activeBase returns the controller URL currently in use when
+	// UNIFI_URL_FALLBACK is set; nil = always cfg.BaseURL. The cookie cache
+	// stays keyed to cfg.BaseURL.
+	activeBase func() string
 }
 
 func newSessionManager(cfg AuthConfig, httpClient *http.Client, log zerolog.Logger) *sessionManager {
@@ -41,6 +62,24 @@ func newSessionManager(cfg AuthConfig, httpClient *http.Client, log zerolog.Logg
 	}
 }
 
+// base returns the controller URL to log in to.
+func (s *sessionManager) base() string {
+	if s.activeBase != nil {
+		return s.activeBase()
+	}
+	return s.cfg.BaseURL
+}
+
+// reset forgets the CSRF token and the last re-auth time after a switch to
+// another controller URL, so the next 401 logs in without waiting out
+// ReauthMinGap.
+func (s *sessionManager) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.csrfToken = ""
+	s.lastReauth = time.Time{}
+}
+
 // EnsureAuth is called by client.go only when a 401 response is detected.
 // The mutex ensures only one of N workers executes Login concurrently.
 func (s *sessionManager) EnsureAuth(ctx context.Context) error {
@@ -92,6 +131,8 @@ func (s *sessionManager) SetAuthHeader(req *http.Request) {
 
 // UpdateFromResponse extracts the CSRF token from the response header and stores it.
 // This is called after every API response to handle CSRF token rotation.
+// Rotated session cookies are already stored by the client's cookie jar; when
+// a response sets cookies, the persisted cookie cache is refreshed as well.
 func (s *sessionManager) UpdateFromResponse(resp *http.Response) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -99,6 +140,68 @@ func (s *sessionManager) UpdateFromResponse(resp *http.Response) {
 	if token := resp.Header.Get("X-Csrf-Token"); token != "" {
 		s.csrfToken = token
 	}
+	if len(resp.Header.Values("Set-Cookie")) > 0 {
+		if err := s.saveCookieCache(); err != nil {
+			s.log.Warn().Err(err).Str("path", s.cfg.CookieCachePath).Msg("failed to persist rotated session cookies")
+		}
+	}
+}
+
+// RefreshCSRF reports whether a 401 to a request sent with token sent was
+// caused by CSRF token rotation rather than an expired session: the token
+// has changed since the request was built, either through the X-Csrf-Token
+// header of the 401 itself (already stored by UpdateFromResponse) or through
+// the csrfToken claim of the TOKEN cookie. The new token is kept, so the
+// caller can simply resend the request without logging in again.
+func (s *sessionManager) RefreshCSRF(sent string) bool {
+	if s.cfg.APIKey != "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.csrfToken != "" && s.csrfToken != sent {
+		return true
+	}
+	if token := s.csrfFromCookie(); token != "" && token != sent {
+		s.csrfToken = token
+		return true
+	}
+	return false
+}
+
+// csrfFromCookie returns the csrfToken claim of the UniFi OS TOKEN cookie, a
+// JWT whose payload carries the session's current CSRF token. The signature
+// is not checked: the controller does that, the claim is only echoed back.
+func (s *sessionManager) csrfFromCookie() string {
+	if s.http.Jar == nil {
+		return ""
+	}
+	u, err := url.Parse(s.base())
+	if err != nil {
+		return ""
+	}
+	for _, c := range s.http.Jar.Cookies(u) {
+		if c.Name != "TOKEN" {
+			continue
+		}
+		parts := strings.Split(c.Value, ".")
+		if len(parts) != 3 {
+			return ""
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return ""
+		}
+		var claims struct {
+			CSRFToken string `json:"csrfToken"`
+		}
+		if json.Unmarshal(payload, &claims) != nil {
+			return ""
+		}
+		return claims.CSRFToken
+	}
+	return ""
 }
 
 // login performs the UniFi login POST and stores the session cookie.
@@ -118,11 +221,14 @@ func (s *sessionManager) login(ctx context.Context) error {
 	}
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
-		s.cfg.BaseURL+"/api/auth/login", bytes.NewReader(body))
+		s.base()+"/api/auth/login", bytes.NewReader(body))
 	if err != nil {
 		return fmt.Errorf("build login request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.UserAgent != "" {
+		req.Header.Set("User-Agent", s.cfg.UserAgent)
+	}
 
 	resp, err := s.http.Do(req)
 	if err != nil {
@@ -135,6 +241,102 @@ func (s *sessionManager) login(ctx context.Context) error {
 	}
 
 	// Cookies are automatically managed by the cookie jar (set via Set-Cookie headers).
-	// SetAuthHeader extracts the csrf_token from the jar and sends it as X-CSRF-Token header.
+	// The CSRF token comes from the login response header or, failing that,
+	// from the TOKEN cookie; SetAuthHeader sends it as X-Csrf-Token.
+	if token := resp.Header.Get("X-Csrf-Token"); token != "" {
+		s.csrfToken = token
+	} else if token := s.csrfFromCookie(); token != "" {
+		s.csrfToken = token
+	}
+	if err := s.saveCookieCache(); err != nil {
+		s.log.Warn().Err(err).Str("path", s.cfg.CookieCachePath).Msg("failed to persist session cookies")
+	}
+	return nil
+}
+
+// cachedCookie is the on-disk form of a session cookie. Only name and value are
+// kept: the jar does not expose attributes, and the controller revalidates the
+// session on first use anyway.
+type cachedCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// saveCookieCache writes the jar's cookies for the controller URL to
+// CookieCachePath (mode 0600, replaced atomically). It is a no-op when no
+// cache path or cookie jar is configured.
+func (s *sessionManager) saveCookieCache() error {
+	if s.cfg.CookieCachePath == "" || s.http.Jar == nil {
+		return nil
+	}
+	u, err := url.Parse(s.cfg.BaseURL)
+	if err != nil {
+		return err
+	}
+	cookies := s.http.Jar.Cookies(u)
+	if len(cookies) == 0 {
+		return nil
+	}
+	cached := make([]cachedCookie, 0, len(cookies))
+	for _, c := range cookies {
+		cached = append(cached, cachedCookie{Name: c.Name, Value: c.Value})
+	}
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if string(data) == s.cachedCookies {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.CookieCachePath), ".session-cookies-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // no-op after a successful rename
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// CreateTemp already uses 0600; rename keeps the permissions.
+	if err := os.Rename(tmp.Name(), s.cfg.CookieCachePath); err != nil {
+		return err
+	}
+	s.cachedCookies = string(data)
 	return nil
 }
+
+// loadCookieCache restores cookies saved by saveCookieCache into the jar and
+// reports whether any were loaded. A missing or unreadable cache is not an
+// error: the caller simply performs a full login.
+func (s *sessionManager) loadCookieCache() bool {
+	if s.cfg.APIKey != "" || s.cfg.CookieCachePath == "" || s.http.Jar == nil {
+		return false
+	}
+	data, err := os.ReadFile(s.cfg.CookieCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.log.Warn().Err(err).Str("path", s.cfg.CookieCachePath).Msg("failed to read session cookie cache")
+		}
+		return false
+	}
+	var cached []cachedCookie
+	if err := json.Unmarshal(data, &cached); err != nil || len(cached) == 0 {
+		s.log.Warn().Err(err).Str("path", s.cfg.CookieCachePath).Msg("ignoring invalid session cookie cache")
+		return false
+	}
+	u, err := url.Parse(s.cfg.BaseURL)
+	if err != nil {
+		return false
+	}
+	cookies := make([]*http.Cookie, 0, len(cached))
+	for _, c := range cached {
+		cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/"})
+	}
+	s.http.Jar.SetCookies(u, cookies)
+	s.cachedCookies = string(data)
+	return true
+}
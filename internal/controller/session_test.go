@@ -2,6 +2,9 @@ package controller
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
@@ -163,3 +166,163 @@ func TestSetAuthHeaderAPIKey(t *testing.T) {
 		t.Errorf("expected X-API-Key header, got %q", got)
 	}
 }
+
+// csrfServer requires a current X-Csrf-Token on writes and rotates it after
+// every accepted write without telling the client, as UniFi OS does when
+// another session or the controller itself refreshes the token. A write with
+// a stale token gets a 401 that carries the new token, in the X-Csrf-Token
+// header or, with viaCookie, in a reissued TOKEN cookie.
+type csrfServer struct {
+	viaCookie bool
+
+	mu       sync.Mutex
+	logins   int
+	token    int
+	accepted int
+	missing  int
+}
+
+func (s *csrfServer) current() string { return fmt.Sprintf("csrf-%d", s.token) }
+
+// sendToken hands the current token to the client.
+func (s *csrfServer) sendToken(w http.ResponseWriter) {
+	if !s.viaCookie {
+		w.Header().Set("X-Csrf-Token", s.current())
+		return
+	}
+	claims, _ := json.Marshal(map[string]string{"csrfToken": s.current()})
+	jwt := "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(claims) + ".sig"
+	http.SetCookie(w, &http.Cookie{Name: "TOKEN", Value: jwt, Path: "/"})
+}
+
+func (s *csrfServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/api/auth/login" {
+		s.logins++
+		s.token++
+		s.sendToken(w)
+		return
+	}
+	if r.Method == http.MethodGet {
+		return
+	}
+	switch r.Header.Get("X-Csrf-Token") {
+	case s.current():
+		s.accepted++
+		s.token++
+	case "":
+		s.missing++
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		s.sendToken(w)
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+}
+
+// TestClient_CSRFRotationRefreshesToken verifies that the CSRF token from
+// login is sent on writes and that a 401 caused by token rotation is retried
+// with the new token instead of triggering a full re-login.
+func TestClient_CSRFRotationRefreshesToken(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		viaCookie bool
+	}{
+		{"header", false},
+		{"cookie", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := &csrfServer{viaCookie: tc.viaCookie}
+			srv := httptest.NewServer(fake)
+			defer srv.Close()
+
+			ctrl, err := NewClient(context.Background(), ClientConfig{
+				BaseURL:  srv.URL,
+				Username: "admin",
+				Password: "secret",
+				Timeout:  5 * time.Second,
+			}, zerolog.Nop())
+			if err != nil {
+				t.Fatalf("NewClient: %v", err)
+			}
+			c := ctrl.(*unifiClient)
+
+			const writes = 3
+			for i := 0; i < writes; i++ {
+				if err := doPUT(context.Background(), c, srv.URL+"/api/s/default/rest/firewallgroup/g1", "test", map[string]string{}); err != nil {
+					t.Fatalf("write %d: %v", i, err)
+				}
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if fake.accepted != writes {
+				t.Errorf("accepted writes: got %d, want %d", fake.accepted, writes)
+			}
+			if fake.missing != 0 {
+				t.Errorf("writes sent without a CSRF token: %d", fake.missing)
+			}
+			if fake.logins != 1 {
+				t.Errorf("logins: got %d, want 1 (rotation must not re-login)", fake.logins)
+			}
+		})
+	}
+}
+
+// TestClient_ExpiredSessionStillReauths verifies that a 401 without a token
+// change still falls back to a full login.
+func TestClient_ExpiredSessionStillReauths(t *testing.T) {
+	var logins, puts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/auth/login" {
+			logins.Add(1)
+			w.Header().Set("X-Csrf-Token", "csrf")
+			return
+		}
+		if r.Method == http.MethodPut && puts.Add(1) == 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	ctrl, err := NewClient(context.Background(), ClientConfig{
+		BaseURL:  srv.URL,
+		Username: "admin",
+		Password: "secret",
+		Timeout:  5 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	if err := doPUT(context.Background(), ctrl.(*unifiClient), srv.URL+"/api/s/default/rest/firewallgroup/g1", "test", map[string]string{}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := logins.Load(); got != 2 {
+		t.Errorf("logins: got %d, want 2", got)
+	}
+}
+
+// TestLoginUserAgent verifies that the login request carries the configured
+// User-Agent.
+func TestLoginUserAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	sm := newSessionManager(AuthConfig{
+		BaseURL:       srv.URL,
+		Username:      "admin",
+		Password:      "secret",
+		ReauthTimeout: 5 * time.Second,
+		UserAgent:     "cs-unifi-bouncer-pro/1.2.3",
+	}, srv.Client(), zerolog.Nop())
+	if err := sm.EnsureAuth(context.Background()); err != nil {
+		t.Fatalf("EnsureAuth: %v", err)
+	}
+	if got != "cs-unifi-bouncer-pro/1.2.3" {
+		t.Errorf("login User-Agent = %q, want cs-unifi-bouncer-pro/1.2.3", got)
+	}
+}
@@ -3,26 +3,39 @@ package controller
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sort"
 	"strings"
+	"time"
 )
 
 // featureFlags maps known feature names to API detection logic.
 // When FIREWALL_MODE=auto, EnsureInfrastructure calls HasFeature.
 const (
-	FeatureZoneBasedFirewall = "ZONE_BASED_FIREWALL"
+	FeatureZoneBasedFirewall  = "ZONE_BASED_FIREWALL"
+	FeatureBulkFirewallGroups = "BULK_FIREWALL_GROUPS"
 )
 
+// featureResult is a cached feature detection and when it was made.
+type featureResult struct {
+	supported  bool
+	detectedAt time.Time
+}
+
 // hasFeature detects whether the controller supports a named feature.
-// Results are cached per (site, feature) to avoid repeated API calls.
+// Results are cached per (site, feature) to avoid repeated API calls; with a
+// FeatureCacheTTL they are probed again once older than it, so a controller
+// upgraded mid-run is noticed without a restart.
 func hasFeature(ctx context.Context, c *unifiClient, site, feature string) (bool, error) {
 	c.cacheMu.RLock()
 	if siteCache, ok := c.featureCache[site]; ok {
-		if val, cached := siteCache[feature]; cached {
+		if res, cached := siteCache[feature]; cached &&
+			(c.cfg.FeatureCacheTTL <= 0 || time.Since(res.detectedAt) < c.cfg.FeatureCacheTTL) {
 			c.cacheMu.RUnlock()
-			return val, nil
+			return res.supported, nil
 		}
 	}
 	c.cacheMu.RUnlock()
@@ -33,6 +46,8 @@ func hasFeature(ctx context.Context, c *unifiClient, site, feature string) (bool
 	switch feature {
 	case FeatureZoneBasedFirewall:
 		result, err = detectZoneFirewall(ctx, c, site)
+	case FeatureBulkFirewallGroups:
+		result, err = detectBulkFirewallGroups(ctx, c, site)
 	default:
 		return false, fmt.Errorf("unknown feature: %s", feature)
 	}
@@ -43,9 +58,13 @@ func hasFeature(ctx context.Context, c *unifiClient, site, feature string) (bool
 
 	c.cacheMu.Lock()
 	if c.featureCache[site] == nil {
-		c.featureCache[site] = make(map[string]bool)
+		c.featureCache[site] = make(map[string]featureResult)
+	}
+	if prev, ok := c.featureCache[site][feature]; ok && prev.supported != result {
+		c.log.Info().Str("site", site).Str("feature", feature).Bool("supported", result).
+			Msg("controller feature detection changed")
 	}
-	c.featureCache[site][feature] = result
+	c.featureCache[site][feature] = featureResult{supported: result, detectedAt: time.Now()}
 	c.cacheMu.Unlock()
 
 	return result, nil
@@ -56,6 +75,9 @@ func hasFeature(ctx context.Context, c *unifiClient, site, feature string) (bool
 func detectZoneFirewall(ctx context.Context, c *unifiClient, site string) (bool, error) {
 	siteID, err := getSiteID(ctx, c, site)
 	if err != nil {
+		if detectionTransient(err) {
+			return false, err
+		}
 		// Cannot resolve site UUID — integration v1 not available; fall back to legacy.
 		return false, nil //nolint:nilerr
 	}
@@ -71,7 +93,7 @@ func detectZoneFirewall(ctx context.Context, c *unifiClient, site string) (bool,
 	callErr := c.withReauth(ctx, func() error {
 		resp, err := c.apiDo(ctx, req, "feature/zone-detect")
 		if err != nil {
-			if _, notFound := err.(*ErrNotFound); notFound {
+			if featureAbsent(err) {
 				supported = false
 				return nil
 			}
@@ -90,6 +112,68 @@ func detectZoneFirewall(ctx context.Context, c *unifiClient, site string) (bool,
 	return supported, callErr
 }
 
+// detectBulkFirewallGroups probes the firewall-group batch endpoint with a
+// GET, which changes nothing on the controller. Firmware that has the endpoint
+// answers 200 or 405 (the route exists but only takes PUT); older firmware
+// answers 404 or the HTML proxy fallback, which reports the feature as absent.
+// A busy or unreachable controller is returned as an error so the previous
+// answer is kept.
+func detectBulkFirewallGroups(ctx context.Context, c *unifiClient, site string) (bool, error) {
+	endpointURL := groupBatchEndpoint(c.cfg.BaseURL, site)
+
+	var supported bool
+	callErr := c.withReauth(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.apiDo(ctx, req, "feature/bulk-groups-detect")
+		if err != nil {
+			var status *ErrHTTPStatus
+			if errors.As(err, &status) && status.Status == http.StatusMethodNotAllowed {
+				supported = true
+				return nil
+			}
+			if featureAbsent(err) {
+				supported = false
+				return nil
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		buf := make([]byte, 1)
+		if n, _ := resp.Body.Read(buf); n > 0 && buf[0] == '<' {
+			supported = false
+			return nil
+		}
+		supported = resp.StatusCode == http.StatusOK
+		return nil
+	})
+	return supported, callErr
+}
+
+// featureAbsent reports whether err from a detection probe is a definitive
+// answer that the endpoint does not exist or may not be used. Anything else,
+// notably ErrServerBusy while the controller restarts, is returned to the
+// caller so it keeps its previous answer instead of caching "unsupported".
+func featureAbsent(err error) bool {
+	var nf *ErrNotFound
+	var forbidden *ErrForbidden
+	var status *ErrHTTPStatus
+	var badReq *ErrBadRequest
+	return errors.As(err, &nf) || errors.As(err, &forbidden) || errors.As(err, &status) || errors.As(err, &badReq)
+}
+
+// detectionTransient reports whether err says nothing about the controller's
+// features: it is busy, rate limiting, or could not be reached.
+func detectionTransient(err error) bool {
+	var busy *ErrServerBusy
+	var rl *ErrRateLimit
+	var netErr net.Error
+	return errors.As(err, &busy) || errors.As(err, &rl) || errors.As(err, &netErr) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
 // --- API helpers for legacy envelope responses ------------------------------
 
 type apiResponse struct {
@@ -97,6 +181,9 @@ type apiResponse struct {
 	Meta struct {
 		RC  string `json:"rc"`
 		Msg string `json:"msg"`
+		// Count is the total number of results when the controller pages a
+		// list response; zero means the data array is complete.
+		Count int `json:"count"`
 	} `json:"meta"`
 }
 
@@ -104,6 +191,10 @@ func groupEndpoint(base, site string) string {
 	return fmt.Sprintf("%s/proxy/network/api/s/%s/rest/firewallgroup", base, site)
 }
 
+func groupBatchEndpoint(base, site string) string {
+	return groupEndpoint(base, site) + "/batch"
+}
+
 func ruleEndpoint(base, site string) string {
 	return fmt.Sprintf("%s/proxy/network/api/s/%s/rest/firewallrule", base, site)
 }
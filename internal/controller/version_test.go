@@ -9,6 +9,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 // Fake UUIDs used throughout these tests.
@@ -74,6 +75,28 @@ func TestHasFeature_ZoneFirewall_NotSupported(t *testing.T) {
 	}
 }
 
+// TestHasFeature_ServerBusyNotCached verifies that a 503 during a controller
+// restart is returned as an error and does not cache "unsupported".
+func TestHasFeature_ServerBusyNotCached(t *testing.T) {
+	status := int32(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	setSiteIDCache(c, "default", testSiteUUID)
+
+	if _, err := hasFeature(context.Background(), c, "default", FeatureZoneBasedFirewall); err == nil {
+		t.Fatal("expected an error while the controller answers 503")
+	}
+	atomic.StoreInt32(&status, http.StatusOK)
+	got, err := hasFeature(context.Background(), c, "default", FeatureZoneBasedFirewall)
+	if err != nil || !got {
+		t.Errorf("after recovery: got %v, %v; want true, nil", got, err)
+	}
+}
+
 // TestHasFeature_Cached verifies that a second call for the same (site, feature)
 // does not make another HTTP request — the result is served from the cache.
 func TestHasFeature_Cached(t *testing.T) {
@@ -112,6 +135,50 @@ func TestHasFeature_Cached(t *testing.T) {
 	}
 }
 
+// TestHasFeature_CacheExpires verifies that a cached result older than
+// FeatureCacheTTL is probed again and picks up a controller upgrade.
+func TestHasFeature_CacheExpires(t *testing.T) {
+	var callCount int32
+	var upgraded atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&callCount, 1)
+		if !upgraded.Load() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"offset":0,"limit":1,"count":0,"totalCount":0,"data":[]}`)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL, "api-key")
+	c.cfg.FeatureCacheTTL = time.Hour
+	setSiteIDCache(c, "default", testSiteUUID)
+	ctx := context.Background()
+
+	if got, err := hasFeature(ctx, c, "default", FeatureZoneBasedFirewall); err != nil || got {
+		t.Fatalf("before upgrade = %v, %v; want false", got, err)
+	}
+	upgraded.Store(true)
+	if got, _ := hasFeature(ctx, c, "default", FeatureZoneBasedFirewall); got {
+		t.Error("fresh cached result was not reused")
+	}
+
+	// Age the cached result past the TTL.
+	c.cacheMu.Lock()
+	res := c.featureCache["default"][FeatureZoneBasedFirewall]
+	res.detectedAt = time.Now().Add(-2 * time.Hour)
+	c.featureCache["default"][FeatureZoneBasedFirewall] = res
+	c.cacheMu.Unlock()
+
+	if got, err := hasFeature(ctx, c, "default", FeatureZoneBasedFirewall); err != nil || !got {
+		t.Errorf("after expiry = %v, %v; want true", got, err)
+	}
+	if n := atomic.LoadInt32(&callCount); n != 2 {
+		t.Errorf("HTTP calls = %d, want 2", n)
+	}
+}
+
 // TestHasFeature_CacheSeparatePerSite verifies that cached results for site "a"
 // do not prevent a fresh HTTP probe for site "b".
 func TestHasFeature_CacheSeparatePerSite(t *testing.T) {
@@ -391,3 +458,46 @@ func TestGetZoneID_NameFails_ZoneNotInList(t *testing.T) {
 		t.Fatalf("unexpected error message: %q", got)
 	}
 }
+
+// TestDetectBulkFirewallGroups verifies that the batch endpoint is probed with
+// a GET, that a 405 for that method counts as supported, and that a busy
+// controller is returned as an error instead of "unsupported".
+func TestDetectBulkFirewallGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK, body: `{"meta":{"rc":"ok"},"data":[]}`, want: true},
+		{name: "method not allowed", status: http.StatusMethodNotAllowed, want: true},
+		{name: "not found", status: http.StatusNotFound},
+		{name: "html fallback", status: http.StatusOK, body: "<html></html>"},
+		{name: "busy", status: http.StatusServiceUnavailable, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet {
+					t.Errorf("probe used %s, want GET", r.Method)
+				}
+				if !strings.HasSuffix(r.URL.Path, "/rest/firewallgroup/batch") {
+					t.Errorf("unexpected path %s", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			c := newTestClient(srv.URL, "api-key")
+			got, err := detectBulkFirewallGroups(context.Background(), c, "default")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("supported = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -12,14 +12,15 @@ import (
 
 // FilterConfig holds the parameters for the 8-stage decision pipeline.
 type FilterConfig struct {
-	// Stage 1: allowed action types
+	// Stage 1: allowed action types; BLOCK_DECISION_TYPES plus "delete"
 	AllowedActions []string // default: ["ban", "delete"]
 
-	// Stage 2: scenario substrings to skip
-	BlockScenarioExclude []string
+	// Stage 2: scenarios to skip; see CompileScenarioPatterns
+	BlockScenarioExclude []ScenarioPattern
 
-	// Stage 3: allowed origins (empty = all)
-	AllowedOrigins []string
+	// Stage 3: allowed origins (empty = all), minus excluded origins
+	AllowedOrigins  []string
+	ExcludedOrigins []string
 
 	// Stage 4: allowed scopes
 	AllowedScopes []string // default: ["ip", "range"]
@@ -75,28 +76,39 @@ func Filter(d *models.Decision, cfg FilterConfig, log zerolog.Logger) FilterResu
 		scenario = *d.Scenario
 	}
 
-	// Stage 1: action must be ban or delete
+	// Stage 1: action must be a blocking type or delete. A captcha or
+	// throttle decision cannot be enforced by a firewall and must not turn
+	// into a hard block.
 	if !containsCI(cfg.AllowedActions, action) {
 		metrics.DecisionsFiltered.WithLabelValues(stageAction, "unsupported_action").Inc()
+		metrics.SkippedDecisionType.WithLabelValues(action).Inc()
 		log.Trace().Str("action", action).Msg("filtered: unsupported action")
 		return FilterResult{}
 	}
 
 	// Stage 2: scenario exclude
 	for _, exc := range cfg.BlockScenarioExclude {
-		if exc != "" && strings.Contains(scenario, exc) {
+		if exc.Match(scenario) {
 			metrics.DecisionsFiltered.WithLabelValues(stageScenario, "excluded_scenario").Inc()
-			log.Trace().Str("scenario", scenario).Str("exclude", exc).Msg("filtered: excluded scenario")
+			log.Trace().Str("scenario", scenario).Str("exclude", exc.String()).Msg("filtered: excluded scenario")
 			return FilterResult{}
 		}
 	}
 
-	// Stage 3: origin filter (empty = all allowed)
+	// Stage 3: origin filter (empty allow list = all allowed); the exclude
+	// list wins over the allow list.
 	if len(cfg.AllowedOrigins) > 0 && !containsCI(cfg.AllowedOrigins, origin) {
 		metrics.DecisionsFiltered.WithLabelValues(stageOrigin, "origin_not_allowed").Inc()
+		metrics.DecisionsOriginSkipped.WithLabelValues(origin).Inc()
 		log.Trace().Str("origin", origin).Msg("filtered: origin not allowed")
 		return FilterResult{}
 	}
+	if containsCI(cfg.ExcludedOrigins, origin) {
+		metrics.DecisionsFiltered.WithLabelValues(stageOrigin, "origin_excluded").Inc()
+		metrics.DecisionsOriginSkipped.WithLabelValues(origin).Inc()
+		log.Trace().Str("origin", origin).Msg("filtered: origin excluded")
+		return FilterResult{}
+	}
 
 	// Stage 4: scope must be ip or range
 	if !containsCI(cfg.AllowedScopes, scope) {
@@ -137,7 +149,7 @@ func Filter(d *models.Decision, cfg FilterConfig, log zerolog.Logger) FilterResu
 			dur = parsed
 		}
 	}
-	if action == "ban" && cfg.MinBanDuration > 0 && dur > 0 && dur < cfg.MinBanDuration {
+	if action != "delete" && cfg.MinBanDuration > 0 && dur > 0 && dur < cfg.MinBanDuration {
 		metrics.DecisionsFiltered.WithLabelValues(stageMinDur, "too_short").Inc()
 		log.Trace().Str("ip", sanitized).Dur("duration", dur).Dur("min", cfg.MinBanDuration).Msg("filtered: ban duration too short")
 		return FilterResult{}
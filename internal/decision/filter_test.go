@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
@@ -39,9 +41,26 @@ func TestStage1_BanAllowed(t *testing.T) {
 	}
 }
 
+// TestStage1_SkippedDecisionType verifies that non-blocking types are counted
+// per type and that a configured alias passes as a ban.
+func TestStage1_SkippedDecisionType(t *testing.T) {
+	cfg := NewFilterConfig()
+	cfg.AllowedActions = []string{"ban", "block", "delete"}
+	before := promtestutil.ToFloat64(metrics.SkippedDecisionType.WithLabelValues("throttle"))
+	if r := Filter(makeDecision("throttle", "ip", "1.2.3.4", "test", "crowdsec", "24h"), cfg, zerolog.Nop()); r.Passed {
+		t.Error("throttle decision should be filtered")
+	}
+	if got := promtestutil.ToFloat64(metrics.SkippedDecisionType.WithLabelValues("throttle")) - before; got != 1 {
+		t.Errorf("skipped throttle decisions = %v, want 1", got)
+	}
+	if r := Filter(makeDecision("Block", "ip", "1.2.3.4", "test", "crowdsec", "24h"), cfg, zerolog.Nop()); !r.Passed {
+		t.Error("decision of a configured block type should pass")
+	}
+}
+
 func TestStage2_ScenarioExclude(t *testing.T) {
 	cfg := NewFilterConfig()
-	cfg.BlockScenarioExclude = []string{"impossible-travel", "test-scenario"}
+	cfg.BlockScenarioExclude = mustScenarioPatterns(t, "impossible-travel", "test-scenario")
 
 	d := makeDecision("ban", "ip", "1.2.3.4", "test-scenario-brute-force", "crowdsec", "24h")
 	r := Filter(d, cfg, zerolog.Nop())
@@ -83,6 +102,38 @@ func TestStage3_EmptyOriginsAllowsAll(t *testing.T) {
 	}
 }
 
+func TestStage3_ExcludedOrigins(t *testing.T) {
+	cfg := NewFilterConfig()
+	cfg.ExcludedOrigins = []string{"lists"}
+	before := promtestutil.ToFloat64(metrics.DecisionsOriginSkipped.WithLabelValues("lists"))
+
+	for _, origin := range []string{"CAPI", "crowdsec"} {
+		d := makeDecision("ban", "ip", "1.2.3.4", "ssh-bf", origin, "24h")
+		if r := Filter(d, cfg, zerolog.Nop()); !r.Passed {
+			t.Errorf("%s origin should pass when only lists is excluded", origin)
+		}
+	}
+	d := makeDecision("ban", "ip", "1.2.3.4", "ssh-bf", "LISTS", "24h")
+	if r := Filter(d, cfg, zerolog.Nop()); r.Passed {
+		t.Error("excluded origin should be filtered, case-insensitively")
+	}
+
+	// The exclude list wins over the allow list.
+	cfg.AllowedOrigins = []string{"crowdsec", "lists"}
+	d = makeDecision("ban", "ip", "1.2.3.4", "ssh-bf", "lists", "24h")
+	if r := Filter(d, cfg, zerolog.Nop()); r.Passed {
+		t.Error("origin in both lists should be filtered")
+	}
+	d = makeDecision("ban", "ip", "1.2.3.4", "ssh-bf", "CAPI", "24h")
+	if r := Filter(d, cfg, zerolog.Nop()); r.Passed {
+		t.Error("origin outside the allow list should still be filtered")
+	}
+
+	if got := promtestutil.ToFloat64(metrics.DecisionsOriginSkipped.WithLabelValues("lists")) - before; got != 1 {
+		t.Errorf("decisions_origin_skipped_total{origin=lists} grew by %v, want 1", got)
+	}
+}
+
 func TestStage4_UnsupportedScope(t *testing.T) {
 	cfg := NewFilterConfig()
 	d := makeDecision("ban", "country", "FR", "geoip", "crowdsec", "24h")
@@ -7,17 +7,24 @@ import (
 )
 
 // ParseAndSanitize parses an IP or CIDR string and returns the canonical form.
+// A host-length CIDR (/32 for IPv4, /128 for IPv6) is returned as the bare
+// address so it is stored and matched identically to the plain IP.
 // Returns an error for unparseable inputs.
 func ParseAndSanitize(value string) (string, bool, error) {
 	value = strings.TrimSpace(value)
 
 	// Try CIDR first
 	if strings.Contains(value, "/") {
-		ip, network, err := net.ParseCIDR(value)
+		_, network, err := net.ParseCIDR(value)
 		if err != nil {
 			return "", false, fmt.Errorf("invalid CIDR %q: %w", value, err)
 		}
-		_ = ip
+		if ones, bits := network.Mask.Size(); ones == bits {
+			if ip4 := network.IP.To4(); ip4 != nil {
+				return ip4.String(), false, nil
+			}
+			return network.IP.String(), false, nil
+		}
 		return network.String(), true, nil
 	}
 
@@ -14,6 +14,9 @@ func TestParseAndSanitize(t *testing.T) {
 		{"::ffff:1.2.3.4", "1.2.3.4", false}, // IPv4-mapped IPv6 normalized
 		{"2001:db8::1", "2001:db8::1", false},
 		{"192.168.1.0/24", "192.168.1.0/24", false},
+		{"2001:db8::1/128", "2001:db8::1", false}, // host prefix collapses to bare host
+		{"1.2.3.4/32", "1.2.3.4", false},
+		{"::ffff:1.2.3.4/128", "1.2.3.4", false},
 		{"not-an-ip", "", true},
 		{"300.1.1.1", "", true},
 	}
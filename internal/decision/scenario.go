@@ -0,0 +1,77 @@
+package decision
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// scenarioRegexPrefix marks a BLOCK_SCENARIO_EXCLUDE entry as a regular
+// expression.
+const scenarioRegexPrefix = "re:"
+
+// ScenarioPattern is one compiled BLOCK_SCENARIO_EXCLUDE entry. A plain entry
+// matches scenarios containing it, a glob ("*" and "?") must match the whole
+// scenario, and an entry prefixed with "re:" is a regular expression.
+type ScenarioPattern struct {
+	expr   string
+	substr string
+	re     *regexp.Regexp
+}
+
+// CompileScenarioPatterns compiles exprs, skipping empty entries.
+func CompileScenarioPatterns(exprs []string) ([]ScenarioPattern, error) {
+	patterns := make([]ScenarioPattern, 0, len(exprs))
+	for _, expr := range exprs {
+		if expr == "" {
+			continue
+		}
+		p := ScenarioPattern{expr: expr}
+		switch {
+		case strings.HasPrefix(expr, scenarioRegexPrefix):
+			re, err := regexp.Compile(strings.TrimPrefix(expr, scenarioRegexPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid scenario pattern %q: %w", expr, err)
+			}
+			p.re = re
+		case strings.ContainsAny(expr, "*?"):
+			p.re = globRegexp(expr)
+		default:
+			p.substr = expr
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Match reports whether scenario is excluded by p.
+func (p ScenarioPattern) Match(scenario string) bool {
+	if p.re != nil {
+		return p.re.MatchString(scenario)
+	}
+	return p.substr != "" && strings.Contains(scenario, p.substr)
+}
+
+// String returns the entry as configured.
+func (p ScenarioPattern) String() string {
+	return p.expr
+}
+
+// globRegexp translates glob into an anchored expression. Unlike path.Match,
+// "*" also matches "/", so "*http*" covers "crowdsecurity/http-probing".
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.MustCompile(b.String())
+}
@@ -0,0 +1,69 @@
+package decision
+
+import (
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func mustScenarioPatterns(t *testing.T, exprs ...string) []ScenarioPattern {
+	t.Helper()
+	patterns, err := CompileScenarioPatterns(exprs)
+	if err != nil {
+		t.Fatalf("CompileScenarioPatterns: %v", err)
+	}
+	return patterns
+}
+
+func TestScenarioPattern_Match(t *testing.T) {
+	tests := []struct {
+		expr     string
+		scenario string
+		want     bool
+	}{
+		// Plain entries keep substring matching.
+		{"impossible-travel", "crowdsecurity/impossible-travel", true},
+		{"impossible-travel", "crowdsecurity/ssh-bf", false},
+		// Globs match the whole scenario; "*" crosses "/".
+		{"crowdsecurity/http-*", "crowdsecurity/http-probing", true},
+		{"crowdsecurity/http-*", "crowdsecurity/ssh-bf", false},
+		{"crowdsecurity/http-*", "acme/crowdsecurity/http-probing", false},
+		{"*http*", "crowdsecurity/http-probing", true},
+		{"crowdsecurity/ssh-?f", "crowdsecurity/ssh-bf", true},
+		{"crowdsecurity/ssh-?f", "crowdsecurity/ssh-slow-bf", false},
+		// Regular expressions are unanchored unless the pattern anchors them.
+		{`re:^crowdsecurity/(http|nginx)-`, "crowdsecurity/nginx-req-limit", true},
+		{`re:^crowdsecurity/(http|nginx)-`, "crowdsecurity/ssh-bf", false},
+		{`re:cve-\d{4}`, "crowdsecurity/vpatch-cve-2023-1234", true},
+	}
+	for _, tt := range tests {
+		p := mustScenarioPatterns(t, tt.expr)[0]
+		if got := p.Match(tt.scenario); got != tt.want {
+			t.Errorf("%q.Match(%q) = %v, want %v", tt.expr, tt.scenario, got, tt.want)
+		}
+	}
+}
+
+func TestCompileScenarioPatterns_Invalid(t *testing.T) {
+	if _, err := CompileScenarioPatterns([]string{"re:(unclosed"}); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestCompileScenarioPatterns_SkipsEmpty(t *testing.T) {
+	if got := mustScenarioPatterns(t, "", "ssh"); len(got) != 1 {
+		t.Errorf("compiled %d patterns, want 1", len(got))
+	}
+}
+
+func TestStage2_ScenarioExcludeGlob(t *testing.T) {
+	cfg := NewFilterConfig()
+	cfg.BlockScenarioExclude = mustScenarioPatterns(t, "crowdsecurity/http-*")
+
+	if r := Filter(makeDecision("ban", "ip", "1.2.3.4", "crowdsecurity/http-probing", "crowdsec", "24h"), cfg, zerolog.Nop()); r.Passed {
+		t.Error("scenario matching the glob should be filtered")
+	}
+	if r := Filter(makeDecision("ban", "ip", "1.2.3.4", "crowdsecurity/ssh-bf", "crowdsec", "24h"), cfg, zerolog.Nop()); !r.Passed {
+		t.Error("scenario outside the glob should pass")
+	}
+}
@@ -0,0 +1,93 @@
+package firewall
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net"
+	"sort"
+)
+
+// addrRange is an inclusive IPv4 address range. uint64 bounds keep end+1
+// from overflowing at 255.255.255.255.
+type addrRange struct{ start, end uint64 }
+
+func ipv4Range(network *net.IPNet) (addrRange, bool) {
+	ip := network.IP.To4()
+	if ip == nil {
+		return addrRange{}, false
+	}
+	ones, _ := network.Mask.Size()
+	start := uint64(binary.BigEndian.Uint32(ip))
+	return addrRange{start: start, end: start + (1 << (32 - ones)) - 1}, true
+}
+
+// aggregateIPv4 collapses IPv4 members (addresses and CIDRs) into the fewest
+// CIDR blocks that cover exactly the same addresses: 256 consecutive
+// addresses become one /24, overlapping ranges merge. IPv6 and unparseable
+// members are dropped. The result is sorted and normalised like
+// normalizeMember.
+func aggregateIPv4(members []string) []string {
+	ranges := make([]addrRange, 0, len(members))
+	for _, member := range members {
+		network, err := parseMember(member)
+		if err != nil {
+			continue
+		}
+		if r, ok := ipv4Range(network); ok {
+			ranges = append(ranges, r)
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var out []string
+	for i := 0; i < len(ranges); {
+		cur := ranges[i]
+		for i++; i < len(ranges) && ranges[i].start <= cur.end+1; i++ {
+			cur.end = max(cur.end, ranges[i].end)
+		}
+		out = appendRangeCIDRs(out, cur)
+	}
+	return out
+}
+
+// subtractIPv4 returns the blocks of outer that remain after removing inner,
+// which must lie within outer. Splitting a /24 around one address yields
+// eight blocks, /25 down to /32.
+func subtractIPv4(outer, inner *net.IPNet) []string {
+	o, ok := ipv4Range(outer)
+	if !ok {
+		return nil
+	}
+	in, ok := ipv4Range(inner)
+	if !ok {
+		return nil
+	}
+	var out []string
+	if in.start > o.start {
+		out = appendRangeCIDRs(out, addrRange{start: o.start, end: in.start - 1})
+	}
+	if in.end < o.end {
+		out = appendRangeCIDRs(out, addrRange{start: in.end + 1, end: o.end})
+	}
+	return out
+}
+
+// appendRangeCIDRs appends the largest aligned CIDR blocks that tile r.
+func appendRangeCIDRs(out []string, r addrRange) []string {
+	for s := r.start; s <= r.end; {
+		// The block size is limited by the alignment of s and by what is left.
+		size := uint64(1) << 32
+		if s != 0 {
+			size = uint64(1) << bits.TrailingZeros64(s)
+		}
+		for size > r.end-s+1 {
+			size >>= 1
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(s))
+		ones := 32 - bits.TrailingZeros64(size)
+		out = append(out, normalizeMember((&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String()))
+		s += size
+	}
+	return out
+}
@@ -0,0 +1,199 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestAggregateIPv4(t *testing.T) {
+	consecutive := make([]string, 256)
+	for i := range consecutive {
+		consecutive[i] = fmt.Sprintf("203.0.113.%d", i)
+	}
+
+	cases := []struct {
+		name    string
+		members []string
+		want    []string
+	}{
+		{"256 addresses become a /24", consecutive, []string{"203.0.113.0/24"}},
+		{"unaligned run splits into aligned blocks",
+			[]string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"},
+			[]string{"192.0.2.1", "192.0.2.2/31", "192.0.2.4"}},
+		{"adjacent CIDRs merge", []string{"192.0.2.0/25", "192.0.2.128/25"}, []string{"192.0.2.0/24"}},
+		{"covered members collapse into the range", []string{"192.0.2.0/24", "192.0.2.7", "192.0.2.7/32"}, []string{"192.0.2.0/24"}},
+		{"gaps are kept", []string{"192.0.2.1", "192.0.2.3"}, []string{"192.0.2.1", "192.0.2.3"}},
+		{"top of the address space", []string{"255.255.255.254", "255.255.255.255"}, []string{"255.255.255.254/31"}},
+		{"IPv6 and junk are dropped", []string{"2001:db8::1", "not-an-ip", "192.0.2.9"}, []string{"192.0.2.9"}},
+		{"empty", nil, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := aggregateIPv4(tc.members); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("aggregateIPv4 = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubtractIPv4(t *testing.T) {
+	_, outer, _ := net.ParseCIDR("192.0.2.0/24")
+	host, _ := parseMember("192.0.2.77")
+	got := subtractIPv4(outer, host)
+	if len(got) != 8 {
+		t.Fatalf("splitting a /24 around one address gave %d blocks, want 8: %v", len(got), got)
+	}
+	// The pieces must cover exactly the /24 minus the address.
+	covered := 0
+	for _, piece := range got {
+		n, _ := parseMember(piece)
+		if n.Contains(host.IP) {
+			t.Errorf("piece %s still contains the removed address", piece)
+		}
+		ones, _ := n.Mask.Size()
+		covered += 1 << (32 - ones)
+	}
+	if covered != 255 {
+		t.Errorf("pieces cover %d addresses, want 255", covered)
+	}
+
+	_, inner, _ := net.ParseCIDR("192.0.2.0/25")
+	if got := subtractIPv4(outer, inner); !reflect.DeepEqual(got, []string{"192.0.2.128/25"}) {
+		t.Errorf("subtracting the lower half = %v, want [192.0.2.128/25]", got)
+	}
+	if got := subtractIPv4(outer, outer); len(got) != 0 {
+		t.Errorf("subtracting the block itself = %v, want nothing", got)
+	}
+}
+
+func sortedMembers(sm *ShardManager) []string {
+	members := sm.AllMembers()
+	sort.Strings(members)
+	return members
+}
+
+// TestReconcile_AggregatesContiguousBans verifies that reconcile replaces
+// contiguous members with a block, and that an aggregate left over from an
+// earlier reconcile does not hide the narrower block that is now desired.
+func TestReconcile_AggregatesContiguousBans(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.AggregateCIDR = true
+	mgr, _, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		_ = store.BanRecord(ip, time.Time{}, false)
+		if err := mgr.ApplyBan(ctx, testSite, ip, false); err != nil {
+			t.Fatalf("ApplyBan(%s): %v", ip, err)
+		}
+	}
+	sm := mgr.(*managerImpl).shardMgr(testSite, false)
+
+	result, err := mgr.Reconcile(ctx, []string{testSite})
+	if err != nil || len(result.Errors) != 0 {
+		t.Fatalf("Reconcile: %v %v", err, result.Errors)
+	}
+	if got := sortedMembers(sm); !reflect.DeepEqual(got, []string{"198.51.100.0/29"}) {
+		t.Fatalf("members = %v, want [198.51.100.0/29]", got)
+	}
+	if result.Added != 1 || result.Removed != 8 {
+		t.Errorf("diff = +%d -%d, want +1 -8", result.Added, result.Removed)
+	}
+	if result.Aggregated != 8 {
+		t.Errorf("aggregated removals = %d, want 8: merging into the block unblocks nothing", result.Aggregated)
+	}
+	if !sm.Contains("198.51.100.5") {
+		t.Error("Contains must report addresses inside the aggregated block")
+	}
+
+	// Four bans leave the store without an unban reaching the manager; the
+	// /29 still covers the /30 that remains desired.
+	for i := 4; i < 8; i++ {
+		_ = store.BanDelete(fmt.Sprintf("198.51.100.%d", i))
+	}
+	if _, err := mgr.Reconcile(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if got := sortedMembers(sm); !reflect.DeepEqual(got, []string{"198.51.100.0/30"}) {
+		t.Errorf("members = %v, want [198.51.100.0/30]", got)
+	}
+	if sm.Contains("198.51.100.5") {
+		t.Error("expired address is still blocked")
+	}
+}
+
+// TestApplyUnban_SplitsAggregatedBlock verifies that unbanning an address
+// inside an aggregated block takes effect without waiting for a reconcile,
+// while a banned range is never split.
+func TestApplyUnban_SplitsAggregatedBlock(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.AggregateCIDR = true
+	cfg.GroupCapacityV4 = 20
+	mgr, _, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		_ = store.BanRecord(fmt.Sprintf("198.51.100.%d", i), time.Time{}, false)
+	}
+	_ = store.BanRecord("192.0.2.0/24", time.Time{}, false)
+	if _, err := mgr.Reconcile(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	sm := mgr.(*managerImpl).shardMgr(testSite, false)
+
+	_ = store.BanDelete("198.51.100.3")
+	if err := mgr.ApplyUnban(ctx, testSite, "198.51.100.3", false); err != nil {
+		t.Fatalf("ApplyUnban: %v", err)
+	}
+	want := []string{"192.0.2.0/24", "198.51.100.0/31", "198.51.100.2", "198.51.100.4/30"}
+	if got := sortedMembers(sm); !reflect.DeepEqual(got, want) {
+		t.Errorf("members = %v, want %v", got, want)
+	}
+
+	// An address inside a banned range stays blocked by the range.
+	if err := mgr.ApplyUnban(ctx, testSite, "192.0.2.9", false); err != nil {
+		t.Fatalf("ApplyUnban: %v", err)
+	}
+	if got := sortedMembers(sm); !reflect.DeepEqual(got, want) {
+		t.Errorf("unban inside a banned range changed members to %v", got)
+	}
+}
+
+// TestApplyUnban_UncoveredSkipsSyncMu verifies that an unban no aggregated
+// block covers does not wait for a flush holding syncMu.
+func TestApplyUnban_UncoveredSkipsSyncMu(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.AggregateCIDR = true
+	mgr, _, _ := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "198.51.100.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+
+	m := mgr.(*managerImpl)
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	done := make(chan error, 1)
+	go func() { done <- mgr.ApplyUnban(ctx, testSite, "198.51.100.1", false) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ApplyUnban: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ApplyUnban blocked on syncMu with no aggregate to split")
+	}
+}
@@ -0,0 +1,243 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// CountrySource supplies the CIDRs allocated to a country (BLOCK_COUNTRIES).
+type CountrySource interface {
+	FetchCountry(ctx context.Context, country string, ipv6 bool) ([]string, error)
+}
+
+// Country blocks live in their own groups and rules/policies so that
+// Reconcile, SyncDirty and Drain of the CrowdSec shards never see them. The
+// names are fixed rather than templated: GROUP_NAME_TEMPLATE and friends
+// describe the decision shards only.
+const (
+	countryGroupTemplate  = "crowdsec-geo-block-{{.Family}}-{{.Index}}"
+	countryRuleTemplate   = "crowdsec-geo-drop-{{.Family}}-{{.Index}}"
+	countryPolicyTemplate = "crowdsec-geo-policy-{{.SrcZone}}-{{.DstZone}}-{{.Family}}-{{.Index}}"
+
+	// countryRuleIndexOffset moves the legacy country rules clear of the
+	// decision rules, which count up from LEGACY_RULE_INDEX_START_V4/V6.
+	countryRuleIndexOffset = 2500
+
+	countryModeLegacy = "geo-legacy"
+	countryModeZone   = "geo-zone"
+)
+
+// countryBlocker owns the country-block groups and rules/policies.
+type countryBlocker struct {
+	countries []string
+	source    CountrySource
+	namer     *Namer
+	legacyMgr *LegacyManager
+	zoneMgr   *ZoneManager
+
+	// Per-site shard managers, guarded by managerImpl.mu.
+	v4Mgrs map[string]*ShardManager
+	v6Mgrs map[string]*ShardManager
+}
+
+// newCountryBlocker returns nil when BLOCK_COUNTRIES is empty.
+func newCountryBlocker(cfg ManagerConfig, m *managerImpl) *countryBlocker {
+	if len(cfg.BlockCountries) == 0 || cfg.CountrySource == nil {
+		return nil
+	}
+	namer, err := NewNamer(countryGroupTemplate, countryRuleTemplate, countryPolicyTemplate, m.namer.Description())
+	if err != nil {
+		m.log.Error().Err(err).Msg("country blocking disabled: invalid name template")
+		return nil
+	}
+
+	legacyCfg := cfg.LegacyCfg
+	legacyCfg.RuleIndexStartV4 += countryRuleIndexOffset
+	legacyCfg.RuleIndexStartV6 += countryRuleIndexOffset
+	legacyCfg.RecordMode = countryModeLegacy
+	zoneCfg := cfg.ZoneCfg
+	zoneCfg.RecordMode = countryModeZone
+
+	return &countryBlocker{
+		countries: cfg.BlockCountries,
+		source:    cfg.CountrySource,
+		namer:     namer,
+		legacyMgr: NewLegacyManager(legacyCfg, namer, m.ctrl, m.store, m.log),
+		zoneMgr:   NewZoneManager(zoneCfg, namer, m.ctrl, m.store, m.log),
+		v4Mgrs:    make(map[string]*ShardManager),
+		v6Mgrs:    make(map[string]*ShardManager),
+	}
+}
+
+// countryCIDRs holds the fetched lists per family; a nil entry means the
+// fetch failed and the existing members must be kept.
+type countryCIDRs struct {
+	v4, v6 []string
+}
+
+// fetchCountryCIDRs downloads every configured country once per
+// EnsureInfrastructure. A family whose download fails for any country is left
+// nil so that a transient outage does not unblock that country.
+func (m *managerImpl) fetchCountryCIDRs(ctx context.Context) countryCIDRs {
+	var out countryCIDRs
+	for _, ipv6 := range []bool{false, true} {
+		if ipv6 && !m.cfg.EnableIPv6 {
+			continue
+		}
+		all := []string{}
+		for _, country := range m.geo.countries {
+			cidrs, err := m.geo.source.FetchCountry(ctx, country, ipv6)
+			if err != nil {
+				m.log.Warn().Err(err).Str("country", country).Bool("ipv6", ipv6).
+					Msg("country list download failed; keeping existing country blocks")
+				all = nil
+				break
+			}
+			all = append(all, cidrs...)
+		}
+		if ipv6 {
+			out.v6 = all
+		} else {
+			out.v4 = all
+		}
+	}
+	return out
+}
+
+// ensureCountryBlocks syncs the country-block groups of one site with lists
+// and provisions the rule or policy for each group. Failures are logged: the
+// decision shards are already in place and must not be held up by GeoIP.
+func (m *managerImpl) ensureCountryBlocks(ctx context.Context, site, mode string, lists countryCIDRs) {
+	if m.geo == nil {
+		return
+	}
+	if m.cfg.DryRun {
+		m.log.Info().Str("site", site).Strs("countries", m.geo.countries).
+			Msg("[DRY-RUN] would ensure country block groups")
+		return
+	}
+
+	v4, err := m.syncCountryFamily(ctx, site, mode, false, lists.v4)
+	if err != nil {
+		m.log.Error().Err(err).Str("site", site).Msg("country blocking: failed to sync v4 groups")
+		return
+	}
+	var v6 *ShardManager
+	if m.cfg.EnableIPv6 {
+		if v6, err = m.syncCountryFamily(ctx, site, mode, true, lists.v6); err != nil {
+			m.log.Error().Err(err).Str("site", site).Msg("country blocking: failed to sync v6 groups")
+			return
+		}
+	}
+
+	m.mu.Lock()
+	m.geo.v4Mgrs[site] = v4
+	if v6 != nil {
+		m.geo.v6Mgrs[site] = v6
+	}
+	m.mu.Unlock()
+
+	switch mode {
+	case "legacy":
+		if err := m.geo.legacyMgr.ResolveRulesets(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("ruleset enumeration failed; using configured legacy rulesets")
+		}
+		err = m.geo.legacyMgr.EnsureRules(ctx, site, v4, v6)
+	case "zone":
+		if err = m.geo.zoneMgr.Bootstrap(ctx, []string{site}); err == nil {
+			err = m.geo.zoneMgr.EnsurePolicies(ctx, site, v4, v6)
+		}
+	}
+	if err != nil {
+		m.log.Error().Err(err).Str("site", site).Str("mode", mode).
+			Msg("country blocking: failed to ensure rules/policies")
+		return
+	}
+	m.log.Info().Str("site", site).Strs("countries", m.geo.countries).
+		Int("v4_groups", len(v4.GroupIDs())).Msg("country blocks ensured")
+}
+
+// syncCountryFamily loads the country groups of one family and, when cidrs
+// is non-nil, replaces their members with it before flushing.
+func (m *managerImpl) syncCountryFamily(ctx context.Context, site, mode string, ipv6 bool, cidrs []string) (*ShardManager, error) {
+	capacity := m.cfg.GroupCapacityV4
+	if ipv6 {
+		capacity = m.cfg.GroupCapacityV6
+	}
+	sm := NewShardManager(site, ipv6, capacity, m.geo.namer, m.ctrl, m.store, m.log,
+		m.cfg.APIShardDelay, m.flushSem, false, mode)
+	sm.SetFlushTimeout(m.cfg.FlushTimeout)
+	if err := sm.EnsureShards(ctx); err != nil {
+		return nil, fmt.Errorf("load country groups: %w", err)
+	}
+	m.deleteOrphanedGroups(ctx, site, mode, sm)
+	if cidrs == nil {
+		return sm, nil
+	}
+
+	desired := make(map[string]bool, len(cidrs))
+	for _, cidr := range cidrs {
+		if _, _, err := sm.Add(ctx, cidr); err != nil {
+			var fm *ErrFamilyMismatch
+			if !errors.As(err, &fm) {
+				m.log.Debug().Err(err).Str("cidr", cidr).Msg("skipping unusable country CIDR")
+			}
+			continue
+		}
+		desired[normalizeMember(cidr)] = true
+	}
+	for _, member := range sm.AllMembers() {
+		if !desired[member] {
+			if _, err := sm.Remove(ctx, member); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := sm.FlushDirty(ctx); err != nil {
+		return nil, fmt.Errorf("flush country groups: %w", err)
+	}
+	return sm, nil
+}
+
+// drainCountryBlocks removes the country rules/policies and groups of a site.
+func (m *managerImpl) drainCountryBlocks(ctx context.Context, site, mode string) int {
+	if m.geo == nil {
+		return 0
+	}
+	if m.cfg.DryRun {
+		m.log.Info().Str("site", site).Msg("[DRY-RUN] would delete country block groups and rules/policies")
+		return 0
+	}
+	switch mode {
+	case "zone":
+		if err := m.geo.zoneMgr.DeletePolicies(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("drain: delete country policies error")
+		}
+	case "legacy":
+		if err := m.geo.legacyMgr.DeleteRules(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("drain: delete country rules error")
+		}
+	}
+
+	m.mu.RLock()
+	v4, v6 := m.geo.v4Mgrs[site], m.geo.v6Mgrs[site]
+	m.mu.RUnlock()
+	deleted := 0
+	for _, sm := range []*ShardManager{v4, v6} {
+		if sm == nil {
+			continue
+		}
+		for _, groupID := range sm.GroupIDs() {
+			if groupID == "" {
+				continue
+			}
+			if err := sm.DeleteShardObject(ctx, groupID); err != nil {
+				m.log.Warn().Err(err).Str("site", site).Str("group_id", groupID).
+					Msg("drain: delete country group error")
+			}
+			deleted++
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,205 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/rs/zerolog"
+)
+
+// fakeCountrySource serves fixed per-country lists.
+type fakeCountrySource struct {
+	v4  map[string][]string
+	err error
+}
+
+func (f *fakeCountrySource) FetchCountry(_ context.Context, country string, ipv6 bool) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if ipv6 {
+		return nil, nil
+	}
+	return f.v4[country], nil
+}
+
+func countryManagerConfig(src CountrySource) ManagerConfig {
+	cfg := defaultManagerConfig()
+	cfg.BlockCountries = []string{"CN", "RU"}
+	cfg.CountrySource = src
+	return cfg
+}
+
+// groupMembersByName returns the members of every group on the mock controller.
+func groupMembersByName(t *testing.T, ctrl *testutil.MockController) map[string][]string {
+	t.Helper()
+	groups, err := ctrl.ListFirewallGroups(context.Background(), testSite)
+	if err != nil {
+		t.Fatalf("ListFirewallGroups: %v", err)
+	}
+	out := make(map[string][]string, len(groups))
+	for _, g := range groups {
+		out[g.Name] = g.GroupMembers
+	}
+	return out
+}
+
+// TestEnsureInfrastructure_CountryBlocks verifies that country CIDRs land in
+// their own groups with a dedicated drop rule.
+func TestEnsureInfrastructure_CountryBlocks(t *testing.T) {
+	src := &fakeCountrySource{v4: map[string][]string{
+		"CN": {"1.0.1.0/24", "1.0.2.0/23"},
+		"RU": {"2.56.88.0/22"},
+	}}
+	mgr, ctrl, store := newTestManager(t, countryManagerConfig(src))
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	members := groupMembersByName(t, ctrl)["crowdsec-geo-block-v4-0"]
+	if len(members) != 3 {
+		t.Fatalf("geo group members = %v, want the 3 country CIDRs", members)
+	}
+	rec, err := store.GetPolicy("crowdsec-geo-drop-v4-0")
+	if err != nil || rec == nil {
+		t.Fatalf("geo drop rule not recorded: rec=%v err=%v", rec, err)
+	}
+	if rec.Mode != countryModeLegacy {
+		t.Errorf("geo rule mode = %q, want %q", rec.Mode, countryModeLegacy)
+	}
+
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	found := false
+	for _, r := range rules {
+		if r.Name != "crowdsec-geo-drop-v4-0" {
+			continue
+		}
+		found = true
+		if r.RuleIndex != 22000+countryRuleIndexOffset {
+			t.Errorf("geo rule index = %d, want %d", r.RuleIndex, 22000+countryRuleIndexOffset)
+		}
+	}
+	if !found {
+		t.Error("geo drop rule not created on the controller")
+	}
+}
+
+// TestReconcile_LeavesCountryBlocks verifies that Reconcile, which prunes
+// shard members without a stored ban, does not touch the country groups.
+func TestReconcile_LeavesCountryBlocks(t *testing.T) {
+	src := &fakeCountrySource{v4: map[string][]string{"CN": {"1.0.1.0/24"}}}
+	mgr, ctrl, _ := newTestManager(t, countryManagerConfig(src))
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if _, err := mgr.Reconcile(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	members := groupMembersByName(t, ctrl)["crowdsec-geo-block-v4-0"]
+	if strings.Join(members, ",") != "1.0.1.0/24" {
+		t.Errorf("geo group members after reconcile = %v, want [1.0.1.0/24]", members)
+	}
+	if mgr.(*managerImpl).shardMgr(testSite, false).Contains("1.0.1.0/24") {
+		t.Error("country CIDR must not be added to the decision shards")
+	}
+}
+
+// TestEnsureInfrastructure_CountryListRefresh verifies that a later startup
+// drops CIDRs no longer listed, and keeps the existing members when the
+// download fails.
+func TestEnsureInfrastructure_CountryListRefresh(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	src := &fakeCountrySource{v4: map[string][]string{"CN": {"1.0.1.0/24", "1.0.2.0/23"}}}
+	start := func() {
+		t.Helper()
+		mgr := NewManager(countryManagerConfig(src), ctrl, store, managerTestNamer(t), zerolog.Nop())
+		if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+			t.Fatalf("EnsureInfrastructure: %v", err)
+		}
+	}
+	start()
+
+	src.v4["CN"] = []string{"1.0.1.0/24"}
+	start()
+	if got := groupMembersByName(t, ctrl)["crowdsec-geo-block-v4-0"]; strings.Join(got, ",") != "1.0.1.0/24" {
+		t.Fatalf("members after refresh = %v, want [1.0.1.0/24]", got)
+	}
+
+	src.err = errors.New("download failed")
+	start()
+	if got := groupMembersByName(t, ctrl)["crowdsec-geo-block-v4-0"]; strings.Join(got, ",") != "1.0.1.0/24" {
+		t.Errorf("members after failed download = %v, want them kept", got)
+	}
+}
+
+// TestDrain_RemovesCountryBlocks verifies that Drain deletes the country
+// rule and group alongside the decision shards.
+func TestDrain_RemovesCountryBlocks(t *testing.T) {
+	src := &fakeCountrySource{v4: map[string][]string{"CN": {"1.0.1.0/24"}}}
+	mgr, ctrl, store := newTestManager(t, countryManagerConfig(src))
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.Drain(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	if _, ok := groupMembersByName(t, ctrl)["crowdsec-geo-block-v4-0"]; ok {
+		t.Error("geo group should be deleted by Drain")
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	for _, r := range rules {
+		if r.Name == "crowdsec-geo-drop-v4-0" {
+			t.Error("geo rule should be deleted by Drain")
+		}
+	}
+	if rec, _ := store.GetPolicy("crowdsec-geo-drop-v4-0"); rec != nil {
+		t.Error("geo rule record should be removed by Drain")
+	}
+}
+
+// TestEnableEnforcement_IncludesCountryBlocks verifies that rules created
+// disabled, country rules included, are all enabled by EnableEnforcement.
+func TestEnableEnforcement_IncludesCountryBlocks(t *testing.T) {
+	src := &fakeCountrySource{v4: map[string][]string{"CN": {"1.0.1.0/24"}}}
+	cfg := countryManagerConfig(src)
+	cfg.LegacyCfg.CreateDisabled = true
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	if len(rules) == 0 {
+		t.Fatal("no rules created")
+	}
+	for _, r := range rules {
+		if r.Enabled {
+			t.Fatalf("rule %s created enabled despite CreateDisabled", r.Name)
+		}
+	}
+
+	n, err := mgr.EnableEnforcement(ctx, []string{testSite})
+	if err != nil {
+		t.Fatalf("EnableEnforcement: %v", err)
+	}
+	if n != len(rules) {
+		t.Errorf("EnableEnforcement changed %d rules, want %d", n, len(rules))
+	}
+	rules, _ = ctrl.ListFirewallRules(ctx, testSite)
+	for _, r := range rules {
+		if !r.Enabled {
+			t.Errorf("rule %s still disabled", r.Name)
+		}
+	}
+}
@@ -4,14 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ShardLimit is the maximum number of IPs per Traffic Matching List shard.
@@ -60,8 +64,16 @@ type Shard struct {
 	// onDrainedFired is set to true after onDrained has been called once for
 	// this shard. Prevents duplicate policy/rule deletion attempts on retry ticks.
 	onDrainedFired bool
+
+	// saturationWarned is set while the shard is at or above
+	// shardSaturationWarn, so the warning is logged once per crossing.
+	saturationWarned bool
 }
 
+// shardSaturationWarn is the fill ratio at which a shard is reported as
+// nearly full: the next overflow provisions a new shard, which is slow.
+const shardSaturationWarn = 0.9
+
 // orphanedGroup represents a placeholder-only UniFi group found during EnsureShards
 // that should be deleted (policies/rules first, then the group itself).
 type orphanedGroup struct {
@@ -75,8 +87,69 @@ type ShardFamily struct {
 	// ipOwner maps each banned IP to the shard index that owns it.
 	// Guarded by ShardManager.mu.
 	ipOwner map[string]int
+	// ranges holds the parsed network of every CIDR member, keyed by the
+	// member string as stored in ipOwner. Used by Contains to match single
+	// IPs that fall inside a banned range. Guarded by ShardManager.mu.
+	ranges map[string]*net.IPNet
+}
+
+// ErrFamilyMismatch is returned by ShardManager.Add and Remove when an address belongs to
+// the other IP family. UniFi rejects a v6 member in an address-group (and vice
+// versa), so the caller must route it to the matching ShardManager instead.
+type ErrFamilyMismatch struct {
+	IP   string
+	IPv6 bool // family of IP, not of the ShardManager
+}
+
+func (e *ErrFamilyMismatch) Error() string {
+	return fmt.Sprintf("address %s is %s but shard manager is %s", e.IP, Family(e.IPv6), Family(!e.IPv6))
+}
+
+// ErrShardLimit is returned by ShardManager.Add when every shard of the family
+// is full and FIREWALL_MAX_SHARDS forbids creating another one.
+type ErrShardLimit struct {
+	Site   string
+	Family string
+	Limit  int
+}
+
+func (e *ErrShardLimit) Error() string {
+	return fmt.Sprintf("site %s %s: all %d shards are full (FIREWALL_MAX_SHARDS)", e.Site, e.Family, e.Limit)
+}
+
+// ErrForeignGroup is returned when a UniFi object already carries a shard's
+// templated name but was not created by this bouncer, and GROUP_NAME_COLLISION
+// is CollisionRefuse. Groups and traffic matching lists have no description
+// field, so ownership is taken from the ID recorded in the store.
+type ErrForeignGroup struct {
+	Kind string // "firewall group" or "traffic matching list"
+	Name string
+	ID   string
+	Site string
+}
+
+func (e *ErrForeignGroup) Error() string {
+	return fmt.Sprintf("%s %q (id %s) on site %s was not created by this bouncer; "+
+		"rename or delete it, or set a different GROUP_NAME_TEMPLATE", e.Kind, e.Name, e.ID, e.Site)
 }
 
+// Group name collision modes (GROUP_NAME_COLLISION). With CollisionAdopt an
+// existing object carrying a shard's name is taken over; CollisionRefuse
+// fails with ErrForeignGroup unless the store recorded its ID.
+const (
+	CollisionAdopt  = "adopt"
+	CollisionRefuse = "refuse"
+)
+
+// CIDR subsumption modes (FIREWALL_CIDR_SUBSUMPTION). With SubsumeSkip a
+// member already covered by a banned range is not added; SubsumePrune also
+// removes the members a newly banned range covers.
+const (
+	SubsumeOff   = "off"
+	SubsumeSkip  = "skip"
+	SubsumePrune = "prune"
+)
+
 // ShardManager manages a set of firewall group shards for one address family on one site.
 // In zone mode, shards are Traffic Matching Lists; in legacy mode, they are firewall groups.
 type ShardManager struct {
@@ -121,10 +194,37 @@ type ShardManager struct {
 	// Called with (ctx, shardIdx, groupID).
 	onDrained func(ctx context.Context, shardIdx int, groupID string)
 
+	// subsumption controls members covered by a banned range; see
+	// SetCIDRSubsumption. Empty behaves as SubsumeOff.
+	subsumption string
+
 	// mergeThreshold is the IP count at or below which a shard is eligible for
 	// consolidation into a larger shard. 0 = auto (shardLimit/2). -1 = disabled.
 	mergeThreshold int
 
+	// flushTimeout bounds each flush write; see SetFlushTimeout. 0 = no bound
+	// beyond the caller's context.
+	flushTimeout time.Duration
+
+	// maxShards caps the shards of this family; see SetMaxShards. 0 = no cap.
+	// limitLogged is set once a refusal has been logged and cleared when the
+	// family has room again, so a flood of bans logs one error. Guarded by mu.
+	maxShards   int
+	limitLogged bool
+
+	// reportShardCount publishes firewall_shard_count for this family; see
+	// SetReportShardCount.
+	reportShardCount bool
+
+	// nameCollision is CollisionAdopt or CollisionRefuse; see
+	// SetNameCollision. Empty behaves as CollisionAdopt.
+	nameCollision string
+
+	// banPending maps each member added through Add with an enqueue time
+	// (see WithBanEnqueued) to that time, until a flush writes it to UniFi and
+	// BanApplyLatency is observed. Guarded by mu.
+	banPending map[string]time.Time
+
 	// orphanedGroups is populated by EnsureShards with placeholder-only groups found in UniFi.
 	// These groups should be deleted (policies/rules first, then the group).
 	// Guarded by mu.
@@ -171,6 +271,7 @@ func NewShardManager(site string, ipv6 bool, capacity int, namer *Namer,
 			family: {
 				Shards:  []*Shard{},
 				ipOwner: make(map[string]int),
+				ranges:  make(map[string]*net.IPNet),
 			},
 		},
 	}
@@ -200,12 +301,71 @@ func (sm *ShardManager) SetDrainCallback(fn func(ctx context.Context, shardIdx i
 	sm.onDrained = fn
 }
 
+// SetCIDRSubsumption configures how members covered by a banned range are
+// handled (SubsumeOff, SubsumeSkip or SubsumePrune).
+func (sm *ShardManager) SetCIDRSubsumption(mode string) {
+	sm.subsumption = mode
+}
+
 // SetMergeThreshold configures the IP count at or below which a shard is eligible
 // for consolidation. 0 = auto (shardLimit/2). -1 = disable rebalancing.
 func (sm *ShardManager) SetMergeThreshold(n int) {
 	sm.mergeThreshold = n
 }
 
+// SetNameCollision configures what happens when an object with a shard's name
+// already exists in UniFi but is not recorded in the store (CollisionAdopt or
+// CollisionRefuse).
+func (sm *ShardManager) SetNameCollision(mode string) {
+	sm.nameCollision = mode
+}
+
+// checkOwnership returns ErrForeignGroup when refusing collisions and id is
+// not the UniFi ID the store recorded for name.
+func (sm *ShardManager) checkOwnership(name, id string) error {
+	if sm.nameCollision != CollisionRefuse {
+		return nil
+	}
+	rec, err := sm.store.GetGroup(name)
+	if err != nil {
+		return fmt.Errorf("check ownership of %s: %w", name, err)
+	}
+	if rec != nil && rec.UnifiID == id && rec.Site == sm.site {
+		return nil
+	}
+	return &ErrForeignGroup{Kind: sm.shardObjectKind(), Name: name, ID: id, Site: sm.site}
+}
+
+// SetFlushTimeout bounds each PUT issued by FlushDirty, so a controller that
+// stops answering cannot hold a flush (and the shared semaphore) indefinitely.
+func (sm *ShardManager) SetFlushTimeout(d time.Duration) {
+	sm.flushTimeout = d
+}
+
+// SetMaxShards caps the number of shards of this family. Once they are all
+// full, Add fails with ErrShardLimit instead of allocating another shard.
+// n <= 0 removes the cap.
+func (sm *ShardManager) SetMaxShards(n int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.maxShards = n
+}
+
+// SetReportShardCount makes the manager publish its shard count as
+// firewall_shard_count. Only the decision shards report it: country and
+// log-sample groups share the site and family labels.
+func (sm *ShardManager) SetReportShardCount(on bool) {
+	sm.reportShardCount = on
+}
+
+// flushCallContext derives the context for one flush write from ctx.
+func (sm *ShardManager) flushCallContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if sm.flushTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, sm.flushTimeout)
+}
+
 // TakeOrphanedGroups returns and clears the list of placeholder-only groups found during EnsureShards.
 // These are groups that exist in UniFi but contain only placeholder IPs and should be deleted.
 func (sm *ShardManager) TakeOrphanedGroups() []orphanedGroup {
@@ -311,6 +471,11 @@ func (sm *ShardManager) EnsureShards(ctx context.Context) error {
 
 		if sm.mode == "zone" {
 			if tml, exists := apiTMLByName[name]; exists {
+				if rec.UnifiID != tml.ID {
+					if err := sm.checkOwnership(name, tml.ID); err != nil {
+						return err
+					}
+				}
 				members := make([]string, 0, len(tml.Items))
 				for _, item := range tml.Items {
 					if item.Value == TMLPlaceholderV4 || item.Value == TMLPlaceholderV6 {
@@ -393,13 +558,24 @@ func (sm *ShardManager) EnsureShards(ctx context.Context) error {
 	// shards and those shards are left dirty for sync.
 	for _, shard := range family.Shards {
 		for _, ip := range shard.IPs.Members() {
-			if _, exists := family.ipOwner[ip]; exists {
+			// Rewrite host-length CIDRs (e.g. 2001:db8::1/128) to the bare
+			// host so they dedupe against the plain form.
+			if norm := normalizeMember(ip); norm != ip {
+				shard.IPs.Remove(ip)
+				ip = norm
+				shard.IPs.Add(ip)
+			}
+			if owner, exists := family.ipOwner[ip]; exists {
+				if owner == shard.Index {
+					continue // both forms were in this shard; one copy is kept
+				}
 				shard.IPs.Remove(ip)
 				sm.log.Warn().Str("shard", shard.Name).Str("ip", ip).
 					Msg("removed duplicate IP from higher-index shard during baseline load")
 				continue
 			}
 			family.ipOwner[ip] = shard.Index
+			family.trackRange(ip)
 		}
 	}
 
@@ -420,6 +596,12 @@ func (sm *ShardManager) EnsureShards(ctx context.Context) error {
 // nextIndex, one would win the re-lock and create the shard, and the rest
 // would find that shard already full and return an error.
 func (sm *ShardManager) AddIP(_ context.Context, ip, ipFamily string) error {
+	network, err := parseMember(ip)
+	if err != nil {
+		return err
+	}
+	ip = normalizeMember(ip)
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -428,6 +610,22 @@ func (sm *ShardManager) AddIP(_ context.Context, ip, ipFamily string) error {
 	if _, owned := family.ipOwner[ip]; owned {
 		return nil
 	}
+	if sm.subsumption == SubsumeSkip || sm.subsumption == SubsumePrune {
+		if covering := family.coveringRange(ip, network); covering != "" {
+			sm.log.Debug().Str("ip", ip).Str("covered_by", covering).
+				Msg("skipping member already covered by a banned range")
+			return nil
+		}
+	}
+	// Checked before any member is pruned so a refused range does not unban
+	// the addresses it covers.
+	if err := sm.checkShardLimitLocked(family, ipFamily); err != nil {
+		return err
+	}
+	family.trackRange(ip)
+	if ones, bits := network.Mask.Size(); sm.subsumption == SubsumePrune && ones < bits {
+		sm.pruneCoveredLocked(family, ip, network)
+	}
 
 	for _, shard := range family.Shards {
 		if shard.State == ShardStateDraining {
@@ -451,8 +649,33 @@ func (sm *ShardManager) AddIP(_ context.Context, ip, ipFamily string) error {
 	return nil
 }
 
+// checkShardLimitLocked returns ErrShardLimit when no shard of family has room
+// and maxShards forbids allocating another. The first refusal is logged and
+// every refusal counted. Caller must hold sm.mu.
+func (sm *ShardManager) checkShardLimitLocked(family *ShardFamily, ipFamily string) error {
+	if sm.maxShards <= 0 || len(family.Shards) < sm.maxShards {
+		sm.limitLogged = false
+		return nil
+	}
+	for _, shard := range family.Shards {
+		if shard.State != ShardStateDraining && shard.IPs.Capacity(sm.shardLimit) > 0 {
+			sm.limitLogged = false
+			return nil
+		}
+	}
+	metrics.ShardLimitReached.WithLabelValues(ipFamily, sm.site).Inc()
+	if !sm.limitLogged {
+		sm.limitLogged = true
+		sm.log.Error().Str("site", sm.site).Str("family", ipFamily).Int("max_shards", sm.maxShards).
+			Int("capacity", sm.shardLimit).
+			Msg("all shards are full and FIREWALL_MAX_SHARDS is reached; new bans are refused until bans expire or the limit is raised")
+	}
+	return &ErrShardLimit{Site: sm.site, Family: ipFamily, Limit: sm.maxShards}
+}
+
 // RemoveIP removes ip from whichever shard owns it. No-op if not tracked.
 func (sm *ShardManager) RemoveIP(ip, ipFamily string) {
+	ip = normalizeMember(ip)
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -466,15 +689,59 @@ func (sm *ShardManager) RemoveIP(ip, ipFamily string) {
 		shard.IPs.Remove(ip)
 	}
 	delete(family.ipOwner, ip)
+	delete(family.ranges, ip)
+	delete(sm.banPending, ip)
 	sm.updateMetricsLocked()
 }
 
+// notePending records when the ban for ip was enqueued, keeping the earliest
+// time if it is already waiting for a flush.
+func (sm *ShardManager) notePending(ip string, at time.Time) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, ok := sm.banPending[ip]; ok {
+		return
+	}
+	if sm.banPending == nil {
+		sm.banPending = make(map[string]time.Time)
+	}
+	sm.banPending[ip] = at
+}
+
+// observeFlushed records BanApplyLatency for every pending member that a
+// successful flush has just written to UniFi.
+func (sm *ShardManager) observeFlushed(members []string) {
+	now := time.Now()
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if len(sm.banPending) == 0 {
+		return
+	}
+	for _, m := range members {
+		at, ok := sm.banPending[m]
+		if !ok {
+			continue
+		}
+		metrics.BanApplyLatency.WithLabelValues(sm.family, sm.site).Observe(now.Sub(at).Seconds())
+		delete(sm.banPending, m)
+	}
+}
+
 // Add adds an IP to the manager family and returns shard details for callers
 // that need to provision rule/policy infrastructure when a new shard appears.
 func (sm *ShardManager) Add(ctx context.Context, ip string) (shardName string, newShardIdx int, err error) {
+	network, err := parseMember(ip)
+	if err != nil {
+		return "", -1, err
+	}
+	if isV6 := network.IP.To4() == nil; isV6 != sm.ipv6 {
+		return "", -1, &ErrFamilyMismatch{IP: ip, IPv6: isV6}
+	}
+	ip = normalizeMember(ip)
 	sm.mu.RLock()
 	family := sm.families[sm.family]
 	before := len(family.Shards)
+	_, existed := family.ipOwner[ip]
 	sm.mu.RUnlock()
 
 	if err := sm.AddIP(ctx, ip, sm.family); err != nil {
@@ -489,6 +756,9 @@ func (sm *ShardManager) Add(ctx context.Context, ip string) (shardName string, n
 	if !owned {
 		return "", -1, nil
 	}
+	if at, ok := banEnqueuedAt(ctx); ok && !existed {
+		sm.notePending(ip, at)
+	}
 
 	name, err := sm.namer.GroupName(NameData{Family: Family(sm.ipv6), Index: ownerIdx, Site: sm.site})
 	if err != nil {
@@ -504,6 +774,12 @@ func (sm *ShardManager) Add(ctx context.Context, ip string) (shardName string, n
 
 // Remove removes an IP from whichever shard contains it.
 func (sm *ShardManager) Remove(ctx context.Context, ip string) (string, error) {
+	if network, err := parseMember(ip); err == nil {
+		if isV6 := network.IP.To4() == nil; isV6 != sm.ipv6 {
+			return "", &ErrFamilyMismatch{IP: ip, IPv6: isV6}
+		}
+	}
+	ip = normalizeMember(ip)
 	sm.mu.RLock()
 	family := sm.families[sm.family]
 	shardIdx, owned := family.ipOwner[ip]
@@ -524,7 +800,14 @@ func (sm *ShardManager) Remove(ctx context.Context, ip string) (string, error) {
 // FlushDirty pushes all dirty shards to the UniFi API.
 // The mutex is released before any HTTP call or sleep, allowing Add/Remove to proceed
 // concurrently. On failure the affected shard is re-marked dirty for retry.
-func (sm *ShardManager) FlushDirty(ctx context.Context) error {
+func (sm *ShardManager) FlushDirty(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "firewall.FlushDirty", tracing.Site(sm.site), tracing.Family(sm.family))
+	defer func() { tracing.End(span, &err) }()
+	return sm.flushDirty(ctx)
+}
+
+// flushDirty implements FlushDirty inside its span.
+func (sm *ShardManager) flushDirty(ctx context.Context) error {
 	groupType := "address-group"
 	if sm.ipv6 {
 		groupType = "ipv6-address-group"
@@ -626,18 +909,23 @@ func (sm *ShardManager) FlushDirty(ctx context.Context) error {
 	}
 
 	// --- Phase 2: flush each snapshot without holding the lock ---
+	if sm.mode != "zone" && len(snapshots) > 1 && sm.bulkGroupsSupported(ctx) {
+		return sm.flushBulk(ctx, snapshots, groupType)
+	}
+
+	// A canceled ctx stops the loop at the next snapshot; every snapshot not
+	// yet written is re-marked dirty for the next flush.
 	var firstErr error
 	for i, snap := range snapshots {
+		if err := ctx.Err(); err != nil {
+			sm.remarkDirty(snapshots[i:])
+			return err
+		}
 		if i > 0 && sm.flushDelay > 0 {
 			select {
 			case <-time.After(sm.flushDelay):
 			case <-ctx.Done():
-				sm.mu.Lock()
-				family := sm.familyStateLocked(sm.family)
-				for _, s := range snapshots[i:] {
-					family.Shards[s.idx].IPs.Replace(s.members)
-				}
-				sm.mu.Unlock()
+				sm.remarkDirty(snapshots[i:])
 				return ctx.Err()
 			}
 		}
@@ -646,23 +934,23 @@ func (sm *ShardManager) FlushDirty(ctx context.Context) error {
 			select {
 			case sm.flushSem <- struct{}{}:
 			case <-ctx.Done():
-				sm.mu.Lock()
-				family := sm.familyStateLocked(sm.family)
-				for _, s := range snapshots[i:] {
-					family.Shards[s.idx].IPs.Replace(s.members)
-				}
-				sm.mu.Unlock()
+				sm.remarkDirty(snapshots[i:])
 				return ctx.Err()
 			}
 		}
 
+		start := time.Now()
+		putCtx, cancel := sm.flushCallContext(ctx)
+		putCtx, span := tracing.Start(putCtx, "firewall.flushShard",
+			tracing.Site(sm.site), tracing.Family(sm.family), tracing.Shard(snap.name),
+			attribute.Int("bouncer.members", len(snap.members)))
 		var putErr error
 		if sm.mode == "zone" {
 			items := make([]controller.TrafficMatchingListItem, 0, len(snap.members))
 			for _, m := range snap.members {
 				items = append(items, controller.TrafficMatchingListItem{Type: "IP_ADDRESS", Value: m})
 			}
-			putErr = sm.ctrl.UpdateTrafficMatchingList(ctx, sm.site, controller.TrafficMatchingList{
+			putErr = sm.ctrl.UpdateTrafficMatchingList(putCtx, sm.site, controller.TrafficMatchingList{
 				ID:        snap.unifiID,
 				Name:      snap.name,
 				Type:      tmlType,
@@ -670,23 +958,29 @@ func (sm *ShardManager) FlushDirty(ctx context.Context) error {
 				Items:     items,
 			})
 		} else {
-			putErr = sm.ctrl.UpdateFirewallGroup(ctx, sm.site, controller.FirewallGroup{
+			putErr = sm.updateGroupMerging(putCtx, controller.FirewallGroup{
 				ID:           snap.unifiID,
 				Name:         snap.name,
 				GroupType:    groupType,
 				GroupMembers: snap.members,
 			})
 		}
+		tracing.End(span, &putErr)
+		cancel()
+		metrics.FirewallFlushDuration.WithLabelValues(sm.family, sm.site).Observe(time.Since(start).Seconds())
 
 		if sm.flushSem != nil {
 			<-sm.flushSem
 		}
 
 		if putErr != nil {
-			sm.mu.Lock()
-			family := sm.familyStateLocked(sm.family)
-			family.Shards[snap.idx].IPs.Replace(snap.members)
-			sm.mu.Unlock()
+			metrics.FirewallFlushErrors.WithLabelValues(sm.family, sm.site).Inc()
+			sm.noteOversize(putErr, snap.name, len(snap.members))
+			if err := ctx.Err(); err != nil {
+				sm.remarkDirty(snapshots[i:])
+				return err
+			}
+			sm.remarkDirty(snapshots[i : i+1])
 
 			if firstErr == nil {
 				firstErr = fmt.Errorf("flush shard %d (%s): %w", snap.idx, snap.name, putErr)
@@ -694,37 +988,238 @@ func (sm *ShardManager) FlushDirty(ctx context.Context) error {
 			continue
 		}
 
-		// Pending→Active transition: mark as Active and fire activation callback
-		wasCreating := snap.shard.State == ShardStatePending
-		if wasCreating {
-			snap.shard.State = ShardStateActive
+		sm.completeSnapshotFlush(ctx, snap)
+	}
+
+	return firstErr
+}
+
+// updateGroupMerging writes g, the shard's desired members. The legacy
+// firewallgroup API carries no revision to send with the PUT, so a concurrent
+// edit by another replica or a human only shows up as a 409 Conflict. On that
+// the group is re-listed and only this bouncer's own pending change since its
+// last write (per the group cache) is applied on top of it, so the other
+// writer's edit survives this write. The shard itself keeps tracking only its
+// own members, which stay the base recorded in the cache.
+func (sm *ShardManager) updateGroupMerging(ctx context.Context, g controller.FirewallGroup) error {
+	err := sm.ctrl.UpdateFirewallGroup(ctx, sm.site, g)
+	var conflict *controller.ErrConflict
+	if !errors.As(err, &conflict) {
+		return err
+	}
+	rebased, listErr := sm.rebaseMembers(ctx, g)
+	if listErr != nil {
+		sm.log.Warn().Err(listErr).Str("shard", g.Name).Msg("group update conflicted and re-listing it failed")
+		return err
+	}
+	if len(rebased) > sm.shardLimit {
+		// The merge would overflow the shard (capacity is already clamped to
+		// FIREWALL_GROUP_HARD_MAX); write the bouncer's own members instead.
+		sm.log.Warn().Str("shard", g.Name).Int("members", len(rebased)).Int("capacity", sm.shardLimit).
+			Msg("group changed concurrently (409 conflict) but the merge exceeds capacity; retrying with own members")
+	} else {
+		sm.log.Warn().Str("shard", g.Name).Int("members", len(rebased)).
+			Msg("group changed concurrently (409 conflict); retrying with own changes applied to the current group")
+		g.GroupMembers = rebased
+	}
+	if err := sm.ctrl.UpdateFirewallGroup(ctx, sm.site, g); err != nil {
+		return fmt.Errorf("retry after conflict: %w", err)
+	}
+	return nil
+}
+
+// rebaseMembers returns the members of g's group on the controller with the
+// change from the last write recorded in the store to g applied: members
+// added since then are added, members removed since then are removed.
+// Without a cached record there is no base to diff against and g's members
+// are returned as they are.
+func (sm *ShardManager) rebaseMembers(ctx context.Context, g controller.FirewallGroup) ([]string, error) {
+	groups, err := sm.ctrl.ListFirewallGroups(ctx, sm.site)
+	if err != nil {
+		return nil, err
+	}
+	var current *controller.FirewallGroup
+	for i := range groups {
+		if groups[i].ID == g.ID {
+			current = &groups[i]
+			break
 		}
+	}
+	if current == nil {
+		return nil, fmt.Errorf("group %s not found on the controller", g.ID)
+	}
+	rec, err := sm.store.GetGroup(g.Name)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return g.GroupMembers, nil
+	}
 
-		if err := sm.store.SetGroup(snap.name, storage.GroupRecord{
-			UnifiID: snap.unifiID,
-			Site:    sm.site,
-			Members: snap.members,
-			IPv6:    sm.ipv6,
-		}); err != nil {
-			sm.log.Warn().Err(err).Str("shard", snap.name).Msg("failed to update bbolt group cache")
+	last := memberSet(rec.Members)
+	desired := memberSet(g.GroupMembers)
+	members := memberSet(current.GroupMembers)
+	for m := range last {
+		if !desired[m] {
+			delete(members, m)
+		}
+	}
+	for m := range desired {
+		if !last[m] {
+			members[m] = true
 		}
+	}
+	if len(members) == 0 {
+		return g.GroupMembers, nil // keep the empty-group placeholder
+	}
+	rebased := make([]string, 0, len(members))
+	for m := range members {
+		rebased = append(rebased, m)
+	}
+	sort.Strings(rebased)
+	return rebased, nil
+}
 
-		// Capture callback, fire after loop with no lock held
-		var pendingCB func()
-		if wasCreating && sm.onActivated != nil {
-			cb := sm.onActivated
-			idx := snap.shard.Index
-			id := snap.shard.ID
-			pendingCB = func() { cb(ctx, idx, id) }
+// memberSet returns the valid members of a group as a set of normalised
+// addresses, leaving out the empty-group placeholders.
+func memberSet(members []string) map[string]bool {
+	set := make(map[string]bool, len(members))
+	for _, m := range members {
+		if m == TMLPlaceholderV4 || m == TMLPlaceholderV6 {
+			continue
 		}
+		if _, err := parseMember(m); err != nil {
+			continue
+		}
+		set[normalizeMember(m)] = true
+	}
+	return set
+}
 
-		// Fire callback outside loop with no lock held
-		if pendingCB != nil {
-			pendingCB()
+// groupOversizeCode is the error code the controller puts in the 400 response
+// body when a group write is rejected for its member count.
+const groupOversizeCode = "api.err.GroupMemberLimitExceeded"
+
+// noteOversize counts and explains a group write the controller rejected
+// for having too many members; other errors are ignored.
+func (sm *ShardManager) noteOversize(err error, name string, members int) {
+	var badReq *controller.ErrBadRequest
+	if !errors.As(err, &badReq) {
+		return
+	}
+	if !strings.Contains(badReq.Msg, groupOversizeCode) {
+		return
+	}
+	metrics.GroupRejectedOversize.WithLabelValues(sm.family, sm.site).Inc()
+	sm.log.Warn().Str("shard", name).Int("members", members).Int("capacity", sm.shardLimit).
+		Msg("controller rejected the group as too large; lower FIREWALL_GROUP_CAPACITY or FIREWALL_GROUP_HARD_MAX")
+}
+
+// bulkGroupsSupported reports whether the controller accepts batched firewall
+// group updates. Detection errors are treated as "not supported" so the flush
+// falls back to per-group PUTs.
+func (sm *ShardManager) bulkGroupsSupported(ctx context.Context) bool {
+	ok, err := sm.ctrl.HasFeature(ctx, sm.site, controller.FeatureBulkFirewallGroups)
+	if err != nil {
+		sm.log.Debug().Err(err).Str("site", sm.site).
+			Msg("bulk firewall group detection failed; using per-group PUTs")
+		return false
+	}
+	return ok
+}
+
+// flushBulk pushes every snapshot in a single BulkUpdateFirewallGroups call
+// instead of one PUT per shard, so no flushDelay spacing is needed. On failure
+// all snapshots are re-marked dirty for the next flush.
+func (sm *ShardManager) flushBulk(ctx context.Context, snapshots []flushSnapshot, groupType string) error {
+	if sm.flushSem != nil {
+		select {
+		case sm.flushSem <- struct{}{}:
+		case <-ctx.Done():
+			sm.remarkDirty(snapshots)
+			return ctx.Err()
 		}
 	}
 
-	return firstErr
+	groups := make([]controller.FirewallGroup, 0, len(snapshots))
+	for _, snap := range snapshots {
+		groups = append(groups, controller.FirewallGroup{
+			ID:           snap.unifiID,
+			Name:         snap.name,
+			GroupType:    groupType,
+			GroupMembers: snap.members,
+		})
+	}
+	start := time.Now()
+	putCtx, cancel := sm.flushCallContext(ctx)
+	err := sm.ctrl.BulkUpdateFirewallGroups(putCtx, sm.site, groups)
+	cancel()
+	metrics.FirewallFlushDuration.WithLabelValues(sm.family, sm.site).Observe(time.Since(start).Seconds())
+
+	if sm.flushSem != nil {
+		<-sm.flushSem
+	}
+
+	if err != nil {
+		metrics.FirewallFlushErrors.WithLabelValues(sm.family, sm.site).Add(float64(len(snapshots)))
+		largest := 0
+		for _, snap := range snapshots {
+			largest = max(largest, len(snap.members))
+		}
+		sm.noteOversize(err, "bulk update", largest)
+		sm.remarkDirty(snapshots)
+		return fmt.Errorf("bulk flush of %d shards: %w", len(snapshots), err)
+	}
+
+	for _, snap := range snapshots {
+		sm.completeSnapshotFlush(ctx, snap)
+	}
+	sm.log.Info().
+		Str("site", sm.site).
+		Int("shards", len(snapshots)).
+		Int("api_calls", 1).
+		Int("api_calls_saved", len(snapshots)-1).
+		Msg("flushed shards with a single bulk update")
+	return nil
+}
+
+// remarkDirty restores the members of each snapshot so the shards are flushed
+// again on the next tick.
+func (sm *ShardManager) remarkDirty(snapshots []flushSnapshot) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	family := sm.familyStateLocked(sm.family)
+	for _, snap := range snapshots {
+		family.Shards[snap.idx].IPs.Replace(snap.members)
+	}
+}
+
+// completeSnapshotFlush records a successfully written snapshot: it activates a
+// Pending shard, refreshes the bbolt group cache and fires the activation
+// callback (with no lock held).
+func (sm *ShardManager) completeSnapshotFlush(ctx context.Context, snap flushSnapshot) {
+	// Pending→Active transition: mark as Active and fire activation callback
+	wasCreating := snap.shard.State == ShardStatePending
+	if wasCreating {
+		sm.mu.Lock()
+		snap.shard.State = ShardStateActive
+		sm.publishShardCountLocked()
+		sm.mu.Unlock()
+	}
+
+	if err := sm.store.SetGroup(snap.name, storage.GroupRecord{
+		UnifiID: snap.unifiID,
+		Site:    sm.site,
+		Members: snap.members,
+		IPv6:    sm.ipv6,
+	}); err != nil {
+		sm.log.Warn().Err(err).Str("shard", snap.name).Msg("failed to update bbolt group cache")
+	}
+	sm.observeFlushed(snap.members)
+
+	if wasCreating && sm.onActivated != nil {
+		sm.onActivated(ctx, snap.shard.Index, snap.shard.ID)
+	}
 }
 
 // PrunableTail returns the last shard's UniFi ID and index if it is pruneable:
@@ -769,6 +1264,7 @@ func (sm *ShardManager) RemoveTail() error {
 		}
 	}
 	family.Shards = family.Shards[:n-1]
+	sm.publishShardCountLocked()
 	sm.mu.Unlock()
 
 	if nameErr != nil {
@@ -786,13 +1282,140 @@ func (sm *ShardManager) DeleteShardObject(ctx context.Context, unifiID string) e
 	return sm.ctrl.DeleteFirewallGroup(ctx, sm.site, unifiID)
 }
 
-// Contains returns true if any shard contains the given IP.
+// Contains returns true if any shard contains the given IP, either as an exact
+// member or because it falls inside a CIDR member. A CIDR query matches when
+// it is an exact member or is wholly covered by a larger CIDR member.
 func (sm *ShardManager) Contains(ip string) bool {
+	ip = normalizeMember(ip)
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
 	family := sm.families[sm.family]
-	_, ok := family.ipOwner[ip]
-	return ok
+	if _, ok := family.ipOwner[ip]; ok {
+		return true
+	}
+	if len(family.ranges) == 0 {
+		return false
+	}
+	query, err := parseMember(ip)
+	if err != nil {
+		return false
+	}
+	queryOnes, _ := query.Mask.Size()
+	for _, r := range family.ranges {
+		ones, _ := r.Mask.Size()
+		if ones <= queryOnes && r.Contains(query.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// coveringRanges returns the CIDR members, other than ip itself, that contain
+// ip.
+func (sm *ShardManager) coveringRanges(ip string) []string {
+	query, err := parseMember(ip)
+	if err != nil {
+		return nil
+	}
+	ip = normalizeMember(ip)
+	queryOnes, _ := query.Mask.Size()
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var covering []string
+	for name, r := range sm.families[sm.family].ranges {
+		if ones, _ := r.Mask.Size(); name != ip && ones <= queryOnes && r.Contains(query.IP) {
+			covering = append(covering, name)
+		}
+	}
+	sort.Strings(covering)
+	return covering
+}
+
+// parseMember validates a shard member as a single IP or a CIDR and returns
+// the network it covers (a /32 or /128 for a single IP).
+func parseMember(member string) (*net.IPNet, error) {
+	if ip := net.ParseIP(member); ip != nil {
+		bits := 128
+		if v4 := ip.To4(); v4 != nil {
+			ip, bits = v4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(member)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shard member %q: not an IP address or CIDR", member)
+	}
+	return network, nil
+}
+
+// isV6Member reports whether member is an IPv6 address or CIDR. IPv4-mapped
+// IPv6 addresses count as IPv4, matching normalizeMember.
+func isV6Member(member string) bool {
+	network, err := parseMember(member)
+	return err == nil && network.IP.To4() == nil
+}
+
+// normalizeMember returns the canonical form of a shard member: a host-length
+// CIDR (/32 for IPv4, /128 for IPv6) collapses to the bare address, IPv4-mapped
+// IPv6 becomes IPv4, and other CIDRs are reduced to their network address.
+// Unparseable input is returned unchanged for parseMember to reject.
+func normalizeMember(member string) string {
+	network, err := parseMember(member)
+	if err != nil {
+		return member
+	}
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return network.IP.String()
+	}
+	return network.String()
+}
+
+// trackRange records member in f.ranges if it is a CIDR. Caller holds sm.mu.
+func (f *ShardFamily) trackRange(member string) {
+	if f.ranges == nil {
+		f.ranges = make(map[string]*net.IPNet)
+	}
+	if _, network, err := net.ParseCIDR(member); err == nil {
+		f.ranges[member] = network
+	}
+}
+
+// coveringRange returns a tracked range other than member that contains
+// network, or "" if there is none.
+func (f *ShardFamily) coveringRange(member string, network *net.IPNet) string {
+	ones, _ := network.Mask.Size()
+	for name, r := range f.ranges {
+		if name == member {
+			continue
+		}
+		if rOnes, _ := r.Mask.Size(); rOnes <= ones && r.Contains(network.IP) {
+			return name
+		}
+	}
+	return ""
+}
+
+// pruneCoveredLocked removes the members that the newly tracked range covers.
+// Callers must hold sm.mu.
+func (sm *ShardManager) pruneCoveredLocked(family *ShardFamily, rangeMember string, network *net.IPNet) {
+	ones, _ := network.Mask.Size()
+	for member, shardIdx := range family.ipOwner {
+		m, err := parseMember(member)
+		if err != nil {
+			continue
+		}
+		if mOnes, _ := m.Mask.Size(); mOnes < ones || !network.Contains(m.IP) {
+			continue
+		}
+		if shard, _ := sm.findShardByIndexLocked(family, shardIdx); shard != nil {
+			shard.IPs.Remove(member)
+		}
+		delete(family.ipOwner, member)
+		delete(family.ranges, member)
+		sm.log.Debug().Str("ip", member).Str("covered_by", rangeMember).
+			Msg("pruned member covered by a banned range")
+	}
 }
 
 // AllMembers returns all IPs across all shards.
@@ -846,6 +1469,9 @@ func (sm *ShardManager) doCreateUniFiGroup(ctx context.Context, name string) (st
 			var conflict *controller.ErrConflict
 			if errors.As(err, &conflict) {
 				if id := sm.findExistingTMLByName(ctx, name); id != "" {
+					if err := sm.checkOwnership(name, id); err != nil {
+						return "", err
+					}
 					sm.log.Warn().Str("shard", name).Str("id", id).
 						Msg("TML already exists (409 conflict); recovering existing ID")
 					return id, nil
@@ -876,6 +1502,9 @@ func (sm *ShardManager) doCreateUniFiGroup(ctx context.Context, name string) (st
 		var conflict *controller.ErrConflict
 		if errors.As(err, &conflict) {
 			if id := sm.findExistingGroupByName(ctx, name); id != "" {
+				if err := sm.checkOwnership(name, id); err != nil {
+					return "", err
+				}
 				sm.log.Warn().Str("shard", name).Str("id", id).
 					Msg("firewall group already exists (409 conflict); recovering existing ID")
 				return id, nil
@@ -947,7 +1576,45 @@ func (sm *ShardManager) GroupIDs() []string {
 	return ids
 }
 
+// shardGroup is the index and UniFi ID of a shard that exists in UniFi.
+type shardGroup struct {
+	Index int
+	ID    string
+}
+
+// shardGroups returns the shards GroupIDs covers together with their index.
+// Names derived from a shard must use Index: a Pending shard below it makes
+// its position in GroupIDs smaller than its index.
+func (sm *ShardManager) shardGroups() []shardGroup {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	family := sm.families[sm.family]
+	groups := make([]shardGroup, 0, len(family.Shards))
+	for _, s := range family.Shards {
+		if s.State != ShardStatePending && s.ID != "" {
+			groups = append(groups, shardGroup{Index: s.Index, ID: s.ID})
+		}
+	}
+	return groups
+}
+
+// publishShardCountLocked sets firewall_shard_count to the number of shards
+// that exist in UniFi, i.e. what GroupIDs returns. Caller holds sm.mu.
+func (sm *ShardManager) publishShardCountLocked() {
+	if !sm.reportShardCount {
+		return
+	}
+	n := 0
+	for _, s := range sm.families[sm.family].Shards {
+		if s.State != ShardStatePending && s.ID != "" {
+			n++
+		}
+	}
+	metrics.FirewallShardCount.WithLabelValues(sm.family, sm.site).Set(float64(n))
+}
+
 func (sm *ShardManager) updateMetricsLocked() {
+	sm.publishShardCountLocked()
 	family := sm.families[sm.family]
 	familyName := Family(sm.ipv6)
 	for i, s := range family.Shards {
@@ -955,7 +1622,17 @@ func (sm *ShardManager) updateMetricsLocked() {
 		count := float64(s.IPs.Len())
 		metrics.FirewallGroupSize.WithLabelValues(familyName, name, sm.site).Set(count)
 		if sm.shardLimit > 0 {
-			metrics.ShardOccupancy.WithLabelValues(familyName, name, sm.site).Set(count / float64(sm.shardLimit))
+			fill := count / float64(sm.shardLimit)
+			metrics.ShardOccupancy.WithLabelValues(familyName, name, sm.site).Set(fill)
+			switch {
+			case fill >= shardSaturationWarn && !s.saturationWarned:
+				s.saturationWarned = true
+				sm.log.Warn().Str("shard", name).Str("site", sm.site).Int("members", s.IPs.Len()).
+					Int("capacity", sm.shardLimit).
+					Msg("shard is over 90% full; raise FIREWALL_GROUP_CAPACITY to avoid provisioning new shards")
+			case fill < shardSaturationWarn:
+				s.saturationWarned = false
+			}
 		}
 	}
 }
@@ -1038,6 +1715,7 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 		if state == ShardStatePending {
 			sm.mu.Lock()
 			shard.State = ShardStateActive
+			sm.publishShardCountLocked()
 			sm.mu.Unlock()
 			if sm.onActivated != nil {
 				cb := sm.onActivated
@@ -1059,6 +1737,7 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 	// Only applicable to Active shards — Pending shards must always be flushed.
 	if state == ShardStateActive && !shard.IPs.HasChangedFromFlushed() {
 		shard.IPs.MarkClean() // clear dirty flag; lastFlushed snapshot remains valid
+		sm.observeFlushed(ips)
 		sm.log.Debug().Str("shard", shard.Name).Msg("shard skipped: no change from last flush")
 		return nil
 	}
@@ -1118,7 +1797,7 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 			Items:     items,
 		})
 	} else {
-		putErr = sm.ctrl.UpdateFirewallGroup(ctx, sm.site, controller.FirewallGroup{
+		putErr = sm.updateGroupMerging(ctx, controller.FirewallGroup{
 			ID:           shard.ID,
 			Name:         shard.Name,
 			GroupType:    groupType,
@@ -1149,11 +1828,13 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 			sm.mu.Lock()
 			shard.State = ShardStatePending
 			shard.ID = ""
+			sm.publishShardCountLocked()
 			sm.mu.Unlock()
 			_ = sm.store.SetGroup(shard.Name, storage.GroupRecord{Site: sm.site, IPv6: sm.ipv6})
 			return nil
 		}
 
+		sm.noteOversize(putErr, shard.Name, len(ips))
 		sm.log.Error().Err(putErr).Str("shard", shard.Name).Str("shard_id", shard.ID).Int("ip_count", len(ips)).
 			Msg("shard sync failed, will retry next tick")
 		if sm.onSyncError != nil {
@@ -1163,6 +1844,7 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 	}
 
 	shard.IPs.CommitFlushed()
+	sm.observeFlushed(ips)
 	if err := sm.store.SetGroup(shard.Name, storage.GroupRecord{
 		UnifiID: shard.ID,
 		Site:    sm.site,
@@ -1178,6 +1860,7 @@ func (sm *ShardManager) syncShard(ctx context.Context, shard *Shard) error {
 	if wasCreating {
 		sm.mu.Lock()
 		shard.State = ShardStateActive
+		sm.publishShardCountLocked()
 		sm.mu.Unlock()
 		if sm.onActivated != nil {
 			cb := sm.onActivated
@@ -1418,6 +2101,7 @@ func (sm *ShardManager) drainShard(ctx context.Context, shard *Shard) {
 			delete(family.ipOwner, ip)
 		}
 	}
+	sm.publishShardCountLocked()
 	sm.mu.Unlock()
 
 	// 6. Increment rebalanced-shards metric.
@@ -2,13 +2,20 @@ package firewall
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/rs/zerolog"
 )
 
@@ -230,6 +237,54 @@ func TestAdd_NewShardOnOverflow(t *testing.T) {
 
 // TestRemove_Basic verifies that adding and then removing an IP causes Contains
 // to return false.
+// TestAdd_WarnsWhenShardNearlyFull verifies that the occupancy gauge tracks
+// the fill ratio and that crossing 90% logs one warning per crossing.
+func TestAdd_WarnsWhenShardNearlyFull(t *testing.T) {
+	var logs strings.Builder
+	sm := NewShardManager(testSite, false, 10, testNamer(t), testutil.NewMockController(), newBboltStore(t),
+		zerolog.New(&logs), 0, nil, false, "legacy")
+	ctx := context.Background()
+	if err := sm.EnsureShards(ctx); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	warnings := func() int { return strings.Count(logs.String(), "over 90% full") }
+
+	for i := 1; i <= 8; i++ {
+		if _, _, err := sm.Add(ctx, fmt.Sprintf("10.0.0.%d", i)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if n := warnings(); n != 0 {
+		t.Fatalf("warnings at 80%% fill = %d, want 0", n)
+	}
+	for i := 9; i <= 10; i++ {
+		if _, _, err := sm.Add(ctx, fmt.Sprintf("10.0.0.%d", i)); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	if n := warnings(); n != 1 {
+		t.Fatalf("warnings after filling the shard = %d, want 1", n)
+	}
+	name, _ := sm.namer.GroupName(NameData{Family: "v4", Index: 0, Site: testSite})
+	if got := promtestutil.ToFloat64(metrics.ShardOccupancy.WithLabelValues("v4", name, testSite)); got != 1 {
+		t.Errorf("shard_occupancy_ratio = %v, want 1", got)
+	}
+
+	// Dropping below the threshold re-arms the warning.
+	if _, err := sm.Remove(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := sm.Remove(ctx, "10.0.0.2"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, _, err := sm.Add(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if n := warnings(); n != 2 {
+		t.Errorf("warnings after crossing again = %d, want 2", n)
+	}
+}
+
 func TestRemove_Basic(t *testing.T) {
 	ctrl := testutil.NewMockController()
 	store := newBboltStore(t)
@@ -288,6 +343,49 @@ func TestFlushDirty_UpdatesAPI(t *testing.T) {
 	if got := ctrl.Calls("UpdateFirewallGroup"); got != 1 {
 		t.Errorf("UpdateFirewallGroup calls: got %d, want 1", got)
 	}
+	if promtestutil.CollectAndCount(metrics.FirewallFlushDuration) == 0 {
+		t.Error("firewall_flush_duration_seconds: no series recorded after flush")
+	}
+}
+
+// TestFlushDirty_CountsOversizeRejection verifies that a 400 naming the
+// member limit is counted in group_rejected_oversize_total, and that other
+// bad requests are not.
+func TestFlushDirty_CountsOversizeRejection(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	sm := newV4ShardManager(t, 5, ctrl, newBboltStore(t))
+	ctx := context.Background()
+	if err := sm.EnsureShards(ctx); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	rejected := metrics.GroupRejectedOversize.WithLabelValues("v4", testSite)
+	before := promtestutil.ToFloat64(rejected)
+
+	if _, _, err := sm.Add(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	ctrl.SetError("UpdateFirewallGroup", &controller.ErrBadRequest{Msg: `{"meta":{"rc":"error","msg":"api.err.InvalidGroupMembers"}}`})
+	if err := sm.FlushDirty(ctx); err == nil {
+		t.Fatal("FlushDirty: expected the injected error")
+	}
+	if got := promtestutil.ToFloat64(rejected) - before; got != 0 {
+		t.Errorf("unrelated bad request counted as oversize (+%v)", got)
+	}
+	ctrl.SetError("UpdateFirewallGroup", &controller.ErrBadRequest{Msg: `{"meta":{"rc":"error","msg":"name exceeds max length limit"}}`})
+	if err := sm.FlushDirty(ctx); err == nil {
+		t.Fatal("FlushDirty: expected the injected error")
+	}
+	if got := promtestutil.ToFloat64(rejected) - before; got != 0 {
+		t.Errorf("bad request mentioning a limit counted as oversize (+%v)", got)
+	}
+
+	ctrl.SetError("UpdateFirewallGroup", &controller.ErrBadRequest{Msg: `{"meta":{"rc":"error","msg":"api.err.GroupMemberLimitExceeded"}}`})
+	if err := sm.FlushDirty(ctx); err == nil {
+		t.Fatal("FlushDirty: expected the injected error")
+	}
+	if got := promtestutil.ToFloat64(rejected) - before; got != 1 {
+		t.Errorf("group_rejected_oversize_total increased by %v, want 1", got)
+	}
 }
 
 // TestFlushDirty_SkipsClean verifies that FlushDirty does not call
@@ -325,11 +423,290 @@ func TestFlushDirty_APIError(t *testing.T) {
 		t.Fatalf("Add: %v", err)
 	}
 
+	flushErrors := metrics.FirewallFlushErrors.WithLabelValues("v4", testSite)
+	before := promtestutil.ToFloat64(flushErrors)
+
 	ctrl.SetError("UpdateFirewallGroup", fmt.Errorf("api unavailable"))
 	err := sm.FlushDirty(context.Background())
 	if err == nil {
 		t.Error("FlushDirty: expected error from UpdateFirewallGroup, got nil")
 	}
+	if got := promtestutil.ToFloat64(flushErrors) - before; got != 1 {
+		t.Errorf("firewall_flush_errors_total delta: got %v, want 1", got)
+	}
+}
+
+// newTwoDirtyShards returns a capacity-2 shard manager with three IPs added,
+// leaving two dirty shards to flush.
+func newTwoDirtyShards(t *testing.T, ctrl *testutil.MockController) *ShardManager {
+	t.Helper()
+	sm := newV4ShardManager(t, 2, ctrl, newBboltStore(t))
+	if err := sm.EnsureShards(context.Background()); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		if _, _, err := sm.Add(context.Background(), ip); err != nil {
+			t.Fatalf("Add(%s): %v", ip, err)
+		}
+	}
+	if got := sm.countDirty(); got != 2 {
+		t.Fatalf("dirty shards: got %d, want 2", got)
+	}
+	return sm
+}
+
+// slowPutController sends UpdateFirewallGroup to put and everything else to
+// the embedded controller.
+type slowPutController struct {
+	controller.Controller
+	put controller.Controller
+}
+
+func (c *slowPutController) UpdateFirewallGroup(ctx context.Context, site string, g controller.FirewallGroup) error {
+	return c.put.UpdateFirewallGroup(ctx, site, g)
+}
+
+// newHangingPutShards returns two activated, dirty shards whose group PUTs go
+// to an httptest server that never answers. The returned channel receives
+// one value per PUT the server sees.
+func newHangingPutShards(t *testing.T) (*ShardManager, chan struct{}) {
+	t.Helper()
+	puts := make(chan struct{}, 4)
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			puts <- struct{}{}
+		}
+		select {
+		case <-r.Context().Done():
+		case <-stop:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(stop) })
+	client, err := controller.NewClient(context.Background(), controller.ClientConfig{
+		BaseURL: srv.URL,
+		APIKey:  "test-key",
+		Timeout: 30 * time.Second,
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	mock := testutil.NewMockController()
+	sm := newTwoDirtyShards(t, mock)
+	if err := sm.FlushDirty(context.Background()); err != nil {
+		t.Fatalf("activating FlushDirty: %v", err)
+	}
+	if _, _, err := sm.Add(context.Background(), "10.0.0.4"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := sm.Remove(context.Background(), "10.0.0.2"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := sm.countDirty(); got != 2 {
+		t.Fatalf("dirty shards: got %d, want 2", got)
+	}
+	sm.ctrl = &slowPutController{Controller: mock, put: client}
+	return sm, puts
+}
+
+// TestFlushDirty_ConflictMergesAndRetries verifies that a 409 on the group
+// PUT re-lists the group, keeps the member another writer added, still
+// applies this bouncer's own unban, and retries with the merge.
+func TestFlushDirty_ConflictMergesAndRetries(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	sm := newV4ShardManager(t, 5, ctrl, newBboltStore(t))
+	ctx := context.Background()
+	if err := sm.EnsureShards(ctx); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	if _, _, err := sm.Add(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := sm.FlushDirty(ctx); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+
+	// Another writer adds a member behind the bouncer's back.
+	groups, _ := ctrl.ListFirewallGroups(ctx, testSite)
+	if len(groups) != 1 {
+		t.Fatalf("groups = %d, want 1", len(groups))
+	}
+	external := groups[0]
+	external.GroupMembers = []string{"10.0.0.1", "198.51.100.9"}
+	if err := ctrl.UpdateFirewallGroup(ctx, testSite, external); err != nil {
+		t.Fatalf("external update: %v", err)
+	}
+
+	if _, _, err := sm.Add(ctx, "10.0.0.2"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if _, err := sm.Remove(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	puts := ctrl.Calls("UpdateFirewallGroup")
+	lists := ctrl.Calls("ListFirewallGroups")
+	ctrl.SetError("UpdateFirewallGroup", &controller.ErrConflict{Msg: "HTTP 409 conflict"})
+	if err := sm.FlushDirty(ctx); err != nil {
+		t.Fatalf("FlushDirty after conflict: %v", err)
+	}
+
+	if got := ctrl.Calls("UpdateFirewallGroup") - puts; got != 2 {
+		t.Errorf("UpdateFirewallGroup calls = %d, want 2 (conflict + retry)", got)
+	}
+	if got := ctrl.Calls("ListFirewallGroups") - lists; got != 1 {
+		t.Errorf("ListFirewallGroups calls = %d, want 1", got)
+	}
+	groups, _ = ctrl.ListFirewallGroups(ctx, testSite)
+	if got := strings.Join(groups[0].GroupMembers, ","); got != "10.0.0.2,198.51.100.9" {
+		t.Errorf("group members = %s, want 10.0.0.2,198.51.100.9", got)
+	}
+	if sm.Contains("198.51.100.9") {
+		t.Error("member added by another writer was adopted by the shard")
+	}
+	rec, err := sm.store.GetGroup(groups[0].Name)
+	if err != nil || rec == nil || strings.Join(rec.Members, ",") != "10.0.0.2" {
+		t.Errorf("cached group record = %+v (err %v), want only the shard's own members", rec, err)
+	}
+}
+
+// TestFlushDirty_ConflictMergeOverCapacity verifies that a merge that would
+// overflow the shard is dropped and the retry writes the own members.
+func TestFlushDirty_ConflictMergeOverCapacity(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	sm := newV4ShardManager(t, 2, ctrl, newBboltStore(t))
+	ctx := context.Background()
+	if err := sm.EnsureShards(ctx); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	if _, _, err := sm.Add(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := sm.FlushDirty(ctx); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+
+	groups, _ := ctrl.ListFirewallGroups(ctx, testSite)
+	external := groups[0]
+	external.GroupMembers = []string{"10.0.0.1", "198.51.100.9"}
+	if err := ctrl.UpdateFirewallGroup(ctx, testSite, external); err != nil {
+		t.Fatalf("external update: %v", err)
+	}
+
+	if _, _, err := sm.Add(ctx, "10.0.0.2"); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	ctrl.SetError("UpdateFirewallGroup", &controller.ErrConflict{Msg: "HTTP 409 conflict"})
+	if err := sm.FlushDirty(ctx); err != nil {
+		t.Fatalf("FlushDirty after conflict: %v", err)
+	}
+
+	groups, _ = ctrl.ListFirewallGroups(ctx, testSite)
+	if got := strings.Join(groups[0].GroupMembers, ","); got != "10.0.0.1,10.0.0.2" {
+		t.Errorf("group members = %s, want 10.0.0.1,10.0.0.2", got)
+	}
+}
+
+// TestFlushDirty_CanceledDuringPut verifies that canceling the context while a
+// PUT hangs aborts the flush promptly and leaves every unwritten shard dirty.
+func TestFlushDirty_CanceledDuringPut(t *testing.T) {
+	sm, puts := newHangingPutShards(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-puts
+		cancel()
+	}()
+
+	start := time.Now()
+	err := sm.FlushDirty(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("FlushDirty error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("FlushDirty took %s after cancel", elapsed)
+	}
+	if got := sm.countDirty(); got != 2 {
+		t.Errorf("dirty shards after cancel: got %d, want 2", got)
+	}
+	if n := len(puts); n != 0 {
+		t.Errorf("%d PUT(s) issued after cancel, want 0", n)
+	}
+}
+
+// TestFlushDirty_PutTimeout verifies that SetFlushTimeout bounds each PUT: a
+// hung controller fails the write, the shard stays dirty and the flush moves
+// on to the next shard.
+func TestFlushDirty_PutTimeout(t *testing.T) {
+	sm, puts := newHangingPutShards(t)
+	sm.SetFlushTimeout(50 * time.Millisecond)
+
+	if err := sm.FlushDirty(context.Background()); err == nil {
+		t.Fatal("FlushDirty: expected a timeout error, got nil")
+	}
+	if n := len(puts); n != 2 {
+		t.Errorf("PUTs issued: got %d, want 2", n)
+	}
+	if got := sm.countDirty(); got != 2 {
+		t.Errorf("dirty shards after timeout: got %d, want 2", got)
+	}
+}
+
+// TestFlushDirty_BulkUpdate verifies that when the controller supports bulk
+// group updates, all dirty shards are written with a single call.
+func TestFlushDirty_BulkUpdate(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetHasFeature(testSite, controller.FeatureBulkFirewallGroups, true)
+	sm := newTwoDirtyShards(t, ctrl)
+
+	if err := sm.FlushDirty(context.Background()); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+	if got := ctrl.Calls("BulkUpdateFirewallGroups"); got != 1 {
+		t.Errorf("BulkUpdateFirewallGroups calls: got %d, want 1", got)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup"); got != 0 {
+		t.Errorf("UpdateFirewallGroup calls: got %d, want 0", got)
+	}
+	if got := sm.countDirty(); got != 0 {
+		t.Errorf("dirty shards after bulk flush: got %d, want 0", got)
+	}
+}
+
+// TestFlushDirty_BulkFallback verifies that controllers without bulk support
+// receive one UpdateFirewallGroup call per dirty shard.
+func TestFlushDirty_BulkFallback(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	sm := newTwoDirtyShards(t, ctrl)
+
+	if err := sm.FlushDirty(context.Background()); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+	if got := ctrl.Calls("BulkUpdateFirewallGroups"); got != 0 {
+		t.Errorf("BulkUpdateFirewallGroups calls: got %d, want 0", got)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup"); got != 2 {
+		t.Errorf("UpdateFirewallGroup calls: got %d, want 2", got)
+	}
+}
+
+// TestFlushDirty_BulkError verifies that a failed bulk update leaves every
+// shard dirty so the next flush retries them.
+func TestFlushDirty_BulkError(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetHasFeature(testSite, controller.FeatureBulkFirewallGroups, true)
+	sm := newTwoDirtyShards(t, ctrl)
+
+	ctrl.SetError("BulkUpdateFirewallGroups", fmt.Errorf("api unavailable"))
+	if err := sm.FlushDirty(context.Background()); err == nil {
+		t.Fatal("FlushDirty: expected error from BulkUpdateFirewallGroups, got nil")
+	}
+	if got := sm.countDirty(); got != 2 {
+		t.Errorf("dirty shards after failed bulk flush: got %d, want 2", got)
+	}
 }
 
 // TestAllMembers_AcrossShards verifies that when two shards exist, AllMembers
@@ -827,6 +1204,74 @@ func TestDoCreateUniFiGroup_Conflict_ZoneMode(t *testing.T) {
 	}
 }
 
+// TestNameCollision_RefuseForeignGroup verifies that with CollisionRefuse a
+// 409 on create does not adopt a same-named group the store has no record of,
+// and names the collision in the error; a group recorded in the store is
+// still recovered.
+func TestNameCollision_RefuseForeignGroup(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+
+	const shardName = "crowdsec-block-v4-0"
+	ctrl.SetGroups(testSite, []controller.FirewallGroup{
+		{ID: "user-group-id", Name: shardName, GroupType: "address-group", GroupMembers: []string{"192.0.2.10"}},
+	})
+	ctrl.SetError("CreateFirewallGroup", &controller.ErrConflict{Msg: "already exists"})
+
+	sm := newV4ShardManager(t, 100, ctrl, store)
+	sm.SetNameCollision(CollisionRefuse)
+
+	_, err := sm.doCreateUniFiGroup(context.Background(), shardName)
+	var foreign *ErrForeignGroup
+	if !errors.As(err, &foreign) {
+		t.Fatalf("doCreateUniFiGroup: got %v, want ErrForeignGroup", err)
+	}
+	if foreign.Name != shardName || foreign.ID != "user-group-id" {
+		t.Errorf("ErrForeignGroup = %+v", foreign)
+	}
+	if !strings.Contains(err.Error(), "GROUP_NAME_TEMPLATE") {
+		t.Errorf("error does not suggest a fix: %v", err)
+	}
+
+	// Once the store records the ID as ours, the conflict is recovered.
+	if err := store.SetGroup(shardName, storage.GroupRecord{UnifiID: "user-group-id", Site: testSite}); err != nil {
+		t.Fatalf("SetGroup: %v", err)
+	}
+	ctrl.SetError("CreateFirewallGroup", &controller.ErrConflict{Msg: "already exists"})
+	if id, err := sm.doCreateUniFiGroup(context.Background(), shardName); err != nil || id != "user-group-id" {
+		t.Errorf("doCreateUniFiGroup with recorded ID: got %q, %v", id, err)
+	}
+}
+
+// TestNameCollision_RefuseForeignTML verifies that EnsureShards in zone mode
+// refuses to take over a same-named TML whose ID differs from the store's.
+func TestNameCollision_RefuseForeignTML(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+
+	const shardName = "crowdsec-block-v4-0"
+	if err := store.SetGroup(shardName, storage.GroupRecord{UnifiID: "our-tml-id", Site: testSite}); err != nil {
+		t.Fatalf("SetGroup: %v", err)
+	}
+	ctrl.SetTMLs(testSite, []controller.TrafficMatchingList{{
+		ID: "user-tml-id", Name: shardName, Type: "IPV4_ADDRESSES",
+		Items: []controller.TrafficMatchingListItem{{Type: "IP_ADDRESS", Value: "192.0.2.10"}},
+	}})
+
+	sm := newZoneV4ShardManager(t, 100, ctrl, store)
+	sm.SetNameCollision(CollisionRefuse)
+	var foreign *ErrForeignGroup
+	if err := sm.EnsureShards(context.Background()); !errors.As(err, &foreign) {
+		t.Fatalf("EnsureShards: got %v, want ErrForeignGroup", err)
+	}
+
+	// The default adopts it, as before.
+	sm.SetNameCollision(CollisionAdopt)
+	if err := sm.EnsureShards(context.Background()); err != nil {
+		t.Fatalf("EnsureShards with adopt: %v", err)
+	}
+}
+
 // TestDoCreateUniFiGroup_Conflict_LegacyMode verifies that when CreateFirewallGroup
 // returns ErrConflict (409), doCreateUniFiGroup recovers the existing group ID via
 // ListFirewallGroups instead of propagating the error.
@@ -858,3 +1303,38 @@ func TestDoCreateUniFiGroup_Conflict_LegacyMode(t *testing.T) {
 		t.Errorf("ListFirewallGroups calls: got %d, want 1", got)
 	}
 }
+
+// TestAdd_ShardLimit verifies that Add refuses a ban needing a shard beyond
+// SetMaxShards with ErrShardLimit, and accepts bans again once room frees up.
+func TestAdd_ShardLimit(t *testing.T) {
+	ctx := context.Background()
+	sm := newV4ShardManager(t, 1, testutil.NewMockController(), newBboltStore(t))
+	if err := sm.EnsureShards(ctx); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+	sm.SetMaxShards(2)
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, _, err := sm.Add(ctx, ip); err != nil {
+			t.Fatalf("Add %s: %v", ip, err)
+		}
+	}
+
+	_, _, err := sm.Add(ctx, "10.0.0.3")
+	var limit *ErrShardLimit
+	if !errors.As(err, &limit) {
+		t.Fatalf("Add beyond limit: got %v, want ErrShardLimit", err)
+	}
+	if limit.Limit != 2 || limit.Family != "v4" {
+		t.Errorf("ErrShardLimit = %+v, want limit 2 for v4", limit)
+	}
+	if sm.Contains("10.0.0.3") {
+		t.Error("refused address should not be tracked")
+	}
+
+	if _, err := sm.Remove(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, _, err := sm.Add(ctx, "10.0.0.3"); err != nil {
+		t.Errorf("Add after room freed: %v", err)
+	}
+}
@@ -4,6 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
@@ -21,8 +25,29 @@ type LegacyConfig struct {
 	LogDrops         bool
 	Description      string
 	APIWriteDelay    time.Duration
+
+	// CreateDisabled creates new rules disabled (LEGACY_RULE_ENABLED=false or
+	// FIREWALL_START_DISABLED=true) until EnableRules is called.
+	// EnforceEnabled makes EnsureRules reset managed rules whose enabled
+	// state differs; otherwise a rule disabled by an operator is left alone.
+	CreateDisabled bool
+	EnforceEnabled bool
+
+	// RecordMode tags the policy records this manager owns in the store, so
+	// that two managers on one site only ever touch their own rules.
+	// Empty = "legacy".
+	RecordMode string
 }
 
+// RulesetAuto selects the WAN-ingress ruleset from the controller's rulesets.
+const RulesetAuto = "auto"
+
+// Default legacy rulesets, used when "auto" finds no candidate.
+const (
+	defaultRulesetV4 = "WAN_IN"
+	defaultRulesetV6 = "WANv6_IN"
+)
+
 // LegacyManager manages legacy WAN_IN drop rules pointing at managed groups.
 type LegacyManager struct {
 	cfg   LegacyConfig
@@ -30,11 +55,142 @@ type LegacyManager struct {
 	ctrl  controller.Controller
 	store storage.Store
 	log   zerolog.Logger
+
+	// rulesets holds per-site [v4, v6] ruleset names resolved by ResolveRulesets.
+	rulesetMu sync.RWMutex
+	rulesets  map[string][2]string
+
+	// enabled is set by EnableRules and overrides CreateDisabled.
+	enabled atomic.Bool
 }
 
 // NewLegacyManager constructs a LegacyManager.
 func NewLegacyManager(cfg LegacyConfig, namer *Namer, ctrl controller.Controller, store storage.Store, log zerolog.Logger) *LegacyManager {
-	return &LegacyManager{cfg: cfg, namer: namer, ctrl: ctrl, store: store, log: log}
+	return &LegacyManager{cfg: cfg, namer: namer, ctrl: ctrl, store: store, log: log,
+		rulesets: make(map[string][2]string)}
+}
+
+// recordMode returns the Mode stored on this manager's policy records.
+func (lm *LegacyManager) recordMode() string {
+	if lm.cfg.RecordMode == "" {
+		return "legacy"
+	}
+	return lm.cfg.RecordMode
+}
+
+// ResolveRulesets enumerates the site's rulesets and fixes the v4/v6 ruleset
+// names used for new rules. "auto" picks the WAN-ingress ruleset from the
+// enumerated set; an explicit name that the controller does not know is kept
+// but logged with a suggestion. The enumeration only sees rulesets referenced
+// by existing rules, so an empty result is not treated as an error.
+func (lm *LegacyManager) ResolveRulesets(ctx context.Context, site string) error {
+	available, err := lm.ctrl.ListRulesets(ctx, site)
+	if err != nil {
+		return fmt.Errorf("list rulesets: %w", err)
+	}
+
+	var resolved [2]string
+	for i, ipv6 := range []bool{false, true} {
+		configured, fallback := lm.cfg.RulesetV4, defaultRulesetV4
+		if ipv6 {
+			configured, fallback = lm.cfg.RulesetV6, defaultRulesetV6
+		}
+
+		if strings.EqualFold(configured, RulesetAuto) {
+			picked := selectWANIngressRuleset(available, ipv6)
+			if picked == "" {
+				picked = fallback
+				lm.log.Warn().Str("site", site).Bool("ipv6", ipv6).Strs("available", available).Str("ruleset", picked).
+					Msg("no WAN-ingress ruleset found on controller; using default")
+			} else {
+				lm.log.Info().Str("site", site).Bool("ipv6", ipv6).Str("ruleset", picked).
+					Msg("auto-selected legacy ruleset")
+			}
+			resolved[i] = picked
+			continue
+		}
+
+		resolved[i] = configured
+		if len(available) > 0 && !slices.Contains(available, configured) {
+			ev := lm.log.Warn().Str("site", site).Str("ruleset", configured).Strs("available", available)
+			if suggestion := suggestRuleset(available, configured, ipv6); suggestion != "" {
+				ev = ev.Str("did_you_mean", suggestion)
+			}
+			ev.Msg("configured legacy ruleset not found on controller")
+		}
+	}
+
+	lm.rulesetMu.Lock()
+	lm.rulesets[site] = resolved
+	lm.rulesetMu.Unlock()
+	return nil
+}
+
+// rulesetFor returns the ruleset used for new rules on site. Before
+// ResolveRulesets has run for the site, the configured value is used, with
+// "auto" mapped to the default ruleset.
+func (lm *LegacyManager) rulesetFor(site string, ipv6 bool) string {
+	idx, configured, fallback := 0, lm.cfg.RulesetV4, defaultRulesetV4
+	if ipv6 {
+		idx, configured, fallback = 1, lm.cfg.RulesetV6, defaultRulesetV6
+	}
+	lm.rulesetMu.RLock()
+	resolved, ok := lm.rulesets[site]
+	lm.rulesetMu.RUnlock()
+	if ok {
+		return resolved[idx]
+	}
+	if strings.EqualFold(configured, RulesetAuto) {
+		return fallback
+	}
+	return configured
+}
+
+// Ruleset returns the ruleset new rules for the family are created in on
+// site, as resolved by ResolveRulesets.
+func (lm *LegacyManager) Ruleset(site string, ipv6 bool) string {
+	return lm.rulesetFor(site, ipv6)
+}
+
+// selectWANIngressRuleset picks the WAN-ingress ruleset for the family: the
+// standard name if present, otherwise the first WAN "_IN" ruleset of the right
+// family (case-insensitive, so renamed variants such as "wan_in" match).
+func selectWANIngressRuleset(available []string, ipv6 bool) string {
+	want := defaultRulesetV4
+	if ipv6 {
+		want = defaultRulesetV6
+	}
+	for _, rs := range available {
+		if rs == want {
+			return rs
+		}
+	}
+	for _, rs := range available {
+		if isWANIngress(rs, ipv6) {
+			return rs
+		}
+	}
+	return ""
+}
+
+// isWANIngress reports whether rs looks like a WAN inbound ruleset of the family.
+func isWANIngress(rs string, ipv6 bool) bool {
+	u := strings.ToUpper(rs)
+	if !strings.HasPrefix(u, "WAN") || !strings.HasSuffix(u, "_IN") {
+		return false
+	}
+	return strings.Contains(u, "V6") == ipv6
+}
+
+// suggestRuleset returns a likely intended ruleset for a configured name that
+// is not in available: a case-insensitive match, else the WAN-ingress ruleset.
+func suggestRuleset(available []string, configured string, ipv6 bool) string {
+	for _, rs := range available {
+		if strings.EqualFold(rs, configured) {
+			return rs
+		}
+	}
+	return selectWANIngressRuleset(available, ipv6)
 }
 
 // EnsureRules idempotently creates drop rules for each group shard.
@@ -49,6 +205,14 @@ func (lm *LegacyManager) EnsureRules(ctx context.Context, site string, v4Shards,
 	for _, r := range existingRules {
 		existingByID[r.ID] = true
 	}
+	if lm.cfg.EnforceEnabled {
+		if _, err := lm.setEnabled(ctx, site, existingRules, !lm.createDisabled()); err != nil {
+			return err
+		}
+	}
+	if err := lm.syncLogging(ctx, site, existingRules); err != nil {
+		return err
+	}
 
 	if err := lm.ensureRulesForFamily(ctx, site, false, existingByID, v4Shards); err != nil {
 		return err
@@ -63,10 +227,9 @@ func (lm *LegacyManager) EnsureRules(ctx context.Context, site string, v4Shards,
 
 func (lm *LegacyManager) ensureRulesForFamily(ctx context.Context, site string, ipv6 bool, existingByID map[string]bool, sm *ShardManager) error {
 	family := Family(ipv6)
-	ruleset := lm.cfg.RulesetV4
+	ruleset := lm.rulesetFor(site, ipv6)
 	indexStart := lm.cfg.RuleIndexStartV4
 	if ipv6 {
-		ruleset = lm.cfg.RulesetV6
 		indexStart = lm.cfg.RuleIndexStartV6
 	}
 
@@ -102,7 +265,7 @@ func (lm *LegacyManager) ensureRulesForFamily(ctx context.Context, site string,
 		// Create the rule
 		rule := controller.FirewallRule{
 			Name:                ruleName,
-			Enabled:             true,
+			Enabled:             !lm.createDisabled(),
 			RuleIndex:           indexStart + i,
 			Action:              lm.cfg.BlockAction,
 			Ruleset:             ruleset,
@@ -119,7 +282,7 @@ func (lm *LegacyManager) ensureRulesForFamily(ctx context.Context, site string,
 				if id := lm.findExistingRuleByName(ctx, site, ruleName); id != "" {
 					lm.log.Warn().Str("rule", ruleName).Str("id", id).
 						Msg("legacy rule already exists (409 conflict); recovering existing ID")
-					if storeErr := lm.store.SetPolicy(ruleName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: "legacy"}); storeErr != nil {
+					if storeErr := lm.store.SetPolicy(ruleName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: lm.recordMode()}); storeErr != nil {
 						lm.log.Warn().Err(storeErr).Str("rule", ruleName).Msg("failed to cache recovered rule in bbolt")
 					}
 					existingByID[id] = true
@@ -133,7 +296,7 @@ func (lm *LegacyManager) ensureRulesForFamily(ctx context.Context, site string,
 		if err := lm.store.SetPolicy(ruleName, storage.PolicyRecord{
 			UnifiID: created.ID,
 			Site:    site,
-			Mode:    "legacy",
+			Mode:    lm.recordMode(),
 		}); err != nil {
 			lm.log.Warn().Err(err).Str("rule", ruleName).Msg("failed to cache rule in bbolt")
 		}
@@ -143,14 +306,146 @@ func (lm *LegacyManager) ensureRulesForFamily(ctx context.Context, site string,
 	return nil
 }
 
+// RepairRuleGroups points every managed rule of site back at the current
+// group of its shard. A group recreated under a new ID (e.g. after it was
+// deleted by hand) leaves its rule referencing the old ID, which blocks
+// nothing. Rules that do not exist yet are left to EnsureRuleForShard.
+// Returns the number of rules updated.
+func (lm *LegacyManager) RepairRuleGroups(ctx context.Context, site string, v4Shards, v6Shards *ShardManager) (int, error) {
+	rules, err := lm.ctrl.ListFirewallRules(ctx, site)
+	if err != nil {
+		return 0, err
+	}
+	byID := make(map[string]controller.FirewallRule, len(rules))
+	for _, r := range rules {
+		byID[r.ID] = r
+	}
+
+	repaired := 0
+	for _, sm := range []*ShardManager{v4Shards, v6Shards} {
+		if sm == nil {
+			continue
+		}
+		family := Family(sm.ipv6)
+		for _, g := range sm.shardGroups() {
+			groupID := g.ID
+			ruleName, err := lm.namer.RuleName(NameData{Family: family, Index: g.Index, Site: site})
+			if err != nil {
+				return repaired, err
+			}
+			rec, err := lm.store.GetPolicy(ruleName)
+			if err != nil {
+				return repaired, fmt.Errorf("lookup policy %s: %w", ruleName, err)
+			}
+			if rec == nil {
+				continue
+			}
+			rule, ok := byID[rec.UnifiID]
+			if !ok || (len(rule.SrcFirewallGroupIDs) == 1 && rule.SrcFirewallGroupIDs[0] == groupID) {
+				continue
+			}
+
+			lm.log.Warn().Str("rule", ruleName).Str("id", rule.ID).
+				Strs("old_group_ids", rule.SrcFirewallGroupIDs).Str("group_id", groupID).
+				Msg("legacy rule references a stale group; repairing")
+			rule.SrcFirewallGroupIDs = []string{groupID}
+			if err := lm.ctrl.UpdateFirewallRule(ctx, site, rule); err != nil {
+				return repaired, fmt.Errorf("repair legacy rule %s: %w", ruleName, err)
+			}
+			repaired++
+		}
+	}
+	return repaired, nil
+}
+
+// createDisabled reports whether new rules are created disabled.
+func (lm *LegacyManager) createDisabled() bool {
+	return lm.cfg.CreateDisabled && !lm.enabled.Load()
+}
+
+// EnableRules enables every managed rule of site that is disabled on the
+// controller and makes rules created from now on start enabled. It returns
+// the number of rules changed.
+func (lm *LegacyManager) EnableRules(ctx context.Context, site string) (int, error) {
+	lm.enabled.Store(true)
+	rules, err := lm.ctrl.ListFirewallRules(ctx, site)
+	if err != nil {
+		return 0, err
+	}
+	return lm.setEnabled(ctx, site, rules, true)
+}
+
+// setEnabled sets the enabled flag of this site's managed rules to want and
+// returns the number of rules changed.
+func (lm *LegacyManager) setEnabled(ctx context.Context, site string, rules []controller.FirewallRule, want bool) (int, error) {
+	managed, err := lm.managedRules(site)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, r := range rules {
+		name, ok := managed[r.ID]
+		if !ok || r.Enabled == want {
+			continue
+		}
+		r.Enabled = want
+		if err := lm.ctrl.UpdateFirewallRule(ctx, site, r); err != nil {
+			return changed, fmt.Errorf("update enabled state of legacy rule %s: %w", name, err)
+		}
+		changed++
+		lm.log.Info().Str("rule", name).Str("id", r.ID).Bool("enabled", want).
+			Msg("set enabled state of legacy rule")
+	}
+	return changed, nil
+}
+
+// syncLogging sets the logging flag of this site's managed rules to LogDrops,
+// so that toggling FIREWALL_LOG_DROPS or FIREWALL_LOG_SAMPLE_RATE also
+// applies to rules created before the change.
+func (lm *LegacyManager) syncLogging(ctx context.Context, site string, rules []controller.FirewallRule) error {
+	managed, err := lm.managedRules(site)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		name, ok := managed[r.ID]
+		if !ok || r.Logging == lm.cfg.LogDrops {
+			continue
+		}
+		r.Logging = lm.cfg.LogDrops
+		if err := lm.ctrl.UpdateFirewallRule(ctx, site, r); err != nil {
+			return fmt.Errorf("update logging of legacy rule %s: %w", name, err)
+		}
+		lm.log.Info().Str("rule", name).Str("id", r.ID).Bool("logging", r.Logging).
+			Msg("set logging of legacy rule")
+	}
+	return nil
+}
+
+// managedRules maps the UniFi IDs of this manager's rules on site to their
+// names.
+func (lm *LegacyManager) managedRules(site string) (map[string]string, error) {
+	records, err := lm.store.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("list policy records: %w", err)
+	}
+	managed := make(map[string]string, len(records))
+	for name, rec := range records {
+		if rec.Site == site && rec.Mode == lm.recordMode() && rec.UnifiID != "" {
+			managed[rec.UnifiID] = name
+		}
+	}
+	return managed, nil
+}
+
 // EnsureRuleForShard creates the firewall rule for a single new shard if it doesn't already exist.
 // Called when a new shard overflows mid-operation.
 func (lm *LegacyManager) EnsureRuleForShard(ctx context.Context, site, groupID string, ipv6 bool, shardIdx int) error {
 	family := Family(ipv6)
-	ruleset := lm.cfg.RulesetV4
+	ruleset := lm.rulesetFor(site, ipv6)
 	indexStart := lm.cfg.RuleIndexStartV4
 	if ipv6 {
-		ruleset = lm.cfg.RulesetV6
 		indexStart = lm.cfg.RuleIndexStartV6
 	}
 
@@ -180,7 +475,7 @@ func (lm *LegacyManager) EnsureRuleForShard(ctx context.Context, site, groupID s
 
 	rule := controller.FirewallRule{
 		Name:                ruleName,
-		Enabled:             true,
+		Enabled:             !lm.createDisabled(),
 		RuleIndex:           indexStart + shardIdx,
 		Action:              lm.cfg.BlockAction,
 		Ruleset:             ruleset,
@@ -197,7 +492,7 @@ func (lm *LegacyManager) EnsureRuleForShard(ctx context.Context, site, groupID s
 			if id := lm.findExistingRuleByName(ctx, site, ruleName); id != "" {
 				lm.log.Warn().Str("rule", ruleName).Str("id", id).
 					Msg("legacy rule already exists (409 conflict); recovering existing ID")
-				if storeErr := lm.store.SetPolicy(ruleName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: "legacy"}); storeErr != nil {
+				if storeErr := lm.store.SetPolicy(ruleName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: lm.recordMode()}); storeErr != nil {
 					lm.log.Warn().Err(storeErr).Str("rule", ruleName).Msg("failed to cache recovered rule in bbolt")
 				}
 				lm.log.Info().Str("name", ruleName).Str("id", id).
@@ -211,7 +506,7 @@ func (lm *LegacyManager) EnsureRuleForShard(ctx context.Context, site, groupID s
 	if err := lm.store.SetPolicy(ruleName, storage.PolicyRecord{
 		UnifiID: created.ID,
 		Site:    site,
-		Mode:    "legacy",
+		Mode:    lm.recordMode(),
 	}); err != nil {
 		lm.log.Warn().Err(err).Str("rule", ruleName).Msg("failed to cache rule in bbolt")
 	}
@@ -259,12 +554,16 @@ func (lm *LegacyManager) DeleteRules(ctx context.Context, site string) error {
 		return err
 	}
 	for name, rec := range policies {
-		if rec.Site != site || rec.Mode != "legacy" {
+		if rec.Site != site || rec.Mode != lm.recordMode() {
 			continue
 		}
 		if err := lm.ctrl.DeleteFirewallRule(ctx, site, rec.UnifiID); err != nil {
-			lm.log.Warn().Err(err).Str("rule", name).Msg("failed to delete legacy rule")
-			continue
+			// A rule already gone from the controller only needs its record removed.
+			var notFound *controller.ErrNotFound
+			if !errors.As(err, &notFound) {
+				lm.log.Warn().Err(err).Str("rule", name).Msg("failed to delete legacy rule")
+				continue
+			}
 		}
 		if err := lm.store.DeletePolicy(name); err != nil {
 			lm.log.Warn().Err(err).Str("rule", name).Msg("failed to delete policy from bbolt")
@@ -2,6 +2,7 @@ package firewall
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
@@ -310,3 +311,211 @@ func TestLegacyManager_EnsureRules_ListsOnce(t *testing.T) {
 		t.Errorf("ListFirewallRules calls = %d, want 1", got)
 	}
 }
+
+func TestLegacyManager_ResolveRulesets_Auto(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetRules(testSite, []controller.FirewallRule{
+		{ID: "r1", Ruleset: "LAN_IN"},
+		{ID: "r2", Ruleset: "wan_in"},
+		{ID: "r3", Ruleset: "WAN_LOCAL"},
+		{ID: "r4", Ruleset: "WANV6_IN"},
+		{ID: "r5", Ruleset: "LANv6_IN"},
+	})
+	lm := NewLegacyManager(LegacyConfig{RulesetV4: RulesetAuto, RulesetV6: RulesetAuto},
+		testNamer(t), ctrl, newBboltStore(t), zerolog.Nop())
+
+	if err := lm.ResolveRulesets(context.Background(), testSite); err != nil {
+		t.Fatalf("ResolveRulesets: %v", err)
+	}
+	if got := lm.rulesetFor(testSite, false); got != "wan_in" {
+		t.Errorf("v4 ruleset: got %q, want wan_in", got)
+	}
+	if got := lm.rulesetFor(testSite, true); got != "WANV6_IN" {
+		t.Errorf("v6 ruleset: got %q, want WANV6_IN", got)
+	}
+}
+
+func TestLegacyManager_ResolveRulesets_AutoPrefersStandardName(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetRules(testSite, []controller.FirewallRule{
+		{ID: "r1", Ruleset: "WAN_GUEST_IN"},
+		{ID: "r2", Ruleset: "WAN_IN"},
+	})
+	lm := NewLegacyManager(LegacyConfig{RulesetV4: RulesetAuto, RulesetV6: RulesetAuto},
+		testNamer(t), ctrl, newBboltStore(t), zerolog.Nop())
+
+	if err := lm.ResolveRulesets(context.Background(), testSite); err != nil {
+		t.Fatalf("ResolveRulesets: %v", err)
+	}
+	if got := lm.rulesetFor(testSite, false); got != "WAN_IN" {
+		t.Errorf("v4 ruleset: got %q, want WAN_IN", got)
+	}
+	// No v6 WAN-ingress ruleset on the controller: fall back to the default.
+	if got := lm.rulesetFor(testSite, true); got != "WANv6_IN" {
+		t.Errorf("v6 ruleset: got %q, want WANv6_IN", got)
+	}
+}
+
+func TestLegacyManager_ResolveRulesets_ExplicitNameKept(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetRules(testSite, []controller.FirewallRule{{ID: "r1", Ruleset: "WAN_IN"}})
+	lm := newTestLegacyManager(ctrl, newBboltStore(t), testNamer(t))
+	lm.cfg.RulesetV4 = "WAN_INBOUND"
+
+	if err := lm.ResolveRulesets(context.Background(), testSite); err != nil {
+		t.Fatalf("ResolveRulesets: %v", err)
+	}
+	if got := lm.rulesetFor(testSite, false); got != "WAN_INBOUND" {
+		t.Errorf("explicit ruleset should be kept, got %q", got)
+	}
+	if got := suggestRuleset([]string{"WAN_IN"}, "WAN_INBOUND", false); got != "WAN_IN" {
+		t.Errorf("suggestion: got %q, want WAN_IN", got)
+	}
+}
+
+func TestLegacyManager_EnsureRules_UsesResolvedRuleset(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	ctrl.SetRules(testSite, []controller.FirewallRule{{ID: "r1", Ruleset: "WAN_EXT_IN"}})
+	store := newBboltStore(t)
+	lm := NewLegacyManager(LegacyConfig{RulesetV4: RulesetAuto, RulesetV6: RulesetAuto, RuleIndexStartV4: 22000},
+		testNamer(t), ctrl, store, zerolog.Nop())
+	if err := lm.ResolveRulesets(context.Background(), testSite); err != nil {
+		t.Fatalf("ResolveRulesets: %v", err)
+	}
+
+	v4 := ensuredV4Shard(t, ctrl, store)
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules: %v", err)
+	}
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	created := rules[len(rules)-1]
+	if created.Ruleset != "WAN_EXT_IN" {
+		t.Errorf("created rule ruleset: got %q, want WAN_EXT_IN", created.Ruleset)
+	}
+}
+
+func TestLegacyManager_EnsureRules_CreateDisabled(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+
+	v4 := ensuredV4Shard(t, ctrl, store)
+	lm := newTestLegacyManager(ctrl, store, testNamer(t))
+	lm.cfg.CreateDisabled = true
+
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules: %v", err)
+	}
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	if len(rules) != 1 || rules[0].Enabled {
+		t.Fatalf("rules = %+v, want one disabled rule", rules)
+	}
+}
+
+// TestLegacyManager_EnsureRules_EnforceEnabled verifies that a managed rule
+// disabled out-of-band is left alone by default and re-enabled only when
+// EnforceEnabled is set.
+func TestLegacyManager_EnsureRules_EnforceEnabled(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+
+	v4 := ensuredV4Shard(t, ctrl, store)
+	lm := newTestLegacyManager(ctrl, store, testNamer(t))
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules (create): %v", err)
+	}
+
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	rules[0].Enabled = false
+	ctrl.SetRules(testSite, rules)
+
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules (preserve): %v", err)
+	}
+	if got := ctrl.Calls("UpdateFirewallRule"); got != 0 {
+		t.Fatalf("UpdateFirewallRule calls = %d, want 0 without EnforceEnabled", got)
+	}
+
+	lm.cfg.EnforceEnabled = true
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules (enforce): %v", err)
+	}
+	if got := ctrl.Calls("UpdateFirewallRule"); got != 1 {
+		t.Errorf("UpdateFirewallRule calls = %d, want 1", got)
+	}
+	rules, _ = ctrl.ListFirewallRules(context.Background(), testSite)
+	if len(rules) != 1 || !rules[0].Enabled {
+		t.Errorf("rules = %+v, want the rule re-enabled", rules)
+	}
+}
+
+// TestLegacyManager_EnableRules verifies that EnableRules turns on rules
+// created disabled and that rules created afterwards start enabled.
+func TestLegacyManager_EnableRules(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+
+	v4 := ensuredV4Shard(t, ctrl, store)
+	lm := newTestLegacyManager(ctrl, store, testNamer(t))
+	lm.cfg.CreateDisabled = true
+	if err := lm.EnsureRules(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsureRules: %v", err)
+	}
+
+	n, err := lm.EnableRules(context.Background(), testSite)
+	if err != nil || n != 1 {
+		t.Fatalf("EnableRules = %d, %v; want 1, nil", n, err)
+	}
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	if len(rules) != 1 || !rules[0].Enabled {
+		t.Fatalf("rules = %+v, want the rule enabled", rules)
+	}
+	if n, _ := lm.EnableRules(context.Background(), testSite); n != 0 {
+		t.Errorf("second EnableRules changed %d rules, want 0", n)
+	}
+
+	if err := lm.EnsureRuleForShard(context.Background(), testSite, "group-new", false, 1); err != nil {
+		t.Fatalf("EnsureRuleForShard: %v", err)
+	}
+	rules, _ = ctrl.ListFirewallRules(context.Background(), testSite)
+	if len(rules) != 2 || !rules[1].Enabled {
+		t.Errorf("rules = %+v, want the new shard's rule created enabled", rules)
+	}
+}
+
+// TestLegacyManager_RepairRuleGroups_UsesShardIndex verifies that a rule is
+// matched to its shard by index when a Pending shard sits below it.
+func TestLegacyManager_RepairRuleGroups_UsesShardIndex(t *testing.T) {
+	ctx := context.Background()
+	ctrl := testutil.NewMockController()
+	store := newBboltStore(t)
+	sm := newV4ShardManager(t, 10, ctrl, store)
+	shard1 := makeActiveShard(t, sm, 1, 1)
+	setupShards(t, sm, []*Shard{makePendingShard(t, sm, 0, 0), shard1})
+
+	lm := newTestLegacyManager(ctrl, store, testNamer(t))
+	for idx, groupID := range []string{"stale-0", "stale-1"} {
+		name, _ := lm.namer.RuleName(NameData{Family: Family(false), Index: idx, Site: testSite})
+		rule, err := ctrl.CreateFirewallRule(ctx, testSite, controller.FirewallRule{Name: name, SrcFirewallGroupIDs: []string{groupID}})
+		if err != nil {
+			t.Fatalf("CreateFirewallRule: %v", err)
+		}
+		if err := store.SetPolicy(name, storage.PolicyRecord{UnifiID: rule.ID, Site: testSite}); err != nil {
+			t.Fatalf("SetPolicy: %v", err)
+		}
+	}
+
+	repaired, err := lm.RepairRuleGroups(ctx, testSite, sm, nil)
+	if err != nil || repaired != 1 {
+		t.Fatalf("RepairRuleGroups = %d, %v; want 1, nil", repaired, err)
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	for _, r := range rules {
+		want := "stale-0"
+		if strings.HasSuffix(r.Name, "-1") {
+			want = shard1.ID
+		}
+		if len(r.SrcFirewallGroupIDs) != 1 || r.SrcFirewallGroupIDs[0] != want {
+			t.Errorf("rule %s groups = %v, want [%s]", r.Name, r.SrcFirewallGroupIDs, want)
+		}
+	}
+}
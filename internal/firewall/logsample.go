@@ -0,0 +1,391 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+)
+
+// Log sampling (FIREWALL_LOG_SAMPLE_RATE) keeps the block rules silent and
+// copies a fixed fraction of the blocked addresses into separate groups whose
+// rules/policies log. Those run ahead of the block rules, so a packet from a
+// sampled address is dropped and logged there while every other address is
+// dropped without a log line.
+//
+// An address is sampled when the FNV-1a hash of its normalised form falls
+// below the rate. That needs no state, gives the same answer on every sync
+// and restart, and keeps all log lines of a repeat offender together. The
+// sample groups are derived from the members of the block shards on each
+// sync rather than tracked per decision, so whatever the shards hold after
+// whitelisting, subsumption and aggregation is what gets sampled.
+const (
+	logSampleGroupTemplate  = "crowdsec-log-sample-{{.Family}}-{{.Index}}"
+	logSampleRuleTemplate   = "crowdsec-log-drop-{{.Family}}-{{.Index}}"
+	logSamplePolicyTemplate = "crowdsec-log-policy-{{.SrcZone}}-{{.DstZone}}-{{.Family}}-{{.Index}}"
+
+	// logSampleRuleIndexOffset places the legacy sample rules just before
+	// the decision rules, which count up from LEGACY_RULE_INDEX_START_V4/V6.
+	logSampleRuleIndexOffset = 100
+
+	// logSampleBuckets is the resolution of the sample rate.
+	logSampleBuckets = 10000
+
+	logSampleModeLegacy = "sample-legacy"
+	logSampleModeZone   = "sample-zone"
+)
+
+// logSampler owns the log-sample groups and rules/policies.
+type logSampler struct {
+	threshold uint32 // hash buckets below this are sampled
+	namer     *Namer
+	legacyMgr *LegacyManager
+	zoneMgr   *ZoneManager
+
+	// Per-site shard managers, guarded by managerImpl.mu.
+	v4Mgrs map[string]*ShardManager
+	v6Mgrs map[string]*ShardManager
+}
+
+// newLogSampler returns nil when FIREWALL_LOG_SAMPLE_RATE is 0.
+func newLogSampler(cfg ManagerConfig, m *managerImpl) *logSampler {
+	if cfg.LogSampleRate <= 0 {
+		return nil
+	}
+	namer, err := NewNamer(logSampleGroupTemplate, logSampleRuleTemplate, logSamplePolicyTemplate, m.namer.Description())
+	if err != nil {
+		m.log.Error().Err(err).Msg("log sampling disabled: invalid name template")
+		return nil
+	}
+
+	legacyCfg := cfg.LegacyCfg
+	legacyCfg.RuleIndexStartV4 -= logSampleRuleIndexOffset
+	legacyCfg.RuleIndexStartV6 -= logSampleRuleIndexOffset
+	legacyCfg.LogDrops = true
+	legacyCfg.RecordMode = logSampleModeLegacy
+	zoneCfg := cfg.ZoneCfg
+	zoneCfg.LogDrops = true
+	zoneCfg.RecordMode = logSampleModeZone
+
+	return &logSampler{
+		threshold: uint32(cfg.LogSampleRate * logSampleBuckets),
+		namer:     namer,
+		legacyMgr: NewLegacyManager(legacyCfg, namer, m.ctrl, m.store, m.log),
+		zoneMgr:   NewZoneManager(zoneCfg, namer, m.ctrl, m.store, m.log),
+		v4Mgrs:    make(map[string]*ShardManager),
+		v6Mgrs:    make(map[string]*ShardManager),
+	}
+}
+
+// sampled reports whether member belongs in the log-sample groups.
+func (s *logSampler) sampled(member string) bool {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(normalizeMember(member)))
+	return h.Sum32()%logSampleBuckets < s.threshold
+}
+
+// ensureLogSamples loads the log-sample groups of one site, fills them from
+// the block shards and provisions their rules or policies. Failures are
+// logged: blocking works without the sample, only the log lines are missing.
+func (m *managerImpl) ensureLogSamples(ctx context.Context, site, mode string, v4Main, v6Main *ShardManager) {
+	if m.logSample == nil {
+		return
+	}
+	if m.cfg.DryRun {
+		m.log.Info().Str("site", site).Msg("[DRY-RUN] would ensure log sample groups")
+		return
+	}
+
+	var err error
+	switch mode {
+	case "legacy":
+		if err = m.logSample.legacyMgr.ResolveRulesets(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("ruleset enumeration failed; using configured legacy rulesets")
+		}
+	case "zone":
+		if err = m.logSample.zoneMgr.Bootstrap(ctx, []string{site}); err != nil {
+			m.log.Error().Err(err).Str("site", site).Msg("log sampling: zone bootstrap failed")
+			return
+		}
+	}
+
+	v4, err := m.loadLogSampleFamily(ctx, site, mode, false)
+	if err != nil {
+		m.log.Error().Err(err).Str("site", site).Msg("log sampling: failed to load v4 groups")
+		return
+	}
+	var v6 *ShardManager
+	if v6Main != nil {
+		if v6, err = m.loadLogSampleFamily(ctx, site, mode, true); err != nil {
+			m.log.Error().Err(err).Str("site", site).Msg("log sampling: failed to load v6 groups")
+			return
+		}
+	}
+
+	if err := m.syncLogSampleFamily(ctx, v4, v4Main); err != nil {
+		m.log.Error().Err(err).Str("site", site).Msg("log sampling: failed to sync v4 groups")
+		return
+	}
+	if v6 != nil {
+		if err := m.syncLogSampleFamily(ctx, v6, v6Main); err != nil {
+			m.log.Error().Err(err).Str("site", site).Msg("log sampling: failed to sync v6 groups")
+			return
+		}
+	}
+
+	switch mode {
+	case "legacy":
+		err = m.logSample.legacyMgr.EnsureRules(ctx, site, v4, v6)
+	case "zone":
+		if err = m.logSample.zoneMgr.EnsurePolicies(ctx, site, v4, v6); err == nil {
+			m.orderLogSamplePolicies(ctx, site, v4, v6)
+		}
+	}
+	if err != nil {
+		m.log.Error().Err(err).Str("site", site).Str("mode", mode).
+			Msg("log sampling: failed to ensure rules/policies")
+		return
+	}
+
+	// Groups created from now on get their rule or policy on activation.
+	for _, sm := range []*ShardManager{v4, v6} {
+		if sm == nil {
+			continue
+		}
+		sm.SetActivationCallback(func(ctx context.Context, shardIdx int, groupID string) {
+			m.provisionLogSampleShard(ctx, site, sm.ipv6, shardIdx, groupID)
+		})
+	}
+
+	m.mu.Lock()
+	m.logSample.v4Mgrs[site] = v4
+	if v6 != nil {
+		m.logSample.v6Mgrs[site] = v6
+	}
+	m.mu.Unlock()
+	m.log.Info().Str("site", site).Int("v4_sampled", len(v4.AllMembers())).Msg("log sample groups ensured")
+}
+
+// loadLogSampleFamily loads the existing log-sample groups of one family.
+func (m *managerImpl) loadLogSampleFamily(ctx context.Context, site, mode string, ipv6 bool) (*ShardManager, error) {
+	capacity := m.cfg.GroupCapacityV4
+	if ipv6 {
+		capacity = m.cfg.GroupCapacityV6
+	}
+	sm := NewShardManager(site, ipv6, capacity, m.logSample.namer, m.ctrl, m.store, m.log,
+		m.cfg.APIShardDelay, m.flushSem, false, mode)
+	sm.SetFlushTimeout(m.cfg.FlushTimeout)
+	if err := sm.EnsureShards(ctx); err != nil {
+		return nil, fmt.Errorf("load log sample groups: %w", err)
+	}
+	m.deleteOrphanedGroups(ctx, site, mode, sm)
+	return sm, nil
+}
+
+// syncLogSampleFamily makes sample hold exactly the sampled members of main
+// and flushes it.
+func (m *managerImpl) syncLogSampleFamily(ctx context.Context, sample, main *ShardManager) error {
+	desired := make(map[string]bool)
+	for _, member := range main.AllMembers() {
+		if !m.logSample.sampled(member) {
+			continue
+		}
+		desired[member] = true
+		if _, _, err := sample.Add(ctx, member); err != nil {
+			var fm *ErrFamilyMismatch
+			if !errors.As(err, &fm) {
+				return err
+			}
+		}
+	}
+	for _, member := range sample.AllMembers() {
+		if !desired[member] {
+			if _, err := sample.Remove(ctx, member); err != nil {
+				return err
+			}
+		}
+	}
+	return sample.FlushDirty(ctx)
+}
+
+// syncLogSamples brings the log-sample groups of site in line with its block
+// shards. Callers hold syncMu.
+func (m *managerImpl) syncLogSamples(ctx context.Context, site string, v4Main, v6Main *ShardManager) error {
+	if m.logSample == nil || m.cfg.DryRun {
+		return nil
+	}
+	m.mu.RLock()
+	v4, v6 := m.logSample.v4Mgrs[site], m.logSample.v6Mgrs[site]
+	m.mu.RUnlock()
+
+	var errs []error
+	if v4 != nil && v4Main != nil {
+		if err := m.syncLogSampleFamily(ctx, v4, v4Main); err != nil {
+			errs = append(errs, fmt.Errorf("v4: %w", err))
+		}
+	}
+	if v6 != nil && v6Main != nil {
+		if err := m.syncLogSampleFamily(ctx, v6, v6Main); err != nil {
+			errs = append(errs, fmt.Errorf("v6: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// provisionLogSampleShard creates the rule or policy of a log-sample group
+// that just became active.
+func (m *managerImpl) provisionLogSampleShard(ctx context.Context, site string, ipv6 bool, shardIdx int, groupID string) {
+	var err error
+	switch m.cachedMode(site) {
+	case "legacy":
+		err = m.logSample.legacyMgr.EnsureRuleForShard(ctx, site, groupID, ipv6, shardIdx)
+	case "zone":
+		if err = m.logSample.zoneMgr.EnsurePoliciesForShard(ctx, site, groupID, ipv6, shardIdx); err == nil {
+			m.mu.RLock()
+			v4, v6 := m.logSample.v4Mgrs[site], m.logSample.v6Mgrs[site]
+			m.mu.RUnlock()
+			m.orderLogSamplePolicies(ctx, site, v4, v6)
+		}
+	}
+	if err != nil {
+		m.log.Error().Err(err).Str("site", site).Bool("ipv6", ipv6).Int("shard_idx", shardIdx).
+			Msg("log sampling: failed to provision rule/policy for new group")
+	}
+}
+
+// orderLogSamplePolicies moves the log-sample policies of each zone pair
+// directly in front of the first block policy. Zone policies match in list
+// order, so a sample policy placed after the block policies would never see
+// a packet.
+func (m *managerImpl) orderLogSamplePolicies(ctx context.Context, site string, v4, v6 *ShardManager) {
+	records, err := m.store.ListPolicies()
+	if err != nil {
+		m.log.Warn().Err(err).Str("site", site).Msg("log sampling: list policy records failed; policy order unchanged")
+		return
+	}
+	blockIDs := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Site == site && rec.Mode == m.zoneMgr.recordMode() && rec.UnifiID != "" {
+			blockIDs[rec.UnifiID] = true
+		}
+	}
+
+	zm := m.logSample.zoneMgr
+	zm.mu.RLock()
+	zones := zm.zoneCache[site]
+	zm.mu.RUnlock()
+
+	for _, pair := range zm.cfg.ZonePairs {
+		srcID, dstID := zones[pair.Src], zones[pair.Dst]
+		if srcID == "" || dstID == "" {
+			continue
+		}
+		var sampleIDs []string
+		for _, sm := range []*ShardManager{v4, v6} {
+			if sm == nil {
+				continue
+			}
+			for _, g := range sm.shardGroups() {
+				name, err := m.logSample.namer.PolicyName(NameData{Family: Family(sm.ipv6), Index: g.Index, Site: site,
+					SrcZone: pair.Src, DstZone: pair.Dst})
+				if err != nil {
+					continue
+				}
+				if rec, err := m.store.GetPolicy(name); err == nil && rec != nil && rec.UnifiID != "" {
+					sampleIDs = append(sampleIDs, rec.UnifiID)
+				}
+			}
+		}
+		if len(sampleIDs) == 0 {
+			continue
+		}
+
+		current, err := m.ctrl.GetPolicyOrdering(ctx, site, srcID, dstID)
+		if err != nil {
+			m.log.Warn().Err(err).Str("pair", pair.Src+"->"+pair.Dst).
+				Msg("log sampling: failed to fetch policy ordering")
+			continue
+		}
+		ordered := placeBefore(current.BeforeSystemDefined, sampleIDs, blockIDs)
+		if slices.Equal(ordered, current.BeforeSystemDefined) {
+			continue
+		}
+		current.BeforeSystemDefined = ordered
+		if err := m.ctrl.SetPolicyOrdering(ctx, site, srcID, dstID, current); err != nil {
+			m.log.Warn().Err(err).Str("pair", pair.Src+"->"+pair.Dst).
+				Msg("log sampling: failed to move sample policies ahead of block policies")
+			continue
+		}
+		m.log.Info().Str("site", site).Str("pair", pair.Src+"->"+pair.Dst).
+			Msg("moved log sample policies ahead of block policies")
+	}
+}
+
+// placeBefore returns order with ids moved directly in front of the first
+// entry in before, or to the front when order holds none of them.
+func placeBefore(order, ids []string, before map[string]bool) []string {
+	move := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		move[id] = true
+	}
+	rest := make([]string, 0, len(order))
+	for _, id := range order {
+		if !move[id] {
+			rest = append(rest, id)
+		}
+	}
+	at := 0
+	for i, id := range rest {
+		if before[id] {
+			at = i
+			break
+		}
+	}
+	out := make([]string, 0, len(rest)+len(ids))
+	out = append(out, rest[:at]...)
+	out = append(out, ids...)
+	return append(out, rest[at:]...)
+}
+
+// drainLogSamples removes the log-sample rules/policies and groups of a site.
+func (m *managerImpl) drainLogSamples(ctx context.Context, site, mode string) int {
+	if m.logSample == nil {
+		return 0
+	}
+	if m.cfg.DryRun {
+		m.log.Info().Str("site", site).Msg("[DRY-RUN] would delete log sample groups and rules/policies")
+		return 0
+	}
+	switch mode {
+	case "zone":
+		if err := m.logSample.zoneMgr.DeletePolicies(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("drain: delete log sample policies error")
+		}
+	case "legacy":
+		if err := m.logSample.legacyMgr.DeleteRules(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("drain: delete log sample rules error")
+		}
+	}
+
+	m.mu.RLock()
+	v4, v6 := m.logSample.v4Mgrs[site], m.logSample.v6Mgrs[site]
+	m.mu.RUnlock()
+	deleted := 0
+	for _, sm := range []*ShardManager{v4, v6} {
+		if sm == nil {
+			continue
+		}
+		for _, groupID := range sm.GroupIDs() {
+			if groupID == "" {
+				continue
+			}
+			if err := sm.DeleteShardObject(ctx, groupID); err != nil {
+				m.log.Warn().Err(err).Str("site", site).Str("group_id", groupID).
+					Msg("drain: delete log sample group error")
+			}
+			deleted++
+		}
+	}
+	return deleted
+}
@@ -0,0 +1,200 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func logSampleManagerConfig(rate float64) ManagerConfig {
+	cfg := defaultManagerConfig()
+	cfg.LegacyCfg.LogDrops = true
+	cfg.ZoneCfg.LogDrops = true
+	cfg.LogSampleRate = rate
+	return cfg
+}
+
+// startLogSampled runs EnsureInfrastructure and bans ips, then syncs so the
+// sample group and its rule exist.
+func startLogSampled(t *testing.T, mgr Manager, ips ...string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for _, ip := range ips {
+		if err := mgr.ApplyBan(ctx, testSite, ip, false); err != nil {
+			t.Fatalf("ApplyBan %s: %v", ip, err)
+		}
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+}
+
+// TestLogSample_LegacyRules verifies that sampling creates a logging rule
+// ahead of the block rules, which are created silent.
+func TestLogSample_LegacyRules(t *testing.T) {
+	mgr, ctrl, store := newTestManager(t, logSampleManagerConfig(1))
+	startLogSampled(t, mgr, "10.0.0.1")
+
+	rec, err := store.GetPolicy("crowdsec-log-drop-v4-0")
+	if err != nil || rec == nil {
+		t.Fatalf("log sample rule not recorded: rec=%v err=%v", rec, err)
+	}
+	if rec.Mode != logSampleModeLegacy {
+		t.Errorf("log sample rule mode = %q, want %q", rec.Mode, logSampleModeLegacy)
+	}
+
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	seen := map[string]bool{}
+	for _, r := range rules {
+		seen[r.Name] = true
+		switch r.Name {
+		case "crowdsec-drop-v4-0":
+			if r.Logging {
+				t.Error("block rule should not log when sampling is on")
+			}
+		case "crowdsec-log-drop-v4-0":
+			if !r.Logging {
+				t.Error("log sample rule should log")
+			}
+			if r.RuleIndex != 22000-logSampleRuleIndexOffset {
+				t.Errorf("log sample rule index = %d, want %d", r.RuleIndex, 22000-logSampleRuleIndexOffset)
+			}
+		}
+	}
+	if !seen["crowdsec-drop-v4-0"] || !seen["crowdsec-log-drop-v4-0"] {
+		t.Errorf("rules = %v, want block and log sample rules", seen)
+	}
+}
+
+// TestLogSample_KeepsCountryLogging verifies that silencing the block rules
+// for sampling leaves LOG_DROPS on the country block rules.
+func TestLogSample_KeepsCountryLogging(t *testing.T) {
+	cfg := logSampleManagerConfig(1)
+	cfg.BlockCountries = []string{"CN"}
+	cfg.CountrySource = &fakeCountrySource{v4: map[string][]string{"CN": {"1.0.1.0/24"}}}
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	startLogSampled(t, mgr, "10.0.0.1")
+
+	rules, _ := ctrl.ListFirewallRules(context.Background(), testSite)
+	seen := map[string]bool{}
+	for _, r := range rules {
+		seen[r.Name] = true
+		switch r.Name {
+		case "crowdsec-drop-v4-0":
+			if r.Logging {
+				t.Error("block rule should not log when sampling is on")
+			}
+		case "crowdsec-geo-drop-v4-0":
+			if !r.Logging {
+				t.Error("country rule should keep LOG_DROPS")
+			}
+		}
+	}
+	if !seen["crowdsec-geo-drop-v4-0"] {
+		t.Errorf("rules = %v, want the country rule", seen)
+	}
+}
+
+// TestLogSample_SyncDirtyCopiesSampledBans verifies that sampled bans reach
+// the sample group on the next sync and leave it once unbanned.
+func TestLogSample_SyncDirtyCopiesSampledBans(t *testing.T) {
+	mgr, ctrl, _ := newTestManager(t, logSampleManagerConfig(1))
+	ctx := context.Background()
+	startLogSampled(t, mgr, "10.0.0.1", "10.0.0.2")
+	got := slices.Clone(groupMembersByName(t, ctrl)["crowdsec-log-sample-v4-0"])
+	slices.Sort(got)
+	if strings.Join(got, ",") != "10.0.0.1,10.0.0.2" {
+		t.Fatalf("log sample members = %v, want both bans", got)
+	}
+
+	if err := mgr.ApplyUnban(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyUnban: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := groupMembersByName(t, ctrl)["crowdsec-log-sample-v4-0"]; strings.Join(got, ",") != "10.0.0.2" {
+		t.Errorf("log sample members after unban = %v, want [10.0.0.2]", got)
+	}
+}
+
+// TestLogSample_SampledIsStable verifies the rate bounds and that the
+// decision for an address does not depend on its spelling.
+func TestLogSample_SampledIsStable(t *testing.T) {
+	none := &logSampler{threshold: 0}
+	all := &logSampler{threshold: logSampleBuckets}
+	half := &logSampler{threshold: logSampleBuckets / 2}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		if none.sampled(ip) {
+			t.Fatalf("%s sampled at rate 0", ip)
+		}
+		if !all.sampled(ip) {
+			t.Fatalf("%s not sampled at rate 1", ip)
+		}
+		if half.sampled(ip) {
+			hits++
+		}
+	}
+	if hits < 400 || hits > 600 {
+		t.Errorf("rate 0.5 sampled %d of 1000 addresses", hits)
+	}
+	if half.sampled("2001:db8::1") != half.sampled("2001:0db8:0:0::1") {
+		t.Error("equivalent IPv6 spellings sampled differently")
+	}
+}
+
+// TestPlaceBefore verifies where sample policies land in a zone ordering.
+func TestPlaceBefore(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  []string
+		ids    []string
+		before map[string]bool
+		want   []string
+	}{
+		{"ahead of first block", []string{"a", "b1", "b2"}, []string{"s"}, map[string]bool{"b1": true, "b2": true}, []string{"a", "s", "b1", "b2"}},
+		{"moves existing", []string{"b1", "s", "a"}, []string{"s"}, map[string]bool{"b1": true}, []string{"s", "b1", "a"}},
+		{"no block policy", []string{"a", "b"}, []string{"s"}, nil, []string{"s", "a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := placeBefore(tt.order, tt.ids, tt.before); !slices.Equal(got, tt.want) {
+				t.Errorf("placeBefore = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDrain_RemovesLogSamples verifies that Drain deletes the sample rule
+// and group alongside the decision shards.
+func TestDrain_RemovesLogSamples(t *testing.T) {
+	mgr, ctrl, store := newTestManager(t, logSampleManagerConfig(1))
+	ctx := context.Background()
+	startLogSampled(t, mgr, "10.0.0.1")
+	if _, ok := groupMembersByName(t, ctrl)["crowdsec-log-sample-v4-0"]; !ok {
+		t.Fatal("log sample group not created")
+	}
+	if err := mgr.Drain(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	if _, ok := groupMembersByName(t, ctrl)["crowdsec-log-sample-v4-0"]; ok {
+		t.Error("log sample group should be deleted by Drain")
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	for _, r := range rules {
+		if r.Name == "crowdsec-log-drop-v4-0" {
+			t.Error("log sample rule should be deleted by Drain")
+		}
+	}
+	if rec, _ := store.GetPolicy("crowdsec-log-drop-v4-0"); rec != nil {
+		t.Error("log sample rule record should be removed by Drain")
+	}
+}
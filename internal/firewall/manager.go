@@ -2,15 +2,22 @@ package firewall
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/tracing"
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
 // circuitBreakerState is the state of the circuit breaker.
@@ -92,7 +99,70 @@ type ReconcileResult struct {
 	Added   int
 	Removed int
 	Errors  []error
+
+	// Whitelisted counts the removals of members covered by BLOCK_WHITELIST
+	// and Aggregated those that only re-shaped CIDR_AGGREGATION blocks; the
+	// rest of Removed had no ban in bbolt.
+	Whitelisted int
+	Aggregated  int
+
 	Elapsed time.Duration
+
+	// Sites holds the per-site diff, keyed by site name.
+	Sites map[string]*SiteReconcileDiff
+}
+
+// reconcileSampleLimit caps how many IPs SiteReconcileDiff keeps per direction
+// so a reconcile that touches a huge ban list does not hold it all in memory.
+const reconcileSampleLimit = 100
+
+// SiteReconcileDiff records the IPs a reconcile added to or removed from one
+// site (or would have, in dry-run). Added/Removed are exact counts; AddedIPs
+// and RemovedIPs are samples of at most reconcileSampleLimit entries each.
+type SiteReconcileDiff struct {
+	Added      int
+	Removed    int
+	AddedIPs   []string
+	RemovedIPs []string
+
+	// RulesRepaired counts legacy rules re-pointed at their shard's group.
+	RulesRepaired int
+
+	// Whitelisted counts removed members covered by BLOCK_WHITELIST.
+	Whitelisted int
+
+	// Aggregated counts removed members whose addresses stay blocked by
+	// another aggregated block: a block split or merged, not an unban.
+	Aggregated int
+}
+
+func (d *SiteReconcileDiff) recordAdded(ip string) {
+	d.Added++
+	if len(d.AddedIPs) < reconcileSampleLimit {
+		d.AddedIPs = append(d.AddedIPs, ip)
+	}
+}
+
+// recordRemoved counts a member taken out by reconcile. whitelist is the
+// BLOCK_WHITELIST the desired set was built with.
+func (d *SiteReconcileDiff) recordRemoved(ip string, whitelist []*net.IPNet) {
+	d.Removed++
+	if decision.IsWhitelisted(ip, whitelist) {
+		d.Whitelisted++
+	}
+	if len(d.RemovedIPs) < reconcileSampleLimit {
+		d.RemovedIPs = append(d.RemovedIPs, ip)
+	}
+}
+
+// recordReshaped counts a member reconcile replaced with other aggregated
+// blocks.
+func (d *SiteReconcileDiff) recordReshaped(ip string) {
+	d.Removed++
+	d.Aggregated++
+	if len(d.RemovedIPs) < reconcileSampleLimit {
+		d.RemovedIPs = append(d.RemovedIPs, ip)
+	}
 }
 
 // Manager is the firewall management interface.
@@ -118,8 +188,30 @@ type Manager interface {
 	// for the given sites and cleans up bbolt state. In dry-run mode it only logs.
 	Drain(ctx context.Context, sites []string) error
 
+	// EnableEnforcement enables every managed rule or policy of the given
+	// sites, country blocks included, and makes those created later in this
+	// process start enabled. It undoes FIREWALL_START_DISABLED and returns
+	// the number of rules/policies changed. In dry-run mode it only logs.
+	EnableEnforcement(ctx context.Context, sites []string) (int, error)
+
 	// ZoneManager returns the underlying ZoneManager, or nil in legacy mode.
 	ZoneManager() *ZoneManager
+
+	// SetWhitelist replaces the BLOCK_WHITELIST used by Reconcile. Whitelisted
+	// IPs are never added and are removed from the shards if present.
+	SetWhitelist(whitelist []*net.IPNet)
+
+	// Shutdown performs a final flush of every dirty shard so bans applied
+	// since the last SyncDirty are not lost on exit. ctx bounds the flush.
+	Shutdown(ctx context.Context) error
+
+	// Ready reports whether EnsureInfrastructure has completed for every site.
+	Ready() bool
+
+	// CheckCapabilities re-runs zone-firewall detection for FIREWALL_MODE=auto
+	// sites and rebuilds the infrastructure of any site whose mode changed.
+	// It returns the sites that changed.
+	CheckCapabilities(ctx context.Context, sites []string) ([]string, error)
 }
 
 // ManagerConfig holds all firewall manager configuration.
@@ -134,6 +226,61 @@ type ManagerConfig struct {
 	LegacyCfg        LegacyConfig
 	ZoneCfg          ZoneConfig
 
+	// NewShardSettle is FIREWALL_NEW_SHARD_SETTLE: the wait between a new
+	// group appearing in UniFi and the create of its rule or policy, and
+	// between retries of that create. 0 = no wait.
+	NewShardSettle time.Duration
+
+	// MaxShards is FIREWALL_MAX_SHARDS: the most decision shards per site and
+	// family. Bans that would need another shard fail with ErrShardLimit.
+	// 0 = unlimited.
+	MaxShards int
+
+	// KeepEmptyShards disables pruneEmptyTailShards
+	// (FIREWALL_PRUNE_EMPTY_SHARDS=false), so empty trailing shards stay in
+	// UniFi to absorb later bans without re-provisioning.
+	KeepEmptyShards bool
+
+	// ModeOverrides pins the mode per site (site → "auto"/"legacy"/"zone"),
+	// taking precedence over FirewallMode.
+	ModeOverrides map[string]string
+
+	// ImmediateFirstBlock flushes the owning shard right away for the first
+	// ban after each SyncDirty tick instead of waiting for the batch window.
+	// Later bans in the same window are batched as usual.
+	ImmediateFirstBlock bool
+
+	// Whitelist is the initial BLOCK_WHITELIST (see Manager.SetWhitelist).
+	Whitelist []*net.IPNet
+
+	// ParallelFamilyEnsure loads the v4 and v6 shard state of a dual-stack
+	// site concurrently during EnsureInfrastructure.
+	ParallelFamilyEnsure bool
+
+	// CIDRSubsumption is SubsumeOff, SubsumeSkip or SubsumePrune (see
+	// ShardManager.SetCIDRSubsumption). Empty = SubsumeOff.
+	CIDRSubsumption string
+
+	// GroupNameCollision is CollisionAdopt or CollisionRefuse (see
+	// ShardManager.SetNameCollision). Empty = CollisionAdopt.
+	GroupNameCollision string
+
+	// AggregateCIDR makes Reconcile collapse contiguous IPv4 members into
+	// CIDR blocks (see aggregateIPv4). An unban inside such a block splits
+	// it around the unbanned address.
+	AggregateCIDR bool
+
+	// BlockCountries lists ISO 3166-1 alpha-2 codes whose address space is
+	// blocked through dedicated groups, filled from CountrySource at startup.
+	// Both must be set for country blocking to be enabled.
+	BlockCountries []string
+	CountrySource  CountrySource
+
+	// LogSampleRate is FIREWALL_LOG_SAMPLE_RATE: the fraction of blocked
+	// addresses that also go into logging groups (see logsample.go). When
+	// set, the block rules/policies are created without logging. 0 = off.
+	LogSampleRate float64
+
 	// Circuit breaker settings. Zero values use defaults (5 failures, 60s reset).
 	CircuitBreakerThreshold     int
 	CircuitBreakerResetInterval time.Duration
@@ -142,6 +289,29 @@ type ManagerConfig struct {
 	// for consolidation into a larger shard (read from SHARD_MERGE_THRESHOLD).
 	// 0 = auto (50% of shard capacity). -1 = disable.
 	ShardMergeThreshold int
+
+	// BufferEarlyDecisions accepts bans/unbans for a site whose shards are not
+	// loaded yet and replays them from the store once EnsureInfrastructure
+	// reaches the site. When false such bans fail with "no shard manager".
+	BufferEarlyDecisions bool
+
+	// CompactStaleModes deletes, on a site whose mode changed, the rules or
+	// policies of the previous mode and their records in the store.
+	CompactStaleModes bool
+
+	// ReconcileSiteConcurrency bounds how many sites Reconcile diffs at once.
+	// Flushes stay serialised by syncMu. Values < 1 mean 1 (sequential).
+	ReconcileSiteConcurrency int
+
+	// BanListRetries is how many times reconcile re-reads the ban list after
+	// a store error before giving up on the site. The wait starts at
+	// BanListRetryDelay and doubles on each attempt.
+	BanListRetries    int
+	BanListRetryDelay time.Duration
+
+	// FlushTimeout bounds each shard PUT of a flush (see
+	// ShardManager.SetFlushTimeout). 0 = bounded only by the caller's context.
+	FlushTimeout time.Duration
 }
 
 type managerImpl struct {
@@ -175,10 +345,35 @@ type managerImpl struct {
 	// cb is the circuit breaker that opens after consecutive sync failures.
 	cb *circuitBreaker
 
+	// whitelist stores the current []*net.IPNet excluded by Reconcile.
+	whitelist atomic.Value
+
 	// syncMu prevents concurrent SyncDirty executions (e.g. startup batch
 	// overlapping the first ticker fire). TryLock is used so a slow flush
 	// does not block the ticker goroutine — the tick is simply skipped.
 	syncMu sync.Mutex
+
+	// immediateUsed records which site/family pairs have already used their
+	// immediate flush since the last SyncDirty (ImmediateFirstBlock only).
+	immediateMu   sync.Mutex
+	immediateUsed map[string]bool
+
+	// geo manages BLOCK_COUNTRIES; nil when country blocking is off.
+	geo *countryBlocker
+
+	// logSample manages FIREWALL_LOG_SAMPLE_RATE; nil when sampling is off.
+	logSample *logSampler
+
+	// replaySites holds sites that received decisions before their shards
+	// were loaded (BufferEarlyDecisions), guarded by mu.
+	replaySites map[string]bool
+
+	// ready is set once EnsureInfrastructure has completed for every site.
+	ready atomic.Bool
+
+	// capProbe holds, per site, the mode the last capability check detected
+	// when it differed from the one in use; guarded by syncMu.
+	capProbe map[string]string
 }
 
 // NewManager constructs a Manager.
@@ -188,10 +383,17 @@ func NewManager(cfg ManagerConfig, ctrl controller.Controller, store storage.Sto
 		conc = 1
 	}
 
-	legacyMgr := NewLegacyManager(cfg.LegacyCfg, namer, ctrl, store, log)
-	zoneMgr := NewZoneManager(cfg.ZoneCfg, namer, ctrl, store, log)
+	// With sampling only the sample rules log and the block rules stay
+	// silent. The copies keep LOG_DROPS for the country blocker built from cfg.
+	legacyCfg, zoneCfg := cfg.LegacyCfg, cfg.ZoneCfg
+	if cfg.LogSampleRate > 0 {
+		legacyCfg.LogDrops = false
+		zoneCfg.LogDrops = false
+	}
+	legacyMgr := NewLegacyManager(legacyCfg, namer, ctrl, store, log)
+	zoneMgr := NewZoneManager(zoneCfg, namer, ctrl, store, log)
 
-	return &managerImpl{
+	m := &managerImpl{
 		cfg:       cfg,
 		ctrl:      ctrl,
 		store:     store,
@@ -204,164 +406,311 @@ func NewManager(cfg ManagerConfig, ctrl controller.Controller, store storage.Sto
 		flushSem:  make(chan struct{}, conc),
 		siteMode:  make(map[string]string),
 		cb:        newCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerResetInterval),
+
+		immediateUsed: make(map[string]bool),
+		replaySites:   make(map[string]bool),
+		capProbe:      make(map[string]string),
 	}
+	m.SetWhitelist(cfg.Whitelist)
+	m.geo = newCountryBlocker(cfg, m)
+	m.logSample = newLogSampler(cfg, m)
+	return m
 }
 
 // EnsureInfrastructure bootstraps all groups and rules/policies for every site.
-func (m *managerImpl) EnsureInfrastructure(ctx context.Context, sites []string) error {
+func (m *managerImpl) EnsureInfrastructure(ctx context.Context, sites []string) (err error) {
+	ctx, span := tracing.Start(ctx, "firewall.EnsureInfrastructure", attribute.StringSlice("unifi.sites", sites))
+	defer func() { tracing.End(span, &err) }()
 	m.sites = sites
 
-	for _, site := range sites {
-		// Callers (main.go runDaemon and reconcileCmd) pre-resolve capacities
-		// via resolveCapacities() before constructing ManagerConfig.
-		v4Cap := m.cfg.GroupCapacityV4
-		v6Cap := m.cfg.GroupCapacityV6
+	var countryLists countryCIDRs
+	if m.geo != nil && !m.cfg.DryRun {
+		countryLists = m.fetchCountryCIDRs(ctx)
+	}
 
-		// Determine effective mode first so shard backend uses the right API object type.
-		mode, err := m.resolveMode(ctx, site)
-		if err != nil {
-			return fmt.Errorf("resolve mode for site %s: %w", site, err)
+	for _, site := range sites {
+		if err := m.ensureSite(ctx, site, countryLists); err != nil {
+			return err
 		}
+	}
+	m.ready.Store(true)
+	return nil
+}
 
-		// Cache resolved mode for use in ensureNewShardInfrastructure and pruneEmptyTailShards.
-		m.siteMu.Lock()
-		m.siteMode[site] = mode
-		m.siteMu.Unlock()
+// ensureSite resolves site's mode and builds its shard managers and
+// rules/policies, replacing any managers the site already had. countryLists
+// feeds BLOCK_COUNTRIES and may be nil.
+func (m *managerImpl) ensureSite(ctx context.Context, site string, countryLists countryCIDRs) error {
+	// Callers (main.go runDaemon and reconcileCmd) pre-resolve capacities
+	// via resolveCapacities() before constructing ManagerConfig.
+	v4Cap := m.cfg.GroupCapacityV4
+	v6Cap := m.cfg.GroupCapacityV6
+
+	// Determine effective mode first so shard backend uses the right API object type.
+	mode, err := m.resolveMode(ctx, site)
+	if err != nil {
+		return fmt.Errorf("resolve mode for site %s: %w", site, err)
+	}
 
-		v4 := NewShardManager(site, false, v4Cap, m.namer, m.ctrl, m.store, m.log,
+	// Cache resolved mode for use in ensureNewShardInfrastructure and pruneEmptyTailShards.
+	m.siteMu.Lock()
+	m.siteMode[site] = mode
+	m.siteMu.Unlock()
+	setModeMetric(site, mode)
+
+	v4 := NewShardManager(site, false, v4Cap, m.namer, m.ctrl, m.store, m.log,
+		m.cfg.APIShardDelay, m.flushSem, m.cfg.DryRun, mode)
+	v4.SetReportShardCount(true)
+	v4.SetMaxShards(m.cfg.MaxShards)
+	var v6 *ShardManager
+	if m.cfg.EnableIPv6 {
+		v6 = NewShardManager(site, true, v6Cap, m.namer, m.ctrl, m.store, m.log,
 			m.cfg.APIShardDelay, m.flushSem, m.cfg.DryRun, mode)
-		if err := v4.EnsureShards(ctx); err != nil {
-			return fmt.Errorf("ensure v4 shards for site %s: %w", site, err)
-		}
+		v6.SetReportShardCount(true)
+		v6.SetMaxShards(m.cfg.MaxShards)
+	}
+	if err := m.ensureFamilies(ctx, site, v4, v6); err != nil {
+		return err
+	}
 
-		// Clean up placeholder-only (orphaned) groups found in UniFi
-		for _, orphan := range v4.TakeOrphanedGroups() {
-			m.log.Info().Str("site", site).Str("group_name", orphan.Name).Str("group_id", orphan.UnifiID).
-				Msg("deleting orphaned placeholder-only group")
-			// Best-effort cleanup of any policies/rules that reference this group.
-			// This handles migration from pre-lazy-creation code where rules were created eagerly.
-			m.deleteOrphanedReferencingObjects(ctx, site, mode, orphan.UnifiID)
-			// Orphaned groups were never adopted into our memory management, so they have no policies/rules created by us.
-			// Delete the group object.
-			if err := v4.DeleteShardObject(ctx, orphan.UnifiID); err != nil {
-				m.log.Warn().Err(err).Str("group_id", orphan.UnifiID).Msg("failed to delete orphaned group (will continue)")
-			}
-		}
+	// Orphan cleanup issues UniFi writes, so it always runs sequentially
+	// (v4 then v6) regardless of ParallelFamilyEnsure.
+	m.deleteOrphanedGroups(ctx, site, mode, v4)
+	m.mu.Lock()
+	m.v4Mgrs[site] = v4
+	m.mu.Unlock()
 
+	if v6 != nil {
+		m.deleteOrphanedGroups(ctx, site, mode, v6)
 		m.mu.Lock()
-		m.v4Mgrs[site] = v4
+		m.v6Mgrs[site] = v6
 		m.mu.Unlock()
+	}
 
-		if m.cfg.EnableIPv6 {
-			v6 := NewShardManager(site, true, v6Cap, m.namer, m.ctrl, m.store, m.log,
-				m.cfg.APIShardDelay, m.flushSem, m.cfg.DryRun, mode)
-			if err := v6.EnsureShards(ctx); err != nil {
-				return fmt.Errorf("ensure v6 shards for site %s: %w", site, err)
-			}
+	// Both families are registered, so no later decision can be buffered
+	// for this site; collect the ones that were.
+	m.mu.Lock()
+	replay := m.replaySites[site]
+	delete(m.replaySites, site)
+	m.mu.Unlock()
 
-			// Clean up placeholder-only (orphaned) groups found in UniFi
-			for _, orphan := range v6.TakeOrphanedGroups() {
-				m.log.Info().Str("site", site).Str("group_name", orphan.Name).Str("group_id", orphan.UnifiID).
-					Msg("deleting orphaned placeholder-only group")
-				// Best-effort cleanup of any policies/rules that reference this group.
-				// This handles migration from pre-lazy-creation code where rules were created eagerly.
-				m.deleteOrphanedReferencingObjects(ctx, site, mode, orphan.UnifiID)
-				// Orphaned groups were never adopted into our memory management, so they have no policies/rules created by us.
-				// Delete the group object.
-				if err := v6.DeleteShardObject(ctx, orphan.UnifiID); err != nil {
-					m.log.Warn().Err(err).Str("group_id", orphan.UnifiID).Msg("failed to delete orphaned group (will continue)")
-				}
+	m.mu.RLock()
+	v4Mgr := m.v4Mgrs[site]
+	v6Mgr := m.v6Mgrs[site]
+	// Set activation callbacks to provision infrastructure when Pending shards become Active
+	v4Mgr.SetActivationCallback(func(ctx context.Context, shardIdx int, groupID string) {
+		if err := m.ensureNewShardInfrastructure(ctx, site, false, shardIdx, v4Mgr); err != nil {
+			m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).Str("group_id", groupID).
+				Msg("failed to provision infrastructure for newly activated v4 shard")
+		}
+	})
+	m.attachShardCallbacks(v4Mgr)
+	v4Mgr.SetMergeThreshold(m.cfg.ShardMergeThreshold)
+	v4Mgr.SetCIDRSubsumption(m.cfg.CIDRSubsumption)
+	v4Mgr.SetFlushTimeout(m.cfg.FlushTimeout)
+	v4Mgr.SetNameCollision(m.cfg.GroupNameCollision)
+	onDrained := func(ctx context.Context, shardIdx int, groupID string) {
+		mode := m.cachedMode(site)
+		switch mode {
+		case "legacy":
+			if err := m.legacyMgr.DeleteRuleForShard(ctx, site, false, shardIdx); err != nil {
+				m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
+					Msg("failed to delete rule for drained v4 shard")
+			}
+		case "zone":
+			if err := m.zoneMgr.DeletePoliciesForShard(ctx, site, false, shardIdx); err != nil {
+				m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
+					Msg("failed to delete policies for drained v4 shard")
 			}
-			m.mu.Lock()
-			m.v6Mgrs[site] = v6
-			m.mu.Unlock()
 		}
-
-		m.mu.RLock()
-		v4Mgr := m.v4Mgrs[site]
-		v6Mgr := m.v6Mgrs[site]
-		// Set activation callbacks to provision infrastructure when Pending shards become Active
-		v4Mgr.SetActivationCallback(func(ctx context.Context, shardIdx int, groupID string) {
-			if err := m.ensureNewShardInfrastructure(ctx, site, false, shardIdx, v4Mgr); err != nil {
+	}
+	v4Mgr.SetDrainCallback(onDrained)
+	if m.cfg.EnableIPv6 && v6Mgr != nil {
+		v6Mgr.SetActivationCallback(func(ctx context.Context, shardIdx int, groupID string) {
+			if err := m.ensureNewShardInfrastructure(ctx, site, true, shardIdx, v6Mgr); err != nil {
 				m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).Str("group_id", groupID).
-					Msg("failed to provision infrastructure for newly activated v4 shard")
+					Msg("failed to provision infrastructure for newly activated v6 shard")
 			}
 		})
-		m.attachShardCallbacks(v4Mgr)
-		v4Mgr.SetMergeThreshold(m.cfg.ShardMergeThreshold)
-		onDrained := func(ctx context.Context, shardIdx int, groupID string) {
+		m.attachShardCallbacks(v6Mgr)
+		v6Mgr.SetMergeThreshold(m.cfg.ShardMergeThreshold)
+		v6Mgr.SetCIDRSubsumption(m.cfg.CIDRSubsumption)
+		v6Mgr.SetFlushTimeout(m.cfg.FlushTimeout)
+		v6Mgr.SetNameCollision(m.cfg.GroupNameCollision)
+		onDrainedV6 := func(ctx context.Context, shardIdx int, groupID string) {
 			mode := m.cachedMode(site)
 			switch mode {
 			case "legacy":
-				if err := m.legacyMgr.DeleteRuleForShard(ctx, site, false, shardIdx); err != nil {
+				if err := m.legacyMgr.DeleteRuleForShard(ctx, site, true, shardIdx); err != nil {
 					m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
-						Msg("failed to delete rule for drained v4 shard")
+						Msg("failed to delete rule for drained v6 shard")
 				}
 			case "zone":
-				if err := m.zoneMgr.DeletePoliciesForShard(ctx, site, false, shardIdx); err != nil {
+				if err := m.zoneMgr.DeletePoliciesForShard(ctx, site, true, shardIdx); err != nil {
 					m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
-						Msg("failed to delete policies for drained v4 shard")
-				}
-			}
-		}
-		v4Mgr.SetDrainCallback(onDrained)
-		if m.cfg.EnableIPv6 && v6Mgr != nil {
-			v6Mgr.SetActivationCallback(func(ctx context.Context, shardIdx int, groupID string) {
-				if err := m.ensureNewShardInfrastructure(ctx, site, true, shardIdx, v6Mgr); err != nil {
-					m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).Str("group_id", groupID).
-						Msg("failed to provision infrastructure for newly activated v6 shard")
-				}
-			})
-			m.attachShardCallbacks(v6Mgr)
-			v6Mgr.SetMergeThreshold(m.cfg.ShardMergeThreshold)
-			onDrainedV6 := func(ctx context.Context, shardIdx int, groupID string) {
-				mode := m.cachedMode(site)
-				switch mode {
-				case "legacy":
-					if err := m.legacyMgr.DeleteRuleForShard(ctx, site, true, shardIdx); err != nil {
-						m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
-							Msg("failed to delete rule for drained v6 shard")
-					}
-				case "zone":
-					if err := m.zoneMgr.DeletePoliciesForShard(ctx, site, true, shardIdx); err != nil {
-						m.log.Error().Err(err).Str("site", site).Int("shard_idx", shardIdx).
-							Msg("failed to delete policies for drained v6 shard")
-					}
+						Msg("failed to delete policies for drained v6 shard")
 				}
 			}
-			v6Mgr.SetDrainCallback(onDrainedV6)
 		}
+		v6Mgr.SetDrainCallback(onDrainedV6)
+	}
 
-		m.mu.RUnlock()
+	m.mu.RUnlock()
 
-		switch mode {
-		case "legacy":
-			if m.cfg.DryRun {
-				m.log.Info().Str("site", site).Str("mode", "legacy").
-					Msg("[DRY-RUN] would ensure legacy firewall rules for all shards")
-			} else {
-				if err := m.legacyMgr.EnsureRules(ctx, site, v4Mgr, v6Mgr); err != nil {
-					return fmt.Errorf("ensure legacy rules for site %s: %w", site, err)
-				}
+	switch mode {
+	case "legacy":
+		if err := m.legacyMgr.ResolveRulesets(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("ruleset enumeration failed; using configured legacy rulesets")
+		}
+		if m.cfg.DryRun {
+			m.log.Info().Str("site", site).Str("mode", "legacy").
+				Msg("[DRY-RUN] would ensure legacy firewall rules for all shards")
+		} else {
+			if err := m.legacyMgr.EnsureRules(ctx, site, v4Mgr, v6Mgr); err != nil {
+				return fmt.Errorf("ensure legacy rules for site %s: %w", site, err)
 			}
-		case "zone":
-			if m.cfg.DryRun {
-				m.log.Info().Str("site", site).Str("mode", "zone").
-					Msg("[DRY-RUN] would ensure zone policies for all shards")
-			} else {
-				// Bootstrap performs fail-fast site UUID resolution and zone discovery.
-				if err := m.zoneMgr.Bootstrap(ctx, []string{site}); err != nil {
-					return fmt.Errorf("zone bootstrap for site %s: %w", site, err)
-				}
-				if err := m.zoneMgr.EnsurePolicies(ctx, site, v4Mgr, v6Mgr); err != nil {
-					return fmt.Errorf("ensure zone policies for site %s: %w", site, err)
-				}
+		}
+	case "zone":
+		if m.cfg.DryRun {
+			m.log.Info().Str("site", site).Str("mode", "zone").
+				Msg("[DRY-RUN] would ensure zone policies for all shards")
+		} else {
+			// Bootstrap performs fail-fast site UUID resolution and zone discovery.
+			if err := m.zoneMgr.Bootstrap(ctx, []string{site}); err != nil {
+				return fmt.Errorf("zone bootstrap for site %s: %w", site, err)
+			}
+			if err := m.zoneMgr.EnsurePolicies(ctx, site, v4Mgr, v6Mgr); err != nil {
+				return fmt.Errorf("ensure zone policies for site %s: %w", site, err)
 			}
 		}
 	}
+
+	m.compactStaleMode(ctx, site, mode)
+	if replay {
+		m.replayEarlyDecisions(ctx, site)
+	}
+	m.ensureLogSamples(ctx, site, mode, v4Mgr, v6Mgr)
+	m.ensureCountryBlocks(ctx, site, mode, countryLists)
 	return nil
 }
 
+// compactStaleMode removes what a previous mode of site left behind: after a
+// switch to zone mode the legacy rules, after a switch to legacy the zone
+// policies. The controller objects are deleted first and a record is only
+// dropped once its object is gone, so the store ends up reflecting the active
+// mode alone. It runs after the active mode's rules/policies are in place.
+func (m *managerImpl) compactStaleMode(ctx context.Context, site, mode string) {
+	if !m.cfg.CompactStaleModes {
+		return
+	}
+	records, err := m.store.ListPolicies()
+	if err != nil {
+		m.log.Warn().Err(err).Str("site", site).Msg("stale mode cleanup: list policy records failed")
+		return
+	}
+	present := make(map[string]bool)
+	for _, rec := range records {
+		if rec.Site == site {
+			present[rec.Mode] = true
+		}
+	}
+
+	type staleSet struct {
+		mode  string
+		purge func(context.Context, string) error
+	}
+	var stale []staleSet
+	switch mode {
+	case "zone":
+		stale = append(stale, staleSet{"legacy", m.legacyMgr.DeleteRules})
+		if m.geo != nil {
+			stale = append(stale, staleSet{countryModeLegacy, m.geo.legacyMgr.DeleteRules})
+		}
+		if m.logSample != nil {
+			stale = append(stale, staleSet{logSampleModeLegacy, m.logSample.legacyMgr.DeleteRules})
+		}
+	case "legacy":
+		stale = append(stale, staleSet{"zone", m.zoneMgr.DeletePolicies})
+		if m.geo != nil {
+			stale = append(stale, staleSet{countryModeZone, m.geo.zoneMgr.DeletePolicies})
+		}
+		if m.logSample != nil {
+			stale = append(stale, staleSet{logSampleModeZone, m.logSample.zoneMgr.DeletePolicies})
+		}
+	}
+
+	for _, s := range stale {
+		if !present[s.mode] {
+			continue
+		}
+		if m.cfg.DryRun {
+			m.log.Info().Str("site", site).Str("stale_mode", s.mode).
+				Msg("[DRY-RUN] would delete rules/policies left by the previous firewall mode")
+			continue
+		}
+		m.log.Info().Str("site", site).Str("mode", mode).Str("stale_mode", s.mode).
+			Msg("firewall mode changed; deleting rules/policies of the previous mode")
+		if err := s.purge(ctx, site); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Str("stale_mode", s.mode).
+				Msg("stale mode cleanup failed; will retry on next start")
+		}
+	}
+}
+
+// Ready reports whether EnsureInfrastructure has completed for every site.
+func (m *managerImpl) Ready() bool {
+	return m.ready.Load()
+}
+
+// bufferEarly is called when a decision finds no shard manager for the site.
+// Before the first EnsureInfrastructure completes it marks the site for
+// replay and reports true; the decision itself is already in the store (bans
+// are recorded before they are applied, unbans deleted after). If the shard
+// manager appeared in the meantime it is returned so the caller can apply
+// the decision directly.
+func (m *managerImpl) bufferEarly(site string, ipv6 bool) (*ShardManager, bool) {
+	if !m.cfg.BufferEarlyDecisions || m.ready.Load() {
+		return nil, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sm := m.shardMgr(site, ipv6); sm != nil {
+		return sm, false
+	}
+	m.replaySites[site] = true
+	return nil, true
+}
+
+// replayEarlyDecisions reconciles a site against the store once its shards
+// are loaded, applying the decisions that arrived before they were.
+func (m *managerImpl) replayEarlyDecisions(ctx context.Context, site string) {
+	diff, errs := m.reconcileSite(ctx, site)
+	for _, err := range errs {
+		m.log.Warn().Err(err).Str("site", site).Msg("replay of early decisions: reconcile error")
+	}
+	m.log.Info().Str("site", site).Int("added", diff.Added).Int("removed", diff.Removed).
+		Msg("replayed decisions received before infrastructure was ready")
+}
+
+// banEnqueuedKey is the context key for WithBanEnqueued.
+type banEnqueuedKey struct{}
+
+// WithBanEnqueued returns ctx carrying the time a ban was enqueued by the
+// poller. ApplyBan remembers it until the ban is flushed to UniFi and reports
+// the difference as BanApplyLatency. A zero time is ignored.
+func WithBanEnqueued(ctx context.Context, at time.Time) context.Context {
+	if at.IsZero() {
+		return ctx
+	}
+	return context.WithValue(ctx, banEnqueuedKey{}, at)
+}
+
+// banEnqueuedAt returns the enqueue time set by WithBanEnqueued.
+func banEnqueuedAt(ctx context.Context) (time.Time, bool) {
+	at, ok := ctx.Value(banEnqueuedKey{}).(time.Time)
+	return at, ok
+}
+
 // ApplyBan adds an IP to the appropriate shard and schedules a batch flush.
 func (m *managerImpl) ApplyBan(ctx context.Context, site, ip string, ipv6 bool) error {
 	if m.cfg.DryRun {
@@ -373,12 +722,26 @@ func (m *managerImpl) ApplyBan(ctx context.Context, site, ip string, ipv6 bool)
 	sm := m.shardMgr(site, ipv6)
 	m.mu.RUnlock()
 
+	if sm == nil {
+		var buffered bool
+		if sm, buffered = m.bufferEarly(site, ipv6); buffered {
+			m.log.Debug().Str("site", site).Str("ip", ip).
+				Msg("infrastructure not ready; ban will be replayed from the store")
+			return nil
+		}
+	}
 	if sm == nil {
 		return fmt.Errorf("no shard manager for site %s (ipv6=%v)", site, ipv6)
 	}
 
 	_, newShardIdx, err := sm.Add(ctx, ip)
 	if err != nil {
+		var fm *ErrFamilyMismatch
+		if errors.As(err, &fm) {
+			m.log.Warn().Str("site", site).Str("ip", ip).Bool("ipv6", fm.IPv6).
+				Msg("ban classified under the wrong IP family; routing to the matching shards")
+			return m.ApplyBan(ctx, site, ip, fm.IPv6)
+		}
 		return err
 	}
 
@@ -396,9 +759,60 @@ func (m *managerImpl) ApplyBan(ctx context.Context, site, ip string, ipv6 bool)
 		}
 	}
 
+	if m.cfg.ImmediateFirstBlock && m.claimImmediateFlush(site, ipv6) {
+		m.flushImmediate(ctx, site, ip, sm)
+	}
+
 	return nil
 }
 
+// claimImmediateFlush reports whether site/family may use its immediate flush
+// in the current batch window and, if so, marks it used. SyncDirty resets the
+// claim so the next ban after each tick is again pushed immediately.
+func (m *managerImpl) claimImmediateFlush(site string, ipv6 bool) bool {
+	key := site + "/" + Family(ipv6)
+	m.immediateMu.Lock()
+	defer m.immediateMu.Unlock()
+	if m.immediateUsed[key] {
+		return false
+	}
+	m.immediateUsed[key] = true
+	return true
+}
+
+// resetImmediateFlush re-arms the immediate flush for every site/family.
+func (m *managerImpl) resetImmediateFlush() {
+	m.immediateMu.Lock()
+	defer m.immediateMu.Unlock()
+	clear(m.immediateUsed)
+}
+
+// flushImmediate pushes sm's dirty shards now rather than at the next
+// SyncDirty tick. It honours the rate-limit window and circuit breaker, and
+// shares syncMu with SyncDirty so the two never write concurrently; if a flush
+// is already running, the ban is left for it. A successful flush clears the
+// shard's dirty flag, so the following SyncDirty skips it instead of writing
+// the same members a second time.
+func (m *managerImpl) flushImmediate(ctx context.Context, site, ip string, sm *ShardManager) {
+	if limited, _ := m.isRateLimited(); limited {
+		return
+	}
+	if !m.cb.allow() {
+		return
+	}
+	if !m.syncMu.TryLock() {
+		return
+	}
+	defer m.syncMu.Unlock()
+
+	if err := sm.syncAllFamilies(ctx); err != nil {
+		m.log.Warn().Err(err).Str("site", site).Str("ip", ip).
+			Msg("immediate first-block flush failed; shard stays dirty for the next sync")
+		return
+	}
+	m.log.Debug().Str("site", site).Str("ip", ip).Msg("immediate first-block flush complete")
+}
+
 // ApplyUnban removes an IP from its shard and schedules a batch flush.
 func (m *managerImpl) ApplyUnban(ctx context.Context, site, ip string, ipv6 bool) error {
 	if m.cfg.DryRun {
@@ -410,40 +824,214 @@ func (m *managerImpl) ApplyUnban(ctx context.Context, site, ip string, ipv6 bool
 	sm := m.shardMgr(site, ipv6)
 	m.mu.RUnlock()
 
+	if sm == nil {
+		var buffered bool
+		if sm, buffered = m.bufferEarly(site, ipv6); buffered {
+			m.log.Debug().Str("site", site).Str("ip", ip).
+				Msg("infrastructure not ready; unban will be replayed from the store")
+			return nil
+		}
+	}
 	if sm == nil {
 		return nil // site not managed
 	}
 
 	if _, err := sm.Remove(ctx, ip); err != nil {
+		var fm *ErrFamilyMismatch
+		if errors.As(err, &fm) {
+			m.log.Warn().Str("site", site).Str("ip", ip).Bool("ipv6", fm.IPv6).
+				Msg("unban classified under the wrong IP family; routing to the matching shards")
+			return m.ApplyUnban(ctx, site, ip, fm.IPv6)
+		}
 		return err
 	}
+	if m.cfg.AggregateCIDR && !ipv6 {
+		m.splitAggregates(ctx, site, ip, sm)
+	}
+	if m.cfg.CIDRSubsumption == SubsumeSkip || m.cfg.CIDRSubsumption == SubsumePrune {
+		m.restoreCovered(ctx, site, ip, sm)
+	}
 	return nil
 }
 
+// restoreCovered re-adds the stored bans that a just-unbanned range covered.
+// Under CIDR subsumption those members were skipped or pruned while the range
+// was banned, so without this they would stay unblocked until the next
+// reconcile. Members still covered by another range are skipped again by Add.
+func (m *managerImpl) restoreCovered(ctx context.Context, site, ip string, sm *ShardManager) {
+	network, err := parseMember(ip)
+	if err != nil {
+		return
+	}
+	ones, bits := network.Mask.Size()
+	if ones == bits {
+		return // a single host covers nothing
+	}
+	bans, err := m.store.BanList()
+	if err != nil {
+		m.log.Warn().Err(err).Str("site", site).Str("range", ip).
+			Msg("could not load bans to restore members covered by unbanned range")
+		return
+	}
+	whitelist, _ := m.whitelist.Load().([]*net.IPNet)
+	removed := normalizeMember(ip)
+	for member := range bans {
+		if normalizeMember(member) == removed || decision.IsWhitelisted(member, whitelist) {
+			continue
+		}
+		mn, err := parseMember(member)
+		if err != nil || (mn.IP.To4() == nil) != sm.ipv6 {
+			continue
+		}
+		if mOnes, _ := mn.Mask.Size(); mOnes < ones || !network.Contains(mn.IP) {
+			continue
+		}
+		if _, _, err := sm.Add(ctx, member); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Str("ip", member).
+				Msg("failed to restore member covered by unbanned range")
+		}
+	}
+}
+
+// SetWhitelist replaces the whitelist applied by Reconcile.
+func (m *managerImpl) SetWhitelist(whitelist []*net.IPNet) {
+	m.whitelist.Store(whitelist)
+}
+
+// ensureFamilies loads the shard state of v4 and, when non-nil, v6. With
+// ParallelFamilyEnsure both families load concurrently; EnsureShards only reads
+// from the controller, so this does not add to UniFi write concurrency.
+func (m *managerImpl) ensureFamilies(ctx context.Context, site string, v4, v6 *ShardManager) error {
+	if v6 == nil || !m.cfg.ParallelFamilyEnsure {
+		if err := v4.EnsureShards(ctx); err != nil {
+			return fmt.Errorf("ensure v4 shards for site %s: %w", site, err)
+		}
+		if v6 != nil {
+			if err := v6.EnsureShards(ctx); err != nil {
+				return fmt.Errorf("ensure v6 shards for site %s: %w", site, err)
+			}
+		}
+		return nil
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		if err := v4.EnsureShards(gctx); err != nil {
+			return fmt.Errorf("ensure v4 shards for site %s: %w", site, err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		if err := v6.EnsureShards(gctx); err != nil {
+			return fmt.Errorf("ensure v6 shards for site %s: %w", site, err)
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+// deleteOrphanedGroups removes placeholder-only (orphaned) groups that
+// EnsureShards found in UniFi for mgr's family.
+func (m *managerImpl) deleteOrphanedGroups(ctx context.Context, site, mode string, mgr *ShardManager) {
+	for _, orphan := range mgr.TakeOrphanedGroups() {
+		m.log.Info().Str("site", site).Str("group_name", orphan.Name).Str("group_id", orphan.UnifiID).
+			Msg("deleting orphaned placeholder-only group")
+		// Best-effort cleanup of any policies/rules that reference this group.
+		// This handles migration from pre-lazy-creation code where rules were created eagerly.
+		m.deleteOrphanedReferencingObjects(ctx, site, mode, orphan.UnifiID)
+		// Orphaned groups were never adopted into our memory management, so they have no policies/rules created by us.
+		// Delete the group object.
+		if err := mgr.DeleteShardObject(ctx, orphan.UnifiID); err != nil {
+			m.log.Warn().Err(err).Str("group_id", orphan.UnifiID).Msg("failed to delete orphaned group (will continue)")
+		}
+	}
+}
+
 // Reconcile performs a full diff between bbolt state and UniFi API state.
 func (m *managerImpl) Reconcile(ctx context.Context, sites []string) (*ReconcileResult, error) {
+	ctx, span := tracing.Start(ctx, "firewall.Reconcile", attribute.StringSlice("unifi.sites", sites))
+	defer span.End()
 	start := time.Now()
-	result := &ReconcileResult{}
+	result := &ReconcileResult{Sites: make(map[string]*SiteReconcileDiff, len(sites))}
 
-	for _, site := range sites {
-		added, removed, errs := m.reconcileSite(ctx, site)
-		result.Added += added
-		result.Removed += removed
+	conc := m.cfg.ReconcileSiteConcurrency
+	if conc < 1 {
+		conc = 1
+	}
+	diffs := make([]*SiteReconcileDiff, len(sites))
+	siteErrs := make([][]error, len(sites))
+	var g errgroup.Group
+	g.SetLimit(conc)
+	for i, site := range sites {
+		g.Go(func() error {
+			diffs[i], siteErrs[i] = m.reconcileSite(ctx, site)
+			return nil
+		})
+	}
+	_ = g.Wait() // reconcileSite reports through siteErrs
+
+	// Aggregate in site order so the result does not depend on scheduling.
+	for i, site := range sites {
+		diff, errs := diffs[i], siteErrs[i]
+		sort.Strings(diff.AddedIPs)
+		sort.Strings(diff.RemovedIPs)
+		result.Sites[site] = diff
+		result.Added += diff.Added
+		result.Removed += diff.Removed
+		result.Whitelisted += diff.Whitelisted
+		result.Aggregated += diff.Aggregated
 		result.Errors = append(result.Errors, errs...)
 
-		metrics.ReconcileDelta.WithLabelValues("added", site).Set(float64(added))
-		metrics.ReconcileDelta.WithLabelValues("removed", site).Set(float64(removed))
+		metrics.ReconcileDelta.WithLabelValues("added", site).Set(float64(diff.Added))
+		metrics.ReconcileDelta.WithLabelValues("removed", site).Set(float64(diff.Removed))
 	}
 
 	result.Elapsed = time.Since(start)
+	span.SetAttributes(
+		attribute.Int("reconcile.added", result.Added),
+		attribute.Int("reconcile.removed", result.Removed),
+		attribute.Int("reconcile.errors", len(result.Errors)),
+	)
 	return result, nil
 }
 
+// loadBanList reads the ban list for a reconcile of site, retrying up to
+// BanListRetries times with a doubling delay so that one transient store
+// error does not skip the whole site.
+func (m *managerImpl) loadBanList(ctx context.Context, site string) (map[string]storage.BanEntry, error) {
+	delay := m.cfg.BanListRetryDelay
+	for attempt := 0; ; attempt++ {
+		bans, err := m.store.BanList()
+		if err == nil {
+			return bans, nil
+		}
+		if attempt >= m.cfg.BanListRetries {
+			return nil, fmt.Errorf("load ban list (%d attempts): %w", attempt+1, err)
+		}
+		m.log.Warn().Err(err).Str("site", site).Int("attempt", attempt+1).Dur("wait", delay).
+			Msg("reconcile: ban list read failed; retrying")
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
 // reconcileSite diffs the bbolt ban list against all UniFi groups for one site.
-func (m *managerImpl) reconcileSite(ctx context.Context, site string) (added, removed int, errs []error) {
-	bans, err := m.store.BanList()
+func (m *managerImpl) reconcileSite(ctx context.Context, site string) (diff *SiteReconcileDiff, errs []error) {
+	ctx, span := tracing.Start(ctx, "firewall.reconcileSite", tracing.Site(site))
+	defer func() {
+		err := errors.Join(errs...)
+		tracing.End(span, &err)
+	}()
+	diff = &SiteReconcileDiff{}
+	bans, err := m.loadBanList(ctx, site)
 	if err != nil {
-		return 0, 0, []error{fmt.Errorf("load ban list: %w", err)}
+		return diff, []error{err}
 	}
 
 	m.mu.RLock()
@@ -455,41 +1043,61 @@ func (m *managerImpl) reconcileSite(ctx context.Context, site string) (added, re
 		return
 	}
 
-	// Build desired sets from bbolt
+	// Build desired sets from bbolt. Bans recorded before an IP was
+	// whitelisted stay in bbolt until they expire but are left out here, so
+	// the removal pass below takes them out of UniFi.
+	whitelist, _ := m.whitelist.Load().([]*net.IPNet)
 	desiredV4 := make(map[string]struct{})
 	desiredV6 := make(map[string]struct{})
-	for ip, entry := range bans {
-		if entry.IPv6 {
+	for ip := range bans {
+		if decision.IsWhitelisted(ip, whitelist) {
+			continue
+		}
+		// Classify by the address itself rather than entry.IPv6 so a record
+		// whose family was misreported upstream still lands in a valid group.
+		if isV6Member(ip) {
 			desiredV6[ip] = struct{}{}
 		} else {
 			desiredV4[ip] = struct{}{}
 		}
 	}
 
-	// Add missing IPs
-	for ip := range desiredV4 {
-		if ctx.Err() != nil {
-			return added, removed, append(errs, ctx.Err())
+	if m.cfg.AggregateCIDR {
+		if aggErrs := m.reconcileAggregatedV4(ctx, v4Mgr, desiredV4, diff); len(aggErrs) > 0 {
+			errs = append(errs, aggErrs...)
+			if ctx.Err() != nil {
+				return diff, errs
+			}
 		}
-		if !v4Mgr.Contains(ip) {
-			if _, _, err := v4Mgr.Add(ctx, ip); err != nil {
-				errs = append(errs, err)
-			} else {
-				added++
+	} else {
+		// Add missing IPs
+		for ip := range desiredV4 {
+			if ctx.Err() != nil {
+				return diff, append(errs, ctx.Err())
+			}
+			if !v4Mgr.Contains(ip) {
+				if _, _, err := v4Mgr.Add(ctx, ip); err != nil {
+					errs = append(errs, err)
+					if errors.As(err, new(*ErrShardLimit)) {
+						break // every further add would be refused too
+					}
+				} else {
+					diff.recordAdded(ip)
+				}
 			}
 		}
-	}
 
-	// Remove extra IPs from v4
-	for _, ip := range v4Mgr.AllMembers() {
-		if ctx.Err() != nil {
-			return added, removed, append(errs, ctx.Err())
-		}
-		if _, ok := desiredV4[ip]; !ok {
-			if _, err := v4Mgr.Remove(ctx, ip); err != nil {
-				errs = append(errs, err)
-			} else {
-				removed++
+		// Remove extra IPs from v4
+		for _, ip := range v4Mgr.AllMembers() {
+			if ctx.Err() != nil {
+				return diff, append(errs, ctx.Err())
+			}
+			if _, ok := desiredV4[ip]; !ok {
+				if _, err := v4Mgr.Remove(ctx, ip); err != nil {
+					errs = append(errs, err)
+				} else {
+					diff.recordRemoved(ip, whitelist)
+				}
 			}
 		}
 	}
@@ -498,33 +1106,36 @@ func (m *managerImpl) reconcileSite(ctx context.Context, site string) (added, re
 	if v6Mgr != nil {
 		for ip := range desiredV6 {
 			if ctx.Err() != nil {
-				return added, removed, append(errs, ctx.Err())
+				return diff, append(errs, ctx.Err())
 			}
 			if !v6Mgr.Contains(ip) {
 				if _, _, err := v6Mgr.Add(ctx, ip); err != nil {
 					errs = append(errs, err)
+					if errors.As(err, new(*ErrShardLimit)) {
+						break // every further add would be refused too
+					}
 				} else {
-					added++
+					diff.recordAdded(ip)
 				}
 			}
 		}
 		for _, ip := range v6Mgr.AllMembers() {
 			if ctx.Err() != nil {
-				return added, removed, append(errs, ctx.Err())
+				return diff, append(errs, ctx.Err())
 			}
 			if _, ok := desiredV6[ip]; !ok {
 				if _, err := v6Mgr.Remove(ctx, ip); err != nil {
 					errs = append(errs, err)
 				} else {
-					removed++
+					diff.recordRemoved(ip, whitelist)
 				}
 			}
 		}
 	}
 
 	if m.cfg.DryRun {
-		if added > 0 || removed > 0 {
-			m.log.Info().Str("site", site).Int("would_add", added).Int("would_remove", removed).
+		if diff.Added > 0 || diff.Removed > 0 {
+			m.log.Info().Str("site", site).Int("would_add", diff.Added).Int("would_remove", diff.Removed).
 				Msg("[DRY-RUN] reconcile diff computed; no changes written to UniFi")
 		}
 	} else {
@@ -539,13 +1150,135 @@ func (m *managerImpl) reconcileSite(ctx context.Context, site string) (added, re
 					errs = append(errs, fmt.Errorf("v6 flush: %w", err))
 				}
 			}
+			if err := m.syncLogSamples(ctx, site, v4Mgr, v6Mgr); err != nil {
+				errs = append(errs, fmt.Errorf("log sample flush: %w", err))
+			}
 		}()
 		m.pruneEmptyTailShards(ctx, site, v4Mgr, v6Mgr)
+
+		// After the flush every Active shard has its final group ID.
+		if m.cachedMode(site) == "legacy" {
+			repaired, err := m.legacyMgr.RepairRuleGroups(ctx, site, v4Mgr, v6Mgr)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("repair legacy rules: %w", err))
+			}
+			diff.RulesRepaired = repaired
+		}
 	}
 
 	return
 }
 
+// reconcileAggregatedV4 brings mgr's members to the aggregated form of
+// desired. Stale members go first: a block aggregated by an earlier reconcile
+// may cover part of what is desired now, and while it is present Contains
+// would report that part as already blocked. Removing first leaves only
+// desired, non-overlapping blocks, so Contains answers exactly. syncMu is
+// held throughout so no flush publishes the state between the two passes.
+func (m *managerImpl) reconcileAggregatedV4(ctx context.Context, mgr *ShardManager,
+	desired map[string]struct{}, diff *SiteReconcileDiff) (errs []error) {
+	members := make([]string, 0, len(desired))
+	for ip := range desired {
+		members = append(members, ip)
+	}
+	aggregated := aggregateIPv4(members)
+	want := make(map[string]struct{}, len(aggregated))
+	wantNets := make([]*net.IPNet, 0, len(aggregated))
+	for _, block := range aggregated {
+		want[block] = struct{}{}
+		if n, err := parseMember(block); err == nil {
+			wantNets = append(wantNets, n)
+		}
+	}
+
+	whitelist, _ := m.whitelist.Load().([]*net.IPNet)
+
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+
+	for _, ip := range mgr.AllMembers() {
+		if ctx.Err() != nil {
+			return append(errs, ctx.Err())
+		}
+		if _, ok := want[ip]; !ok {
+			if _, err := mgr.Remove(ctx, ip); err != nil {
+				errs = append(errs, err)
+			} else if overlapsAny(ip, wantNets) {
+				diff.recordReshaped(ip)
+			} else {
+				diff.recordRemoved(ip, whitelist)
+			}
+		}
+	}
+	for _, block := range aggregated {
+		if ctx.Err() != nil {
+			return append(errs, ctx.Err())
+		}
+		if !mgr.Contains(block) {
+			if _, _, err := mgr.Add(ctx, block); err != nil {
+				errs = append(errs, err)
+			} else {
+				diff.recordAdded(block)
+			}
+		}
+	}
+	return errs
+}
+
+// overlapsAny reports whether member shares addresses with any of nets.
+// Aggregated blocks never partially overlap, so sharing addresses means one
+// contains the other.
+func overlapsAny(member string, nets []*net.IPNet) bool {
+	n, err := parseMember(member)
+	if err != nil {
+		return false
+	}
+	for _, w := range nets {
+		if w.Contains(n.IP) || n.Contains(w.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitAggregates removes ip from the IPv4 blocks that Reconcile aggregated
+// around it, replacing each block with the pieces that are still banned. A
+// covering range that is itself a stored ban is left alone: unbanning one
+// address inside a banned range does not lift the range.
+func (m *managerImpl) splitAggregates(ctx context.Context, site, ip string, sm *ShardManager) {
+	network, err := parseMember(ip)
+	if err != nil || network.IP.To4() == nil {
+		return
+	}
+	// Most unbans hit no aggregate; skip syncMu, which a running flush holds
+	// for the length of its API calls.
+	if len(sm.coveringRanges(ip)) == 0 {
+		return
+	}
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+	for _, block := range sm.coveringRanges(ip) {
+		if banned, err := m.store.BanExists(block); err != nil || banned {
+			continue
+		}
+		_, outer, err := net.ParseCIDR(block)
+		if err != nil {
+			continue
+		}
+		if _, err := sm.Remove(ctx, block); err != nil {
+			m.log.Warn().Err(err).Str("site", site).Str("block", block).Msg("failed to split aggregated block")
+			continue
+		}
+		for _, piece := range subtractIPv4(outer, network) {
+			if _, _, err := sm.Add(ctx, piece); err != nil {
+				m.log.Warn().Err(err).Str("site", site).Str("ip", piece).
+					Msg("failed to re-add part of a split aggregated block; the next reconcile restores it")
+			}
+		}
+		m.log.Debug().Str("site", site).Str("block", block).Str("ip", ip).Msg("split aggregated block around unbanned address")
+	}
+}
+
 // setRateLimitUntil records when the rate-limit window expires.
 func (m *managerImpl) setRateLimitUntil(t time.Time) {
 	m.rateLimitUntil.Store(t)
@@ -659,6 +1392,9 @@ func (m *managerImpl) SyncDirty(ctx context.Context, sites []string) error {
 			if v6 != nil {
 				_ = v6.syncAllFamilies(ctx)
 			}
+			if err := m.syncLogSamples(ctx, site, v4, v6); err != nil {
+				m.log.Warn().Err(err).Str("site", site).Msg("SyncDirty: log sample flush failed")
+			}
 		}()
 
 		// Drain shards consolidated by the rebalance pass — must run after
@@ -688,12 +1424,75 @@ func (m *managerImpl) SyncDirty(ctx context.Context, sites []string) error {
 		}
 	}
 
+	// Re-arm the immediate first-block flush for the next batch window.
+	if m.cfg.ImmediateFirstBlock {
+		m.resetImmediateFlush()
+	}
+
 	// Update active_bans gauge from bbolt after every sync tick.
 	m.UpdateActiveBansMetric()
 	metrics.LastSyncTimestamp.Set(float64(time.Now().Unix()))
 	return nil
 }
 
+// Shutdown flushes every registered site/family once more. Unlike SyncDirty it
+// waits for an in-flight flush or reconcile to finish instead of skipping, and
+// it does not rebalance. Sites are flushed in sorted order until ctx expires.
+func (m *managerImpl) Shutdown(ctx context.Context) error {
+	if limited, until := m.isRateLimited(); limited {
+		m.log.Warn().Time("retry_after", until).Msg("shutdown flush skipped: rate-limited by controller")
+		return nil
+	}
+	if !m.cb.allow() {
+		m.log.Warn().Msg("shutdown flush skipped: circuit breaker open")
+		return nil
+	}
+
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+
+	m.mu.RLock()
+	sites := make([]string, 0, len(m.v4Mgrs))
+	for site := range m.v4Mgrs {
+		sites = append(sites, site)
+	}
+	m.mu.RUnlock()
+	sort.Strings(sites)
+
+	var errs []error
+	flushed := 0
+	for _, site := range sites {
+		m.mu.RLock()
+		v4 := m.v4Mgrs[site]
+		v6 := m.v6Mgrs[site]
+		m.mu.RUnlock()
+
+		for _, sm := range []*ShardManager{v4, v6} {
+			if sm == nil {
+				continue
+			}
+			n := sm.countDirty()
+			if n == 0 {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("shutdown flush: %w", errors.Join(append(errs, err)...))
+			}
+			if err := sm.syncAllFamilies(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("site %s %s: %w", site, Family(sm.ipv6), err))
+				continue
+			}
+			flushed += n
+		}
+	}
+
+	if flushed > 0 {
+		m.log.Info().Int("dirty_shards_flushed", flushed).Msg("shutdown flush complete")
+	}
+	m.UpdateActiveBansMetric()
+	return errors.Join(errs...)
+}
+
 // Drain removes all managed firewall objects for the given sites and cleans up bbolt.
 // Order per site: policies/rules first, then TML groups, then bbolt cleanup.
 func (m *managerImpl) Drain(ctx context.Context, sites []string) error {
@@ -747,6 +1546,9 @@ func (m *managerImpl) Drain(ctx context.Context, sites []string) error {
 			}
 		}
 
+		drainedShards += m.drainCountryBlocks(ctx, site, mode)
+		drainedShards += m.drainLogSamples(ctx, site, mode)
+
 		// 3. Clean up bbolt group and policy records for this site
 		if !m.cfg.DryRun {
 			groups, err := m.store.ListGroups()
@@ -788,6 +1590,51 @@ func (m *managerImpl) Drain(ctx context.Context, sites []string) error {
 	return nil
 }
 
+// EnableEnforcement implements Manager. A failing site does not stop the
+// others; the errors are joined.
+func (m *managerImpl) EnableEnforcement(ctx context.Context, sites []string) (int, error) {
+	type enabler struct {
+		legacy *LegacyManager
+		zone   *ZoneManager
+	}
+	enablers := []enabler{{m.legacyMgr, m.zoneMgr}}
+	if m.geo != nil {
+		enablers = append(enablers, enabler{m.geo.legacyMgr, m.geo.zoneMgr})
+	}
+	if m.logSample != nil {
+		enablers = append(enablers, enabler{m.logSample.legacyMgr, m.logSample.zoneMgr})
+	}
+
+	enabled := 0
+	var errs []error
+	for _, site := range sites {
+		mode := m.cachedMode(site)
+		if m.cfg.DryRun {
+			m.log.Info().Str("site", site).Str("mode", mode).
+				Msg("[DRY-RUN] would enable firewall policies/rules")
+			continue
+		}
+		for _, e := range enablers {
+			var n int
+			var err error
+			switch mode {
+			case "zone":
+				n, err = e.zone.EnablePolicies(ctx, site)
+			case "legacy":
+				n, err = e.legacy.EnableRules(ctx, site)
+			}
+			enabled += n
+			if err != nil {
+				errs = append(errs, fmt.Errorf("site %s: %w", site, err))
+				break
+			}
+		}
+	}
+
+	m.log.Info().Int("enabled", enabled).Bool("dry_run", m.cfg.DryRun).Msg("enable enforcement complete")
+	return enabled, errors.Join(errs...)
+}
+
 // ZoneManager returns the underlying ZoneManager, or nil in legacy mode.
 func (m *managerImpl) ZoneManager() *ZoneManager {
 	return m.zoneMgr
@@ -824,18 +1671,47 @@ func (m *managerImpl) ensureNewShardInfrastructure(ctx context.Context, site str
 	}
 
 	mode := m.cachedMode(site)
-	switch mode {
-	case "legacy":
-		return m.legacyMgr.EnsureRuleForShard(ctx, site, groupID, ipv6, shardIdx)
-	case "zone":
-		return m.zoneMgr.EnsurePoliciesForShard(ctx, site, groupID, ipv6, shardIdx)
+	for attempt := 1; ; attempt++ {
+		// The group was just created; some controllers need a moment before
+		// a rule or policy can reference it.
+		if m.cfg.NewShardSettle > 0 {
+			select {
+			case <-time.After(m.cfg.NewShardSettle):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		var err error
+		switch mode {
+		case "legacy":
+			err = m.legacyMgr.EnsureRuleForShard(ctx, site, groupID, ipv6, shardIdx)
+		case "zone":
+			err = m.zoneMgr.EnsurePoliciesForShard(ctx, site, groupID, ipv6, shardIdx)
+		}
+		if err == nil || attempt >= newShardProvisionAttempts || !groupNotSettled(err) {
+			return err
+		}
+		m.log.Warn().Err(err).Str("site", site).Bool("ipv6", ipv6).Int("shard", shardIdx).
+			Int("attempt", attempt).Msg("new group not yet usable by rule/policy; retrying")
 	}
-	return nil
+}
+
+// newShardProvisionAttempts bounds the rule/policy creates tried for a new
+// shard whose group the controller does not accept yet.
+const newShardProvisionAttempts = 3
+
+// groupNotSettled reports whether err is how a controller refuses a rule or
+// policy that references a group it has not finished creating.
+func groupNotSettled(err error) bool {
+	var nf *controller.ErrNotFound
+	var conflict *controller.ErrConflict
+	return errors.As(err, &nf) || errors.As(err, &conflict)
 }
 
 // pruneEmptyTailShards deletes empty trailing shards (group + rule/policy) for both families.
 func (m *managerImpl) pruneEmptyTailShards(ctx context.Context, site string, v4, v6 *ShardManager) {
-	if m.cfg.DryRun {
+	if m.cfg.DryRun || m.cfg.KeepEmptyShards {
 		return
 	}
 
@@ -894,6 +1770,7 @@ func (m *managerImpl) pruneEmptyTailShards(ctx context.Context, site string, v4,
 			if err := e.sm.RemoveTail(); err != nil {
 				m.log.Warn().Err(err).Msg("RemoveTail bbolt error")
 			}
+			metrics.FirewallShardsPruned.WithLabelValues(Family(e.ipv6), site).Inc()
 
 			m.log.Info().Str("site", site).Bool("ipv6", e.ipv6).Int("shard", shardIdx).
 				Msg("pruned empty shard and its firewall rule/policy")
@@ -961,14 +1838,125 @@ func (m *managerImpl) cachedMode(site string) string {
 	return mode
 }
 
+// CheckCapabilities drops the controller's cached feature flags for every
+// auto-mode site and detects the zone firewall again. A site is switched over
+// once two consecutive checks agree on a mode other than the one in use
+// (typically after a controller firmware upgrade), so one odd answer from a
+// controller mid-upgrade does not flip it: the change is counted and logged,
+// the site's infrastructure is rebuilt under syncMu, which compacts the old
+// mode's objects, and a reconcile refills the new mode's shards. Only the
+// switched sites are rebuilt, so bans still dirty on other sites stay queued.
+// A failed detection leaves the site's mode alone rather than falling back to
+// legacy as resolveMode does at startup.
+func (m *managerImpl) CheckCapabilities(ctx context.Context, sites []string) ([]string, error) {
+	changed, err := m.switchChangedModes(ctx, sites)
+	if err != nil || len(changed) == 0 {
+		return changed, err
+	}
+	result, err := m.Reconcile(ctx, changed)
+	if err != nil {
+		return changed, fmt.Errorf("reconcile after capability change: %w", err)
+	}
+	if len(result.Errors) > 0 {
+		return changed, fmt.Errorf("reconcile after capability change: %w", errors.Join(result.Errors...))
+	}
+	return changed, nil
+}
+
+// switchChangedModes runs the detection half of CheckCapabilities and
+// rebuilds the sites whose change is confirmed, returning them. It holds
+// syncMu throughout so no flush writes through a shard manager being
+// replaced.
+func (m *managerImpl) switchChangedModes(ctx context.Context, sites []string) ([]string, error) {
+	m.syncMu.Lock()
+	defer m.syncMu.Unlock()
+
+	var changed []string
+	for _, site := range sites {
+		if m.configuredMode(site) != "auto" {
+			continue
+		}
+		current := m.cachedMode(site)
+		if current == "" {
+			continue
+		}
+		m.ctrl.InvalidateZoneCache(site)
+		hasZone, err := m.ctrl.HasFeature(ctx, site, controller.FeatureZoneBasedFirewall)
+		if err != nil {
+			m.log.Warn().Err(err).Str("site", site).Msg("capability check: zone feature detection failed; keeping current mode")
+			continue
+		}
+		detected := "legacy"
+		if hasZone {
+			detected = "zone"
+		}
+		if detected == current {
+			delete(m.capProbe, site)
+			continue
+		}
+		if m.capProbe[site] != detected {
+			m.capProbe[site] = detected
+			m.log.Info().Str("site", site).Str("from", current).Str("to", detected).
+				Msg("capability check: mode change detected; confirming on the next check")
+			continue
+		}
+		delete(m.capProbe, site)
+		metrics.ControllerCapabilityChanged.WithLabelValues(site).Inc()
+		m.log.Warn().Str("site", site).Str("from", current).Str("to", detected).
+			Msg("controller capabilities changed; switching firewall mode")
+		changed = append(changed, site)
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	var countryLists countryCIDRs
+	if m.geo != nil && !m.cfg.DryRun {
+		countryLists = m.fetchCountryCIDRs(ctx)
+	}
+	for _, site := range changed {
+		if err := m.ensureSite(ctx, site, countryLists); err != nil {
+			return changed, fmt.Errorf("re-ensure infrastructure for site %s after capability change: %w", site, err)
+		}
+	}
+	return changed, nil
+}
+
+// configuredMode returns the FIREWALL_MODE for site, honouring overrides.
+func (m *managerImpl) configuredMode(site string) string {
+	if override, ok := m.cfg.ModeOverrides[site]; ok {
+		return override
+	}
+	return m.cfg.FirewallMode
+}
+
+// setModeMetric publishes mode as the site's active firewall mode.
+func setModeMetric(site, mode string) {
+	for _, m := range []string{"legacy", "zone"} {
+		v := 0.0
+		if m == mode {
+			v = 1
+		}
+		metrics.FirewallMode.WithLabelValues(site, m).Set(v)
+	}
+}
+
 // resolveMode determines the effective firewall mode for a site.
+// A per-site override wins over the global mode; "auto" (from either source)
+// triggers feature detection. A failed detection keeps the mode already in
+// use for the site, and only falls back to legacy when there is none yet.
 func (m *managerImpl) resolveMode(ctx context.Context, site string) (string, error) {
-	if m.cfg.FirewallMode != "auto" {
-		return m.cfg.FirewallMode, nil
+	mode := m.configuredMode(site)
+	if mode != "auto" {
+		return mode, nil
 	}
 	// Auto-detect
 	hasZone, err := m.ctrl.HasFeature(ctx, site, controller.FeatureZoneBasedFirewall)
 	if err != nil {
+		if current := m.cachedMode(site); current != "" {
+			m.log.Warn().Err(err).Str("site", site).Str("mode", current).Msg("zone feature detection failed, keeping current mode")
+			return current, nil
+		}
 		m.log.Warn().Err(err).Str("site", site).Msg("zone feature detection failed, falling back to legacy")
 		return "legacy", nil
 	}
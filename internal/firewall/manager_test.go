@@ -2,13 +2,23 @@ package firewall
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/decision"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/rs/zerolog"
 )
 
@@ -96,6 +106,107 @@ func TestEnsureInfrastructure_ZoneMode(t *testing.T) {
 	}
 }
 
+// TestEnsureInfrastructure_ParallelFamilies verifies that with
+// ParallelFamilyEnsure both families are registered for every site under the
+// site's resolved mode. Run with -race to check the concurrent ensure path.
+func TestEnsureInfrastructure_ParallelFamilies(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	cfg.EnableIPv6 = true
+	cfg.ParallelFamilyEnsure = true
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	ctrl.SetHasFeature("zone-site", controller.FeatureZoneBasedFirewall, true)
+	ctrl.SetHasFeature("legacy-site", controller.FeatureZoneBasedFirewall, false)
+
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{"zone-site", "legacy-site"}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	m := mgr.(*managerImpl)
+	for site, want := range map[string]string{"zone-site": "zone", "legacy-site": "legacy"} {
+		v4, v6 := m.v4Mgrs[site], m.v6Mgrs[site]
+		if v4 == nil || v6 == nil {
+			t.Fatalf("site %s: v4 registered=%v, v6 registered=%v; want both", site, v4 != nil, v6 != nil)
+		}
+		if v4.mode != want || v6.mode != want {
+			t.Errorf("site %s: modes v4=%q v6=%q, want %q", site, v4.mode, v6.mode, want)
+		}
+		if v4.ipv6 || !v6.ipv6 {
+			t.Errorf("site %s: family flags v4.ipv6=%v v6.ipv6=%v", site, v4.ipv6, v6.ipv6)
+		}
+	}
+}
+
+// TestEnsureInfrastructure_ParallelFamiliesError verifies that a failure in
+// either concurrently ensured family aborts the site without registering it.
+func TestEnsureInfrastructure_ParallelFamiliesError(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+	cfg.EnableIPv6 = true
+	cfg.ParallelFamilyEnsure = true
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	ctrl.SetError("ListFirewallGroups", errors.New("controller unavailable"))
+
+	err := mgr.EnsureInfrastructure(context.Background(), []string{testSite})
+	if err == nil || !strings.Contains(err.Error(), "controller unavailable") {
+		t.Fatalf("EnsureInfrastructure error = %v, want controller unavailable", err)
+	}
+	m := mgr.(*managerImpl)
+	if m.v4Mgrs[testSite] != nil || m.v6Mgrs[testSite] != nil {
+		t.Error("site should not be registered after a failed family ensure")
+	}
+}
+
+// TestResolveMode_SiteOverride verifies that a per-site override takes
+// precedence over the global mode, and that an "auto" override still runs
+// feature detection.
+func TestResolveMode_SiteOverride(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "zone"
+	cfg.ModeOverrides = map[string]string{"homelab": "legacy", "branch": "auto"}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	ctx := context.Background()
+
+	cases := map[string]string{"default": "zone", "homelab": "legacy", "branch": "legacy"}
+	for site, want := range cases {
+		got, err := m.resolveMode(ctx, site)
+		if err != nil {
+			t.Fatalf("resolveMode(%s): %v", site, err)
+		}
+		if got != want {
+			t.Errorf("resolveMode(%s) = %q, want %q", site, got, want)
+		}
+	}
+
+	ctrl.SetHasFeature("branch", controller.FeatureZoneBasedFirewall, true)
+	if got, _ := m.resolveMode(ctx, "branch"); got != "zone" {
+		t.Errorf("resolveMode(branch) with zone feature = %q, want zone", got)
+	}
+	if got := ctrl.Calls("HasFeature"); got != 2 {
+		t.Errorf("HasFeature calls: got %d, want 2 (only for the auto site)", got)
+	}
+}
+
+// TestResolveMode_DetectionErrorKeepsMode verifies that a failed detection
+// for a site already in zone mode keeps zone instead of flipping to legacy.
+func TestResolveMode_DetectionErrorKeepsMode(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	m.siteMode[testSite] = "zone"
+
+	ctrl.SetError("HasFeature", &controller.ErrServerBusy{Status: 503})
+	if got, err := m.resolveMode(context.Background(), testSite); err != nil || got != "zone" {
+		t.Errorf("resolveMode during 503 = %q, %v; want zone", got, err)
+	}
+}
+
 // TestEnsureInfrastructure_AutoMode_Zone verifies that in auto mode, when the
 // controller reports zone-based firewall support, lazy creation still applies
 // (no policies created at startup, only when shards are needed).
@@ -217,6 +328,146 @@ func TestApplyBan_UnknownSite(t *testing.T) {
 	}
 }
 
+// TestApplyBan_BufferedUntilReady verifies that with BufferEarlyDecisions a
+// ban and an unban received before EnsureInfrastructure are accepted and
+// applied from the store once the site's shards are loaded.
+func TestApplyBan_BufferedUntilReady(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.BufferEarlyDecisions = true
+
+	mgr, ctrl, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	// 10.0.0.9 is in UniFi from an earlier run; its unban arrives early.
+	ctrl.SetGroups(testSite, []controller.FirewallGroup{
+		{ID: "grp-0", Name: "crowdsec-block-v4-0", GroupType: "address-group", GroupMembers: []string{"10.0.0.9"}},
+	})
+
+	if mgr.Ready() {
+		t.Fatal("Ready() = true before EnsureInfrastructure")
+	}
+	// The job handler records a ban before applying it.
+	if err := store.BanRecord("10.0.0.1", time.Time{}, false); err != nil {
+		t.Fatalf("BanRecord: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan before ready: %v", err)
+	}
+	if err := mgr.ApplyUnban(ctx, testSite, "10.0.0.9", false); err != nil {
+		t.Fatalf("ApplyUnban before ready: %v", err)
+	}
+
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if !mgr.Ready() {
+		t.Fatal("Ready() = false after EnsureInfrastructure")
+	}
+	sm := mgr.(*managerImpl).shardMgr(testSite, false)
+	if !sm.Contains("10.0.0.1") {
+		t.Error("early ban was not replayed into the shards")
+	}
+	if sm.Contains("10.0.0.9") {
+		t.Error("early unban was not replayed; 10.0.0.9 is still a member")
+	}
+}
+
+// TestApplyBan_NotBufferedAfterReady verifies that buffering only covers the
+// window before EnsureInfrastructure: afterwards an unknown site still errors.
+func TestApplyBan_NotBufferedAfterReady(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.BufferEarlyDecisions = true
+
+	mgr, _, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(context.Background(), "unknown-site", "10.0.0.1", false); err == nil {
+		t.Error("ApplyBan on unknown site after ready: expected error, got nil")
+	}
+}
+
+// TestApplyBan_RoutesMisclassifiedFamily verifies that a ban flagged with the
+// wrong IP family lands in the shards of the address's real family.
+func TestApplyBan_RoutesMisclassifiedFamily(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.EnableIPv6 = true
+
+	mgr, _, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	if err := mgr.ApplyBan(context.Background(), testSite, "2001:db8::1", false); err != nil {
+		t.Fatalf("ApplyBan(v6 flagged as v4): %v", err)
+	}
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", true); err != nil {
+		t.Fatalf("ApplyBan(v4 flagged as v6): %v", err)
+	}
+
+	m := mgr.(*managerImpl)
+	if !m.shardMgr(testSite, true).Contains("2001:db8::1") || m.shardMgr(testSite, false).Contains("2001:db8::1") {
+		t.Error("2001:db8::1 should be tracked by the v6 shard manager only")
+	}
+	if !m.shardMgr(testSite, false).Contains("10.0.0.1") || m.shardMgr(testSite, true).Contains("10.0.0.1") {
+		t.Error("10.0.0.1 should be tracked by the v4 shard manager only")
+	}
+}
+
+// TestApplyUnban_RoutesMisclassifiedFamily verifies that an unban flagged
+// with the wrong IP family removes the address from its real family's shards.
+func TestApplyUnban_RoutesMisclassifiedFamily(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.EnableIPv6 = true
+
+	mgr, _, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(context.Background(), testSite, "2001:db8::1", true); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+
+	if err := mgr.ApplyUnban(context.Background(), testSite, "2001:db8::1", false); err != nil {
+		t.Fatalf("ApplyUnban(v6 flagged as v4): %v", err)
+	}
+	if err := mgr.ApplyUnban(context.Background(), testSite, "10.0.0.1", true); err != nil {
+		t.Fatalf("ApplyUnban(v4 flagged as v6): %v", err)
+	}
+
+	m := mgr.(*managerImpl)
+	if m.shardMgr(testSite, true).Contains("2001:db8::1") {
+		t.Error("2001:db8::1 should be removed from the v6 shard manager")
+	}
+	if m.shardMgr(testSite, false).Contains("10.0.0.1") {
+		t.Error("10.0.0.1 should be removed from the v4 shard manager")
+	}
+}
+
+// TestReconcile_ClassifiesByAddressFamily verifies that Reconcile places a
+// stored ban by the family of the address, not the recorded IPv6 flag.
+func TestReconcile_ClassifiesByAddressFamily(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.EnableIPv6 = true
+
+	mgr, _, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := store.BanRecord("2001:db8::7", time.Time{}, false); err != nil {
+		t.Fatalf("BanRecord: %v", err)
+	}
+	if _, err := mgr.Reconcile(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if !mgr.(*managerImpl).shardMgr(testSite, true).Contains("2001:db8::7") {
+		t.Error("2001:db8::7 should be reconciled into the v6 shards")
+	}
+}
+
 // TestApplyUnban_Basic verifies that unbanning after a ban succeeds.
 func TestApplyUnban_Basic(t *testing.T) {
 	cfg := defaultManagerConfig()
@@ -235,6 +486,41 @@ func TestApplyUnban_Basic(t *testing.T) {
 	}
 }
 
+// TestApplyUnban_RestoresMembersCoveredByRange verifies that unbanning a range
+// under CIDR subsumption puts back the still-banned hosts it covered.
+func TestApplyUnban_RestoresMembersCoveredByRange(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.CIDRSubsumption = SubsumePrune
+
+	mgr, _, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for _, ip := range []string{"198.51.100.7", "198.51.100.0/24"} {
+		if err := store.BanRecord(ip, time.Time{}, false); err != nil {
+			t.Fatalf("BanRecord(%s): %v", ip, err)
+		}
+		if err := mgr.ApplyBan(ctx, testSite, ip, false); err != nil {
+			t.Fatalf("ApplyBan(%s): %v", ip, err)
+		}
+	}
+	sm := mgr.(*managerImpl).shardMgr(testSite, false)
+	if got := sm.AllMembers(); len(got) != 1 || got[0] != "198.51.100.0/24" {
+		t.Fatalf("AllMembers = %v, want only the range", got)
+	}
+
+	if err := store.BanDelete("198.51.100.0/24"); err != nil {
+		t.Fatalf("BanDelete: %v", err)
+	}
+	if err := mgr.ApplyUnban(ctx, testSite, "198.51.100.0/24", false); err != nil {
+		t.Fatalf("ApplyUnban: %v", err)
+	}
+	if got := sm.AllMembers(); len(got) != 1 || got[0] != "198.51.100.7" {
+		t.Errorf("AllMembers = %v, want the covered host restored", got)
+	}
+}
+
 // TestApplyUnban_UnknownSite verifies that unbanning on an unknown site is
 // idempotent (no error, no panic).
 func TestApplyUnban_UnknownSite(t *testing.T) {
@@ -275,108 +561,692 @@ func TestReconcile_AddsMissing(t *testing.T) {
 	if len(result.Errors) != 0 {
 		t.Errorf("Reconcile.Errors: got %v, want empty", result.Errors)
 	}
-	if got := ctrl.Calls("UpdateFirewallGroup"); got < 1 {
-		t.Errorf("UpdateFirewallGroup calls: got %d, want >= 1 (flush after reconcile)", got)
+	if got := ctrl.Calls("UpdateFirewallGroup"); got < 1 {
+		t.Errorf("UpdateFirewallGroup calls: got %d, want >= 1 (flush after reconcile)", got)
+	}
+}
+
+// flakyBanListStore fails the next `failures` BanList calls.
+type flakyBanListStore struct {
+	*testutil.MockStore
+	failures atomic.Int32
+	calls    atomic.Int32
+}
+
+func (f *flakyBanListStore) BanList() (map[string]storage.BanEntry, error) {
+	f.calls.Add(1)
+	if f.failures.Add(-1) >= 0 {
+		return nil, errors.New("bbolt: transaction not valid")
+	}
+	return f.MockStore.BanList()
+}
+
+// TestReconcile_RetriesBanListRead verifies that a transient BanList error is
+// retried and the site still reconciles, and that the error surfaces once
+// BanListRetries is exhausted.
+func TestReconcile_RetriesBanListRead(t *testing.T) {
+	cases := []struct {
+		name      string
+		failures  int32
+		wantCalls int32
+		wantErr   bool
+	}{
+		{name: "transient", failures: 1, wantCalls: 2},
+		{name: "exhausted", failures: 10, wantCalls: 3, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := defaultManagerConfig()
+			cfg.BanListRetries = 2
+			cfg.BanListRetryDelay = time.Millisecond
+
+			store := &flakyBanListStore{MockStore: testutil.NewMockStore()}
+			mgr := NewManager(cfg, testutil.NewMockController(), store, managerTestNamer(t), zerolog.Nop())
+			ctx := context.Background()
+			if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+				t.Fatalf("EnsureInfrastructure: %v", err)
+			}
+			if err := store.BanRecord("10.0.0.99", time.Time{}, false); err != nil {
+				t.Fatalf("BanRecord: %v", err)
+			}
+
+			store.calls.Store(0)
+			store.failures.Store(tc.failures)
+			result, err := mgr.Reconcile(ctx, []string{testSite})
+			if err != nil {
+				t.Fatalf("Reconcile: %v", err)
+			}
+			if got := store.calls.Load(); got != tc.wantCalls {
+				t.Errorf("BanList calls: got %d, want %d", got, tc.wantCalls)
+			}
+			if tc.wantErr {
+				if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), "load ban list (3 attempts)") {
+					t.Errorf("Reconcile.Errors: got %v, want one exhausted ban list error", result.Errors)
+				}
+				return
+			}
+			if len(result.Errors) != 0 || result.Added != 1 {
+				t.Errorf("Reconcile: got added=%d errors=%v, want added=1 and no errors", result.Added, result.Errors)
+			}
+		})
+	}
+}
+
+// TestReconcile_DryRunReportsPerSiteIPs verifies that a dry-run reconcile
+// TestReconcile_RemovesWhitelisted verifies that IPs whitelisted after they
+// were banned are removed from the shards by Reconcile and not re-added,
+// for both families.
+func TestReconcile_RemovesWhitelisted(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.EnableIPv6 = true
+
+	mgr, _, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	bans := map[string]bool{"10.0.0.5": false, "203.0.113.9": false, "2001:db8::5": true, "2001:db9::5": true}
+	for ip, v6 := range bans {
+		if err := store.BanRecord(ip, time.Time{}, v6); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+		if err := mgr.ApplyBan(ctx, testSite, ip, v6); err != nil {
+			t.Fatalf("ApplyBan(%s): %v", ip, err)
+		}
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	whitelist, err := decision.ParseWhitelist([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr.SetWhitelist(whitelist)
+	result, err := mgr.Reconcile(ctx, []string{testSite})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	diff := result.Sites[testSite]
+	if got := strings.Join(diff.RemovedIPs, ","); diff.Added != 0 || got != "10.0.0.5,2001:db8::5" {
+		t.Errorf("reconcile diff = %+v, want only the whitelisted IPs removed", diff)
+	}
+	if diff.Whitelisted != 2 || result.Whitelisted != 2 {
+		t.Errorf("whitelisted removals = %d (site) / %d (total), want 2", diff.Whitelisted, result.Whitelisted)
+	}
+
+	m := mgr.(*managerImpl)
+	for ip, v6 := range bans {
+		want := ip == "203.0.113.9" || ip == "2001:db9::5"
+		if got := m.shardMgr(testSite, v6).Contains(ip); got != want {
+			t.Errorf("shard contains %s = %v, want %v", ip, got, want)
+		}
+	}
+}
+
+// lists the IPs it would add and remove, keyed by site.
+func TestReconcile_DryRunReportsPerSiteIPs(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.DryRun = true
+	const otherSite = "branch"
+
+	mgr, ctrl, store := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite, otherSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for _, ip := range []string{"203.0.113.2", "203.0.113.1"} {
+		if err := store.BanRecord(ip, time.Time{}, false); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+	}
+	// An IP present only in the branch site's shard is extra there.
+	mi := mgr.(*managerImpl)
+	mi.mu.RLock()
+	branchV4 := mi.v4Mgrs[otherSite]
+	mi.mu.RUnlock()
+	if _, _, err := branchV4.Add(context.Background(), "198.51.100.7"); err != nil {
+		t.Fatalf("direct shard Add: %v", err)
+	}
+
+	result, err := mgr.Reconcile(context.Background(), []string{testSite, otherSite})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+
+	primary := result.Sites[testSite]
+	if primary == nil || primary.Added != 2 || primary.Removed != 0 {
+		t.Fatalf("site %s diff: got %+v, want 2 added, 0 removed", testSite, primary)
+	}
+	if got := strings.Join(primary.AddedIPs, ","); got != "203.0.113.1,203.0.113.2" {
+		t.Errorf("site %s AddedIPs: got %s", testSite, got)
+	}
+	branch := result.Sites[otherSite]
+	if branch == nil || branch.Removed != 1 || len(branch.RemovedIPs) != 1 || branch.RemovedIPs[0] != "198.51.100.7" {
+		t.Fatalf("site %s diff: got %+v, want 198.51.100.7 removed", otherSite, branch)
+	}
+	if result.Added != 4 || result.Removed != 1 {
+		t.Errorf("aggregate counts: got added=%d removed=%d, want 4/1", result.Added, result.Removed)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup"); got != 0 {
+		t.Errorf("UpdateFirewallGroup calls in dry-run: got %d, want 0", got)
+	}
+}
+
+// TestReconcile_DiffSampleCapped verifies that the per-site IP lists are capped
+// while the counts stay exact.
+func TestReconcile_DiffSampleCapped(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.DryRun = true
+	cfg.GroupCapacityV4 = 1000
+
+	mgr, _, store := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	const n = reconcileSampleLimit + 50
+	for i := 0; i < n; i++ {
+		if err := store.BanRecord(fmt.Sprintf("203.0.%d.%d", i/256, i%256), time.Time{}, false); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+	}
+
+	result, err := mgr.Reconcile(context.Background(), []string{testSite})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	diff := result.Sites[testSite]
+	if diff.Added != n {
+		t.Errorf("Added: got %d, want %d", diff.Added, n)
+	}
+	if len(diff.AddedIPs) != reconcileSampleLimit {
+		t.Errorf("len(AddedIPs): got %d, want %d", len(diff.AddedIPs), reconcileSampleLimit)
+	}
+}
+
+// TestReconcile_RemovesExtra verifies that Reconcile removes an IP from the
+// shard when the shard has it but the store does not.
+func TestReconcile_RemovesExtra(t *testing.T) {
+	cfg := defaultManagerConfig()
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	// Put an IP directly into the shard (bypassing the store).
+	mi := mgr.(*managerImpl)
+	mi.mu.RLock()
+	v4 := mi.v4Mgrs[testSite]
+	mi.mu.RUnlock()
+
+	if _, _, err := v4.Add(context.Background(), "10.0.0.99"); err != nil {
+		t.Fatalf("direct shard Add: %v", err)
+	}
+	// Flush to create the shard Active in UniFi so Reconcile's sync can update it.
+	if err := v4.FlushDirty(context.Background()); err != nil {
+		t.Fatalf("FlushDirty: %v", err)
+	}
+
+	// Store has no bans, so 10.0.0.99 is extra.
+	result, err := mgr.Reconcile(context.Background(), []string{testSite})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if result.Removed < 1 {
+		t.Errorf("Reconcile.Removed: got %d, want >= 1", result.Removed)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup"); got < 1 {
+		t.Errorf("UpdateFirewallGroup calls: got %d, want >= 1 (flush after reconcile)", got)
+	}
+}
+
+// TestIPv6Disabled verifies that when EnableIPv6 is false, no v6 shard manager
+// is created (v6Mgrs stays empty for the site).
+func TestIPv6Disabled(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.EnableIPv6 = false
+
+	mgr, _, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	mi := mgr.(*managerImpl)
+	mi.mu.RLock()
+	_, hasV6 := mi.v6Mgrs[testSite]
+	mi.mu.RUnlock()
+
+	if hasV6 {
+		t.Error("v6Mgrs should be empty when EnableIPv6=false")
+	}
+}
+
+// TestApplyBan_OverflowProvisionRule verifies that when ApplyBan causes a new
+// shard to be created (capacity overflow), a firewall rule is provisioned for
+// the new shard.
+func TestApplyBan_OverflowProvisionRule(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+	cfg.GroupCapacityV4 = 1 // capacity=1 so second IP forces new shard
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	// First IP creates Pending shard 0; flush to make it Active and fire rule creation.
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan (first IP): %v", err)
+	}
+	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty (after first ban): %v", err)
+	}
+
+	rulesAfterFirst := ctrl.Calls("CreateFirewallRule")
+
+	// Second IP overflows into shard 1; flush to make it Active → new rule must be created.
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.2", false); err != nil {
+		t.Fatalf("ApplyBan (overflow IP): %v", err)
+	}
+	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty (after overflow ban): %v", err)
+	}
+
+	if got := ctrl.Calls("CreateFirewallRule"); got <= rulesAfterFirst {
+		t.Errorf("CreateFirewallRule calls: got %d, want > %d (new shard needs a rule)", got, rulesAfterFirst)
+	}
+}
+
+// TestReconcile_RepairsRuleWithStaleGroupID verifies that reconcile re-points
+// a legacy rule at its shard's group after the group was deleted by hand and
+// recreated under a new ID.
+func TestReconcile_RepairsRuleWithStaleGroupID(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+
+	mgr, ctrl, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := store.BanRecord("10.0.0.1", time.Time{}, false); err != nil {
+		t.Fatalf("BanRecord: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	oldID := mgr.(*managerImpl).shardMgr(testSite, false).GroupIDs()[0]
+
+	// An operator deletes the group; the next start recreates it.
+	ctrl.SetGroups(testSite, nil)
+	mgr2 := NewManager(cfg, ctrl, store, managerTestNamer(t), zerolog.Nop())
+	if err := mgr2.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure after group deletion: %v", err)
+	}
+	result, err := mgr2.Reconcile(ctx, []string{testSite})
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("Reconcile errors: %v", result.Errors)
+	}
+
+	newID := mgr2.(*managerImpl).shardMgr(testSite, false).GroupIDs()[0]
+	if newID == "" || newID == oldID {
+		t.Fatalf("expected the group to be recreated under a new ID; old=%q new=%q", oldID, newID)
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(rules))
+	}
+	if got := rules[0].SrcFirewallGroupIDs; len(got) != 1 || got[0] != newID {
+		t.Errorf("rule SrcFirewallGroupIDs = %v, want [%s]", got, newID)
+	}
+	if got := result.Sites[testSite].RulesRepaired; got != 1 {
+		t.Errorf("RulesRepaired = %d, want 1", got)
+	}
+}
+
+// policyModes returns the modes of the policy records stored for site.
+func policyModes(t *testing.T, store *testutil.MockStore, site string) map[string]int {
+	t.Helper()
+	records, err := store.ListPolicies()
+	if err != nil {
+		t.Fatalf("ListPolicies: %v", err)
+	}
+	modes := make(map[string]int)
+	for _, rec := range records {
+		if rec.Site == site {
+			modes[rec.Mode]++
+		}
+	}
+	return modes
+}
+
+// TestEnsureInfrastructure_CompactsLegacyAfterSwitchToZone verifies that a
+// site switched from legacy to zone loses its legacy rules and records.
+func TestEnsureInfrastructure_CompactsLegacyAfterSwitchToZone(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+	cfg.CompactStaleModes = true
+
+	mgr, ctrl, store := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure (legacy): %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := policyModes(t, store, testSite)["legacy"]; got != 1 {
+		t.Fatalf("legacy records before switch: got %d, want 1", got)
+	}
+
+	cfg.FirewallMode = "zone"
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+	zoneMgr := NewManager(cfg, ctrl, store, managerTestNamer(t), zerolog.Nop())
+	if err := zoneMgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure (zone): %v", err)
+	}
+
+	if got := policyModes(t, store, testSite)["legacy"]; got != 0 {
+		t.Errorf("legacy records after switch: got %d, want 0", got)
+	}
+	if rules, _ := ctrl.ListFirewallRules(ctx, testSite); len(rules) != 0 {
+		t.Errorf("legacy rules after switch: got %d, want 0", len(rules))
+	}
+}
+
+// TestEnsureInfrastructure_CompactsZoneAfterSwitchToLegacy verifies the
+// reverse switch, and that CompactStaleModes=false leaves everything alone.
+func TestEnsureInfrastructure_CompactsZoneAfterSwitchToLegacy(t *testing.T) {
+	for _, compact := range []bool{true, false} {
+		cfg := defaultManagerConfig()
+		cfg.FirewallMode = "legacy"
+		cfg.CompactStaleModes = compact
+
+		mgr, ctrl, store := newTestManager(t, cfg)
+		ctx := context.Background()
+		ctrl.SetPolicies(testSite, []controller.ZonePolicy{{ID: "pol-1", Name: "crowdsec-policy-wan-lan-v4-0"}})
+		if err := store.SetPolicy("crowdsec-policy-wan-lan-v4-0", storage.PolicyRecord{
+			UnifiID: "pol-1", Site: testSite, Mode: "zone",
+		}); err != nil {
+			t.Fatalf("SetPolicy: %v", err)
+		}
+
+		if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+			t.Fatalf("EnsureInfrastructure: %v", err)
+		}
+
+		wantLeft := 1
+		if compact {
+			wantLeft = 0
+		}
+		if got := policyModes(t, store, testSite)["zone"]; got != wantLeft {
+			t.Errorf("compact=%v: zone records got %d, want %d", compact, got, wantLeft)
+		}
+		if got := ctrl.Calls("DeleteZonePolicy"); got != 1-wantLeft {
+			t.Errorf("compact=%v: DeleteZonePolicy calls got %d, want %d", compact, got, 1-wantLeft)
+		}
+	}
+}
+
+// barrierStore holds each BanList call, which opens every site reconcile,
+// once armed until want calls are in flight together (or a timeout passes),
+// recording the highest concurrency seen.
+type barrierStore struct {
+	*testutil.MockStore
+	want     int32
+	armed    atomic.Bool
+	inflight atomic.Int32
+	peak     atomic.Int32
+	all      chan struct{}
+	once     sync.Once
+}
+
+func (c *barrierStore) BanList() (map[string]storage.BanEntry, error) {
+	if c.armed.Load() {
+		n := c.inflight.Add(1)
+		defer c.inflight.Add(-1)
+		for {
+			p := c.peak.Load()
+			if n <= p || c.peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		if n == c.want {
+			c.once.Do(func() { close(c.all) })
+		}
+		select {
+		case <-c.all:
+		case <-time.After(2 * time.Second):
+		}
+	}
+	return c.MockStore.BanList()
+}
+
+// TestReconcile_SitesConcurrently verifies that ReconcileSiteConcurrency lets
+// sites reconcile in parallel and that the per-site results aggregate.
+func TestReconcile_SitesConcurrently(t *testing.T) {
+	sites := []string{"site-a", "site-b", "site-c"}
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+	cfg.ReconcileSiteConcurrency = len(sites)
+
+	store := &barrierStore{
+		MockStore: testutil.NewMockStore(),
+		want:      int32(len(sites)),
+		all:       make(chan struct{}),
+	}
+	mgr := NewManager(cfg, testutil.NewMockController(), store, managerTestNamer(t), zerolog.Nop())
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, sites); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := store.BanRecord(ip, time.Time{}, false); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+	}
+
+	store.armed.Store(true)
+	result, err := mgr.Reconcile(ctx, sites)
+	if err != nil {
+		t.Fatalf("Reconcile: %v", err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatalf("Reconcile errors: %v", result.Errors)
+	}
+	if got := store.peak.Load(); got != int32(len(sites)) {
+		t.Errorf("peak concurrent site reconciles: got %d, want %d", got, len(sites))
+	}
+	if result.Added != 2*len(sites) {
+		t.Errorf("Added: got %d, want %d", result.Added, 2*len(sites))
+	}
+	for _, site := range sites {
+		diff := result.Sites[site]
+		if diff == nil || diff.Added != 2 {
+			t.Errorf("site %s: diff %+v, want Added=2", site, diff)
+			continue
+		}
+		if diff.AddedIPs[0] != "10.0.0.1" || diff.AddedIPs[1] != "10.0.0.2" {
+			t.Errorf("site %s: AddedIPs = %v", site, diff.AddedIPs)
+		}
+		if !mgr.(*managerImpl).shardMgr(site, false).Contains("10.0.0.2") {
+			t.Errorf("site %s: 10.0.0.2 not in shards", site)
+		}
+		if got := promtestutil.ToFloat64(metrics.ReconcileDelta.WithLabelValues("added", site)); got != 2 {
+			t.Errorf("site %s: ReconcileDelta{added} = %v, want 2", site, got)
+		}
+	}
+}
+
+// TestSyncDirty_FlushesAllSites verifies that SyncDirty calls the API for each
+// managed site with dirty shards and leaves clean shards untouched.
+func TestSyncDirty_FlushesAllSites(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	// Add an IP to make shard0 dirty.
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+
+	updatesBefore := ctrl.Calls("UpdateFirewallGroup")
+
+	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	// Exactly one dirty shard should have been flushed.
+	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 1 {
+		t.Errorf("UpdateFirewallGroup calls after SyncDirty = %d, want 1", got)
+	}
+
+	// Second SyncDirty: shard is now clean, no further API call.
+	updatesBefore = ctrl.Calls("UpdateFirewallGroup")
+	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty (second): %v", err)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 0 {
+		t.Errorf("UpdateFirewallGroup calls on clean sync = %d, want 0", got)
 	}
 }
 
-// TestReconcile_RemovesExtra verifies that Reconcile removes an IP from the
-// shard when the shard has it but the store does not.
-func TestReconcile_RemovesExtra(t *testing.T) {
+// TestShutdown_FlushesPendingBans verifies that Shutdown writes bans applied
+// since the last SyncDirty for every site/family and leaves the shards clean.
+func TestShutdown_FlushesPendingBans(t *testing.T) {
 	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "legacy"
+	cfg.EnableIPv6 = true
 
 	mgr, ctrl, _ := newTestManager(t, cfg)
-	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
+	ctx := context.Background()
+	sites := []string{testSite, "branch"}
+	if err := mgr.EnsureInfrastructure(ctx, sites); err != nil {
 		t.Fatalf("EnsureInfrastructure: %v", err)
 	}
-
-	// Put an IP directly into the shard (bypassing the store).
-	mi := mgr.(*managerImpl)
-	mi.mu.RLock()
-	v4 := mi.v4Mgrs[testSite]
-	mi.mu.RUnlock()
-
-	if _, _, err := v4.Add(context.Background(), "10.0.0.99"); err != nil {
-		t.Fatalf("direct shard Add: %v", err)
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan v4: %v", err)
 	}
-	// Flush to create the shard Active in UniFi so Reconcile's sync can update it.
-	if err := v4.FlushDirty(context.Background()); err != nil {
-		t.Fatalf("FlushDirty: %v", err)
+	if err := mgr.ApplyBan(ctx, "branch", "2001:db8::1", true); err != nil {
+		t.Fatalf("ApplyBan v6: %v", err)
 	}
 
-	// Store has no bans, so 10.0.0.99 is extra.
-	result, err := mgr.Reconcile(context.Background(), []string{testSite})
-	if err != nil {
-		t.Fatalf("Reconcile: %v", err)
+	updatesBefore := ctrl.Calls("UpdateFirewallGroup")
+	if err := mgr.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
 	}
-	if result.Removed < 1 {
-		t.Errorf("Reconcile.Removed: got %d, want >= 1", result.Removed)
+	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 2 {
+		t.Errorf("UpdateFirewallGroup calls during Shutdown = %d, want 2", got)
 	}
-	if got := ctrl.Calls("UpdateFirewallGroup"); got < 1 {
-		t.Errorf("UpdateFirewallGroup calls: got %d, want >= 1 (flush after reconcile)", got)
+
+	m := mgr.(*managerImpl)
+	if n := m.v4Mgrs[testSite].countDirty() + m.v6Mgrs["branch"].countDirty(); n != 0 {
+		t.Errorf("dirty shards after Shutdown = %d, want 0", n)
 	}
 }
 
-// TestIPv6Disabled verifies that when EnableIPv6 is false, no v6 shard manager
-// is created (v6Mgrs stays empty for the site).
-func TestIPv6Disabled(t *testing.T) {
+// TestShutdown_ContextExpired verifies that Shutdown gives up without writing
+// once its context has expired, leaving the shard dirty for the next reconcile.
+func TestShutdown_ContextExpired(t *testing.T) {
 	cfg := defaultManagerConfig()
-	cfg.EnableIPv6 = false
+	cfg.FirewallMode = "legacy"
 
-	mgr, _, _ := newTestManager(t, cfg)
+	mgr, ctrl, _ := newTestManager(t, cfg)
 	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
 		t.Fatalf("EnsureInfrastructure: %v", err)
 	}
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
 
-	mi := mgr.(*managerImpl)
-	mi.mu.RLock()
-	_, hasV6 := mi.v6Mgrs[testSite]
-	mi.mu.RUnlock()
-
-	if hasV6 {
-		t.Error("v6Mgrs should be empty when EnableIPv6=false")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	updatesBefore := ctrl.Calls("UpdateFirewallGroup")
+	if err := mgr.Shutdown(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Shutdown error = %v, want context.Canceled", err)
+	}
+	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 0 {
+		t.Errorf("UpdateFirewallGroup calls = %d, want 0", got)
+	}
+	if n := mgr.(*managerImpl).v4Mgrs[testSite].countDirty(); n != 1 {
+		t.Errorf("dirty shards = %d, want 1", n)
 	}
 }
 
-// TestApplyBan_OverflowProvisionRule verifies that when ApplyBan causes a new
-// shard to be created (capacity overflow), a firewall rule is provisioned for
-// the new shard.
-func TestApplyBan_OverflowProvisionRule(t *testing.T) {
+// TestApplyBan_ImmediateFirstBlock verifies that with ImmediateFirstBlock the
+// first ban after a sync tick is written straight away, follow-up bans wait
+// for SyncDirty, and SyncDirty does not rewrite the already-flushed shard.
+func TestApplyBan_ImmediateFirstBlock(t *testing.T) {
 	cfg := defaultManagerConfig()
 	cfg.FirewallMode = "legacy"
-	cfg.GroupCapacityV4 = 1 // capacity=1 so second IP forces new shard
+	cfg.ImmediateFirstBlock = true
 
 	mgr, ctrl, _ := newTestManager(t, cfg)
 	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
 		t.Fatalf("EnsureInfrastructure: %v", err)
 	}
+	writes := func() int {
+		return ctrl.Calls("CreateFirewallGroup") + ctrl.Calls("UpdateFirewallGroup")
+	}
 
-	// First IP creates Pending shard 0; flush to make it Active and fire rule creation.
 	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
-		t.Fatalf("ApplyBan (first IP): %v", err)
+		t.Fatalf("ApplyBan: %v", err)
 	}
-	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
-		t.Fatalf("SyncDirty (after first ban): %v", err)
+	if got := writes(); got == 0 {
+		t.Fatal("first ban should be flushed immediately")
 	}
 
-	rulesAfterFirst := ctrl.Calls("CreateFirewallRule")
-
-	// Second IP overflows into shard 1; flush to make it Active → new rule must be created.
-	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.2", false); err != nil {
-		t.Fatalf("ApplyBan (overflow IP): %v", err)
+	// Rapid follow-ups are batched.
+	before := writes()
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		if err := mgr.ApplyBan(context.Background(), testSite, ip, false); err != nil {
+			t.Fatalf("ApplyBan(%s): %v", ip, err)
+		}
+	}
+	if got := writes() - before; got != 0 {
+		t.Errorf("follow-up bans wrote %d times before SyncDirty, want 0", got)
 	}
+
 	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
-		t.Fatalf("SyncDirty (after overflow ban): %v", err)
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := writes() - before; got != 1 {
+		t.Errorf("SyncDirty writes = %d, want 1 (batched follow-ups only)", got)
 	}
 
-	if got := ctrl.Calls("CreateFirewallRule"); got <= rulesAfterFirst {
-		t.Errorf("CreateFirewallRule calls: got %d, want > %d (new shard needs a rule)", got, rulesAfterFirst)
+	// The tick re-arms the fast path for the next window.
+	before = writes()
+	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.4", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if got := writes() - before; got != 1 {
+		t.Errorf("first ban after SyncDirty wrote %d times, want 1", got)
+	}
+	before = writes()
+	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := writes() - before; got != 0 {
+		t.Errorf("SyncDirty rewrote an already-flushed shard: %d writes", got)
 	}
 }
 
-// TestSyncDirty_FlushesAllSites verifies that SyncDirty calls the API for each
-// managed site with dirty shards and leaves clean shards untouched.
-func TestSyncDirty_FlushesAllSites(t *testing.T) {
+// TestApplyBan_BatchedByDefault verifies that without ImmediateFirstBlock a ban
+// is only written by SyncDirty.
+func TestApplyBan_BatchedByDefault(t *testing.T) {
 	cfg := defaultManagerConfig()
 	cfg.FirewallMode = "legacy"
 
@@ -384,30 +1254,11 @@ func TestSyncDirty_FlushesAllSites(t *testing.T) {
 	if err := mgr.EnsureInfrastructure(context.Background(), []string{testSite}); err != nil {
 		t.Fatalf("EnsureInfrastructure: %v", err)
 	}
-
-	// Add an IP to make shard0 dirty.
 	if err := mgr.ApplyBan(context.Background(), testSite, "10.0.0.1", false); err != nil {
 		t.Fatalf("ApplyBan: %v", err)
 	}
-
-	updatesBefore := ctrl.Calls("UpdateFirewallGroup")
-
-	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
-		t.Fatalf("SyncDirty: %v", err)
-	}
-
-	// Exactly one dirty shard should have been flushed.
-	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 1 {
-		t.Errorf("UpdateFirewallGroup calls after SyncDirty = %d, want 1", got)
-	}
-
-	// Second SyncDirty: shard is now clean, no further API call.
-	updatesBefore = ctrl.Calls("UpdateFirewallGroup")
-	if err := mgr.SyncDirty(context.Background(), []string{testSite}); err != nil {
-		t.Fatalf("SyncDirty (second): %v", err)
-	}
-	if got := ctrl.Calls("UpdateFirewallGroup") - updatesBefore; got != 0 {
-		t.Errorf("UpdateFirewallGroup calls on clean sync = %d, want 0", got)
+	if got := ctrl.Calls("CreateFirewallGroup") + ctrl.Calls("UpdateFirewallGroup"); got != 0 {
+		t.Errorf("ApplyBan wrote %d times without ImmediateFirstBlock, want 0", got)
 	}
 }
 
@@ -601,6 +1452,10 @@ func (pc *PanicController) UpdateFirewallGroup(ctx context.Context, site string,
 	panic("DryRun gate failed: UpdateFirewallGroup called")
 }
 
+func (pc *PanicController) BulkUpdateFirewallGroups(ctx context.Context, site string, groups []controller.FirewallGroup) error {
+	panic("DryRun gate failed: BulkUpdateFirewallGroups called")
+}
+
 func (pc *PanicController) DeleteFirewallGroup(ctx context.Context, site string, id string) error {
 	panic("DryRun gate failed: DeleteFirewallGroup called")
 }
@@ -609,6 +1464,10 @@ func (pc *PanicController) ListFirewallRules(ctx context.Context, site string) (
 	return []controller.FirewallRule{}, nil
 }
 
+func (pc *PanicController) ListRulesets(ctx context.Context, site string) ([]string, error) {
+	return []string{}, nil
+}
+
 func (pc *PanicController) CreateFirewallRule(ctx context.Context, site string, r controller.FirewallRule) (controller.FirewallRule, error) {
 	panic("DryRun gate failed: CreateFirewallRule called")
 }
@@ -686,3 +1545,333 @@ func (pc *PanicController) GetPolicyOrdering(ctx context.Context, site, srcZoneI
 func (pc *PanicController) SetPolicyOrdering(ctx context.Context, site, srcZoneID, dstZoneID string, ordering controller.PolicyOrdering) error {
 	return nil
 }
+
+// TestCheckCapabilities_ModeChangeTriggersReResolve verifies that when the
+// zone firewall appears between checks (e.g. a firmware upgrade), an auto-mode
+// site is switched to zone mode and the change is counted.
+func TestCheckCapabilities_ModeChangeTriggersReResolve(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if got := m.cachedMode(testSite); got != "legacy" {
+		t.Fatalf("initial mode: got %q, want legacy", got)
+	}
+
+	changedMetric := metrics.ControllerCapabilityChanged.WithLabelValues(testSite)
+	before := promtestutil.ToFloat64(changedMetric)
+
+	// No change yet: nothing is re-resolved.
+	changed, err := mgr.CheckCapabilities(ctx, []string{testSite})
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("unchanged check: got %v, %v; want no sites", changed, err)
+	}
+
+	ctrl.SetHasFeature(testSite, controller.FeatureZoneBasedFirewall, true)
+	// The first differing probe only arms the switch.
+	changed, err = mgr.CheckCapabilities(ctx, []string{testSite})
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("first differing check: got %v, %v; want no sites", changed, err)
+	}
+	if got := m.cachedMode(testSite); got != "legacy" {
+		t.Fatalf("mode after one probe: got %q, want legacy", got)
+	}
+	changed, err = mgr.CheckCapabilities(ctx, []string{testSite})
+	if err != nil {
+		t.Fatalf("CheckCapabilities: %v", err)
+	}
+	if len(changed) != 1 || changed[0] != testSite {
+		t.Fatalf("changed sites: got %v, want [%s]", changed, testSite)
+	}
+	if got := m.cachedMode(testSite); got != "zone" {
+		t.Errorf("mode after upgrade: got %q, want zone", got)
+	}
+	if got := promtestutil.ToFloat64(changedMetric) - before; got != 1 {
+		t.Errorf("controller_capability_changed_total delta: got %v, want 1", got)
+	}
+	if ctrl.Calls("InvalidateZoneCache") == 0 {
+		t.Error("expected the controller feature cache to be invalidated")
+	}
+}
+
+// TestCheckCapabilities_FlappingProbeIgnored verifies that a differing probe
+// followed by one agreeing with the current mode does not switch the site.
+func TestCheckCapabilities_FlappingProbeIgnored(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	for _, hasZone := range []bool{true, false, true} {
+		ctrl.SetHasFeature(testSite, controller.FeatureZoneBasedFirewall, hasZone)
+		if changed, err := mgr.CheckCapabilities(ctx, []string{testSite}); err != nil || len(changed) != 0 {
+			t.Fatalf("hasZone=%v: got %v, %v; want no sites", hasZone, changed, err)
+		}
+	}
+	if got := m.cachedMode(testSite); got != "legacy" {
+		t.Errorf("mode: got %q, want legacy", got)
+	}
+}
+
+// TestCheckCapabilities_OtherSitesUntouched verifies that switching one site
+// leaves the shard managers, and so the pending bans, of the others alone.
+func TestCheckCapabilities_OtherSitesUntouched(t *testing.T) {
+	const other = "other-site"
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite, other}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, other, "203.0.113.7", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	m.mu.RLock()
+	otherMgr := m.v4Mgrs[other]
+	m.mu.RUnlock()
+
+	ctrl.SetHasFeature(testSite, controller.FeatureZoneBasedFirewall, true)
+	for i := 0; i < 2; i++ {
+		if _, err := mgr.CheckCapabilities(ctx, []string{testSite, other}); err != nil {
+			t.Fatalf("CheckCapabilities: %v", err)
+		}
+	}
+	if got := m.cachedMode(testSite); got != "zone" {
+		t.Fatalf("mode: got %q, want zone", got)
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.v4Mgrs[other] != otherMgr {
+		t.Error("the other site's shard manager was rebuilt")
+	}
+	if !otherMgr.Contains("203.0.113.7") {
+		t.Error("the other site's pending ban was lost")
+	}
+}
+
+// TestCheckCapabilities_DetectionErrorKeepsMode verifies that a failed
+// detection does not flip a zone site back to legacy, and that explicitly
+// configured modes are never re-checked.
+func TestCheckCapabilities_DetectionErrorKeepsMode(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.FirewallMode = "auto"
+	cfg.ModeOverrides = map[string]string{"pinned": "legacy"}
+	cfg.ZoneCfg.ZonePairs = []config.ZonePair{{Src: "wan", Dst: "lan"}}
+
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	m := mgr.(*managerImpl)
+	ctx := context.Background()
+	ctrl.SetHasFeature(testSite, controller.FeatureZoneBasedFirewall, true)
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite, "pinned"}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+
+	calls := ctrl.Calls("HasFeature")
+	ctrl.SetError("HasFeature", errors.New("controller unreachable"))
+	changed, err := mgr.CheckCapabilities(ctx, []string{testSite, "pinned"})
+	if err != nil || len(changed) != 0 {
+		t.Fatalf("got %v, %v; want no sites changed", changed, err)
+	}
+	if got := m.cachedMode(testSite); got != "zone" {
+		t.Errorf("mode after failed detection: got %q, want zone", got)
+	}
+	if got := ctrl.Calls("HasFeature") - calls; got != 1 {
+		t.Errorf("HasFeature calls: got %d, want 1 (pinned site must be skipped)", got)
+	}
+}
+
+// TestShardCountMetric verifies that firewall_shard_count follows the number
+// of decision shards created in and pruned from UniFi.
+func TestShardCountMetric(t *testing.T) {
+	const site = "shard-count-site"
+	mgr, _, _ := newTestManager(t, defaultManagerConfig())
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{site}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	gauge := metrics.FirewallShardCount.WithLabelValues("v4", site)
+	if got := promtestutil.ToFloat64(gauge); got != 0 {
+		t.Fatalf("shard count before any ban = %v, want 0", got)
+	}
+
+	// Capacity is 5, so six bans need a second shard.
+	for i := 1; i <= 6; i++ {
+		if err := mgr.ApplyBan(ctx, site, fmt.Sprintf("10.0.0.%d", i), false); err != nil {
+			t.Fatalf("ApplyBan: %v", err)
+		}
+	}
+	if err := mgr.SyncDirty(ctx, []string{site}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := promtestutil.ToFloat64(gauge); got != 2 {
+		t.Fatalf("shard count after 6 bans = %v, want 2", got)
+	}
+
+	if err := mgr.ApplyUnban(ctx, site, "10.0.0.6", false); err != nil {
+		t.Fatalf("ApplyUnban: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{site}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+	if got := promtestutil.ToFloat64(gauge); got != 1 {
+		t.Errorf("shard count after the tail shard emptied = %v, want 1", got)
+	}
+}
+
+// TestEnsureNewShardInfrastructure_RetriesUnsettledGroup verifies that a rule
+// create refused with ErrNotFound, as when the controller has not finished
+// creating the group, is retried after NewShardSettle.
+func TestEnsureNewShardInfrastructure_RetriesUnsettledGroup(t *testing.T) {
+	cfg := defaultManagerConfig()
+	cfg.NewShardSettle = time.Millisecond
+	mgr, ctrl, _ := newTestManager(t, cfg)
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+
+	ctrl.SetError("CreateFirewallRule", &controller.ErrNotFound{URL: "/rest/firewallrule"})
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	if n := ctrl.Calls("CreateFirewallRule"); n != 2 {
+		t.Errorf("CreateFirewallRule calls = %d, want 2 (refused, then retried)", n)
+	}
+	rules, _ := ctrl.ListFirewallRules(ctx, testSite)
+	if len(rules) != 1 || rules[0].Name != "crowdsec-drop-v4-0" {
+		t.Errorf("rules = %+v, want crowdsec-drop-v4-0 created on retry", rules)
+	}
+}
+
+// TestEnsureNewShardInfrastructure_WaitsAPIShardDelay verifies that the
+// rule create of a new shard is paced by APIShardDelay.
+func TestEnsureNewShardInfrastructure_WaitsAPIShardDelay(t *testing.T) {
+	mgr, ctrl, _ := newTestManager(t, defaultManagerConfig())
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{testSite}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, testSite, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if err := mgr.SyncDirty(ctx, []string{testSite}); err != nil {
+		t.Fatalf("SyncDirty: %v", err)
+	}
+
+	m := mgr.(*managerImpl)
+	m.cfg.APIShardDelay = time.Hour
+	creates := ctrl.Calls("CreateFirewallRule")
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	err := m.ensureNewShardInfrastructure(canceled, testSite, false, 0, m.shardMgr(testSite, false))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled while waiting out the delay", err)
+	}
+	if n := ctrl.Calls("CreateFirewallRule") - creates; n != 0 {
+		t.Errorf("CreateFirewallRule calls = %d before the delay elapsed, want 0", n)
+	}
+}
+
+// TestBanApplyLatency verifies that a ban enqueued with WithBanEnqueued is
+// observed once, when the flush writes it, and not again on later flushes.
+func TestBanApplyLatency(t *testing.T) {
+	const site = "ban-latency-site"
+	mgr, _, _ := newTestManager(t, defaultManagerConfig())
+	ctx := context.Background()
+	if err := mgr.EnsureInfrastructure(ctx, []string{site}); err != nil {
+		t.Fatalf("EnsureInfrastructure: %v", err)
+	}
+	hist := metrics.BanApplyLatency.WithLabelValues("v4", site)
+
+	enqueued := WithBanEnqueued(ctx, time.Now().Add(-2*time.Second))
+	if err := mgr.ApplyBan(enqueued, site, "10.0.0.1", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	if err := mgr.ApplyBan(ctx, site, "10.0.0.2", false); err != nil {
+		t.Fatalf("ApplyBan: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := mgr.SyncDirty(ctx, []string{site}); err != nil {
+			t.Fatalf("SyncDirty: %v", err)
+		}
+	}
+
+	m := &dto.Metric{}
+	if err := hist.(prometheus.Metric).Write(m); err != nil {
+		t.Fatalf("write histogram: %v", err)
+	}
+	if got := m.GetHistogram().GetSampleCount(); got != 1 {
+		t.Errorf("sample count = %d, want 1", got)
+	}
+	if got := m.GetHistogram().GetSampleSum(); got < 2 {
+		t.Errorf("sample sum = %v, want >= 2s", got)
+	}
+}
+
+// TestPruneEmptyShards verifies that reconcile prunes an emptied tail shard and
+// counted by default, and kept when KeepEmptyShards is set.
+func TestPruneEmptyShards(t *testing.T) {
+	tests := []struct {
+		name       string
+		keep       bool
+		wantShards int
+		wantPruned float64
+	}{
+		{"prune", false, 1, 1},
+		{"keep", true, 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			site := "prune-site-" + tt.name
+			cfg := defaultManagerConfig()
+			cfg.KeepEmptyShards = tt.keep
+			cfg.ShardMergeThreshold = -1 // keep consolidation out of the way
+			mgr, ctrl, _ := newTestManager(t, cfg)
+			ctx := context.Background()
+			if err := mgr.EnsureInfrastructure(ctx, []string{site}); err != nil {
+				t.Fatalf("EnsureInfrastructure: %v", err)
+			}
+			// Capacity is 5, so six bans need a second shard.
+			for i := 1; i <= 6; i++ {
+				if err := mgr.ApplyBan(ctx, site, fmt.Sprintf("10.0.0.%d", i), false); err != nil {
+					t.Fatalf("ApplyBan: %v", err)
+				}
+			}
+			if err := mgr.SyncDirty(ctx, []string{site}); err != nil {
+				t.Fatalf("SyncDirty: %v", err)
+			}
+			// The store holds no bans, so reconcile empties both shards.
+			if _, err := mgr.Reconcile(ctx, []string{site}); err != nil {
+				t.Fatalf("Reconcile: %v", err)
+			}
+
+			groups, _ := ctrl.ListFirewallGroups(ctx, site)
+			if len(groups) != tt.wantShards {
+				t.Errorf("groups = %d, want %d", len(groups), tt.wantShards)
+			}
+			if got := promtestutil.ToFloat64(metrics.FirewallShardsPruned.WithLabelValues("v4", site)); got != tt.wantPruned {
+				t.Errorf("pruned = %v, want %v", got, tt.wantPruned)
+			}
+		})
+	}
+}
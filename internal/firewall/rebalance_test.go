@@ -203,3 +203,17 @@ func TestRebalance_NegativeThresholdDisables(t *testing.T) {
 		t.Errorf("shard0.IPs.Len() = %d; want 7 (unchanged)", got)
 	}
 }
+
+// TestShardGroups_KeepsIndexPastPendingShard verifies that a Pending shard
+// below an Active one does not shift the Active shard's reported index.
+func TestShardGroups_KeepsIndexPastPendingShard(t *testing.T) {
+	sm := newV4ShardManager(t, 10, testutil.NewMockController(), newBboltStore(t))
+	shard0 := makePendingShard(t, sm, 0, 0)
+	shard1 := makeActiveShard(t, sm, 1, 3)
+	setupShards(t, sm, []*Shard{shard0, shard1})
+
+	got := sm.shardGroups()
+	if len(got) != 1 || got[0].Index != 1 || got[0].ID != shard1.ID {
+		t.Errorf("shardGroups() = %+v, want only shard 1 (%s)", got, shard1.ID)
+	}
+}
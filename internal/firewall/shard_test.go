@@ -2,7 +2,10 @@ package firewall
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 
@@ -453,3 +456,211 @@ func TestSyncAllFamilies_ConcurrentWithAddIP(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestAdd_RejectsInvalidMember(t *testing.T) {
+	sm, _ := newShardTestManager(t, "legacy", 10)
+
+	for _, bad := range []string{"not-an-ip", "10.0.0.0/33", ""} {
+		if _, _, err := sm.Add(context.Background(), bad); err == nil {
+			t.Errorf("Add(%q): expected error", bad)
+		}
+	}
+	if got := len(familyState(t, sm).ipOwner); got != 0 {
+		t.Fatalf("ipOwner len = %d, want 0 after rejected adds", got)
+	}
+}
+
+func TestAdd_RejectsFamilyMismatch(t *testing.T) {
+	sm, _ := newShardTestManager(t, "legacy", 10)
+
+	_, _, err := sm.Add(context.Background(), "2001:db8::1")
+	var fm *ErrFamilyMismatch
+	if !errors.As(err, &fm) {
+		t.Fatalf("Add(v6 into v4 manager) err = %v, want *ErrFamilyMismatch", err)
+	}
+	if !fm.IPv6 || fm.IP != "2001:db8::1" {
+		t.Errorf("ErrFamilyMismatch = %+v, want IP 2001:db8::1 with IPv6=true", fm)
+	}
+	if got := len(familyState(t, sm).ipOwner); got != 0 {
+		t.Fatalf("ipOwner len = %d, want 0 after rejected add", got)
+	}
+
+	// IPv4-mapped IPv6 normalises to IPv4, so it belongs in the v4 manager.
+	if _, _, err := sm.Add(context.Background(), "::ffff:192.0.2.1"); err != nil {
+		t.Fatalf("Add(IPv4-mapped): %v", err)
+	}
+}
+
+func TestAdd_CIDRSubsumption_HostCoveredByRange(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{SubsumeOff, []string{"198.51.100.0/24", "198.51.100.7"}},
+		{SubsumeSkip, []string{"198.51.100.0/24"}},
+		{SubsumePrune, []string{"198.51.100.0/24"}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			sm, _ := newShardTestManager(t, "legacy", 10)
+			sm.SetCIDRSubsumption(tc.mode)
+
+			for _, ip := range []string{"198.51.100.0/24", "198.51.100.7"} {
+				if _, _, err := sm.Add(context.Background(), ip); err != nil {
+					t.Fatalf("Add(%q): %v", ip, err)
+				}
+			}
+			members := sm.AllMembers()
+			sort.Strings(members)
+			if strings.Join(members, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("AllMembers = %v, want %v", members, tc.want)
+			}
+			if !sm.Contains("198.51.100.7") {
+				t.Error("Contains(198.51.100.7) = false, want true")
+			}
+		})
+	}
+}
+
+func TestAdd_CIDRSubsumption_RangeCoversExistingHosts(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want []string
+	}{
+		{SubsumeSkip, []string{"198.51.100.0/24", "198.51.100.128/25", "198.51.100.7", "198.51.101.1"}},
+		{SubsumePrune, []string{"198.51.100.0/24", "198.51.101.1"}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			sm, _ := newShardTestManager(t, "legacy", 10)
+			sm.SetCIDRSubsumption(tc.mode)
+
+			for _, ip := range []string{"198.51.100.7", "198.51.100.128/25", "198.51.101.1", "198.51.100.0/24"} {
+				if _, _, err := sm.Add(context.Background(), ip); err != nil {
+					t.Fatalf("Add(%q): %v", ip, err)
+				}
+			}
+			members := sm.AllMembers()
+			sort.Strings(members)
+			if strings.Join(members, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("AllMembers = %v, want %v", members, tc.want)
+			}
+			if got := len(familyState(t, sm).ipOwner); got != len(tc.want) {
+				t.Errorf("ipOwner len = %d, want %d", got, len(tc.want))
+			}
+		})
+	}
+}
+
+func TestContains_CIDRMembers(t *testing.T) {
+	sm, _ := newShardTestManager(t, "legacy", 10)
+
+	if _, _, err := sm.Add(context.Background(), "198.51.100.0/24"); err != nil {
+		t.Fatalf("Add CIDR: %v", err)
+	}
+
+	cases := []struct {
+		query string
+		want  bool
+	}{
+		{"198.51.100.0/24", true},   // exact member
+		{"198.51.100.77", true},     // single IP inside the range
+		{"198.51.100.128/25", true}, // narrower range inside the member
+		{"198.51.101.1", false},     // outside the range
+		{"198.51.0.0/16", false},    // wider than the member
+		{"garbage", false},
+	}
+	for _, tc := range cases {
+		if got := sm.Contains(tc.query); got != tc.want {
+			t.Errorf("Contains(%q) = %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// Wire format is unchanged: the CIDR is stored verbatim.
+	members := sm.AllMembers()
+	if len(members) != 1 || members[0] != "198.51.100.0/24" {
+		t.Fatalf("AllMembers = %v, want [198.51.100.0/24]", members)
+	}
+
+	if _, err := sm.Remove(context.Background(), "198.51.100.0/24"); err != nil {
+		t.Fatalf("Remove CIDR: %v", err)
+	}
+	if sm.Contains("198.51.100.77") {
+		t.Error("Contains should be false after the covering range is removed")
+	}
+}
+
+func TestAdd_HostPrefixCollapsesToBareHost(t *testing.T) {
+	store := newShardTestStore(t)
+	sm := NewShardManager(testSite, true, 10, newShardTestNamer(t), testutil.NewMockController(),
+		store, zerolog.Nop(), 0, nil, false, "legacy")
+	if err := sm.EnsureShards(context.Background()); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+
+	for _, ip := range []string{"2001:db8::1", "2001:db8::1/128", "2001:DB8:0::1/128"} {
+		if _, _, err := sm.Add(context.Background(), ip); err != nil {
+			t.Fatalf("Add(%q): %v", ip, err)
+		}
+	}
+	members := sm.AllMembers()
+	if len(members) != 1 || members[0] != "2001:db8::1" {
+		t.Fatalf("AllMembers = %v, want [2001:db8::1]", members)
+	}
+	if !sm.Contains("2001:db8::1/128") {
+		t.Error("Contains(2001:db8::1/128) = false, want true")
+	}
+
+	if _, err := sm.Remove(context.Background(), "2001:db8::1/128"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if sm.Contains("2001:db8::1") {
+		t.Error("bare host still present after removing its /128 form")
+	}
+}
+
+func TestAdd_IPv4HostPrefixCollapses(t *testing.T) {
+	sm, _ := newShardTestManager(t, "legacy", 10)
+
+	for _, ip := range []string{"203.0.113.9/32", "203.0.113.9"} {
+		if _, _, err := sm.Add(context.Background(), ip); err != nil {
+			t.Fatalf("Add(%q): %v", ip, err)
+		}
+	}
+	if got := len(familyState(t, sm).ipOwner); got != 1 {
+		t.Fatalf("ipOwner len = %d, want 1", got)
+	}
+}
+
+func TestEnsureShards_CollapsesHostPrefixAliases(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := newShardTestStore(t)
+
+	const shardName = "crowdsec-block-v6-0"
+	const shardID = "grp-v6-0"
+	if err := store.SetGroup(shardName, storage.GroupRecord{UnifiID: shardID, Site: testSite, IPv6: true}); err != nil {
+		t.Fatalf("SetGroup: %v", err)
+	}
+	ctrl.SetGroups(testSite, []controller.FirewallGroup{{
+		ID:           shardID,
+		Name:         shardName,
+		GroupType:    "ipv6-address-group",
+		GroupMembers: []string{"2001:db8::1/128", "2001:db8::1", "2001:db8::2/128"},
+	}})
+
+	sm := NewShardManager(testSite, true, 10, newShardTestNamer(t), ctrl, store, zerolog.Nop(), 0, nil, false, "legacy")
+	if err := sm.EnsureShards(context.Background()); err != nil {
+		t.Fatalf("EnsureShards: %v", err)
+	}
+
+	family := familyState(t, sm)
+	if got := family.Shards[0].IPs.Len(); got != 2 {
+		t.Fatalf("shard len = %d, want 2 (members %v)", got, family.Shards[0].IPs.Members())
+	}
+	for _, ip := range []string{"2001:db8::1", "2001:db8::2"} {
+		if countIPAcrossShards(family, ip) != 1 {
+			t.Errorf("%s not stored exactly once as a bare host", ip)
+		}
+	}
+	if !family.Shards[0].IPs.IsDirty() {
+		t.Error("shard should be dirty so the canonical members are written back")
+	}
+}
@@ -0,0 +1,360 @@
+package firewall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+)
+
+// verifyMaxShardIndex bounds the shard indexes whose names Verify treats as
+// managed when looking for orphaned groups.
+const verifyMaxShardIndex = 1000
+
+// verifyExamples is how many IPs a ban coverage issue lists.
+const verifyExamples = 5
+
+// Verify issue kinds.
+const (
+	// VerifyStaleGroup: a cached group whose object is gone from the controller.
+	VerifyStaleGroup = "stale_group"
+	// VerifyStalePolicy: a cached rule or zone policy gone from the controller.
+	VerifyStalePolicy = "stale_policy"
+	// VerifyOrphanGroup: a controller object with a managed shard name but no
+	// cache record (or a record pointing at another ID).
+	VerifyOrphanGroup = "orphan_group"
+	// VerifyMemberDrift: cached members differ from the controller's.
+	VerifyMemberDrift = "member_drift"
+	// VerifyMissingBan: active bans not present in any shard.
+	VerifyMissingBan = "missing_ban"
+	// VerifyUnexpectedMember: shard members with no active ban.
+	VerifyUnexpectedMember = "unexpected_member"
+)
+
+// VerifyConfig holds what Verify needs to know about the deployment.
+type VerifyConfig struct {
+	Namer      *Namer
+	EnableIPv6 bool
+	Whitelist  []*net.IPNet // bans covered by BLOCK_WHITELIST are not expected in shards
+}
+
+// VerifyIssue is one discrepancy between the store and the controller.
+type VerifyIssue struct {
+	Site   string
+	Kind   string
+	Name   string
+	ID     string
+	Detail string
+}
+
+// VerifyReport is the outcome of Verify. Errors holds lookups that failed;
+// checks that depended on them were skipped.
+type VerifyReport struct {
+	Issues []VerifyIssue
+	Errors []error
+}
+
+// siteObjects is the controller's view of one site.
+type siteObjects struct {
+	groups   map[string]controller.FirewallGroup       // by ID
+	tmls     map[string]controller.TrafficMatchingList // by ID
+	rules    map[string]bool                           // rule IDs
+	policies map[string]bool                           // zone policy IDs
+}
+
+// Verify cross-checks the store's group and policy caches and its ban list
+// against the controller for each site. It only reads: ctrl is never asked
+// to change anything and the store is not written, so it is safe to run
+// beside a live bouncer or before a risky reconcile.
+func Verify(ctx context.Context, ctrl controller.Controller, store storage.Store, cfg VerifyConfig, sites []string) (*VerifyReport, error) {
+	groups, err := store.ListGroups()
+	if err != nil {
+		return nil, fmt.Errorf("list group records: %w", err)
+	}
+	policies, err := store.ListPolicies()
+	if err != nil {
+		return nil, fmt.Errorf("list policy records: %w", err)
+	}
+	bans, err := store.BanList()
+	if err != nil {
+		return nil, fmt.Errorf("list bans: %w", err)
+	}
+
+	report := &VerifyReport{}
+	now := time.Now()
+	for _, site := range sites {
+		objs := fetchSiteObjects(ctx, ctrl, site, report)
+		verifyGroups(site, objs, groups, report)
+		verifyPolicies(site, objs, policies, report)
+		verifyShards(site, objs, groups, bans, cfg, now, report)
+	}
+	return report, nil
+}
+
+// fetchSiteObjects lists the site's objects. A failed list is recorded in
+// report and leaves its map nil, which the checks treat as unknown.
+func fetchSiteObjects(ctx context.Context, ctrl controller.Controller, site string, report *VerifyReport) siteObjects {
+	var objs siteObjects
+	if list, err := ctrl.ListFirewallGroups(ctx, site); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("site %s: list firewall groups: %w", site, err))
+	} else {
+		objs.groups = make(map[string]controller.FirewallGroup, len(list))
+		for _, g := range list {
+			objs.groups[g.ID] = g
+		}
+	}
+	if list, err := ctrl.ListTrafficMatchingLists(ctx, site); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("site %s: list traffic matching lists: %w", site, err))
+	} else {
+		objs.tmls = make(map[string]controller.TrafficMatchingList, len(list))
+		for _, t := range list {
+			objs.tmls[t.ID] = t
+		}
+	}
+	if list, err := ctrl.ListFirewallRules(ctx, site); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("site %s: list firewall rules: %w", site, err))
+	} else {
+		objs.rules = make(map[string]bool, len(list))
+		for _, r := range list {
+			objs.rules[r.ID] = true
+		}
+	}
+	if list, err := ctrl.ListZonePolicies(ctx, site); err != nil {
+		report.Errors = append(report.Errors, fmt.Errorf("site %s: list zone policies: %w", site, err))
+	} else {
+		objs.policies = make(map[string]bool, len(list))
+		for _, p := range list {
+			objs.policies[p.ID] = true
+		}
+	}
+	return objs
+}
+
+// members returns the non-placeholder members of the group or list with id,
+// and whether the controller has it.
+func (o siteObjects) members(id string) ([]string, bool) {
+	var raw []string
+	if g, ok := o.groups[id]; ok {
+		raw = g.GroupMembers
+	} else if t, ok := o.tmls[id]; ok {
+		for _, item := range t.Items {
+			raw = append(raw, item.Value)
+		}
+	} else {
+		return nil, false
+	}
+	out := make([]string, 0, len(raw))
+	for _, m := range raw {
+		if m != TMLPlaceholderV4 && m != TMLPlaceholderV6 {
+			out = append(out, m)
+		}
+	}
+	return out, true
+}
+
+// verifyGroups reports cached groups of site whose object is gone. It needs
+// both group and list lookups, since a record does not say which it is.
+func verifyGroups(site string, objs siteObjects, groups map[string]storage.GroupRecord, report *VerifyReport) {
+	if objs.groups == nil || objs.tmls == nil {
+		return
+	}
+	for _, name := range sortedKeys(groups) {
+		rec := groups[name]
+		if rec.Site != site || rec.UnifiID == "" {
+			continue
+		}
+		if _, ok := objs.members(rec.UnifiID); !ok {
+			report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyStaleGroup, Name: name, ID: rec.UnifiID,
+				Detail: "cached group not found on the controller"})
+		}
+	}
+}
+
+// verifyPolicies reports cached rules and zone policies of site whose object
+// is gone.
+func verifyPolicies(site string, objs siteObjects, policies map[string]storage.PolicyRecord, report *VerifyReport) {
+	for _, name := range sortedKeys(policies) {
+		rec := policies[name]
+		if rec.Site != site || rec.UnifiID == "" {
+			continue
+		}
+		known := objs.policies
+		kind := "zone policy"
+		if strings.HasSuffix(rec.Mode, "legacy") {
+			known, kind = objs.rules, "firewall rule"
+		}
+		if known == nil || known[rec.UnifiID] {
+			continue
+		}
+		report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyStalePolicy, Name: name, ID: rec.UnifiID,
+			Detail: "cached " + kind + " not found on the controller"})
+	}
+}
+
+// verifyShards checks the site's shard groups: orphans, cache member drift,
+// and whether the shards hold exactly the active bans.
+func verifyShards(site string, objs siteObjects, groups map[string]storage.GroupRecord,
+	bans map[string]storage.BanEntry, cfg VerifyConfig, now time.Time, report *VerifyReport) {
+	if objs.groups == nil || objs.tmls == nil {
+		return
+	}
+
+	families := []bool{false}
+	if cfg.EnableIPv6 {
+		families = append(families, true)
+	}
+	for _, ipv6 := range families {
+		family := Family(ipv6)
+		shardNames := make(map[string]bool)
+		for idx := 0; idx < verifyMaxShardIndex; idx++ {
+			name, err := cfg.Namer.GroupName(NameData{Family: family, Index: idx, Site: site})
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Errorf("site %s: render group name: %w", site, err))
+				return
+			}
+			shardNames[name] = true
+		}
+
+		// Collect the members of every shard the controller has, flagging
+		// shards the store does not know.
+		inShards := make(map[string]bool)
+		var shardCIDRs []*net.IPNet
+		for _, obj := range objs.named() {
+			if !shardNames[obj.name] {
+				continue
+			}
+			members, _ := objs.members(obj.id)
+			for _, m := range members {
+				inShards[m] = true
+				if _, n, err := net.ParseCIDR(m); err == nil {
+					shardCIDRs = append(shardCIDRs, n)
+				}
+			}
+			rec, ok := groups[obj.name]
+			switch {
+			case !ok || rec.Site != site || rec.UnifiID != obj.id:
+				report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyOrphanGroup, Name: obj.name, ID: obj.id,
+					Detail: "managed shard on the controller has no cache record"})
+			case !sameMembers(rec.Members, members):
+				report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyMemberDrift, Name: obj.name, ID: obj.id,
+					Detail: fmt.Sprintf("cache has %d members, controller has %d", len(rec.Members), len(members))})
+			}
+		}
+
+		var missing []string
+		for ip, entry := range bans {
+			if entry.IPv6 != ipv6 || (!entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now)) {
+				continue
+			}
+			if inShards[ip] || coveredBy(ip, shardCIDRs) || coveredBy(ip, cfg.Whitelist) {
+				continue
+			}
+			missing = append(missing, ip)
+		}
+		if len(missing) > 0 {
+			report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyMissingBan, Name: family,
+				Detail: fmt.Sprintf("%d active bans not in any shard: %s", len(missing), examples(missing))})
+		}
+
+		var unexpected []string
+		for m := range inShards {
+			if _, ok := bans[m]; !ok && !coversBan(m, bans) {
+				unexpected = append(unexpected, m)
+			}
+		}
+		if len(unexpected) > 0 {
+			report.Issues = append(report.Issues, VerifyIssue{Site: site, Kind: VerifyUnexpectedMember, Name: family,
+				Detail: fmt.Sprintf("%d shard members without a ban: %s", len(unexpected), examples(unexpected))})
+		}
+	}
+}
+
+type namedObject struct{ name, id string }
+
+// named returns the site's groups and lists, ordered by name.
+func (o siteObjects) named() []namedObject {
+	out := make([]namedObject, 0, len(o.groups)+len(o.tmls))
+	for id, g := range o.groups {
+		out = append(out, namedObject{name: g.Name, id: id})
+	}
+	for id, t := range o.tmls {
+		out = append(out, namedObject{name: t.Name, id: id})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// sameMembers reports whether a and b hold the same members in any order.
+func sameMembers(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, m := range a {
+		set[m] = true
+	}
+	for _, m := range b {
+		if !set[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// coveredBy reports whether the address or prefix s lies inside one of nets.
+func coveredBy(s string, nets []*net.IPNet) bool {
+	if len(nets) == 0 {
+		return false
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(s); err != nil {
+			return false
+		}
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// coversBan reports whether member is a prefix holding at least one ban, as
+// CIDR aggregation and subsumption write.
+func coversBan(member string, bans map[string]storage.BanEntry) bool {
+	_, n, err := net.ParseCIDR(member)
+	if err != nil {
+		return false
+	}
+	for ip := range bans {
+		if coveredBy(ip, []*net.IPNet{n}) {
+			return true
+		}
+	}
+	return false
+}
+
+// examples lists the first verifyExamples of ips in sorted order.
+func examples(ips []string) string {
+	sort.Strings(ips)
+	if len(ips) > verifyExamples {
+		return strings.Join(ips[:verifyExamples], ", ") + ", …"
+	}
+	return strings.Join(ips, ", ")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
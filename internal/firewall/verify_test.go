@@ -0,0 +1,102 @@
+package firewall
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/controller"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/storage"
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/testutil"
+)
+
+// TestVerify_ReportsDiscrepancies verifies each kind of issue Verify reports
+// and that it makes no write calls.
+func TestVerify_ReportsDiscrepancies(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	future := time.Now().Add(time.Hour)
+
+	ctrl.SetGroups(testSite, []controller.FirewallGroup{
+		{ID: "g0", Name: "crowdsec-block-v4-0", GroupMembers: []string{"192.0.2.10", "192.0.2.99"}},
+		{ID: "g1", Name: "crowdsec-block-v4-1", GroupMembers: []string{"198.51.100.0/24"}},
+		{ID: "other", Name: "office-allow", GroupMembers: []string{"203.0.113.1"}},
+	})
+	ctrl.SetRules(testSite, []controller.FirewallRule{{ID: "r0", Name: "crowdsec-drop-v4-0"}})
+
+	_ = store.SetGroup("crowdsec-block-v4-0", storage.GroupRecord{UnifiID: "g0", Site: testSite, Members: []string{"192.0.2.10"}})
+	_ = store.SetGroup("crowdsec-block-v4-2", storage.GroupRecord{UnifiID: "gone", Site: testSite})
+	_ = store.SetPolicy("crowdsec-drop-v4-0", storage.PolicyRecord{UnifiID: "r0", Site: testSite, Mode: "legacy"})
+	_ = store.SetPolicy("crowdsec-drop-v4-2", storage.PolicyRecord{UnifiID: "r-gone", Site: testSite, Mode: "legacy"})
+	for _, ip := range []string{"192.0.2.10", "198.51.100.7", "192.0.2.50"} {
+		_ = store.BanRecord(ip, future, false)
+	}
+	_ = store.BanRecord("192.0.2.60", time.Now().Add(-time.Hour), false) // expired, not expected
+
+	report, err := Verify(context.Background(), controller.NewReadOnlyController(ctrl), store,
+		VerifyConfig{Namer: testNamer(t)}, []string{testSite})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(report.Errors) != 0 {
+		t.Fatalf("Errors = %v", report.Errors)
+	}
+
+	got := make(map[string]VerifyIssue)
+	for _, issue := range report.Issues {
+		if _, dup := got[issue.Kind]; dup {
+			t.Errorf("more than one %s issue: %+v", issue.Kind, report.Issues)
+		}
+		got[issue.Kind] = issue
+	}
+	want := map[string]string{
+		VerifyStaleGroup:       "crowdsec-block-v4-2",
+		VerifyStalePolicy:      "crowdsec-drop-v4-2",
+		VerifyOrphanGroup:      "crowdsec-block-v4-1",
+		VerifyMemberDrift:      "crowdsec-block-v4-0",
+		VerifyMissingBan:       "v4",
+		VerifyUnexpectedMember: "v4",
+	}
+	if len(got) != len(want) {
+		t.Errorf("issues = %+v, want one of each of %v", report.Issues, want)
+	}
+	for kind, name := range want {
+		if got[kind].Name != name {
+			t.Errorf("%s issue = %+v, want name %q", kind, got[kind], name)
+		}
+	}
+	if d := got[VerifyMissingBan].Detail; d != "1 active bans not in any shard: 192.0.2.50" {
+		t.Errorf("missing_ban detail = %q", d)
+	}
+	if d := got[VerifyUnexpectedMember].Detail; d != "1 shard members without a ban: 192.0.2.99" {
+		t.Errorf("unexpected_member detail = %q", d)
+	}
+
+	for _, method := range []string{"CreateFirewallGroup", "UpdateFirewallGroup", "DeleteFirewallGroup",
+		"CreateFirewallRule", "UpdateFirewallRule", "DeleteFirewallRule"} {
+		if n := ctrl.Calls(method); n != 0 {
+			t.Errorf("%s called %d times", method, n)
+		}
+	}
+}
+
+// TestVerify_SkipsChecksOnListError verifies that a failed lookup is reported
+// and does not turn every cached record into a false stale issue.
+func TestVerify_SkipsChecksOnListError(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	_ = store.SetGroup("crowdsec-block-v4-0", storage.GroupRecord{UnifiID: "g0", Site: testSite})
+	ctrl.SetError("ListTrafficMatchingLists", errors.New("404"))
+
+	report, err := Verify(context.Background(), ctrl, store, VerifyConfig{Namer: testNamer(t)}, []string{testSite})
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if len(report.Errors) != 1 {
+		t.Errorf("Errors = %v, want the failed list", report.Errors)
+	}
+	if len(report.Issues) != 0 {
+		t.Errorf("Issues = %+v, want none when groups cannot be checked", report.Issues)
+	}
+}
@@ -4,9 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
@@ -21,6 +23,23 @@ type ZoneConfig struct {
 	Description string
 	LogDrops    bool
 	APIWriteDelay time.Duration
+
+	// BlockAction is FIREWALL_BLOCK_ACTION: "drop" maps to the BLOCK policy
+	// action and "reject" to REJECT, falling back to BLOCK on controllers
+	// that refuse it.
+	BlockAction string
+
+	// CreateDisabled creates new policies disabled (ZONE_POLICY_ENABLED=false
+	// or FIREWALL_START_DISABLED=true) until EnablePolicies is called.
+	// EnforceEnabled lets drift repair reset managed policies whose enabled
+	// state differs; otherwise a policy disabled by an operator is left alone.
+	CreateDisabled bool
+	EnforceEnabled bool
+
+	// RecordMode tags the policy records this manager owns in the store, so
+	// that two managers on one site only ever touch their own policies.
+	// Empty = "zone".
+	RecordMode string
 }
 
 // portTMLIDs holds port TML IDs for a single zone pair (src and dst directions).
@@ -40,11 +59,70 @@ type ZoneManager struct {
 	mu           sync.RWMutex
 	zoneCache    map[string]map[string]string      // site -> zone name -> zone ID
 	portTMLCache map[string]map[string]portTMLIDs  // site -> "SrcName:DstName" -> port TML IDs
+
+	// noReject records sites whose controller refused the REJECT action.
+	noReject map[string]bool
+
+	// enabled is set by EnablePolicies and overrides CreateDisabled.
+	enabled atomic.Bool
 }
 
 // NewZoneManager constructs a ZoneManager.
 func NewZoneManager(cfg ZoneConfig, namer *Namer, ctrl controller.Controller, store storage.Store, log zerolog.Logger) *ZoneManager {
-	return &ZoneManager{cfg: cfg, namer: namer, ctrl: ctrl, store: store, log: log}
+	return &ZoneManager{cfg: cfg, namer: namer, ctrl: ctrl, store: store, log: log,
+		noReject: make(map[string]bool)}
+}
+
+// recordMode returns the Mode stored on this manager's policy records.
+func (zm *ZoneManager) recordMode() string {
+	if zm.cfg.RecordMode == "" {
+		return "zone"
+	}
+	return zm.cfg.RecordMode
+}
+
+// createDisabled reports whether new policies are created disabled.
+func (zm *ZoneManager) createDisabled() bool {
+	return zm.cfg.CreateDisabled && !zm.enabled.Load()
+}
+
+// EnablePolicies enables every managed policy of site that is disabled on
+// the controller and makes policies created from now on start enabled. It
+// returns the number of policies changed.
+func (zm *ZoneManager) EnablePolicies(ctx context.Context, site string) (int, error) {
+	zm.enabled.Store(true)
+	records, err := zm.store.ListPolicies()
+	if err != nil {
+		return 0, fmt.Errorf("list policy records: %w", err)
+	}
+	managed := make(map[string]string, len(records))
+	for name, rec := range records {
+		if rec.Site == site && rec.Mode == zm.recordMode() && rec.UnifiID != "" {
+			managed[rec.UnifiID] = name
+		}
+	}
+	if len(managed) == 0 {
+		return 0, nil
+	}
+
+	policies, err := zm.ctrl.ListZonePolicies(ctx, site)
+	if err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, p := range policies {
+		name, ok := managed[p.ID]
+		if !ok || p.Enabled {
+			continue
+		}
+		p.Enabled = true
+		if err := zm.ctrl.UpdateZonePolicy(ctx, site, p); err != nil {
+			return changed, fmt.Errorf("enable zone policy %s: %w", name, err)
+		}
+		changed++
+		zm.log.Info().Str("policy", name).Str("id", p.ID).Msg("enabled zone policy")
+	}
+	return changed, nil
 }
 
 // Bootstrap performs fail-fast startup discovery for all configured sites:
@@ -66,7 +144,7 @@ func (zm *ZoneManager) Bootstrap(ctx context.Context, sites []string) error {
 		zm.log.Info().Str("site", site).Int("zone_count", len(zones)).Msg("zone discovery complete")
 
 		// Emit per-zone debug log when log level is DEBUG.
-		if zm.log.GetLevel() <= zerolog.DebugLevel {
+		if zm.log.GetLevel() <= zerolog.DebugLevel && zerolog.GlobalLevel() <= zerolog.DebugLevel {
 			for _, z := range zones {
 				zm.log.Debug().
 					Str("site", site).
@@ -332,7 +410,6 @@ func (zm *ZoneManager) EnsurePolicies(ctx context.Context, site string, v4Shards
 	}
 
 	for _, pair := range zm.cfg.ZonePairs {
-		// ConnectionStateFilter = nil means "All" states in UniFi API.
 		if err := zm.ensurePoliciesForPair(ctx, site, pair, zoneMap, existingByID, false, v4Shards); err != nil {
 			return err
 		}
@@ -393,7 +470,9 @@ func (zm *ZoneManager) ensurePoliciesForPair(ctx context.Context, site string, p
 		// Check if policy exists in API and needs update (reconcile mode)
 		if existing != nil && existing.UnifiID != "" {
 			if apiPolicy, found := existingByID[existing.UnifiID]; found {
-				if needsUpdateZonePolicy(&apiPolicy, groupID, srcPortTMLID, dstPortTMLID) {
+				enabledDrift := zm.cfg.EnforceEnabled && apiPolicy.Enabled == zm.createDisabled()
+				if enabledDrift || apiPolicy.LoggingEnabled != zm.cfg.LogDrops ||
+					needsUpdateZonePolicy(&apiPolicy, zm.policyAction(site), groupID, srcPortTMLID, dstPortTMLID, pair.ConnectionStates) {
 					zm.log.Info().Str("policy", policyName).Msg("zone policy needs update, applying reconcile")
 
 					// If portFilter is the reason for the update, the UniFi PUT endpoint
@@ -413,7 +492,7 @@ func (zm *ZoneManager) ensurePoliciesForPair(ctx context.Context, site string, p
 						_ = zm.store.DeletePolicy(policyName)
 						// Fall through to creation below.
 					} else {
-						updateErr := zm.updateZonePolicy(ctx, site, apiPolicy, groupID, srcPortTMLID, dstPortTMLID)
+						updateErr := zm.updateZonePolicy(ctx, site, apiPolicy, groupID, srcPortTMLID, dstPortTMLID, pair.ConnectionStates)
 						if updateErr != nil {
 							var nf *controller.ErrNotFound
 							if !errors.As(updateErr, &nf) {
@@ -446,33 +525,32 @@ func (zm *ZoneManager) ensurePoliciesForPair(ctx context.Context, site string, p
 		firstCreate = false
 
 		// groupID is the TML UUID in zone mode (integration v1).
-		// ConnectionStateFilter = nil means "All" states in UniFi API.
 		if groupID == "" {
 			return fmt.Errorf("shard %d for %s->%s has empty TML ID — cannot create block policy without source filter", i, pair.Src, pair.Dst)
 		}
 		policy := controller.ZonePolicy{
 			Name:                   policyName,
-			Enabled:                true,
-			Action:                 "BLOCK",
+			Enabled:                !zm.createDisabled(),
+			Action:                 zm.policyAction(site),
 			Description:            zm.cfg.Description,
 			SrcZone:                srcZoneID,
 			DstZone:                dstZoneID,
 			IPVersion:              ipVersion,
 			TrafficMatchingListIDs: []string{groupID},
-			ConnectionStateFilter:  nil, // nil = All connection states
+			ConnectionStateFilter:  connectionStateFilter(pair),
 			LoggingEnabled:         zm.cfg.LogDrops,
 			SrcPortTMLID:           srcPortTMLID,
 			DstPortTMLID:           dstPortTMLID,
 		}
 
-		created, err := zm.ctrl.CreateZonePolicy(ctx, site, policy)
+		created, err := zm.createZonePolicy(ctx, site, policy)
 		if err != nil {
 			var conflict *controller.ErrConflict
 			if errors.As(err, &conflict) {
 				if id := zm.findExistingPolicyByName(ctx, site, policyName); id != "" {
 					zm.log.Warn().Str("policy", policyName).Str("id", id).
 						Msg("zone policy already exists (409 conflict); recovering existing ID")
-					if storeErr := zm.store.SetPolicy(policyName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: "zone"}); storeErr != nil {
+					if storeErr := zm.store.SetPolicy(policyName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: zm.recordMode()}); storeErr != nil {
 						zm.log.Warn().Err(storeErr).Str("policy", policyName).Msg("failed to cache recovered policy in bbolt")
 					}
 					existingByID[id] = controller.ZonePolicy{ID: id}
@@ -486,7 +564,7 @@ func (zm *ZoneManager) ensurePoliciesForPair(ctx context.Context, site string, p
 		if err := zm.store.SetPolicy(policyName, storage.PolicyRecord{
 			UnifiID: created.ID,
 			Site:    site,
-			Mode:    "zone",
+			Mode:    zm.recordMode(),
 		}); err != nil {
 			zm.log.Warn().Err(err).Str("policy", policyName).Msg("failed to cache policy in bbolt")
 		}
@@ -572,27 +650,27 @@ func (zm *ZoneManager) EnsurePoliciesForShard(ctx context.Context, site, groupID
 		}
 		policy := controller.ZonePolicy{
 			Name:                   policyName,
-			Enabled:                true,
-			Action:                 "BLOCK",
+			Enabled:                !zm.createDisabled(),
+			Action:                 zm.policyAction(site),
 			Description:            zm.cfg.Description,
 			SrcZone:                srcZoneID,
 			DstZone:                dstZoneID,
 			IPVersion:              ipVersion,
 			TrafficMatchingListIDs: []string{groupID},
-			ConnectionStateFilter:  nil, // nil = All connection states
+			ConnectionStateFilter:  connectionStateFilter(pair),
 			LoggingEnabled:         zm.cfg.LogDrops,
 			SrcPortTMLID:           srcPortTMLID,
 			DstPortTMLID:           dstPortTMLID,
 		}
 
-		created, err := zm.ctrl.CreateZonePolicy(ctx, site, policy)
+		created, err := zm.createZonePolicy(ctx, site, policy)
 		if err != nil {
 			var conflict *controller.ErrConflict
 			if errors.As(err, &conflict) {
 				if id := zm.findExistingPolicyByName(ctx, site, policyName); id != "" {
 					zm.log.Warn().Str("policy", policyName).Str("id", id).
 						Msg("zone policy already exists (409 conflict); recovering existing ID")
-					if storeErr := zm.store.SetPolicy(policyName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: "zone"}); storeErr != nil {
+					if storeErr := zm.store.SetPolicy(policyName, storage.PolicyRecord{UnifiID: id, Site: site, Mode: zm.recordMode()}); storeErr != nil {
 						zm.log.Warn().Err(storeErr).Str("policy", policyName).Msg("failed to cache recovered policy in bbolt")
 					}
 					continue
@@ -604,7 +682,7 @@ func (zm *ZoneManager) EnsurePoliciesForShard(ctx context.Context, site, groupID
 		if err := zm.store.SetPolicy(policyName, storage.PolicyRecord{
 			UnifiID: created.ID,
 			Site:    site,
-			Mode:    "zone",
+			Mode:    zm.recordMode(),
 		}); err != nil {
 			zm.log.Warn().Err(err).Str("policy", policyName).Msg("failed to cache policy in bbolt")
 		}
@@ -673,7 +751,7 @@ func (zm *ZoneManager) cleanupOrphanedBlockPolicies(ctx context.Context, site st
 		return
 	}
 	for name, rec := range allBbolt {
-		if rec.Site != site || rec.Mode != "zone" {
+		if rec.Site != site || rec.Mode != zm.recordMode() {
 			continue
 		}
 		if expectedNames[name] {
@@ -696,10 +774,15 @@ func (zm *ZoneManager) cleanupOrphanedBlockPolicies(ctx context.Context, site st
 }
 
 // DeletePoliciesForShard deletes all zone policies for the given shard across all zone pairs.
-// Called during shard pruning.
+// Called during shard pruning. A policy already removed from the controller
+// (e.g. deleted by hand) only has its bbolt record cleaned up.
 func (zm *ZoneManager) DeletePoliciesForShard(ctx context.Context, site string, ipv6 bool, shardIdx int) error {
 	family := Family(ipv6)
 
+	// live holds the IDs of the site's zone policies; listed on first use so
+	// a shard without policy records costs no API call.
+	var live map[string]bool
+
 	for _, pair := range zm.cfg.ZonePairs {
 		policyName, err := zm.namer.PolicyName(NameData{
 			Family:  family,
@@ -721,15 +804,39 @@ func (zm *ZoneManager) DeletePoliciesForShard(ctx context.Context, site string,
 			continue // Already gone
 		}
 
-		if err := zm.ctrl.DeleteZonePolicy(ctx, site, existing.UnifiID); err != nil {
-			return fmt.Errorf("delete zone policy %s: %w", policyName, err)
+		if live == nil {
+			policies, err := zm.ctrl.ListZonePolicies(ctx, site)
+			if err != nil {
+				return fmt.Errorf("list zone policies: %w", err)
+			}
+			live = make(map[string]bool, len(policies))
+			for _, p := range policies {
+				live[p.ID] = true
+			}
+		}
+
+		deleted := false
+		if live[existing.UnifiID] {
+			if err := zm.ctrl.DeleteZonePolicy(ctx, site, existing.UnifiID); err != nil {
+				var notFound *controller.ErrNotFound
+				if !errors.As(err, &notFound) {
+					return fmt.Errorf("delete zone policy %s: %w", policyName, err)
+				}
+			} else {
+				deleted = true
+			}
 		}
 
 		if err := zm.store.DeletePolicy(policyName); err != nil {
 			zm.log.Warn().Err(err).Str("policy", policyName).Msg("failed to delete policy from bbolt")
 		}
 
-		zm.log.Info().Str("name", policyName).Msg("deleted zone policy for pruned shard")
+		if deleted {
+			zm.log.Info().Str("name", policyName).Msg("deleted zone policy for pruned shard")
+		} else {
+			zm.log.Debug().Str("name", policyName).Str("id", existing.UnifiID).
+				Msg("zone policy for pruned shard already gone from the controller; removed its record")
+		}
 	}
 	return nil
 }
@@ -741,12 +848,16 @@ func (zm *ZoneManager) DeletePolicies(ctx context.Context, site string) error {
 		return err
 	}
 	for name, rec := range policies {
-		if rec.Site != site || rec.Mode != "zone" {
+		if rec.Site != site || rec.Mode != zm.recordMode() {
 			continue
 		}
 		if err := zm.ctrl.DeleteZonePolicy(ctx, site, rec.UnifiID); err != nil {
-			zm.log.Warn().Err(err).Str("policy", name).Msg("failed to delete zone policy")
-			continue
+			// A policy already gone from the controller only needs its record removed.
+			var notFound *controller.ErrNotFound
+			if !errors.As(err, &notFound) {
+				zm.log.Warn().Err(err).Str("policy", name).Msg("failed to delete zone policy")
+				continue
+			}
 		}
 		if err := zm.store.DeletePolicy(name); err != nil {
 			zm.log.Warn().Err(err).Str("policy", name).Msg("failed to delete policy from bbolt")
@@ -778,14 +889,29 @@ func (zm *ZoneManager) UpdateGroupReference(ctx context.Context, site, oldGroupI
 	return nil
 }
 
+// connectionStateFilter returns the ConnectionStateFilter for pair's block
+// policies: nil ("All" in the UniFi UI) unless the pair lists states.
+func connectionStateFilter(pair config.ZonePair) []string {
+	if len(pair.ConnectionStates) == 0 {
+		return nil
+	}
+	return slices.Clone(pair.ConnectionStates)
+}
+
 // needsUpdateZonePolicy returns true if the policy needs to be updated to match the desired state.
 // It checks:
-// 1. ConnectionStateFilter is not nil (UniFi API will show "Custom" instead of "All")
+// 1. ConnectionStateFilter differs from desiredStates (nil when none, or the UniFi UI shows "Custom" instead of "All")
 // 2. TrafficMatchingListIDs is empty or has the wrong IP TML ID
 // 3. SrcPortTMLID or DstPortTMLID differ from desired
-func needsUpdateZonePolicy(policy *controller.ZonePolicy, desiredTMLID, desiredSrcPortTMLID, desiredDstPortTMLID string) bool {
-	// ConnectionStateFilter should be nil for "All" states
-	if policy.ConnectionStateFilter != nil {
+func needsUpdateZonePolicy(policy *controller.ZonePolicy, desiredAction, desiredTMLID, desiredSrcPortTMLID, desiredDstPortTMLID string, desiredStates []string) bool {
+	if len(desiredStates) == 0 {
+		if policy.ConnectionStateFilter != nil {
+			return true
+		}
+	} else if !sameConnectionStates(policy.ConnectionStateFilter, desiredStates) {
+		return true
+	}
+	if policy.Action != desiredAction {
 		return true
 	}
 	// TrafficMatchingListIDs should have exactly one entry with the desired TML ID
@@ -801,14 +927,102 @@ func needsUpdateZonePolicy(policy *controller.ZonePolicy, desiredTMLID, desiredS
 	return false
 }
 
+// sameConnectionStates reports whether got and want name the same states,
+// ignoring order and case.
+func sameConnectionStates(got, want []string) bool {
+	norm := func(states []string) []string {
+		out := make([]string, len(states))
+		for i, st := range states {
+			out[i] = strings.ToUpper(st)
+		}
+		slices.Sort(out)
+		return slices.Compact(out)
+	}
+	return slices.Equal(norm(got), norm(want))
+}
+
 // updateZonePolicy updates an existing zone policy with the correct settings.
-func (zm *ZoneManager) updateZonePolicy(ctx context.Context, site string, policy controller.ZonePolicy, newGroupID, srcPortTMLID, dstPortTMLID string) error {
+// states is the pair's connection state list; empty means all states.
+func (zm *ZoneManager) updateZonePolicy(ctx context.Context, site string, policy controller.ZonePolicy, newGroupID, srcPortTMLID, dstPortTMLID string, states []string) error {
 	policy.TrafficMatchingListIDs = []string{newGroupID}
 	policy.ConnectionStateFilter = nil
+	if len(states) > 0 {
+		policy.ConnectionStateFilter = slices.Clone(states)
+	}
 	policy.LoggingEnabled = zm.cfg.LogDrops
 	policy.SrcPortTMLID = srcPortTMLID
 	policy.DstPortTMLID = dstPortTMLID
-	return zm.ctrl.UpdateZonePolicy(ctx, site, policy)
+	policy.Action = zm.policyAction(site)
+	if zm.cfg.EnforceEnabled {
+		policy.Enabled = !zm.createDisabled()
+	}
+	err := zm.ctrl.UpdateZonePolicy(ctx, site, policy)
+	if zm.rejectRefused(site, policy.Action, err) {
+		policy.Action = "BLOCK"
+		err = zm.ctrl.UpdateZonePolicy(ctx, site, policy)
+	}
+	return err
+}
+
+// createZonePolicy creates policy, retrying with BLOCK if the controller
+// refuses the REJECT action.
+func (zm *ZoneManager) createZonePolicy(ctx context.Context, site string, policy controller.ZonePolicy) (controller.ZonePolicy, error) {
+	created, err := zm.ctrl.CreateZonePolicy(ctx, site, policy)
+	if zm.rejectRefused(site, policy.Action, err) {
+		policy.Action = "BLOCK"
+		created, err = zm.ctrl.CreateZonePolicy(ctx, site, policy)
+	}
+	return created, err
+}
+
+// policyAction returns the zone-policy action for FIREWALL_BLOCK_ACTION on site.
+func (zm *ZoneManager) policyAction(site string) string {
+	if zm.cfg.BlockAction != "reject" {
+		return "BLOCK"
+	}
+	zm.mu.RLock()
+	defer zm.mu.RUnlock()
+	if zm.noReject[site] {
+		return "BLOCK"
+	}
+	return "REJECT"
+}
+
+// invalidActionHints are fragments of a 400 response body that, next to the
+// word "action", identify the controller refusing the policy's action rather
+// than some other field.
+var invalidActionHints = []string{"invalid", "unsupported", "not supported", "must be one of"}
+
+// invalidActionError reports whether a 400 response body msg names the
+// policy action as the invalid field.
+func invalidActionError(msg string) bool {
+	msg = strings.ToLower(msg)
+	if !strings.Contains(msg, "action") {
+		return false
+	}
+	for _, hint := range invalidActionHints {
+		if strings.Contains(msg, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectRefused reports whether err is the controller refusing a REJECT
+// policy because of its action. If so it logs a warning and pins site to
+// BLOCK for later writes. Any other 400 is left to the caller, so an
+// unrelated validation error does not silently downgrade the site.
+func (zm *ZoneManager) rejectRefused(site, action string, err error) bool {
+	var badReq *controller.ErrBadRequest
+	if action != "REJECT" || !errors.As(err, &badReq) || !invalidActionError(badReq.Msg) {
+		return false
+	}
+	zm.mu.Lock()
+	zm.noReject[site] = true
+	zm.mu.Unlock()
+	zm.log.Warn().Err(err).Str("site", site).
+		Msg("controller does not support the REJECT zone-policy action; falling back to BLOCK")
+	return true
 }
 
 // findExistingPolicyByName queries the UniFi API for a zone policy with the given name.
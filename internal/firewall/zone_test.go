@@ -2,6 +2,7 @@ package firewall
 
 import (
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/developingchet/cs-unifi-bouncer-pro/internal/config"
@@ -321,6 +322,49 @@ func TestZoneManager_DeletePoliciesForShard(t *testing.T) {
 	}
 }
 
+// TestZoneManager_DeletePoliciesForShard_AlreadyDeleted verifies that a policy
+// removed from the controller behind the bouncer's back only has its bbolt
+// record cleaned up, without a delete call or an error.
+func TestZoneManager_DeletePoliciesForShard_AlreadyDeleted(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	namer := zoneTestNamer(t)
+
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newTestZoneManager(ctrl, store, namer)
+	ctx := context.Background()
+	if err := zm.Bootstrap(ctx, []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if err := zm.EnsurePoliciesForShard(ctx, testSite, v4.GroupIDs()[0], false, 0); err != nil {
+		t.Fatalf("EnsurePoliciesForShard: %v", err)
+	}
+
+	policyName, err := namer.PolicyName(NameData{Family: "v4", Index: 0, Site: testSite, SrcZone: "wan", DstZone: "lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := store.GetPolicy(policyName)
+	if err != nil || rec == nil {
+		t.Fatalf("GetPolicy(%s) = %v, %v; want a record", policyName, rec, err)
+	}
+	// Deleted by hand on the controller.
+	if err := ctrl.DeleteZonePolicy(ctx, testSite, rec.UnifiID); err != nil {
+		t.Fatal(err)
+	}
+	deletesBefore := ctrl.Calls("DeleteZonePolicy")
+
+	if err := zm.DeletePoliciesForShard(ctx, testSite, false, 0); err != nil {
+		t.Fatalf("DeletePoliciesForShard: %v", err)
+	}
+	if got := ctrl.Calls("DeleteZonePolicy"); got != deletesBefore {
+		t.Errorf("DeleteZonePolicy calls: got %d, want %d (policy already gone)", got, deletesBefore)
+	}
+	if rec, _ := store.GetPolicy(policyName); rec != nil {
+		t.Errorf("bbolt record %s still present: %+v", policyName, rec)
+	}
+}
+
 // TestZoneManager_DeletePoliciesForShard_NoOp verifies that DeletePoliciesForShard
 // is a no-op when no policy record exists.
 func TestZoneManager_DeletePoliciesForShard_NoOp(t *testing.T) {
@@ -515,3 +559,291 @@ func TestZoneManager_EnsurePolicies_ReconcileFixesMissingTML(t *testing.T) {
 		t.Error("updated policy: TrafficMatchingListIDs[0] is empty, want non-empty TML ID")
 	}
 }
+
+// newRejectZoneManager returns a wan->lan ZoneManager with BlockAction "reject".
+func newRejectZoneManager(t *testing.T, ctrl controller.Controller, store storage.Store) *ZoneManager {
+	t.Helper()
+	zm := NewZoneManager(ZoneConfig{
+		ZonePairs:   []config.ZonePair{{Src: "wan", Dst: "lan"}},
+		Description: "test",
+		BlockAction: "reject",
+	}, zoneTestNamer(t), ctrl, store, zerolog.Nop())
+	if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	return zm
+}
+
+// TestZoneManager_BlockActionReject verifies that FIREWALL_BLOCK_ACTION=reject
+// creates zone policies with the REJECT action.
+func TestZoneManager_BlockActionReject(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newRejectZoneManager(t, ctrl, store)
+
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies: %v", err)
+	}
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || policies[0].Action != "REJECT" {
+		t.Fatalf("policies = %+v, want one REJECT policy", policies)
+	}
+}
+
+// TestZoneManager_BlockActionRejectFallback verifies that a controller refusing
+// REJECT gets a BLOCK policy instead, and later policies for the site go
+// straight to BLOCK.
+func TestZoneManager_BlockActionRejectFallback(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newRejectZoneManager(t, ctrl, store)
+
+	ctrl.SetError("CreateZonePolicy", &controller.ErrBadRequest{Msg: "invalid action"})
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies: %v", err)
+	}
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || policies[0].Action != "BLOCK" {
+		t.Fatalf("policies = %+v, want one BLOCK policy", policies)
+	}
+	if got := ctrl.Calls("CreateZonePolicy"); got != 2 {
+		t.Errorf("CreateZonePolicy calls = %d, want 2 (REJECT, then BLOCK)", got)
+	}
+
+	// The existing BLOCK policy is not rewritten, and new shards use BLOCK.
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (second): %v", err)
+	}
+	if got := ctrl.Calls("UpdateZonePolicy"); got != 0 {
+		t.Errorf("UpdateZonePolicy calls = %d, want 0", got)
+	}
+	if err := zm.EnsurePoliciesForShard(context.Background(), testSite, "tml-shard-1", false, 1); err != nil {
+		t.Fatalf("EnsurePoliciesForShard: %v", err)
+	}
+	policies, _ = ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 2 || policies[1].Action != "BLOCK" {
+		t.Errorf("policies = %+v, want the new shard policy to use BLOCK", policies)
+	}
+}
+
+// TestZoneManager_BlockActionOtherBadRequest verifies that a 400 about
+// something other than the action is returned and does not pin the site to
+// BLOCK.
+func TestZoneManager_BlockActionOtherBadRequest(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newRejectZoneManager(t, ctrl, store)
+
+	ctrl.SetError("CreateZonePolicy", &controller.ErrBadRequest{Msg: `{"error":"invalid name"}`})
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err == nil {
+		t.Fatal("EnsurePolicies: want the 400 returned")
+	}
+	if got := ctrl.Calls("CreateZonePolicy"); got != 1 {
+		t.Errorf("CreateZonePolicy calls = %d, want 1 (no BLOCK retry)", got)
+	}
+	if got := zm.policyAction(testSite); got != "REJECT" {
+		t.Errorf("policyAction = %s, want REJECT kept", got)
+	}
+}
+
+func TestInvalidActionError(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"invalid action": true,
+		`{"code":"api.err.InvalidPayload","message":"Unsupported action REJECT"}`: true,
+		"action must be one of [ALLOW BLOCK]":                                     true,
+		"invalid name":                                                            false,
+		"action":                                                                  false,
+	} {
+		if got := invalidActionError(msg); got != want {
+			t.Errorf("invalidActionError(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+// TestZoneManager_BlockActionChangeUpdatesPolicy verifies that switching
+// FIREWALL_BLOCK_ACTION updates the action of existing zone policies.
+func TestZoneManager_BlockActionChangeUpdatesPolicy(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	namer := zoneTestNamer(t)
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+
+	zm := newTestZoneManager(ctrl, store, namer)
+	if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (drop): %v", err)
+	}
+
+	zm = newRejectZoneManager(t, ctrl, store)
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (reject): %v", err)
+	}
+	if got := ctrl.Calls("UpdateZonePolicy"); got != 1 {
+		t.Errorf("UpdateZonePolicy calls = %d, want 1", got)
+	}
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || policies[0].Action != "REJECT" {
+		t.Errorf("policies = %+v, want the existing policy switched to REJECT", policies)
+	}
+}
+
+// TestZoneManager_EnsurePolicies_ConnectionStates verifies that a pair's
+// connection states reach its policies, and that changing them updates the
+// existing policy in place.
+func TestZoneManager_EnsurePolicies_ConnectionStates(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	namer := zoneTestNamer(t)
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+
+	newZM := func(states ...string) *ZoneManager {
+		zm := NewZoneManager(ZoneConfig{
+			ZonePairs: []config.ZonePair{
+				{Src: "wan", Dst: "lan"},
+				{Src: "wan", Dst: "dmz", ConnectionStates: states},
+			},
+			Description: "test",
+		}, namer, ctrl, store, zerolog.Nop())
+		if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+			t.Fatalf("Bootstrap: %v", err)
+		}
+		if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+			t.Fatalf("EnsurePolicies: %v", err)
+		}
+		return zm
+	}
+	statesByDst := func() map[string][]string {
+		zoneMap := map[string]string{}
+		for _, name := range []string{"lan", "dmz"} {
+			id, _ := ctrl.GetZoneID(context.Background(), testSite, name)
+			zoneMap[id] = name
+		}
+		policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+		got := map[string][]string{}
+		for _, p := range policies {
+			got[zoneMap[p.DstZone]] = p.ConnectionStateFilter
+		}
+		return got
+	}
+
+	newZM("NEW", "INVALID")
+	got := statesByDst()
+	if got["lan"] != nil {
+		t.Errorf("wan->lan states = %v, want nil (all states)", got["lan"])
+	}
+	if strings.Join(got["dmz"], ",") != "NEW,INVALID" {
+		t.Errorf("wan->dmz states = %v, want [NEW INVALID]", got["dmz"])
+	}
+
+	newZM("NEW", "INVALID")
+	if n := ctrl.Calls("UpdateZonePolicy"); n != 0 {
+		t.Errorf("UpdateZonePolicy calls with unchanged states = %d, want 0", n)
+	}
+
+	newZM("NEW", "ESTABLISHED")
+	if n := ctrl.Calls("UpdateZonePolicy"); n != 1 {
+		t.Errorf("UpdateZonePolicy calls after state change = %d, want 1", n)
+	}
+	if got := statesByDst()["dmz"]; strings.Join(got, ",") != "NEW,ESTABLISHED" {
+		t.Errorf("wan->dmz states after change = %v, want [NEW ESTABLISHED]", got)
+	}
+}
+
+func TestZoneManager_EnsurePolicies_CreateDisabled(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newTestZoneManager(ctrl, store, zoneTestNamer(t))
+	zm.cfg.CreateDisabled = true
+	if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies: %v", err)
+	}
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || policies[0].Enabled {
+		t.Fatalf("policies = %+v, want one disabled policy", policies)
+	}
+}
+
+// TestZoneManager_EnsurePolicies_EnforceEnabled verifies that a managed policy
+// disabled out-of-band survives reconcile by default and is re-enabled only
+// when EnforceEnabled is set.
+func TestZoneManager_EnsurePolicies_EnforceEnabled(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newTestZoneManager(ctrl, store, zoneTestNamer(t))
+	if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (create): %v", err)
+	}
+
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	policies[0].Enabled = false
+	ctrl.SetPolicies(testSite, policies)
+
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (preserve): %v", err)
+	}
+	if got := ctrl.Calls("UpdateZonePolicy"); got != 0 {
+		t.Fatalf("UpdateZonePolicy calls = %d, want 0 without EnforceEnabled", got)
+	}
+
+	zm.cfg.EnforceEnabled = true
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (enforce): %v", err)
+	}
+	if got := ctrl.Calls("UpdateZonePolicy"); got != 1 {
+		t.Errorf("UpdateZonePolicy calls = %d, want 1", got)
+	}
+	policies, _ = ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || !policies[0].Enabled {
+		t.Errorf("policies = %+v, want the policy re-enabled", policies)
+	}
+}
+
+// TestZoneManager_EnablePolicies verifies that EnablePolicies turns on
+// policies created disabled and leaves enabled ones untouched.
+func TestZoneManager_EnablePolicies(t *testing.T) {
+	ctrl := testutil.NewMockController()
+	store := testutil.NewMockStore()
+	v4 := ensuredZoneV4Shard(t, ctrl, store)
+	zm := newTestZoneManager(ctrl, store, zoneTestNamer(t))
+	zm.cfg.CreateDisabled = true
+	if err := zm.Bootstrap(context.Background(), []string{testSite}); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies: %v", err)
+	}
+
+	n, err := zm.EnablePolicies(context.Background(), testSite)
+	if err != nil || n != 1 {
+		t.Fatalf("EnablePolicies = %d, %v; want 1, nil", n, err)
+	}
+	policies, _ := ctrl.ListZonePolicies(context.Background(), testSite)
+	if len(policies) != 1 || !policies[0].Enabled {
+		t.Fatalf("policies = %+v, want the policy enabled", policies)
+	}
+	if n, _ := zm.EnablePolicies(context.Background(), testSite); n != 0 {
+		t.Errorf("second EnablePolicies changed %d policies, want 0", n)
+	}
+
+	// Reconcile must not treat the now-enabled policy as drift.
+	if err := zm.EnsurePolicies(context.Background(), testSite, v4, nil); err != nil {
+		t.Fatalf("EnsurePolicies (after enable): %v", err)
+	}
+	if got := ctrl.Calls("UpdateZonePolicy"); got != 1 {
+		t.Errorf("UpdateZonePolicy calls = %d, want 1", got)
+	}
+}
@@ -0,0 +1,92 @@
+// Package geoip downloads per-country CIDR lists used by BLOCK_COUNTRIES.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CountryPlaceholder is replaced with the lower-case ISO 3166-1 alpha-2
+// country code in the provider URLs.
+const CountryPlaceholder = "{country}"
+
+// maxListBytes caps a single country list. The largest aggregated lists are
+// a few hundred KiB, so this only guards against a misbehaving server.
+const maxListBytes = 8 << 20
+
+// Provider fetches country CIDR lists from a plain-text source with one CIDR
+// per line (the ipdeny.com aggregated zone format).
+type Provider struct {
+	IPv4URL    string
+	IPv6URL    string
+	HTTPClient *http.Client
+}
+
+// NewProvider creates a provider with a 30-second timeout.
+func NewProvider(ipv4URL, ipv6URL string) *Provider {
+	return &Provider{
+		IPv4URL:    ipv4URL,
+		IPv6URL:    ipv6URL,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// FetchCountry returns the CIDRs of one family allocated to country.
+// Blank lines, comments and entries that do not parse as an address or CIDR
+// of the requested family are skipped.
+func (p *Provider) FetchCountry(ctx context.Context, country string, ipv6 bool) ([]string, error) {
+	tmpl := p.IPv4URL
+	if ipv6 {
+		tmpl = p.IPv6URL
+	}
+	url := strings.ReplaceAll(tmpl, CountryPlaceholder, strings.ToLower(country))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build request for %s: %w", url, err)
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: HTTP %d", url, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListBytes))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", url, err)
+	}
+
+	var result []string
+	for _, line := range strings.Split(string(body), "\n") {
+		entry := strings.TrimSpace(line)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if !matchesFamily(entry, ipv6) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// matchesFamily reports whether entry is an address or CIDR of the family.
+func matchesFamily(entry string, ipv6 bool) bool {
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		var err error
+		if ip, _, err = net.ParseCIDR(entry); err != nil {
+			return false
+		}
+	}
+	return (ip.To4() == nil) == ipv6
+}
@@ -0,0 +1,58 @@
+package geoip
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchCountry_SubstitutesCountry(t *testing.T) {
+	var gotPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		w.Write([]byte("1.0.1.0/24\n1.0.2.0/23\n"))
+	}))
+	defer server.Close()
+
+	p := NewProvider(server.URL+"/v4/{country}-aggregated.zone", server.URL+"/v6/{country}.zone")
+	cidrs, err := p.FetchCountry(context.Background(), "CN", false)
+	if err != nil {
+		t.Fatalf("FetchCountry: %v", err)
+	}
+	if gotPath != "/v4/cn-aggregated.zone" {
+		t.Errorf("path = %q, want /v4/cn-aggregated.zone", gotPath)
+	}
+	if len(cidrs) != 2 || cidrs[0] != "1.0.1.0/24" {
+		t.Errorf("cidrs = %v", cidrs)
+	}
+}
+
+func TestFetchCountry_FiltersByFamily(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# header\n\n2001:db8::/32\n1.0.1.0/24\nnot-a-cidr\n2001:db9::1\n"))
+	}))
+	defer server.Close()
+
+	p := NewProvider(server.URL+"/{country}", server.URL+"/{country}")
+	cidrs, err := p.FetchCountry(context.Background(), "de", true)
+	if err != nil {
+		t.Fatalf("FetchCountry: %v", err)
+	}
+	if strings.Join(cidrs, ",") != "2001:db8::/32,2001:db9::1" {
+		t.Errorf("cidrs = %v, want only the IPv6 entries", cidrs)
+	}
+}
+
+func TestFetchCountry_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	p := NewProvider(server.URL+"/{country}", "")
+	if _, err := p.FetchCountry(context.Background(), "xx", false); err == nil {
+		t.Fatal("expected error for HTTP 404")
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,6 +34,10 @@ type Reporter struct {
 	mu        sync.Mutex
 	blocked   map[originKey]int64
 	processed int64
+
+	// deleted counts deletions recorded with a reason; they are pushed as
+	// separate processed items labelled with the reason.
+	deleted map[string]int64
 }
 
 type originKey struct {
@@ -58,6 +63,7 @@ func NewReporter(lapiURL, apiKey, version string, interval time.Duration, log ze
 		log:         log,
 		httpClient:  &http.Client{Timeout: 5 * time.Second},
 		blocked:     make(map[originKey]int64),
+		deleted:     make(map[string]int64),
 	}
 }
 
@@ -69,10 +75,16 @@ func (r *Reporter) RecordBan(origin, remediationType string) {
 	r.mu.Unlock()
 }
 
-// RecordDeletion increments only the processed counter.
-func (r *Reporter) RecordDeletion() {
+// RecordDeletion counts an unban as processed. A non-empty reason (e.g.
+// "expired", "decision_deleted") is pushed as its own processed item with a
+// reason label; an empty reason counts towards the unlabelled item.
+func (r *Reporter) RecordDeletion(reason string) {
 	r.mu.Lock()
-	r.processed++
+	if reason == "" {
+		r.processed++
+	} else {
+		r.deleted[reason]++
+	}
 	r.mu.Unlock()
 }
 
@@ -113,8 +125,10 @@ func (r *Reporter) push(ctx context.Context) error {
 	r.mu.Lock()
 	blocked := r.blocked
 	processed := r.processed
+	deleted := r.deleted
 	r.blocked = make(map[originKey]int64)
 	r.processed = 0
+	r.deleted = make(map[string]int64)
 	r.mu.Unlock()
 
 	now := time.Now()
@@ -147,6 +161,24 @@ func (r *Reporter) push(ctx context.Context) error {
 		Value: processed,
 		Unit:  "request",
 	})
+	// Deletions with a reason are broken out so that expiry can be told apart
+	// from explicit deletion; the processed items sum to the total.
+	reasons := make([]string, 0, len(deleted))
+	for reason := range deleted {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		if deleted[reason] <= 0 {
+			continue
+		}
+		metricItems = append(metricItems, metricEntry{
+			Name:   "processed",
+			Value:  deleted[reason],
+			Unit:   "request",
+			Labels: map[string]string{"reason": reason},
+		})
+	}
 
 	osName, osVersion := detectOS()
 
@@ -188,6 +188,47 @@ func TestRecordBan_IncrementsCounters(t *testing.T) {
 	}
 }
 
+// TestRecordDeletion_BreaksOutReasons verifies that deletions with a reason
+// are pushed as processed items labelled with it, next to the unlabelled one.
+func TestRecordDeletion_BreaksOutReasons(t *testing.T) {
+	ch := &captureHandler{}
+	srv := httptest.NewServer(ch)
+	defer srv.Close()
+
+	r := newTestReporter(t, srv, 10*time.Minute)
+	r.RecordBan("crowdsec", "ban")
+	r.RecordDeletion("")
+	r.RecordDeletion("expired")
+	r.RecordDeletion("expired")
+	r.RecordDeletion("decision_deleted")
+
+	if err := r.push(context.Background()); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	payload := ch.lastPayload()
+	if payload == nil {
+		t.Fatal("no payload received")
+	}
+
+	got := make(map[string]int64)
+	for _, m := range payload.Metrics[0].Items {
+		if m.Name != "processed" {
+			continue
+		}
+		reason, _ := m.Labels["reason"].(string)
+		got[reason] = m.Value
+	}
+	want := map[string]int64{"": 2, "expired": 2, "decision_deleted": 1}
+	if len(got) != len(want) {
+		t.Fatalf("processed items = %v, want %v", got, want)
+	}
+	for reason, n := range want {
+		if got[reason] != n {
+			t.Errorf("processed{reason=%q} = %d, want %d", reason, got[reason], n)
+		}
+	}
+}
+
 // TestRecordDeletion_OnlyIncreasesProcessed verifies deletion only touches processed counter.
 func TestRecordDeletion_OnlyIncreasesProcessed(t *testing.T) {
 	ch := &captureHandler{}
@@ -196,8 +237,8 @@ func TestRecordDeletion_OnlyIncreasesProcessed(t *testing.T) {
 
 	r := newTestReporter(t, srv, 10*time.Minute)
 
-	r.RecordDeletion()
-	r.RecordDeletion()
+	r.RecordDeletion("")
+	r.RecordDeletion("")
 
 	if err := r.push(context.Background()); err != nil {
 		t.Fatalf("push failed: %v", err)
@@ -278,7 +319,7 @@ func TestPush_PayloadStructure(t *testing.T) {
 
 	r := newTestReporter(t, srv, 10*time.Minute)
 	r.RecordBan("CAPI", "ban")
-	r.RecordDeletion()
+	r.RecordDeletion("")
 
 	if err := r.push(context.Background()); err != nil {
 		t.Fatalf("push failed: %v", err)
@@ -0,0 +1,38 @@
+package logger
+
+import (
+	"io"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// FileConfig describes a rotating log file destination.
+type FileConfig struct {
+	Path       string
+	MaxSizeMB  int           // rotate once the active file exceeds this many megabytes
+	MaxBackups int           // number of rotated files to keep; 0 keeps all
+	MaxAge     time.Duration // delete rotated files older than this; 0 disables age-based pruning
+}
+
+// NewFileWriter returns a writer that appends to cfg.Path and rotates the file
+// when it grows past cfg.MaxSizeMB. The file is opened lazily on first write.
+// Callers should Close the writer on shutdown to release the file handle.
+func NewFileWriter(cfg FileConfig) io.WriteCloser {
+	return &lumberjack.Logger{
+		Filename:   cfg.Path,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     maxAgeDays(cfg.MaxAge),
+	}
+}
+
+// maxAgeDays converts d to whole days, rounding up so that a non-zero age never
+// becomes 0 (which lumberjack treats as "keep forever").
+func maxAgeDays(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	const day = 24 * time.Hour
+	return int((d + day - 1) / day)
+}
@@ -0,0 +1,79 @@
+package logger
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileWriter_WritesToFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bouncer.log")
+	w := NewFileWriter(FileConfig{Path: path, MaxSizeMB: 1})
+	defer w.Close()
+
+	if _, err := NewRedactWriter(w).Write([]byte("hello password=hunter2\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	if !strings.Contains(string(data), "hello") {
+		t.Errorf("expected log line in file, got %q", data)
+	}
+	if strings.Contains(string(data), "hunter2") {
+		t.Errorf("password leaked to log file: %q", data)
+	}
+}
+
+func TestFileWriter_RotatesOnSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bouncer.log")
+	w := NewFileWriter(FileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	defer w.Close()
+
+	line := append(bytes.Repeat([]byte("x"), 1023), '\n')
+	// 1100 KiB — just over the 1 MiB limit.
+	for i := 0; i < 1100; i++ {
+		if _, err := w.Write(line); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("expected active file plus a rotated backup, got %d entries", len(entries))
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= 1024*1024 {
+		t.Errorf("active file should have been rotated, size=%d", info.Size())
+	}
+}
+
+func TestMaxAgeDays(t *testing.T) {
+	cases := []struct {
+		in   time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Hour, 1},
+		{24 * time.Hour, 1},
+		{25 * time.Hour, 2},
+		{168 * time.Hour, 7},
+	}
+	for _, c := range cases {
+		if got := maxAgeDays(c.in); got != c.want {
+			t.Errorf("maxAgeDays(%s) = %d, want %d", c.in, got, c.want)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package logger
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"regexp"
 )
 
+// Redacted is the text that replaces each masked value.
+const Redacted = "[REDACTED]"
+
 // RedactWriter wraps an io.Writer and masks sensitive values before writing.
 // It redacts UNIFI_PASSWORD values, API keys, and Bearer tokens from log lines.
 type RedactWriter struct {
@@ -28,6 +32,11 @@ var defaultPatterns = []*regexp.Regexp{
 	regexp.MustCompile(`(?i)(bouncer[_-]?api[_-]?key["'\s:=]+)\S+`),
 	// X-Api-Key header
 	regexp.MustCompile(`(?i)(X-Api-Key["'\s:=]+)\S+`),
+	// UniFi session cookies and CSRF token
+	regexp.MustCompile(`(?i)((?:unifises|TOKEN)=)[^;\s"]+`),
+	regexp.MustCompile(`(?i)(x[_-]?csrf[_-]?token["'\s:=]+)\S+`),
+	// Settings whose values may embed credentials or tokens
+	regexp.MustCompile(`(?i)((?:redis_url|unifi_http_proxy|webhook_url|webhook_secret)["'\s:=]+)\S+`),
 }
 
 // NewRedactWriter returns a RedactWriter that applies all default sensitive patterns.
@@ -35,16 +44,69 @@ func NewRedactWriter(w io.Writer) *RedactWriter {
 	return &RedactWriter{
 		w:          w,
 		patterns:   defaultPatterns,
-		redactWith: "[REDACTED]",
+		redactWith: Redacted,
+	}
+}
+
+// NewRedactWriterWithPatterns returns a RedactWriter that applies the default
+// patterns followed by extra. An extra pattern with a capture group keeps
+// group 1 and masks the rest of the match; without a group the whole match is
+// masked.
+func NewRedactWriterWithPatterns(w io.Writer, extra []*regexp.Regexp) *RedactWriter {
+	return &RedactWriter{
+		w:          w,
+		patterns:   withDefaults(extra),
+		redactWith: Redacted,
+	}
+}
+
+// withDefaults returns the default patterns followed by extra.
+func withDefaults(extra []*regexp.Regexp) []*regexp.Regexp {
+	patterns := make([]*regexp.Regexp, 0, len(defaultPatterns)+len(extra))
+	patterns = append(patterns, defaultPatterns...)
+	return append(patterns, extra...)
+}
+
+// CompilePatterns compiles user-supplied redaction expressions.
+func CompilePatterns(exprs []string) ([]*regexp.Regexp, error) {
+	patterns := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction pattern %q: %w", expr, err)
+		}
+		patterns = append(patterns, re)
 	}
+	return patterns, nil
+}
+
+// Redact returns p with the default sensitive patterns masked. It is for
+// values such as HTTP bodies that are escaped once they reach a JSON log
+// line, where the writer's patterns no longer match.
+func Redact(p []byte) []byte {
+	return redactAll(p, defaultPatterns, Redacted)
+}
+
+// RedactString returns s masked exactly as a writer from
+// NewRedactWriterWithPatterns(w, extra) would write it.
+func RedactString(s string, extra []*regexp.Regexp) string {
+	return string(redactAll([]byte(s), withDefaults(extra), Redacted))
+}
+
+// RedactField returns Redacted when a log line holding key=value would have
+// anything masked, and value otherwise. The whole value is replaced, so a
+// secret containing spaces is never partly shown.
+func RedactField(key, value string, extra []*regexp.Regexp) string {
+	line := key + "=" + value
+	if RedactString(line, extra) != line {
+		return Redacted
+	}
+	return value
 }
 
 // Write applies all redaction patterns before forwarding to the underlying writer.
 func (r *RedactWriter) Write(p []byte) (int, error) {
-	sanitized := p
-	for _, re := range r.patterns {
-		sanitized = re.ReplaceAll(sanitized, appendRedacted(re, r.redactWith))
-	}
+	sanitized := redactAll(p, r.patterns, r.redactWith)
 	n, err := r.w.Write(sanitized)
 	// Return original length so callers don't get short-write errors
 	// even if redaction changed the byte count.
@@ -57,9 +119,17 @@ func (r *RedactWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+func redactAll(p []byte, patterns []*regexp.Regexp, redactWith string) []byte {
+	for _, re := range patterns {
+		p = re.ReplaceAll(p, appendRedacted(re, redactWith))
+	}
+	return p
+}
+
 // appendRedacted builds a replacement []byte that keeps capture group $1 + redactWith.
 func appendRedacted(re *regexp.Regexp, redact string) []byte {
-	// All our patterns have exactly one capture group for the key/prefix.
+	// Built-in patterns have exactly one capture group for the key/prefix.
+	// For patterns without a group, ${1} expands to "" and the whole match is masked.
 	var buf bytes.Buffer
 	buf.WriteString("${1}")
 	buf.WriteString(redact)
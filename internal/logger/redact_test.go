@@ -94,3 +94,85 @@ func TestRedactXApiKeyHeader(t *testing.T) {
 		t.Errorf("X-Api-Key value should be redacted, got: %q", got)
 	}
 }
+
+func TestRedactCustomPatterns(t *testing.T) {
+	extra, err := CompilePatterns([]string{
+		`[a-z0-9-]+\.corp\.example\.com`, // no capture group: whole match masked
+		`(session_token=)\S+`,            // capture group: prefix kept
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewRedactWriterWithPatterns(&buf, extra)
+	_, _ = w.Write([]byte(`connecting to fw01.corp.example.com session_token=abc123 site=default`))
+	got := buf.String()
+
+	for _, secret := range []string{"fw01.corp.example.com", "abc123"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("%q should be redacted, got: %q", secret, got)
+		}
+	}
+	for _, keep := range []string{"connecting to [REDACTED]", "session_token=[REDACTED]", "site=default"} {
+		if !strings.Contains(got, keep) {
+			t.Errorf("output should contain %q, got: %q", keep, got)
+		}
+	}
+}
+
+func TestRedactCustomPatterns_DefaultsStillApply(t *testing.T) {
+	extra, err := CompilePatterns([]string{`internal-\d+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewRedactWriterWithPatterns(&buf, extra)
+	_, _ = w.Write([]byte(`password=hunter2 host=internal-42`))
+	got := buf.String()
+	if strings.Contains(got, "hunter2") || strings.Contains(got, "internal-42") {
+		t.Errorf("expected both default and custom redaction, got: %q", got)
+	}
+}
+
+func TestCompilePatterns_Invalid(t *testing.T) {
+	if _, err := CompilePatterns([]string{`(unclosed`}); err == nil {
+		t.Error("expected error for invalid regex")
+	}
+}
+
+func TestRedactSessionCookies(t *testing.T) {
+	got := redact(`Cookie: unifises=abc123def; TOKEN=eyJhbGciOi.x.y; X-Csrf-Token: 0f1e2d3c`)
+	for _, secret := range []string{"abc123def", "eyJhbGciOi", "0f1e2d3c"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("cookie value %q should be redacted, got: %q", secret, got)
+		}
+	}
+}
+
+func TestRedactBytes(t *testing.T) {
+	got := string(Redact([]byte(`{"username":"admin","password":"hunter2"}`)))
+	if strings.Contains(got, "hunter2") || !strings.Contains(got, `"username":"admin"`) {
+		t.Errorf("Redact = %q, want only the password masked", got)
+	}
+}
+
+func TestRedactField(t *testing.T) {
+	extra, err := CompilePatterns([]string{`(site=)\S+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		key, value, want string
+	}{
+		{"unifi_password", "pass word", Redacted},
+		{"webhook_url", "https://hooks.example/T0K3N", Redacted},
+		{"redis_url", "redis://:pw@cache:6379", Redacted},
+		{"unifi_url", "https://192.168.1.1", "https://192.168.1.1"},
+		{"site", "homelab", Redacted},
+	}
+	for _, c := range cases {
+		if got := RedactField(c.key, c.value, extra); got != c.want {
+			t.Errorf("RedactField(%q, %q) = %q, want %q", c.key, c.value, got, c.want)
+		}
+	}
+}
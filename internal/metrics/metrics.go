@@ -22,6 +22,56 @@ var (
 		Help:      "Decisions rejected per filter stage.",
 	}, []string{"stage", "reason"})
 
+	// DecisionsOriginSkipped counts decisions dropped by the origin stage
+	// (CROWDSEC_ORIGINS or CROWDSEC_ORIGINS_EXCLUDE), per origin.
+	DecisionsOriginSkipped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_origin_skipped_total",
+		Help:      "Decisions skipped by the origin filter, per origin.",
+	}, []string{"origin"})
+
+	// SkippedDecisionType counts decisions dropped because their type is not
+	// in BLOCK_DECISION_TYPES (e.g. captcha or throttle), per type.
+	SkippedDecisionType = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "skipped_decision_type_total",
+		Help:      "Decisions skipped because their type is not a blocking type, per type.",
+	}, []string{"type"})
+
+	// DecisionsDeduped counts ban decisions dropped before the filter because
+	// the same decision ID was already applied (DECISION_DEDUP_CACHE_SIZE).
+	DecisionsDeduped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "decisions_deduped_total",
+		Help:      "Ban decisions skipped because the same decision was already applied.",
+	})
+
+	// CrowdSecLastPollSuccess records the Unix timestamp of the last decision
+	// stream fetch from the LAPI that succeeded. Alert when it falls several
+	// CROWDSEC_POLL_INTERVALs behind: the bouncer has stopped receiving
+	// decisions while its existing bans stay in place.
+	CrowdSecLastPollSuccess = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "crowdsec_last_poll_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful CrowdSec LAPI decision fetch.",
+	})
+
+	// CrowdSecPollErrors counts decision stream fetches from the LAPI that
+	// failed (connection error or non-2xx response).
+	CrowdSecPollErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crowdsec_poll_errors_total",
+		Help:      "Failed CrowdSec LAPI decision fetches.",
+	})
+
+	// WhitelistedSkips counts ban jobs dropped by the job handler because the
+	// IP matches BLOCK_WHITELIST.
+	WhitelistedSkips = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "whitelisted_skips_total",
+		Help:      "Ban jobs skipped by the job handler because the IP is whitelisted.",
+	})
+
 	// APICalls counts raw UniFi API calls.
 	APICalls = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -37,6 +87,31 @@ var (
 		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0},
 	}, []string{"endpoint"})
 
+	// APIRetries counts UniFi API requests retried by the client.
+	APIRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "api_retries_total",
+		Help:      "UniFi API requests retried after a rate limit, 5xx, or network error.",
+	}, []string{"endpoint", "reason"})
+
+	// ClockSkew is the controller's clock minus the local clock, estimated
+	// from the Date header of every UniFi API response. Ban expiry runs on
+	// the local clock, so a large value explains bans expiring early or late.
+	ClockSkew = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "clock_skew_seconds",
+		Help:      "UniFi controller clock minus local clock in seconds, from the last API response.",
+	})
+
+	// ControllerURLActive is 1 for the controller URL requests go to
+	// (role "primary" = UNIFI_URL, "fallback" = UNIFI_URL_FALLBACK) and 0
+	// for the other. Only set when a fallback is configured.
+	ControllerURLActive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "controller_url_active",
+		Help:      "1 for the UniFi controller URL in use (primary or fallback), 0 for the other.",
+	}, []string{"role"})
+
 	// AuthErrors counts re-auth calls that failed.
 	AuthErrors = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -65,6 +140,54 @@ var (
 		Help:      "IPs per firewall group shard in UniFi.",
 	}, []string{"family", "shard", "site"})
 
+	// FirewallShardCount tracks decision shards that exist in UniFi, per
+	// site and family.
+	FirewallShardCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "firewall_shard_count",
+		Help:      "Decision shards that exist in UniFi, per site and family.",
+	}, []string{"family", "site"})
+
+	// ShardLimitReached counts bans refused because every shard of the family
+	// was full and FIREWALL_MAX_SHARDS was reached.
+	ShardLimitReached = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shard_limit_reached_total",
+		Help:      "Bans refused because all shards were full at FIREWALL_MAX_SHARDS.",
+	}, []string{"family", "site"})
+
+	// FirewallShardsPruned counts empty trailing shards deleted from UniFi
+	// together with their rule or policies.
+	FirewallShardsPruned = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firewall_shards_pruned_total",
+		Help:      "Empty trailing shards deleted from UniFi, per site and family.",
+	}, []string{"family", "site"})
+
+	// FirewallFlushDuration records the latency of each FlushDirty write
+	// (one per-group PUT, or one bulk PUT).
+	FirewallFlushDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "firewall_flush_duration_seconds",
+		Help:      "Firewall group flush write latency in seconds.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0},
+	}, []string{"family", "site"})
+
+	// FirewallFlushErrors counts shards re-marked dirty after a failed flush write.
+	FirewallFlushErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "firewall_flush_errors_total",
+		Help:      "Shards re-marked dirty after a failed flush write.",
+	}, []string{"family", "site"})
+
+	// GroupRejectedOversize counts group writes the controller rejected for
+	// having too many members (FIREWALL_GROUP_CAPACITY above its limit).
+	GroupRejectedOversize = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "group_rejected_oversize_total",
+		Help:      "Firewall group writes rejected by the controller for exceeding its member limit.",
+	}, []string{"family", "site"})
+
 	// DBSizeBytes tracks bbolt on-disk file size.
 	DBSizeBytes = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -72,6 +195,29 @@ var (
 		Help:      "bbolt on-disk file size in bytes.",
 	})
 
+	// EvictedBans counts bans the janitor evicted to keep the store under
+	// BAN_STORE_MAX.
+	EvictedBans = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "evicted_bans_total",
+		Help:      "Non-permanent bans evicted, oldest first, to keep the store under BAN_STORE_MAX.",
+	})
+
+	// BanOldestAgeSeconds tracks how long ago the oldest active ban was
+	// recorded, refreshed by the janitor. Useful for tuning BAN_TTL.
+	BanOldestAgeSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ban_oldest_age_seconds",
+		Help:      "Age in seconds of the oldest active ban (0 when there are none).",
+	})
+
+	// BanExpiringWithin1h counts active bans that expire within the next hour.
+	BanExpiringWithin1h = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "bans_expiring_within_1h",
+		Help:      "Active bans whose expiry is within the next hour.",
+	})
+
 	// ReconcileDuration records full reconcile duration.
 	ReconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
 		Namespace: namespace,
@@ -80,6 +226,14 @@ var (
 		Buckets:   []float64{0.1, 0.5, 1.0, 5.0, 15.0, 60.0, 300.0},
 	}, []string{"trigger"})
 
+	// ReconcileSkippedOverlap counts periodic reconcile ticks skipped because
+	// the previous run was still in progress.
+	ReconcileSkippedOverlap = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reconcile_skipped_overlap_total",
+		Help:      "Periodic reconciles skipped because the previous run was still in progress.",
+	})
+
 	// ReconcileDelta tracks IPs changed in last reconcile.
 	ReconcileDelta = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -140,6 +294,16 @@ var (
 		Buckets:   []float64{0.1, 0.5, 1.0, 2.5, 5.0, 10.0, 30.0},
 	})
 
+	// BanApplyLatency measures time from the poller enqueuing a ban to the
+	// flush that writes it to a UniFi group, including batch-window and
+	// rate-limit delays.
+	BanApplyLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ban_apply_latency_seconds",
+		Help:      "Time from a ban being enqueued to its flush to the UniFi group.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"family", "site"})
+
 	// CircuitBreakerState tracks whether the circuit breaker is open (1) or closed (0).
 	CircuitBreakerState = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
@@ -153,4 +317,28 @@ var (
 		Name:      "shards_rebalanced_total",
 		Help:      "Number of shards drained by the rebalance pass, by family and site.",
 	}, []string{"family", "site"})
+
+	// WebhookDelivery counts WEBHOOK_URL event deliveries by result
+	// (success, failure, dropped).
+	WebhookDelivery = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_delivery_total",
+		Help:      "Webhook event deliveries by result (success, failure, dropped).",
+	}, []string{"result"})
+
+	// ControllerCapabilityChanged counts FIREWALL_MODE=auto sites whose
+	// detected firewall mode changed at runtime, e.g. after a firmware upgrade.
+	ControllerCapabilityChanged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "controller_capability_changed_total",
+		Help:      "Detected firewall mode changes per site (auto mode only).",
+	}, []string{"site"})
+
+	// FirewallMode is 1 for the firewall mode each site runs in and 0 for
+	// the other, so a flip of auto-detection is visible on a dashboard.
+	FirewallMode = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "firewall_mode",
+		Help:      "Firewall mode in use per site (1 = active): legacy or zone.",
+	}, []string{"site", "mode"})
 )
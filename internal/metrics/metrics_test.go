@@ -18,14 +18,27 @@ func TestMetricCollectorsNonNil(t *testing.T) {
 	}{
 		{"DecisionsProcessed", metrics.DecisionsProcessed},
 		{"DecisionsFiltered", metrics.DecisionsFiltered},
+		{"WhitelistedSkips", metrics.WhitelistedSkips},
+		{"SkippedDecisionType", metrics.SkippedDecisionType},
+		{"DecisionsDeduped", metrics.DecisionsDeduped},
+		{"CrowdSecLastPollSuccess", metrics.CrowdSecLastPollSuccess},
+		{"CrowdSecPollErrors", metrics.CrowdSecPollErrors},
 		{"APICalls", metrics.APICalls},
 		{"APIDuration", metrics.APIDuration},
+		{"APIRetries", metrics.APIRetries},
 		{"AuthErrors", metrics.AuthErrors},
 		{"ReauthTotal", metrics.ReauthTotal},
 		{"ActiveBans", metrics.ActiveBans},
 		{"FirewallGroupSize", metrics.FirewallGroupSize},
+		{"FirewallShardCount", metrics.FirewallShardCount},
+		{"FirewallShardsPruned", metrics.FirewallShardsPruned},
+		{"ShardLimitReached", metrics.ShardLimitReached},
+		{"BanApplyLatency", metrics.BanApplyLatency},
+		{"FirewallFlushDuration", metrics.FirewallFlushDuration},
+		{"FirewallFlushErrors", metrics.FirewallFlushErrors},
 		{"DBSizeBytes", metrics.DBSizeBytes},
 		{"ReconcileDuration", metrics.ReconcileDuration},
+		{"ReconcileSkippedOverlap", metrics.ReconcileSkippedOverlap},
 		{"ReconcileDelta", metrics.ReconcileDelta},
 		{"ShardIPCount", metrics.ShardIPCount},
 		{"ShardSyncTotal", metrics.ShardSyncTotal},
@@ -61,12 +74,20 @@ func TestMetricNamesAndHelp(t *testing.T) {
 	}{
 		{"crowdsec_unifi_decisions_processed_total", metrics.DecisionsProcessed},
 		{"crowdsec_unifi_decisions_filtered_total", metrics.DecisionsFiltered},
+		{"crowdsec_unifi_skipped_decision_type_total", metrics.SkippedDecisionType},
+		{"crowdsec_unifi_decisions_deduped_total", metrics.DecisionsDeduped},
+		{"crowdsec_unifi_crowdsec_last_poll_success_timestamp_seconds", metrics.CrowdSecLastPollSuccess},
+		{"crowdsec_unifi_crowdsec_poll_errors_total", metrics.CrowdSecPollErrors},
 		{"crowdsec_unifi_api_calls_total", metrics.APICalls},
 		{"crowdsec_unifi_api_duration_seconds", metrics.APIDuration},
 		{"crowdsec_unifi_auth_errors_total", metrics.AuthErrors},
 		{"crowdsec_unifi_reauth_total", metrics.ReauthTotal},
 		{"crowdsec_unifi_active_bans", metrics.ActiveBans},
 		{"crowdsec_unifi_firewall_group_size", metrics.FirewallGroupSize},
+		{"crowdsec_unifi_firewall_shard_count", metrics.FirewallShardCount},
+		{"crowdsec_unifi_firewall_shards_pruned_total", metrics.FirewallShardsPruned},
+		{"crowdsec_unifi_shard_limit_reached_total", metrics.ShardLimitReached},
+		{"crowdsec_unifi_ban_apply_latency_seconds", metrics.BanApplyLatency},
 		{"crowdsec_unifi_db_size_bytes", metrics.DBSizeBytes},
 		{"crowdsec_unifi_reconcile_duration_seconds", metrics.ReconcileDuration},
 		{"crowdsec_unifi_reconcile_delta", metrics.ReconcileDelta},
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// preRestoreSuffix is appended to the database a restore replaced, so the
+// previous state can be recovered by hand.
+const preRestoreSuffix = ".pre-restore"
+
+// ErrStoreInUse is returned by RestoreBbolt and NewBboltStoreReadOnly when
+// another process, normally the running bouncer, holds the database lock.
+var ErrStoreInUse = errors.New("database is locked by another process, normally the running bouncer")
+
+// RestoreBbolt validates the bbolt backup at src and swaps it in as
+// dataDir/bouncer.db. The replaced database is kept as bouncer.db.pre-restore.
+// The bouncer must be stopped: an open database fails with ErrStoreInUse.
+func RestoreBbolt(dataDir, src string) error {
+	if err := validateBboltBackup(src); err != nil {
+		return err
+	}
+	dst := filepath.Join(dataDir, "bouncer.db")
+	if _, err := os.Stat(dst); err == nil {
+		// Only the lock matters here: a database that fails to open for any
+		// other reason, such as corruption, is what restores are for.
+		db, err := bolt.Open(dst, 0o600, &bolt.Options{Timeout: time.Second})
+		if errors.Is(err, bolt.ErrTimeout) {
+			return fmt.Errorf("restore %s: %w", dst, ErrStoreInUse)
+		}
+		if err == nil {
+			_ = db.Close()
+		}
+	}
+	return swapInBackup(src, dst)
+}
+
+// validateBboltBackup checks that src is a bbolt database with the bouncer's
+// buckets, written by a schema version this binary understands.
+func validateBboltBackup(src string) error {
+	db, err := bolt.Open(src, 0o600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open backup %s: %w", src, err)
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		for _, name := range []string{bucketBans, bucketGroups, bucketPolicies} {
+			if tx.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("backup %s is not a bouncer database: bucket %s missing", src, name)
+			}
+		}
+		meta := tx.Bucket([]byte(bucketMeta))
+		if meta == nil {
+			return nil
+		}
+		return checkBackupSchema(src, string(meta.Get([]byte(metaKeySchemaVersion))))
+	})
+}
+
+// RestoreSQLite validates the SQLite backup at src and swaps it in as
+// dataDir/bouncer.sqlite. The replaced database is kept as
+// bouncer.sqlite.pre-restore. SQLite does not hold a lock between
+// transactions, so a running bouncer cannot be detected: stop it first.
+func RestoreSQLite(dataDir, src string) error {
+	if err := validateSQLiteBackup(src); err != nil {
+		return err
+	}
+	dst := filepath.Join(dataDir, sqliteFileName)
+	if _, err := os.Stat(dst); err == nil {
+		// Closing the last connection checkpoints the write-ahead log into
+		// the main file and removes it, so no stale -wal is replayed onto
+		// the restored database.
+		if db, err := openSQLite(dst, false); err == nil {
+			_ = db.Close()
+		}
+		for _, suffix := range []string{"-wal", "-shm"} {
+			if err := os.Remove(dst + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("remove %s: %w", dst+suffix, err)
+			}
+		}
+	}
+	return swapInBackup(src, dst)
+}
+
+// validateSQLiteBackup checks that src is a SQLite database with the
+// bouncer's tables, written by a schema version this binary understands.
+func validateSQLiteBackup(src string) error {
+	if _, err := os.Stat(src); err != nil {
+		return fmt.Errorf("open backup %s: %w", src, err)
+	}
+	db, err := openSQLite(src, true)
+	if err != nil {
+		return fmt.Errorf("open backup %s: %w", src, err)
+	}
+	defer db.Close()
+
+	var tables int
+	if err := db.QueryRow(`SELECT count(*) FROM sqlite_master
+		WHERE type = 'table' AND name IN ('meta', 'bans', 'groups', 'policies')`).Scan(&tables); err != nil {
+		return fmt.Errorf("backup %s is not a SQLite database: %w", src, err)
+	}
+	if tables != 4 {
+		return fmt.Errorf("backup %s is not a bouncer database: tables missing", src)
+	}
+	var v string
+	_ = db.QueryRow(`SELECT value FROM meta WHERE key = ?`, metaKeySchemaVersion).Scan(&v)
+	return checkBackupSchema(src, v)
+}
+
+// checkBackupSchema refuses a backup stamped by a newer binary. An empty
+// version predates versioning and is accepted.
+func checkBackupSchema(src, v string) error {
+	if v == "" {
+		return nil
+	}
+	stored, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("backup %s: parse schema version %q: %w", src, v, err)
+	}
+	if stored > SchemaVersion {
+		return fmt.Errorf("backup %s: %w", src, &ErrSchemaTooNew{Stored: stored, Supported: SchemaVersion})
+	}
+	return nil
+}
+
+// swapInBackup copies src next to dst, syncs it, moves any existing dst to
+// dst.pre-restore and renames the copy into place, so dst is never partially
+// written.
+func swapInBackup(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o750); err != nil {
+		return fmt.Errorf("create data dir: %w", err)
+	}
+	tmp := dst + ".restore"
+	if err := copyFileSync(src, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return fmt.Errorf("copy backup: %w", err)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		if err := os.Rename(dst, dst+preRestoreSuffix); err != nil {
+			_ = os.Remove(tmp)
+			return fmt.Errorf("move aside %s: %w", dst, err)
+		}
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("install backup: %w", err)
+	}
+	return nil
+}
+
+func copyFileSync(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
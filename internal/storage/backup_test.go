@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	bolt "go.etcd.io/bbolt"
+)
+
+// writeBackup backs s up to a file in a fresh temp dir and returns its path.
+func writeBackup(t *testing.T, s Store) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "backup")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := s.Backup(f); err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+	return path
+}
+
+// testBackupRestore backs up a store while another goroutine keeps writing,
+// restores the copy over an existing database in a second data dir, and
+// checks the restored records.
+func testBackupRestore(t *testing.T, open func(string, zerolog.Logger) (Store, error),
+	restore func(string, string) error, fileName string) {
+	src, err := open(t.TempDir(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if err := src.BanRecord("192.0.2.1", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.SetGroup("crowdsec-block-v4-0", GroupRecord{UnifiID: "g1", Site: "default", Members: []string{"192.0.2.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = src.BanRecord(fmt.Sprintf("198.51.100.%d", i%250), time.Time{}, false)
+			}
+		}
+	}()
+	backup := writeBackup(t, src)
+	close(stop)
+	wg.Wait()
+
+	dataDir := t.TempDir()
+	old, err := open(dataDir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.BanRecord("203.0.113.9", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := old.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := restore(dataDir, backup); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, fileName+preRestoreSuffix)); err != nil {
+		t.Errorf("replaced database not kept: %v", err)
+	}
+
+	restored, err := open(dataDir, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("open restored store: %v", err)
+	}
+	defer restored.Close()
+	if ok, _ := restored.BanExists("192.0.2.1"); !ok {
+		t.Error("restored store is missing 192.0.2.1")
+	}
+	if ok, _ := restored.BanExists("203.0.113.9"); ok {
+		t.Error("restored store still has the replaced database's ban")
+	}
+	if g, err := restored.GetGroup("crowdsec-block-v4-0"); err != nil || g == nil || g.UnifiID != "g1" {
+		t.Errorf("restored group = %+v, %v", g, err)
+	}
+}
+
+func TestBackupRestore_Bbolt(t *testing.T) {
+	testBackupRestore(t, NewBboltStore, RestoreBbolt, "bouncer.db")
+}
+
+func TestBackupRestore_SQLite(t *testing.T) {
+	testBackupRestore(t, NewSQLiteStore, RestoreSQLite, sqliteFileName)
+}
+
+// TestBackup_ReadOnlyStore verifies that a backup can be taken through the
+// read-only handle the CLI uses.
+func TestBackup_ReadOnlyStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBboltStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.BanRecord("192.0.2.1", time.Time{}, false)
+	_ = s.Close()
+
+	ro, err := NewBboltStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := validateBboltBackup(writeBackup(t, ro)); err != nil {
+		t.Errorf("backup from read-only store is invalid: %v", err)
+	}
+}
+
+func TestRestoreBbolt_InUse(t *testing.T) {
+	backup := writeBackup(t, newTestBboltStore(t))
+
+	dataDir := t.TempDir()
+	running, err := NewBboltStore(dataDir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer running.Close()
+
+	if err := RestoreBbolt(dataDir, backup); !errors.Is(err, ErrStoreInUse) {
+		t.Fatalf("RestoreBbolt on an open database = %v, want ErrStoreInUse", err)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "bouncer.db"+preRestoreSuffix)); !os.IsNotExist(err) {
+		t.Errorf("database was moved aside despite the failed restore: %v", err)
+	}
+}
+
+func TestRestore_RejectsInvalidBackups(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	foreign := filepath.Join(dir, "foreign.db")
+	db, err := bolt.Open(foreign, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucket([]byte("other"))
+		return err
+	})
+	_ = db.Close()
+
+	newer := writeBackup(t, newTestBboltStore(t))
+	db, err = bolt.Open(newer, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketMeta)).Put([]byte(metaKeySchemaVersion), []byte(fmt.Sprint(SchemaVersion+1)))
+	})
+	_ = db.Close()
+
+	bboltBackup := writeBackup(t, newTestBboltStore(t))
+
+	for _, tc := range []struct {
+		name    string
+		restore func(string, string) error
+		src     string
+	}{
+		{"bbolt_garbage", RestoreBbolt, garbage},
+		{"bbolt_foreign_buckets", RestoreBbolt, foreign},
+		{"bbolt_schema_too_new", RestoreBbolt, newer},
+		{"bbolt_missing", RestoreBbolt, filepath.Join(dir, "missing")},
+		{"sqlite_garbage", RestoreSQLite, garbage},
+		{"sqlite_from_bbolt", RestoreSQLite, bboltBackup},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			if err := tc.restore(dataDir, tc.src); err == nil {
+				t.Fatal("restore accepted an invalid backup")
+			}
+			entries, _ := os.ReadDir(dataDir)
+			if len(entries) != 0 {
+				t.Errorf("failed restore left files in the data dir: %v", entries)
+			}
+		})
+	}
+}
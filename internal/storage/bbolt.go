@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -13,16 +16,24 @@ import (
 
 const (
 	bucketBans     = "bans"
+	bucketHistory  = "history"
 	bucketGroups   = "groups"
 	bucketPolicies = "policies"
+	bucketMeta     = "meta"
 )
 
+// metaKeySchemaVersion holds the SchemaVersion that last wrote the database,
+// as a decimal string. Databases from before versioning have no entry.
+const metaKeySchemaVersion = "schema_version"
+
 type bboltStore struct {
 	db  *bolt.DB
 	log zerolog.Logger
 }
 
 // NewBboltStore opens (or creates) a bbolt database at dataDir/bouncer.db.
+// It stamps the database with SchemaVersion and fails with *ErrSchemaTooNew
+// if a newer binary has already stamped it.
 func NewBboltStore(dataDir string, log zerolog.Logger) (Store, error) {
 	if err := os.MkdirAll(dataDir, 0o750); err != nil {
 		return nil, fmt.Errorf("create data dir: %w", err)
@@ -33,12 +44,12 @@ func NewBboltStore(dataDir string, log zerolog.Logger) (Store, error) {
 		return nil, fmt.Errorf("open bbolt at %s: %w", path, err)
 	}
 	if err := db.Update(func(tx *bolt.Tx) error {
-		for _, name := range []string{bucketBans, bucketGroups, bucketPolicies} {
+		for _, name := range []string{bucketBans, bucketHistory, bucketGroups, bucketPolicies, bucketMeta} {
 			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
 				return fmt.Errorf("create bucket %s: %w", name, err)
 			}
 		}
-		return nil
+		return stampSchemaVersion(tx.Bucket([]byte(bucketMeta)))
 	}); err != nil {
 		_ = db.Close()
 		return nil, err
@@ -48,17 +59,40 @@ func NewBboltStore(dataDir string, log zerolog.Logger) (Store, error) {
 
 // NewBboltStoreReadOnly opens an existing bbolt database in read-only mode.
 // It does not create the file or buckets. Suitable for the status subcommand
-// while the daemon may be running concurrently.
+// while the daemon may be running concurrently. The schema version is not
+// checked: a read-only handle cannot write records a newer binary would misread.
+// Writes fail with ErrReadOnly.
 func NewBboltStoreReadOnly(dataDir string) (Store, error) {
 	path := filepath.Join(dataDir, "bouncer.db")
 	db, err := bolt.Open(path, 0o600, &bolt.Options{
 		ReadOnly: true,
 		Timeout:  3 * time.Second,
 	})
+	if errors.Is(err, bolt.ErrTimeout) {
+		err = ErrStoreInUse
+	}
 	if err != nil {
 		return nil, fmt.Errorf("open bbolt (read-only) at %s: %w", path, err)
 	}
-	return &bboltStore{db: db, log: zerolog.Nop()}, nil
+	return readOnlyStore{Store: &bboltStore{db: db, log: zerolog.Nop()}}, nil
+}
+
+// stampSchemaVersion records SchemaVersion in the meta bucket, refusing to
+// overwrite a newer version.
+func stampSchemaVersion(meta *bolt.Bucket) error {
+	if v := meta.Get([]byte(metaKeySchemaVersion)); v != nil {
+		stored, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("parse schema version %q: %w", v, err)
+		}
+		if stored > SchemaVersion {
+			return &ErrSchemaTooNew{Stored: stored, Supported: SchemaVersion}
+		}
+		if stored == SchemaVersion {
+			return nil
+		}
+	}
+	return meta.Put([]byte(metaKeySchemaVersion), []byte(strconv.Itoa(SchemaVersion)))
 }
 
 // ---- Ban operations --------------------------------------------------------
@@ -73,21 +107,89 @@ func (s *bboltStore) BanExists(ip string) (bool, error) {
 	return exists, err
 }
 
+func (s *bboltStore) BanGet(ip string) (*BanEntry, error) {
+	var entry *BanEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bucketBans)).Get([]byte(ip))
+		if v == nil {
+			return nil
+		}
+		entry = &BanEntry{}
+		if err := msgpack.Unmarshal(v, entry); err != nil {
+			return fmt.Errorf("unmarshal BanEntry for %s: %w", ip, err)
+		}
+		return nil
+	})
+	return entry, err
+}
+
 func (s *bboltStore) BanRecord(ip string, expiresAt time.Time, ipv6 bool) error {
+	return s.BanRecordOrigin(ip, expiresAt, ipv6, "")
+}
+
+func (s *bboltStore) BanRecordOrigin(ip string, expiresAt time.Time, ipv6 bool, origin string) error {
+	now := time.Now().UTC()
 	entry := BanEntry{
-		RecordedAt: time.Now().UTC(),
+		RecordedAt: now,
 		ExpiresAt:  expiresAt.UTC(),
 		IPv6:       ipv6,
+		Origin:     origin,
 	}
 	data, err := msgpack.Marshal(entry)
 	if err != nil {
 		return fmt.Errorf("marshal BanEntry: %w", err)
 	}
 	return s.db.Update(func(tx *bolt.Tx) error {
-		return tx.Bucket([]byte(bucketBans)).Put([]byte(ip), data)
+		if err := tx.Bucket([]byte(bucketBans)).Put([]byte(ip), data); err != nil {
+			return err
+		}
+		return recordBanHistory(tx.Bucket([]byte(bucketHistory)), ip, now)
 	})
 }
 
+// recordBanHistory increments ip's history in b. A corrupt entry is replaced
+// rather than failing the ban.
+func recordBanHistory(b *bolt.Bucket, ip string, now time.Time) error {
+	var h BanHistory
+	if v := b.Get([]byte(ip)); v != nil {
+		if err := msgpack.Unmarshal(v, &h); err != nil {
+			h = BanHistory{}
+		}
+	}
+	h.record(now)
+	data, err := msgpack.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("marshal BanHistory: %w", err)
+	}
+	return b.Put([]byte(ip), data)
+}
+
+func (s *bboltStore) GetBanHistory(ip string) (*BanHistory, error) {
+	var h BanHistory
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// The bucket is missing when a read-only store opens a database
+		// written by an older version.
+		b := tx.Bucket([]byte(bucketHistory))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(ip))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return msgpack.Unmarshal(v, &h)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+	return &h, nil
+}
+
 func (s *bboltStore) BanDelete(ip string) error {
 	return s.db.Update(func(tx *bolt.Tx) error {
 		return tx.Bucket([]byte(bucketBans)).Delete([]byte(ip))
@@ -111,13 +213,15 @@ func (s *bboltStore) BanList() (map[string]BanEntry, error) {
 
 // ---- Janitor ---------------------------------------------------------------
 
-func (s *bboltStore) PruneExpiredBans() (int, error) {
+// PruneExpiredBans deletes expired bans in batches of batchSize. Expired
+// keys are collected in a read transaction, then removed in separate write
+// transactions; the write lock is released between batches so concurrent
+// BanRecord/BanDelete calls are not stalled behind a large prune.
+func (s *bboltStore) PruneExpiredBans(batchSize int) (int, error) {
 	now := time.Now().UTC()
-	var pruned int
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucketBans))
-		var toDelete [][]byte
-		if err := b.ForEach(func(k, v []byte) error {
+	var expired [][]byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketBans)).ForEach(func(k, v []byte) error {
 			var entry BanEntry
 			if err := msgpack.Unmarshal(v, &entry); err != nil {
 				s.log.Warn().Str("key", string(k)).Err(err).Msg("janitor: skipping corrupt ban entry")
@@ -126,21 +230,87 @@ func (s *bboltStore) PruneExpiredBans() (int, error) {
 			if !entry.ExpiresAt.IsZero() && entry.ExpiresAt.Before(now) {
 				key := make([]byte, len(k))
 				copy(key, k)
-				toDelete = append(toDelete, key)
+				expired = append(expired, key)
 			}
 			return nil
-		}); err != nil {
-			return err
+		})
+	}); err != nil {
+		return 0, err
+	}
+
+	var pruned int
+	batch := max(batchSize, 1)
+	for start := 0; start < len(expired); start += batch {
+		end := min(start+batch, len(expired))
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucketBans))
+			for _, k := range expired[start:end] {
+				// Re-check inside the write transaction: the ban may have been
+				// re-recorded with a fresh expiry since the scan.
+				v := b.Get(k)
+				if v == nil {
+					continue
+				}
+				var entry BanEntry
+				if err := msgpack.Unmarshal(v, &entry); err != nil ||
+					entry.ExpiresAt.IsZero() || !entry.ExpiresAt.Before(now) {
+					continue
+				}
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				pruned++
+			}
+			return nil
+		})
+		if err != nil {
+			return pruned, err
 		}
-		for _, k := range toDelete {
-			if err := b.Delete(k); err != nil {
-				return err
+	}
+	return pruned, s.pruneBanHistory(now, batch)
+}
+
+// pruneBanHistory deletes history entries whose last ban is older than
+// banHistoryRetention, in batches of batch.
+func (s *bboltStore) pruneBanHistory(now time.Time, batch int) error {
+	cutoff := now.Add(-banHistoryRetention)
+	var aged [][]byte
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketHistory)).ForEach(func(k, v []byte) error {
+			var h BanHistory
+			if err := msgpack.Unmarshal(v, &h); err != nil || h.LastBanned.Before(cutoff) {
+				key := make([]byte, len(k))
+				copy(key, k)
+				aged = append(aged, key)
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(aged); start += batch {
+		end := min(start+batch, len(aged))
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(bucketHistory))
+			for _, k := range aged[start:end] {
+				// Skip entries re-banned since the scan.
+				var h BanHistory
+				if v := b.Get(k); v == nil ||
+					(msgpack.Unmarshal(v, &h) == nil && !h.LastBanned.Before(cutoff)) {
+					continue
+				}
+				if err := b.Delete(k); err != nil {
+					return err
+				}
 			}
-			pruned++
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-	return pruned, err
+	}
+	return nil
 }
 
 // ---- Group cache -----------------------------------------------------------
@@ -262,3 +432,12 @@ func (s *bboltStore) SizeBytes() (int64, error) {
 func (s *bboltStore) Close() error {
 	return s.db.Close()
 }
+
+// Backup streams the whole database file from a read transaction, so the
+// copy is a consistent snapshot while writers continue.
+func (s *bboltStore) Backup(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
@@ -1,15 +1,23 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+	bolt "go.etcd.io/bbolt"
 )
 
-func newTestStore(t *testing.T) Store {
+// newTestStore opens the store the backend-neutral tests below run against.
+// TestSQLiteStore_Parity swaps it to rerun them on SQLite.
+var newTestStore = newTestBboltStore
+
+func newTestBboltStore(t *testing.T) Store {
 	t.Helper()
 	dir := t.TempDir()
 	s, err := NewBboltStore(dir, zerolog.Nop())
@@ -77,7 +85,7 @@ func TestBanEntryExpiresAt(t *testing.T) {
 	if err := s.BanRecord(ip, past, false); err != nil {
 		t.Fatalf("BanRecord: %v", err)
 	}
-	pruned, err := s.PruneExpiredBans()
+	pruned, err := s.PruneExpiredBans(testPruneBatch)
 	if err != nil {
 		t.Fatalf("PruneExpiredBans: %v", err)
 	}
@@ -90,6 +98,35 @@ func TestBanEntryExpiresAt(t *testing.T) {
 	}
 }
 
+func TestBanGet(t *testing.T) {
+	s := newTestStore(t)
+	const ip = "5.6.7.9"
+	if entry, err := s.BanGet(ip); err != nil || entry != nil {
+		t.Fatalf("BanGet before record: %+v, %v; want nil", entry, err)
+	}
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	if err := s.BanRecord(ip, expires, false); err != nil {
+		t.Fatalf("BanRecord: %v", err)
+	}
+	entry, err := s.BanGet(ip)
+	if err != nil || entry == nil {
+		t.Fatalf("BanGet: %+v, %v", entry, err)
+	}
+	if !entry.ExpiresAt.Equal(expires) || entry.IPv6 || entry.Origin != "" {
+		t.Errorf("BanGet = %+v, want expiry %v", entry, expires)
+	}
+
+	if err := s.BanRecordOrigin(ip, time.Time{}, false, "blocklist-import"); err != nil {
+		t.Fatalf("BanRecordOrigin: %v", err)
+	}
+	if entry, _ := s.BanGet(ip); entry == nil || entry.Origin != "blocklist-import" || !entry.ExpiresAt.IsZero() {
+		t.Errorf("BanGet after BanRecordOrigin = %+v", entry)
+	}
+	if list, _ := s.BanList(); list[ip].Origin != "blocklist-import" {
+		t.Errorf("BanList origin = %q, want blocklist-import", list[ip].Origin)
+	}
+}
+
 func TestPruneKeepsFreshBans(t *testing.T) {
 	s := newTestStore(t)
 
@@ -102,7 +139,7 @@ func TestPruneKeepsFreshBans(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	pruned, err := s.PruneExpiredBans()
+	pruned, err := s.PruneExpiredBans(testPruneBatch)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -252,3 +289,249 @@ func TestFileCreated(t *testing.T) {
 		t.Errorf("db file not created: %v", err)
 	}
 }
+
+// testPruneBatch is the JANITOR_BATCH_SIZE default used by the prune tests.
+const testPruneBatch = 500
+
+func TestPruneExpiredBans_Batched(t *testing.T) {
+	s := newTestStore(t)
+
+	n := testPruneBatch*2 + 17
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("198.51.%d.%d", i/256, i%256)
+		if err := s.BanRecord(ip, past, false); err != nil {
+			t.Fatalf("BanRecord %s: %v", ip, err)
+		}
+	}
+	if err := s.BanRecord("203.0.113.1", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.PruneExpiredBans(testPruneBatch)
+	if err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if pruned != n {
+		t.Fatalf("expected %d pruned, got %d", n, pruned)
+	}
+	list, err := s.BanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expected only the fresh ban to remain, got %d entries", len(list))
+	}
+}
+
+// TestPruneExpiredBans_ConfiguredBatchSize verifies that a small
+// JANITOR_BATCH_SIZE still removes every expired ban and reports the total.
+func TestPruneExpiredBans_ConfiguredBatchSize(t *testing.T) {
+	s := newTestStore(t)
+
+	const n = 7*12 + 3
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		if err := s.BanRecord(fmt.Sprintf("198.51.100.%d", i), past, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BanRecord("203.0.113.1", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.PruneExpiredBans(7)
+	if err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if pruned != n {
+		t.Errorf("pruned = %d, want %d", pruned, n)
+	}
+	if list, _ := s.BanList(); len(list) != 1 {
+		t.Errorf("%d bans remain, want only the fresh one", len(list))
+	}
+}
+
+func TestPruneExpiredBans_StoreResponsive(t *testing.T) {
+	s := newTestStore(t)
+
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < testPruneBatch*4; i++ {
+		ip := fmt.Sprintf("198.51.%d.%d", i/256, i%256)
+		if err := s.BanRecord(ip, past, false); err != nil {
+			t.Fatalf("BanRecord %s: %v", ip, err)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.PruneExpiredBans(testPruneBatch)
+		done <- err
+	}()
+
+	// Writes issued while the prune runs must succeed and must not be
+	// removed by it.
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		if err := s.BanRecord(ip, time.Now().Add(time.Hour), false); err != nil {
+			t.Fatalf("BanRecord during prune: %v", err)
+		}
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		ip := fmt.Sprintf("203.0.113.%d", i)
+		if ok, _ := s.BanExists(ip); !ok {
+			t.Errorf("fresh ban %s recorded during prune was removed", ip)
+		}
+	}
+}
+
+func TestBanHistory_IncrementsOnReban(t *testing.T) {
+	s := newTestStore(t)
+
+	const ip = "192.0.2.7"
+	if h, err := s.GetBanHistory(ip); err != nil || h != nil {
+		t.Fatalf("GetBanHistory before any ban: h=%+v, err=%v", h, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.BanRecord(ip, time.Now().Add(time.Hour), false); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+		if err := s.BanDelete(ip); err != nil {
+			t.Fatalf("BanDelete: %v", err)
+		}
+	}
+
+	h, err := s.GetBanHistory(ip)
+	if err != nil || h == nil {
+		t.Fatalf("GetBanHistory: h=%v, err=%v", h, err)
+	}
+	if h.Count != 3 {
+		t.Errorf("Count = %d, want 3", h.Count)
+	}
+	if h.FirstBanned.IsZero() || h.LastBanned.Before(h.FirstBanned) {
+		t.Errorf("unexpected timestamps: first=%v last=%v", h.FirstBanned, h.LastBanned)
+	}
+}
+
+// putHistory writes a history entry directly, bypassing BanRecord.
+func putHistory(t *testing.T, s Store, ip string, h BanHistory) {
+	t.Helper()
+	data, err := msgpack.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(*bboltStore).db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketHistory)).Put([]byte(ip), data)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBanHistory_AgedAndCapped(t *testing.T) {
+	s := newTestStore(t)
+
+	old := time.Now().Add(-banHistoryRetention - time.Hour).UTC()
+	putHistory(t, s, "192.0.2.1", BanHistory{Count: 5, FirstBanned: old, LastBanned: old})
+	putHistory(t, s, "192.0.2.2", BanHistory{Count: 5, FirstBanned: old, LastBanned: old})
+	putHistory(t, s, "192.0.2.3", BanHistory{Count: maxBanHistoryCount, FirstBanned: old, LastBanned: time.Now().UTC()})
+
+	// A ban after the retention window starts a new count.
+	if err := s.BanRecord("192.0.2.1", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.1"); h == nil || h.Count != 1 || h.FirstBanned.Equal(old) {
+		t.Errorf("aged history after re-ban = %+v, want a fresh count of 1", h)
+	}
+
+	// The counter does not grow past the cap.
+	if err := s.BanRecord("192.0.2.3", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.3"); h == nil || h.Count != maxBanHistoryCount {
+		t.Errorf("capped history = %+v, want Count %d", h, maxBanHistoryCount)
+	}
+
+	// The janitor drops aged entries and keeps recent ones.
+	if _, err := s.PruneExpiredBans(testPruneBatch); err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.2"); h != nil {
+		t.Errorf("aged history survived prune: %+v", h)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3"} {
+		if h, _ := s.GetBanHistory(ip); h == nil {
+			t.Errorf("recent history for %s was pruned", ip)
+		}
+	}
+}
+
+func TestBanHistory_ReadOnlyLegacyDatabase(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBboltStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a database written before the history bucket existed.
+	if err := s.(*bboltStore).db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket([]byte(bucketHistory))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	ro, err := NewBboltStoreReadOnly(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if h, err := ro.GetBanHistory("192.0.2.1"); err != nil || h != nil {
+		t.Errorf("GetBanHistory on legacy db: h=%+v, err=%v", h, err)
+	}
+}
+
+func TestNewBboltStore_SchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBboltStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stamped string
+	_ = s.(*bboltStore).db.View(func(tx *bolt.Tx) error {
+		stamped = string(tx.Bucket([]byte(bucketMeta)).Get([]byte(metaKeySchemaVersion)))
+		return nil
+	})
+	if stamped != fmt.Sprint(SchemaVersion) {
+		t.Errorf("stamped schema version = %q, want %d", stamped, SchemaVersion)
+	}
+
+	// Simulate a database last written by a newer release.
+	if err := s.(*bboltStore).db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketMeta)).Put([]byte(metaKeySchemaVersion), []byte(fmt.Sprint(SchemaVersion+1)))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, err = NewBboltStore(dir, zerolog.Nop())
+	var tooNew *ErrSchemaTooNew
+	if !errors.As(err, &tooNew) {
+		t.Fatalf("NewBboltStore err = %v, want *ErrSchemaTooNew", err)
+	}
+	if tooNew.Stored != SchemaVersion+1 || tooNew.Supported != SchemaVersion {
+		t.Errorf("ErrSchemaTooNew = %+v", tooNew)
+	}
+
+	// The newer stamp is left intact and the database stays readable.
+	ro, err := NewBboltStoreReadOnly(dir)
+	if err != nil {
+		t.Fatalf("NewBboltStoreReadOnly: %v", err)
+	}
+	defer ro.Close()
+	if _, err := ro.BanList(); err != nil {
+		t.Errorf("BanList on read-only store: %v", err)
+	}
+}
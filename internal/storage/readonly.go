@@ -0,0 +1,19 @@
+package storage
+
+import "time"
+
+// readOnlyStore wraps a Store and rejects every mutation with ErrReadOnly.
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) BanRecord(string, time.Time, bool) error { return ErrReadOnly }
+func (readOnlyStore) BanRecordOrigin(string, time.Time, bool, string) error {
+	return ErrReadOnly
+}
+func (readOnlyStore) BanDelete(string) error               { return ErrReadOnly }
+func (readOnlyStore) PruneExpiredBans(int) (int, error)    { return 0, ErrReadOnly }
+func (readOnlyStore) SetGroup(string, GroupRecord) error   { return ErrReadOnly }
+func (readOnlyStore) DeleteGroup(string) error             { return ErrReadOnly }
+func (readOnlyStore) SetPolicy(string, PolicyRecord) error { return ErrReadOnly }
+func (readOnlyStore) DeletePolicy(string) error            { return ErrReadOnly }
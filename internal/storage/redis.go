@@ -0,0 +1,429 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// redisKeyPrefix namespaces every key written by the bouncer so a shared Redis
+// instance can host other data alongside it.
+const redisKeyPrefix = "cs-unifi-bouncer:"
+
+const (
+	redisKeyBans      = redisKeyPrefix + "bans"        // hash: ip → msgpack BanEntry
+	redisKeyBanExpiry = redisKeyPrefix + "bans:expiry" // zset: ip scored by ExpiresAt (unix seconds)
+	redisKeyGroups    = redisKeyPrefix + "groups"      // hash: name → msgpack GroupRecord
+	redisKeyPolicies  = redisKeyPrefix + "policies"    // hash: name → msgpack PolicyRecord
+	redisKeySchema    = redisKeyPrefix + "schema"      // string: SchemaVersion of the last writer
+	redisOpTimeout    = 5 * time.Second
+)
+
+const (
+	redisKeyHistoryCount = redisKeyPrefix + "history:count" // hash: ip → ban count
+	redisKeyHistoryFirst = redisKeyPrefix + "history:first" // hash: ip → first ban (unix seconds)
+	redisKeyHistoryLast  = redisKeyPrefix + "history:last"  // zset: ip scored by last ban (unix seconds)
+)
+
+// pruneScript atomically removes up to ARGV[2] members whose score in the
+// index sorted set (the last key) is below ARGV[1], deleting them from every
+// other hash key as well. Because the script runs atomically, a concurrent
+// BanRecord that refreshes an IP's score either lands first (the new score is
+// out of range and the IP is kept) or after the IP has been pruned — never in
+// between.
+var pruneScript = redis.NewScript(`
+local index = KEYS[#KEYS]
+local ips = redis.call('ZRANGEBYSCORE', index, '-inf', ARGV[1], 'LIMIT', 0, tonumber(ARGV[2]))
+for _, ip in ipairs(ips) do
+	for i = 1, #KEYS - 1 do
+		redis.call('HDEL', KEYS[i], ip)
+	end
+	redis.call('ZREM', index, ip)
+end
+return #ips
+`)
+
+// historyScript increments the ban history of ARGV[1] at time ARGV[2],
+// restarting it when the last ban is older than ARGV[3] and capping the
+// count at ARGV[4]. KEYS are the count hash, first-ban hash and last-ban zset.
+var historyScript = redis.NewScript(`
+local last = redis.call('ZSCORE', KEYS[3], ARGV[1])
+if last and tonumber(last) < tonumber(ARGV[3]) then
+	redis.call('HDEL', KEYS[1], ARGV[1])
+	redis.call('HDEL', KEYS[2], ARGV[1])
+end
+if redis.call('HINCRBY', KEYS[1], ARGV[1], 1) > tonumber(ARGV[4]) then
+	redis.call('HSET', KEYS[1], ARGV[1], ARGV[4])
+end
+redis.call('HSETNX', KEYS[2], ARGV[1], ARGV[2])
+redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+return 1
+`)
+
+// schemaScript sets KEYS[1] to ARGV[1] unless it already holds a higher
+// version, and returns the version stored before the call (0 if unset). The
+// compare and set are atomic so an older replica cannot overwrite the stamp
+// of a newer one that starts concurrently.
+var schemaScript = redis.NewScript(`
+local stored = tonumber(redis.call('GET', KEYS[1]) or '0')
+if stored < tonumber(ARGV[1]) then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return stored
+`)
+
+type redisStore struct {
+	client *redis.Client
+	log    zerolog.Logger
+}
+
+// NewRedisStore connects to the Redis server at url (redis:// or rediss://)
+// and verifies connectivity with a PING. Multiple bouncer replicas may share
+// the same Redis instance. Like NewBboltStore it stamps SchemaVersion and
+// fails with *ErrSchemaTooNew if a newer binary has already stamped it.
+func NewRedisStore(url string, log zerolog.Logger) (Store, error) {
+	s, err := dialRedis(url, log)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	stored, err := schemaScript.Run(ctx, s.client, []string{redisKeySchema}, SchemaVersion).Int()
+	if err != nil {
+		_ = s.client.Close()
+		return nil, fmt.Errorf("stamp schema version: %w", err)
+	}
+	if stored > SchemaVersion {
+		_ = s.client.Close()
+		return nil, &ErrSchemaTooNew{Stored: stored, Supported: SchemaVersion}
+	}
+	return s, nil
+}
+
+// NewRedisStoreReadOnly connects like NewRedisStore but neither checks nor
+// stamps the schema version, and rejects every write with ErrReadOnly.
+func NewRedisStoreReadOnly(url string, log zerolog.Logger) (Store, error) {
+	s, err := dialRedis(url, log)
+	if err != nil {
+		return nil, err
+	}
+	return readOnlyStore{Store: s}, nil
+}
+
+func dialRedis(url string, log zerolog.Logger) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("parse REDIS_URL: %w", err)
+	}
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("connect to redis at %s: %w", opts.Addr, err)
+	}
+	return &redisStore{client: client, log: log}, nil
+}
+
+func (s *redisStore) ctx() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), redisOpTimeout)
+}
+
+// ---- Ban operations --------------------------------------------------------
+
+func (s *redisStore) BanExists(ip string) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return s.client.HExists(ctx, redisKeyBans, ip).Result()
+}
+
+func (s *redisStore) BanGet(ip string) (*BanEntry, error) {
+	var entry BanEntry
+	found, err := s.hget(redisKeyBans, ip, &entry)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *redisStore) BanRecord(ip string, expiresAt time.Time, ipv6 bool) error {
+	return s.BanRecordOrigin(ip, expiresAt, ipv6, "")
+}
+
+func (s *redisStore) BanRecordOrigin(ip string, expiresAt time.Time, ipv6 bool, origin string) error {
+	now := time.Now().UTC()
+	entry := BanEntry{
+		RecordedAt: now,
+		ExpiresAt:  expiresAt.UTC(),
+		IPv6:       ipv6,
+		Origin:     origin,
+	}
+	data, err := msgpack.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("marshal BanEntry: %w", err)
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, redisKeyBans, ip, data)
+		if expiresAt.IsZero() {
+			pipe.ZRem(ctx, redisKeyBanExpiry, ip)
+		} else {
+			pipe.ZAdd(ctx, redisKeyBanExpiry, redis.Z{Score: float64(expiresAt.Unix()), Member: ip})
+		}
+		// Eval rather than Run: the EVALSHA fallback cannot work inside MULTI.
+		historyScript.Eval(ctx, pipe,
+			[]string{redisKeyHistoryCount, redisKeyHistoryFirst, redisKeyHistoryLast},
+			ip, now.Unix(), now.Add(-banHistoryRetention).Unix(), maxBanHistoryCount)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) GetBanHistory(ip string) (*BanHistory, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var count, first *redis.StringCmd
+	var last *redis.FloatCmd
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		count = pipe.HGet(ctx, redisKeyHistoryCount, ip)
+		first = pipe.HGet(ctx, redisKeyHistoryFirst, ip)
+		last = pipe.ZScore(ctx, redisKeyHistoryLast, ip)
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n, err := count.Int()
+	if err != nil {
+		return nil, fmt.Errorf("parse history count for %s: %w", ip, err)
+	}
+	firstUnix, err := first.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("parse history first ban for %s: %w", ip, err)
+	}
+	return &BanHistory{
+		Count:       n,
+		FirstBanned: time.Unix(firstUnix, 0).UTC(),
+		LastBanned:  time.Unix(int64(last.Val()), 0).UTC(),
+	}, nil
+}
+
+func (s *redisStore) BanDelete(ip string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, redisKeyBans, ip)
+		pipe.ZRem(ctx, redisKeyBanExpiry, ip)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) BanList() (map[string]BanEntry, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	raw, err := s.client.HGetAll(ctx, redisKeyBans).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]BanEntry, len(raw))
+	for ip, v := range raw {
+		var entry BanEntry
+		if err := msgpack.Unmarshal([]byte(v), &entry); err != nil {
+			return nil, fmt.Errorf("unmarshal BanEntry for %s: %w", ip, err)
+		}
+		result[ip] = entry
+	}
+	return result, nil
+}
+
+// ---- Janitor ---------------------------------------------------------------
+
+// PruneExpiredBans removes expired bans in batches of batchSize using the
+// expiry sorted set, so the cost is proportional to the number of expired
+// entries rather than the total ban count.
+func (s *redisStore) PruneExpiredBans(batchSize int) (int, error) {
+	now := time.Now().Unix()
+	batch := max(batchSize, 1)
+	var pruned int
+	for {
+		ctx, cancel := s.ctx()
+		n, err := pruneScript.Run(ctx, s.client,
+			[]string{redisKeyBans, redisKeyBanExpiry},
+			// Scores are whole seconds; "(" makes the bound exclusive so a ban
+			// expiring this second is kept until the next prune, matching the
+			// strict Before(now) check of the bbolt store.
+			fmt.Sprintf("(%d", now), batch).Int()
+		cancel()
+		if err != nil {
+			return pruned, err
+		}
+		pruned += n
+		if n < batch {
+			return pruned, s.pruneBanHistory(now, batch)
+		}
+	}
+}
+
+// pruneBanHistory deletes history entries whose last ban is older than
+// banHistoryRetention, in batches of batch.
+func (s *redisStore) pruneBanHistory(now int64, batch int) error {
+	cutoff := now - int64(banHistoryRetention/time.Second)
+	for {
+		ctx, cancel := s.ctx()
+		n, err := pruneScript.Run(ctx, s.client,
+			[]string{redisKeyHistoryCount, redisKeyHistoryFirst, redisKeyHistoryLast},
+			fmt.Sprintf("(%d", cutoff), batch).Int()
+		cancel()
+		if err != nil || n < batch {
+			return err
+		}
+	}
+}
+
+// ---- Group cache -----------------------------------------------------------
+
+func (s *redisStore) GetGroup(name string) (*GroupRecord, error) {
+	var rec GroupRecord
+	found, err := s.hget(redisKeyGroups, name, &rec)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *redisStore) SetGroup(name string, rec GroupRecord) error {
+	return s.hset(redisKeyGroups, name, rec)
+}
+
+func (s *redisStore) DeleteGroup(name string) error {
+	return s.hdel(redisKeyGroups, name)
+}
+
+func (s *redisStore) ListGroups() (map[string]GroupRecord, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	raw, err := s.client.HGetAll(ctx, redisKeyGroups).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]GroupRecord, len(raw))
+	for k, v := range raw {
+		var rec GroupRecord
+		if err := msgpack.Unmarshal([]byte(v), &rec); err != nil {
+			return nil, err
+		}
+		result[k] = rec
+	}
+	return result, nil
+}
+
+// ---- Policy cache ----------------------------------------------------------
+
+func (s *redisStore) GetPolicy(name string) (*PolicyRecord, error) {
+	var rec PolicyRecord
+	found, err := s.hget(redisKeyPolicies, name, &rec)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *redisStore) SetPolicy(name string, rec PolicyRecord) error {
+	return s.hset(redisKeyPolicies, name, rec)
+}
+
+func (s *redisStore) DeletePolicy(name string) error {
+	return s.hdel(redisKeyPolicies, name)
+}
+
+func (s *redisStore) ListPolicies() (map[string]PolicyRecord, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	raw, err := s.client.HGetAll(ctx, redisKeyPolicies).Result()
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]PolicyRecord, len(raw))
+	for k, v := range raw {
+		var rec PolicyRecord
+		if err := msgpack.Unmarshal([]byte(v), &rec); err != nil {
+			return nil, err
+		}
+		result[k] = rec
+	}
+	return result, nil
+}
+
+// ---- Utility ---------------------------------------------------------------
+
+// SizeBytes reports the approximate memory used by the bouncer's keys, as
+// returned by MEMORY USAGE. Keys that do not exist yet count as zero.
+func (s *redisStore) SizeBytes() (int64, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	var total int64
+	for _, key := range []string{redisKeyBans, redisKeyBanExpiry, redisKeyGroups, redisKeyPolicies,
+		redisKeyHistoryCount, redisKeyHistoryFirst, redisKeyHistoryLast} {
+		n, err := s.client.MemoryUsage(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Backup is not supported: use the Redis server's own RDB or AOF persistence.
+func (s *redisStore) Backup(io.Writer) error {
+	return ErrBackupUnsupported
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+// ---- helpers ---------------------------------------------------------------
+
+func (s *redisStore) hget(key, field string, out interface{}) (bool, error) {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	v, err := s.client.HGet(ctx, key, field).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, msgpack.Unmarshal(v, out)
+}
+
+func (s *redisStore) hset(key, field string, rec interface{}) error {
+	data, err := msgpack.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return s.client.HSet(ctx, key, field, data).Err()
+}
+
+func (s *redisStore) hdel(key, field string) error {
+	ctx, cancel := s.ctx()
+	defer cancel()
+	return s.client.HDel(ctx, key, field).Err()
+}
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog"
+)
+
+func newTestRedisStore(t *testing.T) Store {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	s, err := NewRedisStore("redis://"+mr.Addr(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewRedisStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRedisStore_BanRecordExistsDelete(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	const ip = "1.2.3.4"
+	if exists, err := s.BanExists(ip); err != nil || exists {
+		t.Fatalf("BanExists before record: err=%v, exists=%v", err, exists)
+	}
+	if err := s.BanRecord(ip, time.Now().Add(24*time.Hour), true); err != nil {
+		t.Fatalf("BanRecord: %v", err)
+	}
+	if exists, err := s.BanExists(ip); err != nil || !exists {
+		t.Fatalf("BanExists after record: err=%v, exists=%v", err, exists)
+	}
+
+	list, err := s.BanList()
+	if err != nil {
+		t.Fatalf("BanList: %v", err)
+	}
+	entry, ok := list[ip]
+	if !ok {
+		t.Fatal("BanList missing ip")
+	}
+	if !entry.IPv6 || entry.ExpiresAt.IsZero() {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if got, err := s.BanGet(ip); err != nil || got == nil || !got.ExpiresAt.Equal(entry.ExpiresAt) {
+		t.Errorf("BanGet = %+v, %v; want %+v", got, err, entry)
+	}
+
+	if err := s.BanDelete(ip); err != nil {
+		t.Fatalf("BanDelete: %v", err)
+	}
+	if exists, _ := s.BanExists(ip); exists {
+		t.Fatal("BanExists after delete should be false")
+	}
+}
+
+func TestRedisStore_PruneExpiredBans(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	n := testPruneBatch + 3
+	past := time.Now().Add(-time.Hour)
+	for i := 0; i < n; i++ {
+		if err := s.BanRecord(fmt.Sprintf("198.51.%d.%d", i/256, i%256), past, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BanRecord("9.9.9.9", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.BanRecord("10.0.0.1", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := s.PruneExpiredBans(testPruneBatch)
+	if err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if pruned != n {
+		t.Fatalf("expected %d pruned, got %d", n, pruned)
+	}
+	list, _ := s.BanList()
+	if len(list) != 2 {
+		t.Fatalf("expected fresh and never-expiring bans to remain, got %d entries", len(list))
+	}
+}
+
+func TestRedisStore_RerecordClearsExpiry(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	if err := s.BanRecord("5.6.7.8", time.Now().Add(-time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	// Re-recording as permanent must drop the IP from the expiry index.
+	if err := s.BanRecord("5.6.7.8", time.Time{}, false); err != nil {
+		t.Fatal(err)
+	}
+	pruned, err := s.PruneExpiredBans(testPruneBatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 0 {
+		t.Fatalf("expected 0 pruned, got %d", pruned)
+	}
+}
+
+func TestRedisStore_GroupAndPolicyCRUD(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	if rec, err := s.GetGroup("missing"); err != nil || rec != nil {
+		t.Fatalf("GetGroup missing: rec=%v err=%v", rec, err)
+	}
+	grp := GroupRecord{UnifiID: "g1", Site: "default", Members: []string{"1.2.3.4"}}
+	if err := s.SetGroup("crowdsec-block-v4-0", grp); err != nil {
+		t.Fatalf("SetGroup: %v", err)
+	}
+	got, err := s.GetGroup("crowdsec-block-v4-0")
+	if err != nil || got == nil || got.UnifiID != "g1" || len(got.Members) != 1 {
+		t.Fatalf("GetGroup: rec=%+v err=%v", got, err)
+	}
+	groups, err := s.ListGroups()
+	if err != nil || len(groups) != 1 {
+		t.Fatalf("ListGroups: %v (%d entries)", err, len(groups))
+	}
+	if err := s.DeleteGroup("crowdsec-block-v4-0"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := s.GetGroup("crowdsec-block-v4-0"); rec != nil {
+		t.Fatal("group should be deleted")
+	}
+
+	pol := PolicyRecord{UnifiID: "p1", Site: "default", Mode: "zone", Priority: 100}
+	if err := s.SetPolicy("policy-a", pol); err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	gotPol, err := s.GetPolicy("policy-a")
+	if err != nil || gotPol == nil || gotPol.Priority != 100 {
+		t.Fatalf("GetPolicy: rec=%+v err=%v", gotPol, err)
+	}
+	policies, err := s.ListPolicies()
+	if err != nil || len(policies) != 1 {
+		t.Fatalf("ListPolicies: %v (%d entries)", err, len(policies))
+	}
+	if err := s.DeletePolicy("policy-a"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := s.GetPolicy("policy-a"); rec != nil {
+		t.Fatal("policy should be deleted")
+	}
+}
+
+func TestRedisStore_SharedBetweenReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a, err := NewRedisStore("redis://"+mr.Addr(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := NewRedisStore("redis://"+mr.Addr(), zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			store := a
+			if id%2 == 1 {
+				store = b
+			}
+			_ = store.BanRecord(fmt.Sprintf("192.0.2.%d", id), time.Now().Add(time.Hour), false)
+		}(i)
+	}
+	wg.Wait()
+
+	list, err := b.BanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 8 {
+		t.Fatalf("expected 8 bans visible to both replicas, got %d", len(list))
+	}
+}
+
+func TestNewRedisStore_InvalidURL(t *testing.T) {
+	if _, err := NewRedisStore("not-a-url", zerolog.Nop()); err == nil {
+		t.Fatal("expected error for invalid REDIS_URL")
+	}
+}
+
+func TestRedisStore_SizeBytes(t *testing.T) {
+	s := newTestRedisStore(t)
+	if size, err := s.SizeBytes(); err != nil || size != 0 {
+		t.Fatalf("SizeBytes on empty store: size=%d err=%v", size, err)
+	}
+	_ = s.BanRecord("1.2.3.4", time.Now().Add(time.Hour), false)
+	size, err := s.SizeBytes()
+	if err != nil {
+		t.Fatalf("SizeBytes: %v", err)
+	}
+	if size <= 0 {
+		t.Errorf("expected positive size, got %d", size)
+	}
+}
+
+func TestRedisStore_BanHistory(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	const ip = "192.0.2.7"
+	if h, err := s.GetBanHistory(ip); err != nil || h != nil {
+		t.Fatalf("GetBanHistory before any ban: h=%+v, err=%v", h, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.BanRecord(ip, time.Now().Add(time.Hour), false); err != nil {
+			t.Fatalf("BanRecord: %v", err)
+		}
+		if err := s.BanDelete(ip); err != nil {
+			t.Fatalf("BanDelete: %v", err)
+		}
+	}
+	h, err := s.GetBanHistory(ip)
+	if err != nil || h == nil {
+		t.Fatalf("GetBanHistory: h=%v, err=%v", h, err)
+	}
+	if h.Count != 3 || h.FirstBanned.IsZero() || h.LastBanned.Before(h.FirstBanned) {
+		t.Errorf("unexpected history: %+v", h)
+	}
+
+	// Backdate the last ban past the retention window: the next ban restarts
+	// the count, and a prune drops an aged entry entirely.
+	rs := s.(*redisStore)
+	old := float64(time.Now().Add(-banHistoryRetention - time.Hour).Unix())
+	for _, aged := range []string{ip, "192.0.2.8"} {
+		rs.client.HSet(context.Background(), redisKeyHistoryCount, aged, 5)
+		rs.client.HSet(context.Background(), redisKeyHistoryFirst, aged, int64(old))
+		rs.client.ZAdd(context.Background(), redisKeyHistoryLast, redis.Z{Score: old, Member: aged})
+	}
+	if err := s.BanRecord(ip, time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.GetBanHistory(ip); h == nil || h.Count != 1 {
+		t.Errorf("aged history after re-ban = %+v, want Count 1", h)
+	}
+	if _, err := s.PruneExpiredBans(testPruneBatch); err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.8"); h != nil {
+		t.Errorf("aged history survived prune: %+v", h)
+	}
+	if h, _ := s.GetBanHistory(ip); h == nil {
+		t.Error("recent history was pruned")
+	}
+}
+
+func TestRedisStore_SchemaVersion(t *testing.T) {
+	mr := miniredis.RunT(t)
+	url := "redis://" + mr.Addr()
+
+	s, err := NewRedisStore(url, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewRedisStore: %v", err)
+	}
+	s.Close()
+	if got, _ := mr.Get(redisKeySchema); got != fmt.Sprint(SchemaVersion) {
+		t.Errorf("stamped schema version = %q, want %d", got, SchemaVersion)
+	}
+
+	_ = mr.Set(redisKeySchema, fmt.Sprint(SchemaVersion+1))
+	_, err = NewRedisStore(url, zerolog.Nop())
+	var tooNew *ErrSchemaTooNew
+	if !errors.As(err, &tooNew) || tooNew.Stored != SchemaVersion+1 {
+		t.Fatalf("NewRedisStore err = %v, want *ErrSchemaTooNew with Stored=%d", err, SchemaVersion+1)
+	}
+	if got, _ := mr.Get(redisKeySchema); got != fmt.Sprint(SchemaVersion+1) {
+		t.Errorf("newer schema stamp overwritten: got %q", got)
+	}
+
+	ro, err := NewRedisStoreReadOnly(url, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewRedisStoreReadOnly: %v", err)
+	}
+	defer ro.Close()
+	if _, err := ro.BanList(); err != nil {
+		t.Errorf("BanList on read-only store: %v", err)
+	}
+	if err := ro.BanRecord("1.2.3.4", time.Time{}, false); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("BanRecord on read-only store err = %v, want ErrReadOnly", err)
+	}
+}
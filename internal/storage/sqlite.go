@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+// sqliteFileName is the database file created in DATA_DIR.
+const sqliteFileName = "bouncer.sqlite"
+
+// sqliteSchema creates the tables on first open. Timestamps are Unix
+// nanoseconds (0 = zero time) and group members a JSON array, so the file can
+// be queried directly, e.g. datetime(expires_at / 1e9, 'unixepoch') or
+// json_each(members).
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS bans (
+	ip          TEXT PRIMARY KEY,
+	recorded_at INTEGER NOT NULL,
+	expires_at  INTEGER NOT NULL,
+	ipv6        INTEGER NOT NULL,
+	origin      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS bans_expires_at ON bans (expires_at) WHERE expires_at != 0;
+CREATE TABLE IF NOT EXISTS ban_history (
+	ip           TEXT PRIMARY KEY,
+	count        INTEGER NOT NULL,
+	first_banned INTEGER NOT NULL,
+	last_banned  INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS groups (
+	name       TEXT PRIMARY KEY,
+	unifi_id   TEXT NOT NULL,
+	site       TEXT NOT NULL,
+	members    TEXT NOT NULL,
+	ipv6       INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS policies (
+	name       TEXT PRIMARY KEY,
+	unifi_id   TEXT NOT NULL,
+	rule_id    TEXT NOT NULL,
+	site       TEXT NOT NULL,
+	mode       TEXT NOT NULL,
+	priority   INTEGER NOT NULL,
+	updated_at INTEGER NOT NULL
+);
+`
+
+type sqliteStore struct {
+	db   *sql.DB
+	path string
+	log  zerolog.Logger
+
+	// banOrigin is the select expression for BanEntry.Origin: the origin
+	// column, or '' for a database opened read-only that predates it.
+	banOrigin string
+}
+
+// NewSQLiteStore opens (or creates) a SQLite database at dataDir/bouncer.sqlite.
+// The database runs in WAL mode so external tools can read it while the
+// bouncer writes. Like NewBboltStore it stamps SchemaVersion and fails with
+// *ErrSchemaTooNew if a newer binary has already stamped it.
+func NewSQLiteStore(dataDir string, log zerolog.Logger) (Store, error) {
+	if err := os.MkdirAll(dataDir, 0o750); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	path := filepath.Join(dataDir, sqliteFileName)
+	db, err := openSQLite(path, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create sqlite schema: %w", err)
+	}
+	if err := addSQLiteBanOrigin(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := stampSQLiteSchemaVersion(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db, path: path, log: log, banOrigin: "origin"}, nil
+}
+
+// NewSQLiteStoreReadOnly opens an existing SQLite database read-only for the
+// status subcommands. It does not create the file, and the schema version is
+// not checked. Writes fail with ErrReadOnly.
+func NewSQLiteStoreReadOnly(dataDir string) (Store, error) {
+	path := filepath.Join(dataDir, sqliteFileName)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("open sqlite (read-only) at %s: %w", path, err)
+	}
+	db, err := openSQLite(path, true)
+	if err != nil {
+		return nil, err
+	}
+	banOrigin := "origin"
+	if ok, err := sqliteHasColumn(db, "bans", "origin"); err != nil {
+		_ = db.Close()
+		return nil, err
+	} else if !ok {
+		banOrigin = "''"
+	}
+	return readOnlyStore{Store: &sqliteStore{db: db, path: path, log: zerolog.Nop(), banOrigin: banOrigin}}, nil
+}
+
+// openSQLite opens path with a busy timeout so writers from another process
+// wait instead of failing. A single connection serialises this process's
+// writes, matching bbolt's one-writer model.
+func openSQLite(path string, readOnly bool) (*sql.DB, error) {
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	if readOnly {
+		dsn += "&mode=ro"
+	} else {
+		dsn += "&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open sqlite at %s: %w", path, err)
+	}
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("open sqlite at %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// addSQLiteBanOrigin adds the bans.origin column to a database created before
+// it existed. Older binaries ignore the column, so SchemaVersion is unchanged.
+func addSQLiteBanOrigin(db *sql.DB) error {
+	ok, err := sqliteHasColumn(db, "bans", "origin")
+	if err != nil || ok {
+		return err
+	}
+	if _, err := db.Exec(`ALTER TABLE bans ADD COLUMN origin TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("add bans.origin column: %w", err)
+	}
+	return nil
+}
+
+// sqliteHasColumn reports whether table has column.
+func sqliteHasColumn(db *sql.DB, table, column string) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("inspect %s table: %w", table, err)
+	}
+	return n > 0, nil
+}
+
+// stampSQLiteSchemaVersion records SchemaVersion in the meta table, refusing
+// to overwrite a newer version.
+func stampSQLiteSchemaVersion(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var v string
+	err = tx.QueryRow(`SELECT value FROM meta WHERE key = ?`, metaKeySchemaVersion).Scan(&v)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return fmt.Errorf("read schema version: %w", err)
+	default:
+		stored, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("parse schema version %q: %w", v, err)
+		}
+		if stored > SchemaVersion {
+			return &ErrSchemaTooNew{Stored: stored, Supported: SchemaVersion}
+		}
+		if stored == SchemaVersion {
+			return nil
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)
+		ON CONFLICT (key) DO UPDATE SET value = excluded.value`,
+		metaKeySchemaVersion, strconv.Itoa(SchemaVersion)); err != nil {
+		return fmt.Errorf("stamp schema version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// toUnixNano and fromUnixNano map the zero time to 0 and back.
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n).UTC()
+}
+
+// ---- Ban operations --------------------------------------------------------
+
+func (s *sqliteStore) BanExists(ip string) (bool, error) {
+	var one int
+	err := s.db.QueryRow(`SELECT 1 FROM bans WHERE ip = ?`, ip).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *sqliteStore) BanGet(ip string) (*BanEntry, error) {
+	var recorded, expires int64
+	var entry BanEntry
+	err := s.db.QueryRow(`SELECT recorded_at, expires_at, ipv6, `+s.banOrigin+` FROM bans WHERE ip = ?`, ip).
+		Scan(&recorded, &expires, &entry.IPv6, &entry.Origin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry.RecordedAt, entry.ExpiresAt = fromUnixNano(recorded), fromUnixNano(expires)
+	return &entry, nil
+}
+
+func (s *sqliteStore) BanRecord(ip string, expiresAt time.Time, ipv6 bool) error {
+	return s.BanRecordOrigin(ip, expiresAt, ipv6, "")
+}
+
+func (s *sqliteStore) BanRecordOrigin(ip string, expiresAt time.Time, ipv6 bool, origin string) error {
+	now := time.Now().UTC()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err := tx.Exec(`INSERT INTO bans (ip, recorded_at, expires_at, ipv6, origin) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET recorded_at = excluded.recorded_at,
+			expires_at = excluded.expires_at, ipv6 = excluded.ipv6, origin = excluded.origin`,
+		ip, now.UnixNano(), toUnixNano(expiresAt.UTC()), ipv6, origin); err != nil {
+		return err
+	}
+	if err := recordSQLiteBanHistory(tx, ip, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// recordSQLiteBanHistory increments ip's history inside tx.
+func recordSQLiteBanHistory(tx *sql.Tx, ip string, now time.Time) error {
+	var h BanHistory
+	var first, last int64
+	err := tx.QueryRow(`SELECT count, first_banned, last_banned FROM ban_history WHERE ip = ?`, ip).
+		Scan(&h.Count, &first, &last)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("read ban history: %w", err)
+	}
+	h.FirstBanned, h.LastBanned = fromUnixNano(first), fromUnixNano(last)
+	h.record(now)
+	_, err = tx.Exec(`INSERT INTO ban_history (ip, count, first_banned, last_banned) VALUES (?, ?, ?, ?)
+		ON CONFLICT (ip) DO UPDATE SET count = excluded.count,
+			first_banned = excluded.first_banned, last_banned = excluded.last_banned`,
+		ip, h.Count, toUnixNano(h.FirstBanned), toUnixNano(h.LastBanned))
+	return err
+}
+
+func (s *sqliteStore) GetBanHistory(ip string) (*BanHistory, error) {
+	var h BanHistory
+	var first, last int64
+	err := s.db.QueryRow(`SELECT count, first_banned, last_banned FROM ban_history WHERE ip = ?`, ip).
+		Scan(&h.Count, &first, &last)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.FirstBanned, h.LastBanned = fromUnixNano(first), fromUnixNano(last)
+	return &h, nil
+}
+
+func (s *sqliteStore) BanDelete(ip string) error {
+	_, err := s.db.Exec(`DELETE FROM bans WHERE ip = ?`, ip)
+	return err
+}
+
+func (s *sqliteStore) BanList() (map[string]BanEntry, error) {
+	rows, err := s.db.Query(`SELECT ip, recorded_at, expires_at, ipv6, ` + s.banOrigin + ` FROM bans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]BanEntry)
+	for rows.Next() {
+		var ip string
+		var recorded, expires int64
+		var entry BanEntry
+		if err := rows.Scan(&ip, &recorded, &expires, &entry.IPv6, &entry.Origin); err != nil {
+			return nil, fmt.Errorf("scan ban: %w", err)
+		}
+		entry.RecordedAt, entry.ExpiresAt = fromUnixNano(recorded), fromUnixNano(expires)
+		result[ip] = entry
+	}
+	return result, rows.Err()
+}
+
+// ---- Janitor ---------------------------------------------------------------
+
+// PruneExpiredBans deletes expired bans, batchSize rows per statement so
+// the write lock is released between batches. Each DELETE re-evaluates the
+// expiry, so a ban re-recorded with a fresh expiry is never removed.
+func (s *sqliteStore) PruneExpiredBans(batchSize int) (int, error) {
+	now := time.Now().UTC()
+	batch := max(batchSize, 1)
+	pruned, err := s.deleteInBatches(`DELETE FROM bans WHERE rowid IN (
+		SELECT rowid FROM bans WHERE expires_at != 0 AND expires_at < ? LIMIT ?)`, now.UnixNano(), batch)
+	if err != nil {
+		return pruned, err
+	}
+	_, err = s.deleteInBatches(`DELETE FROM ban_history WHERE rowid IN (
+		SELECT rowid FROM ban_history WHERE last_banned < ? LIMIT ?)`, now.Add(-banHistoryRetention).UnixNano(), batch)
+	return pruned, err
+}
+
+// deleteInBatches runs query (which takes a cutoff and a LIMIT) until it
+// deletes fewer than batch rows, returning the total deleted.
+func (s *sqliteStore) deleteInBatches(query string, cutoff int64, batch int) (int, error) {
+	var total int
+	for {
+		res, err := s.db.Exec(query, cutoff, batch)
+		if err != nil {
+			return total, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += int(n)
+		if n < int64(batch) {
+			return total, nil
+		}
+	}
+}
+
+// ---- Group cache -----------------------------------------------------------
+
+func (s *sqliteStore) GetGroup(name string) (*GroupRecord, error) {
+	rec, err := scanGroup(s.db.QueryRow(
+		`SELECT unifi_id, site, members, ipv6, updated_at FROM groups WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *sqliteStore) SetGroup(name string, rec GroupRecord) error {
+	members, err := json.Marshal(rec.Members)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO groups (name, unifi_id, site, members, ipv6, updated_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET unifi_id = excluded.unifi_id, site = excluded.site,
+			members = excluded.members, ipv6 = excluded.ipv6, updated_at = excluded.updated_at`,
+		name, rec.UnifiID, rec.Site, string(members), rec.IPv6, toUnixNano(rec.UpdatedAt))
+	return err
+}
+
+func (s *sqliteStore) DeleteGroup(name string) error {
+	_, err := s.db.Exec(`DELETE FROM groups WHERE name = ?`, name)
+	return err
+}
+
+func (s *sqliteStore) ListGroups() (map[string]GroupRecord, error) {
+	rows, err := s.db.Query(`SELECT name, unifi_id, site, members, ipv6, updated_at FROM groups`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]GroupRecord)
+	for rows.Next() {
+		var name string
+		rec, err := scanGroup(rows, &name)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = rec
+	}
+	return result, rows.Err()
+}
+
+// scanGroup reads a groups row; lead receives any columns selected before
+// unifi_id.
+func scanGroup(row interface{ Scan(...any) error }, lead ...any) (GroupRecord, error) {
+	var rec GroupRecord
+	var members string
+	var updated int64
+	dest := append(lead, &rec.UnifiID, &rec.Site, &members, &rec.IPv6, &updated)
+	if err := row.Scan(dest...); err != nil {
+		return GroupRecord{}, err
+	}
+	if err := json.Unmarshal([]byte(members), &rec.Members); err != nil {
+		return GroupRecord{}, fmt.Errorf("decode group members: %w", err)
+	}
+	rec.UpdatedAt = fromUnixNano(updated)
+	return rec, nil
+}
+
+// ---- Policy cache ----------------------------------------------------------
+
+func (s *sqliteStore) GetPolicy(name string) (*PolicyRecord, error) {
+	rec, err := scanPolicy(s.db.QueryRow(
+		`SELECT unifi_id, rule_id, site, mode, priority, updated_at FROM policies WHERE name = ?`, name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (s *sqliteStore) SetPolicy(name string, rec PolicyRecord) error {
+	_, err := s.db.Exec(`INSERT INTO policies (name, unifi_id, rule_id, site, mode, priority, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET unifi_id = excluded.unifi_id, rule_id = excluded.rule_id,
+			site = excluded.site, mode = excluded.mode, priority = excluded.priority,
+			updated_at = excluded.updated_at`,
+		name, rec.UnifiID, rec.RuleID, rec.Site, rec.Mode, rec.Priority, toUnixNano(rec.UpdatedAt))
+	return err
+}
+
+func (s *sqliteStore) DeletePolicy(name string) error {
+	_, err := s.db.Exec(`DELETE FROM policies WHERE name = ?`, name)
+	return err
+}
+
+func (s *sqliteStore) ListPolicies() (map[string]PolicyRecord, error) {
+	rows, err := s.db.Query(`SELECT name, unifi_id, rule_id, site, mode, priority, updated_at FROM policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string]PolicyRecord)
+	for rows.Next() {
+		var name string
+		rec, err := scanPolicy(rows, &name)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = rec
+	}
+	return result, rows.Err()
+}
+
+// scanPolicy reads a policies row; lead receives any columns selected before
+// unifi_id.
+func scanPolicy(row interface{ Scan(...any) error }, lead ...any) (PolicyRecord, error) {
+	var rec PolicyRecord
+	var updated int64
+	dest := append(lead, &rec.UnifiID, &rec.RuleID, &rec.Site, &rec.Mode, &rec.Priority, &updated)
+	if err := row.Scan(dest...); err != nil {
+		return PolicyRecord{}, err
+	}
+	rec.UpdatedAt = fromUnixNano(updated)
+	return rec, nil
+}
+
+// ---- Utility ---------------------------------------------------------------
+
+// SizeBytes reports the database file plus its write-ahead log.
+func (s *sqliteStore) SizeBytes() (int64, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if wal, err := os.Stat(s.path + "-wal"); err == nil {
+		size += wal.Size()
+	}
+	return size, nil
+}
+
+// Backup writes a VACUUM INTO snapshot to a temporary file and streams it to
+// w. VACUUM INTO reads inside one transaction, so the copy is consistent
+// while the bouncer keeps writing.
+func (s *sqliteStore) Backup(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "bouncer-backup-")
+	if err != nil {
+		return fmt.Errorf("create backup dir: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	snapshot := filepath.Join(dir, sqliteFileName)
+	if _, err := s.db.Exec(`VACUUM INTO ?`, snapshot); err != nil {
+		return fmt.Errorf("snapshot sqlite: %w", err)
+	}
+	f, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
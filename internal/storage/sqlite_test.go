@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func newTestSQLiteStore(t *testing.T) Store {
+	t.Helper()
+	s, err := NewSQLiteStore(t.TempDir(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// TestSQLiteStore_Parity reruns the backend-neutral bbolt tests against the
+// SQLite store.
+func TestSQLiteStore_Parity(t *testing.T) {
+	newTestStore = newTestSQLiteStore
+	defer func() { newTestStore = newTestBboltStore }()
+
+	for _, tc := range []struct {
+		name string
+		fn   func(*testing.T)
+	}{
+		{"BanRecordExistsDelete", TestBanRecordExistsDelete},
+		{"BanEntryExpiresAt", TestBanEntryExpiresAt},
+		{"BanGet", TestBanGet},
+		{"PruneKeepsFreshBans", TestPruneKeepsFreshBans},
+		{"ConcurrentBanAccess", TestConcurrentBanAccess},
+		{"SizeBytes", TestSizeBytes},
+		{"GroupCRUD", TestGroupCRUD},
+		{"PolicyCRUD", TestPolicyCRUD},
+		{"ListGroups", TestListGroups},
+		{"ListPolicies", TestListPolicies},
+		{"PruneExpiredBans_Batched", TestPruneExpiredBans_Batched},
+		{"PruneExpiredBans_ConfiguredBatchSize", TestPruneExpiredBans_ConfiguredBatchSize},
+		{"PruneExpiredBans_StoreResponsive", TestPruneExpiredBans_StoreResponsive},
+		{"BanHistory_IncrementsOnReban", TestBanHistory_IncrementsOnReban},
+	} {
+		t.Run(tc.name, tc.fn)
+	}
+}
+
+// TestSQLiteStore_RoundTrip verifies that every record field survives a
+// write and read, including zero times and empty member lists.
+func TestSQLiteStore_RoundTrip(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	now := time.Now().UTC()
+
+	if err := s.BanRecord("2001:db8::1", time.Time{}, true); err != nil {
+		t.Fatal(err)
+	}
+	list, err := s.BanList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := list["2001:db8::1"]; !e.IPv6 || !e.ExpiresAt.IsZero() || e.RecordedAt.IsZero() {
+		t.Errorf("ban entry = %+v, want IPv6 with no expiry", e)
+	}
+
+	grp := GroupRecord{UnifiID: "g1", Site: "branch", Members: []string{"192.0.2.1", "198.51.100.0/24"}, IPv6: false, UpdatedAt: now}
+	if err := s.SetGroup("crowdsec-block-v4-0", grp); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetGroup("crowdsec-block-v6-0", GroupRecord{UnifiID: "g2", Site: "branch", IPv6: true}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetGroup("crowdsec-block-v4-0")
+	if err != nil || got == nil {
+		t.Fatalf("GetGroup: %+v, %v", got, err)
+	}
+	if got.UnifiID != grp.UnifiID || got.Site != grp.Site || len(got.Members) != 2 ||
+		got.Members[1] != "198.51.100.0/24" || !got.UpdatedAt.Equal(now) {
+		t.Errorf("GetGroup = %+v, want %+v", got, grp)
+	}
+	if v6, _ := s.GetGroup("crowdsec-block-v6-0"); v6 == nil || !v6.IPv6 || len(v6.Members) != 0 || !v6.UpdatedAt.IsZero() {
+		t.Errorf("empty v6 group = %+v", v6)
+	}
+
+	pol := PolicyRecord{UnifiID: "p1", RuleID: "r1", Site: "default", Mode: "geo-zone", Priority: 42, UpdatedAt: now}
+	if err := s.SetPolicy("policy-a", pol); err != nil {
+		t.Fatal(err)
+	}
+	pol.Priority = 43
+	if err := s.SetPolicy("policy-a", pol); err != nil {
+		t.Fatal(err)
+	}
+	if gotPol, _ := s.GetPolicy("policy-a"); gotPol == nil || *gotPol != pol {
+		t.Errorf("GetPolicy = %+v, want %+v", gotPol, pol)
+	}
+}
+
+// TestSQLiteStore_BanHistoryAged verifies that a ban after the retention
+// window restarts the count and that a prune drops aged history.
+func TestSQLiteStore_BanHistoryAged(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	db := s.(*sqliteStore).db
+
+	old := time.Now().Add(-banHistoryRetention - time.Hour).UnixNano()
+	for _, ip := range []string{"192.0.2.7", "192.0.2.8"} {
+		if _, err := db.Exec(`INSERT INTO ban_history (ip, count, first_banned, last_banned) VALUES (?, 5, ?, ?)`,
+			ip, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.BanRecord("192.0.2.7", time.Now().Add(time.Hour), false); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.7"); h == nil || h.Count != 1 {
+		t.Errorf("aged history after re-ban = %+v, want Count 1", h)
+	}
+	if _, err := s.PruneExpiredBans(testPruneBatch); err != nil {
+		t.Fatalf("PruneExpiredBans: %v", err)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.8"); h != nil {
+		t.Errorf("aged history survived prune: %+v", h)
+	}
+	if h, _ := s.GetBanHistory("192.0.2.7"); h == nil {
+		t.Error("recent history was pruned")
+	}
+}
+
+// TestSQLiteStore_ConcurrentHistory verifies that concurrent bans of one IP
+// are all counted: the ban and its history update share a transaction.
+func TestSQLiteStore_ConcurrentHistory(t *testing.T) {
+	s := newTestSQLiteStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.BanRecord("192.0.2.9", time.Now().Add(time.Hour), false); err != nil {
+				t.Errorf("BanRecord: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if h, _ := s.GetBanHistory("192.0.2.9"); h == nil || h.Count != 20 {
+		t.Errorf("history after 20 concurrent bans = %+v, want Count 20", h)
+	}
+}
+
+// TestSQLiteStore_QueryableByExternalTools verifies that a second connection
+// can read the bans table with plain SQL while the store has it open.
+func TestSQLiteStore_QueryableByExternalTools(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSQLiteStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		if err := s.BanRecord(fmt.Sprintf("192.0.2.%d", i), time.Now().Add(time.Hour), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ext, err := sql.Open("sqlite", "file:"+filepath.Join(dir, sqliteFileName)+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ext.Close()
+	var n int
+	if err := ext.QueryRow(`SELECT count(*) FROM bans WHERE expires_at > ?`, time.Now().UnixNano()).Scan(&n); err != nil {
+		t.Fatalf("external query: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("external count = %d, want 3", n)
+	}
+}
+
+func TestNewSQLiteStore_SchemaVersion(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewSQLiteStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	db := s.(*sqliteStore).db
+	var v string
+	if err := db.QueryRow(`SELECT value FROM meta WHERE key = ?`, metaKeySchemaVersion).Scan(&v); err != nil || v != fmt.Sprint(SchemaVersion) {
+		t.Errorf("stamped schema version = %q (%v), want %d", v, err, SchemaVersion)
+	}
+	if _, err := db.Exec(`UPDATE meta SET value = ? WHERE key = ?`, fmt.Sprint(SchemaVersion+1), metaKeySchemaVersion); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	_, err = NewSQLiteStore(dir, zerolog.Nop())
+	var tooNew *ErrSchemaTooNew
+	if !errors.As(err, &tooNew) || tooNew.Stored != SchemaVersion+1 {
+		t.Fatalf("NewSQLiteStore err = %v, want *ErrSchemaTooNew with Stored=%d", err, SchemaVersion+1)
+	}
+
+	ro, err := NewSQLiteStoreReadOnly(dir)
+	if err != nil {
+		t.Fatalf("NewSQLiteStoreReadOnly: %v", err)
+	}
+	defer ro.Close()
+	if _, err := ro.BanList(); err != nil {
+		t.Errorf("BanList on read-only store: %v", err)
+	}
+	if err := ro.BanRecord("1.2.3.4", time.Time{}, false); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("BanRecord on read-only store err = %v, want ErrReadOnly", err)
+	}
+}
+
+// TestSQLiteStore_AddsBanOrigin verifies that a database created before the
+// bans.origin column is readable read-only and gains the column on open.
+func TestSQLiteStore_AddsBanOrigin(t *testing.T) {
+	dir := t.TempDir()
+	db, err := openSQLite(filepath.Join(dir, sqliteFileName), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE bans (ip TEXT PRIMARY KEY, recorded_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL, ipv6 INTEGER NOT NULL);
+		INSERT INTO bans VALUES ('192.0.2.1', 1, 0, 0)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	ro, err := NewSQLiteStoreReadOnly(dir)
+	if err != nil {
+		t.Fatalf("NewSQLiteStoreReadOnly: %v", err)
+	}
+	if list, err := ro.BanList(); err != nil || len(list) != 1 {
+		t.Errorf("read-only BanList = %v, %v; want one ban", list, err)
+	}
+	ro.Close()
+
+	s, err := NewSQLiteStore(dir, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewSQLiteStore: %v", err)
+	}
+	defer s.Close()
+	if err := s.BanRecordOrigin("192.0.2.2", time.Time{}, false, "blocklist-import"); err != nil {
+		t.Fatalf("BanRecordOrigin: %v", err)
+	}
+	if e, _ := s.BanGet("192.0.2.2"); e == nil || e.Origin != "blocklist-import" {
+		t.Errorf("BanGet = %+v, want origin blocklist-import", e)
+	}
+}
+
+func TestNewSQLiteStoreReadOnly_Missing(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewSQLiteStoreReadOnly(dir); err == nil {
+		t.Fatal("expected an error for a missing database")
+	}
+	if _, err := os.Stat(filepath.Join(dir, sqliteFileName)); !os.IsNotExist(err) {
+		t.Errorf("read-only open created the database file: %v", err)
+	}
+}
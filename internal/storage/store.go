@@ -1,14 +1,73 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"time"
 )
 
+// SchemaVersion is the on-disk record layout this binary reads and writes.
+// Bump it whenever a record type changes incompatibly; a store stamped with a
+// higher version was written by a newer release and is refused on open.
+const SchemaVersion = 1
+
+// ErrSchemaTooNew is returned when opening a store stamped with a schema
+// version newer than SchemaVersion, typically after a binary downgrade.
+type ErrSchemaTooNew struct {
+	Stored    int
+	Supported int
+}
+
+func (e *ErrSchemaTooNew) Error() string {
+	return fmt.Sprintf("store schema version %d is newer than this binary supports (%d); upgrade the bouncer or start with STORAGE_SCHEMA_POLICY=read-only",
+		e.Stored, e.Supported)
+}
+
+// ErrReadOnly is returned by the mutating methods of a read-only store.
+var ErrReadOnly = errors.New("store is read-only")
+
+// ErrBackupUnsupported is returned by Backup on backends whose data lives
+// outside DATA_DIR and is backed up by the server itself.
+var ErrBackupUnsupported = errors.New("backup is not supported by this storage backend")
+
 // BanEntry holds metadata about a tracked ban.
 type BanEntry struct {
 	RecordedAt time.Time
 	ExpiresAt  time.Time // zero = never expires
 	IPv6       bool
+	Origin     string // set by BanRecordOrigin; empty for LAPI bans
+}
+
+// BanHistory counts how often an IP has been banned. It survives the ban
+// itself and is dropped banHistoryRetention after the most recent ban.
+type BanHistory struct {
+	Count       int
+	FirstBanned time.Time
+	LastBanned  time.Time
+}
+
+const (
+	// banHistoryRetention is how long an IP's history is kept after its last
+	// ban. A ban after a longer gap starts a fresh count.
+	banHistoryRetention = 90 * 24 * time.Hour
+
+	// maxBanHistoryCount caps the per-IP counter.
+	maxBanHistoryCount = 10000
+)
+
+// record counts a ban at now, restarting the history when it has aged out.
+func (h *BanHistory) record(now time.Time) {
+	if h.Count > 0 && now.Sub(h.LastBanned) > banHistoryRetention {
+		*h = BanHistory{}
+	}
+	if h.Count == 0 {
+		h.FirstBanned = now
+	}
+	if h.Count < maxBanHistoryCount {
+		h.Count++
+	}
+	h.LastBanned = now
 }
 
 // GroupRecord is the write-through cache of a UniFi firewall group shard.
@@ -25,21 +84,33 @@ type PolicyRecord struct {
 	UnifiID   string
 	RuleID    string
 	Site      string
-	Mode      string // "legacy" or "zone"
+	Mode      string // "legacy" or "zone"; "geo-legacy"/"geo-zone" for country blocks
 	Priority  int
 	UpdatedAt time.Time
 }
 
 // Store is the persistence interface for the bouncer.
 type Store interface {
-	// Ban operations
+	// Ban operations. BanRecord also increments the IP's BanHistory.
 	BanExists(ip string) (bool, error)
 	BanRecord(ip string, expiresAt time.Time, ipv6 bool) error
+	// BanRecordOrigin is BanRecord for bans that did not come from LAPI,
+	// tagging the entry with origin (e.g. a blocklist import).
+	BanRecordOrigin(ip string, expiresAt time.Time, ipv6 bool, origin string) error
 	BanDelete(ip string) error
 	BanList() (map[string]BanEntry, error)
 
-	// Janitor helpers
-	PruneExpiredBans() (int, error)
+	// BanGet returns the IP's ban, or nil if it is not banned.
+	BanGet(ip string) (*BanEntry, error)
+
+	// GetBanHistory returns the IP's ban history, or nil if it has none.
+	GetBanHistory(ip string) (*BanHistory, error)
+
+	// Janitor helpers. PruneExpiredBans deletes at most batchSize entries per
+	// write (JANITOR_BATCH_SIZE) so the write lock is released between batches;
+	// a batchSize below 1 is treated as 1. It also drops aged-out ban history;
+	// the returned count covers bans only.
+	PruneExpiredBans(batchSize int) (int, error)
 
 	// Group cache
 	GetGroup(name string) (*GroupRecord, error)
@@ -56,4 +127,8 @@ type Store interface {
 	// Utility
 	SizeBytes() (int64, error)
 	Close() error
+
+	// Backup writes a consistent copy of the database to w, taken inside a
+	// single read transaction so concurrent writes are not torn.
+	Backup(w io.Writer) error
 }
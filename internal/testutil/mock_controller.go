@@ -174,6 +174,24 @@ func (m *MockController) UpdateFirewallGroup(ctx context.Context, site string, g
 	return nil
 }
 
+func (m *MockController) BulkUpdateFirewallGroups(ctx context.Context, site string, groups []controller.FirewallGroup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls["BulkUpdateFirewallGroups"]++
+	if err := m.popError("BulkUpdateFirewallGroups"); err != nil {
+		return err
+	}
+	for _, g := range groups {
+		for i, existing := range m.groups[site] {
+			if existing.ID == g.ID {
+				m.groups[site][i] = g
+				break
+			}
+		}
+	}
+	return nil
+}
+
 func (m *MockController) DeleteFirewallGroup(ctx context.Context, site string, id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -201,6 +219,18 @@ func (m *MockController) ListFirewallRules(ctx context.Context, site string) ([]
 	return append([]controller.FirewallRule{}, m.rules[site]...), nil
 }
 
+// ListRulesets derives the ruleset names from the preset/created rules, like
+// the real client does.
+func (m *MockController) ListRulesets(ctx context.Context, site string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls["ListRulesets"]++
+	if err := m.popError("ListRulesets"); err != nil {
+		return nil, err
+	}
+	return controller.DistinctRulesets(m.rules[site]), nil
+}
+
 func (m *MockController) CreateFirewallRule(ctx context.Context, site string, r controller.FirewallRule) (controller.FirewallRule, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -1,6 +1,8 @@
 package testutil
 
 import (
+	"encoding/json"
+	"io"
 	"sync"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 type MockStore struct {
 	mu       sync.Mutex
 	bans     map[string]storage.BanEntry
+	history  map[string]storage.BanHistory
 	groups   map[string]storage.GroupRecord
 	policies map[string]storage.PolicyRecord
 
@@ -26,6 +29,7 @@ type MockStore struct {
 func NewMockStore() *MockStore {
 	return &MockStore{
 		bans:     make(map[string]storage.BanEntry),
+		history:  make(map[string]storage.BanHistory),
 		groups:   make(map[string]storage.GroupRecord),
 		policies: make(map[string]storage.PolicyRecord),
 		errors:   make(map[string]error),
@@ -58,20 +62,60 @@ func (m *MockStore) BanExists(ip string) (bool, error) {
 	return ok, nil
 }
 
+func (m *MockStore) BanGet(ip string) (*storage.BanEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.popError("BanGet"); err != nil {
+		return nil, err
+	}
+	entry, ok := m.bans[ip]
+	if !ok {
+		return nil, nil
+	}
+	return &entry, nil
+}
+
 func (m *MockStore) BanRecord(ip string, expiresAt time.Time, ipv6 bool) error {
+	return m.BanRecordOrigin(ip, expiresAt, ipv6, "")
+}
+
+func (m *MockStore) BanRecordOrigin(ip string, expiresAt time.Time, ipv6 bool, origin string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if err := m.popError("BanRecord"); err != nil {
 		return err
 	}
+	now := time.Now().UTC()
 	m.bans[ip] = storage.BanEntry{
-		RecordedAt: time.Now().UTC(),
+		RecordedAt: now,
 		ExpiresAt:  expiresAt.UTC(),
 		IPv6:       ipv6,
+		Origin:     origin,
+	}
+	// History is counted without the real stores' aging and cap.
+	h := m.history[ip]
+	if h.Count == 0 {
+		h.FirstBanned = now
 	}
+	h.Count++
+	h.LastBanned = now
+	m.history[ip] = h
 	return nil
 }
 
+func (m *MockStore) GetBanHistory(ip string) (*storage.BanHistory, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.popError("GetBanHistory"); err != nil {
+		return nil, err
+	}
+	h, ok := m.history[ip]
+	if !ok {
+		return nil, nil
+	}
+	return &h, nil
+}
+
 func (m *MockStore) BanDelete(ip string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -97,7 +141,7 @@ func (m *MockStore) BanList() (map[string]storage.BanEntry, error) {
 
 // --- Janitor helpers --------------------------------------------------------
 
-func (m *MockStore) PruneExpiredBans() (int, error) {
+func (m *MockStore) PruneExpiredBans(int) (int, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if err := m.popError("PruneExpiredBans"); err != nil {
@@ -223,6 +267,18 @@ func (m *MockStore) SizeBytes() (int64, error) {
 	return m.Size, nil
 }
 
+// Backup writes the mock's bans, groups and policies as JSON.
+func (m *MockStore) Backup(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.popError("Backup"); err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(map[string]any{
+		"bans": m.bans, "groups": m.groups, "policies": m.policies,
+	})
+}
+
 func (m *MockStore) Close() error {
 	return nil
 }
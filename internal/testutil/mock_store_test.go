@@ -96,7 +96,7 @@ func TestMockStore_PruneExpiredBans(t *testing.T) {
 		_ = s.BanRecord("live", future, false)
 		_ = s.BanRecord("permanent", time.Time{}, false) // zero = never expires
 
-		pruned, err := s.PruneExpiredBans()
+		pruned, err := s.PruneExpiredBans(100)
 		if err != nil {
 			t.Fatalf("PruneExpiredBans: %v", err)
 		}
@@ -117,7 +117,7 @@ func TestMockStore_PruneExpiredBans(t *testing.T) {
 
 	t.Run("empty store returns zero", func(t *testing.T) {
 		s := testutil.NewMockStore()
-		pruned, err := s.PruneExpiredBans()
+		pruned, err := s.PruneExpiredBans(100)
 		if err != nil || pruned != 0 {
 			t.Fatalf("expected 0, nil; got %d, %v", pruned, err)
 		}
@@ -295,7 +295,7 @@ func TestMockStore_ErrorInjection(t *testing.T) {
 		},
 		{
 			"PruneExpiredBans",
-			func(s *testutil.MockStore) error { _, err := s.PruneExpiredBans(); return err },
+			func(s *testutil.MockStore) error { _, err := s.PruneExpiredBans(100); return err },
 		},
 		{
 			"GetGroup",
@@ -0,0 +1,88 @@
+// Package tracing wires optional OpenTelemetry tracing into the bouncer.
+//
+// Spans are always created through the global tracer provider. Until Setup
+// installs an SDK provider (OTEL_ENABLED=true) that provider is the otel
+// no-op, so instrumented code pays almost nothing when tracing is disabled.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the bouncer's spans to the backend.
+const instrumentationName = "github.com/developingchet/cs-unifi-bouncer-pro"
+
+// serviceName is the default service.name resource attribute; OTEL_SERVICE_NAME
+// and OTEL_RESOURCE_ATTRIBUTES override it.
+const serviceName = "cs-unifi-bouncer-pro"
+
+// Setup installs a global tracer provider that exports spans over OTLP/HTTP.
+// The exporter is configured by the standard OTEL_EXPORTER_OTLP_* variables
+// (endpoint, headers, TLS). The returned func flushes pending spans and shuts
+// the provider down; it must be called before exit. When enabled is false
+// Setup does nothing and the returned func is a no-op.
+func Setup(ctx context.Context, enabled bool, version string) (func(context.Context) error, error) {
+	if !enabled {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("create OTLP exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", serviceName),
+			attribute.String("service.version", version),
+		),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build trace resource: %w", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+	return tp.Shutdown, nil
+}
+
+// Start starts a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on span, if any, and ends it. It is meant to be deferred
+// with a pointer to a named error result.
+func End(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// Site is the span attribute for a UniFi site name.
+func Site(site string) attribute.KeyValue { return attribute.String("unifi.site", site) }
+
+// Family is the span attribute for an address family ("v4" or "v6").
+func Family(family string) attribute.KeyValue { return attribute.String("bouncer.family", family) }
+
+// Shard is the span attribute for a firewall group or traffic matching list name.
+func Shard(name string) attribute.KeyValue { return attribute.String("bouncer.shard", name) }
@@ -0,0 +1,73 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// TestSetup_Disabled verifies that a disabled Setup leaves the global no-op
+// provider in place.
+func TestSetup_Disabled(t *testing.T) {
+	before := otel.GetTracerProvider()
+	shutdown, err := Setup(context.Background(), false, "test")
+	if err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if otel.GetTracerProvider() != before {
+		t.Error("disabled Setup replaced the global tracer provider")
+	}
+	_, span := Start(context.Background(), "noop")
+	if span.IsRecording() {
+		t.Error("span is recording with tracing disabled")
+	}
+	span.End()
+}
+
+// TestStartEnd verifies that spans carry their attributes, nest through the
+// context and record errors passed to End.
+func TestStartEnd(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(tp)
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	ctx, parent := Start(context.Background(), "parent", Site("default"))
+	func() (err error) {
+		_, child := Start(ctx, "child", Family("v4"), Shard("crowdsec-block-v4-0"))
+		defer End(child, &err)
+		return errors.New("boom")
+	}()
+	End(parent, nil)
+
+	spans := rec.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended spans = %d, want 2", len(spans))
+	}
+	child, p := spans[0], spans[1]
+	if child.Parent().SpanID() != p.SpanContext().SpanID() {
+		t.Error("child span is not parented to the outer span")
+	}
+	if child.Status().Code != codes.Error || child.Status().Description != "boom" {
+		t.Errorf("child status = %+v, want error boom", child.Status())
+	}
+	if p.Status().Code == codes.Error {
+		t.Error("parent span marked as failed without an error")
+	}
+	attrs := map[string]string{}
+	for _, kv := range child.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.AsString()
+	}
+	if attrs["bouncer.family"] != "v4" || attrs["bouncer.shard"] != "crowdsec-block-v4-0" {
+		t.Errorf("child attributes = %v", attrs)
+	}
+}
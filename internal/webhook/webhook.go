@@ -0,0 +1,118 @@
+// Package webhook delivers ban/unban events to an operator-supplied HTTP
+// endpoint (WEBHOOK_URL), e.g. to feed bouncer actions into a SIEM.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	"github.com/rs/zerolog"
+)
+
+// SignatureHeader carries "sha256=<hex HMAC of the body>" when a secret is set.
+const SignatureHeader = "X-Bouncer-Signature"
+
+// queueSize bounds the events waiting for delivery; when it is full new
+// events are dropped rather than stalling the job handler.
+const queueSize = 1024
+
+// Event is the JSON body POSTed for each ban or unban applied to a site.
+type Event struct {
+	Action string    `json:"action"` // "ban" or "unban"
+	IP     string    `json:"ip"`
+	IPv6   bool      `json:"ipv6"`
+	Site   string    `json:"site"`
+	TS     time.Time `json:"ts"`
+}
+
+// Notifier queues events and POSTs them one at a time from Run. Delivery is
+// best-effort: failures are logged and counted, never retried.
+type Notifier struct {
+	url        string
+	secret     string
+	httpClient *http.Client
+	queue      chan Event
+	log        zerolog.Logger
+}
+
+// NewNotifier constructs a Notifier. timeout bounds each delivery; an empty
+// secret disables the signature header.
+func NewNotifier(url, secret string, timeout time.Duration, log zerolog.Logger) *Notifier {
+	return &Notifier{
+		url:        url,
+		secret:     secret,
+		httpClient: &http.Client{Timeout: timeout},
+		queue:      make(chan Event, queueSize),
+		log:        log,
+	}
+}
+
+// Notify queues ev for delivery without blocking.
+func (n *Notifier) Notify(ev Event) {
+	select {
+	case n.queue <- ev:
+	default:
+		metrics.WebhookDelivery.WithLabelValues("dropped").Inc()
+		n.log.Warn().Str("ip", ev.IP).Str("action", ev.Action).Msg("webhook queue full; event dropped")
+	}
+}
+
+// Run delivers queued events until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-n.queue:
+			if err := n.deliver(ctx, ev); err != nil {
+				metrics.WebhookDelivery.WithLabelValues("failure").Inc()
+				n.log.Warn().Err(err).Str("ip", ev.IP).Str("action", ev.Action).Msg("webhook delivery failed")
+				continue
+			}
+			metrics.WebhookDelivery.WithLabelValues("success").Inc()
+		}
+	}
+}
+
+func (n *Notifier) deliver(ctx context.Context, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("build request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		req.Header.Set(SignatureHeader, Sign(n.secret, body))
+	}
+
+	resp, err := n.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the SignatureHeader value for body: "sha256=" followed by the
+// hex HMAC-SHA256 of body keyed by secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,131 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/developingchet/cs-unifi-bouncer-pro/internal/metrics"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+type received struct {
+	body      []byte
+	signature string
+}
+
+func newReceiver(t *testing.T, status int) (*httptest.Server, chan received) {
+	t.Helper()
+	got := make(chan received, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- received{body: body, signature: r.Header.Get(SignatureHeader)}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func waitReceived(t *testing.T, got chan received) received {
+	t.Helper()
+	select {
+	case r := <-got:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook was not delivered")
+		return received{}
+	}
+}
+
+func TestNotifier_DeliversSignedEvent(t *testing.T) {
+	srv, got := newReceiver(t, http.StatusNoContent)
+	n := NewNotifier(srv.URL, "s3cret", time.Second, zerolog.Nop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	before := promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("success"))
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	n.Notify(Event{Action: "ban", IP: "203.0.113.7", Site: "default", TS: ts})
+	r := waitReceived(t, got)
+
+	var ev Event
+	if err := json.Unmarshal(r.body, &ev); err != nil {
+		t.Fatalf("unmarshal body %s: %v", r.body, err)
+	}
+	if ev.Action != "ban" || ev.IP != "203.0.113.7" || ev.IPv6 || ev.Site != "default" || !ev.TS.Equal(ts) {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if want := Sign("s3cret", r.body); r.signature != want {
+		t.Errorf("signature = %q, want %q", r.signature, want)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("success")) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("success delivery was not counted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestNotifier_NoSignatureWithoutSecret(t *testing.T) {
+	srv, got := newReceiver(t, http.StatusOK)
+	n := NewNotifier(srv.URL, "", time.Second, zerolog.Nop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	n.Notify(Event{Action: "unban", IP: "2001:db8::1", IPv6: true, Site: "default"})
+	if r := waitReceived(t, got); r.signature != "" {
+		t.Errorf("expected no signature header, got %q", r.signature)
+	}
+}
+
+func TestNotifier_FailureCounted(t *testing.T) {
+	srv, got := newReceiver(t, http.StatusInternalServerError)
+	n := NewNotifier(srv.URL, "", time.Second, zerolog.Nop())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go n.Run(ctx)
+
+	before := promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("failure"))
+	n.Notify(Event{Action: "ban", IP: "198.51.100.1", Site: "default"})
+	waitReceived(t, got)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("failure")) != before+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("failed delivery was not counted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestNotifier_DropsWhenQueueFull verifies that Notify never blocks: with no
+// Run loop draining the queue, events beyond its capacity are dropped.
+func TestNotifier_DropsWhenQueueFull(t *testing.T) {
+	n := NewNotifier("http://127.0.0.1:1", "", time.Second, zerolog.Nop())
+	before := promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("dropped"))
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < queueSize+3; i++ {
+			n.Notify(Event{Action: "ban", IP: "192.0.2.1", Site: "default"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Notify blocked on a full queue")
+	}
+	if got := promtestutil.ToFloat64(metrics.WebhookDelivery.WithLabelValues("dropped")) - before; got != 3 {
+		t.Errorf("dropped events: got %v, want 3", got)
+	}
+}